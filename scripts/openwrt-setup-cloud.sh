@@ -428,39 +428,11 @@ echo -e "${GREEN}✓ MQTT bridge installed${NC}"
 STEP_NUM=$((STEP_NUM + 1))
 echo -e "${YELLOW}[${STEP_NUM}/${TOTAL_STEPS}] Creating init scripts...${NC}"
 
-cat > /etc/init.d/spotfi-bridge << 'INITEOF'
-#!/bin/sh /etc/rc.common
-
-START=99
-STOP=10
-
-USE_PROCD=1
-PROG=/usr/bin/spotfi-bridge
-
-start_service() {
-    [ ! -f /etc/spotfi.env ] || [ ! -r /etc/spotfi.env ] || [ ! -x "$PROG" ] && {
-        logger -t spotfi-bridge "Error: Missing configuration or binary"
-        exit 1
-    }
-    
-    # Load environment variables from /etc/spotfi.env
-    # Export them so the bridge can read them via os.Getenv()
-    . /etc/spotfi.env
-    
-    procd_open_instance
-    procd_set_param command $PROG
-    # Export environment variables from spotfi.env
-    procd_set_param env SPOTFI_TOKEN="$SPOTFI_TOKEN"
-    procd_set_param env SPOTFI_MQTT_BROKER="$SPOTFI_MQTT_BROKER"
-    [ -n "$SPOTFI_MAC" ] && procd_set_param env SPOTFI_MAC="$SPOTFI_MAC"
-    procd_set_param respawn 3600 5 5
-    procd_set_param stdout 1
-    procd_set_param stderr 1
-    procd_close_instance
-}
-INITEOF
-
-chmod +x /etc/init.d/spotfi-bridge
+# The bridge writes its own procd init script (respawn and watchdog) and rpcd plugin link
+if ! /usr/bin/spotfi-bridge --install; then
+    echo -e "${RED}Error: Failed to install the init script${NC}"
+    exit 1
+fi
 
 echo -e "${GREEN}✓ Init scripts created${NC}"
 
@@ -10,7 +10,18 @@ if [ "$1" = "--no-upx" ] || [ "$SKIP_UPX_COMPRESSION" = "true" ] || [ "$SKIP_UPX
     SKIP_UPX=true
 fi
 
+# Build information reported by --version, hello and /status. VERSION (e.g. from the
+# release tag) overrides the version in main.go; a leading "v" is dropped
+VERSION="${VERSION:-$(git describe --tags --exact-match 2>/dev/null || true)}"
+VERSION="${VERSION#v}"
+COMMIT="$(git rev-parse HEAD 2>/dev/null || true)"
+BUILD_TIME="$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+LDFLAGS="-s -w -X main.buildTime=${BUILD_TIME}"
+[ -n "$VERSION" ] && LDFLAGS="$LDFLAGS -X main.version=${VERSION}"
+[ -n "$COMMIT" ] && LDFLAGS="$LDFLAGS -X main.commit=${COMMIT}"
+
 echo "Building SpotFi Bridge for all architectures..."
+echo "  version: ${VERSION:-(from main.go)}  commit: ${COMMIT:-unknown}  built: ${BUILD_TIME}"
 echo ""
 
 # Disable CGO for static binaries (required for OpenWRT)
@@ -74,7 +85,7 @@ echo "Building for MIPS (mips_24kc)..."
 export GOOS=linux
 export GOARCH=mips
 export GOMIPS=softfloat
-go build -ldflags="-s -w" -o spotfi-bridge-mips
+go build -ldflags="$LDFLAGS" -o spotfi-bridge-mips
 if [ "$SKIP_UPX" = true ]; then
     echo "✓ Built: spotfi-bridge-mips (compression skipped)"
 elif [ "$HAS_UPX" = true ]; then
@@ -93,7 +104,7 @@ echo "Building for MIPSLE (mipsel_24kc)..."
 export GOOS=linux
 export GOARCH=mipsle
 export GOMIPS=softfloat
-go build -ldflags="-s -w" -o spotfi-bridge-mipsle
+go build -ldflags="$LDFLAGS" -o spotfi-bridge-mipsle
 if [ "$SKIP_UPX" = true ]; then
     echo "✓ Built: spotfi-bridge-mipsle (compression skipped)"
 elif [ "$HAS_UPX" = true ]; then
@@ -112,7 +123,7 @@ echo "Building for ARM64 (aarch64)..."
 export GOOS=linux
 export GOARCH=arm64
 unset GOMIPS
-go build -ldflags="-s -w" -o spotfi-bridge-arm64
+go build -ldflags="$LDFLAGS" -o spotfi-bridge-arm64
 if [ "$SKIP_UPX" = true ]; then
     echo "✓ Built: spotfi-bridge-arm64 (compression skipped)"
 elif [ "$HAS_UPX" = true ]; then
@@ -131,7 +142,7 @@ echo "Building for AMD64 (x86_64)..."
 export GOOS=linux
 export GOARCH=amd64
 unset GOMIPS
-go build -ldflags="-s -w" -o spotfi-bridge-amd64
+go build -ldflags="$LDFLAGS" -o spotfi-bridge-amd64
 if [ "$SKIP_UPX" = true ]; then
     echo "✓ Built: spotfi-bridge-amd64 (compression skipped)"
 elif [ "$HAS_UPX" = true ]; then
@@ -150,7 +161,7 @@ echo "Building for 386 (i386/i686)..."
 export GOOS=linux
 export GOARCH=386
 unset GOMIPS
-go build -ldflags="-s -w" -o spotfi-bridge-386
+go build -ldflags="$LDFLAGS" -o spotfi-bridge-386
 if [ "$SKIP_UPX" = true ]; then
     echo "✓ Built: spotfi-bridge-386 (compression skipped)"
 elif [ "$HAS_UPX" = true ]; then
@@ -170,7 +181,7 @@ export GOOS=linux
 export GOARCH=arm
 export GOARM=7
 unset GOMIPS
-go build -ldflags="-s -w" -o spotfi-bridge-arm
+go build -ldflags="$LDFLAGS" -o spotfi-bridge-arm
 if [ "$SKIP_UPX" = true ]; then
     echo "✓ Built: spotfi-bridge-arm (compression skipped)"
 elif [ "$HAS_UPX" = true ]; then
@@ -189,7 +200,7 @@ echo "Building for MIPS64 (64-bit MIPS big-endian)..."
 export GOOS=linux
 export GOARCH=mips64
 export GOMIPS=softfloat
-go build -ldflags="-s -w" -o spotfi-bridge-mips64
+go build -ldflags="$LDFLAGS" -o spotfi-bridge-mips64
 if [ "$SKIP_UPX" = true ]; then
     echo "✓ Built: spotfi-bridge-mips64 (compression skipped)"
 elif [ "$HAS_UPX" = true ]; then
@@ -208,7 +219,7 @@ echo "Building for MIPS64LE (64-bit MIPS little-endian)..."
 export GOOS=linux
 export GOARCH=mips64le
 export GOMIPS=softfloat
-go build -ldflags="-s -w" -o spotfi-bridge-mips64le
+go build -ldflags="$LDFLAGS" -o spotfi-bridge-mips64le
 if [ "$SKIP_UPX" = true ]; then
     echo "✓ Built: spotfi-bridge-mips64le (compression skipped)"
 elif [ "$HAS_UPX" = true ]; then
@@ -227,7 +238,7 @@ echo "Building for RISC-V 64..."
 export GOOS=linux
 export GOARCH=riscv64
 unset GOMIPS
-go build -ldflags="-s -w" -o spotfi-bridge-riscv64
+go build -ldflags="$LDFLAGS" -o spotfi-bridge-riscv64
 if [ "$SKIP_UPX" = true ]; then
     echo "✓ Built: spotfi-bridge-riscv64 (compression skipped)"
 elif [ "$HAS_UPX" = true ]; then
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/rpc"
+)
+
+const (
+	// defaultOverrideDuration applies when a log-level request has no duration
+	defaultOverrideDuration = 15 * time.Minute
+	// maxOverrideDuration bounds remote log-level changes, so a forgotten debug
+	// session cannot fill the router's log for days
+	maxOverrideDuration = 24 * time.Hour
+)
+
+// controlRequest is a message on the control topic:
+//
+//	{"id": "...", "type": "debug", "duration": "30m"}
+//	{"id": "...", "type": "log-level", "level": "info,rpc=debug", "duration": "1h"}
+//	{"id": "...", "type": "log-level"}  (no level: back to the configured levels)
+type controlRequest struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Level    string `json:"level"`
+	Duration string `json:"duration"`
+}
+
+// handleControl applies a control request and returns the reply for control/response
+func handleControl(payload []byte) map[string]interface{} {
+	var req controlRequest
+	reply := map[string]interface{}{"type": "control-result"}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		reply["error"] = "invalid JSON: " + err.Error()
+		return reply
+	}
+	reply["id"] = req.ID
+	reply["request"] = req.Type
+
+	// Signed like RPC requests when request signing is enabled
+	if err := rpc.VerifyMessage("control", payload); err != nil {
+		reply["error"] = err.Error()
+		return reply
+	}
+	if err := applyControl(req); err != nil {
+		reply["error"] = err.Error()
+	}
+	reply["level"] = logging.Levels()
+	if until := logging.OverrideUntil(); !until.IsZero() {
+		reply["revertAt"] = until.Unix()
+	}
+	return reply
+}
+
+func applyControl(req controlRequest) error {
+	switch req.Type {
+	case "debug":
+		req.Level = "debug"
+	case "log-level":
+	default:
+		return fmt.Errorf("unknown control request %q", req.Type)
+	}
+
+	d := defaultOverrideDuration
+	if req.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(req.Duration); err != nil {
+			return fmt.Errorf("invalid duration %q", req.Duration)
+		}
+	}
+	if d > maxOverrideDuration {
+		return fmt.Errorf("duration %s is longer than %s", d, maxOverrideDuration)
+	}
+
+	until, err := logging.Override(req.Level, d, func() {
+		logger.Info("Log level override expired", "levels", logging.Levels())
+	})
+	if err != nil {
+		return err
+	}
+	if until.IsZero() {
+		logger.Info("Log levels restored by control request", "levels", logging.Levels())
+		return nil
+	}
+	logger.Warn("Log levels changed by control request", "levels", logging.Levels(), "duration", d, "id", req.ID)
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"spotfi-bridge/pkg/downtime"
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/portalauth"
+	"spotfi-bridge/pkg/session"
+	"spotfi-bridge/pkg/update"
+)
+
+const (
+	// statusSocket serves the local status API to the rpcd plugin and scripts;
+	// instances other than the default one listen on statusSocket-<instance>
+	statusSocket = "/var/run/spotfi-bridge.sock"
+
+	// rpcdObject is the ubus object the binary serves when installed as an rpcd plugin
+	rpcdObject = "spotfi.bridge"
+)
+
+// connectedAt is when the broker connection last came up (Unix seconds)
+var connectedAt atomic.Int64
+
+// statusSocketPath is the socket of this instance
+func statusSocketPath() string {
+	if cfg.Instance != "" {
+		return statusSocket + "-" + cfg.Instance
+	}
+	return statusSocket
+}
+
+// startStatusServer serves /healthz, /status, /sessions and /auth on the status socket
+// and, when SPOTFI_HEALTH_LISTEN is set, on that loopback address, until ctx is cancelled
+func startStatusServer(ctx context.Context, broker string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h := bridgeHealth()
+		code := http.StatusOK
+		if !h["healthy"].(bool) {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, h)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, bridgeStatus(broker))
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		list := []session.SessionInfo{}
+		if sm != nil {
+			list = sm.List()
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": list})
+	})
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "use POST"})
+			return
+		}
+		var req portalauth.Request
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid request: " + err.Error()})
+			return
+		}
+		res, err := portalauth.Handle(&req)
+		if err != nil {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"allowed": false, "error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close() // Also removes the socket
+	}()
+
+	path := statusSocketPath()
+	os.Remove(path) // Left behind by a previous run
+	if ln, err := net.Listen("unix", path); err != nil {
+		logger.Error("Local status socket disabled", "error", err)
+	} else {
+		os.Chmod(path, 0600)
+		go srv.Serve(ln)
+	}
+
+	if cfg.HealthListen == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", cfg.HealthListen)
+	if err == nil && !ln.Addr().(*net.TCPAddr).IP.IsLoopback() {
+		ln.Close()
+		err = fmt.Errorf("refusing to listen on %q: use a loopback address", cfg.HealthListen)
+	}
+	if err != nil {
+		logger.Error("Health endpoint disabled", "error", err)
+		return
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error("Health endpoint stopped", "error", err)
+		}
+	}()
+	logger.Info("Health endpoint listening", "addr", ln.Addr().String())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// bridgeHealth is healthy while the broker connection is up
+func bridgeHealth() map[string]interface{} {
+	connected := mqttClient != nil && mqttClient.IsConnected()
+	h := map[string]interface{}{
+		"healthy":   connected,
+		"connected": connected,
+		"uptime":    int64(time.Since(startedAt).Seconds()),
+		"version":   version,
+	}
+	if !connected {
+		h["reason"] = "not connected to the broker"
+	}
+	return h
+}
+
+// bridgeStatus describes the running bridge for local tools
+func bridgeStatus(broker string) map[string]interface{} {
+	connected := mqttClient != nil && mqttClient.IsConnected()
+	conn := map[string]interface{}{
+		"connected": connected,
+		"broker":    broker,
+	}
+	if at := connectedAt.Load(); at > 0 {
+		conn["connectedAt"] = at
+	}
+	if mqttClient != nil {
+		conn["stats"] = mqttClient.Stats()
+	}
+	status := map[string]interface{}{
+		"version":    version,
+		"build":      bridgeBuild(),
+		"channel":    update.Channel(),
+		"routerId":   cfg.RouterID,
+		"routerName": cfg.RouterName,
+		"startedAt":  startedAt.Unix(),
+		"uptime":     int64(time.Since(startedAt).Seconds()),
+		"mqtt":       conn,
+		"sessions":   0,
+		"logLevel":   logging.Levels(),
+	}
+	if sm != nil {
+		status["sessions"] = sm.Count()
+	}
+	if cfg.Instance != "" {
+		status["instance"] = cfg.Instance
+	}
+	if disabled := disabledSubsystems(); len(disabled) > 0 {
+		status["disabled"] = disabled
+	}
+	if res := update.Last(); res != nil {
+		status["update"] = res
+	}
+	if portalauth.Enabled() {
+		status["portalAuth"] = portalauth.GetStats()
+	}
+	status["downtime"] = downtime.Status()
+	return status
+}
+
+// authSignature lists the arguments of the spotfi.bridge auth method for rpcd
+var authSignature = map[string]interface{}{
+	"mac": "str", "ip": "str", "interface": "str", "username": "str", "password": "str", "voucher": "str",
+}
+
+// rpcdPlugin implements the rpcd exec plugin protocol for the spotfi.bridge ubus
+// object: "list" prints the method signatures and "call <method>" the result,
+// fetched from the running bridge over the status socket. auth passes the
+// arguments rpcd writes to stdin on to the portal auth relay
+func rpcdPlugin(args []string) int {
+	methods := map[string]string{"status": "/status", "health": "/healthz", "sessions": "/sessions", "auth": "/auth"}
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s list | call <method>\n", rpcdObject)
+		return 1
+	}
+	switch args[0] {
+	case "list":
+		list := map[string]interface{}{}
+		for name := range methods {
+			list[name] = map[string]interface{}{}
+		}
+		list["auth"] = authSignature
+		json.NewEncoder(os.Stdout).Encode(list)
+		return 0
+	case "call":
+		if len(args) < 2 || methods[args[1]] == "" {
+			return 1
+		}
+	default:
+		return 1
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", statusSocket)
+			},
+		},
+	}
+	var resp *http.Response
+	var err error
+	if args[1] == "auth" {
+		// Up to the relay timeout for the cloud, plus authorizing the client
+		client.Timeout = time.Minute
+		resp, err = client.Post("http://bridge/auth", "application/json", io.LimitReader(os.Stdin, 4096))
+	} else {
+		resp, err = client.Get("http://bridge" + methods[args[1]])
+	}
+	if err != nil {
+		reply := map[string]interface{}{"running": false, "healthy": false, "error": "bridge is not running"}
+		if args[1] == "auth" {
+			reply = map[string]interface{}{"allowed": false, "error": "bridge is not running"}
+		}
+		json.NewEncoder(os.Stdout).Encode(reply)
+		return 0
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	return 0
+}
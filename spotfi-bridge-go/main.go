@@ -4,88 +4,585 @@ SpotFi Bridge (Go) - MQTT-Only Architecture
 This bridge connects OpenWrt routers to the SpotFi API using MQTT exclusively.
 No WebSocket connections are used - all communication flows through the MQTT broker.
 
-Topics:
+Topics (the "spotfi" prefix can be changed with SPOTFI_TOPIC_PREFIX):
   - spotfi/router/{id}/metrics       - Router heartbeat and metrics (published every 30s)
-  - spotfi/router/{id}/status        - Online/Offline status (with LWT)
+  - spotfi/router/{id}/metrics/request - On-demand metrics refresh requests from API
+  - spotfi/router/{id}/metrics/backfill - Samples collected while the broker was unreachable, replayed on reconnect
+  - spotfi/router/{id}/metrics/summary - Hourly min/max/avg summaries (retained, QoS 1)
+  - spotfi/router/{id}/status        - Online/Offline/Rebooting status (with LWT)
+  - spotfi/router/{id}/hello         - Identity and boot information (published on every connect)
   - spotfi/router/{id}/rpc/request   - Incoming RPC commands from API
   - spotfi/router/{id}/rpc/response  - RPC responses to API
+  - spotfi/router/{id}/alerts        - Threshold and rogue AP alert events (firing/cleared)
+  - spotfi/router/{id}/failover      - mwan3 uplink status and policy changes, published as they happen
+  - spotfi/router/{id}/speedtest     - Speedtest results (scheduled or via spotfi.speedtest/run)
+  - spotfi/router/{id}/location      - GPS position of mobile routers (optional, SPOTFI_LOCATION_SOURCE)
+  - spotfi/router/{id}/inventory     - Devices seen in the ARP/neighbor table, with their mDNS/SSDP services (every 5m, SPOTFI_INVENTORY_INTERVAL, and after each discovery)
+  - spotfi/router/{id}/traffic       - nlbwmon top talkers by host and protocol (every 15m, SPOTFI_TRAFFIC_INTERVAL)
+  - spotfi/router/{id}/events/clients - Client association, authorization and disconnect events as they happen
+  - spotfi/router/{id}/events/quota  - Client quota warnings, cutoffs/throttling and period resets (QoS 1)
+  - spotfi/router/{id}/events/plugins - Events emitted by plugins in SPOTFI_PLUGIN_DIR
+  - spotfi/router/{id}/events/automation - Automation run reports and events published by automations
+  - spotfi/router/{id}/auth/request  - Captive portal logins relayed for a cloud decision (optional, SPOTFI_PORTAL_AUTH)
+  - spotfi/router/{id}/auth/response - Allow/deny decisions for relayed logins and logins allowed offline
+  - spotfi/router/{id}/auth/offline  - Logins allowed while the cloud was unreachable, reported on reconnect
+  - spotfi/router/{id}/walledgarden  - Effective walled garden (pre-login destinations) whenever it changes
+  - spotfi/router/{id}/presence      - Anonymized probe-request footfall counts (opt-in, SPOTFI_PRESENCE)
+  - spotfi/router/{id}/audit         - RPC audit records (optional, SPOTFI_AUDIT_TOPIC)
+  - spotfi/router/{id}/jobs          - Background job state and progress updates
+  - spotfi/router/{id}/journal/ack   - Acknowledgments of journaled events from API (optional, SPOTFI_JOURNAL)
+  - spotfi/router/{id}/schedule      - Scheduled task run reports, kept and replayed while offline, and SSID timetable switches (QoS 1)
+  - spotfi/router/{id}/downtime      - Broker-unreachable windows with their cause, reported after reconnecting (QoS 1)
+  - spotfi/router/{id}/crash         - Panic reports, including crashes of the previous process (QoS 1)
+  - spotfi/router/{id}/logs          - System log lines, batched (optional, SPOTFI_LOG_SHIP)
+  - spotfi/router/{id}/control       - Control requests from API, e.g. temporary debug logging
+  - spotfi/router/{id}/control/response - Control request results
   - spotfi/router/{id}/x/in          - Incoming x-tunnel data from API
   - spotfi/router/{id}/x/out         - Outgoing x-tunnel data to API
+  - spotfi/router/{id}/ap/{mac}/...  - Downstream APs in gateway mode (SPOTFI_MULTI_AP): metrics, status (retained),
+    rpc/request, rpc/response, x/in and x/out as for the router itself
 */
 package main
 
+//go:generate sh -c "go run . --schema > config.schema.json"
+
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"spotfi-bridge/pkg/alerts"
+	"spotfi-bridge/pkg/clientevents"
 	"spotfi-bridge/pkg/config"
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/device"
+	"spotfi-bridge/pkg/downtime"
+	"spotfi-bridge/pkg/inventory"
+	"spotfi-bridge/pkg/journal"
+	"spotfi-bridge/pkg/location"
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/logship"
 	"spotfi-bridge/pkg/metrics"
 	"spotfi-bridge/pkg/mqtt"
+	"spotfi-bridge/pkg/multiap"
+	"spotfi-bridge/pkg/plugins"
+	"spotfi-bridge/pkg/portalauth"
+	"spotfi-bridge/pkg/presence"
+	"spotfi-bridge/pkg/provision"
+	"spotfi-bridge/pkg/rogueap"
 	"spotfi-bridge/pkg/rpc"
 	"spotfi-bridge/pkg/session"
+	"spotfi-bridge/pkg/speedtest"
+	"spotfi-bridge/pkg/traffic"
+	"spotfi-bridge/pkg/update"
 	paho "github.com/eclipse/paho.mqtt.golang"
 )
 
+// Build information, set by build.sh with
+//
+//	-ldflags "-X main.version=2.1.0 -X main.commit=<git commit> -X main.buildTime=<RFC 3339 UTC>"
+//
+// Without them the commit and build time come from the toolchain's VCS stamping, if any
+var (
+	version   = "2.0.0"
+	commit    string
+	buildTime string
+)
+
+// defaultBrokerURL is used when no broker is configured, for manual testing
+const defaultBrokerURL = "tcp://emqx:1883"
+
 // Global state
 var (
 	cfg        config.Config
 	mqttClient *mqtt.Client
 	sm         *session.SessionManager
+
+	// alertEngine evaluates threshold rules on every metrics sample (nil when alerting is off)
+	alertEngine *alerts.Engine
+
+	// metricsDelta encodes metrics as deltas between full snapshots (nil publishes full samples)
+	metricsDelta *metrics.DeltaEncoder
+
+	// metricsBackfill buffers samples while the broker is unreachable (nil when disabled)
+	metricsBackfill *metrics.Backfill
+
+	// metricsSummary aggregates samples into hourly summaries (nil when disabled)
+	metricsSummary *metrics.Summarizer
+
+	// influxOut mirrors samples to a local line protocol listener (nil when disabled)
+	influxOut     *metrics.InfluxOutput
+	influxFailing bool
+
+	// latestMetrics is the most recent sample, served by the Prometheus exporter
+	latestMetrics atomic.Pointer[metrics.Metrics]
+
+	// metricsRefresh carries on-demand refresh requests (with their optional ID) to the metrics loop
+	metricsRefresh = make(chan string, 16)
+
+	// startedAt is when this bridge process started
+	startedAt = time.Now()
+
+	// identity holds the configured and detected MAC address and the serial number, reported in hello
+	identity map[string]interface{}
+
+	// lastReboot is the reason recorded before a requested reboot, reported in every hello of this boot
+	lastReboot *rpc.RebootRecord
 )
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// apTopicMAC extracts the MAC from a topic of the form .../ap/{mac}/...
+func apTopicMAC(topic string) string {
+	parts := strings.Split(strings.TrimPrefix(topic, routerTopic("ap/")), "/")
+	return parts[0]
+}
+
+// routerTopic returns the full name of one of this router's topics, e.g. routerTopic("metrics")
+func routerTopic(name string) string {
+	prefix := cfg.TopicPrefix
+	if prefix == "" {
+		prefix = "spotfi"
+	}
+	return fmt.Sprintf("%s/router/%s/%s", prefix, cfg.RouterID, name)
+}
+
+// redactingWriter masks configured secrets in everything written to the log
+type redactingWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	secrets []string
+}
+
+// add registers a secret; very short values are ignored so ordinary text is not masked
+func (r *redactingWriter) add(secret string) {
+	if len(secret) < 6 {
+		return
+	}
+	r.mu.Lock()
+	r.secrets = append(r.secrets, secret)
+	r.mu.Unlock()
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	s := string(p)
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, "[redacted]")
+	}
+	r.mu.Unlock()
+	if _, err := io.WriteString(r.w, s); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logRedactor is the log output, set up before any secret is loaded
+var logRedactor = &redactingWriter{w: os.Stderr}
+
+var logger = logging.For("bridge")
+
+// detectIdentity reads the MAC address and serial number from the hardware, uses the MAC
+// when SPOTFI_MAC is unset and records both values for the hello message
+func detectIdentity() {
+	mac, source := device.PrimaryMAC()
+	identity = map[string]interface{}{
+		"configuredMac": cfg.Mac,
+		"detectedMac":   mac,
+		"macSource":     source,
+		"serial":        device.Serial(),
 	}
-	return b
+	switch {
+	case mac == "":
+		if cfg.Mac == "" {
+			logger.Warn("SPOTFI_MAC not set and no MAC address could be detected")
+		}
+	case cfg.Mac == "":
+		cfg.Mac = mac
+		logger.Info("SPOTFI_MAC not set, using the detected MAC", "mac", mac, "source", source)
+	case device.NormalizeMAC(cfg.Mac) != mac:
+		identity["macMismatch"] = true
+		logger.Warn("SPOTFI_MAC differs from the detected MAC", "configured", cfg.Mac, "detected", mac, "source", source)
+	}
+}
+
+// provisionIdentity obtains the router ID and token from the provisioning endpoint,
+// waiting until the unit has been claimed, and persists them for the next start
+func provisionIdentity(ctx context.Context) {
+	logger.Info("No router identity configured, provisioning", "url", cfg.ProvisionURL)
+	req := provision.Request{ClaimCode: cfg.ClaimCode, MAC: cfg.Mac, Serial: device.Serial(), Version: version}
+	if req.MAC == "" {
+		req.MAC, _ = device.PrimaryMAC()
+	}
+	if board, err := metrics.BoardInfo(); err == nil {
+		req.Model = board.Model
+		req.BoardName = board.BoardName
+	}
+
+	id, err := provision.Run(ctx, cfg.ProvisionURL, req, cfg.ProvisionRetry)
+	if err != nil && ctx.Err() != nil {
+		logger.Info("Shutting down...")
+		os.Exit(0)
+	}
+	if err != nil {
+		logging.Fatal(logger, "Provisioning failed", "error", err)
+	}
+	logRedactor.add(id.Token)
+	cfg.RouterID, cfg.Token = id.RouterID, id.Token
+	if id.Name != "" {
+		cfg.RouterName = id.Name
+	}
+	if id.MQTTBroker != "" {
+		cfg.MQTTBroker = id.MQTTBroker
+	}
+	if err := cfg.SaveIdentity(); err != nil {
+		// Keep running; the unit will provision again on the next start
+		logger.Error("Provisioned, but saving the identity failed", "routerId", cfg.RouterID, "error", err)
+		return
+	}
+	logger.Info("Provisioned, identity saved to /etc/config/spotfi", "routerId", cfg.RouterID)
 }
 
 // Main entry point
 func main() {
-	log.SetOutput(os.Stderr)
+	if filepath.Base(os.Args[0]) == rpcdObject {
+		// Installed as /usr/libexec/rpcd/spotfi.bridge
+		os.Exit(rpcdPlugin(os.Args[1:]))
+	}
+	defer crash.Recover("main")
+	logging.Setup(logRedactor, "")
+
+	// CLI Flags - every env file option is also a flag (e.g. --metrics-interval=10s), flags win
+	fs := flag.NewFlagSet("spotfi-bridge", flag.ExitOnError)
+	var showVersion, testConfig bool
+	fs.BoolVar(&showVersion, "version", false, "print the version and exit")
+	fs.BoolVar(&showVersion, "v", false, "shorthand for --version")
+	fs.BoolVar(&testConfig, "test", false, "check the configuration, broker connectivity and ubus, then exit")
+	fs.BoolVar(&testConfig, "t", false, "shorthand for --test")
+	envFile := fs.String("env-file", "", "env file to load instead of /etc/config/spotfi and /etc/spotfi.env")
+	configFile := fs.String("config", "", "structured YAML/JSON config (default /etc/spotfi/config.yaml, .yml or .json)")
+	encryptToken := fs.Bool("encrypt-token", false, "store the configured token encrypted with a device-unique key in SPOTFI_TOKEN_FILE (default /etc/spotfi/token) and exit")
+	printSchema := fs.Bool("schema", false, "print the JSON Schema of the structured config file and exit")
+	migrateEnv := fs.String("migrate-env", "", "copy the settings of an env file (e.g. /etc/spotfi.env) into /etc/config/spotfi and exit")
+	installService := fs.Bool("install", false, "write the procd init script for this binary, enable it at boot, link the spotfi.bridge rpcd plugin and exit")
+	applyFlags := config.Flags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: spotfi-bridge [flags]\n\n")
+		fmt.Fprintf(fs.Output(), "Options are read from /etc/spotfi/config.yaml, /etc/config/spotfi and /etc/spotfi.env (SPOTFI_* keys), in that order of precedence; flags override them all.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
 
-	// CLI Flags
-	if len(os.Args) > 1 {
-		switch os.Args[1] {
-		case "--version", "-v":
-			fmt.Fprintln(os.Stdout, "spotfi-bridge v2.0.0 (MQTT)")
-			os.Exit(0)
-		case "--test", "-t":
-			cfg = config.LoadEnv()
-			fmt.Fprintln(os.Stdout, "Configuration OK")
-			os.Exit(0)
+	if showVersion {
+		// "spotfi-bridge v<version> " is checked by the self-update preflight
+		fmt.Fprintf(os.Stdout, "spotfi-bridge v%s (MQTT)\n", version)
+		build := bridgeBuild()
+		if c, ok := build["commit"].(string); ok {
+			dirty := ""
+			if build["dirty"] == true {
+				dirty = "-dirty"
+			}
+			fmt.Fprintf(os.Stdout, "commit: %s%s\n", c, dirty)
 		}
+		if t, ok := build["buildTime"].(string); ok {
+			fmt.Fprintf(os.Stdout, "built: %s\n", t)
+		}
+		fmt.Fprintf(os.Stdout, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		os.Exit(0)
+	}
+
+	if *printSchema {
+		schema, err := config.JSONSchema()
+		if err != nil {
+			logging.Fatal(logger, "Failed to build schema", "error", err)
+		}
+		os.Stdout.Write(schema)
+		os.Exit(0)
+	}
+
+	if *migrateEnv != "" {
+		n, err := config.MigrateEnv(*migrateEnv)
+		if err != nil {
+			logging.Fatal(logger, "Migration failed", "error", err)
+		}
+		fmt.Fprintf(os.Stdout, "Migrated %d settings from %s to /etc/config/spotfi\n", n, *migrateEnv)
+		os.Exit(0)
+	}
+
+	if *installService {
+		if err := install(); err != nil {
+			logging.Fatal(logger, "Install failed", "error", err)
+		}
+		fmt.Fprintf(os.Stdout, "Start the bridge with: %s start\n", initScript)
+		os.Exit(0)
+	}
+
+	if *envFile != "" {
+		var err error
+		if cfg, err = config.LoadFile(*envFile); err != nil {
+			logging.Fatal(logger, "Invalid configuration", "error", err)
+		}
+	} else {
+		var sources []string
+		var err error
+		if cfg, sources, err = config.Load(*configFile); err != nil {
+			logging.Fatal(logger, "Invalid configuration", "error", err)
+		}
+		if len(sources) > 0 {
+			logger.Info("Loaded configuration", "sources", strings.Join(sources, ", "))
+		}
+	}
+	if broker := os.Getenv("SPOTFI_MQTT_BROKER"); broker != "" {
+		cfg.MQTTBroker = broker
+	}
+	applyFlags(&cfg)
+	if cfg.Profile != "" {
+		if err := cfg.ApplyProfile(); err != nil {
+			logging.Fatal(logger, "Invalid configuration", "error", err)
+		}
+		// Flags still win over the profile
+		applyFlags(&cfg)
+		logger.Info("Using profile", "profile", cfg.Profile)
+	}
+	if err := logging.Setup(logRedactor, cfg.LogFormat); err != nil {
+		logging.Fatal(logger, "Invalid configuration", "error", err)
+	}
+	logging.SetLevels(cfg.LogLevel) // Validated by config
+	// --test leaves /etc/config/spotfi alone
+	if err := cfg.Migrate(!testConfig); err != nil {
+		logging.Fatal(logger, "Configuration migration failed", "error", err)
+	}
+	for _, w := range cfg.Warnings() {
+		logger.Warn("Configuration warning: " + w)
+	}
+	// --encrypt-token may be creating the token file
+	if err := cfg.LoadToken(); err != nil && !(*encryptToken && os.IsNotExist(err)) {
+		logging.Fatal(logger, "Failed to read token file", "error", err)
+	}
+	logRedactor.add(cfg.Token)
+	logRedactor.add(cfg.RPCSigningKey)
+	logRedactor.add(cfg.PrometheusToken)
+
+	if *encryptToken {
+		path, err := cfg.EncryptTokenFile()
+		if err != nil {
+			logging.Fatal(logger, "Failed to encrypt token", "error", err)
+		}
+		fmt.Fprintf(os.Stdout, "Token encrypted to %s; set SPOTFI_TOKEN_FILE=%s and remove SPOTFI_TOKEN from the config\n", path, path)
+		os.Exit(0)
+	}
+
+	if testConfig {
+		if !selfTest() {
+			fmt.Fprintln(os.Stdout, "Configuration check failed")
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stdout, "Configuration OK")
+		os.Exit(0)
+	}
+
+	// Reports of a crash of the previous process are published once connected
+	crash.Configure(version)
+
+	// SIGINT and SIGTERM cancel ctx, which every subsystem watches; see shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if (cfg.RouterID == "" || cfg.Token == "") && cfg.ProvisionURL != "" {
+		provisionIdentity(ctx)
 	}
 
-	cfg = config.LoadEnv()
 	if cfg.Token == "" {
-		log.Fatal("Missing configuration: SPOTFI_TOKEN not set")
+		logging.Fatal(logger, "Missing configuration: SPOTFI_TOKEN or SPOTFI_TOKEN_FILE not set")
 	}
+	detectIdentity()
 
-	// Determine Broker URL
-	// Try environment variable first, then config file, then default
-	brokerURL := os.Getenv("SPOTFI_MQTT_BROKER")
-	if brokerURL == "" {
-		brokerURL = cfg.MQTTBroker
+	lastReboot = rpc.ConsumeRebootRecord()
+
+	signingKey := cfg.RPCSigningKey
+	if cfg.RPCSigningKeyFile != "" {
+		data, err := os.ReadFile(cfg.RPCSigningKeyFile)
+		if err != nil {
+			logging.Fatal(logger, "Failed to read RPC signing key", "error", err)
+		}
+		signingKey = string(data)
+		logRedactor.add(strings.TrimSpace(signingKey))
+	}
+	signingKeyBytes, keyErr := rpc.ParseSigningKey(cfg.RPCSigning, signingKey)
+	if keyErr != nil {
+		logging.Fatal(logger, "Invalid RPC signing configuration", "error", keyErr)
+	}
+	if cfg.RPCSigning != "" && cfg.RPCSigning != rpc.SigningOff {
+		logger.Info("RPC request signing enabled", "mode", cfg.RPCSigning)
+	}
+
+	var publishAudit func(v interface{}) error
+	if cfg.AuditTopic {
+		publishAudit = func(v interface{}) error {
+			return publishJournaled("audit", v, false)
+		}
 	}
+
+	// Before anything publishes, so entries left by the previous process are delivered first
+	journal.Configure(ctx, journal.Config{
+		Enabled: cfg.Journal,
+		MaxSize: cfg.JournalSize,
+		Publish: func(topic string, payload json.RawMessage) error {
+			return mqttClient.PublishReliable(routerTopic(topic), payload)
+		},
+		Connected: func() bool {
+			return mqttClient != nil && mqttClient.IsConnected()
+		},
+	})
+
+	rpc.Configure(rpc.Options{
+		DisableExec:       !cfg.RPCExec,
+		ServiceAllowlist:  cfg.RPCServices,
+		IdempotencyWindow: cfg.RPCIdempotencyWindow,
+		MaxArgsSize:       cfg.RPCMaxArgs,
+		MaxPayloadSize:    cfg.RPCMaxPayload,
+		RateLimit:         cfg.RPCRateLimit,
+		RateBurst:         cfg.RPCRateBurst,
+		MaxConcurrent:     cfg.RPCMaxConcurrent,
+		UrgentWorkers:     cfg.RPCUrgentWorkers,
+		UrgentPaths:       cfg.RPCUrgentPaths,
+		CachePolicy:       rpc.ParseCachePolicy(cfg.RPCCache),
+		SigningMode:       cfg.RPCSigning,
+		SigningKey:        signingKeyBytes,
+		SignatureMaxAge:   cfg.RPCSignatureAge,
+		AuditLogPath:      cfg.AuditLog,
+		AuditLogMaxSize:   cfg.AuditLogSize,
+		PublishAudit:      publishAudit,
+		PublishJob: func(v interface{}) error {
+			if mqttClient == nil {
+				return fmt.Errorf("mqtt not connected")
+			}
+			return mqttClient.Publish(routerTopic("jobs"), withLabels(v))
+		},
+		PublishSchedule: func(v interface{}) error {
+			if mqttClient == nil {
+				return fmt.Errorf("mqtt not connected")
+			}
+			return mqttClient.PublishReliable(routerTopic("schedule"), withLabels(v))
+		},
+		PublishQuota: func(v interface{}) error {
+			return publishJournaled("events/quota", v, true)
+		},
+		PublishAutomation: func(v interface{}) error {
+			if mqttClient == nil {
+				return fmt.Errorf("mqtt not connected")
+			}
+			return mqttClient.Publish(routerTopic("events/automation"), withLabels(v))
+		},
+		PublishWalledGarden: func(v interface{}) error {
+			if mqttClient == nil {
+				return fmt.Errorf("mqtt not connected")
+			}
+			return mqttClient.Publish(routerTopic("walledgarden"), withLabels(v))
+		},
+		PublishStatus: func(status string) error {
+			if mqttClient == nil {
+				return fmt.Errorf("mqtt not connected")
+			}
+			return mqttClient.PublishStatus(status)
+		},
+		Connected: func() bool {
+			return mqttClient != nil && mqttClient.IsConnected()
+		},
+		LatestMetrics: latestMetrics.Load,
+		Context:       ctx,
+	})
+	// Schedules, automations, the walled garden, client quotas and the DNS filter are enforced
+	// whether or not the broker is reachable
+	rpc.StartScheduler()
+	rpc.StartAutomations()
+	rpc.StartWalledGarden()
+	rpc.StartQuotas()
+	rpc.StartDNSFilter()
+
+	updateKey, keyErr := update.ParseKey(cfg.UpdateKey)
+	if keyErr != nil {
+		logging.Fatal(logger, "Invalid update configuration", "error", keyErr)
+	}
+	// Before connecting, so a pending update's grace period covers the first attempt
+	update.Configure(ctx, update.Config{
+		ManifestURL: cfg.UpdateURL,
+		PublicKey:   updateKey,
+		Channel:     cfg.UpdateChannel,
+		RouterID:    cfg.RouterID,
+		SaveChannel: func(channel string) error {
+			return config.SaveSetting("SPOTFI_UPDATE_CHANNEL", channel)
+		},
+		Interval:    cfg.UpdateInterval,
+		GracePeriod: cfg.UpdateGrace,
+		Version:     version,
+		PublishStatus: func(status string) error {
+			if mqttClient == nil {
+				return fmt.Errorf("mqtt not connected")
+			}
+			return mqttClient.PublishStatus(status)
+		},
+	})
+
+	// Before connecting, so the fallback policy answers logins while the broker is unreachable
+	portalauth.Configure(ctx, portalauth.Config{
+		Enabled:         cfg.PortalAuth,
+		Timeout:         cfg.PortalAuthTimeout,
+		Fallback:        cfg.PortalAuthFallback,
+		FallbackSession: cfg.PortalAuthFallbackSession,
+		Cache:           cfg.PortalAuthCache,
+		Authorize: func(req *portalauth.Request, d *portalauth.Decision) error {
+			return rpc.AuthorizePortalClient(rpc.PortalClientArgs{
+				Mac:            req.Mac,
+				Interface:      req.Interface,
+				SessionTimeout: d.SessionTimeout,
+				MaxTotalOctets: d.MaxTotalOctets,
+				UploadKbit:     d.UploadKbit,
+				DownloadKbit:   d.DownloadKbit,
+			})
+		},
+		Deauthorize: func(req *portalauth.Request) error {
+			return rpc.DeauthorizePortalClient(req.Mac, req.Interface)
+		},
+	}, func(req *portalauth.Request) error {
+		return mqttClient.PublishReliable(routerTopic("auth/request"), withLabels(req))
+	}, func() bool {
+		return mqttClient != nil && mqttClient.IsConnected()
+	})
+
+	if cfg.Metrics && cfg.MetricsBufferSize >= 0 {
+		metricsBackfill = metrics.NewBackfill(cfg.MetricsBufferSize)
+	}
+	if cfg.Metrics && cfg.MetricsSummaryPeriod >= 0 {
+		metricsSummary = metrics.NewSummarizer(cfg.MetricsSummaryPeriod)
+	}
+
+	// Determine Broker URL
+	// Flag first, then environment variable, then config file, then default
+	brokerURL := cfg.MQTTBroker
 	if brokerURL == "" {
-		brokerURL = "tcp://emqx:1883" // Default for manual testing
-		log.Printf("Using default broker: %s", brokerURL)
+		brokerURL = defaultBrokerURL
+		logger.Info("Using default broker", "broker", brokerURL)
 	} else {
-		log.Printf("Using MQTT broker: %s", brokerURL)
+		logger.Info("Using MQTT broker", "broker", brokerURL)
 	}
+	startStatusServer(ctx, brokerURL)
 
 	// Router ID - Required for MQTT authentication (username = router ID, password = token)
 	// EMQX authenticates using: SELECT token FROM routers WHERE id = username
 	routerID := cfg.RouterID
 	if routerID == "" {
-		log.Fatal("Missing configuration: SPOTFI_ROUTER_ID not set. Router ID is required for MQTT authentication.")
+		logging.Fatal(logger, "Missing configuration: SPOTFI_ROUTER_ID not set. Router ID is required for MQTT authentication.")
 	}
 
 	// Initialize global SessionManager (will be set up after MQTT connection)
@@ -99,50 +596,170 @@ func main() {
 		}
 
 		// 1. RPC Requests
-		rpcTopic := fmt.Sprintf("spotfi/router/%s/rpc/request", routerID)
+		rpcTopic := routerTopic("rpc/request")
 		err := mqttClient.Subscribe(rpcTopic, func(c paho.Client, m paho.Message) {
-			var msg map[string]interface{}
-			if err := json.Unmarshal(m.Payload(), &msg); err != nil {
-				log.Printf("Invalid RPC JSON: %v", err)
-				return
-			}
-
 			// Respond via MQTT
 			sendFunc := func(v interface{}) error {
-				payload, _ := json.Marshal(v)
-				return mqttClient.Publish(fmt.Sprintf("spotfi/router/%s/rpc/response", routerID), payload)
+				payload, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				return mqttClient.Publish(routerTopic("rpc/response"), payload)
 			}
 
-			go rpc.HandleRPC(msg, sendFunc)
+			// Validated (and signature-checked) on the raw payload
+			go rpc.HandleRPC(m.Payload(), sendFunc)
 		})
 		if err != nil {
-			log.Printf("Failed to subscribe to RPC: %v", err)
+			logger.Error("Failed to subscribe to RPC", "error", err)
 		} else {
-			log.Printf("Subscribed to RPC topic: %s", rpcTopic)
+			logger.Info("Subscribed to RPC topic", "topic", rpcTopic)
 		}
 
 		// 2. X-Tunnel Data (Inbound - from API to Router)
-		xTopic := fmt.Sprintf("spotfi/router/%s/x/in", routerID)
-		err = mqttClient.Subscribe(xTopic, func(c paho.Client, m paho.Message) {
-			var msg map[string]interface{}
-			if err := json.Unmarshal(m.Payload(), &msg); err != nil {
-				return
+		if cfg.XTunnel {
+			xTopic := routerTopic("x/in")
+			err = mqttClient.Subscribe(xTopic, func(c paho.Client, m paho.Message) {
+				var msg map[string]interface{}
+				if err := json.Unmarshal(m.Payload(), &msg); err != nil {
+					return
+				}
+
+				msgType, _ := msg["type"].(string)
+				switch msgType {
+				case "x-start":
+					go sm.HandleStart(msg)
+				case "x-data":
+					sm.HandleData(msg)
+				case "x-stop":
+					sm.HandleStop(msg)
+				}
+			})
+			if err != nil {
+				logger.Error("Failed to subscribe to X-Tunnel", "error", err)
+			} else {
+				logger.Info("Subscribed to X-Tunnel topic", "topic", xTopic)
 			}
+		}
 
-			msgType, _ := msg["type"].(string)
-			switch msgType {
-			case "x-start":
-				go sm.HandleStart(msg)
-			case "x-data":
-				sm.HandleData(msg)
-			case "x-stop":
-				sm.HandleStop(msg)
+		// 3. On-demand metrics refresh
+		if cfg.Metrics {
+			refreshTopic := routerTopic("metrics/request")
+			err = mqttClient.Subscribe(refreshTopic, func(c paho.Client, m paho.Message) {
+				var req struct {
+					ID string `json:"id"`
+				}
+				json.Unmarshal(m.Payload(), &req) // An empty payload is a valid request
+				select {
+				case metricsRefresh <- req.ID:
+				default: // Plenty of refreshes are already pending
+				}
+			})
+			if err != nil {
+				logger.Error("Failed to subscribe to metrics requests", "error", err)
+			}
+		}
+
+		// 4. Control requests (temporary log levels)
+		controlTopic := routerTopic("control")
+		err = mqttClient.Subscribe(controlTopic, func(c paho.Client, m paho.Message) {
+			reply := handleControl(m.Payload())
+			payload, err := json.Marshal(reply)
+			if err != nil {
+				return
+			}
+			if err := mqttClient.Publish(routerTopic("control/response"), payload); err != nil {
+				logger.Error("Failed to publish control response", "error", err)
 			}
 		})
 		if err != nil {
-			log.Printf("Failed to subscribe to X-Tunnel: %v", err)
-		} else {
-			log.Printf("Subscribed to X-Tunnel topic: %s", xTopic)
+			logger.Error("Failed to subscribe to control requests", "error", err)
+		}
+
+		// 5. Captive portal login decisions
+		if cfg.PortalAuth {
+			err = mqttClient.Subscribe(routerTopic("auth/response"), func(c paho.Client, m paho.Message) {
+				portalauth.HandleResponse(m.Payload())
+			})
+			if err != nil {
+				logger.Error("Failed to subscribe to portal auth responses", "error", err)
+			}
+			go portalauth.Reconcile(func(r *portalauth.OfflineReport) error {
+				return mqttClient.PublishReliable(routerTopic("auth/offline"), withLabels(r))
+			})
+		}
+
+		// 6. Requests and terminals for downstream APs
+		if cfg.MultiAP {
+			err = mqttClient.Subscribe(routerTopic("ap/+/rpc/request"), func(c paho.Client, m paho.Message) {
+				mac := apTopicMAC(m.Topic())
+				sendFunc := func(v interface{}) error {
+					payload, err := json.Marshal(v)
+					if err != nil {
+						return err
+					}
+					return mqttClient.Publish(routerTopic("ap/"+mac+"/rpc/response"), payload)
+				}
+				go rpc.HandleAPRPC(mac, m.Payload(), sendFunc)
+			})
+			if err != nil {
+				logger.Error("Failed to subscribe to AP RPC", "error", err)
+			}
+			if cfg.XTunnel {
+				err = mqttClient.Subscribe(routerTopic("ap/+/x/in"), func(c paho.Client, m paho.Message) {
+					var msg map[string]interface{}
+					if err := json.Unmarshal(m.Payload(), &msg); err != nil {
+						return
+					}
+					multiap.HandleTerminal(apTopicMAC(m.Topic()), msg)
+				})
+				if err != nil {
+					logger.Error("Failed to subscribe to AP X-Tunnel", "error", err)
+				}
+			}
+			multiap.PublishStatuses()
+		}
+
+		// 7. Acknowledgments of journaled events
+		if journal.Enabled() {
+			err = mqttClient.Subscribe(routerTopic("journal/ack"), func(c paho.Client, m paho.Message) {
+				// A forged acknowledgment would discard events before the backend has them
+				if err := rpc.VerifyMessage("journal/ack", m.Payload()); err != nil {
+					logger.Warn("Ignoring journal acknowledgment", "error", err)
+					return
+				}
+				journal.HandleAck(m.Payload())
+			})
+			if err != nil {
+				logger.Error("Failed to subscribe to journal acknowledgments", "error", err)
+			}
+			journal.Reconnected()
+		}
+
+		connectedAt.Store(time.Now().Unix())
+		downtime.Connected()
+		update.Confirm()
+		publishHello()
+		go crash.Publish(func(r *crash.Report) error {
+			return mqttClient.PublishReliable(routerTopic("crash"), withLabels(r))
+		})
+		rpc.ConnectionEstablished()
+		logship.Flush()
+		if metricsDelta != nil {
+			// Deltas published while offline were lost; start over from a snapshot
+			metricsDelta.Reset()
+		}
+		if metricsBackfill != nil && metricsBackfill.Len() > 0 {
+			go func() {
+				defer crash.Catch("metrics backfill")
+				logger.Info("Replaying buffered metrics samples", "samples", metricsBackfill.Len())
+				err := metricsBackfill.Replay(func(v interface{}) error {
+					return mqttClient.PublishReliable(routerTopic("metrics/backfill"), withLabels(v))
+				})
+				if err != nil {
+					logger.Warn("Metrics backfill interrupted", "error", err)
+				}
+			}()
 		}
 	}
 
@@ -150,7 +767,21 @@ func main() {
 	// Username = Router ID (from database)
 	// Password = Router Token
 	clientID := fmt.Sprintf("router-%s", routerID)
-	log.Printf("Connecting to MQTT broker with username='%s' (router ID)", routerID)
+	if cfg.Instance != "" {
+		// A distinct client ID, so the broker does not disconnect the other instance
+		clientID += "-" + cfg.Instance
+	}
+	logger.Info("Connecting to MQTT broker", "username", routerID)
+
+	// Before connecting, so the time the previous process was down is a window of its own
+	downtime.Start(ctx, downtime.Config{
+		Publish: func(r *downtime.Report) error {
+			return mqttClient.PublishReliable(routerTopic("downtime"), withLabels(r))
+		},
+		Connected: func() bool {
+			return mqttClient != nil && mqttClient.IsConnected()
+		},
+	})
 	
 	// Connect to MQTT with Exponential Backoff
 	var client *mqtt.Client
@@ -160,29 +791,34 @@ func main() {
 
 	for {
 		// OnConnectHandler will re-subscribe on every reconnect
-		client, err = mqtt.NewClient(brokerURL, clientID, routerID, cfg.Token, func(c paho.Client) {
-			log.Println("MQTT Client Connected")
+		client, err = mqtt.NewClient(brokerURL, clientID, routerTopic("status"), cfg.Instance, routerID, cfg.Token, func(c paho.Client) {
+			logger.Info("MQTT Client Connected")
 			// Re-subscribe on reconnect (subscriptions are lost with CleanSession=true)
 			setupSubscriptions()
-		})
+		}, downtime.Lost)
 		if err == nil {
 			break
 		}
+		downtime.Lost(err)
 		// Provide more helpful error messages for authentication failures
 		errMsg := err.Error()
 		if strings.Contains(errMsg, "not Authorized") || strings.Contains(errMsg, "NotAuthorized") {
-			log.Printf("MQTT authentication failed: username='%s' (router ID), password='%s...' (token)", routerID, cfg.Token[:min(8, len(cfg.Token))])
-			log.Printf("Verify: 1) Router ID '%s' exists in database, 2) Token matches router's token in database", routerID)
+			logger.Error("MQTT authentication failed", "username", routerID, "tokenLength", len(cfg.Token))
+			logger.Error("Verify: 1) the router ID exists in the database, 2) the token matches the router's token in the database", "routerId", routerID)
+		}
+		logger.Warn("Failed to connect to MQTT broker", "error", err, "retry", backoff)
+		select {
+		case <-ctx.Done():
+			logger.Info("Shutting down...")
+			return
+		case <-time.After(backoff):
 		}
-		log.Printf("Failed to connect to MQTT broker: %v. Retrying in %v...", err, backoff)
-		time.Sleep(backoff)
 		backoff *= 2
 		if backoff > maxBackoff {
 			backoff = maxBackoff
 		}
 	}
 	mqttClient = client
-	defer mqttClient.Close()
 
 	// Set up publish function for SessionManager
 	publishFunc = func(topic string, v interface{}) error {
@@ -190,44 +826,489 @@ func main() {
 		// Use provided topic if possible, fallback to standard out topic
 		pubTopic := topic
 		if pubTopic == "" {
-			pubTopic = fmt.Sprintf("spotfi/router/%s/x/out", routerID)
+			pubTopic = routerTopic("x/out")
 		}
 		return mqttClient.Publish(pubTopic, payload)
 	}
 
 	// Initialize global SessionManager pointing to MQTT
-	sm = session.NewSessionManager(publishFunc)
+	if cfg.XTunnel {
+		sm = session.NewSessionManager(ctx, publishFunc)
+	}
 
 	// Set up subscriptions on initial connect
 	setupSubscriptions()
+	startWatchdog(ctx, cfg.Watchdog)
 
-	log.Printf("SpotFi Bridge (MQTT) Started. ID: %s", routerID)
+	logger.Info("SpotFi Bridge (MQTT) Started", "routerId", routerID)
 
-	// Metric Loop
-	ticker := time.NewTicker(30 * time.Second)
-	metricsTopic := fmt.Sprintf("spotfi/router/%s/metrics", routerID)
+	// Subsystems switched off in the configuration are not started, and their topics were not subscribed above
+	if disabled := disabledSubsystems(); len(disabled) > 0 {
+		logger.Info("Disabled by configuration", "subsystems", strings.Join(disabled, ", "))
+	}
 
-	// Send initial metrics
-	initialMetrics := map[string]interface{}{
-		"type":    "metrics",
-		"metrics": metrics.GetMetrics(),
+	if cfg.Metrics {
+		metrics.StartWANProbe(ctx, metrics.WANProbeConfig{
+			Target:      cfg.WANProbeTarget,
+			Interval:    cfg.WANProbeInterval,
+			PublicIPURL: cfg.PublicIPURL,
+			DNSName:     cfg.DNSProbeName,
+		})
+
+		metrics.StartLogWatch(ctx)
+		metrics.StartMWANWatch(ctx, 0, func(ev *metrics.FailoverEvent) error {
+			rpc.Notify(ev)
+			return mqttClient.PublishReliable(routerTopic("failover"), withLabels(ev))
+		})
+		metrics.SetModem(cfg.Modem, cfg.ModemDevice)
+		metrics.SetWatchedServices(cfg.WatchedServices)
+		metrics.SetPlugins(cfg.MetricsPluginDir, cfg.MetricsPluginTimeout)
+		metrics.SetPluginSource(plugins.Collect)
+	}
+
+	speedtest.Configure(ctx, speedtest.Config{
+		Endpoint:    cfg.SpeedtestEndpoint,
+		Interval:    cfg.SpeedtestInterval,
+		MinInterval: cfg.SpeedtestMinInterval,
+		MaxBytes:    cfg.SpeedtestMaxBytes,
+	}, func(res *speedtest.Result) error {
+		return mqttClient.PublishReliable(routerTopic("speedtest"), withLabels(res))
+	})
+
+	location.Configure(ctx, location.Config{
+		Source:    cfg.LocationSource,
+		Interval:  cfg.LocationInterval,
+		Precision: cfg.LocationPrecision,
+	}, func(fix *location.Fix) error {
+		return mqttClient.Publish(routerTopic("location"), withLabels(fix))
+	})
+
+	inventory.Configure(ctx, inventory.Config{
+		Interval:          cfg.InventoryInterval,
+		Discovery:         cfg.Discovery,
+		DiscoveryInterval: cfg.DiscoveryInterval,
+		Subnets:           cfg.DiscoverySubnets,
+	}, func(inv *inventory.Inventory) error {
+		return mqttClient.Publish(routerTopic("inventory"), withLabels(inv))
+	})
+
+	traffic.Configure(ctx, traffic.Config{
+		Interval: cfg.TrafficInterval,
+		Top:      cfg.TrafficTop,
+	}, func(s *traffic.Summary) error {
+		return mqttClient.Publish(routerTopic("traffic"), withLabels(s))
+	})
+
+	clientevents.Configure(ctx, clientevents.Config{
+		Enabled: cfg.ClientEvents,
+		MaxRate: cfg.ClientEventsMaxRate,
+	}, func(ev *clientevents.Event) error {
+		rpc.Notify(ev)
+		return publishJournaled("events/clients", ev, false)
+	})
+
+	presence.Configure(ctx, presence.Config{
+		Enabled:      cfg.Presence,
+		Interval:     cfg.PresenceInterval,
+		MinSignal:    cfg.PresenceMinSignal,
+		SaltRotation: cfg.PresenceSaltRotation,
+		MaxRate:      cfg.PresenceMaxRate,
+		MaxDevices:   cfg.PresenceMaxDevices,
+	}, func(r *presence.Report) error {
+		return mqttClient.Publish(routerTopic("presence"), withLabels(r))
+	})
+
+	rogueap.Configure(ctx, rogueap.Config{
+		Enabled:  cfg.RogueAP,
+		Interval: cfg.RogueAPInterval,
+		SSIDs:    cfg.RogueAPSSIDs,
+		Allow:    cfg.RogueAPAllow,
+	}, func(a *rogueap.Alert) error {
+		rpc.Notify(a)
+		return publishJournaled("alerts", a, true)
+	})
+
+	multiap.Start(ctx, multiap.Config{
+		Enabled:  cfg.MultiAP,
+		Interval: cfg.MultiAPInterval,
+		PublishMetrics: func(mac string, m *multiap.Metrics) error {
+			return mqttClient.Publish(routerTopic("ap/"+mac+"/metrics"), withLabels(m))
+		},
+		PublishStatus: func(mac string, st *multiap.Status) error {
+			return mqttClient.PublishRetained(routerTopic("ap/"+mac+"/status"), withLabels(st))
+		},
+		PublishTerminal: func(mac, topic string, v interface{}) error {
+			if topic == "" {
+				topic = routerTopic("ap/" + mac + "/x/out")
+			}
+			payload, _ := json.Marshal(v)
+			return mqttClient.Publish(topic, payload)
+		},
+	})
+
+	plugins.Start(ctx, plugins.Config{
+		Dir: cfg.PluginDir,
+		PublishEvent: func(ev *plugins.Event) error {
+			rpc.Notify(ev)
+			return mqttClient.Publish(routerTopic("events/plugins"), withLabels(ev))
+		},
+	})
+
+	logship.Configure(ctx, logship.Config{
+		Enabled:       cfg.LogShip,
+		Source:        cfg.LogShipSource,
+		Severity:      cfg.LogShipSeverity,
+		Include:       cfg.LogShipInclude,
+		Exclude:       cfg.LogShipExclude,
+		BatchSize:     cfg.LogShipBatch,
+		FlushInterval: cfg.LogShipFlushInterval,
+		MaxRate:       cfg.LogShipMaxRate,
+		Backlog:       cfg.LogShipBacklog,
+	}, func(b *logship.Batch) error {
+		return mqttClient.PublishReliable(routerTopic("logs"), withLabels(b))
+	}, func() bool {
+		return mqttClient != nil && mqttClient.IsConnected()
+	})
+
+	if !cfg.Metrics {
+		<-ctx.Done()
+		shutdown()
+		return
+	}
+
+	// Alerts are evaluated on every collection and published independently of metrics
+	alertRules := alerts.DefaultRules
+	if len(cfg.AlertRules) == 1 && cfg.AlertRules[0] == "off" {
+		alertRules = nil
+	} else if len(cfg.AlertRules) > 0 {
+		alertRules = alerts.ParseRules(cfg.AlertRules)
+	}
+	if len(alertRules) > 0 {
+		alertEngine = alerts.NewEngine(alertRules, func(ev alerts.Event) error {
+			rpc.Notify(ev)
+			return publishJournaled("alerts", ev, true)
+		})
 	}
-	mqttClient.Publish(metricsTopic, initialMetrics)
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	if cfg.PrometheusListen != "" {
+		err := metrics.ServePrometheus(ctx, metrics.PrometheusOptions{
+			Addr:         cfg.PrometheusListen,
+			Token:        cfg.PrometheusToken,
+			ClientLabels: cfg.PrometheusClientLabels,
+		}, func() *metrics.Metrics {
+			m := latestMetrics.Load()
+			if m == nil {
+				return nil
+			}
+			sample := *m
+			sample.RPC = rpc.Stats()
+			sample.Bridge = bridgeStats()
+			return &sample
+		})
+		if err != nil {
+			logger.Error("Prometheus exporter disabled", "error", err)
+		}
+	}
+
+	if cfg.InfluxTarget != "" {
+		tags := map[string]string{"router": routerID}
+		for k, v := range cfg.Labels {
+			tags[k] = v
+		}
+		var err error
+		if influxOut, err = metrics.NewInfluxOutput(cfg.InfluxTarget, tags); err != nil {
+			logger.Error("Influx output disabled", "error", err)
+		}
+	}
+
+	if cfg.MetricsDelta {
+		metricsDelta = metrics.NewDeltaEncoder(metrics.ParseDeadbands(cfg.MetricsDeadbands), cfg.MetricsFullInterval)
+	}
+
+	// Metric Loop
+	metrics.SetBaseInterval(cfg.MetricsInterval)
+	metrics.SetSchedule(routerID, cfg.MetricsPhase, cfg.MetricsSplay)
+	timer := time.NewTimer(metrics.NextTick())
+	metricsTopic := routerTopic("metrics")
+
+	// Send initial metrics
+	mqttClient.Publish(metricsTopic, collectMetrics(true))
+	lastPublish := time.Now()
 
 	for {
+		loopBeat.Store(time.Now().Unix())
 		select {
-		case <-ticker.C:
-			data := map[string]interface{}{
-				"type":    "metrics",
-				"metrics": metrics.GetMetrics(),
-			}
-			mqttClient.Publish(metricsTopic, data)
-		case <-quit:
-			log.Println("Shutting down...")
+		case <-timer.C:
+			timer.Reset(metrics.NextTick())
+			msg := collectMetrics(false)
+			if metricsBackfill != nil && !mqttClient.IsConnected() {
+				// Kept for replay on reconnect instead of being lost
+				metricsBackfill.Add(latestMetrics.Load())
+				continue
+			}
+			mqttClient.Publish(metricsTopic, msg)
+			lastPublish = time.Now()
+			if metricsSummary != nil {
+				// Finished periods, including those that ended while offline
+				err := metricsSummary.Flush(func(sum *metrics.Summary) error {
+					return mqttClient.PublishRetained(routerTopic("metrics/summary"), withLabels(sum))
+				})
+				if err != nil {
+					logger.Error("Failed to publish metrics summary", "error", err)
+				}
+			}
+		case id := <-metricsRefresh:
+			// Refresh button mashing is collected at most once per second; within
+			// the second the sample just published answers the request
+			var m map[string]interface{}
+			if latest := latestMetrics.Load(); latest != nil && time.Since(lastPublish) < time.Second {
+				m = encodeMetrics(latest, true)
+			} else {
+				m = collectMetrics(true)
+				lastPublish = time.Now()
+				timer.Reset(metrics.NextTick())
+			}
+			if id != "" {
+				m["requestId"] = id
+			}
+			mqttClient.Publish(metricsTopic, m)
+		case <-metrics.IntervalChanged():
+			// Publish right away so a shortened interval takes effect immediately
+			timer.Reset(metrics.NextTick())
+			logger.Info("Metrics interval changed", "interval", metrics.Interval())
+			mqttClient.Publish(metricsTopic, collectMetrics(true))
+			lastPublish = time.Now()
+		case <-ctx.Done():
+			shutdown()
 			return
 		}
 	}
 }
+
+// shutdownTimeout bounds the graceful shutdown, within the term_timeout of the init script
+// written by --install
+const shutdownTimeout = 10 * time.Second
+
+// shutdown runs once the root context is cancelled, which has stopped the subsystems'
+// tickers and cancelled in-flight RPCs: it waits for their responses, closes x-tunnel
+// sessions with a notification, drains the publish queue and publishes OFFLINE
+func shutdown() {
+	logger.Info("Shutting down...")
+	deadline := time.Now().Add(shutdownTimeout)
+	if !rpc.Drain(shutdownTimeout / 2) {
+		logger.Warn("RPC requests still running at shutdown")
+	}
+	if sm != nil {
+		sm.CloseAll("bridge is shutting down")
+	}
+	downtime.Stopped()
+	mqttClient.Close(time.Until(deadline))
+	logger.Info("Shutdown complete")
+}
+
+// collectMetrics builds the metrics payload, including bridge-internal counters;
+// in delta mode only changes are sent unless full is set
+func collectMetrics(full bool) map[string]interface{} {
+	m := metrics.GetMetrics()
+	m.RPC = rpc.Stats()
+	m.Bridge = bridgeStats()
+	if alertEngine != nil {
+		alertEngine.Evaluate(m)
+	}
+	latestMetrics.Store(m)
+	if metricsSummary != nil {
+		metricsSummary.Add(m)
+	}
+	if influxOut != nil {
+		// Logged once per outage, not on every sample
+		err := influxOut.Write(m)
+		if err != nil && !influxFailing {
+			logger.Error("Failed to write to influx target", "error", err)
+		}
+		influxFailing = err != nil
+	}
+	return encodeMetrics(m, full)
+}
+
+// encodeMetrics builds the payload of a sample; in delta mode only changes are
+// sent unless full is set
+func encodeMetrics(m *metrics.Metrics, full bool) map[string]interface{} {
+	var msg map[string]interface{}
+	if metricsDelta != nil {
+		msg = metricsDelta.Encode(m, full)
+	} else {
+		msg = map[string]interface{}{
+			"type":    "metrics",
+			"metrics": m,
+		}
+	}
+	if len(cfg.Labels) > 0 {
+		msg["labels"] = cfg.Labels
+	}
+	return msg
+}
+
+// withLabels adds the configured SPOTFI_LABELS to a JSON object payload
+func withLabels(v interface{}) interface{} {
+	if len(cfg.Labels) == 0 {
+		return v
+	}
+	if doc, ok := v.(map[string]interface{}); ok {
+		doc["labels"] = cfg.Labels
+		return doc
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	// Raw values keep large integers exact
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return v // Not an object
+	}
+	doc["labels"], _ = json.Marshal(cfg.Labels)
+	return doc
+}
+
+// publishJournaled publishes an event on topic through the journal when it is enabled,
+// so it survives broker outages and reboots, and directly (with QoS 1 if reliable) otherwise
+func publishJournaled(topic string, v interface{}, reliable bool) error {
+	if journal.Enabled() {
+		return journal.Append(topic, withLabels(v))
+	}
+	if mqttClient == nil {
+		return fmt.Errorf("mqtt not connected")
+	}
+	if reliable {
+		return mqttClient.PublishReliable(routerTopic(topic), withLabels(v))
+	}
+	return mqttClient.Publish(routerTopic(topic), withLabels(v))
+}
+
+// bridgeStats reports the bridge's own health, to catch leaks across the fleet
+func bridgeStats() map[string]interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := map[string]interface{}{
+		"uptime":           int64(time.Since(startedAt).Seconds()),
+		"goroutines":       runtime.NumGoroutine(),
+		"heapAlloc":        mem.HeapAlloc,
+		"heapSys":          mem.HeapSys,
+		"sys":              mem.Sys,
+		"numGC":            mem.NumGC,
+		"gcPauseTotalMs":   float64(mem.PauseTotalNs) / 1e6,
+		"gcLastPauseMs":    float64(mem.PauseNs[(mem.NumGC+255)%256]) / 1e6,
+		"sessions":         0,
+		"backfillSamples":  0,
+		"pendingSummaries": 0,
+		"version":          version,
+		"channel":          update.Channel(),
+	}
+	if sm != nil {
+		stats["sessions"] = sm.Count()
+	}
+	if metricsBackfill != nil {
+		stats["backfillSamples"] = metricsBackfill.Len()
+	}
+	if metricsSummary != nil {
+		stats["pendingSummaries"] = metricsSummary.Pending()
+	}
+	if s := logship.Stats(); s != nil {
+		stats["logShipping"] = s
+	}
+	if s := journal.Stats(); s != nil {
+		stats["journal"] = s
+	}
+	if mqttClient != nil {
+		stats["mqtt"] = mqttClient.Stats()
+	}
+	return stats
+}
+
+// publishHello announces the bridge identity and boot information after every connect
+func publishHello() {
+	hello := map[string]interface{}{
+		"type":       "hello",
+		"version":    version,
+		"routerId":   cfg.RouterID,
+		"routerName": cfg.RouterName,
+		"mac":        cfg.Mac,
+	}
+	if board, err := metrics.BoardInfo(); err == nil {
+		hello["board"] = board
+	} else {
+		logger.Warn("Failed to read board info", "error", err)
+	}
+	hello["bridge"] = bridgeBuild()
+	hello["channel"] = update.Channel()
+	hello["bootTime"], hello["bootId"] = metrics.BootInfo()
+	if lastReboot != nil {
+		hello["lastReboot"] = lastReboot
+	}
+	if res := update.Last(); res != nil {
+		hello["update"] = res
+	}
+	if cfg.Profile != "" {
+		hello["profile"] = cfg.Profile
+	}
+	if cfg.Instance != "" {
+		hello["instance"] = cfg.Instance
+	}
+	hello["identity"] = identity
+	if disabled := disabledSubsystems(); len(disabled) > 0 {
+		hello["disabled"] = disabled
+	}
+	if err := mqttClient.Publish(routerTopic("hello"), withLabels(hello)); err != nil {
+		logger.Error("Failed to publish hello", "error", err)
+	}
+}
+
+// disabledSubsystems lists the subsystems switched off in the configuration
+func disabledSubsystems() []string {
+	var disabled []string
+	if !cfg.XTunnel {
+		disabled = append(disabled, "xtunnel")
+	}
+	if !cfg.RPCExec {
+		disabled = append(disabled, "exec")
+	}
+	if !cfg.Metrics {
+		disabled = append(disabled, "metrics")
+	}
+	if !cfg.ClientEvents {
+		disabled = append(disabled, "clientevents")
+	}
+	return disabled
+}
+
+// bridgeBuild describes this binary; the commit and build time come from the linker
+// flags of build.sh, or the VCS stamp Go embeds when building from a git checkout
+func bridgeBuild() map[string]interface{} {
+	build := map[string]interface{}{
+		"version":   version,
+		"goVersion": runtime.Version(),
+		"arch":      runtime.GOARCH,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				build["commit"] = s.Value
+			case "vcs.time":
+				build["buildTime"] = s.Value
+			case "vcs.modified":
+				if s.Value == "true" {
+					build["dirty"] = true
+				}
+			}
+		}
+	}
+	// VCS stamping is missing e.g. in Docker builds and from source tarballs
+	if commit != "" {
+		build["commit"] = commit
+	}
+	if buildTime != "" {
+		build["buildTime"] = buildTime
+	}
+	return build
+}
@@ -0,0 +1,312 @@
+package alerts
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/metrics"
+)
+
+var logger = logging.For("alerts")
+
+// Severities
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Alert states
+const (
+	StateFiring  = "firing"
+	StateCleared = "cleared"
+)
+
+// Rule raises an alert when Metric compares to Threshold (">" or "<") for
+// For consecutive samples, and clears it after For samples back in range
+type Rule struct {
+	Metric    string  `json:"metric"`
+	Op        string  `json:"op"`
+	Threshold float64 `json:"threshold"`
+	Severity  string  `json:"severity"`
+	For       int     `json:"for"`
+}
+
+// Name identifies the rule in events, e.g. "cpuLoad>90"
+func (r Rule) Name() string {
+	return r.Metric + r.Op + strconv.FormatFloat(r.Threshold, 'f', -1, 64)
+}
+
+// Event is published on the alerts topic when an alert fires or clears
+type Event struct {
+	Type      string  `json:"type"` // Always "alert"
+	Rule      string  `json:"rule"`
+	Metric    string  `json:"metric"`
+	Severity  string  `json:"severity"`
+	State     string  `json:"state"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Since     int64   `json:"since"` // Unix time the alert started firing
+	Ts        int64   `json:"ts"`
+	Message   string  `json:"message"`
+}
+
+// DefaultRules are used unless SPOTFI_ALERT_RULES overrides them
+var DefaultRules = []Rule{
+	{Metric: "cpuLoad", Op: ">", Threshold: 90, Severity: SeverityWarning, For: 3},
+	{Metric: "freeMemoryPercent", Op: "<", Threshold: 10, Severity: SeverityCritical, For: 2},
+	{Metric: "overlayUsedPercent", Op: ">", Threshold: 90, Severity: SeverityCritical, For: 1},
+	{Metric: "activeUsers", Op: ">", Threshold: 200, Severity: SeverityInfo, For: 2},
+	{Metric: "wanLossPercent", Op: ">", Threshold: 20, Severity: SeverityCritical, For: 2},
+	{Metric: "conntrackUsedPercent", Op: ">", Threshold: 90, Severity: SeverityCritical, For: 2},
+	{Metric: "servicesDown", Op: ">", Threshold: 0, Severity: SeverityCritical, For: 1},
+	{Metric: "clockOffsetMs", Op: ">", Threshold: 2000, Severity: SeverityWarning, For: 1},
+	{Metric: "dnsFailed", Op: ">", Threshold: 0, Severity: SeverityCritical, For: 2},
+	{Metric: "oomKills", Op: ">", Threshold: 0, Severity: SeverityWarning, For: 1},
+	{Metric: "kernelOops", Op: ">", Threshold: 0, Severity: SeverityWarning, For: 1},
+	{Metric: "deauths", Op: ">", Threshold: 50, Severity: SeverityWarning, For: 2},
+}
+
+// values extracts the metrics rules can refer to; metrics that were not
+// collected are absent so their rules neither fire nor clear
+var values = map[string]func(m *metrics.Metrics) (float64, bool){
+	"cpuLoad": func(m *metrics.Metrics) (float64, bool) { return m.CPULoad, true },
+	"freeMemoryPercent": func(m *metrics.Metrics) (float64, bool) {
+		if m.TotalMemory == 0 {
+			return 0, false
+		}
+		return float64(m.FreeMemory) / float64(m.TotalMemory) * 100, true
+	},
+	"overlayUsedPercent": func(m *metrics.Metrics) (float64, bool) {
+		return metrics.OverlayUsedPercent()
+	},
+	"activeUsers":    func(m *metrics.Metrics) (float64, bool) { return float64(m.ActiveUsers), true },
+	"wanLossPercent": metrics.WANLossPercent,
+	"maxTemperature": func(m *metrics.Metrics) (float64, bool) {
+		if len(m.Storage.Temperatures) == 0 {
+			return 0, false
+		}
+		max := m.Storage.Temperatures[0].Celsius
+		for _, t := range m.Storage.Temperatures[1:] {
+			if t.Celsius > max {
+				max = t.Celsius
+			}
+		}
+		return max, true
+	},
+	"conntrackUsedPercent": func(m *metrics.Metrics) (float64, bool) {
+		if m.Conntrack == nil || m.Conntrack.Max == 0 {
+			return 0, false
+		}
+		return m.Conntrack.UsedPercent, true
+	},
+	"servicesDown": metrics.ServicesDown,
+	"clockOffsetMs": func(m *metrics.Metrics) (float64, bool) {
+		if m.Clock == nil || m.Clock.Error != "" {
+			return 0, false
+		}
+		return math.Abs(m.Clock.OffsetMs), true
+	},
+	"dnsFailed": func(m *metrics.Metrics) (float64, bool) {
+		if m.DNS == nil {
+			return 0, false
+		}
+		if m.DNS.OK {
+			return 0, true
+		}
+		return 1, true
+	},
+	"oomKills":      logCount(func(c *metrics.LogCounts) int64 { return c.OOMKills }),
+	"kernelOops":    logCount(func(c *metrics.LogCounts) int64 { return c.KernelOops }),
+	"deauths":       logCount(func(c *metrics.LogCounts) int64 { return c.Deauths }),
+	"dnsmasqErrors": logCount(func(c *metrics.LogCounts) int64 { return c.DnsmasqErrors }),
+}
+
+// IsMetric reports whether rules (and automation scripts) can refer to name
+func IsMetric(name string) bool {
+	_, ok := values[name]
+	return ok
+}
+
+// Value returns the named metric of a sample; ok is false for an unknown name
+// or a metric that was not collected
+func Value(m *metrics.Metrics, name string) (value float64, ok bool) {
+	get, ok := values[name]
+	if !ok || m == nil {
+		return 0, false
+	}
+	return get(m)
+}
+
+// logCount reads a per-sample system log counter
+func logCount(get func(c *metrics.LogCounts) int64) func(m *metrics.Metrics) (float64, bool) {
+	return func(m *metrics.Metrics) (float64, bool) {
+		if m.Log == nil {
+			return 0, false
+		}
+		return float64(get(m.Log)), true
+	}
+}
+
+type ruleState struct {
+	breaches, recoveries int
+	firing               bool
+	since                time.Time
+}
+
+// Engine evaluates rules against every metrics sample
+type Engine struct {
+	mu      sync.Mutex
+	rules   []Rule
+	state   map[string]*ruleState
+	publish func(Event) error
+}
+
+// NewEngine creates an engine; publish is called for every state change
+func NewEngine(rules []Rule, publish func(Event) error) *Engine {
+	return &Engine{rules: rules, state: map[string]*ruleState{}, publish: publish}
+}
+
+// ParseRules parses entries like "cpuLoad>90:warning:3" (severity defaults to
+// warning, the sample count to 1); invalid entries are logged and skipped
+func ParseRules(entries []string) []Rule {
+	var rules []Rule
+	for _, entry := range entries {
+		rule, err := parseRule(entry)
+		if err != nil {
+			logger.Warn("Ignoring alert rule", "rule", entry, "error", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func parseRule(entry string) (Rule, error) {
+	parts := strings.Split(entry, ":")
+	expr := parts[0]
+	i := strings.IndexAny(expr, "<>")
+	if i <= 0 {
+		return Rule{}, fmt.Errorf("expected metric>value or metric<value")
+	}
+	threshold, err := strconv.ParseFloat(expr[i+1:], 64)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid threshold: %w", err)
+	}
+	rule := Rule{Metric: expr[:i], Op: expr[i : i+1], Threshold: threshold, Severity: SeverityWarning, For: 1}
+	if _, ok := values[rule.Metric]; !ok {
+		return Rule{}, fmt.Errorf("unknown metric %q", rule.Metric)
+	}
+	if len(parts) > 1 {
+		switch parts[1] {
+		case SeverityInfo, SeverityWarning, SeverityCritical:
+			rule.Severity = parts[1]
+		default:
+			return Rule{}, fmt.Errorf("unknown severity %q", parts[1])
+		}
+	}
+	if len(parts) > 2 {
+		if rule.For, err = strconv.Atoi(parts[2]); err != nil || rule.For < 1 {
+			return Rule{}, fmt.Errorf("invalid sample count %q", parts[2])
+		}
+	}
+	return rule, nil
+}
+
+// Evaluate checks every rule against a metrics sample and publishes transitions
+func (e *Engine) Evaluate(m *metrics.Metrics) {
+	e.mu.Lock()
+	var events []Event
+	now := time.Now()
+	for _, rule := range e.rules {
+		get, ok := values[rule.Metric]
+		if !ok {
+			continue
+		}
+		value, ok := get(m)
+		if !ok {
+			continue
+		}
+
+		name := rule.Name()
+		st := e.state[name]
+		if st == nil {
+			st = &ruleState{}
+			e.state[name] = st
+		}
+		breached := (rule.Op == ">" && value > rule.Threshold) || (rule.Op == "<" && value < rule.Threshold)
+		if breached {
+			st.breaches++
+			st.recoveries = 0
+		} else {
+			st.recoveries++
+			st.breaches = 0
+		}
+
+		required := rule.For
+		if required < 1 {
+			required = 1
+		}
+		switch {
+		case !st.firing && st.breaches >= required:
+			st.firing = true
+			st.since = now
+			events = append(events, newEvent(rule, StateFiring, value, st.since, now))
+		case st.firing && st.recoveries >= required:
+			st.firing = false
+			events = append(events, newEvent(rule, StateCleared, value, st.since, now))
+		}
+	}
+	e.mu.Unlock()
+
+	for _, ev := range events {
+		logger.Info("Alert "+ev.State, "rule", ev.Rule, "severity", ev.Severity, "message", ev.Message)
+		if e.publish == nil {
+			continue
+		}
+		if err := e.publish(ev); err != nil {
+			logger.Error("Failed to publish alert", "rule", ev.Rule, "error", err)
+		}
+	}
+}
+
+// Active returns the currently firing rules
+func (e *Engine) Active() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	active := []string{}
+	for name, st := range e.state {
+		if st.firing {
+			active = append(active, name)
+		}
+	}
+	return active
+}
+
+func newEvent(rule Rule, state string, value float64, since, now time.Time) Event {
+	verb := "above"
+	if rule.Op == "<" {
+		verb = "below"
+	}
+	msg := fmt.Sprintf("%s is %.1f, %s threshold %g", rule.Metric, value, verb, rule.Threshold)
+	if state == StateCleared {
+		msg = fmt.Sprintf("%s back to %.1f", rule.Metric, value)
+	}
+	return Event{
+		Type:      "alert",
+		Rule:      rule.Name(),
+		Metric:    rule.Metric,
+		Severity:  rule.Severity,
+		State:     state,
+		Value:     value,
+		Threshold: rule.Threshold,
+		Since:     since.Unix(),
+		Ts:        now.Unix(),
+		Message:   msg,
+	}
+}
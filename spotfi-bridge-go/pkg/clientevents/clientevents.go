@@ -0,0 +1,307 @@
+package clientevents
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/ubus"
+)
+
+var logger = logging.For("clientevents")
+
+const (
+	DefaultMaxRate = 50
+
+	// The hostapd object list is checked this often, picking up radios that came up
+	// later and hostapd restarts, which replace the objects subscribed to
+	refreshEvery = 30 * time.Second
+
+	// uspotEvents is the ubus event pattern the captive portal is listened to on
+	uspotEvents = "uspot.*"
+)
+
+// Config configures the client event stream. Events are taken from hostapd's ubus
+// notifications and uspot's ubus events, so they are published as they happen
+// instead of with the next metrics sample
+type Config struct {
+	// Enabled turns the stream on; it is on by default (SPOTFI_CLIENT_EVENTS)
+	Enabled bool
+
+	// MaxRate caps the events published per second; the rest are only counted as dropped
+	MaxRate int
+}
+
+// Event is published on the events/clients topic for every client state change
+type Event struct {
+	Type string `json:"type"` // Always "client"
+
+	// Event is authenticated (802.11 authentication), associated, authorized (WPA
+	// handshake completed), disconnected, or portal for a uspot event
+	Event     string `json:"event"`
+	Mac       string `json:"mac"`
+	Interface string `json:"interface,omitempty"` // Wireless interface, or uspot instance
+	SSID      string `json:"ssid,omitempty"`
+	Band      string `json:"band,omitempty"`   // 2g, 5g or 6g
+	Signal    int    `json:"signal,omitempty"` // dBm, authenticated and associated only
+
+	// Portal is the uspot event name and IP the client's address, portal events only
+	Portal string `json:"portal,omitempty"`
+	IP     string `json:"ip,omitempty"`
+
+	// Seq increases by one per event published, so gaps show lost messages
+	Seq     int64 `json:"seq"`
+	Ts      int64 `json:"ts"`                // Unix milliseconds
+	Dropped int64 `json:"dropped,omitempty"` // Events dropped by the rate cap since the previous event
+}
+
+// hostapdEvents maps hostapd notification types to event names. Probe requests
+// are left to pkg/presence
+var hostapdEvents = map[string]string{
+	"auth":           "authenticated",
+	"assoc":          "associated",
+	"sta-authorized": "authorized",
+	"disassoc":       "disconnected",
+	"deauth":         "disconnected",
+}
+
+var state = struct {
+	mu       sync.Mutex
+	cfg      Config
+	publish  func(*Event) error
+	seq      int64
+	dropped  int64
+	second   int64 // Unix second of the rate counter
+	inSecond int
+}{}
+
+// Configure starts the client event stream when enabled
+func Configure(ctx context.Context, cfg Config, publish func(*Event) error) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.MaxRate <= 0 {
+		cfg.MaxRate = DefaultMaxRate
+	}
+	state.mu.Lock()
+	state.cfg = cfg
+	state.publish = publish
+	state.mu.Unlock()
+
+	go watchHostapd(ctx)
+	go listenLoop(ctx)
+}
+
+// emit stamps ev and publishes it unless the rate cap is reached
+func emit(ev *Event) {
+	now := time.Now()
+	state.mu.Lock()
+	if sec := now.Unix(); sec != state.second {
+		state.second, state.inSecond = sec, 0
+	}
+	state.inSecond++
+	if state.inSecond > state.cfg.MaxRate {
+		state.dropped++
+		state.mu.Unlock()
+		return
+	}
+	state.seq++
+	ev.Type, ev.Seq, ev.Ts, ev.Dropped = "client", state.seq, now.UnixMilli(), state.dropped
+	state.dropped = 0
+	publish := state.publish
+	state.mu.Unlock()
+
+	if err := publish(ev); err != nil {
+		logger.Debug("Failed to publish client event", "event", ev.Event, "error", err)
+	}
+}
+
+// subscriber is the "ubus subscribe" running on one hostapd object
+type subscriber struct {
+	id     string // ubus object ID; a new one means hostapd recreated the object
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (s *subscriber) running() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// watchHostapd keeps one subscriber on every hostapd interface; the notifications
+// of "ubus subscribe" don't name their object, so each needs its own
+func watchHostapd(ctx context.Context) {
+	defer crash.Recover("client events")
+	subscribers := map[string]*subscriber{}
+	ticker := time.NewTicker(refreshEvery)
+	defer ticker.Stop()
+	for {
+		objects, err := ubus.Objects("hostapd.*")
+		if err != nil {
+			logger.Warn("Cannot list hostapd interfaces", "error", err)
+		}
+		seen := map[string]bool{}
+		for _, obj := range objects {
+			seen[obj.Name] = true
+			if s := subscribers[obj.Name]; s != nil {
+				if s.id == obj.ID && s.running() {
+					continue
+				}
+				s.cancel()
+			}
+			subCtx, cancel := context.WithCancel(ctx)
+			s := &subscriber{id: obj.ID, cancel: cancel, done: make(chan struct{})}
+			subscribers[obj.Name] = s
+			go func(name string) {
+				defer crash.Recover("client events subscribe")
+				defer close(s.done)
+				if err := subscribe(subCtx, name); err != nil && subCtx.Err() == nil {
+					logger.Warn("Client event subscription ended", "object", name, "error", err)
+				}
+			}(obj.Name)
+		}
+		for name, s := range subscribers {
+			if err == nil && !seen[name] {
+				s.cancel()
+				delete(subscribers, name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// subscribe publishes the notifications of one hostapd object until ctx is cancelled
+func subscribe(ctx context.Context, object string) error {
+	iface := strings.TrimPrefix(object, "hostapd.")
+	var ssid, bnd string
+	if status, err := ubus.Call(object, "get_status", nil); err == nil {
+		ssid, _ = status["ssid"].(string)
+		freq, _ := status["freq"].(float64)
+		bnd = band(int(freq))
+	}
+
+	cmd := exec.CommandContext(ctx, "ubus", "subscribe", object)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Wait()
+
+	dec := json.NewDecoder(stdout)
+	for {
+		var notification map[string]struct {
+			Address string `json:"address"`
+			Signal  int    `json:"signal"`
+			Freq    int    `json:"freq"`
+		}
+		if err := dec.Decode(&notification); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		for typ, n := range notification {
+			name, ok := hostapdEvents[typ]
+			if !ok || n.Address == "" {
+				continue
+			}
+			ev := &Event{Event: name, Mac: strings.ToLower(n.Address), Interface: iface, SSID: ssid, Band: bnd, Signal: n.Signal}
+			if n.Freq > 0 {
+				ev.Band = band(n.Freq)
+			}
+			emit(ev)
+		}
+	}
+}
+
+// listenLoop keeps a "ubus listen" running for uspot's events. It runs whether or
+// not uspot is installed, so a portal started later is picked up
+func listenLoop(ctx context.Context) {
+	defer crash.Recover("client events listen")
+	backoff := time.Second
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) >= time.Minute {
+			backoff = time.Second
+		}
+		logger.Warn("Portal event listener failed", "error", err, "retry", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// listen publishes uspot's events, e.g. logins and logouts, as portal events
+func listen(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "ubus", "listen", uspotEvents)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Wait()
+
+	dec := json.NewDecoder(stdout)
+	for {
+		var events map[string]struct {
+			Address   string `json:"address"`
+			Mac       string `json:"mac"`
+			Interface string `json:"interface"`
+			IP        string `json:"ip"`
+		}
+		if err := dec.Decode(&events); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		for name, e := range events {
+			mac := e.Address
+			if mac == "" {
+				mac = e.Mac
+			}
+			if mac == "" {
+				continue
+			}
+			emit(&Event{Event: "portal", Portal: name, Mac: strings.ToLower(mac), Interface: e.Interface, IP: e.IP})
+		}
+	}
+}
+
+func band(freq int) string {
+	switch {
+	case freq >= 5925:
+		return "6g"
+	case freq >= 5000:
+		return "5g"
+	case freq > 0:
+		return "2g"
+	}
+	return ""
+}
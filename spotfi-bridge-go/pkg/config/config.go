@@ -1,61 +1,707 @@
 package config
 
 import (
-	"bufio"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"spotfi-bridge/pkg/logging"
 )
 
 // Config holds environment variables
 type Config struct {
 	RouterID   string
 	Token      string
+	TokenFile  string
 	Mac        string
-	WsURL      string
 	RouterName string
 	MQTTBroker string
+
+	// Instance names this bridge when several run for one router ID (e.g. blue/green
+	// upgrade tests); it is appended to the MQTT client ID and sent in status messages
+	Instance string
+
+	// TopicPrefix replaces "spotfi" in spotfi/router/{id}/... topics
+	TopicPrefix string
+
+	// Profile names an overlay in /etc/spotfi/profiles/{name}.env applied on top of
+	// the configuration, e.g. to point a router at staging
+	Profile string
+
+	// ProvisionURL is the zero-touch provisioning endpoint used while RouterID or Token
+	// is unset, with ClaimCode identifying the unit and ProvisionRetry the poll interval
+	ProvisionURL   string
+	ClaimCode      string
+	ProvisionRetry time.Duration
+
+	// XTunnel, RPCExec and Metrics switch off the remote shell, ubus file.exec and the
+	// metrics collectors for deployments that forbid them; all default to on
+	XTunnel bool
+	RPCExec bool
+	Metrics bool
+
+	// RPCServices overrides the allowlist of services manageable via spotfi.service
+	RPCServices []string
+
+	// RPCIdempotencyWindow is how long RPC responses are cached for duplicate suppression
+	RPCIdempotencyWindow time.Duration
+
+	// RPCMaxArgs is the largest accepted request args object in bytes
+	RPCMaxArgs int
+
+	// RPCMaxPayload is the response size in bytes above which responses are chunked
+	RPCMaxPayload int
+
+	// RPCRateLimit, RPCRateBurst and RPCMaxConcurrent configure RPC flood protection
+	RPCRateLimit     float64
+	RPCRateBurst     int
+	RPCMaxConcurrent int
+
+	// RPCUrgentWorkers and RPCUrgentPaths configure the reserved lane for urgent RPCs
+	RPCUrgentWorkers int
+	RPCUrgentPaths   []string
+
+	// RPCCache overrides the read-only cache policy as "path:method=ttl" entries
+	RPCCache []string
+
+	// RPCSigning is the request signing mode (off, hmac, ed25519) with its key,
+	// given inline or as a file, and the accepted timestamp skew
+	RPCSigning        string
+	RPCSigningKey     string
+	RPCSigningKeyFile string
+	RPCSignatureAge   time.Duration
+
+	// MetricsInterval is how often metrics are published (default 30s)
+	MetricsInterval time.Duration
+
+	// MetricsPhase offsets collections by a per-router slot within the interval
+	// (default on) and MetricsSplay adds a random delay of up to this much
+	MetricsPhase bool
+	MetricsSplay time.Duration
+
+	// MetricsDelta publishes only changed fields between full snapshots sent every
+	// MetricsFullInterval; MetricsDeadbands overrides deadbands as "path=value" entries
+	MetricsDelta        bool
+	MetricsFullInterval time.Duration
+	MetricsDeadbands    []string
+
+	// MetricsSummaryPeriod is the period of the min/max/avg summaries (-1 disables them)
+	MetricsSummaryPeriod time.Duration
+
+	// MetricsBufferSize bounds the samples kept while offline, in bytes (-1 disables buffering)
+	MetricsBufferSize int
+
+	// WANProbeTarget, WANProbeInterval, PublicIPURL and DNSProbeName configure the WAN health probe
+	WANProbeTarget   string
+	WANProbeInterval time.Duration
+	PublicIPURL      string
+	DNSProbeName     string
+
+	// MetricsPluginDir holds custom collector executables ("off" disables them),
+	// each allowed MetricsPluginTimeout per run
+	MetricsPluginDir     string
+	MetricsPluginTimeout time.Duration
+
+	// WatchedServices overrides the daemons whose health is reported in metrics
+	WatchedServices []string
+
+	// Modem selects the cellular modem backend (auto, off, mmcli, uqmi, at) and
+	// ModemDevice its QMI device or AT serial port
+	Modem       string
+	ModemDevice string
+
+	// Location configures the optional GPS reporter (see pkg/location)
+	LocationSource    string
+	LocationInterval  time.Duration
+	LocationPrecision int
+
+	// ClientEvents publishes client connect/disconnect events as they happen (see pkg/clientevents)
+	ClientEvents        bool
+	ClientEventsMaxRate int
+
+	// PortalAuth relays captive portal logins to the cloud, with a local fallback policy (see pkg/portalauth)
+	PortalAuth                bool
+	PortalAuthTimeout         time.Duration
+	PortalAuthFallback        string
+	PortalAuthFallbackSession time.Duration
+	PortalAuthCache           time.Duration
+
+	// Presence configures opt-in footfall counting from probe requests (see pkg/presence)
+	Presence             bool
+	PresenceInterval     time.Duration
+	PresenceMinSignal    int
+	PresenceSaltRotation time.Duration
+	PresenceMaxRate      int
+	PresenceMaxDevices   int
+
+	// MultiAP manages downstream OpenWrt APs on their behalf (see pkg/multiap)
+	MultiAP         bool
+	MultiAPInterval time.Duration
+
+	// PluginDir holds long-running plugin executables ("off" disables them, see pkg/plugins)
+	PluginDir string
+
+	// Journal keeps alerts, audit records, quota and client events in a file until the
+	// backend acknowledges them, at most JournalSize bytes (see pkg/journal)
+	Journal     bool
+	JournalSize int64
+
+	// Labels are attached to every metrics and event payload (site, tenant, venue, ...)
+	Labels map[string]string
+
+	// InventoryInterval is how often the device inventory is published (-1 disables it)
+	InventoryInterval time.Duration
+
+	// Discovery sweeps the LAN subnets and collects mDNS/SSDP announcements into the
+	// inventory; DiscoveryInterval schedules the sweeps (-1 for on demand only)
+	Discovery         bool
+	DiscoveryInterval time.Duration
+	DiscoverySubnets  []string
+
+	// TrafficInterval is how often the nlbwmon top talkers are published (-1 disables it)
+	TrafficInterval time.Duration
+	TrafficTop      int
+
+	// RogueAP scans for APs broadcasting the venue's SSIDs (see pkg/rogueap)
+	RogueAP         bool
+	RogueAPInterval time.Duration
+	RogueAPSSIDs    []string
+	RogueAPAllow    []string
+
+	// Speedtest configures the optional speedtest runner (see pkg/speedtest)
+	SpeedtestEndpoint    string
+	SpeedtestInterval    time.Duration
+	SpeedtestMinInterval time.Duration
+	SpeedtestMaxBytes    int64
+
+	// Update configures self-update of the bridge binary (see pkg/update)
+	UpdateURL      string
+	UpdateKey      string
+	UpdateChannel  string
+	UpdateInterval time.Duration
+	UpdateGrace    time.Duration
+
+	// InfluxTarget receives every sample in InfluxDB line protocol (udp://, tcp://, unix:// or unixgram://)
+	InfluxTarget string
+
+	// HealthListen is the loopback address of the optional HTTP health endpoint
+	HealthListen string
+
+	// Watchdog is the procd watchdog timeout (0 for the default, -1 when off)
+	Watchdog time.Duration
+
+	// PrometheusListen is the LAN or loopback address of the optional Prometheus exporter
+	PrometheusListen string
+
+	// PrometheusToken is the bearer token scrapers must send, required for a LAN address
+	PrometheusToken string
+
+	// PrometheusClientLabels exports per-client series labelled with MAC and IP
+	PrometheusClientLabels bool
+
+	// AlertRules overrides the default alert rules ("off" disables alerting)
+	AlertRules []string
+
+	// AuditLog is the RPC audit log path ("off" disables it), rotated at AuditLogSize bytes
+	AuditLog     string
+	AuditLogSize int64
+
+	// AuditTopic mirrors audit records to spotfi/router/{id}/audit
+	AuditTopic bool
+
+	// LogLevel is a level spec such as "info" or "info,rpc=debug" (see logging.ParseLevels)
+	// and LogFormat the output format, text or json
+	LogLevel  string
+	LogFormat string
+
+	// LogShip configures shipping the system log to the logs topic (see pkg/logship)
+	LogShip              bool
+	LogShipSource        string
+	LogShipSeverity      string
+	LogShipInclude       []string
+	LogShipExclude       []string
+	LogShipBatch         int
+	LogShipFlushInterval time.Duration
+	LogShipMaxRate       int
+	LogShipBacklog       int
+
+	// Version is the configuration format (see Migrate)
+	Version int
+
+	legacy   map[string]string // Values of legacy keys, consumed by Migrate
+	fromUCI  bool              // Whether /etc/config/spotfi was read, so Migrate can update it
+	warnings []string
+}
+
+// defaultConfig is the configuration before any source is applied
+func defaultConfig() Config {
+	return Config{MetricsPhase: true, XTunnel: true, RPCExec: true, Metrics: true, ClientEvents: true}
 }
 
 // LoadEnv loads .env file manually to avoid extra dependencies
-func LoadEnv() Config {
-	var config Config
-	file, err := os.Open("/etc/spotfi.env")
-	if err != nil {
+func LoadEnv() (Config, error) {
+	config := defaultConfig()
+	path := "/etc/spotfi.env"
+	if _, err := os.Stat(path); err != nil {
 		// Fallback for local testing
-		file, err = os.Open(".env")
-		if err != nil {
+		path = ".env"
+		if _, err := os.Stat(path); err != nil {
 			// It's okay if file doesn't exist, we might be using real env vars
 			// But for this specific implementation, it seems to rely on the file or manual env vars
 			// Let's just return empty and let the caller validate
-			return config
+			return config, nil
 		}
 	}
-	defer file.Close()
+	err := readEnvFile(path, config.set)
+	return config, err
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
+// LoadFile loads an env file at an explicit path
+func LoadFile(path string) (Config, error) {
+	config := defaultConfig()
+	err := readEnvFile(path, config.set)
+	return config, err
+}
+
+// set applies a single SPOTFI_* option; unknown keys are ignored. Values that do not
+// parse as the option's type (duration, number, byte size, boolean, URL) are reported
+// as errors, and an empty value restores the default
+func (c *Config) set(key, val string) error {
+	var err error
+	switch key {
+	case "SPOTFI_ROUTER_ID":
+		c.RouterID = val
+	case "SPOTFI_TOKEN":
+		c.Token = val
+	case "SPOTFI_TOKEN_FILE":
+		c.TokenFile = val
+	case "SPOTFI_MAC":
+		c.Mac = val
+	case "SPOTFI_LOG_LEVEL":
+		_, _, err = logging.ParseLevels(val)
+		c.LogLevel = val
+	case "SPOTFI_LOG_FORMAT":
+		c.LogFormat = val
+	case "SPOTFI_LOG_SHIP":
+		c.LogShip, err = parseBool(val)
+	case "SPOTFI_LOG_SHIP_SOURCE":
+		c.LogShipSource = val
+	case "SPOTFI_LOG_SHIP_SEVERITY":
+		c.LogShipSeverity = val
+	case "SPOTFI_LOG_SHIP_INCLUDE":
+		c.LogShipInclude = splitList(val)
+	case "SPOTFI_LOG_SHIP_EXCLUDE":
+		c.LogShipExclude = splitList(val)
+	case "SPOTFI_LOG_SHIP_BATCH":
+		c.LogShipBatch, err = parseInt(val)
+	case "SPOTFI_LOG_SHIP_FLUSH_INTERVAL":
+		c.LogShipFlushInterval, err = parseDuration(val)
+	case "SPOTFI_LOG_SHIP_MAX_RATE":
+		c.LogShipMaxRate, err = parseInt(val)
+	case "SPOTFI_LOG_SHIP_BACKLOG":
+		c.LogShipBacklog, err = parseInt(val)
+	case "SPOTFI_CONFIG_VERSION":
+		c.Version, err = parseInt(val)
+	case "SPOTFI_WS_URL":
+		// Only kept for Migrate
+		err = checkURL(val, "ws", "wss")
+		if c.legacy == nil {
+			c.legacy = map[string]string{}
+		}
+		c.legacy[key] = val
+	case "SPOTFI_ROUTER_NAME":
+		c.RouterName = val
+	case "SPOTFI_MQTT_BROKER":
+		err = checkURL(val, "tcp", "mqtt", "ssl", "tls", "mqtts", "tcps", "ws", "wss")
+		c.MQTTBroker = val
+	case "SPOTFI_INSTANCE":
+		if val != "" && !validName(val) {
+			err = fmt.Errorf("invalid instance name %q (use letters, digits, - and _)", val)
+		}
+		c.Instance = val
+	case "SPOTFI_TOPIC_PREFIX":
+		if val != "" && (strings.ContainsAny(val, "+#") || strings.HasPrefix(val, "/") || strings.HasSuffix(val, "/")) {
+			err = fmt.Errorf("invalid topic prefix %q (no wildcards or leading/trailing slash)", val)
+		}
+		c.TopicPrefix = val
+	case "SPOTFI_PROFILE":
+		if val != "" && !validName(val) {
+			err = fmt.Errorf("invalid profile name %q (use letters, digits, - and _)", val)
+		}
+		c.Profile = val
+	case "SPOTFI_PROVISION_URL":
+		err = checkURL(val, "http", "https")
+		c.ProvisionURL = val
+	case "SPOTFI_CLAIM_CODE":
+		c.ClaimCode = val
+	case "SPOTFI_PROVISION_RETRY":
+		c.ProvisionRetry, err = parseDuration(val)
+	case "SPOTFI_RPC_SERVICES":
+		c.RPCServices = splitList(val)
+	case "SPOTFI_RPC_IDEMPOTENCY_WINDOW":
+		c.RPCIdempotencyWindow, err = parseDuration(val)
+	case "SPOTFI_RPC_MAX_ARGS":
+		c.RPCMaxArgs, err = parseSizeInt(val)
+	case "SPOTFI_RPC_MAX_PAYLOAD":
+		c.RPCMaxPayload, err = parseSizeInt(val)
+	case "SPOTFI_RPC_RATE_LIMIT":
+		c.RPCRateLimit, err = parseFloat(val)
+	case "SPOTFI_RPC_RATE_BURST":
+		c.RPCRateBurst, err = parseInt(val)
+	case "SPOTFI_RPC_MAX_CONCURRENT":
+		c.RPCMaxConcurrent, err = parseInt(val)
+	case "SPOTFI_RPC_URGENT_WORKERS":
+		c.RPCUrgentWorkers, err = parseInt(val)
+	case "SPOTFI_RPC_URGENT_PATHS":
+		c.RPCUrgentPaths = splitList(val)
+	case "SPOTFI_RPC_CACHE":
+		c.RPCCache = splitList(val)
+	case "SPOTFI_RPC_SIGNING":
+		c.RPCSigning = val
+	case "SPOTFI_RPC_SIGNING_KEY":
+		c.RPCSigningKey = val
+	case "SPOTFI_RPC_SIGNING_KEY_FILE":
+		c.RPCSigningKeyFile = val
+	case "SPOTFI_RPC_SIGNATURE_MAX_AGE":
+		c.RPCSignatureAge, err = parseDuration(val)
+	case "SPOTFI_XTUNNEL":
+		c.XTunnel, err = parseDefaultBool(val)
+	case "SPOTFI_RPC_EXEC":
+		c.RPCExec, err = parseDefaultBool(val)
+	case "SPOTFI_METRICS":
+		c.Metrics, err = parseDefaultBool(val)
+	case "SPOTFI_METRICS_INTERVAL":
+		c.MetricsInterval, err = parseDuration(val)
+	case "SPOTFI_METRICS_PHASE":
+		c.MetricsPhase, err = parseDefaultBool(val)
+	case "SPOTFI_METRICS_SPLAY":
+		c.MetricsSplay, err = parseDuration(val)
+	case "SPOTFI_METRICS_DELTA":
+		c.MetricsDelta, err = parseBool(val)
+	case "SPOTFI_METRICS_FULL_INTERVAL":
+		c.MetricsFullInterval, err = parseDuration(val)
+	case "SPOTFI_METRICS_DEADBANDS":
+		c.MetricsDeadbands = splitList(val)
+	case "SPOTFI_METRICS_SUMMARY_PERIOD":
+		c.MetricsSummaryPeriod, err = parseOptionalDuration(val)
+	case "SPOTFI_METRICS_BUFFER_SIZE":
+		c.MetricsBufferSize, err = parseSizeInt(val)
+	case "SPOTFI_WAN_PROBE_TARGET":
+		c.WANProbeTarget = val
+	case "SPOTFI_WAN_PROBE_INTERVAL":
+		c.WANProbeInterval, err = parseDuration(val)
+	case "SPOTFI_PUBLIC_IP_URL":
+		if val != "off" {
+			err = checkURL(val, "http", "https")
+		}
+		c.PublicIPURL = val
+	case "SPOTFI_DNS_PROBE_NAME":
+		c.DNSProbeName = val
+	case "SPOTFI_METRICS_PLUGIN_DIR":
+		c.MetricsPluginDir = val
+	case "SPOTFI_METRICS_PLUGIN_TIMEOUT":
+		c.MetricsPluginTimeout, err = parseDuration(val)
+	case "SPOTFI_WATCHED_SERVICES":
+		c.WatchedServices = splitList(val)
+	case "SPOTFI_MODEM":
+		c.Modem = val
+	case "SPOTFI_MODEM_DEVICE":
+		c.ModemDevice = val
+	case "SPOTFI_LOCATION_SOURCE":
+		if strings.Contains(val, "://") {
+			err = checkURL(val, "gpsd")
+		}
+		c.LocationSource = val
+	case "SPOTFI_LOCATION_INTERVAL":
+		c.LocationInterval, err = parseDuration(val)
+	case "SPOTFI_LOCATION_PRECISION":
+		c.LocationPrecision, err = parseInt(val)
+	case "SPOTFI_CLIENT_EVENTS":
+		c.ClientEvents, err = parseDefaultBool(val)
+	case "SPOTFI_CLIENT_EVENTS_MAX_RATE":
+		c.ClientEventsMaxRate, err = parseInt(val)
+	case "SPOTFI_PORTAL_AUTH":
+		c.PortalAuth, err = parseBool(val)
+	case "SPOTFI_PORTAL_AUTH_TIMEOUT":
+		c.PortalAuthTimeout, err = parseDuration(val)
+	case "SPOTFI_PORTAL_AUTH_FALLBACK":
+		c.PortalAuthFallback = val
+	case "SPOTFI_PORTAL_AUTH_FALLBACK_SESSION":
+		c.PortalAuthFallbackSession, err = parseDuration(val)
+	case "SPOTFI_PORTAL_AUTH_CACHE":
+		c.PortalAuthCache, err = parseDuration(val)
+	case "SPOTFI_PRESENCE":
+		c.Presence, err = parseBool(val)
+	case "SPOTFI_PRESENCE_INTERVAL":
+		c.PresenceInterval, err = parseDuration(val)
+	case "SPOTFI_PRESENCE_MIN_SIGNAL":
+		c.PresenceMinSignal, err = parseInt(val)
+	case "SPOTFI_PRESENCE_SALT_ROTATION":
+		c.PresenceSaltRotation, err = parseDuration(val)
+	case "SPOTFI_PRESENCE_MAX_RATE":
+		c.PresenceMaxRate, err = parseInt(val)
+	case "SPOTFI_PRESENCE_MAX_DEVICES":
+		c.PresenceMaxDevices, err = parseInt(val)
+	case "SPOTFI_MULTI_AP":
+		c.MultiAP, err = parseBool(val)
+	case "SPOTFI_MULTI_AP_INTERVAL":
+		c.MultiAPInterval, err = parseDuration(val)
+	case "SPOTFI_PLUGIN_DIR":
+		c.PluginDir = val
+	case "SPOTFI_JOURNAL":
+		c.Journal, err = parseBool(val)
+	case "SPOTFI_JOURNAL_SIZE":
+		c.JournalSize, err = parseSize(val)
+	case "SPOTFI_INFLUX_TARGET":
+		err = checkURL(val, "udp", "tcp", "unix", "unixgram")
+		c.InfluxTarget = val
+	case "SPOTFI_LABELS":
+		c.Labels = parseLabels(val)
+	case "SPOTFI_INVENTORY_INTERVAL":
+		c.InventoryInterval, err = parseOptionalDuration(val)
+	case "SPOTFI_DISCOVERY":
+		c.Discovery, err = parseBool(val)
+	case "SPOTFI_DISCOVERY_INTERVAL":
+		c.DiscoveryInterval, err = parseOptionalDuration(val)
+	case "SPOTFI_DISCOVERY_SUBNETS":
+		c.DiscoverySubnets = splitList(val)
+		for _, s := range c.DiscoverySubnets {
+			_, subnet, cidrErr := net.ParseCIDR(s)
+			if cidrErr != nil || subnet.IP.To4() == nil {
+				err = fmt.Errorf("invalid IPv4 subnet: %q", s)
+			} else if ones, _ := subnet.Mask.Size(); ones < 22 {
+				err = fmt.Errorf("subnet %s is larger than a /22", s)
+			}
+		}
+	case "SPOTFI_TRAFFIC_INTERVAL":
+		c.TrafficInterval, err = parseOptionalDuration(val)
+	case "SPOTFI_TRAFFIC_TOP":
+		c.TrafficTop, err = parseInt(val)
+	case "SPOTFI_ROGUE_AP":
+		c.RogueAP, err = parseBool(val)
+	case "SPOTFI_ROGUE_AP_INTERVAL":
+		c.RogueAPInterval, err = parseDuration(val)
+	case "SPOTFI_ROGUE_AP_SSIDS":
+		c.RogueAPSSIDs = splitList(val)
+	case "SPOTFI_ROGUE_AP_ALLOW":
+		c.RogueAPAllow = nil
+		for _, entry := range splitList(val) {
+			entry = strings.ToLower(strings.ReplaceAll(entry, "-", ":"))
+			if !isMACPrefix(entry) {
+				err = fmt.Errorf("invalid BSSID or prefix: %q", entry)
+			}
+			c.RogueAPAllow = append(c.RogueAPAllow, entry)
+		}
+	case "SPOTFI_SPEEDTEST_ENDPOINT":
+		err = checkURL(val, "http", "https", "iperf3")
+		c.SpeedtestEndpoint = val
+	case "SPOTFI_SPEEDTEST_INTERVAL":
+		c.SpeedtestInterval, err = parseDuration(val)
+	case "SPOTFI_SPEEDTEST_MIN_INTERVAL":
+		c.SpeedtestMinInterval, err = parseDuration(val)
+	case "SPOTFI_SPEEDTEST_MAX_BYTES":
+		c.SpeedtestMaxBytes, err = parseSize(val)
+	case "SPOTFI_UPDATE_URL":
+		err = checkURL(val, "http", "https")
+		c.UpdateURL = val
+	case "SPOTFI_UPDATE_KEY":
+		c.UpdateKey = val
+	case "SPOTFI_UPDATE_CHANNEL":
+		c.UpdateChannel = val
+	case "SPOTFI_UPDATE_INTERVAL":
+		c.UpdateInterval, err = parseDuration(val)
+	case "SPOTFI_UPDATE_GRACE":
+		c.UpdateGrace, err = parseDuration(val)
+	case "SPOTFI_HEALTH_LISTEN":
+		if val != "" {
+			_, _, err = net.SplitHostPort(val)
+		}
+		c.HealthListen = val
+	case "SPOTFI_WATCHDOG":
+		c.Watchdog, err = parseOptionalDuration(val)
+	case "SPOTFI_PROMETHEUS_LISTEN":
+		if val != "" {
+			_, _, err = net.SplitHostPort(val)
+		}
+		c.PrometheusListen = val
+	case "SPOTFI_PROMETHEUS_TOKEN":
+		c.PrometheusToken = val
+	case "SPOTFI_PROMETHEUS_CLIENT_LABELS":
+		c.PrometheusClientLabels, err = parseBool(val)
+	case "SPOTFI_ALERT_RULES":
+		c.AlertRules = splitList(val)
+	case "SPOTFI_AUDIT_LOG":
+		c.AuditLog = val
+	case "SPOTFI_AUDIT_LOG_SIZE":
+		c.AuditLogSize, err = parseSize(val)
+	case "SPOTFI_AUDIT_TOPIC":
+		c.AuditTopic, err = parseBool(val)
+	}
+	if o, ok := optionsByKey[key]; ok && err == nil {
+		err = o.checkValue(val)
+		if o.deprecated != "" && val != "" {
+			c.deprecate(o)
+		}
+	}
+	return err
+}
+
+// splitList parses a comma or space separated list value
+func splitList(val string) []string {
+	return strings.FieldsFunc(val, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// parseLabels reads comma-separated key=value pairs; values may contain spaces
+func parseLabels(val string) map[string]string {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(val, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
 			continue
 		}
-		key := strings.TrimSpace(parts[0])
-		val := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
-
-		switch key {
-		case "SPOTFI_ROUTER_ID":
-			config.RouterID = val
-		case "SPOTFI_TOKEN":
-			config.Token = val
-		case "SPOTFI_MAC":
-			config.Mac = val
-		case "SPOTFI_WS_URL":
-			config.WsURL = val
-		case "SPOTFI_ROUTER_NAME":
-			config.RouterName = val
-		case "SPOTFI_MQTT_BROKER":
-			config.MQTTBroker = val
-		}
-	}
-	return config
+		labels[k] = strings.TrimSpace(v)
+	}
+	return labels
+}
+
+// parseDuration accepts Go durations ("90s", "5m") or plain seconds ("300")
+func parseDuration(val string) (time.Duration, error) {
+	if val == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.Atoi(val); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q (use e.g. 30s, 5m, 1h or plain seconds)", val)
+	}
+	return d, nil
+}
+
+// parseOptionalDuration is parseDuration that also accepts "off", returned as -1
+func parseOptionalDuration(val string) (time.Duration, error) {
+	if val == "off" {
+		return -1, nil
+	}
+	return parseDuration(val)
+}
+
+// parseInt accepts a whole number
+func parseInt(val string) (int, error) {
+	if val == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", val)
+	}
+	return n, nil
+}
+
+// parseFloat accepts a decimal number
+func parseFloat(val string) (float64, error) {
+	if val == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", val)
+	}
+	return f, nil
+}
+
+// sizeUnits are the accepted byte size suffixes; K, M and G are binary like the rest of OpenWrt
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// parseSize accepts a byte count, optionally with a unit ("262144", "256K", "1MiB");
+// -1 is passed through for the settings where it disables the feature
+func parseSize(val string) (int64, error) {
+	if val == "" {
+		return 0, nil
+	}
+	num, factor := val, int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(val), strings.ToUpper(u.suffix)) {
+			num, factor = strings.TrimSpace(val[:len(val)-len(u.suffix)]), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || (n < 0 && !(n == -1 && factor == 1)) {
+		return 0, fmt.Errorf("invalid size %q (use bytes or a K, M or G suffix)", val)
+	}
+	return n * factor, nil
+}
+
+// parseSizeInt is parseSize for int settings
+func parseSizeInt(val string) (int, error) {
+	n, err := parseSize(val)
+	return int(n), err
+}
+
+// parseBool accepts the usual UCI/env spellings of true and false
+func parseBool(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "1", "true", "yes", "on", "enabled":
+		return true, nil
+	case "", "0", "false", "no", "off", "disabled":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q (use true or false)", val)
+}
+
+// parseDefaultBool is parseBool for options that are on by default
+func parseDefaultBool(val string) (bool, error) {
+	if val == "" {
+		return true, nil
+	}
+	return parseBool(val)
+}
+
+// checkURL requires a URL with a host (or a path for unix sockets) and one of schemes
+func checkURL(val string, schemes ...string) error {
+	if val == "" {
+		return nil
+	}
+	u, err := url.Parse(val)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q", val)
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			if u.Host == "" && u.Path == "" {
+				return fmt.Errorf("invalid URL %q: missing host", val)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid URL %q: scheme must be %s", val, strings.Join(schemes, ", "))
+}
+
+// isMACPrefix reports whether s is a MAC address or its first 3 to 5 octets, e.g. "aa:bb:cc"
+func isMACPrefix(s string) bool {
+	octets := strings.Split(s, ":")
+	if len(octets) < 3 || len(octets) > 6 {
+		return false
+	}
+	for _, o := range octets {
+		if _, err := strconv.ParseUint(o, 16, 8); err != nil || len(o) != 2 {
+			return false
+		}
+	}
+	return true
 }
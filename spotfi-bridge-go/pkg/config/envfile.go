@@ -0,0 +1,133 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxIncludeDepth bounds nested includes
+const maxIncludeDepth = 8
+
+// envVarRef matches ${VAR} and ${VAR:-default}
+var envVarRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// envParser reads KEY=value env files. Values may reference keys set earlier (in this
+// file or an included one) or the process environment as ${VAR} or ${VAR:-default},
+// except in single quotes. "include <path>" or ". <path>" reads another file in place,
+// relative to the including file
+type envParser struct {
+	apply func(key, val string) error
+	vars  map[string]string // Keys set so far
+	stack []string          // Files being read, to reject include cycles
+}
+
+// readEnvFile applies every KEY=value of an env file and its includes to apply,
+// collecting the errors of every bad line
+func readEnvFile(path string, apply func(key, val string) error) error {
+	p := &envParser{apply: apply, vars: map[string]string{}}
+	return p.file(path)
+}
+
+func (p *envParser) file(path string) error {
+	for _, f := range p.stack {
+		if f == path {
+			return fmt.Errorf("%s: include cycle", path)
+		}
+	}
+	if len(p.stack) >= maxIncludeDepth {
+		return fmt.Errorf("%s: includes nested deeper than %d", path, maxIncludeDepth)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	p.stack = append(p.stack, path)
+	defer func() { p.stack = p.stack[:len(p.stack)-1] }()
+
+	var errs []error
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if inc, ok := includePath(line); ok {
+			inc, err := p.expand(strings.Trim(inc, `"'`))
+			if err == nil {
+				if !filepath.IsAbs(inc) {
+					inc = filepath.Join(filepath.Dir(path), inc)
+				}
+				err = p.file(inc)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", n, err))
+			}
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimPrefix(strings.TrimSpace(key), "export ")
+		raw = strings.TrimSpace(raw)
+		val := strings.Trim(raw, `"'`)
+		if !strings.HasPrefix(raw, "'") {
+			var err error
+			if val, err = p.expand(val); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %s: %w", n, key, err))
+				continue
+			}
+		}
+		p.vars[key] = val
+		if err := p.apply(key, val); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %s: %w", n, key, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// includePath recognizes "include <path>" and the shell's ". <path>"
+func includePath(line string) (string, bool) {
+	for _, prefix := range []string{"include ", ". "} {
+		if rest, ok := strings.CutPrefix(line, prefix); ok {
+			return strings.TrimSpace(rest), true
+		}
+	}
+	return "", false
+}
+
+// expand substitutes ${VAR} references; an unset variable without a default is an error
+func (p *envParser) expand(val string) (string, error) {
+	var missing []string
+	out := envVarRef.ReplaceAllStringFunc(val, func(ref string) string {
+		m := envVarRef.FindStringSubmatch(ref)
+		if v, ok := p.vars[m[1]]; ok {
+			return v
+		}
+		if v, ok := os.LookupEnv(m[1]); ok {
+			return v
+		}
+		if strings.Contains(ref, ":-") {
+			return m[2]
+		}
+		missing = append(missing, m[1])
+		return ""
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("${%s} is not set", strings.Join(missing, "}, ${"))
+	}
+	return out, nil
+}
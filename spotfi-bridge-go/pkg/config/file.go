@@ -0,0 +1,320 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileSchemaVersion is the newest structured config layout this bridge understands
+const FileSchemaVersion = 1
+
+// filePaths are where the optional structured config is looked for; JSON documents
+// are read by the same parser since YAML is a superset of JSON
+var filePaths = []string{"/etc/spotfi/config.yaml", "/etc/spotfi/config.yml", "/etc/spotfi/config.json"}
+
+// fileFields maps the nested keys of the structured config to their env file keys
+var fileFields = []struct{ path, key string }{
+	{"router.id", "SPOTFI_ROUTER_ID"},
+	{"router.token", "SPOTFI_TOKEN"},
+	{"router.tokenFile", "SPOTFI_TOKEN_FILE"},
+	{"router.mac", "SPOTFI_MAC"},
+	{"router.name", "SPOTFI_ROUTER_NAME"},
+	{"mqtt.broker", "SPOTFI_MQTT_BROKER"},
+	{"mqtt.topicPrefix", "SPOTFI_TOPIC_PREFIX"},
+	{"mqtt.instance", "SPOTFI_INSTANCE"},
+	{"health.listen", "SPOTFI_HEALTH_LISTEN"},
+	{"health.watchdog", "SPOTFI_WATCHDOG"},
+	{"profile", "SPOTFI_PROFILE"},
+	{"log.level", "SPOTFI_LOG_LEVEL"},
+	{"log.format", "SPOTFI_LOG_FORMAT"},
+	{"log.ship.enabled", "SPOTFI_LOG_SHIP"},
+	{"log.ship.source", "SPOTFI_LOG_SHIP_SOURCE"},
+	{"log.ship.severity", "SPOTFI_LOG_SHIP_SEVERITY"},
+	{"log.ship.include", "SPOTFI_LOG_SHIP_INCLUDE"},
+	{"log.ship.exclude", "SPOTFI_LOG_SHIP_EXCLUDE"},
+	{"log.ship.batch", "SPOTFI_LOG_SHIP_BATCH"},
+	{"log.ship.flushInterval", "SPOTFI_LOG_SHIP_FLUSH_INTERVAL"},
+	{"log.ship.maxRate", "SPOTFI_LOG_SHIP_MAX_RATE"},
+	{"log.ship.backlog", "SPOTFI_LOG_SHIP_BACKLOG"},
+	{"labels", "SPOTFI_LABELS"},
+	{"provision.url", "SPOTFI_PROVISION_URL"},
+	{"provision.claimCode", "SPOTFI_CLAIM_CODE"},
+	{"provision.retry", "SPOTFI_PROVISION_RETRY"},
+
+	{"xtunnel.enabled", "SPOTFI_XTUNNEL"},
+
+	{"metrics.enabled", "SPOTFI_METRICS"},
+	{"metrics.interval", "SPOTFI_METRICS_INTERVAL"},
+	{"metrics.phase", "SPOTFI_METRICS_PHASE"},
+	{"metrics.splay", "SPOTFI_METRICS_SPLAY"},
+	{"metrics.delta", "SPOTFI_METRICS_DELTA"},
+	{"metrics.fullInterval", "SPOTFI_METRICS_FULL_INTERVAL"},
+	{"metrics.deadbands", "SPOTFI_METRICS_DEADBANDS"},
+	{"metrics.summaryPeriod", "SPOTFI_METRICS_SUMMARY_PERIOD"},
+	{"metrics.bufferSize", "SPOTFI_METRICS_BUFFER_SIZE"},
+	{"metrics.watchedServices", "SPOTFI_WATCHED_SERVICES"},
+	{"metrics.plugins.dir", "SPOTFI_METRICS_PLUGIN_DIR"},
+	{"metrics.plugins.timeout", "SPOTFI_METRICS_PLUGIN_TIMEOUT"},
+	{"metrics.wanProbe.target", "SPOTFI_WAN_PROBE_TARGET"},
+	{"metrics.wanProbe.interval", "SPOTFI_WAN_PROBE_INTERVAL"},
+	{"metrics.wanProbe.publicIpUrl", "SPOTFI_PUBLIC_IP_URL"},
+	{"metrics.wanProbe.dnsName", "SPOTFI_DNS_PROBE_NAME"},
+	{"metrics.modem.type", "SPOTFI_MODEM"},
+	{"metrics.modem.device", "SPOTFI_MODEM_DEVICE"},
+	{"metrics.prometheusListen", "SPOTFI_PROMETHEUS_LISTEN"},
+	{"metrics.prometheusToken", "SPOTFI_PROMETHEUS_TOKEN"},
+	{"metrics.prometheusClientLabels", "SPOTFI_PROMETHEUS_CLIENT_LABELS"},
+	{"metrics.influxTarget", "SPOTFI_INFLUX_TARGET"},
+	{"metrics.alertRules", "SPOTFI_ALERT_RULES"},
+
+	{"rpc.exec", "SPOTFI_RPC_EXEC"},
+	{"rpc.services", "SPOTFI_RPC_SERVICES"},
+	{"rpc.idempotencyWindow", "SPOTFI_RPC_IDEMPOTENCY_WINDOW"},
+	{"rpc.maxArgs", "SPOTFI_RPC_MAX_ARGS"},
+	{"rpc.maxPayload", "SPOTFI_RPC_MAX_PAYLOAD"},
+	{"rpc.rateLimit", "SPOTFI_RPC_RATE_LIMIT"},
+	{"rpc.rateBurst", "SPOTFI_RPC_RATE_BURST"},
+	{"rpc.maxConcurrent", "SPOTFI_RPC_MAX_CONCURRENT"},
+	{"rpc.urgentWorkers", "SPOTFI_RPC_URGENT_WORKERS"},
+	{"rpc.urgentPaths", "SPOTFI_RPC_URGENT_PATHS"},
+	{"rpc.cache", "SPOTFI_RPC_CACHE"},
+	{"rpc.signing.mode", "SPOTFI_RPC_SIGNING"},
+	{"rpc.signing.key", "SPOTFI_RPC_SIGNING_KEY"},
+	{"rpc.signing.keyFile", "SPOTFI_RPC_SIGNING_KEY_FILE"},
+	{"rpc.signing.maxAge", "SPOTFI_RPC_SIGNATURE_MAX_AGE"},
+	{"rpc.audit.log", "SPOTFI_AUDIT_LOG"},
+	{"rpc.audit.logSize", "SPOTFI_AUDIT_LOG_SIZE"},
+	{"rpc.audit.topic", "SPOTFI_AUDIT_TOPIC"},
+
+	{"location.source", "SPOTFI_LOCATION_SOURCE"},
+	{"location.interval", "SPOTFI_LOCATION_INTERVAL"},
+	{"location.precision", "SPOTFI_LOCATION_PRECISION"},
+
+	{"clientEvents.enabled", "SPOTFI_CLIENT_EVENTS"},
+	{"clientEvents.maxRate", "SPOTFI_CLIENT_EVENTS_MAX_RATE"},
+
+	{"portalAuth.enabled", "SPOTFI_PORTAL_AUTH"},
+	{"portalAuth.timeout", "SPOTFI_PORTAL_AUTH_TIMEOUT"},
+	{"portalAuth.fallback", "SPOTFI_PORTAL_AUTH_FALLBACK"},
+	{"portalAuth.fallbackSession", "SPOTFI_PORTAL_AUTH_FALLBACK_SESSION"},
+	{"portalAuth.cache", "SPOTFI_PORTAL_AUTH_CACHE"},
+
+	{"presence.enabled", "SPOTFI_PRESENCE"},
+	{"presence.interval", "SPOTFI_PRESENCE_INTERVAL"},
+	{"presence.minSignal", "SPOTFI_PRESENCE_MIN_SIGNAL"},
+	{"presence.saltRotation", "SPOTFI_PRESENCE_SALT_ROTATION"},
+	{"presence.maxRate", "SPOTFI_PRESENCE_MAX_RATE"},
+	{"presence.maxDevices", "SPOTFI_PRESENCE_MAX_DEVICES"},
+	{"multiAP.enabled", "SPOTFI_MULTI_AP"},
+	{"multiAP.interval", "SPOTFI_MULTI_AP_INTERVAL"},
+	{"plugins.dir", "SPOTFI_PLUGIN_DIR"},
+	{"journal.enabled", "SPOTFI_JOURNAL"},
+	{"journal.size", "SPOTFI_JOURNAL_SIZE"},
+	{"inventory.interval", "SPOTFI_INVENTORY_INTERVAL"},
+	{"inventory.discovery.enabled", "SPOTFI_DISCOVERY"},
+	{"inventory.discovery.interval", "SPOTFI_DISCOVERY_INTERVAL"},
+	{"inventory.discovery.subnets", "SPOTFI_DISCOVERY_SUBNETS"},
+	{"traffic.interval", "SPOTFI_TRAFFIC_INTERVAL"},
+	{"traffic.top", "SPOTFI_TRAFFIC_TOP"},
+	{"rogueAP.enabled", "SPOTFI_ROGUE_AP"},
+	{"rogueAP.interval", "SPOTFI_ROGUE_AP_INTERVAL"},
+	{"rogueAP.ssids", "SPOTFI_ROGUE_AP_SSIDS"},
+	{"rogueAP.allow", "SPOTFI_ROGUE_AP_ALLOW"},
+	{"speedtest.endpoint", "SPOTFI_SPEEDTEST_ENDPOINT"},
+	{"speedtest.interval", "SPOTFI_SPEEDTEST_INTERVAL"},
+	{"speedtest.minInterval", "SPOTFI_SPEEDTEST_MIN_INTERVAL"},
+	{"speedtest.maxBytes", "SPOTFI_SPEEDTEST_MAX_BYTES"},
+	{"update.url", "SPOTFI_UPDATE_URL"},
+	{"update.key", "SPOTFI_UPDATE_KEY"},
+	{"update.channel", "SPOTFI_UPDATE_CHANNEL"},
+	{"update.interval", "SPOTFI_UPDATE_INTERVAL"},
+	{"update.grace", "SPOTFI_UPDATE_GRACE"},
+}
+
+// fileSchema is fileFields as a tree: each value is an env key or a nested section
+func fileSchema() map[string]interface{} {
+	root := map[string]interface{}{}
+	for _, f := range fileFields {
+		parts := strings.Split(f.path, ".")
+		section := root
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := section[p].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				section[p] = next
+			}
+			section = next
+		}
+		section[parts[len(parts)-1]] = f.key
+	}
+	return root
+}
+
+// Load reads, in increasing precedence, the env file, /etc/config/spotfi and the
+// structured config (path, or the first of /etc/spotfi/config.{yaml,yml,json} when
+// empty), and returns the UCI and structured sources that were found
+func Load(path string) (Config, []string, error) {
+	config, err := LoadEnv()
+	if err != nil {
+		return config, nil, err
+	}
+	var sources []string
+	found, err := config.readUCI()
+	if err != nil {
+		return config, nil, fmt.Errorf("%s: %w", uciPath, err)
+	}
+	if found {
+		config.fromUCI = true
+		sources = append(sources, uciPath)
+	}
+
+	if path == "" {
+		for _, p := range filePaths {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return config, sources, nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, sources, err
+	}
+	if err := config.readFile(data); err != nil {
+		return config, sources, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, append(sources, path), nil
+}
+
+// readFile applies a structured config document, rejecting unknown keys and
+// values of the wrong shape with the line they appear on
+func (c *Config) readFile(data []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return fmt.Errorf("empty document")
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping of sections", root.Line)
+	}
+
+	version := 0
+	rest := &yaml.Node{Kind: yaml.MappingNode}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i], root.Content[i+1]
+		if k.Value != "schemaVersion" {
+			rest.Content = append(rest.Content, k, v)
+			continue
+		}
+		if err := v.Decode(&version); err != nil || version < 1 {
+			return fmt.Errorf("line %d: schemaVersion must be a positive integer", v.Line)
+		}
+	}
+	if version == 0 {
+		return fmt.Errorf("missing schemaVersion (this bridge reads version %d)", FileSchemaVersion)
+	}
+	if version > FileSchemaVersion {
+		return fmt.Errorf("schemaVersion %d is newer than this bridge supports (%d)", version, FileSchemaVersion)
+	}
+
+	known := map[string]option{}
+	for _, o := range options {
+		known[o.key] = o
+	}
+	return c.readSection(rest, fileSchema(), "", known)
+}
+
+// readSection applies the keys of one mapping node against its part of the schema
+func (c *Config) readSection(node *yaml.Node, schema map[string]interface{}, prefix string, known map[string]option) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: %s must be a section", node.Line, prefix)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if v.Kind == yaml.AliasNode {
+			v = v.Alias
+		}
+		path := k.Value
+		if prefix != "" {
+			path = prefix + "." + k.Value
+		}
+		switch entry := schema[k.Value].(type) {
+		case map[string]interface{}:
+			if err := c.readSection(v, entry, path, known); err != nil {
+				return err
+			}
+		case string:
+			val, err := fileValue(v, known[entry], path)
+			if err != nil {
+				return err
+			}
+			if err := c.set(entry, val); err != nil {
+				return fmt.Errorf("line %d: %s: %w", v.Line, path, err)
+			}
+		default:
+			where, expected := "at the top level", sortedKeys(schema)
+			if prefix != "" {
+				where = "in " + prefix
+			} else {
+				expected = append([]string{"schemaVersion"}, expected...)
+			}
+			return fmt.Errorf("line %d: unknown key %q %s (expected one of: %s)", k.Line, k.Value, where, strings.Join(expected, ", "))
+		}
+	}
+	return nil
+}
+
+// fileValue flattens a leaf node into the env file form understood by set
+func fileValue(v *yaml.Node, o option, path string) (string, error) {
+	switch v.Kind {
+	case yaml.ScalarNode:
+		if o.boolean && v.Tag != "!!bool" {
+			return "", fmt.Errorf("line %d: %s must be true or false, got %q", v.Line, path, v.Value)
+		}
+		return v.Value, nil
+	case yaml.SequenceNode:
+		if !o.list {
+			return "", fmt.Errorf("line %d: %s takes a single value, not a list", v.Line, path)
+		}
+		items := make([]string, 0, len(v.Content))
+		for _, item := range v.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("line %d: %s entries must be plain values", item.Line, path)
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), nil
+	case yaml.MappingNode:
+		if o.key != "SPOTFI_LABELS" {
+			return "", fmt.Errorf("line %d: %s takes a value, not a section", v.Line, path)
+		}
+		pairs := make([]string, 0, len(v.Content)/2)
+		for i := 0; i+1 < len(v.Content); i += 2 {
+			if v.Content[i+1].Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("line %d: label %q must be a plain value", v.Content[i+1].Line, v.Content[i].Value)
+			}
+			pairs = append(pairs, v.Content[i].Value+"="+v.Content[i+1].Value)
+		}
+		return strings.Join(pairs, ","), nil
+	}
+	return "", fmt.Errorf("line %d: unsupported value for %s", v.Line, path)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
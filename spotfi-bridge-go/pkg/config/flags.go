@@ -0,0 +1,166 @@
+package config
+
+import (
+	"flag"
+	"strings"
+)
+
+// option describes an env file key exposed as a command-line flag and UCI option.
+// kind, min, max and enum are checked by set and published in the JSON Schema
+type option struct {
+	key        string
+	usage      string
+	boolean    bool
+	list       bool
+	kind       valueKind
+	min, max   string   // Bounds in the option's own syntax, e.g. "5s" or "-120"
+	enum       []string // Accepted values besides the empty default
+	deprecated string   // Why the option should no longer be set
+}
+
+// options lists every key handled by set
+var options = []option{
+	{key: "SPOTFI_ROUTER_ID", usage: "router ID, used as the MQTT username"},
+	{key: "SPOTFI_TOKEN", usage: "router token, used as the MQTT password"},
+	{key: "SPOTFI_TOKEN_FILE", usage: "file holding the router token (mode 0600), optionally encrypted with --encrypt-token"},
+	{key: "SPOTFI_MAC", usage: "router MAC address (detected when unset)"},
+	{key: "SPOTFI_LOG_LEVEL", usage: "log level: debug, info, warn or error, optionally per subsystem as info,rpc=debug (default info)"},
+	{key: "SPOTFI_LOG_FORMAT", usage: "log output: text or json (default text)", enum: []string{"text", "json"}},
+	{key: "SPOTFI_LOG_SHIP", usage: "publish system log lines to the logs topic", boolean: true},
+	{key: "SPOTFI_LOG_SHIP_SOURCE", usage: "logread or a syslog file to follow (default logread)"},
+	{key: "SPOTFI_LOG_SHIP_SEVERITY", usage: "least severe syslog level shipped (default warning)", enum: []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}},
+	{key: "SPOTFI_LOG_SHIP_INCLUDE", usage: "processes whose lines are shipped, default all (comma-separated)", list: true},
+	{key: "SPOTFI_LOG_SHIP_EXCLUDE", usage: "lines containing any of these strings are not shipped (comma-separated)", list: true},
+	{key: "SPOTFI_LOG_SHIP_BATCH", usage: "log lines per message (default 50)", kind: kindInt, min: "0", max: "1000"},
+	{key: "SPOTFI_LOG_SHIP_FLUSH_INTERVAL", usage: "longest wait before a partial batch is published (default 10s)", kind: kindDuration, min: "1s", max: "10m"},
+	{key: "SPOTFI_LOG_SHIP_MAX_RATE", usage: "log lines accepted per second (default 20)", kind: kindInt, min: "0", max: "1000"},
+	{key: "SPOTFI_LOG_SHIP_BACKLOG", usage: "log lines kept while offline (default 1000)", kind: kindInt, min: "0", max: "100000"},
+	{key: "SPOTFI_CONFIG_VERSION", usage: "configuration format version, recorded by migrations", kind: kindInt, min: "1"},
+	{key: "SPOTFI_WS_URL", usage: "legacy WebSocket API URL, migrated to SPOTFI_MQTT_BROKER"},
+	{key: "SPOTFI_ROUTER_NAME", usage: "router display name"},
+	{key: "SPOTFI_MQTT_BROKER", usage: "MQTT broker URL (default tcp://emqx:1883)"},
+	{key: "SPOTFI_INSTANCE", usage: "instance name appended to the MQTT client ID, for running a second bridge per router"},
+	{key: "SPOTFI_TOPIC_PREFIX", usage: "first element of the router's MQTT topics (default spotfi)"},
+	{key: "SPOTFI_PROFILE", usage: "profile from /etc/spotfi/profiles/<name>.env applied on top of the configuration"},
+	{key: "SPOTFI_PROVISION_URL", usage: "zero-touch provisioning endpoint, used when no router ID or token is set"},
+	{key: "SPOTFI_CLAIM_CODE", usage: "claim code sent to the provisioning endpoint"},
+	{key: "SPOTFI_PROVISION_RETRY", usage: "how often an unclaimed router asks again (default 1m)", kind: kindDuration, min: "1s"},
+	{key: "SPOTFI_RPC_SERVICES", usage: "services spotfi.service may control (comma-separated)", list: true},
+	{key: "SPOTFI_RPC_IDEMPOTENCY_WINDOW", usage: "how long RPC responses are kept for duplicate requests (default 5m)", kind: kindDuration, min: "0s"},
+	{key: "SPOTFI_RPC_MAX_ARGS", usage: "largest accepted RPC args in bytes (default 65536)", kind: kindSize, min: "0"},
+	{key: "SPOTFI_RPC_MAX_PAYLOAD", usage: "RPC response size in bytes above which responses are chunked (default 262144)", kind: kindSize, min: "0"},
+	{key: "SPOTFI_RPC_RATE_LIMIT", usage: "RPC requests per second per source (default 10)", kind: kindNumber, min: "0"},
+	{key: "SPOTFI_RPC_RATE_BURST", usage: "RPC burst per source (default 20)", kind: kindInt, min: "0"},
+	{key: "SPOTFI_RPC_MAX_CONCURRENT", usage: "concurrent RPC executions (default 8)", kind: kindInt, min: "0", max: "256"},
+	{key: "SPOTFI_RPC_URGENT_WORKERS", usage: "execution slots reserved for urgent RPCs (default 2)", kind: kindInt, min: "0", max: "64"},
+	{key: "SPOTFI_RPC_URGENT_PATHS", usage: "paths allowed to use the urgent lane (comma-separated)", list: true},
+	{key: "SPOTFI_RPC_CACHE", usage: "read-only RPC cache policy as path:method=ttl entries", list: true},
+	{key: "SPOTFI_RPC_SIGNING", usage: "RPC request signing: off, hmac or ed25519", enum: []string{"off", "hmac", "ed25519"}},
+	{key: "SPOTFI_RPC_SIGNING_KEY", usage: "RPC signing key"},
+	{key: "SPOTFI_RPC_SIGNING_KEY_FILE", usage: "file holding the RPC signing key"},
+	{key: "SPOTFI_RPC_SIGNATURE_MAX_AGE", usage: "accepted clock difference for signed requests (default 60s)", kind: kindDuration, min: "1s"},
+	{key: "SPOTFI_METRICS_INTERVAL", usage: "metrics publish interval, 5s to 1h (default 30s)", kind: kindDuration, min: "5s", max: "1h"},
+	{key: "SPOTFI_METRICS_PHASE", usage: "collect at a per-router offset into the interval (default true)", boolean: true},
+	{key: "SPOTFI_METRICS_SPLAY", usage: "random delay of up to this much per sample", kind: kindDuration, min: "0s"},
+	{key: "SPOTFI_METRICS_DELTA", usage: "publish only changed fields between full snapshots", boolean: true},
+	{key: "SPOTFI_METRICS_FULL_INTERVAL", usage: "full snapshot interval in delta mode (default 10m)", kind: kindDuration, min: "0s"},
+	{key: "SPOTFI_METRICS_DEADBANDS", usage: "delta deadbands as path=value entries", list: true},
+	{key: "SPOTFI_METRICS_SUMMARY_PERIOD", usage: "metrics summary period, or off (default 1h)", kind: kindOptionalDuration, min: "1m"},
+	{key: "SPOTFI_METRICS_BUFFER_SIZE", usage: "bytes of samples kept while offline, -1 disables (default 1048576)", kind: kindSize, min: "-1"},
+	{key: "SPOTFI_WAN_PROBE_TARGET", usage: "WAN ping target besides the gateway, or off"},
+	{key: "SPOTFI_WAN_PROBE_INTERVAL", usage: "WAN probe interval (default 60s)", kind: kindDuration, min: "0s"},
+	{key: "SPOTFI_PUBLIC_IP_URL", usage: "public IP echo service"},
+	{key: "SPOTFI_DNS_PROBE_NAME", usage: "name resolved to check DNS health (default cloudflare.com)"},
+	{key: "SPOTFI_METRICS_PLUGIN_DIR", usage: "metrics plugin directory, or off (default /usr/lib/spotfi/metrics.d)"},
+	{key: "SPOTFI_METRICS_PLUGIN_TIMEOUT", usage: "metrics plugin timeout (default 5s)", kind: kindDuration, min: "0s"},
+	{key: "SPOTFI_WATCHED_SERVICES", usage: "daemons whose health is reported (comma-separated)", list: true},
+	{key: "SPOTFI_MODEM", usage: "modem backend: auto, off, mmcli, uqmi or at (default auto)", enum: []string{"auto", "off", "mmcli", "uqmi", "at"}},
+	{key: "SPOTFI_MODEM_DEVICE", usage: "QMI device or AT serial port"},
+	{key: "SPOTFI_LOCATION_SOURCE", usage: "GPS source: gpsd://host:port or an NMEA serial port"},
+	{key: "SPOTFI_LOCATION_INTERVAL", usage: "location publish interval (default 30s)", kind: kindDuration, min: "0s"},
+	{key: "SPOTFI_LOCATION_PRECISION", usage: "coordinate decimals, 0 for full precision", kind: kindInt, min: "0", max: "15"},
+	{key: "SPOTFI_XTUNNEL", usage: "accept x-tunnel remote shell sessions (default true)", boolean: true},
+	{key: "SPOTFI_RPC_EXEC", usage: "allow ubus file.exec over RPC (default true)", boolean: true},
+	{key: "SPOTFI_METRICS", usage: "run the metrics collectors and publish metrics (default true)", boolean: true},
+	{key: "SPOTFI_CLIENT_EVENTS", usage: "publish client connect/disconnect events as they happen (default true)", boolean: true},
+	{key: "SPOTFI_CLIENT_EVENTS_MAX_RATE", usage: "client events published per second (default 50)", kind: kindInt, min: "0"},
+	{key: "SPOTFI_PORTAL_AUTH", usage: "relay captive portal logins to the cloud for a decision", boolean: true},
+	{key: "SPOTFI_PORTAL_AUTH_TIMEOUT", usage: "time the cloud has to decide a login (default 5s)", kind: kindDuration, min: "1s", max: "30s"},
+	{key: "SPOTFI_PORTAL_AUTH_FALLBACK", usage: "login policy while the cloud cannot decide: deny or allow (default deny)", enum: []string{"deny", "allow"}},
+	{key: "SPOTFI_PORTAL_AUTH_FALLBACK_SESSION", usage: "session timeout of logins allowed by the fallback (default 1h)", kind: kindDuration, min: "1m", max: "24h"},
+	{key: "SPOTFI_PORTAL_AUTH_CACHE", usage: "how long allowed logins may be reused offline, 0 to disable (default 0)", kind: kindDuration, min: "0s", max: "720h"},
+	{key: "SPOTFI_PRESENCE", usage: "count footfall from Wi-Fi probe requests", boolean: true},
+	{key: "SPOTFI_PRESENCE_INTERVAL", usage: "presence report window (default 5m)", kind: kindDuration, min: "0s"},
+	{key: "SPOTFI_PRESENCE_MIN_SIGNAL", usage: "weakest probe signal counted in dBm (default -80)", kind: kindInt, min: "-120", max: "0"},
+	{key: "SPOTFI_PRESENCE_SALT_ROTATION", usage: "presence salt lifetime (default 24h)", kind: kindDuration, min: "0s"},
+	{key: "SPOTFI_PRESENCE_MAX_RATE", usage: "probes processed per second (default 200)", kind: kindInt, min: "0"},
+	{key: "SPOTFI_PRESENCE_MAX_DEVICES", usage: "devices tracked per window (default 5000)", kind: kindInt, min: "0"},
+	{key: "SPOTFI_MULTI_AP", usage: "manage downstream OpenWrt APs behind this router", boolean: true},
+	{key: "SPOTFI_MULTI_AP_INTERVAL", usage: "downstream AP metrics interval (default 1m)", kind: kindDuration, min: "10s", max: "1h"},
+	{key: "SPOTFI_PLUGIN_DIR", usage: "RPC, metrics and event plugin directory, or off (default /usr/lib/spotfi/plugins)"},
+	{key: "SPOTFI_JOURNAL", usage: "keep alerts, audit records, quota and client events on flash until the backend acknowledges them", boolean: true},
+	{key: "SPOTFI_JOURNAL_SIZE", usage: "bytes of unacknowledged journal entries kept (default 1048576)", kind: kindSize, min: "4096", max: "16777216"},
+	{key: "SPOTFI_INFLUX_TARGET", usage: "InfluxDB line protocol target: udp://, tcp://, unix:// or unixgram://"},
+	{key: "SPOTFI_LABELS", usage: "labels added to published messages as key=value pairs", list: true},
+	{key: "SPOTFI_INVENTORY_INTERVAL", usage: "device inventory interval, or off (default 5m)", kind: kindOptionalDuration, min: "0s"},
+	{key: "SPOTFI_DISCOVERY", usage: "sweep LAN subnets and collect mDNS/SSDP announcements into the device inventory", boolean: true},
+	{key: "SPOTFI_DISCOVERY_INTERVAL", usage: "network discovery interval, or off for on demand only (default 1h)", kind: kindOptionalDuration, min: "1m"},
+	{key: "SPOTFI_DISCOVERY_SUBNETS", usage: "IPv4 subnets swept, at most /22 each (default the private LAN subnets, comma-separated)", list: true},
+	{key: "SPOTFI_TRAFFIC_INTERVAL", usage: "nlbwmon top talkers interval, or off (default 15m)", kind: kindOptionalDuration, min: "0s"},
+	{key: "SPOTFI_TRAFFIC_TOP", usage: "hosts and protocols per top talkers summary (default 10)", kind: kindInt, min: "0", max: "100"},
+	{key: "SPOTFI_ROGUE_AP", usage: "scan for APs broadcasting the venue's SSIDs and raise alerts", boolean: true},
+	{key: "SPOTFI_ROGUE_AP_INTERVAL", usage: "rogue AP scan interval (default 15m)", kind: kindDuration, min: "1m"},
+	{key: "SPOTFI_ROGUE_AP_SSIDS", usage: "venue SSIDs served by other equipment (comma-separated)", list: true},
+	{key: "SPOTFI_ROGUE_AP_ALLOW", usage: "BSSIDs or MAC prefixes allowed to broadcast venue SSIDs (comma-separated)", list: true},
+	{key: "SPOTFI_SPEEDTEST_ENDPOINT", usage: "LibreSpeed backend URL or iperf3://host[:port]"},
+	{key: "SPOTFI_SPEEDTEST_INTERVAL", usage: "speedtest schedule, 0 for on demand only", kind: kindDuration, min: "0s"},
+	{key: "SPOTFI_SPEEDTEST_MIN_INTERVAL", usage: "minimum time between speedtests (default 1h)", kind: kindDuration, min: "0s"},
+	{key: "SPOTFI_SPEEDTEST_MAX_BYTES", usage: "speedtest bytes per direction (default 26214400)", kind: kindSize, min: "0"},
+	{key: "SPOTFI_UPDATE_URL", usage: "release manifest URL for self-update"},
+	{key: "SPOTFI_UPDATE_KEY", usage: "Ed25519 public key release binaries are signed with (base64 or hex)"},
+	{key: "SPOTFI_UPDATE_CHANNEL", usage: "release channel: stable, beta or canary (default stable)", enum: []string{"stable", "beta", "canary"}},
+	{key: "SPOTFI_UPDATE_INTERVAL", usage: "automatic update check interval, 0 for on demand only", kind: kindDuration, min: "1h"},
+	{key: "SPOTFI_UPDATE_GRACE", usage: "time an updated bridge has to connect before it is rolled back (default 5m)", kind: kindDuration, min: "30s", max: "1h"},
+	{key: "SPOTFI_HEALTH_LISTEN", usage: "loopback address of the HTTP /healthz and /status endpoint, e.g. 127.0.0.1:9101"},
+	{key: "SPOTFI_WATCHDOG", usage: "procd watchdog timeout after which a wedged bridge is restarted, or off (default 60s)", kind: kindOptionalDuration, min: "10s", max: "1h"},
+	{key: "SPOTFI_PROMETHEUS_LISTEN", usage: "Prometheus exporter listen address (loopback or LAN)"},
+	{key: "SPOTFI_PROMETHEUS_TOKEN", usage: "bearer token required by the Prometheus exporter (needed on a LAN address)"},
+	{key: "SPOTFI_PROMETHEUS_CLIENT_LABELS", usage: "export per-client Prometheus series with MAC and IP labels", boolean: true},
+	{key: "SPOTFI_ALERT_RULES", usage: "alert rules as metric>threshold:severity:samples, or off", list: true},
+	{key: "SPOTFI_AUDIT_LOG", usage: "RPC audit log path, or off (default /var/log/spotfi-rpc-audit.log)"},
+	{key: "SPOTFI_AUDIT_LOG_SIZE", usage: "audit log size in bytes before rotation (default 262144)", kind: kindSize, min: "0"},
+	{key: "SPOTFI_AUDIT_TOPIC", usage: "also publish audit records to the audit topic", boolean: true},
+}
+
+// flagName is the command-line flag for an env file key, e.g. SPOTFI_METRICS_INTERVAL -> metrics-interval
+func flagName(key string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(key, "SPOTFI_")), "_", "-")
+}
+
+// Flags registers a flag for every option on fs. The returned function applies the
+// flags given on the command line, so they override the env file
+func Flags(fs *flag.FlagSet) func(*Config) {
+	var given [][2]string
+	for _, o := range options {
+		key := o.key
+		record := func(val string) error {
+			// Reject bad values while parsing, so flag reports them with the usage
+			var check Config
+			if err := check.set(key, val); err != nil {
+				return err
+			}
+			given = append(given, [2]string{key, val})
+			return nil
+		}
+		if o.boolean {
+			fs.BoolFunc(flagName(key), o.usage, record)
+		} else {
+			fs.Func(flagName(key), o.usage, record)
+		}
+	}
+	return func(c *Config) {
+		for _, kv := range given {
+			c.set(kv[0], kv[1])
+		}
+	}
+}
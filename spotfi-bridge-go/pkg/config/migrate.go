@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"spotfi-bridge/pkg/uci"
+)
+
+// ConfigVersion is the env/UCI configuration format of this bridge, recorded as
+// SPOTFI_CONFIG_VERSION. Configurations without one predate the MQTT bridge (version 1)
+const ConfigVersion = 2
+
+// migration upgrades a configuration to version, consuming the legacy keys it maps.
+// apply returns the settings to write back (an empty value deletes the key) and
+// one note per decision for the log
+type migration struct {
+	version int
+	keys    []string
+	apply   func(c *Config) (map[string]string, []string)
+}
+
+// migrations run in order for every version above the configuration's
+var migrations = []migration{
+	{version: 2, keys: []string{"SPOTFI_WS_URL"}, apply: migrateWebSocket},
+}
+
+// Migrate upgrades a configuration written for an older bridge to ConfigVersion and
+// adds what it did to Warnings. Legacy keys found in a configuration that is
+// already current are ignored with a warning. With persist, when the settings came
+// from /etc/config/spotfi, the result and the new version are written back so the
+// migration only runs once; env files are migrated in memory on every start
+func (c *Config) Migrate(persist bool) error {
+	from := c.Version
+	if from == 0 {
+		from = 1
+	}
+	if from > ConfigVersion {
+		return fmt.Errorf("SPOTFI_CONFIG_VERSION %d is newer than this bridge supports (%d)", from, ConfigVersion)
+	}
+
+	changes := map[string]string{}
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+		set, notes := m.apply(c)
+		for k, v := range set {
+			changes[k] = v
+		}
+		c.warnings = append(c.warnings, notes...)
+		for _, k := range m.keys {
+			delete(c.legacy, k)
+		}
+	}
+	for key := range c.legacy {
+		c.warnings = append(c.warnings, fmt.Sprintf("%s is ignored: it was replaced in configuration version %d", key, migrationOf(key)))
+		delete(c.legacy, key)
+	}
+	c.Version = ConfigVersion
+
+	if !persist || !c.fromUCI || from == ConfigVersion {
+		return nil
+	}
+	changes["SPOTFI_CONFIG_VERSION"] = strconv.Itoa(ConfigVersion)
+	return saveUCI(changes)
+}
+
+// migrationOf is the version whose migration consumes a legacy key
+func migrationOf(key string) int {
+	for _, m := range migrations {
+		for _, k := range m.keys {
+			if k == key {
+				return m.version
+			}
+		}
+	}
+	return 0
+}
+
+// SaveSetting validates a value and writes it to /etc/config/spotfi, e.g. for settings
+// changed remotely. The structured config file and flags still take precedence
+func SaveSetting(key, val string) error {
+	var check Config
+	if err := check.set(key, val); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return saveUCI(map[string]string{key: val})
+}
+
+// saveUCI writes settings to the spotfi UCI section; empty values delete the option
+func saveUCI(settings map[string]string) error {
+	uci.Lock()
+	defer uci.Unlock()
+	section, err := ensureUCISection()
+	if err != nil {
+		return err
+	}
+	prefix := uciConfig + "." + section + "."
+	for key, val := range settings {
+		if val == "" {
+			uci.Delete(prefix + uciName(key))
+			continue
+		}
+		if err := uci.Set(prefix+uciName(key), val); err != nil {
+			uci.Revert(uciConfig)
+			return err
+		}
+	}
+	return uci.Commit(uciConfig)
+}
+
+// migrateWebSocket maps the SPOTFI_WS_URL of the WebSocket bridge to an MQTT broker
+// on the same host (wss to TLS on 8883, ws to plain MQTT on 1883), unless a broker
+// is configured already
+func migrateWebSocket(c *Config) (map[string]string, []string) {
+	ws := c.legacy["SPOTFI_WS_URL"]
+	if ws == "" {
+		return nil, nil
+	}
+	if c.MQTTBroker != "" {
+		return map[string]string{"SPOTFI_WS_URL": ""},
+			[]string{"SPOTFI_WS_URL is ignored: SPOTFI_MQTT_BROKER is set and the bridge no longer uses WebSockets"}
+	}
+	u, err := url.Parse(ws)
+	if err != nil || u.Hostname() == "" {
+		return map[string]string{"SPOTFI_WS_URL": ""},
+			[]string{fmt.Sprintf("SPOTFI_WS_URL %q is ignored: no broker host can be derived from it", ws)}
+	}
+	broker := "tcp://" + u.Hostname() + ":1883"
+	if u.Scheme == "wss" {
+		broker = "ssl://" + u.Hostname() + ":8883"
+	}
+	c.MQTTBroker = broker
+	return map[string]string{"SPOTFI_WS_URL": "", "SPOTFI_MQTT_BROKER": broker},
+		[]string{fmt.Sprintf("SPOTFI_WS_URL %s migrated to SPOTFI_MQTT_BROKER %s; set the broker explicitly if it runs elsewhere", ws, broker)}
+}
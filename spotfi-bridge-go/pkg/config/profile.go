@@ -0,0 +1,34 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ProfileDir holds the profile overlays, one env file per profile
+const ProfileDir = "/etc/spotfi/profiles"
+
+// ApplyProfile overlays /etc/spotfi/profiles/{Profile}.env on the configuration.
+// A profile may set any SPOTFI_* key (broker, topic prefix, ...) except
+// SPOTFI_PROFILE itself
+func (c *Config) ApplyProfile() error {
+	name := c.Profile
+	path := filepath.Join(ProfileDir, name+".env")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("profile %q not found (expected %s)", name, path)
+	}
+	err := readEnvFile(path, c.set)
+	c.Profile = name
+	return err
+}
+
+// validName keeps profile and instance names to plain file name characters
+func validName(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// valueKind is the type of an option's value beyond plain strings, booleans and lists
+type valueKind int
+
+const (
+	kindString valueKind = iota
+	kindDuration
+	kindOptionalDuration // A duration or "off"
+	kindInt
+	kindNumber
+	kindSize
+)
+
+// durationPattern matches the Go durations accepted by parseDuration
+const durationPattern = `([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+`
+
+// sizePattern matches the byte sizes accepted by parseSize
+const sizePattern = `^-?[0-9]+ *([KkMmGg]([Ii]?[Bb])?|[Bb])?$`
+
+var optionsByKey = func() map[string]option {
+	m := make(map[string]option, len(options))
+	for _, o := range options {
+		m[o.key] = o
+	}
+	return m
+}()
+
+// checkValue enforces an option's enum and bounds on a value that set parsed
+// successfully. Zero keeps the default and is always accepted
+func (o option) checkValue(val string) error {
+	if val == "" {
+		return nil
+	}
+	if len(o.enum) > 0 {
+		for _, e := range o.enum {
+			if val == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid value %q (use %s)", val, strings.Join(o.enum, ", "))
+	}
+	if o.min == "" && o.max == "" {
+		return nil
+	}
+
+	if o.kind == kindOptionalDuration && val == "off" {
+		return nil
+	}
+	parse := func(s string) float64 {
+		switch o.kind {
+		case kindDuration, kindOptionalDuration:
+			d, _ := parseDuration(s)
+			return float64(d)
+		case kindSize:
+			n, _ := parseSize(s)
+			return float64(n)
+		}
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	n := parse(val)
+	if n == 0 {
+		return nil
+	}
+	if (o.min != "" && n < parse(o.min)) || (o.max != "" && n > parse(o.max)) {
+		return fmt.Errorf("%s is out of range (%s)", val, o.bounds())
+	}
+	return nil
+}
+
+// bounds describes the accepted range for error messages
+func (o option) bounds() string {
+	switch {
+	case o.min != "" && o.max != "":
+		return fmt.Sprintf("%s to %s", o.min, o.max)
+	case o.min != "":
+		return "at least " + o.min
+	}
+	return "at most " + o.max
+}
+
+// deprecate records a warning for a deprecated option that is set
+func (c *Config) deprecate(o option) {
+	msg := fmt.Sprintf("%s is deprecated: %s", o.key, o.deprecated)
+	for _, w := range c.warnings {
+		if w == msg {
+			return
+		}
+	}
+	c.warnings = append(c.warnings, msg)
+}
+
+// Warnings returns the problems found while loading that did not stop it, such as
+// deprecated options being set
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
+
+// JSONSchema describes the structured config file as a JSON Schema (draft 2020-12),
+// generated from the same table the loader validates against
+func JSONSchema() ([]byte, error) {
+	root := schemaObject(fileSchema())
+	props := root["properties"].(map[string]interface{})
+	props["schemaVersion"] = map[string]interface{}{
+		"description": "layout version of this file",
+		"type":        "integer",
+		"minimum":     1,
+		"maximum":     FileSchemaVersion,
+	}
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["title"] = "SpotFi bridge configuration"
+	root["required"] = []string{"schemaVersion"}
+	out, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// schemaObject converts one section of fileSchema
+func schemaObject(section map[string]interface{}) map[string]interface{} {
+	props := map[string]interface{}{}
+	for name, entry := range section {
+		switch entry := entry.(type) {
+		case map[string]interface{}:
+			props[name] = schemaObject(entry)
+		case string:
+			props[name] = optionsByKey[entry].schema()
+		}
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+// schema describes the values an option accepts in the structured file
+func (o option) schema() map[string]interface{} {
+	s := map[string]interface{}{}
+	switch {
+	case o.key == "SPOTFI_LABELS":
+		s["anyOf"] = []interface{}{
+			map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": []string{"string", "number", "boolean"}}},
+			map[string]interface{}{"type": "string"},
+		}
+	case o.boolean:
+		s["type"] = "boolean"
+	case o.list:
+		s["anyOf"] = []interface{}{
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": []string{"string", "number"}}},
+			map[string]interface{}{"type": "string"},
+		}
+	case o.kind == kindDuration || o.kind == kindOptionalDuration:
+		str := map[string]interface{}{"type": "string", "pattern": "^" + durationPattern + "$"}
+		if o.kind == kindOptionalDuration {
+			str["pattern"] = "^(" + durationPattern + "|off)$"
+		}
+		s["anyOf"] = []interface{}{map[string]interface{}{"type": "integer", "minimum": 0}, str}
+	case o.kind == kindSize:
+		s["anyOf"] = []interface{}{map[string]interface{}{"type": "integer"}, map[string]interface{}{"type": "string", "pattern": sizePattern}}
+	case o.kind == kindInt || o.kind == kindNumber:
+		s["type"] = "integer"
+		if o.kind == kindNumber {
+			s["type"] = "number"
+		}
+		if o.min != "" {
+			s["minimum"], _ = strconv.Atoi(o.min)
+		}
+		if o.max != "" {
+			s["maximum"], _ = strconv.Atoi(o.max)
+		}
+	case len(o.enum) > 0:
+		s["enum"] = o.enum
+	default:
+		s["type"] = "string"
+	}
+
+	s["description"] = o.usage
+	if o.deprecated != "" {
+		s["deprecated"] = true
+	}
+	return s
+}
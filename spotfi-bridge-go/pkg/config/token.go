@@ -0,0 +1,141 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"spotfi-bridge/pkg/device"
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("config")
+
+// DefaultTokenFile is where EncryptTokenFile stores the token when SPOTFI_TOKEN_FILE is unset
+const DefaultTokenFile = "/etc/spotfi/token"
+
+// encryptedPrefix marks a token file sealed with the device key
+const encryptedPrefix = "enc:v1:"
+
+// LoadToken reads the token from TokenFile when one is configured, decrypting it if it
+// was sealed with EncryptTokenFile. The file wins over an inline SPOTFI_TOKEN
+func (c *Config) LoadToken() error {
+	if c.TokenFile == "" {
+		return nil
+	}
+	info, err := os.Stat(c.TokenFile)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		logger.Warn("Token file is readable by other users, run chmod 600 on it", "path", c.TokenFile, "mode", fmt.Sprintf("%04o", info.Mode().Perm()))
+	}
+	data, err := os.ReadFile(c.TokenFile)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(data))
+	if strings.HasPrefix(token, encryptedPrefix) {
+		if token, err = decryptToken(strings.TrimPrefix(token, encryptedPrefix)); err != nil {
+			return fmt.Errorf("%s: %w", c.TokenFile, err)
+		}
+	}
+	if token == "" {
+		return fmt.Errorf("%s is empty", c.TokenFile)
+	}
+	c.Token = token
+	return nil
+}
+
+// EncryptTokenFile seals the current token with the device key and writes it to
+// TokenFile (DefaultTokenFile when unset) with mode 0600, returning the path
+func (c *Config) EncryptTokenFile() (string, error) {
+	if c.Token == "" {
+		return "", fmt.Errorf("no token configured")
+	}
+	path := c.TokenFile
+	if path == "" {
+		path = DefaultTokenFile
+	}
+	sealed, err := encryptToken(c.Token)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(encryptedPrefix+sealed+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+func encryptToken(token string) (string, error) {
+	gcm, err := deviceCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(token), nil)), nil
+}
+
+func decryptToken(sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted token: %v", err)
+	}
+	gcm, err := deviceCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted token")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("token was encrypted on a different device or is corrupt")
+	}
+	return string(plain), nil
+}
+
+// deviceCipher derives an AES-GCM key from a value unique to this device. It keeps a
+// copied token file (e.g. in a backup) useless elsewhere; it does not protect against root on the router
+func deviceCipher() (cipher.AEAD, error) {
+	id, err := deviceID()
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte("spotfi-token:" + id))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deviceID is the device tree serial number, the machine ID or else the lowest
+// factory MAC address of the physical network interfaces
+func deviceID() (string, error) {
+	if serial := device.Serial(); serial != "" {
+		return serial, nil
+	}
+	if data, err := os.ReadFile("/etc/machine-id"); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	}
+	if macs := device.FactoryMACs(); len(macs) > 0 {
+		return macs[0], nil
+	}
+	return "", fmt.Errorf("no device-unique value found to derive the token key")
+}
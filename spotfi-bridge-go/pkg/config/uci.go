@@ -0,0 +1,150 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"spotfi-bridge/pkg/uci"
+)
+
+// UCI settings live in the first "spotfi" section of /etc/config/spotfi, with each
+// SPOTFI_* key as a lowercase option (SPOTFI_METRICS_INTERVAL -> metrics_interval)
+const (
+	uciConfig  = "spotfi"
+	uciSection = "spotfi"
+	uciPath    = "/etc/config/spotfi"
+)
+
+// readUCI applies the options of the spotfi UCI section and reports whether one exists
+func (c *Config) readUCI() (bool, error) {
+	sections, err := uci.SectionsOfType(uciConfig, uciSection)
+	if err != nil || len(sections) == 0 {
+		return false, nil
+	}
+	var errs []error
+	for _, o := range options {
+		values, ok := sections[0].Options[uciName(o.key)]
+		if !ok || len(values) == 0 {
+			continue
+		}
+		val := values[0]
+		if o.list {
+			val = strings.Join(values, ",")
+		}
+		if err := c.set(o.key, val); err != nil {
+			errs = append(errs, fmt.Errorf("option %s: %w", uciName(o.key), err))
+		}
+	}
+	return true, errors.Join(errs...)
+}
+
+// uciName is the UCI option for an env file key
+func uciName(key string) string {
+	return strings.ToLower(strings.TrimPrefix(key, "SPOTFI_"))
+}
+
+// MigrateEnv copies the keys of an env file (with its includes and ${VAR} references
+// resolved) into /etc/config/spotfi, creating the "main" section if the config has none,
+// and returns the number of options written. Existing options are replaced; the env
+// file itself is left untouched
+func MigrateEnv(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	known := map[string]option{}
+	for _, o := range options {
+		known[o.key] = o
+	}
+
+	uci.Lock()
+	defer uci.Unlock()
+	section, err := ensureUCISection()
+	if err != nil {
+		return 0, err
+	}
+
+	written := map[string]bool{}
+	err = readEnvFile(path, func(key, val string) error {
+		o, ok := known[key]
+		if !ok || val == "" {
+			return nil
+		}
+		name := uciConfig + "." + section + "." + uciName(o.key)
+		uci.Delete(name)
+		written[key] = true
+		if !o.list {
+			return uci.Set(name, val)
+		}
+		items := splitList(val)
+		if o.key == "SPOTFI_LABELS" {
+			// Label values may contain spaces
+			items = strings.Split(val, ",")
+		}
+		for _, item := range items {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			if err := uci.AddList(name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		uci.Revert(uciConfig)
+		return 0, err
+	}
+	return len(written), uci.Commit(uciConfig)
+}
+
+// ensureUCISection returns the name of the spotfi section, creating the config and a
+// "main" section when there is none yet; the caller holds the uci lock
+func ensureUCISection() (string, error) {
+	// uci cannot add sections to a config that does not exist yet
+	if _, err := os.Stat(uciPath); os.IsNotExist(err) {
+		if err := os.WriteFile(uciPath, nil, 0600); err != nil {
+			return "", err
+		}
+	}
+	if sections, err := uci.SectionsOfType(uciConfig, uciSection); err == nil && len(sections) > 0 {
+		return sections[0].Name, nil
+	}
+	return "main", uci.Set(uciConfig+".main", uciSection)
+}
+
+// SaveIdentity persists a provisioned identity: the token is encrypted into TokenFile
+// (DefaultTokenFile when unset) and the router ID, token file, name and broker are
+// written to /etc/config/spotfi, which takes precedence over the env file
+func (c *Config) SaveIdentity() error {
+	path, err := c.EncryptTokenFile()
+	if err != nil {
+		return err
+	}
+	c.TokenFile = path
+	uci.Lock()
+	defer uci.Unlock()
+	section, err := ensureUCISection()
+	if err != nil {
+		return err
+	}
+	prefix := uciConfig + "." + section + "."
+	for key, val := range map[string]string{
+		"router_id":   c.RouterID,
+		"token_file":  c.TokenFile,
+		"router_name": c.RouterName,
+		"mqtt_broker": c.MQTTBroker,
+	} {
+		if val == "" {
+			continue
+		}
+		if err := uci.Set(prefix+key, val); err != nil {
+			uci.Revert(uciConfig)
+			return err
+		}
+	}
+	// An inline token left over in UCI would be stale
+	uci.Delete(prefix + "token")
+	return uci.Commit(uciConfig)
+}
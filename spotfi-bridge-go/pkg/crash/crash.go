@@ -0,0 +1,229 @@
+package crash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("crash")
+
+const (
+	// ReportFile keeps crash reports until they have been published
+	ReportFile = "/etc/spotfi/crash.json"
+
+	// OutputFile receives the runtime's own report of a panic that was not recovered
+	// or a fatal error (see debug.SetCrashOutput), after a header line written at startup
+	OutputFile = "/etc/spotfi/crash.log"
+
+	// maxStack truncates stack traces, so a report fits one MQTT message
+	maxStack = 32 * 1024
+
+	// maxReports bounds ReportFile while the broker cannot be reached
+	maxReports = 5
+)
+
+// Report describes one crash
+type Report struct {
+	Type      string `json:"type"`                // Always "crash"
+	Version   string `json:"version"`             // Of the bridge that crashed
+	Goroutine string `json:"goroutine,omitempty"` // Name given to Recover or Catch; empty for runtime crashes
+	Panic     string `json:"panic"`               // Panic value or runtime error
+	Stack     string `json:"stack"`
+	Uptime    int64  `json:"uptime"` // Seconds the crashed process had been running
+	At        int64  `json:"at"`
+
+	// Recovered is set when the bridge kept running (Catch); otherwise it was restarted
+	Recovered bool `json:"recovered"`
+}
+
+var state = struct {
+	mu      sync.Mutex
+	version string
+	started time.Time
+	publish func(*Report) error
+}{started: time.Now()}
+
+// files serializes access to ReportFile
+var files sync.Mutex
+
+// Configure records the version for reports and directs the runtime's crash output to
+// OutputFile. A crash left there by the previous process is kept for Publish
+func Configure(version string) {
+	state.mu.Lock()
+	state.version = version
+	state.mu.Unlock()
+
+	if data, err := os.ReadFile(OutputFile); err == nil {
+		if r := parseOutput(data); r != nil {
+			logger.Warn("The previous bridge process crashed", "version", r.Version, "panic", r.Panic)
+			save(r)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(OutputFile), 0755); err != nil {
+		logger.Warn("Crash output not captured", "error", err)
+		return
+	}
+	f, err := os.Create(OutputFile)
+	if err != nil {
+		logger.Warn("Crash output not captured", "error", err)
+		return
+	}
+	defer f.Close() // The runtime keeps its own descriptor
+	fmt.Fprintf(f, "spotfi-bridge v%s started %d\n", version, time.Now().Unix())
+	if err := debug.SetCrashOutput(f, debug.CrashOptions{}); err != nil {
+		logger.Warn("Crash output not captured", "error", err)
+	}
+}
+
+// Recover reports a panic of a long-running goroutine and exits, so procd restarts the
+// bridge instead of it running on without the goroutine. Use as defer crash.Recover(name)
+func Recover(name string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	record(name, v, false)
+	os.Exit(2)
+}
+
+// Catch reports a panic of a goroutine handling one request or message and lets the
+// bridge keep running. Use as defer crash.Catch(name)
+func Catch(name string) {
+	if v := recover(); v != nil {
+		Record(name, v)
+	}
+}
+
+// Record reports a panic recovered by the caller, which keeps running, e.g. an RPC
+// handler answering with an error instead. It must be called from the deferred function
+// so the stack still shows where the panic happened
+func Record(name string, v interface{}) *Report {
+	r := record(name, v, true)
+	state.mu.Lock()
+	publish := state.publish
+	state.mu.Unlock()
+	if publish != nil {
+		go Publish(publish)
+	}
+	return r
+}
+
+func record(name string, v interface{}, recovered bool) *Report {
+	state.mu.Lock()
+	r := &Report{
+		Type:      "crash",
+		Version:   state.version,
+		Goroutine: name,
+		Panic:     fmt.Sprint(v),
+		Stack:     truncate(string(debug.Stack())),
+		Uptime:    int64(time.Since(state.started).Seconds()),
+		At:        time.Now().Unix(),
+		Recovered: recovered,
+	}
+	state.mu.Unlock()
+	logger.Error("Panic", "goroutine", name, "panic", r.Panic, "recovered", recovered, "stack", r.Stack)
+	save(r)
+	return r
+}
+
+// Publish sends the saved reports, oldest first, and removes them once all were sent.
+// publish is kept for reports recorded later
+func Publish(publish func(*Report) error) {
+	state.mu.Lock()
+	state.publish = publish
+	state.mu.Unlock()
+
+	files.Lock()
+	defer files.Unlock()
+	reports := load()
+	for i, r := range reports {
+		if err := publish(r); err != nil {
+			logger.Warn("Crash report not published, kept for retry", "error", err)
+			writeReports(reports[i:])
+			return
+		}
+	}
+	if len(reports) > 0 {
+		os.Remove(ReportFile)
+		logger.Info("Published crash reports", "reports", len(reports))
+	}
+}
+
+// save appends r to ReportFile, dropping the oldest beyond maxReports
+func save(r *Report) {
+	files.Lock()
+	defer files.Unlock()
+	reports := append(load(), r)
+	if len(reports) > maxReports {
+		reports = reports[len(reports)-maxReports:]
+	}
+	writeReports(reports)
+}
+
+// load reads ReportFile; files must be held
+func load() []*Report {
+	var reports []*Report
+	if data, err := os.ReadFile(ReportFile); err == nil {
+		json.Unmarshal(data, &reports)
+	}
+	return reports
+}
+
+func writeReports(reports []*Report) {
+	data, err := json.Marshal(reports)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(ReportFile), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(ReportFile, data, 0644)
+	}
+	if err != nil {
+		logger.Error("Failed to save crash report", "error", err)
+	}
+}
+
+// parseOutput turns the crash output of a previous process into a report, or nil when
+// it exited without crashing. The output starts with the header written by Configure,
+// followed by e.g. "panic: ..." or "fatal error: ..." and the goroutine stacks
+func parseOutput(data []byte) *Report {
+	header, rest, _ := bytes.Cut(data, []byte("\n"))
+	rest = bytes.TrimSpace(rest)
+	if len(rest) == 0 {
+		return nil
+	}
+	r := &Report{Type: "crash"}
+	var started int64
+	if f := strings.Fields(string(header)); len(f) == 4 && f[0] == "spotfi-bridge" {
+		r.Version = strings.TrimPrefix(f[1], "v")
+		started, _ = strconv.ParseInt(f[3], 10, 64)
+	}
+	if info, err := os.Stat(OutputFile); err == nil {
+		r.At = info.ModTime().Unix()
+		if started > 0 && r.At >= started {
+			r.Uptime = r.At - started
+		}
+	}
+
+	first, _, _ := bytes.Cut(rest, []byte("\n"))
+	r.Panic = strings.TrimSpace(string(first))
+	r.Stack = truncate(string(rest))
+	return r
+}
+
+func truncate(stack string) string {
+	if len(stack) > maxStack {
+		return stack[:maxStack] + "\n... (truncated)"
+	}
+	return stack
+}
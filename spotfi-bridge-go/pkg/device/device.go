@@ -0,0 +1,124 @@
+package device
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Serial returns the board serial number from the device tree or the "Serial" line of
+// /proc/cpuinfo, or "" when the board has none
+func Serial() string {
+	if data, err := os.ReadFile("/proc/device-tree/serial-number"); err == nil {
+		if serial := strings.Trim(strings.TrimSpace(string(data)), "\x00"); serial != "" {
+			return serial
+		}
+	}
+	data, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(k) == "Serial" {
+			if serial := strings.TrimSpace(v); strings.Trim(serial, "0") != "" {
+				return serial
+			}
+		}
+	}
+	return ""
+}
+
+// FactoryMACs returns the permanent (factory-assigned) MAC addresses of the physical
+// network interfaces, sorted; virtual devices (bridges, VLANs, tunnels) have none
+func FactoryMACs() []string {
+	var macs []string
+	links, _ := filepath.Glob("/sys/class/net/*/device")
+	for _, link := range links {
+		dir := filepath.Dir(link)
+		// addr_assign_type 0 is a permanent address
+		if t, err := os.ReadFile(filepath.Join(dir, "addr_assign_type")); err != nil || strings.TrimSpace(string(t)) != "0" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "address"))
+		if err != nil {
+			continue
+		}
+		if mac := strings.TrimSpace(string(data)); mac != "" && mac != "00:00:00:00:00:00" {
+			macs = append(macs, mac)
+		}
+	}
+	sort.Strings(macs)
+	return macs
+}
+
+// PrimaryMAC returns the router's main MAC address and where it was found: the
+// label MAC from the device tree (the one printed on the unit), the LAN bridge,
+// eth0, or else the lowest factory MAC. Addresses are upper case
+func PrimaryMAC() (mac, source string) {
+	if mac = labelMAC(); mac != "" {
+		return mac, "label"
+	}
+	for _, dev := range []string{"br-lan", "eth0"} {
+		if mac = interfaceMAC(dev); mac != "" {
+			return mac, dev
+		}
+	}
+	if macs := FactoryMACs(); len(macs) > 0 {
+		return strings.ToUpper(macs[0]), "factory"
+	}
+	return "", ""
+}
+
+// labelMAC reads the mac-address property of the device tree node that
+// aliases/label-mac-device points to, when the address is stored there
+func labelMAC() string {
+	node, err := os.ReadFile("/proc/device-tree/aliases/label-mac-device")
+	if err != nil {
+		return ""
+	}
+	dir := filepath.Join("/proc/device-tree", strings.Trim(string(node), "\x00\n"))
+	for _, prop := range []string{"mac-address", "local-mac-address"} {
+		if b, err := os.ReadFile(filepath.Join(dir, prop)); err == nil && len(b) == 6 {
+			if mac := formatMAC(b); mac != "00:00:00:00:00:00" {
+				return mac
+			}
+		}
+	}
+	return ""
+}
+
+func interfaceMAC(dev string) string {
+	data, err := os.ReadFile(filepath.Join("/sys/class/net", dev, "address"))
+	if err != nil {
+		return ""
+	}
+	mac := strings.ToUpper(strings.TrimSpace(string(data)))
+	if mac == "" || mac == "00:00:00:00:00:00" {
+		return ""
+	}
+	return mac
+}
+
+func formatMAC(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02X", c)
+	}
+	return strings.Join(parts, ":")
+}
+
+// NormalizeMAC upper-cases a MAC address and accepts "-" or no separators, so
+// configured and detected values can be compared
+func NormalizeMAC(mac string) string {
+	hex := strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.TrimSpace(mac)))
+	if len(hex) != 12 {
+		return strings.ToUpper(strings.TrimSpace(mac))
+	}
+	parts := make([]string, 6)
+	for i := range parts {
+		parts[i] = hex[2*i : 2*i+2]
+	}
+	return strings.Join(parts, ":")
+}
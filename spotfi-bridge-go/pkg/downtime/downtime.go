@@ -0,0 +1,351 @@
+package downtime
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/metrics"
+)
+
+var logger = logging.For("downtime")
+
+// File keeps the current window and the windows not yet reported, across restarts
+const File = "/etc/spotfi/downtime.json"
+
+const (
+	// While connected the time is recorded this often, which bounds how far off the
+	// start of a window caused by a crash or power loss can be
+	heartbeatInterval = 5 * time.Minute
+	wanCheckInterval  = 30 * time.Second
+
+	maxUnreported = 200
+	maxHistory    = 20
+)
+
+// Causes of a window
+const (
+	CauseReboot       = "reboot"        // The router rebooted or lost power
+	CauseStopped      = "bridgeStopped" // The bridge was stopped
+	CauseRestart      = "bridgeRestart" // The bridge ended without stopping, e.g. a crash
+	CauseWANDown      = "wanDown"       // The router had no default route
+	CauseTimeout      = "timeout"       // Keepalive or connect timeout
+	CauseBrokerClosed = "brokerClosed"  // The broker closed or reset the connection
+	CauseRefused      = "refused"       // The broker refused the connection
+	CauseAuth         = "auth"          // The broker rejected the credentials
+	CauseDNS          = "dns"           // The broker name did not resolve
+	CauseNetwork      = "network"       // No route to the broker
+	CauseUnknown      = "unknown"
+)
+
+// Window is a period the broker was unreachable
+type Window struct {
+	Start    int64  `json:"start"`
+	End      int64  `json:"end,omitempty"`
+	Duration int64  `json:"duration"` // Seconds
+	Cause    string `json:"cause"`
+	Error    string `json:"error,omitempty"` // First error seen, when the cause came from one
+
+	// WANDown is roughly how many of the seconds the router had no default route
+	WANDown int64 `json:"wanDownSeconds,omitempty"`
+
+	// Approximate is set when Start is the last time the bridge recorded being
+	// connected, at most 5 minutes before the crash or power loss
+	Approximate bool `json:"approximate,omitempty"`
+}
+
+// Report is published on the downtime topic after reconnecting
+type Report struct {
+	Type    string   `json:"type"` // Always "downtime"
+	Windows []Window `json:"windows"`
+	Total   int64    `json:"total"` // Seconds, of Windows
+	TS      int64    `json:"ts"`
+}
+
+// Config configures downtime tracking
+type Config struct {
+	// Publish sends a report, returning once the broker accepted it
+	Publish   func(*Report) error
+	Connected func() bool
+}
+
+// flushing serializes reports, so a window is never reported twice
+var flushing sync.Mutex
+
+var state = struct {
+	mu         sync.Mutex
+	cfg        Config
+	lastSeen   int64 // Last time the broker was known reachable
+	current    *Window
+	unreported []Window
+	history    []Window // Latest first
+}{}
+
+// Start loads the state left by the previous process, turning the time it was
+// down into a window, and keeps the record current until ctx is cancelled
+func Start(ctx context.Context, cfg Config) {
+	state.mu.Lock()
+	state.cfg = cfg
+	load()
+	bootTime, _ := metrics.BootInfo()
+	now := time.Now().Unix()
+	switch {
+	case state.current != nil:
+		// Stopped by the reboot, or down since before it
+		if state.current.Cause == CauseStopped && bootTime > state.current.Start {
+			state.current.Cause = CauseReboot
+		}
+	case state.lastSeen > 0:
+		cause := CauseRestart
+		if bootTime > state.lastSeen {
+			cause = CauseReboot
+		}
+		state.current = &Window{Start: state.lastSeen, Cause: cause, Approximate: true}
+	}
+	if state.current != nil {
+		logger.Info("Offline since", "start", time.Unix(state.current.Start, 0), "cause", state.current.Cause,
+			"seconds", now-state.current.Start)
+	}
+	save()
+	state.mu.Unlock()
+
+	go loop(ctx)
+}
+
+// Lost starts a window when the connection to the broker drops or connecting
+// fails. The error of a window already going is kept if it had none
+func Lost(err error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if w := state.current; w != nil {
+		if w.Error == "" && err != nil {
+			w.Error = err.Error()
+			save()
+		}
+		return
+	}
+	w := &Window{Start: time.Now().Unix(), Cause: Classify(err)}
+	if err != nil {
+		w.Error = err.Error()
+	}
+	state.current = w
+	save()
+}
+
+// Connected ends the current window and publishes the windows not yet reported
+func Connected() {
+	state.mu.Lock()
+	now := time.Now().Unix()
+	if w := state.current; w != nil {
+		w.End = now
+		w.Duration = max(w.End-w.Start, 0)
+		state.unreported = append(state.unreported, *w)
+		if len(state.unreported) > maxUnreported {
+			state.unreported = state.unreported[len(state.unreported)-maxUnreported:]
+		}
+		state.history = append([]Window{*w}, state.history...)
+		if len(state.history) > maxHistory {
+			state.history = state.history[:maxHistory]
+		}
+		state.current = nil
+		logger.Info("Broker reachable again", "cause", w.Cause, "seconds", w.Duration)
+	}
+	state.lastSeen = now
+	save()
+	state.mu.Unlock()
+
+	go flush()
+}
+
+// Stopped records a clean stop, so the time until the next start is a window of its own
+func Stopped() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.current == nil {
+		state.current = &Window{Start: time.Now().Unix(), Cause: CauseStopped}
+	}
+	save()
+}
+
+// Status returns the current window, if offline, and the latest windows
+func Status() map[string]interface{} {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	status := map[string]interface{}{"history": append([]Window{}, state.history...)}
+	if state.current != nil {
+		w := *state.current
+		w.Duration = max(time.Now().Unix()-w.Start, 0)
+		status["current"] = w
+	}
+	return status
+}
+
+// flush publishes the windows not yet reported in one report
+func flush() {
+	defer crash.Catch("downtime report")
+	if state.cfg.Publish == nil {
+		return
+	}
+	flushing.Lock()
+	defer flushing.Unlock()
+	state.mu.Lock()
+	windows := append([]Window{}, state.unreported...)
+	state.mu.Unlock()
+	if len(windows) == 0 {
+		return
+	}
+
+	report := &Report{Type: "downtime", Windows: windows, TS: time.Now().Unix()}
+	for _, w := range windows {
+		report.Total += w.Duration
+	}
+	if err := state.cfg.Publish(report); err != nil {
+		logger.Warn("Downtime report not published, kept for the next connect", "windows", len(windows), "error", err)
+		return
+	}
+	state.mu.Lock()
+	state.unreported = state.unreported[min(len(windows), len(state.unreported)):]
+	save()
+	state.mu.Unlock()
+}
+
+// loop records the time while connected and watches the default route while not
+func loop(ctx context.Context) {
+	defer crash.Recover("downtime")
+	ticker := time.NewTicker(wanCheckInterval)
+	defer ticker.Stop()
+	lastBeat := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		state.mu.Lock()
+		switch {
+		case state.current != nil:
+			if !hasDefaultRoute() {
+				state.current.WANDown += int64(wanCheckInterval.Seconds())
+				if state.current.Cause == CauseTimeout || state.current.Cause == CauseNetwork ||
+					state.current.Cause == CauseDNS || state.current.Cause == CauseUnknown {
+					state.current.Cause = CauseWANDown
+				}
+				save()
+			}
+		case time.Since(lastBeat) >= heartbeatInterval && (state.cfg.Connected == nil || state.cfg.Connected()):
+			state.lastSeen = time.Now().Unix()
+			lastBeat = time.Now()
+			save()
+		}
+		state.mu.Unlock()
+	}
+}
+
+// Classify maps a connection error to a cause
+func Classify(err error) string {
+	if err == nil {
+		return CauseUnknown
+	}
+	msg := err.Error()
+	var dnsErr *net.DNSError
+	switch {
+	case !hasDefaultRoute():
+		return CauseWANDown
+	case strings.Contains(msg, "not Authorized") || strings.Contains(msg, "NotAuthorized") ||
+		strings.Contains(msg, "bad user name or password"):
+		return CauseAuth
+	case errors.As(err, &dnsErr) || strings.Contains(msg, "no such host"):
+		return CauseDNS
+	case errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(msg, "connection refused"):
+		return CauseRefused
+	case errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		strings.Contains(msg, "unreachable") || strings.Contains(msg, "no route to host"):
+		return CauseNetwork
+	case strings.Contains(msg, "pingresp not received") || strings.Contains(msg, "timeout"):
+		return CauseTimeout
+	case strings.Contains(msg, "EOF") || strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe"):
+		return CauseBrokerClosed
+	}
+	return CauseUnknown
+}
+
+// hasDefaultRoute reports whether the kernel has an IPv4 or IPv6 default route; it
+// errs on the side of true when the routing tables cannot be read
+func hasDefaultRoute() bool {
+	found, readable := false, false
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		readable = true
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			// Iface Destination Gateway Flags ... Mask; a default route has destination and mask 0
+			if len(fields) >= 8 && fields[1] == "00000000" && fields[7] == "00000000" {
+				found = true
+			}
+		}
+		f.Close()
+	}
+	if f, err := os.Open("/proc/net/ipv6_route"); err == nil && !found {
+		readable = true
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			// Destination prefix-length ... device; skip the unreachable default of the loopback
+			if len(fields) >= 10 && fields[0] == strings.Repeat("0", 32) && fields[1] == "00" && fields[9] != "lo" {
+				found = true
+			}
+		}
+		f.Close()
+	}
+	return found || !readable
+}
+
+func load() {
+	data, err := os.ReadFile(File)
+	if err != nil {
+		return
+	}
+	var saved struct {
+		LastSeen   int64    `json:"lastSeen"`
+		Current    *Window  `json:"current"`
+		Unreported []Window `json:"unreported"`
+		History    []Window `json:"history"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		logger.Error("Ignoring corrupt downtime file", "file", File, "error", err)
+		return
+	}
+	state.lastSeen, state.current, state.unreported, state.history = saved.LastSeen, saved.Current, saved.Unreported, saved.History
+}
+
+// save writes File; state.mu must be held
+func save() {
+	data, err := json.Marshal(map[string]interface{}{
+		"lastSeen":   state.lastSeen,
+		"current":    state.current,
+		"unreported": state.unreported,
+		"history":    state.history,
+	})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(File), 0755)
+	}
+	if err == nil {
+		tmp := File + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, File)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save downtime", "error", err)
+	}
+}
@@ -0,0 +1,677 @@
+package inventory
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+)
+
+const (
+	DefaultDiscoveryInterval = time.Hour
+
+	// MaxSubnetHosts bounds the addresses of one swept subnet, a /22
+	MaxSubnetHosts = 1024
+
+	// Replies to the mDNS and SSDP queries are collected this long
+	discoveryWait = 3 * time.Second
+
+	// Probes are paced so a sweep does not flood the LAN or the kernel's neighbor table
+	probeGap = 2 * time.Millisecond
+
+	maxHosts           = 2048
+	maxServicesPerHost = 32
+	maxDescription     = 64 << 10
+)
+
+var (
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	ssdpGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+	// ErrDiscoveryDisabled is returned by Discover when SPOTFI_DISCOVERY is off
+	ErrDiscoveryDisabled = errors.New("network discovery is disabled")
+)
+
+// Service is something a device advertises over mDNS or SSDP
+type Service struct {
+	Protocol string `json:"protocol"`        // mdns or ssdp
+	Type     string `json:"type,omitempty"`  // e.g. _ipp._tcp or urn:schemas-upnp-org:device:MediaRenderer:1
+	Name     string `json:"name,omitempty"`  // mDNS instance or UPnP friendly name
+	Port     int    `json:"port,omitempty"`  // From the SRV record or the description URL
+	Model    string `json:"model,omitempty"` // From the TXT record or the UPnP description
+	Server   string `json:"server,omitempty"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+// host is what was learned about an IP from its announcements
+type host struct {
+	hostname string
+	services map[string]*Service
+	lastSeen int64
+}
+
+// lanNet is a LAN subnet the router is attached to
+type lanNet struct {
+	iface  *net.Interface
+	ip     net.IP
+	subnet *net.IPNet
+}
+
+// discovering serializes discovery runs
+var discovering sync.Mutex
+
+// Discover sweeps the subnets so the kernel resolves every host that answers
+// ARP, queries mDNS and SSDP, and merges what was found into the inventory
+func Discover(ctx context.Context) (*Inventory, error) {
+	state.mu.Lock()
+	enabled, subnets := state.discovery, state.subnets
+	state.mu.Unlock()
+	if !enabled {
+		return nil, ErrDiscoveryDisabled
+	}
+	discovering.Lock()
+	defer discovering.Unlock()
+
+	nets := lanNets(subnets)
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("no LAN subnet to scan")
+	}
+	probes := 0
+	for _, n := range nets {
+		probes += sweep(ctx, n, MaxSubnetHosts)
+	}
+	var wg sync.WaitGroup
+	for _, n := range nets {
+		wg.Add(1)
+		go func(n lanNet) {
+			defer wg.Done()
+			defer crash.Catch("inventory query")
+			query(ctx, n)
+		}(n)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	Scan()
+
+	state.mu.Lock()
+	state.lastDiscovery = time.Now().Unix()
+	state.mu.Unlock()
+	inv, _ := Current()
+	logger.Info("Network discovery finished", "subnets", len(nets), "probes", probes, "devices", len(inv.Devices))
+	return inv, nil
+}
+
+// discoveryLoop runs a discovery every interval and publishes its inventory
+func discoveryLoop(ctx context.Context, subnets []*net.IPNet, interval time.Duration, publish func(*Inventory) error) {
+	defer crash.Recover("inventory discovery")
+	for _, n := range lanNets(subnets) {
+		go listen(ctx, n.iface, mdnsGroup, handleMDNS)
+		go listen(ctx, n.iface, ssdpGroup, handleSSDP)
+	}
+	if interval < 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		inv, err := Discover(ctx)
+		if err != nil {
+			logger.Warn("Network discovery failed", "error", err)
+			continue
+		}
+		if err := publish(inv); err != nil {
+			logger.Error("Failed to publish inventory", "error", err)
+		}
+	}
+}
+
+// lanNets returns the IPv4 subnets to scan: those of subnets the router has an
+// address in or, without subnets, its private networks of at most
+// MaxSubnetHosts addresses. Interfaces with the default route are never scanned
+func lanNets(subnets []*net.IPNet) []lanNet {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	wan := defaultRouteInterfaces()
+	var nets []lanNet
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&(net.FlagLoopback|net.FlagPointToPoint) != 0 || wan[iface.Name] {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			ip := ipnet.IP.To4()
+			if len(subnets) == 0 {
+				ones, _ := ipnet.Mask.Size()
+				if ip.IsPrivate() && 1<<(32-ones) <= MaxSubnetHosts {
+					nets = append(nets, lanNet{iface, ip, &net.IPNet{IP: ip.Mask(ipnet.Mask), Mask: ipnet.Mask}})
+				}
+				continue
+			}
+			for _, s := range subnets {
+				if s.Contains(ip) {
+					nets = append(nets, lanNet{iface, ip, s})
+				}
+			}
+		}
+	}
+	return nets
+}
+
+// defaultRouteInterfaces reads the interfaces of the IPv4 default routes
+func defaultRouteInterfaces() map[string]bool {
+	ifaces := map[string]bool{}
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ifaces
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ... Mask
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 8 && fields[1] == "00000000" && fields[7] == "00000000" {
+			ifaces[fields[0]] = true
+		}
+	}
+	return ifaces
+}
+
+// sweep sends a UDP datagram to the discard port of every address of n, so the
+// kernel ARPs for each one and the hosts that answer land in the neighbor table.
+// Nothing listens on the port, and no raw socket or arp-scan is needed
+func sweep(ctx context.Context, n lanNet, limit int) int {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: n.ip})
+	if err != nil {
+		logger.Warn("Cannot sweep subnet", "subnet", n.subnet, "error", err)
+		return 0
+	}
+	defer conn.Close()
+
+	ones, _ := n.subnet.Mask.Size()
+	size := uint32(1) << (32 - ones)
+	base := binary.BigEndian.Uint32(n.subnet.IP.To4())
+	sent := 0
+	for i := uint32(1); i+1 < size && sent < limit; i++ {
+		if ctx.Err() != nil {
+			break
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+i)
+		if ip.Equal(n.ip) {
+			continue
+		}
+		conn.WriteToUDP([]byte{0}, &net.UDPAddr{IP: ip, Port: 9})
+		sent++
+		time.Sleep(probeGap)
+	}
+	return sent
+}
+
+// probe makes the kernel resolve a host heard on the LAN but not in the neighbor table
+func probe(ip net.IP) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return
+	}
+	conn.Write([]byte{0})
+	conn.Close()
+}
+
+// query asks the hosts of n for their mDNS services and UPnP devices. It queries
+// from an ordinary port, so mDNS responders answer it directly and it works
+// alongside umdns and miniupnpd holding ports 5353 and 1900
+func query(ctx context.Context, n lanNet) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: n.ip})
+	if err != nil {
+		logger.Warn("Cannot query subnet", "subnet", n.subnet, "error", err)
+		return
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(discoveryWait)
+	conn.SetReadDeadline(deadline)
+
+	conn.WriteToUDP(dnsQuery("_services._dns-sd._udp.local"), mdnsGroup)
+	conn.WriteToUDP([]byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\n"+
+		"MX: 2\r\nST: ssdp:all\r\n\r\n"), ssdpGroup)
+
+	queried := map[string]bool{}
+	buf := make([]byte, 9000)
+	for ctx.Err() == nil {
+		size, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg := buf[:size]
+		if from.Port == ssdpGroup.Port || strings.HasPrefix(string(msg), "HTTP/") {
+			handleSSDP(msg, from)
+			continue
+		}
+		// The service types found are queried for their instances in turn
+		for _, t := range handleMDNS(msg, from) {
+			if !queried[t] && len(queried) < maxServicesPerHost*4 {
+				queried[t] = true
+				conn.WriteToUDP(dnsQuery(t), mdnsGroup)
+			}
+		}
+	}
+}
+
+// listen picks up the announcements devices multicast on iface. Binding the
+// group port fails where another daemon holds it exclusively; queries then
+// still find the devices on each discovery
+func listen(ctx context.Context, iface *net.Interface, group *net.UDPAddr, handle func([]byte, *net.UDPAddr) []string) {
+	defer crash.Recover("inventory listener")
+	conn, err := net.ListenMulticastUDP("udp4", iface, group)
+	if err != nil {
+		logger.Debug("Not listening for announcements", "interface", iface.Name, "group", group, "error", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 9000)
+	for {
+		size, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		handle(buf[:size], from)
+	}
+}
+
+// learn records what ip announced; update runs with state.mu held
+func learn(ip net.IP, update func(h *host)) {
+	key := ip.String()
+	state.mu.Lock()
+	if !state.discovery || isLocal(ip) {
+		state.mu.Unlock()
+		return
+	}
+	h, ok := state.hosts[key]
+	if !ok {
+		if len(state.hosts) >= maxHosts {
+			state.mu.Unlock()
+			return
+		}
+		h = &host{services: map[string]*Service{}}
+		state.hosts[key] = h
+	}
+	h.lastSeen = time.Now().Unix()
+	update(h)
+	known := false
+	for _, d := range state.devices {
+		for _, a := range d.IPs {
+			known = known || a == key
+		}
+	}
+	state.mu.Unlock()
+	if !known {
+		probe(ip)
+	}
+}
+
+// addService adds or refreshes a service of h, returning nil when h has too many
+func (h *host) addService(key string, s Service) *Service {
+	existing, ok := h.services[key]
+	if !ok {
+		if len(h.services) >= maxServicesPerHost {
+			return nil
+		}
+		existing = &s
+		h.services[key] = existing
+	}
+	existing.LastSeen = time.Now().Unix()
+	return existing
+}
+
+func isLocal(ip net.IP) bool {
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMDNS merges the records of an mDNS response into the sender's services,
+// returning the service types it lists in answer to the enumeration query
+func handleMDNS(msg []byte, from *net.UDPAddr) []string {
+	records, err := parseDNS(msg)
+	if err != nil || len(records) == 0 {
+		return nil
+	}
+	var types []string
+	learn(from.IP, func(h *host) {
+		for _, r := range records {
+			switch r.typ {
+			case dnsA:
+				if r.ip.Equal(from.IP) && len(r.name) == 2 && strings.EqualFold(r.name[1], "local") {
+					h.hostname = r.name[0]
+				}
+			case dnsPTR:
+				if strings.EqualFold(strings.Join(r.name, "."), "_services._dns-sd._udp.local") {
+					if t, ok := serviceType(r.target); ok {
+						types = append(types, t+".local")
+					}
+					continue
+				}
+				instance, t, ok := splitInstance(r.target)
+				if !ok {
+					continue
+				}
+				key := "mdns|" + strings.ToLower(instance+"."+t)
+				if r.ttl == 0 {
+					delete(h.services, key)
+					continue
+				}
+				h.addService(key, Service{Protocol: "mdns", Type: t, Name: instance})
+			case dnsSRV, dnsTXT:
+				instance, t, ok := splitInstance(r.name)
+				if !ok {
+					continue
+				}
+				s := h.addService("mdns|"+strings.ToLower(instance+"."+t), Service{Protocol: "mdns", Type: t, Name: instance})
+				if s == nil {
+					continue
+				}
+				if r.typ == dnsSRV {
+					s.Port = r.port
+				}
+				for _, kv := range r.txt {
+					// Printers announce ty, most other devices md
+					if k, v, ok := strings.Cut(kv, "="); ok && (strings.EqualFold(k, "md") || strings.EqualFold(k, "ty")) && s.Model == "" {
+						s.Model = v
+					}
+				}
+			}
+		}
+	})
+	return types
+}
+
+// serviceType returns the type of labels such as _ipp._tcp.local
+func serviceType(labels []string) (string, bool) {
+	if len(labels) != 3 || !strings.HasPrefix(labels[0], "_") || !strings.EqualFold(labels[2], "local") {
+		return "", false
+	}
+	return labels[0] + "." + labels[1], true
+}
+
+// splitInstance splits "HP LaserJet._ipp._tcp.local" into the instance name and type
+func splitInstance(labels []string) (string, string, bool) {
+	if len(labels) < 4 {
+		return "", "", false
+	}
+	t, ok := serviceType(labels[len(labels)-3:])
+	if !ok {
+		return "", "", false
+	}
+	return strings.Join(labels[:len(labels)-3], "."), t, true
+}
+
+// handleSSDP merges an SSDP announcement or search response into the sender's
+// services, one per device description
+func handleSSDP(msg []byte, from *net.UDPAddr) []string {
+	lines := strings.Split(string(msg), "\r\n")
+	if len(lines) == 0 || !(strings.HasPrefix(lines[0], "NOTIFY ") || strings.HasPrefix(lines[0], "HTTP/1.1 200")) {
+		return nil
+	}
+	headers := map[string]string{}
+	for _, line := range lines[1:] {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			headers[strings.ToUpper(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	location := headers["LOCATION"]
+	u, err := url.Parse(location)
+	if location == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	nt := headers["NT"]
+	if nt == "" {
+		nt = headers["ST"]
+	}
+	fetch := false
+	learn(from.IP, func(h *host) {
+		key := "ssdp|" + location
+		if headers["NTS"] == "ssdp:byebye" {
+			delete(h.services, key)
+			return
+		}
+		port, _ := strconv.Atoi(u.Port())
+		s := h.addService(key, Service{Protocol: "ssdp", Port: port})
+		if s == nil {
+			return
+		}
+		if s.Type == "" && strings.Contains(nt, ":device:") {
+			s.Type = nt
+		}
+		if server := headers["SERVER"]; server != "" {
+			s.Server = server
+		}
+		// The description is only fetched from the device itself, never from
+		// another address an announcement points to
+		fetch = s.Name == "" && net.ParseIP(u.Hostname()).Equal(from.IP)
+	})
+	if fetch {
+		go describe(from.IP, location)
+	}
+	return nil
+}
+
+// describing holds the description URLs being fetched
+var describing = struct {
+	sync.Mutex
+	urls map[string]bool
+}{urls: map[string]bool{}}
+
+// describe fetches a UPnP device description for the friendly name and model
+func describe(ip net.IP, location string) {
+	defer crash.Catch("inventory describe")
+	describing.Lock()
+	if describing.urls[location] || len(describing.urls) >= 8 {
+		describing.Unlock()
+		return
+	}
+	describing.urls[location] = true
+	describing.Unlock()
+	defer func() {
+		describing.Lock()
+		delete(describing.urls, location)
+		describing.Unlock()
+	}()
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(location)
+	if err != nil {
+		logger.Debug("Failed to fetch UPnP description", "url", location, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	var desc struct {
+		Device struct {
+			DeviceType   string `xml:"deviceType"`
+			FriendlyName string `xml:"friendlyName"`
+			Manufacturer string `xml:"manufacturer"`
+			ModelName    string `xml:"modelName"`
+		} `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxDescription)).Decode(&desc); err != nil {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	h, ok := state.hosts[ip.String()]
+	if !ok {
+		return
+	}
+	s, ok := h.services["ssdp|"+location]
+	if !ok {
+		return
+	}
+	d := desc.Device
+	s.Name = d.FriendlyName
+	if d.DeviceType != "" {
+		s.Type = d.DeviceType
+	}
+	s.Model = strings.TrimSpace(d.Manufacturer + " " + d.ModelName)
+}
+
+// DNS record types read from mDNS responses
+const (
+	dnsA   = 1
+	dnsPTR = 12
+	dnsTXT = 16
+	dnsSRV = 33
+)
+
+type dnsRecord struct {
+	name   []string
+	typ    uint16
+	ttl    uint32
+	target []string // PTR and SRV
+	port   int      // SRV
+	ip     net.IP   // A
+	txt    []string
+}
+
+// dnsQuery builds an mDNS query for the PTR records of name
+func dnsQuery(name string) []byte {
+	msg := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, dnsPTR, 0, 1)
+}
+
+// parseDNS returns the answer and additional records of a DNS response
+func parseDNS(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return nil, errors.New("not a DNS response")
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+	var records []dnsRecord
+	for i := 0; i < count && i < 256; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return records, errors.New("truncated record")
+		}
+		r := dnsRecord{name: name, typ: binary.BigEndian.Uint16(msg[next:]), ttl: binary.BigEndian.Uint32(msg[next+4:])}
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+length > len(msg) {
+			return records, errors.New("truncated record")
+		}
+		rdata := msg[start : start+length]
+		switch r.typ {
+		case dnsA:
+			if length == 4 {
+				r.ip = net.IPv4(rdata[0], rdata[1], rdata[2], rdata[3])
+			}
+		case dnsPTR:
+			r.target, _, err = readName(msg, start)
+		case dnsSRV:
+			if length >= 7 {
+				r.port = int(binary.BigEndian.Uint16(rdata[4:]))
+				r.target, _, err = readName(msg, start+6)
+			}
+		case dnsTXT:
+			for j := 0; j < len(rdata); {
+				n := int(rdata[j])
+				if j+1+n > len(rdata) {
+					break
+				}
+				r.txt = append(r.txt, string(rdata[j+1:j+1+n]))
+				j += 1 + n
+			}
+		}
+		if err == nil {
+			records = append(records, r)
+		}
+		off = start + length
+	}
+	return records, nil
+}
+
+// readName reads a possibly compressed name at off, returning its labels and
+// the offset after it
+func readName(msg []byte, off int) ([]string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return nil, 0, errors.New("truncated name")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return labels, end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return nil, 0, errors.New("invalid name pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return nil, 0, errors.New("truncated label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
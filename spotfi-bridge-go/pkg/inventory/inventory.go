@@ -0,0 +1,342 @@
+package inventory
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("inventory")
+
+const (
+	DefaultInterval = 5 * time.Minute
+
+	// The neighbor table is sampled more often than it is published so that
+	// short visits still show up with accurate last-seen times
+	scanInterval = 30 * time.Second
+
+	// Devices not seen for this long are dropped from the inventory
+	forgetAfter = 24 * time.Hour
+)
+
+// OUIFiles are the vendor databases tried in order: the bridge's own copy,
+// arp-scan's ieee-oui.txt and Wireshark's manuf
+var OUIFiles = []string{
+	"/usr/share/spotfi/oui.txt",
+	"/usr/share/arp-scan/ieee-oui.txt",
+	"/usr/share/wireshark/manuf",
+}
+
+// Config configures the inventory reporter
+type Config struct {
+	// Interval between inventory messages; negative disables the subsystem
+	Interval time.Duration
+
+	// Discovery enables sweeping the LAN subnets and collecting mDNS and SSDP
+	// announcements; DiscoveryInterval schedules the sweeps, negative for on demand only
+	Discovery         bool
+	DiscoveryInterval time.Duration
+
+	// Subnets are the IPv4 CIDRs swept, default the router's private LAN subnets
+	Subnets []string
+}
+
+// Device is one host seen in the ARP/neighbor table
+type Device struct {
+	Mac        string   `json:"mac"`
+	IPs        []string `json:"ips"`
+	Interface  string   `json:"interface"`
+	Vendor     string   `json:"vendor,omitempty"`
+	Randomized bool     `json:"randomized,omitempty"` // Locally administered (private) MAC
+	Active     bool     `json:"active"`               // Present in the latest scan
+	FirstSeen  int64    `json:"firstSeen"`
+	LastSeen   int64    `json:"lastSeen"`
+
+	// Hostname and Services are what the device announced over mDNS and SSDP (with discovery)
+	Hostname string    `json:"hostname,omitempty"`
+	Services []Service `json:"services,omitempty"`
+}
+
+// Inventory is published on the inventory topic
+type Inventory struct {
+	Type    string   `json:"type"` // Always "inventory"
+	Devices []Device `json:"devices"`
+	TS      int64    `json:"ts"`
+
+	LastDiscovery int64 `json:"lastDiscovery,omitempty"`
+}
+
+var state = struct {
+	mu            sync.Mutex
+	enabled       bool
+	devices       map[string]*Device
+	ouiOnce       sync.Once
+	oui           map[string]string
+	discovery     bool
+	subnets       []*net.IPNet
+	hosts         map[string]*host // By IP
+	lastDiscovery int64
+}{devices: map[string]*Device{}, hosts: map[string]*host{}}
+
+// Configure starts scanning the neighbor table and publishing the inventory
+func Configure(ctx context.Context, cfg Config, publish func(*Inventory) error) {
+	if cfg.Interval < 0 {
+		return
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.DiscoveryInterval == 0 {
+		cfg.DiscoveryInterval = DefaultDiscoveryInterval
+	}
+	var subnets []*net.IPNet
+	for _, s := range cfg.Subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil || subnet.IP.To4() == nil {
+			logger.Warn("Ignoring invalid discovery subnet", "subnet", s)
+			continue
+		}
+		subnets = append(subnets, subnet)
+	}
+	state.mu.Lock()
+	state.enabled = true
+	state.discovery = cfg.Discovery
+	state.subnets = subnets
+	state.mu.Unlock()
+	if cfg.Discovery {
+		go discoveryLoop(ctx, subnets, cfg.DiscoveryInterval, publish)
+	}
+
+	go func() {
+		defer crash.Recover("inventory")
+		scan := time.NewTicker(scanInterval)
+		defer scan.Stop()
+		report := time.NewTicker(cfg.Interval)
+		defer report.Stop()
+		Scan()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-scan.C:
+				Scan()
+			case <-report.C:
+				inv, _ := Current()
+				if err := publish(inv); err != nil {
+					logger.Error("Failed to publish inventory", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Current returns the inventory, sorted by MAC; ok is false when the
+// subsystem is disabled
+func Current() (*Inventory, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.enabled {
+		return nil, false
+	}
+	inv := &Inventory{Type: "inventory", Devices: []Device{}, TS: time.Now().Unix(), LastDiscovery: state.lastDiscovery}
+	for _, d := range state.devices {
+		dev := *d
+		dev.IPs = append([]string(nil), d.IPs...)
+		for _, ip := range d.IPs {
+			h, ok := state.hosts[ip]
+			if !ok {
+				continue
+			}
+			if dev.Hostname == "" {
+				dev.Hostname = h.hostname
+			}
+			for _, s := range h.services {
+				dev.Services = append(dev.Services, *s)
+			}
+		}
+		sort.Slice(dev.Services, func(i, j int) bool {
+			a, b := dev.Services[i], dev.Services[j]
+			if a.Protocol != b.Protocol {
+				return a.Protocol < b.Protocol
+			}
+			if a.Type != b.Type {
+				return a.Type < b.Type
+			}
+			return a.Name < b.Name
+		})
+		inv.Devices = append(inv.Devices, dev)
+	}
+	sort.Slice(inv.Devices, func(i, j int) bool { return inv.Devices[i].Mac < inv.Devices[j].Mac })
+	return inv, true
+}
+
+// Scan merges the current neighbor table into the inventory
+func Scan() {
+	neighbors := readNeighbors()
+	now := time.Now().Unix()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.enabled {
+		return
+	}
+	for _, d := range state.devices {
+		d.Active = false
+	}
+	for mac, n := range neighbors {
+		d, ok := state.devices[mac]
+		if !ok {
+			d = &Device{Mac: mac, FirstSeen: now, Vendor: vendor(mac), Randomized: randomized(mac)}
+			state.devices[mac] = d
+		}
+		d.IPs, d.Interface, d.Active = n.ips, n.iface, true
+		// STALE entries are kept by the kernel without recent traffic, so
+		// they only count as a sighting the first time
+		if n.confirmed || !ok {
+			d.LastSeen = now
+		}
+	}
+	for mac, d := range state.devices {
+		if now-d.LastSeen > int64(forgetAfter.Seconds()) {
+			delete(state.devices, mac)
+		}
+	}
+	for ip, h := range state.hosts {
+		for key, s := range h.services {
+			if now-s.LastSeen > int64(forgetAfter.Seconds()) {
+				delete(h.services, key)
+			}
+		}
+		if now-h.lastSeen > int64(forgetAfter.Seconds()) {
+			delete(state.hosts, ip)
+		}
+	}
+}
+
+type neighbor struct {
+	ips       []string
+	iface     string
+	confirmed bool
+}
+
+// readNeighbors parses "ip neigh show", e.g.
+// "192.168.1.20 dev br-lan lladdr aa:bb:cc:dd:ee:ff REACHABLE", falling back
+// to /proc/net/arp when ip is not installed. WAN-side neighbors are included
+func readNeighbors() map[string]*neighbor {
+	neighbors := map[string]*neighbor{}
+	add := func(ip, iface, mac string, confirmed bool) {
+		mac = strings.ToLower(mac)
+		if mac == "" || mac == "00:00:00:00:00:00" {
+			return
+		}
+		n, ok := neighbors[mac]
+		if !ok {
+			n = &neighbor{iface: iface}
+			neighbors[mac] = n
+		}
+		n.ips = append(n.ips, ip)
+		n.confirmed = n.confirmed || confirmed
+	}
+
+	if out, err := exec.Command("ip", "neigh", "show").Output(); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 5 {
+				continue
+			}
+			var iface, mac string
+			for i := 1; i+1 < len(f); i++ {
+				switch f[i] {
+				case "dev":
+					iface = f[i+1]
+				case "lladdr":
+					mac = f[i+1]
+				}
+			}
+			switch st := f[len(f)-1]; st {
+			case "FAILED", "INCOMPLETE", "NOARP":
+			default:
+				add(f[0], iface, mac, st != "STALE")
+			}
+		}
+		return neighbors
+	}
+
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return neighbors
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[2] == "0x0" || fields[0] == "IP" {
+			continue
+		}
+		add(fields[0], fields[5], fields[3], true)
+	}
+	return neighbors
+}
+
+// randomized reports whether the locally administered bit is set, as it is
+// for the private addresses phones use per network
+func randomized(mac string) bool {
+	if len(mac) < 2 {
+		return false
+	}
+	b, err := strconv.ParseUint(mac[:2], 16, 8)
+	return err == nil && b&0x02 != 0
+}
+
+// vendor looks up the OUI of mac in the first vendor database found
+func vendor(mac string) string {
+	state.ouiOnce.Do(func() { state.oui = loadOUI() })
+	key := strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(mac))
+	if len(key) < 6 {
+		return ""
+	}
+	return state.oui[key[:6]]
+}
+
+// loadOUI reads "001122<tab>Vendor" (arp-scan) or "00:11:22<tab>Short<tab>Long"
+// (Wireshark) lines; longer Wireshark prefixes such as 00:11:22:33/28 are skipped
+func loadOUI() map[string]string {
+	oui := map[string]string{}
+	for _, path := range OUIFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			fields := strings.Split(line, "\t")
+			if len(fields) < 2 {
+				continue
+			}
+			prefix := strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(fields[0]))
+			if len(prefix) != 6 {
+				continue
+			}
+			name := strings.TrimSpace(fields[len(fields)-1])
+			oui[prefix] = name
+		}
+		f.Close()
+		return oui
+	}
+	return oui
+}
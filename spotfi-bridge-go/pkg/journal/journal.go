@@ -0,0 +1,435 @@
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("journal")
+
+const (
+	DefaultPath    = "/etc/spotfi/journal.log"
+	DefaultMaxSize = 1 << 20
+
+	// Acknowledged entries and ack records are rewritten away once they take this much of the file
+	compactGarbage = 64 << 10
+
+	// The file is synced this often rather than on every write, to spare the flash
+	syncInterval = 5 * time.Second
+	sendInterval = 30 * time.Second
+)
+
+// ErrDisabled is returned by Append when the journal is not enabled
+var ErrDisabled = errors.New("journal disabled")
+
+// Config configures the journal. Events appended to it are kept in a file until
+// the backend acknowledges them, across broker outages and reboots
+type Config struct {
+	Enabled bool
+	Path    string
+
+	// MaxSize bounds the unacknowledged entries in bytes; when full the oldest are discarded
+	MaxSize int64
+
+	// Publish sends an entry's payload on topic (relative to the router's topics),
+	// returning once the broker accepted it. It is only called while Connected reports true
+	Publish   func(topic string, payload json.RawMessage) error
+	Connected func() bool
+}
+
+// record is a line of the journal file: an entry, an acknowledgment, or the
+// header written on compaction
+type record struct {
+	Seq     uint64          `json:"seq,omitempty"`
+	Topic   string          `json:"topic,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Ack     uint64          `json:"ack,omitempty"`
+	Next    uint64          `json:"next,omitempty"`
+}
+
+type entry struct {
+	seq     uint64
+	topic   string
+	payload json.RawMessage
+	size    int64 // Of its line in the file
+}
+
+var state = struct {
+	mu       sync.Mutex
+	cfg      Config
+	file     *os.File
+	entries  []entry // Unacknowledged, oldest first
+	size     int64   // Of the entries' lines
+	fileSize int64
+	next     uint64 // Sequence number of the next entry
+	acked    uint64 // Highest acknowledged sequence number
+	sent     uint64 // Highest sequence number published since the last connect
+	dirty    bool
+	lost     int64 // Entries discarded from a full journal
+	running  bool
+}{}
+
+var wake = make(chan struct{}, 1)
+
+// Configure opens the journal when enabled, loading the entries left unacknowledged
+// by the previous process, and starts delivering them
+func Configure(ctx context.Context, cfg Config) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Path == "" {
+		cfg.Path = DefaultPath
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = DefaultMaxSize
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.cfg = cfg
+	state.next = 1
+	if err := loadLocked(); err != nil {
+		logger.Error("Journal disabled", "path", cfg.Path, "error", err)
+		return
+	}
+	state.running = true
+	logger.Info("Journal opened", "path", cfg.Path, "pending", len(state.entries), "next", state.next)
+
+	go sendLoop(ctx)
+	go syncLoop(ctx)
+}
+
+// Enabled reports whether events go through the journal
+func Enabled() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.running
+}
+
+// loadLocked reads the journal file, skipping a line cut short by a power loss,
+// and rewrites it compacted; state.mu must be held
+func loadLocked() error {
+	if err := os.MkdirAll(filepath.Dir(state.cfg.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Open(state.cfg.Path)
+	if err == nil {
+		reader := bufio.NewReader(f)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				var r record
+				if json.Unmarshal(line, &r) != nil {
+					logger.Warn("Skipping corrupt journal line", "bytes", len(line))
+				} else {
+					applyLocked(r, int64(len(line)))
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	trimLocked()
+	return compactLocked()
+}
+
+// applyLocked replays a record read from the file
+func applyLocked(r record, size int64) {
+	if r.Next > state.next {
+		state.next = r.Next
+	}
+	if r.Ack > state.acked {
+		state.acked = r.Ack
+		dropAckedLocked()
+	}
+	if r.Seq > state.acked && r.Topic != "" && len(r.Payload) > 0 {
+		state.entries = append(state.entries, entry{seq: r.Seq, topic: r.Topic, payload: r.Payload, size: size})
+		state.size += size
+		if r.Seq >= state.next {
+			state.next = r.Seq + 1
+		}
+	}
+}
+
+func dropAckedLocked() {
+	n := 0
+	for n < len(state.entries) && state.entries[n].seq <= state.acked {
+		state.size -= state.entries[n].size
+		n++
+	}
+	state.entries = state.entries[n:]
+}
+
+// trimLocked discards the oldest entries once they exceed MaxSize, down to 90%
+// of it, so a full journal is compacted once per batch rather than per append
+func trimLocked() bool {
+	if state.size <= state.cfg.MaxSize {
+		return false
+	}
+	n := 0
+	for state.size > state.cfg.MaxSize/10*9 && n < len(state.entries) {
+		state.size -= state.entries[n].size
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+	logger.Warn("Journal full, discarded the oldest entries", "entries", n, "maxSize", state.cfg.MaxSize)
+	state.entries = state.entries[n:]
+	state.lost += int64(n)
+	return true
+}
+
+// compactLocked rewrites the file with a header and the unacknowledged entries only
+func compactLocked() error {
+	var buf bytes.Buffer
+	header, _ := json.Marshal(record{Next: state.next, Ack: state.acked})
+	buf.Write(header)
+	buf.WriteByte('\n')
+	for _, e := range state.entries {
+		line, _ := json.Marshal(record{Seq: e.seq, Topic: e.topic, Payload: e.payload})
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	tmp := state.cfg.Path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, state.cfg.Path); err != nil {
+		return err
+	}
+	if state.file != nil {
+		state.file.Close()
+	}
+	f, err := os.OpenFile(state.cfg.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		state.file = nil
+		return err
+	}
+	state.file = f
+	state.fileSize = int64(buf.Len())
+	state.dirty = false
+	return nil
+}
+
+// writeLocked appends a record to the file, compacting it when it has grown
+// well past what it still needs to hold
+func writeLocked(line []byte) {
+	if state.file == nil {
+		if err := compactLocked(); err != nil {
+			logger.Error("Journal not writable", "error", err)
+			return
+		}
+	}
+	if _, err := state.file.Write(line); err != nil {
+		logger.Error("Journal write failed", "error", err)
+		return
+	}
+	state.fileSize += int64(len(line))
+	state.dirty = true
+	if state.fileSize-state.size >= min(compactGarbage, state.cfg.MaxSize) {
+		if err := compactLocked(); err != nil {
+			logger.Error("Journal compaction failed", "error", err)
+		}
+	}
+}
+
+// Append journals an event for topic. v is published as a JSON object with the
+// entry's sequence number added as journalSeq, which the backend acknowledges
+func Append(topic string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	state.mu.Lock()
+	if !state.running {
+		state.mu.Unlock()
+		return ErrDisabled
+	}
+	seq := state.next
+	state.next++
+	doc["journalSeq"], _ = json.Marshal(seq)
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		state.mu.Unlock()
+		return err
+	}
+	line, _ := json.Marshal(record{Seq: seq, Topic: topic, Payload: payload})
+	line = append(line, '\n')
+	state.entries = append(state.entries, entry{seq: seq, topic: topic, payload: payload, size: int64(len(line))})
+	state.size += int64(len(line))
+	if trimLocked() {
+		// Discarded entries must not come back after a restart
+		if err := compactLocked(); err != nil {
+			logger.Error("Journal compaction failed", "error", err)
+		}
+	} else {
+		writeLocked(line)
+	}
+	state.mu.Unlock()
+
+	Flush()
+	return nil
+}
+
+// Ack acknowledges every entry up to and including seq
+func Ack(seq uint64) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.running || seq <= state.acked {
+		return
+	}
+	if seq >= state.next {
+		logger.Warn("Ignoring acknowledgment of an entry never journaled", "seq", seq, "next", state.next)
+		return
+	}
+	state.acked = seq
+	dropAckedLocked()
+	line, _ := json.Marshal(record{Ack: seq})
+	writeLocked(append(line, '\n'))
+}
+
+// HandleAck processes an acknowledgment {"seq": N} from the backend
+func HandleAck(payload []byte) {
+	var ack struct {
+		Seq uint64 `json:"seq"`
+	}
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		logger.Warn("Ignoring invalid journal acknowledgment", "error", err)
+		return
+	}
+	Ack(ack.Seq)
+}
+
+// Reconnected delivers again every unacknowledged entry, e.g. after reconnecting,
+// as the backend may have missed those published before the connection dropped
+func Reconnected() {
+	state.mu.Lock()
+	state.sent = state.acked
+	state.mu.Unlock()
+	Flush()
+}
+
+// Flush wakes the sender
+func Flush() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns the journal counters for the health report, or nil when disabled
+func Stats() map[string]interface{} {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.running {
+		return nil
+	}
+	return map[string]interface{}{
+		"pending":  len(state.entries),
+		"bytes":    state.size,
+		"fileSize": state.fileSize,
+		"acked":    state.acked,
+		"lost":     state.lost,
+	}
+}
+
+func sendLoop(ctx context.Context) {
+	defer crash.Recover("journal sender")
+	ticker := time.NewTicker(sendInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+		if state.cfg.Connected != nil && !state.cfg.Connected() {
+			continue
+		}
+		if err := send(); err != nil {
+			logger.Debug("Journal entry not published, kept for retry", "error", err)
+		}
+	}
+}
+
+// send publishes the entries not yet sent on this connection, oldest first
+func send() error {
+	for {
+		state.mu.Lock()
+		var next *entry
+		for i := range state.entries {
+			if state.entries[i].seq > state.sent {
+				e := state.entries[i]
+				next = &e
+				break
+			}
+		}
+		state.mu.Unlock()
+		if next == nil {
+			return nil
+		}
+		if err := state.cfg.Publish(next.topic, next.payload); err != nil {
+			return err
+		}
+		state.mu.Lock()
+		if next.seq > state.sent {
+			state.sent = next.seq
+		}
+		state.mu.Unlock()
+	}
+}
+
+// syncLoop flushes appended records to flash every syncInterval
+func syncLoop(ctx context.Context) {
+	defer crash.Recover("journal sync")
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			Close()
+			return
+		case <-ticker.C:
+		}
+		state.mu.Lock()
+		if state.dirty && state.file != nil {
+			state.file.Sync()
+			state.dirty = false
+		}
+		state.mu.Unlock()
+	}
+}
+
+// Close syncs and closes the journal file; later appends fail with ErrDisabled
+func Close() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.file != nil {
+		state.file.Sync()
+		state.file.Close()
+		state.file = nil
+	}
+	state.running = false
+}
@@ -0,0 +1,57 @@
+package journal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTrimLocked(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+		sizes   []int64 // Of the entries, oldest first
+		trimmed bool
+		kept    []uint64 // Sequence numbers left
+	}{
+		{"empty", 100, nil, false, nil},
+		{"under the limit", 100, []int64{30, 30, 30}, false, []uint64{1, 2, 3}},
+		{"at the limit", 100, []int64{50, 50}, false, []uint64{1, 2}},
+		{"just over", 100, []int64{40, 40, 30}, true, []uint64{2, 3}},
+		{"down to 90 percent", 1000, []int64{100, 100, 100, 100, 100, 100, 100, 100, 100, 101}, true, []uint64{3, 4, 5, 6, 7, 8, 9, 10}},
+		{"oversized newest", 100, []int64{10, 200}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state.mu.Lock()
+			defer state.mu.Unlock()
+			state.cfg = Config{MaxSize: tt.maxSize}
+			state.entries, state.size, state.lost = nil, 0, 0
+			for i, size := range tt.sizes {
+				state.entries = append(state.entries, entry{seq: uint64(i + 1), size: size})
+				state.size += size
+			}
+
+			if got := trimLocked(); got != tt.trimmed {
+				t.Errorf("trimLocked = %t, want %t", got, tt.trimmed)
+			}
+			var kept []uint64
+			var size int64
+			for _, e := range state.entries {
+				kept = append(kept, e.seq)
+				size += e.size
+			}
+			if !reflect.DeepEqual(kept, tt.kept) {
+				t.Errorf("kept entries %v, want %v", kept, tt.kept)
+			}
+			if state.size != size {
+				t.Errorf("size = %d, entries add up to %d", state.size, size)
+			}
+			if tt.trimmed && state.size > tt.maxSize/10*9 {
+				t.Errorf("size = %d after trimming, want at most 90%% of %d", state.size, tt.maxSize)
+			}
+			if lost := int64(len(tt.sizes) - len(tt.kept)); state.lost != lost {
+				t.Errorf("lost = %d, want %d", state.lost, lost)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package location
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("location")
+
+const (
+	DefaultInterval = 30 * time.Second
+	DefaultGPSD     = "gpsd://127.0.0.1:2947"
+
+	// DisabledFile persists a remote opt-out across restarts
+	DisabledFile = "/etc/spotfi/location.disabled"
+
+	// A fix older than this is reported as lost
+	staleAfter = 10 * time.Second
+)
+
+// Config configures the location reporter
+type Config struct {
+	// Source is gpsd://host:port or the path of a serial port streaming NMEA
+	// (e.g. the GNSS port of an LTE modem); empty disables the subsystem
+	Source string
+
+	// Interval between location messages
+	Interval time.Duration
+
+	// Precision rounds coordinates to this many decimals (0 keeps full precision);
+	// 3 decimals is roughly 100 m
+	Precision int
+}
+
+// Fix is published on the location topic
+type Fix struct {
+	Type       string   `json:"type"` // Always "location"
+	Source     string   `json:"source"`
+	Mode       string   `json:"fix"` // none, 2d or 3d
+	Lat        *float64 `json:"lat,omitempty"`
+	Lon        *float64 `json:"lon,omitempty"`
+	AltM       *float64 `json:"altM,omitempty"`
+	SpeedKmh   *float64 `json:"speedKmh,omitempty"`
+	Course     *float64 `json:"course,omitempty"` // Degrees from true north
+	Satellites int      `json:"satellites,omitempty"`
+	HDOP       *float64 `json:"hdop,omitempty"`
+	FixTime    int64    `json:"fixTime,omitempty"` // When the receiver reported the position
+	TS         int64    `json:"ts"`
+}
+
+var state = struct {
+	mu       sync.Mutex
+	cfg      Config
+	disabled bool // Remote opt-out, see SetEnabled
+	fix      Fix
+	fixAt    time.Time
+}{}
+
+// Configure starts reading the receiver and publishing fixes when a source is set
+func Configure(ctx context.Context, cfg Config, publish func(*Fix) error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	_, err := os.Stat(DisabledFile)
+	state.mu.Lock()
+	state.cfg = cfg
+	state.disabled = err == nil
+	state.mu.Unlock()
+
+	if cfg.Source == "" {
+		return
+	}
+	if strings.HasPrefix(cfg.Source, "gpsd://") {
+		go readLoop(ctx, cfg.Source, readGPSD)
+	} else {
+		go readLoop(ctx, cfg.Source, readNMEA)
+	}
+
+	go func() {
+		defer crash.Recover("location report")
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			fix, ok := Current()
+			if !ok {
+				continue
+			}
+			if err := publish(fix); err != nil {
+				logger.Error("Failed to publish location", "error", err)
+			}
+		}
+	}()
+}
+
+// Current returns the latest fix, rounded to the configured precision; ok is
+// false when location reporting is disabled
+func Current() (*Fix, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.cfg.Source == "" || state.disabled {
+		return nil, false
+	}
+	fix := state.fix
+	fix.Type, fix.Source, fix.TS = "location", state.cfg.Source, time.Now().Unix()
+	if state.fixAt.IsZero() || time.Since(state.fixAt) > staleAfter {
+		fix = Fix{Type: fix.Type, Source: fix.Source, Mode: "none", TS: fix.TS}
+	}
+	if p := state.cfg.Precision; p > 0 {
+		scale := math.Pow10(p)
+		for _, v := range []**float64{&fix.Lat, &fix.Lon} {
+			if *v != nil {
+				*v = float(math.Round(**v*scale) / scale)
+			}
+		}
+	}
+	return &fix, true
+}
+
+// Status reports whether location reporting is configured and enabled
+func Status() map[string]interface{} {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return map[string]interface{}{
+		"configured": state.cfg.Source != "",
+		"enabled":    state.cfg.Source != "" && !state.disabled,
+		"source":     state.cfg.Source,
+		"interval":   int(state.cfg.Interval.Seconds()),
+		"precision":  state.cfg.Precision,
+	}
+}
+
+// SetEnabled turns reporting on or off for this router; the opt-out is
+// persisted so it survives restarts and upgrades of the bridge
+func SetEnabled(enabled bool) error {
+	if enabled {
+		if err := os.Remove(DisabledFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll("/etc/spotfi", 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(DisabledFile, nil, 0644); err != nil {
+			return err
+		}
+	}
+	state.mu.Lock()
+	state.disabled = !enabled
+	state.mu.Unlock()
+	return nil
+}
+
+func update(f func(fix *Fix)) {
+	state.mu.Lock()
+	f(&state.fix)
+	state.fixAt = time.Now()
+	state.mu.Unlock()
+}
+
+// readLoop keeps the receiver open, reconnecting with a backoff
+func readLoop(ctx context.Context, source string, read func(ctx context.Context, source string) error) {
+	defer crash.Recover("location reader")
+	backoff := time.Second
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := read(ctx, source)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		logger.Warn("Location source failed", "source", source, "error", err, "retry", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+// readGPSD streams TPV and SKY reports from gpsd
+func readGPSD(ctx context.Context, source string) error {
+	addr := strings.TrimPrefix(source, "gpsd://")
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	if _, err := io.WriteString(conn, `?WATCH={"enable":true,"json":true}`+"\n"); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var report struct {
+			Class string   `json:"class"`
+			Mode  int      `json:"mode"`
+			Time  string   `json:"time"`
+			Lat   *float64 `json:"lat"`
+			Lon   *float64 `json:"lon"`
+			Alt   *float64 `json:"altMSL"`
+			Speed *float64 `json:"speed"` // m/s
+			Track *float64 `json:"track"`
+			HDOP  *float64 `json:"hdop"`
+			USat  int      `json:"uSat"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &report) != nil {
+			continue
+		}
+		switch report.Class {
+		case "TPV":
+			update(func(fix *Fix) {
+				fix.Mode = [...]string{"none", "none", "2d", "3d"}[min(max(report.Mode, 0), 3)]
+				fix.Lat, fix.Lon, fix.AltM, fix.Course = report.Lat, report.Lon, report.Alt, report.Track
+				fix.SpeedKmh = nil
+				if report.Speed != nil {
+					fix.SpeedKmh = float(*report.Speed * 3.6)
+				}
+				if t, err := time.Parse(time.RFC3339, report.Time); err == nil {
+					fix.FixTime = t.Unix()
+				}
+			})
+		case "SKY":
+			update(func(fix *Fix) {
+				fix.Satellites = report.USat
+				if report.HDOP != nil {
+					fix.HDOP = report.HDOP
+				}
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("connection closed")
+}
+
+// readNMEA parses RMC and GGA sentences from a serial port
+func readNMEA(ctx context.Context, source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, '*'); i >= 0 {
+			line = line[:i] // Checksum
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) < 10 || len(fields[0]) != 6 || fields[0][0] != '$' {
+			continue
+		}
+		switch fields[0][3:] {
+		case "RMC":
+			// $GNRMC,time,status,lat,N,lon,E,knots,course,date,...
+			if fields[2] != "A" {
+				update(func(fix *Fix) { fix.Mode, fix.Lat, fix.Lon = "none", nil, nil })
+				continue
+			}
+			lat, lon := nmeaCoord(fields[3], fields[4]), nmeaCoord(fields[5], fields[6])
+			update(func(fix *Fix) {
+				fix.Lat, fix.Lon = lat, lon
+				if fix.Mode == "" || fix.Mode == "none" {
+					fix.Mode = "2d"
+				}
+				fix.SpeedKmh, fix.Course = nil, nil
+				if knots, err := strconv.ParseFloat(fields[7], 64); err == nil {
+					fix.SpeedKmh = float(knots * 1.852)
+				}
+				if course, err := strconv.ParseFloat(fields[8], 64); err == nil {
+					fix.Course = float(course)
+				}
+				if t, err := time.Parse("020106150405", fields[9]+strings.SplitN(fields[1], ".", 2)[0]); err == nil {
+					fix.FixTime = t.Unix()
+				}
+			})
+		case "GGA":
+			// $GPGGA,time,lat,N,lon,E,quality,satellites,hdop,altitude,M,...
+			quality, _ := strconv.Atoi(fields[6])
+			sats, _ := strconv.Atoi(fields[7])
+			update(func(fix *Fix) {
+				fix.Satellites = sats
+				fix.HDOP, fix.AltM = nil, nil
+				if hdop, err := strconv.ParseFloat(fields[8], 64); err == nil {
+					fix.HDOP = float(hdop)
+				}
+				if alt, err := strconv.ParseFloat(fields[9], 64); err == nil {
+					fix.AltM = float(alt)
+				}
+				switch {
+				case quality == 0:
+					fix.Mode = "none"
+				case fix.AltM != nil:
+					fix.Mode = "3d"
+				default:
+					fix.Mode = "2d"
+				}
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("end of stream")
+}
+
+// nmeaCoord converts ddmm.mmmm with its hemisphere to decimal degrees
+func nmeaCoord(value, hemisphere string) *float64 {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	deg := math.Floor(v / 100)
+	dec := deg + (v-deg*100)/60
+	if hemisphere == "S" || hemisphere == "W" {
+		dec = -dec
+	}
+	return &dec
+}
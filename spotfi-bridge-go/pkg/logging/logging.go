@@ -0,0 +1,228 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// state is the output shared by every logger, replaced by Setup
+var state = struct {
+	mu        sync.RWMutex
+	base      slog.Handler
+	level     slog.Level            // Default level
+	overrides map[string]slog.Level // Per-subsystem levels
+
+	configured string      // Spec of the last SetLevels, restored when an Override ends
+	revert     *time.Timer // Ends the running Override
+	until      time.Time
+}{
+	base:  slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: readableDurations}),
+	level: slog.LevelInfo,
+}
+
+func init() {
+	slog.SetDefault(For("bridge"))
+}
+
+// Setup directs all loggers to w as "text" (key=value) or "json" lines. Messages
+// from the standard log package, e.g. of dependencies, go to the "bridge" logger at info level
+func Setup(w io.Writer, format string) error {
+	opts := &slog.HandlerOptions{
+		Level:       slog.LevelDebug, // Filtered per subsystem
+		ReplaceAttr: readableDurations,
+	}
+	var h slog.Handler
+	switch format {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q (use text or json)", format)
+	}
+	state.mu.Lock()
+	state.base = h
+	state.mu.Unlock()
+	slog.SetDefault(For("bridge"))
+	return nil
+}
+
+// readableDurations logs durations as "1m30s" instead of nanoseconds
+func readableDurations(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.String(a.Key, a.Value.Duration().String())
+	}
+	return a
+}
+
+// ParseLevels reads a level spec: a default level optionally followed by
+// subsystem=level overrides, e.g. "info,rpc=debug,mqtt=warn"
+func ParseLevels(spec string) (slog.Level, map[string]slog.Level, error) {
+	def := slog.LevelInfo
+	overrides := map[string]slog.Level{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, lvl, scoped := strings.Cut(part, "=")
+		if !scoped {
+			lvl = name
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(lvl)); err != nil {
+			return 0, nil, fmt.Errorf("invalid log level %q (use debug, info, warn or error)", lvl)
+		}
+		if scoped {
+			overrides[strings.TrimSpace(name)] = l
+		} else {
+			def = l
+		}
+	}
+	return def, overrides, nil
+}
+
+// SetLevels applies a level spec (see ParseLevels). During an Override it only takes
+// effect once the override ends
+func SetLevels(spec string) error {
+	def, overrides, err := ParseLevels(spec)
+	if err != nil {
+		return err
+	}
+	state.mu.Lock()
+	state.configured = spec
+	if state.revert == nil {
+		state.level, state.overrides = def, overrides
+	}
+	state.mu.Unlock()
+	return nil
+}
+
+// Override applies a level spec for d, after which the SetLevels levels are restored
+// and expired, if not nil, is called. It returns when that happens. A new Override
+// replaces a running one; an empty spec or d <= 0 ends it right away
+func Override(spec string, d time.Duration, expired func()) (time.Time, error) {
+	def, overrides, err := ParseLevels(spec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.revert != nil {
+		state.revert.Stop()
+		state.revert = nil
+	}
+	if spec == "" || d <= 0 {
+		restore()
+		return time.Time{}, nil
+	}
+	state.level, state.overrides = def, overrides
+	state.until = time.Now().Add(d)
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		state.mu.Lock()
+		current := state.revert == timer
+		if current {
+			state.revert = nil
+			restore()
+		}
+		state.mu.Unlock()
+		if current && expired != nil {
+			expired()
+		}
+	})
+	state.revert = timer
+	return state.until, nil
+}
+
+// OverrideUntil returns when the running Override ends, or the zero time
+func OverrideUntil() time.Time {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	if state.revert == nil {
+		return time.Time{}
+	}
+	return state.until
+}
+
+// restore applies the configured levels; state.mu must be held
+func restore() {
+	def, overrides, _ := ParseLevels(state.configured)
+	state.level, state.overrides = def, overrides
+}
+
+// Levels returns the current level spec
+func Levels() string {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	parts := []string{strings.ToLower(state.level.String())}
+	names := make([]string, 0, len(state.overrides))
+	for name := range state.overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, name+"="+strings.ToLower(state.overrides[name].String()))
+	}
+	return strings.Join(parts, ",")
+}
+
+// For returns the logger of a subsystem; its messages carry a "subsystem" attribute
+// and are filtered by the subsystem's level. It follows later Setup and SetLevels calls
+func For(subsystem string) *slog.Logger {
+	return slog.New(&handler{subsystem: subsystem})
+}
+
+// Fatal logs at error level and exits, for startup failures
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// handler resolves the shared output on every record, so loggers created at package
+// init pick up the configuration applied later
+type handler struct {
+	subsystem string
+	wrap      []func(slog.Handler) slog.Handler // WithAttrs and WithGroup, in order
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	min, ok := state.overrides[h.subsystem]
+	if !ok {
+		min = state.level
+	}
+	return l >= min
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	state.mu.RLock()
+	base := state.base
+	state.mu.RUnlock()
+	out := base.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, w := range h.wrap {
+		out = w(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *handler) with(w func(slog.Handler) slog.Handler) slog.Handler {
+	wrap := append(append([]func(slog.Handler) slog.Handler{}, h.wrap...), w)
+	return &handler{subsystem: h.subsystem, wrap: wrap}
+}
@@ -0,0 +1,389 @@
+package logship
+
+import (
+	"bufio"
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("logship")
+
+const (
+	DefaultSource        = "logread"
+	DefaultSeverity      = "warning"
+	DefaultBatchSize     = 50
+	DefaultFlushInterval = 10 * time.Second
+	DefaultMaxRate       = 20
+	DefaultBacklog       = 1000
+
+	// maxLineLength truncates single messages, e.g. kernel dumps
+	maxLineLength = 1024
+)
+
+// severities are the syslog severities, most severe first
+var severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Config configures log shipping. Lines are read from the system log as they are
+// written; the buffer already present at startup is not shipped
+type Config struct {
+	Enabled bool
+
+	// Source is "logread" or the path of a syslog file, which is followed like tail -F
+	Source string
+
+	// Severity is the least severe level shipped, e.g. "warning" ships warning and
+	// above. Lines whose severity cannot be parsed are treated as notice
+	Severity string
+
+	// Include limits shipping to these processes (syslog tags); empty ships all
+	Include []string
+
+	// Exclude drops lines containing any of these strings
+	Exclude []string
+
+	// BatchSize lines are published per message, at least every FlushInterval
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// MaxRate caps the lines accepted per second; the rest are only counted as dropped
+	MaxRate int
+
+	// Backlog is the number of lines kept while the broker is unreachable; when full
+	// the oldest are discarded
+	Backlog int
+}
+
+// Line is one shipped log line
+type Line struct {
+	TS       int64  `json:"ts"`
+	Facility string `json:"facility,omitempty"`
+	Severity string `json:"severity"`
+	Process  string `json:"process,omitempty"`
+	PID      int    `json:"pid,omitempty"`
+	Message  string `json:"message"`
+
+	seq int64
+}
+
+// Batch is published on the logs topic
+type Batch struct {
+	Type    string `json:"type"` // Always "logs"
+	Lines   []Line `json:"lines"`
+	Dropped int64  `json:"dropped,omitempty"` // Lines over MaxRate since the previous batch
+	Lost    int64  `json:"lost,omitempty"`    // Lines discarded from a full backlog since the previous batch
+}
+
+var state = struct {
+	mu       sync.Mutex
+	cfg      Config
+	minLevel int
+	pending  []Line // Oldest first, at most cfg.Backlog
+	seq      int64
+	dropped  int64
+	lost     int64
+	second   int64 // Unix second of the rate counter
+	inSecond int
+	shipped  int64
+	running  bool
+}{}
+
+// flushNow wakes the sender, e.g. on reconnect or when a batch is full
+var flushNow = make(chan struct{}, 1)
+
+// Configure starts shipping when enabled. publish is only called while connected
+// reports true; lines read meanwhile wait in the backlog
+func Configure(ctx context.Context, cfg Config, publish func(*Batch) error, connected func() bool) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Source == "" {
+		cfg.Source = DefaultSource
+	}
+	if cfg.Severity == "" {
+		cfg.Severity = DefaultSeverity
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	if cfg.MaxRate <= 0 {
+		cfg.MaxRate = DefaultMaxRate
+	}
+	if cfg.Backlog <= 0 {
+		cfg.Backlog = DefaultBacklog
+	}
+	state.mu.Lock()
+	state.cfg = cfg
+	state.minLevel = severityLevel(cfg.Severity)
+	state.running = true
+	state.mu.Unlock()
+
+	go followLoop(ctx, cfg.Source)
+	go sendLoop(ctx, cfg.FlushInterval, publish, connected)
+	logger.Info("Shipping system log", "source", cfg.Source, "severity", cfg.Severity)
+}
+
+// Flush publishes the backlog right away, e.g. after reconnecting
+func Flush() {
+	select {
+	case flushNow <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns the shipping counters for the health report, or nil when disabled
+func Stats() map[string]interface{} {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.running {
+		return nil
+	}
+	return map[string]interface{}{
+		"pending": len(state.pending),
+		"shipped": state.shipped,
+		"dropped": state.dropped,
+		"lost":    state.lost,
+	}
+}
+
+// followLoop restarts the reader with backoff until ctx is cancelled
+func followLoop(ctx context.Context, source string) {
+	defer crash.Recover("log ship reader")
+	backoff := time.Second
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := follow(ctx, source)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		logger.Warn("Log reader failed", "source", source, "error", err, "retry", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// follow streams new lines. "logread -f" replays the whole buffer first, so only
+// the last line is requested and then skipped
+func follow(ctx context.Context, source string) error {
+	cmd := exec.CommandContext(ctx, "tail", "-F", "-n", "0", source)
+	skip := false
+	if source == DefaultSource {
+		cmd = exec.CommandContext(ctx, "logread", "-f", "-l", "1")
+		skip = true
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 4096), 64*1024)
+	for scanner.Scan() {
+		if skip {
+			skip = false
+			continue
+		}
+		add(scanner.Text())
+	}
+	return cmd.Wait()
+}
+
+// add filters, rate-limits and queues one raw line
+func add(raw string) {
+	line, ok := parseLine(raw, time.Now())
+	if !ok {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	cfg := state.cfg
+	if severityLevel(line.Severity) > state.minLevel {
+		return
+	}
+	if len(cfg.Include) > 0 && !contains(cfg.Include, line.Process) {
+		return
+	}
+	for _, ex := range cfg.Exclude {
+		if strings.Contains(raw, ex) {
+			return
+		}
+	}
+	if now := time.Now().Unix(); now != state.second {
+		state.second, state.inSecond = now, 0
+	}
+	if state.inSecond >= cfg.MaxRate {
+		state.dropped++
+		return
+	}
+	state.inSecond++
+
+	if len(line.Message) > maxLineLength {
+		line.Message = line.Message[:maxLineLength] + "..."
+	}
+	state.seq++
+	line.seq = state.seq
+	state.pending = append(state.pending, line)
+	if over := len(state.pending) - cfg.Backlog; over > 0 {
+		state.pending = state.pending[over:]
+		state.lost += int64(over)
+	}
+	if len(state.pending) >= cfg.BatchSize {
+		Flush()
+	}
+}
+
+// sendLoop publishes the pending lines every interval or when woken by Flush
+func sendLoop(ctx context.Context, interval time.Duration, publish func(*Batch) error, connected func() bool) {
+	defer crash.Recover("log ship sender")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-flushNow:
+		}
+		if !connected() {
+			continue
+		}
+		if err := send(publish); err != nil {
+			logger.Debug("Log batch not published, kept for retry", "error", err)
+		}
+	}
+}
+
+// send publishes the pending lines in batches, oldest first. A batch that fails is
+// kept for the next attempt
+func send(publish func(*Batch) error) error {
+	for {
+		state.mu.Lock()
+		n := min(len(state.pending), state.cfg.BatchSize)
+		if n == 0 && state.dropped == 0 && state.lost == 0 {
+			state.mu.Unlock()
+			return nil
+		}
+		batch := &Batch{
+			Type:    "logs",
+			Lines:   append([]Line{}, state.pending[:n]...),
+			Dropped: state.dropped,
+			Lost:    state.lost,
+		}
+		state.mu.Unlock()
+
+		if err := publish(batch); err != nil {
+			return err
+		}
+
+		// New lines are appended and a full backlog drops from the front, so the
+		// lines still pending from this batch are at the front
+		state.mu.Lock()
+		if n > 0 {
+			last := batch.Lines[n-1].seq
+			for len(state.pending) > 0 && state.pending[0].seq <= last {
+				state.pending = state.pending[1:]
+			}
+		}
+		state.dropped -= batch.Dropped
+		state.lost -= batch.Lost
+		state.shipped += int64(len(batch.Lines))
+		state.mu.Unlock()
+	}
+}
+
+// parseLine reads a logread or syslogd line:
+//
+//	Tue Oct 14 10:00:00 2026 kern.err kernel: [  12.3] Out of memory: Killed process 123 (uhttpd)
+//	Oct 14 10:00:00 OpenWrt daemon.notice netifd: Interface 'wan' is now up
+//
+// Lines without a timestamp are stamped with now
+func parseLine(raw string, now time.Time) (Line, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return Line{}, false
+	}
+	line := Line{TS: now.Unix(), Severity: "notice"}
+	rest := raw
+	if len(raw) > 24 {
+		if t, err := time.ParseInLocation("Mon Jan _2 15:04:05 2006", raw[:24], time.Local); err == nil {
+			line.TS, rest = t.Unix(), raw[25:]
+		}
+	}
+	if rest == raw && len(raw) > 15 {
+		if t, err := time.ParseInLocation("Jan _2 15:04:05", raw[:15], time.Local); err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0) // Logged last December
+			}
+			line.TS, rest = t.Unix(), raw[16:]
+		}
+	}
+
+	// "facility.severity", possibly after a hostname
+	fields := strings.SplitN(rest, " ", 3)
+	for i := 0; i < len(fields)-1 && i < 2; i++ {
+		facility, sev, ok := strings.Cut(fields[i], ".")
+		if level := severityLevel(sev); ok && level >= 0 {
+			line.Facility, line.Severity = facility, severities[level]
+			rest = strings.Join(fields[i+1:], " ")
+			break
+		}
+	}
+
+	// "tag[pid]: message"
+	if tag, msg, ok := strings.Cut(rest, ": "); ok && !strings.Contains(tag, " ") {
+		if name, pid, ok := strings.Cut(strings.TrimSuffix(tag, "]"), "["); ok {
+			tag = name
+			line.PID, _ = strconv.Atoi(pid)
+		}
+		line.Process, rest = tag, msg
+	}
+	line.Message = rest
+	return line, true
+}
+
+// severityLevel is the syslog number of a severity (0 = emerg), or -1 if unknown
+func severityLevel(s string) int {
+	switch s {
+	case "error":
+		s = "err"
+	case "warn":
+		s = "warning"
+	case "panic":
+		s = "emerg"
+	}
+	for i, name := range severities {
+		if s == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
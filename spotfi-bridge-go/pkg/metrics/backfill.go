@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBackfillSize = 1024 * 1024
+
+	backfillBatch = 20
+)
+
+// BackfillSample is one sample recorded while the broker was unreachable
+type BackfillSample struct {
+	TS      int64           `json:"ts"`
+	Metrics json.RawMessage `json:"metrics"`
+
+	seq int64
+}
+
+// Backfill is a bounded in-memory buffer of samples collected while offline;
+// when full the oldest samples are dropped
+type Backfill struct {
+	maxBytes int
+
+	mu        sync.Mutex
+	samples   []BackfillSample
+	seq       int64
+	size      int
+	dropped   int64
+	replaying bool
+}
+
+// NewBackfill creates a buffer holding up to maxBytes of encoded samples
+func NewBackfill(maxBytes int) *Backfill {
+	if maxBytes <= 0 {
+		maxBytes = DefaultBackfillSize
+	}
+	return &Backfill{maxBytes: maxBytes}
+}
+
+// Add records a sample. The per-client list is left out to keep the buffer
+// small; graphs are drawn from the aggregate values
+func (b *Backfill) Add(m *Metrics) {
+	sample := *m
+	sample.Clients = nil
+	data, err := json.Marshal(&sample)
+	if err != nil || len(data) > b.maxBytes {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	b.samples = append(b.samples, BackfillSample{TS: time.Now().Unix(), Metrics: data, seq: b.seq})
+	b.size += len(data)
+	for b.size > b.maxBytes {
+		b.size -= len(b.samples[0].Metrics)
+		b.samples = b.samples[1:]
+		b.dropped++
+	}
+}
+
+// Len returns the number of buffered samples
+func (b *Backfill) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.samples)
+}
+
+// Replay publishes the buffered samples oldest first, in batches. A batch that
+// fails to publish is kept for the next replay; only one replay runs at a time
+func (b *Backfill) Replay(publish func(v interface{}) error) error {
+	b.mu.Lock()
+	if b.replaying {
+		b.mu.Unlock()
+		return nil
+	}
+	b.replaying = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.replaying = false
+		b.mu.Unlock()
+	}()
+
+	for {
+		b.mu.Lock()
+		n := min(len(b.samples), backfillBatch)
+		if n == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		batch := append([]BackfillSample(nil), b.samples[:n]...)
+		remaining, dropped := len(b.samples)-n, b.dropped
+		b.mu.Unlock()
+
+		msg := map[string]interface{}{
+			"type":      "metrics-backfill",
+			"samples":   batch,
+			"remaining": remaining,
+		}
+		if dropped > 0 {
+			msg["dropped"] = dropped
+		}
+		if err := publish(msg); err != nil {
+			return err
+		}
+
+		// Samples added meanwhile were appended and overflow only drops from the
+		// front, so whatever is left of the batch is still at the front
+		b.mu.Lock()
+		last := batch[len(batch)-1].seq
+		for len(b.samples) > 0 && b.samples[0].seq <= last {
+			b.size -= len(b.samples[0].Metrics)
+			b.samples = b.samples[1:]
+		}
+		b.dropped -= dropped
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"spotfi-bridge/pkg/ubus"
+)
+
+// Board identifies the hardware and firmware, from "ubus call system board"
+type Board struct {
+	Model     string `json:"model"`
+	BoardName string `json:"boardName"`
+	Kernel    string `json:"kernel"`
+	System    string `json:"system,omitempty"` // CPU description
+	Release   string `json:"release"`          // e.g. "OpenWrt 23.05.3"
+	Revision  string `json:"revision,omitempty"`
+	Target    string `json:"target,omitempty"` // e.g. ramips/mt7621
+}
+
+// board caches the first successful lookup; it cannot change without a reboot
+var board struct {
+	mu   sync.Mutex
+	info *Board
+}
+
+// BoardInfo returns the board and firmware description
+func BoardInfo() (*Board, error) {
+	board.mu.Lock()
+	defer board.mu.Unlock()
+	if board.info != nil {
+		return board.info, nil
+	}
+	res, err := ubus.Call("system", "board", nil)
+	if err != nil {
+		return nil, err
+	}
+	b := &Board{
+		Model:     str(res, "model"),
+		BoardName: str(res, "board_name"),
+		Kernel:    str(res, "kernel"),
+		System:    str(res, "system"),
+	}
+	if rel, ok := res["release"].(map[string]interface{}); ok {
+		b.Release = str(rel, "description")
+		if b.Release == "" {
+			b.Release = str(rel, "distribution") + " " + str(rel, "version")
+		}
+		b.Revision = str(rel, "revision")
+		b.Target = str(rel, "target")
+	}
+	board.info = b
+	return b, nil
+}
+
+// BootInfo returns the boot time from /proc/stat (stable, unlike now minus
+// uptime) and the kernel's random per-boot ID
+func BootInfo() (bootTime int64, bootID string) {
+	bootID = readTrimmed("/proc/sys/kernel/random/boot_id")
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, bootID
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			bootTime, _ = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			break
+		}
+	}
+	return bootTime, bootID
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"spotfi-bridge/pkg/ubus"
+)
+
+// Segment counts the clients of one SSID, radio or network
+type Segment struct {
+	Name       string `json:"name"`
+	Band       string `json:"band,omitempty"` // Radios only: 2g, 5g or 6g
+	VLAN       int    `json:"vlan,omitempty"` // Networks only, when the device is a VLAN
+	Connected  int    `json:"connected"`      // Associated wireless stations
+	Authorized int    `json:"authorized"`     // Clients logged in through the portal
+}
+
+// ClientBreakdown splits the client counts per SSID, radio and network (VLAN
+// or guest network), so staff and guest occupancy can be told apart
+type ClientBreakdown struct {
+	SSIDs    []Segment `json:"ssids"`
+	Radios   []Segment `json:"radios"`
+	Networks []Segment `json:"networks"`
+}
+
+// wifiIface is a wireless interface as configured in /etc/config/wireless
+type wifiIface struct {
+	radio    string
+	networks []string
+}
+
+// wirelessTopology maps interface names (wlan0) to their radio and networks
+func wirelessTopology() map[string]wifiIface {
+	topo := map[string]wifiIface{}
+	status, err := ubus.Call("network.wireless", "status", nil)
+	if err != nil {
+		return topo
+	}
+	for radio, v := range status {
+		r, _ := v.(map[string]interface{})
+		ifaces, _ := r["interfaces"].([]interface{})
+		for _, i := range ifaces {
+			iface, _ := i.(map[string]interface{})
+			name := str(iface, "ifname")
+			if name == "" {
+				continue
+			}
+			w := wifiIface{radio: radio}
+			conf, _ := iface["config"].(map[string]interface{})
+			nets, _ := conf["network"].([]interface{})
+			for _, n := range nets {
+				if s, ok := n.(string); ok {
+					w.networks = append(w.networks, s)
+				}
+			}
+			topo[name] = w
+		}
+	}
+	return topo
+}
+
+// networkVLAN returns the VLAN ID of a network whose device is e.g. eth0.20 or br-lan.20
+func networkVLAN(network string) int {
+	status, err := ubus.Call("network.interface."+network, "status", nil)
+	if err != nil {
+		return 0
+	}
+	dev := str(status, "l3_device", "device")
+	if i := strings.LastIndexByte(dev, '.'); i >= 0 {
+		if id, err := strconv.Atoi(dev[i+1:]); err == nil {
+			return id
+		}
+	}
+	return 0
+}
+
+func band(frequency int) string {
+	switch {
+	case frequency >= 5925:
+		return "6g"
+	case frequency >= 5000:
+		return "5g"
+	case frequency > 0:
+		return "2g"
+	}
+	return ""
+}
+
+// segments keeps segments addressable by name and returns them sorted
+type segments map[string]*Segment
+
+func (s segments) get(name string) *Segment {
+	seg := s[name]
+	if seg == nil {
+		seg = &Segment{Name: name}
+		s[name] = seg
+	}
+	return seg
+}
+
+func (s segments) sorted() []Segment {
+	list := make([]Segment, 0, len(s))
+	for _, seg := range s {
+		list = append(list, *seg)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// collectBreakdown attributes associated stations to their SSID, radio and
+// network; authorized clients that are not associated (wired) are counted
+// under their uspot instance
+func collectBreakdown(radios []RadioMetrics, clients []ClientTraffic) ClientBreakdown {
+	authorized := map[string]bool{}
+	for _, c := range clients {
+		if c.Authorized {
+			authorized[c.Mac] = true
+		}
+	}
+	topo := wirelessTopology()
+
+	ssids, radioSegs, networks := segments{}, segments{}, segments{}
+	seen := map[string]bool{}
+	for _, r := range radios {
+		w := topo[r.Device]
+		radioName := w.radio
+		if radioName == "" {
+			radioName = r.Phy
+		}
+
+		logged := 0
+		for _, mac := range r.stationMacs {
+			if authorized[mac] {
+				logged++
+				seen[mac] = true
+			}
+		}
+		if r.SSID != "" {
+			seg := ssids.get(r.SSID)
+			seg.Connected += r.Stations
+			seg.Authorized += logged
+		}
+		if radioName != "" {
+			seg := radioSegs.get(radioName)
+			seg.Band = band(r.Frequency)
+			seg.Connected += r.Stations
+			seg.Authorized += logged
+		}
+		for _, n := range w.networks {
+			seg := networks.get(n)
+			seg.Connected += r.Stations
+			seg.Authorized += logged
+		}
+	}
+	for _, c := range clients {
+		if c.Authorized && !seen[c.Mac] && c.Interface != "" {
+			networks.get(c.Interface).Authorized++
+		}
+	}
+	for name, seg := range networks {
+		seg.VLAN = networkVLAN(name)
+	}
+
+	return ClientBreakdown{SSIDs: ssids.sorted(), Radios: radioSegs.sorted(), Networks: networks.sorted()}
+}
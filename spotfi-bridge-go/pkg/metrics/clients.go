@@ -0,0 +1,232 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientTraffic is the usage of one hotspot client
+type ClientTraffic struct {
+	Mac            string  `json:"mac"`
+	IP             string  `json:"ip,omitempty"`
+	Interface      string  `json:"interface,omitempty"` // uspot instance
+	BytesUp        int64   `json:"bytesUp"`
+	BytesDown      int64   `json:"bytesDown"`
+	SessionSeconds int64   `json:"sessionSeconds"`
+	Authorized     bool    `json:"authorized"` // Passed the captive portal
+	RateUp         float64 `json:"rateUp"`     // Bytes/s since the previous collection
+	RateDown       float64 `json:"rateDown"`   // Bytes/s since the previous collection
+	Source         string  `json:"source"`     // Where the byte counters came from: uspot, nlbwmon or conntrack
+
+	// Voucher limits set by uspot; remaining values are only sent for limited sessions
+	SessionTimeout   int64  `json:"sessionTimeout,omitempty"` // Seconds
+	RemainingSeconds *int64 `json:"remainingSeconds,omitempty"`
+	QuotaBytes       int64  `json:"quotaBytes,omitempty"` // Upload and download combined
+	RemainingBytes   *int64 `json:"remainingBytes,omitempty"`
+}
+
+type trafficSample struct {
+	up, down int64
+	at       time.Time
+}
+
+// previous byte counters per MAC, used to derive the current rate
+var lastTraffic = struct {
+	mu      sync.Mutex
+	samples map[string]trafficSample
+}{samples: map[string]trafficSample{}}
+
+func number(m map[string]interface{}, names ...string) int64 {
+	for _, name := range names {
+		if v, ok := m[name].(float64); ok {
+			return int64(v)
+		}
+	}
+	return 0
+}
+
+func str(m map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		if v, ok := m[name].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// collectClients merges the uspot client list with byte counters from uspot
+// itself, nlbwmon or, as a last resort, the conntrack table of active flows
+func collectClients(clientList map[string]interface{}) []ClientTraffic {
+	clients := []ClientTraffic{}
+	for iface, v := range clientList {
+		entries, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for mac, e := range entries {
+			info, _ := e.(map[string]interface{})
+			c := ClientTraffic{
+				Mac:            strings.ToLower(mac),
+				IP:             str(info, "ip4addr", "ipaddr", "ip"),
+				Interface:      iface,
+				BytesUp:        number(info, "bytes_ul", "acct_output_octets", "upload"),
+				BytesDown:      number(info, "bytes_dl", "acct_input_octets", "download"),
+				SessionSeconds: number(info, "duration", "time"),
+				Source:         "uspot",
+				Authorized:     true,
+			}
+			// Clients are listed from their first contact; state tells whether they logged in
+			if state, ok := info["state"].(float64); ok {
+				c.Authorized = state != 0
+			}
+			applyLimits(&c, info)
+			clients = append(clients, c)
+		}
+	}
+
+	var nlbw, conntrack map[string][2]int64
+	for i := range clients {
+		c := &clients[i]
+		if c.BytesUp != 0 || c.BytesDown != 0 {
+			continue
+		}
+		if nlbw == nil {
+			nlbw = nlbwTraffic()
+		}
+		if t, ok := nlbw[c.Mac]; ok {
+			c.BytesUp, c.BytesDown, c.Source = t[0], t[1], "nlbwmon"
+			continue
+		}
+		if c.IP == "" {
+			continue
+		}
+		if conntrack == nil {
+			conntrack = conntrackTraffic()
+		}
+		if t, ok := conntrack[c.IP]; ok {
+			c.BytesUp, c.BytesDown, c.Source = t[0], t[1], "conntrack"
+		}
+	}
+
+	applyRates(clients)
+	// A stable order keeps consecutive samples comparable (delta publishing)
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Mac < clients[j].Mac })
+	return clients
+}
+
+// applyLimits fills in the remaining time and data of a voucher session. Quota
+// use is counted with uspot's own counters, which are what it enforces
+func applyLimits(c *ClientTraffic, info map[string]interface{}) {
+	if c.SessionTimeout = number(info, "session_timeout"); c.SessionTimeout > 0 {
+		remaining := max(c.SessionTimeout-c.SessionSeconds, 0)
+		c.RemainingSeconds = &remaining
+	}
+	if c.QuotaBytes = number(info, "max_total_octets"); c.QuotaBytes > 0 {
+		used := number(info, "bytes_dl", "acct_input_octets", "download") + number(info, "bytes_ul", "acct_output_octets", "upload")
+		remaining := max(c.QuotaBytes-used, 0)
+		c.RemainingBytes = &remaining
+	}
+}
+
+// applyRates derives per-client rates from the previous sample and forgets departed clients
+func applyRates(clients []ClientTraffic) {
+	now := time.Now()
+	lastTraffic.mu.Lock()
+	defer lastTraffic.mu.Unlock()
+
+	seen := map[string]trafficSample{}
+	for i := range clients {
+		c := &clients[i]
+		if prev, ok := lastTraffic.samples[c.Mac]; ok {
+			elapsed := now.Sub(prev.at).Seconds()
+			// Counters reset on a new session; report no rate rather than a negative one
+			if elapsed > 0 && c.BytesUp >= prev.up && c.BytesDown >= prev.down {
+				c.RateUp = float64(c.BytesUp-prev.up) / elapsed
+				c.RateDown = float64(c.BytesDown-prev.down) / elapsed
+			}
+		}
+		seen[c.Mac] = trafficSample{up: c.BytesUp, down: c.BytesDown, at: now}
+	}
+	lastTraffic.samples = seen
+}
+
+// nlbwTraffic returns cumulative [up, down] bytes per MAC from nlbwmon, if installed
+func nlbwTraffic() map[string][2]int64 {
+	traffic := map[string][2]int64{}
+	out, err := exec.Command("nlbw", "-c", "json", "-g", "mac").Output()
+	if err != nil {
+		return traffic
+	}
+	var table struct {
+		Columns []string        `json:"columns"`
+		Data    [][]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(out, &table); err != nil {
+		return traffic
+	}
+	col := map[string]int{}
+	for i, name := range table.Columns {
+		col[name] = i
+	}
+	macCol, okMac := col["mac"]
+	rxCol, okRx := col["rx_bytes"]
+	txCol, okTx := col["tx_bytes"]
+	if !okMac || !okRx || !okTx {
+		return traffic
+	}
+	for _, row := range table.Data {
+		if len(row) <= macCol || len(row) <= rxCol || len(row) <= txCol {
+			continue
+		}
+		mac, _ := row[macCol].(string)
+		rx, _ := row[rxCol].(float64)
+		tx, _ := row[txCol].(float64)
+		// nlbwmon counts from the client's point of view: rx is download
+		traffic[strings.ToLower(mac)] = [2]int64{int64(tx), int64(rx)}
+	}
+	return traffic
+}
+
+// conntrackTraffic sums [up, down] bytes of the active flows per source IP.
+// Byte counters are only present with net.netfilter.nf_conntrack_acct=1
+func conntrackTraffic() map[string][2]int64 {
+	traffic := map[string][2]int64{}
+	f, err := os.Open("/proc/net/nf_conntrack")
+	if err != nil {
+		return traffic
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), 64*1024)
+	for scanner.Scan() {
+		// The first src= and bytes= belong to the original (client -> internet)
+		// direction, the second bytes= to the reply
+		var src string
+		var counters []int64
+		for _, field := range strings.Fields(scanner.Text()) {
+			switch {
+			case src == "" && strings.HasPrefix(field, "src="):
+				src = field[len("src="):]
+			case strings.HasPrefix(field, "bytes="):
+				n, _ := strconv.ParseInt(field[len("bytes="):], 10, 64)
+				counters = append(counters, n)
+			}
+		}
+		if src == "" || len(counters) < 2 {
+			continue
+		}
+		t := traffic[src]
+		t[0] += counters[0]
+		t[1] += counters[1]
+		traffic[src] = t
+	}
+	return traffic
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const topConntrackSources = 5
+
+// ConntrackSource is a client holding many connection tracking entries
+type ConntrackSource struct {
+	IP      string `json:"ip"`
+	Entries int    `json:"entries"`
+}
+
+// ConntrackMetrics reports how full the connection tracking table is. A full
+// table makes the router drop new connections, which guests see as "no internet"
+type ConntrackMetrics struct {
+	Count        int64             `json:"count"`
+	Max          int64             `json:"max"`
+	UsedPercent  float64           `json:"usedPercent"`
+	Protocols    map[string]int    `json:"protocols"`           // Entries per protocol (tcp, udp, icmp, ...)
+	TCPStates    map[string]int    `json:"tcpStates,omitempty"` // TCP entries per state
+	TopSources   []ConntrackSource `json:"topSources,omitempty"`
+	Drop         int64             `json:"drop"`         // Packets dropped because the table was full (since boot)
+	EarlyDrop    int64             `json:"earlyDrop"`    // Entries evicted to make room (since boot)
+	InsertFailed int64             `json:"insertFailed"` // Entries that could not be inserted (since boot)
+}
+
+// collectConntrack returns nil when connection tracking is not loaded. If only
+// the table listing or the drop counters fail, the rest is returned with the error
+func collectConntrack() (*ConntrackMetrics, error) {
+	data, err := os.ReadFile("/proc/sys/net/netfilter/nf_conntrack_count")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("nf_conntrack_count: %w", err)
+	}
+	c := &ConntrackMetrics{Count: count, Protocols: map[string]int{}, TCPStates: map[string]int{}}
+	c.Max, _ = readInt("/proc/sys/net/netfilter/nf_conntrack_max")
+	if c.Max > 0 {
+		c.UsedPercent = float64(c.Count) / float64(c.Max) * 100
+	}
+
+	// The table listing needs nf_conntrack_procfs, which minimal images leave out
+	var errs []error
+	f, err := os.Open("/proc/net/nf_conntrack")
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		errs = append(errs, err)
+	default:
+		sources := map[string]int{}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 4096), 64*1024)
+		for scanner.Scan() {
+			// ipv4 2 tcp 6 431999 ESTABLISHED src=... dst=...
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 6 {
+				continue
+			}
+			proto := fields[2]
+			c.Protocols[proto]++
+			if proto == "tcp" && !strings.Contains(fields[5], "=") {
+				c.TCPStates[fields[5]]++
+			}
+			for _, field := range fields[4:] {
+				if src, ok := strings.CutPrefix(field, "src="); ok {
+					sources[src]++
+					break
+				}
+			}
+		}
+		err := scanner.Err()
+		f.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("/proc/net/nf_conntrack: %w", err))
+		}
+
+		for ip, n := range sources {
+			c.TopSources = append(c.TopSources, ConntrackSource{IP: ip, Entries: n})
+		}
+		sort.Slice(c.TopSources, func(i, j int) bool {
+			if c.TopSources[i].Entries != c.TopSources[j].Entries {
+				return c.TopSources[i].Entries > c.TopSources[j].Entries
+			}
+			return c.TopSources[i].IP < c.TopSources[j].IP
+		})
+		if len(c.TopSources) > topConntrackSources {
+			c.TopSources = c.TopSources[:topConntrackSources]
+		}
+	}
+
+	c.Drop, c.EarlyDrop, c.InsertFailed, err = conntrackStats()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return c, errors.Join(errs...)
+}
+
+// conntrackStats sums the per-CPU counters of /proc/net/stat/nf_conntrack,
+// a header line followed by one line of hex values per CPU
+func conntrackStats() (drop, earlyDrop, insertFailed int64, err error) {
+	data, err := os.ReadFile("/proc/net/stat/nf_conntrack")
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 {
+		return
+	}
+	col := map[string]int{}
+	for i, name := range strings.Fields(lines[0]) {
+		col[name] = i
+	}
+	sum := func(fields []string, name string) int64 {
+		i, ok := col[name]
+		if !ok || i >= len(fields) {
+			return 0
+		}
+		v, _ := strconv.ParseInt(fields[i], 16, 64)
+		return v
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		drop += sum(fields, "drop")
+		earlyDrop += sum(fields, "early_drop")
+		insertFailed += sum(fields, "insert_failed")
+	}
+	return
+}
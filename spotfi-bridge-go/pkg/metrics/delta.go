@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFullInterval is how often a full snapshot is sent in delta mode
+const DefaultFullInterval = 10 * time.Minute
+
+// DefaultDeadbands are the absolute changes below which a numeric field does
+// not count as changed. Paths are dotted JSON keys; array elements share the
+// path of their array (clients.rateDown applies to every client)
+var DefaultDeadbands = map[string]float64{
+	"cpuLoad":                         5,
+	"freeMemory":                      1024 * 1024,
+	"clients.rateUp":                  4096,
+	"clients.rateDown":                4096,
+	"clients.bytesUp":                 256 * 1024,
+	"clients.bytesDown":               1024 * 1024,
+	"clients.sessionSeconds":          300,
+	"wireless.noise":                  3,
+	"wireless.busyPercent":            5,
+	"storage.temperatures.celsius":    2,
+	"storage.filesystems.freeBytes":   1024 * 1024,
+	"storage.filesystems.usedPercent": 1,
+	"wan.uptime":                      math.Inf(1),
+	"wan.probedAt":                    math.Inf(1),
+	"wan.gateway.avgMs":               5,
+	"wan.gateway.jitterMs":            5,
+	"wan.target.avgMs":                10,
+	"wan.target.jitterMs":             10,
+}
+
+// deltaSkip lists keys that change on every sample and are only sent in full snapshots
+var deltaSkip = map[string]bool{"uptime": true}
+
+// DeltaEncoder turns samples into full snapshots and deltas. A delta carries
+// only the top-level keys that changed beyond their deadband since they were
+// last sent; consumers rebuild the state by merging deltas, key by key, into
+// the snapshot referenced by "base"
+type DeltaEncoder struct {
+	deadbands map[string]float64
+	fullEvery time.Duration
+
+	mu       sync.Mutex
+	sent     map[string]interface{} // Last sent value per top-level key
+	lastFull time.Time
+	seq      int64
+	base     int64
+}
+
+// NewDeltaEncoder creates an encoder; nil deadbands use DefaultDeadbands
+func NewDeltaEncoder(deadbands map[string]float64, fullEvery time.Duration) *DeltaEncoder {
+	if deadbands == nil {
+		deadbands = DefaultDeadbands
+	}
+	if fullEvery <= 0 {
+		fullEvery = DefaultFullInterval
+	}
+	return &DeltaEncoder{deadbands: deadbands, fullEvery: fullEvery}
+}
+
+// ParseDeadbands parses "path=value" entries on top of DefaultDeadbands
+func ParseDeadbands(entries []string) map[string]float64 {
+	deadbands := make(map[string]float64, len(DefaultDeadbands)+len(entries))
+	for k, v := range DefaultDeadbands {
+		deadbands[k] = v
+	}
+	for _, e := range entries {
+		path, val, ok := strings.Cut(e, "=")
+		if !ok {
+			continue
+		}
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			deadbands[path] = f
+		}
+	}
+	return deadbands
+}
+
+// Reset forces the next sample to be a full snapshot, e.g. after a reconnect
+// when the consumer may have missed messages
+func (e *DeltaEncoder) Reset() {
+	e.mu.Lock()
+	e.sent = nil
+	e.mu.Unlock()
+}
+
+// Encode returns the message to publish for a sample: a full snapshot when
+// forced, due or without a previous snapshot, otherwise a delta
+func (e *DeltaEncoder) Encode(m *Metrics, full bool) map[string]interface{} {
+	doc := toDocument(m)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	if full || e.sent == nil || time.Since(e.lastFull) >= e.fullEvery {
+		e.sent = doc
+		e.lastFull = time.Now()
+		e.base = e.seq
+		return map[string]interface{}{
+			"type":    "metrics",
+			"seq":     e.seq,
+			"metrics": m,
+		}
+	}
+
+	changed := map[string]interface{}{}
+	for k, v := range doc {
+		if deltaSkip[k] {
+			continue
+		}
+		if prev, ok := e.sent[k]; !ok || e.differs(k, prev, v) {
+			changed[k] = v
+			e.sent[k] = v
+		}
+	}
+	removed := []string{}
+	for k := range e.sent {
+		if _, ok := doc[k]; !ok {
+			removed = append(removed, k)
+			delete(e.sent, k)
+		}
+	}
+	msg := map[string]interface{}{
+		"type":    "metrics-delta",
+		"seq":     e.seq,
+		"base":    e.base,
+		"ts":      time.Now().Unix(),
+		"metrics": changed,
+	}
+	if len(removed) > 0 {
+		msg["removed"] = removed
+	}
+	return msg
+}
+
+// toDocument converts a sample to its generic JSON form
+func toDocument(m *Metrics) map[string]interface{} {
+	doc := map[string]interface{}{}
+	if b, err := json.Marshal(m); err == nil {
+		json.Unmarshal(b, &doc)
+	}
+	return doc
+}
+
+// differs compares two JSON values, applying the deadband of each numeric leaf
+func (e *DeltaEncoder) differs(path string, a, b interface{}) bool {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return true
+		}
+		return math.Abs(av-bv) > e.deadbands[path]
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return true
+		}
+		for k, v := range av {
+			w, ok := bv[k]
+			if !ok || e.differs(path+"."+k, v, w) {
+				return true
+			}
+		}
+		return false
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return true
+		}
+		for i := range av {
+			if e.differs(path, av[i], bv[i]) {
+				return true
+			}
+		}
+		return false
+	}
+	return !reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"spotfi-bridge/pkg/uci"
+)
+
+const (
+	DefaultDNSProbeName = "cloudflare.com"
+
+	clockProbeInterval = 5 * time.Minute
+
+	// Clocks further off than this break TLS handshakes and voucher expiry checks
+	maxClockOffset = 2 * time.Second
+)
+
+var ntpdOffsetRe = regexp.MustCompile(`reply from ([^:]+): offset:([-+0-9.]+) .*strat:(\d+)`)
+
+// DNSHealth is the result of resolving a known name through the local resolver
+type DNSHealth struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ClockHealth reports whether the system clock is synchronized
+type ClockHealth struct {
+	Source   string  `json:"source"` // chrony or ntpd
+	Synced   bool    `json:"synced"`
+	OffsetMs float64 `json:"offsetMs"` // As reported by the time source
+	Stratum  int     `json:"stratum,omitempty"`
+	Server   string  `json:"server,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// probeDNS resolves name through the system resolver (dnsmasq on OpenWrt)
+func probeDNS(ctx context.Context, name string) *DNSHealth {
+	h := &DNSHealth{Name: name}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+	h.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	switch {
+	case err != nil:
+		h.Error = err.Error()
+	case len(addrs) == 0:
+		h.Error = "no addresses"
+	default:
+		h.OK = true
+	}
+	return h
+}
+
+// probeClock asks chrony for its tracking state or, with busybox ntpd, queries
+// the first configured NTP server without setting the clock. The error is set
+// when chronyc itself fails; an unsynced clock or silent server is only reported
+// in ClockHealth. Without either time source it returns nil
+func probeClock(ctx context.Context) (*ClockHealth, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if _, err := exec.LookPath("chronyc"); err == nil {
+		h := &ClockHealth{Source: "chrony"}
+		out, err := exec.CommandContext(ctx, "chronyc", "-c", "tracking").Output()
+		if err != nil {
+			err = fmt.Errorf("chronyc tracking: %w", err)
+			h.Error = err.Error()
+			return h, err
+		}
+		// Ref ID, name, stratum, ref time, system time offset (s), ..., leap status
+		f := strings.Split(strings.TrimSpace(string(out)), ",")
+		if len(f) < 14 {
+			h.Error = "unexpected chronyc output"
+			return h, errors.New(h.Error)
+		}
+		h.Server = f[1]
+		h.Stratum, _ = strconv.Atoi(f[2])
+		offset, _ := strconv.ParseFloat(f[4], 64)
+		h.OffsetMs = offset * 1000
+		h.Synced = f[13] != "Not synchronised" && h.Stratum > 0 && time.Duration(offset*float64(time.Second)).Abs() < maxClockOffset
+		return h, nil
+	}
+	if !available("ntpd") {
+		return nil, nil
+	}
+
+	h := &ClockHealth{Source: "ntpd"}
+	servers, _ := uci.Get("system.ntp.server")
+	fields := strings.Fields(strings.ReplaceAll(servers, "'", ""))
+	if len(fields) == 0 {
+		h.Error = "no NTP server configured"
+		return h, nil
+	}
+	h.Server = fields[0]
+	// -w only queries; with -q busybox would otherwise step the clock
+	out, _ := exec.CommandContext(ctx, "ntpd", "-n", "-w", "-q", "-p", h.Server).CombinedOutput()
+	m := ntpdOffsetRe.FindStringSubmatch(string(out))
+	if m == nil {
+		h.Error = "no reply from " + h.Server
+		return h, nil
+	}
+	offset, _ := strconv.ParseFloat(m[2], 64)
+	h.Stratum, _ = strconv.Atoi(m[3])
+	h.OffsetMs = offset * 1000
+	h.Synced = time.Duration(offset*float64(time.Second)).Abs() < maxClockOffset
+	return h, nil
+}
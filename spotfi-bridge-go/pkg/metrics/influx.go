@@ -0,0 +1,257 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// influxDatagram keeps UDP and unixgram writes below common MTUs; Telegraf's
+// socket_listener parses every datagram on its own
+const influxDatagram = 1400
+
+// InfluxOutput writes samples in InfluxDB line protocol to a local Telegraf
+// socket_listener or InfluxDB UDP listener, besides the MQTT publish
+type InfluxOutput struct {
+	network, addr string
+	tags          map[string]string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewInfluxOutput parses a target such as udp://127.0.0.1:8094,
+// tcp://10.0.0.5:8094, unix:///var/run/telegraf.sock or unixgram:///var/run/telegraf.sock;
+// tags are added to every line
+func NewInfluxOutput(target string, tags map[string]string) (*InfluxOutput, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	o := &InfluxOutput{network: u.Scheme, tags: tags}
+	switch u.Scheme {
+	case "udp", "tcp":
+		o.addr = u.Host
+	case "unix", "unixgram":
+		o.addr = u.Path
+	default:
+		return nil, fmt.Errorf("unsupported influx target %q: use udp, tcp, unix or unixgram", target)
+	}
+	if o.addr == "" {
+		return nil, fmt.Errorf("influx target %q has no address", target)
+	}
+	return o, nil
+}
+
+// Write sends the sample; a failed connection is redialed on the next sample
+func (o *InfluxOutput) Write(m *Metrics) error {
+	lines := renderInflux(m, o.tags, time.Now())
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.conn == nil {
+		conn, err := net.DialTimeout(o.network, o.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		o.conn = conn
+	}
+	o.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	var err error
+	if o.network == "udp" || o.network == "unixgram" {
+		var batch []byte
+		for _, line := range lines {
+			if len(batch) > 0 && len(batch)+len(line) > influxDatagram {
+				if _, err = o.conn.Write(batch); err != nil {
+					break
+				}
+				batch = batch[:0]
+			}
+			batch = append(batch, line...)
+		}
+		if err == nil && len(batch) > 0 {
+			_, err = o.conn.Write(batch)
+		}
+	} else {
+		_, err = o.conn.Write([]byte(strings.Join(lines, "")))
+	}
+	if err != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+	return err
+}
+
+// influxLine builds one line; fields are name, value pairs where value is an
+// int64, float64, bool or string
+type influxLine struct {
+	b      strings.Builder
+	fields int
+}
+
+var (
+	influxKeyEscaper    = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+func newInfluxLine(measurement string, tags map[string]string, extra ...string) *influxLine {
+	l := &influxLine{}
+	l.b.WriteString(measurement)
+	all := map[string]string{}
+	for k, v := range tags {
+		all[k] = v
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		all[extra[i]] = extra[i+1]
+	}
+	keys := make([]string, 0, len(all))
+	for k, v := range all {
+		if v != "" { // Empty tag values are invalid
+			keys = append(keys, k)
+		}
+	}
+	// Sorted tags are what InfluxDB stores anyway and parse faster
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&l.b, ",%s=%s", influxKeyEscaper.Replace(k), influxKeyEscaper.Replace(all[k]))
+	}
+	return l
+}
+
+func (l *influxLine) field(name string, value interface{}) *influxLine {
+	if l.fields == 0 {
+		l.b.WriteByte(' ')
+	} else {
+		l.b.WriteByte(',')
+	}
+	l.fields++
+	l.b.WriteString(influxKeyEscaper.Replace(name))
+	l.b.WriteByte('=')
+	switch v := value.(type) {
+	case int64:
+		l.b.WriteString(strconv.FormatInt(v, 10) + "i")
+	case int:
+		l.b.WriteString(strconv.Itoa(v) + "i")
+	case float64:
+		l.b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		l.b.WriteString(strconv.FormatBool(v))
+	default:
+		l.b.WriteString(`"` + influxStringEscaper.Replace(fmt.Sprint(v)) + `"`)
+	}
+	return l
+}
+
+func (l *influxLine) end(ts int64) string {
+	if l.fields == 0 {
+		return ""
+	}
+	return l.b.String() + " " + strconv.FormatInt(ts, 10) + "\n"
+}
+
+func renderInflux(m *Metrics, tags map[string]string, now time.Time) []string {
+	ts := now.UnixNano()
+	var lines []string
+	add := func(l *influxLine) {
+		if s := l.end(ts); s != "" {
+			lines = append(lines, s)
+		}
+	}
+
+	add(newInfluxLine("spotfi_system", tags).
+		field("uptime", m.Uptime).
+		field("cpu_load", m.CPULoad).
+		field("memory_total", m.TotalMemory).
+		field("memory_free", m.FreeMemory).
+		field("active_users", m.ActiveUsers).
+		field("status", m.Status))
+
+	for _, c := range m.Clients {
+		add(newInfluxLine("spotfi_client", tags, "mac", c.Mac, "interface", c.Interface).
+			field("ip", c.IP).
+			field("bytes_up", c.BytesUp).
+			field("bytes_down", c.BytesDown).
+			field("rate_up", c.RateUp).
+			field("rate_down", c.RateDown).
+			field("session_seconds", c.SessionSeconds).
+			field("authorized", c.Authorized))
+	}
+
+	for _, r := range m.Wireless {
+		l := newInfluxLine("spotfi_wireless", tags, "device", r.Device, "ssid", r.SSID).
+			field("channel", r.Channel).
+			field("stations", r.Stations).
+			field("noise", r.Noise).
+			field("txpower", r.TxPower)
+		if r.BusyPercent != nil {
+			l.field("busy_percent", *r.BusyPercent)
+		}
+		add(l)
+	}
+
+	for _, fs := range m.Storage.Filesystems {
+		add(newInfluxLine("spotfi_filesystem", tags, "mount", fs.Mount).
+			field("total", fs.TotalBytes).
+			field("free", fs.FreeBytes).
+			field("used_percent", fs.UsedPercent))
+	}
+	for _, t := range m.Storage.Temperatures {
+		add(newInfluxLine("spotfi_temperature", tags, "sensor", t.Name).field("celsius", t.Celsius))
+	}
+
+	if m.WAN != nil {
+		l := newInfluxLine("spotfi_wan", tags, "interface", m.WAN.Interface).
+			field("up", m.WAN.Up).
+			field("uptime", m.WAN.Uptime)
+		if p := m.WAN.Gateway; p != nil {
+			l.field("gateway_loss_percent", p.LossPercent).field("gateway_avg_ms", p.AvgMs).field("gateway_jitter_ms", p.JitterMs)
+		}
+		if p := m.WAN.Target; p != nil {
+			l.field("target_loss_percent", p.LossPercent).field("target_avg_ms", p.AvgMs).field("target_jitter_ms", p.JitterMs)
+		}
+		add(l)
+	}
+
+	if c := m.Conntrack; c != nil {
+		add(newInfluxLine("spotfi_conntrack", tags).
+			field("count", c.Count).
+			field("max", c.Max).
+			field("used_percent", c.UsedPercent).
+			field("drop", c.Drop))
+	}
+
+	if s := m.Sessions; s != nil {
+		add(newInfluxLine("spotfi_sessions", tags).
+			field("started", s.Started).
+			field("ended", s.Ended).
+			field("auth_failures", s.AuthFailures).
+			field("sum_seconds", s.SumSeconds))
+	}
+
+	for _, svc := range m.Services {
+		add(newInfluxLine("spotfi_service", tags, "service", svc.Name).
+			field("up", svc.Up).
+			field("restarts", svc.Restarts))
+	}
+
+	if md := m.Modem; md != nil {
+		l := newInfluxLine("spotfi_modem", tags, "operator", md.Operator, "technology", md.Technology).
+			field("data_connected", md.DataConnected)
+		for _, v := range []struct {
+			name  string
+			value *float64
+		}{{"rsrp", md.RSRP}, {"rsrq", md.RSRQ}, {"sinr", md.SINR}, {"rssi", md.RSSI}} {
+			if v.value != nil {
+				l.field(v.name, *v.value)
+			}
+		}
+		add(l)
+	}
+	return lines
+}
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Bounds for the collection interval
+const (
+	DefaultInterval = 30 * time.Second
+	MinInterval     = 5 * time.Second
+	MaxInterval     = 1 * time.Hour
+)
+
+var interval = struct {
+	mu      sync.Mutex
+	base    time.Duration // Configured interval
+	current time.Duration
+	until   time.Time // When a temporary override reverts to base
+	revert  *time.Timer
+	changed chan struct{}
+	phase   uint64        // Per-router offset into the interval, 0 when disabled
+	splay   time.Duration // Maximum random delay added to every collection
+}{base: DefaultInterval, current: DefaultInterval, changed: make(chan struct{}, 1)}
+
+func clampInterval(d time.Duration) time.Duration {
+	if d < MinInterval {
+		return MinInterval
+	}
+	if d > MaxInterval {
+		return MaxInterval
+	}
+	return d
+}
+
+// notifyLocked wakes the publish loop without blocking if it is already pending
+func notifyLocked() {
+	select {
+	case interval.changed <- struct{}{}:
+	default:
+	}
+}
+
+// SetBaseInterval sets the configured interval (0 keeps the default); it is
+// applied when the publish loop starts and does not signal IntervalChanged
+func SetBaseInterval(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	interval.mu.Lock()
+	defer interval.mu.Unlock()
+	interval.base = clampInterval(d)
+	if interval.revert == nil {
+		interval.current = interval.base
+	}
+}
+
+// SetInterval changes the interval at runtime. With revertAfter > 0 the
+// configured interval is restored afterwards, e.g. when a live dashboard closes
+func SetInterval(d, revertAfter time.Duration) time.Duration {
+	interval.mu.Lock()
+	defer interval.mu.Unlock()
+
+	if interval.revert != nil {
+		interval.revert.Stop()
+		interval.revert = nil
+		interval.until = time.Time{}
+	}
+	if d <= 0 {
+		d = interval.base
+	}
+	interval.current = clampInterval(d)
+	if revertAfter > 0 {
+		interval.until = time.Now().Add(revertAfter)
+		interval.revert = time.AfterFunc(revertAfter, func() {
+			interval.mu.Lock()
+			defer interval.mu.Unlock()
+			interval.current = interval.base
+			interval.revert = nil
+			interval.until = time.Time{}
+			notifyLocked()
+		})
+	}
+	notifyLocked()
+	return interval.current
+}
+
+// Interval returns the current collection interval
+func Interval() time.Duration {
+	interval.mu.Lock()
+	defer interval.mu.Unlock()
+	return interval.current
+}
+
+// IntervalState reports the current and configured interval and when an override ends
+func IntervalState() map[string]interface{} {
+	interval.mu.Lock()
+	defer interval.mu.Unlock()
+	state := map[string]interface{}{
+		"interval":     int(interval.current.Seconds()),
+		"baseInterval": int(interval.base.Seconds()),
+	}
+	if !interval.until.IsZero() {
+		state["revertAt"] = interval.until.Unix()
+	}
+	return state
+}
+
+// IntervalChanged signals when the publish loop must pick up a new interval
+func IntervalChanged() <-chan struct{} {
+	return interval.changed
+}
+
+// SetSchedule spreads collections of a fleet over the interval: with phase set,
+// each router collects at its own fixed offset into the interval (derived from
+// its ID, so routers provisioned or powered up together stay apart), and every
+// collection is delayed by up to splay at random
+func SetSchedule(routerID string, phase bool, splay time.Duration) {
+	interval.mu.Lock()
+	defer interval.mu.Unlock()
+	interval.phase = 0
+	if phase {
+		h := fnv.New64a()
+		h.Write([]byte(routerID))
+		interval.phase = h.Sum64() | 1
+	}
+	interval.splay = max(splay, 0)
+}
+
+// NextTick returns the delay until the next collection: a full interval, or
+// with a phase the time until the router's next slot on the wall-clock grid,
+// plus the random splay (at most half the interval)
+func NextTick() time.Duration {
+	interval.mu.Lock()
+	defer interval.mu.Unlock()
+	d := interval.current
+	if interval.phase != 0 {
+		offset := time.Duration(interval.phase % uint64(d))
+		now := time.Duration(time.Now().UnixNano() % int64(d))
+		d = offset - now
+		// A slot that is due right away was just served (or a refresh was)
+		if d <= interval.current/10 {
+			d += interval.current
+		}
+	}
+	if splay := min(interval.splay, interval.current/2); splay > 0 {
+		d += rand.N(splay)
+	}
+	return d
+}
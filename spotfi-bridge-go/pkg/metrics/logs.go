@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+)
+
+// LogCounts are error events found in the system log since the previous sample
+type LogCounts struct {
+	KernelOops    int64 `json:"kernelOops"`    // Oops, BUG and WARNING splats
+	OOMKills      int64 `json:"oomKills"`      // Processes killed by the OOM killer
+	Deauths       int64 `json:"deauths"`       // Stations deauthenticated by hostapd; storms show up as spikes
+	DnsmasqErrors int64 `json:"dnsmasqErrors"` // Failed queries, exhausted DHCP pools, query limits
+	AuthFailures  int64 `json:"authFailures"`  // Captive portal logins rejected by uspot or RADIUS
+	Lines         int64 `json:"lines"`         // Log lines read, to tell a quiet log from a broken reader
+}
+
+// logPatterns classifies log lines; each line counts at most once
+var logPatterns = []struct {
+	process string // Syslog tag, e.g. "kernel"; empty matches any
+	match   []string
+	count   func(c *LogCounts)
+}{
+	{"kernel", []string{"Out of memory: Kill", "oom-kill:"}, func(c *LogCounts) { c.OOMKills++ }},
+	{"kernel", []string{"Oops:", "BUG:", "WARNING: CPU:", "Kernel panic"}, func(c *LogCounts) { c.KernelOops++ }},
+	{"hostapd", []string{"deauthenticated"}, func(c *LogCounts) { c.Deauths++ }},
+	{"uspot", []string{"Access-Reject", "auth failed", "authentication failed", "login failed"}, func(c *LogCounts) { c.AuthFailures++ }},
+	{"dnsmasq", []string{"failed to", "no address range available", "Maximum number of concurrent DNS queries reached"}, func(c *LogCounts) { c.DnsmasqErrors++ }},
+}
+
+var logWatch = struct {
+	mu      sync.Mutex
+	running bool
+	counts  LogCounts
+}{}
+
+// StartLogWatch follows logread until ctx is cancelled, counting error events
+// between samples
+func StartLogWatch(ctx context.Context) {
+	logWatch.mu.Lock()
+	logWatch.running = true
+	logWatch.mu.Unlock()
+
+	go func() {
+		defer crash.Recover("log watch")
+		backoff := time.Second
+		for ctx.Err() == nil {
+			started := time.Now()
+			err := followLog(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if time.Since(started) > time.Minute {
+				backoff = time.Second
+			}
+			logger.Warn("logread failed", "error", err, "retry", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, time.Minute)
+		}
+	}()
+}
+
+// followLog streams new log lines. "logread -f" replays the whole buffer
+// first, so only the last line is requested and then skipped
+func followLog(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "logread", "-f", "-l", "1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 4096), 64*1024)
+	first := true
+	for scanner.Scan() {
+		if first {
+			first = false
+			continue
+		}
+		countLogLine(scanner.Text())
+	}
+	return cmd.Wait()
+}
+
+// countLogLine classifies one line such as
+// "Tue Oct 14 10:00:00 2026 kern.err kernel: [  12.3] Out of memory: Killed process 123 (uhttpd)"
+func countLogLine(line string) {
+	logWatch.mu.Lock()
+	defer logWatch.mu.Unlock()
+	logWatch.counts.Lines++
+	for _, p := range logPatterns {
+		if p.process != "" && !hasTag(line, p.process) {
+			continue
+		}
+		for _, m := range p.match {
+			if strings.Contains(line, m) {
+				p.count(&logWatch.counts)
+				return
+			}
+		}
+	}
+}
+
+// hasTag matches "kernel:", "hostapd:" or "dnsmasq[123]:" and "dnsmasq-dhcp[123]:"
+func hasTag(line, process string) bool {
+	for _, sep := range []string{":", "[", "-"} {
+		if strings.Contains(line, " "+process+sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectLogs returns and resets the counts, or nil when the watcher is not running
+func collectLogs() *LogCounts {
+	logWatch.mu.Lock()
+	defer logWatch.mu.Unlock()
+	if !logWatch.running {
+		return nil
+	}
+	c := logWatch.counts
+	logWatch.counts = LogCounts{}
+	return &c
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// MeshPeer is a directly linked mesh or WDS neighbour
+type MeshPeer struct {
+	Mac                string  `json:"mac"`
+	Signal             int     `json:"signal"`                       // dBm
+	TxBitrate          float64 `json:"txBitrate"`                    // Mbit/s
+	RxBitrate          float64 `json:"rxBitrate"`                    // Mbit/s
+	ExpectedThroughput float64 `json:"expectedThroughput,omitempty"` // Mbit/s, from the rate control
+	LinkState          string  `json:"linkState,omitempty"`          // Mesh peer link state, e.g. ESTAB
+	InactiveMs         int64   `json:"inactiveMs"`
+}
+
+// MeshPath is an 802.11s forwarding path to a mesh node
+type MeshPath struct {
+	Dest     string `json:"dest"`
+	NextHop  string `json:"nextHop"`
+	Metric   int64  `json:"metric"` // Airtime metric, lower is better
+	HopCount int    `json:"hopCount,omitempty"`
+	Flags    string `json:"flags,omitempty"`
+}
+
+// MeshProxy maps a non-mesh station to the mesh node proxying for it
+type MeshProxy struct {
+	Dest  string `json:"dest"`
+	Proxy string `json:"proxy"`
+}
+
+// MeshMetrics describes the wireless backhaul of one mesh or WDS interface
+type MeshMetrics struct {
+	Device  string      `json:"device"`
+	Mode    string      `json:"mode"` // mesh or wds
+	MeshID  string      `json:"meshId,omitempty"`
+	Peers   []MeshPeer  `json:"peers"`
+	Paths   []MeshPath  `json:"paths,omitempty"`
+	Proxies []MeshProxy `json:"proxies,omitempty"`
+}
+
+func iw(args ...string) ([]byte, error) {
+	return exec.Command("iw", args...).Output()
+}
+
+// collectMesh reports the backhaul of 802.11s mesh points and WDS links
+// (4-address stations, named like wlan0.sta1)
+func collectMesh(radios []RadioMetrics) []MeshMetrics {
+	var mesh []MeshMetrics
+	for _, r := range radios {
+		var mm MeshMetrics
+		switch {
+		case strings.Contains(strings.ToLower(r.Mode), "mesh"):
+			mm = MeshMetrics{Device: r.Device, Mode: "mesh", MeshID: r.SSID}
+		case strings.Contains(r.Device, ".sta"):
+			mm = MeshMetrics{Device: r.Device, Mode: "wds"}
+		default:
+			continue
+		}
+		out, err := iw("dev", r.Device, "station", "dump")
+		if err != nil {
+			continue
+		}
+		mm.Peers = parseStationDump(out)
+		if mm.Mode == "mesh" {
+			if out, err := iw("dev", r.Device, "mpath", "dump"); err == nil {
+				mm.Paths = parseMeshPaths(out)
+			}
+			if out, err := iw("dev", r.Device, "mpp", "dump"); err == nil {
+				mm.Proxies = parseMeshProxies(out)
+			}
+		}
+		mesh = append(mesh, mm)
+	}
+	return mesh
+}
+
+// leadingFloat parses the number at the start of values like "144.4 MBit/s" or "58.43Mbps"
+func leadingFloat(s string) float64 {
+	end := 0
+	for end < len(s) && (s[end] == '-' || s[end] == '.' || (s[end] >= '0' && s[end] <= '9')) {
+		end++
+	}
+	v, _ := strconv.ParseFloat(s[:end], 64)
+	return v
+}
+
+func parseStationDump(out []byte) []MeshPeer {
+	peers := []MeshPeer{}
+	var cur *MeshPeer
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if rest, ok := strings.CutPrefix(line, "Station "); ok {
+			peers = append(peers, MeshPeer{Mac: strings.ToLower(strings.Fields(rest)[0])})
+			cur = &peers[len(peers)-1]
+			continue
+		}
+		key, val, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if cur == nil || !ok {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		switch key {
+		case "signal":
+			cur.Signal = int(leadingFloat(val))
+		case "tx bitrate":
+			cur.TxBitrate = leadingFloat(val)
+		case "rx bitrate":
+			cur.RxBitrate = leadingFloat(val)
+		case "expected throughput":
+			cur.ExpectedThroughput = leadingFloat(val)
+		case "mesh plink":
+			cur.LinkState = val
+		case "inactive time":
+			cur.InactiveMs = int64(leadingFloat(val))
+		}
+	}
+	return peers
+}
+
+// parseMeshPaths reads "iw mpath dump": DEST ADDR, NEXT HOP, IFACE, SN, METRIC,
+// QLEN, EXPTIME, DTIM, DRET, FLAGS and, on newer iw, HOP_COUNT and PATH_CHANGE
+func parseMeshPaths(out []byte) []MeshPath {
+	var paths []MeshPath
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 10 || f[0] == "DEST" {
+			continue
+		}
+		p := MeshPath{Dest: strings.ToLower(f[0]), NextHop: strings.ToLower(f[1]), Flags: f[9]}
+		p.Metric, _ = strconv.ParseInt(f[4], 10, 64)
+		if len(f) > 10 {
+			p.HopCount, _ = strconv.Atoi(f[10])
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// parseMeshProxies reads "iw mpp dump": DEST ADDR, PROXY NODE, IFACE
+func parseMeshProxies(out []byte) []MeshProxy {
+	var proxies []MeshProxy
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || f[0] == "DEST" {
+			continue
+		}
+		proxies = append(proxies, MeshProxy{Dest: strings.ToLower(f[0]), Proxy: strings.ToLower(f[1])})
+	}
+	return proxies
+}
@@ -2,53 +2,148 @@ package metrics
 
 import (
 	"encoding/json"
-	"fmt"
-	"os/exec"
+	"time"
+
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/ubus"
+)
+
+var logger = logging.For("metrics")
+
+// SchemaVersion is bumped whenever a field of Metrics changes meaning or type
+const SchemaVersion = 2
+
+// Collection status values
+const (
+	StatusOK      = "ok"      // Every collector succeeded
+	StatusPartial = "partial" // Some collectors failed, see Errors
+	StatusFailed  = "failed"  // System info could not be read; the numbers are meaningless
 )
 
+// Metrics is the payload published on the metrics topic
+type Metrics struct {
+	SchemaVersion int `json:"schemaVersion"`
+
+	// Status summarizes the collection; Errors maps failed collectors to their error
+	Status string            `json:"status"`
+	Errors map[string]string `json:"errors,omitempty"`
+
+	// System info from "ubus call system info"
+	Uptime      int64   `json:"uptime"`      // Seconds since boot
+	BootTime    int64   `json:"bootTime"`    // Unix time of the last boot
+	BootID      string  `json:"bootId"`      // Changes on every boot, unlike a restarted counter
+	CPULoad     float64 `json:"cpuLoad"`     // 1 minute load average in percent
+	TotalMemory int64   `json:"totalMemory"` // Bytes
+	FreeMemory  int64   `json:"freeMemory"`  // Bytes
+
+	ActiveUsers int               `json:"activeUsers"`
+	Clients     []ClientTraffic   `json:"clients"`
+	Wireless    []RadioMetrics    `json:"wireless"`
+	Breakdown   ClientBreakdown   `json:"breakdown"`          // Clients per SSID, radio and network
+	Sessions    *SessionStats     `json:"sessions,omitempty"` // Portal logins and logouts since the previous sample
+	Mesh        []MeshMetrics     `json:"mesh,omitempty"`     // Mesh and WDS backhaul links
+	Storage     StorageMetrics    `json:"storage"`
+	WAN         *WANMetrics       `json:"wan,omitempty"`   // Latest background probe
+	MWAN        *MWANMetrics      `json:"mwan,omitempty"`  // Multi-WAN state, when mwan3 is installed
+	Modem       *ModemMetrics     `json:"modem,omitempty"` // Cellular uplink, when present
+	DNS         *DNSHealth        `json:"dns,omitempty"`   // Local resolver check
+	Clock       *ClockHealth      `json:"clock,omitempty"` // NTP synchronization
+	Conntrack   *ConntrackMetrics `json:"conntrack,omitempty"`
+	Log         *LogCounts        `json:"log,omitempty"`      // System log errors since the previous sample
+	Services    []ServiceHealth   `json:"services,omitempty"` // Critical daemons
+	SQM         []QueueStats      `json:"sqm,omitempty"`      // Shaping queues set up by SQM
+	Ports       []PortMetrics     `json:"ports,omitempty"`    // Ethernet switch ports
+	PoE         *PoEBudget        `json:"poe,omitempty"`
+
+	// Plugins holds the output of the metrics.d collectors, by plugin name
+	Plugins map[string]json.RawMessage `json:"plugins,omitempty"`
+
+	// RPC holds bridge-internal RPC counters, filled in by the caller
+	RPC map[string]interface{} `json:"rpc,omitempty"`
+
+	// Bridge holds the bridge's own runtime and queue statistics, filled in by the caller
+	Bridge map[string]interface{} `json:"bridge,omitempty"`
+}
+
 // GetMetrics collects system info and client list
-func GetMetrics() map[string]interface{} {
+func GetMetrics() *Metrics {
+	m := &Metrics{SchemaVersion: SchemaVersion, Status: StatusOK, Errors: map[string]string{}}
+
 	// 1. System Info
-	cmdSys := exec.Command("ubus", "call", "system", "info")
-	outSys, _ := cmdSys.Output()
-	var sysInfo map[string]interface{}
-	json.Unmarshal(outSys, &sysInfo)
+	sysInfo, err := ubus.Call("system", "info", nil)
+	m.fail("system", err)
+	m.Uptime = number(sysInfo, "uptime")
+	m.BootTime, m.BootID = BootInfo()
+	if m.BootTime == 0 && m.Uptime > 0 {
+		m.BootTime = time.Now().Unix() - m.Uptime
+	}
+	if mem, ok := sysInfo["memory"].(map[string]interface{}); ok {
+		m.TotalMemory = number(mem, "total")
+		m.FreeMemory = number(mem, "free")
+	}
+	if load, ok := sysInfo["load"].([]interface{}); ok && len(load) > 0 {
+		// OpenWrt load is usually integer scaled by 65535
+		if l, ok := load[0].(float64); ok {
+			m.CPULoad = (l / 65535.0) * 100.0
+		}
+	}
 
 	// 2. Client List
-	cmdClients := exec.Command("ubus", "call", "uspot", "client_list")
-	outClients, _ := cmdClients.Output()
-	var clientList map[string]interface{}
-	json.Unmarshal(outClients, &clientList)
-
-	// Calculate active users
-	activeUsers := 0
+	clientList, err := ubus.Call("uspot", "client_list", nil)
+	m.fail("clients", err)
 	for _, iface := range clientList {
 		if clients, ok := iface.(map[string]interface{}); ok {
-			activeUsers += len(clients)
+			m.ActiveUsers += len(clients)
 		}
 	}
+	m.Clients = collectClients(clientList)
+	if m.Errors["clients"] == "" {
+		m.Sessions = trackSessions(m.Clients)
+	}
+	m.Wireless, err = collectWireless()
+	m.fail("wireless", err)
+	m.Breakdown = collectBreakdown(m.Wireless, m.Clients)
+	m.Mesh = collectMesh(m.Wireless)
+	m.Storage, err = collectStorage()
+	m.fail("storage", err)
+	m.WAN = collectWAN()
+	if m.WAN != nil && m.WAN.Error != "" {
+		m.Errors["wan"] = m.WAN.Error
+	}
 
-	// Extract memory
-	var totalMem, freeMem float64
-	if mem, ok := sysInfo["memory"].(map[string]interface{}); ok {
-		totalMem, _ = mem["total"].(float64)
-		freeMem, _ = mem["free"].(float64)
+	m.MWAN, err = collectMWAN()
+	m.fail("mwan", err)
+	m.DNS, m.Clock, err = collectHealth()
+	m.fail("health", err)
+	m.Conntrack, err = collectConntrack()
+	m.fail("conntrack", err)
+	m.Log = collectLogs()
+	if m.Log != nil && m.Sessions != nil {
+		m.Sessions.AuthFailures = m.Log.AuthFailures
 	}
+	m.Services, err = collectServices()
+	m.fail("services", err)
+	m.SQM, err = collectSQM()
+	m.fail("sqm", err)
+	m.Ports, m.PoE, err = collectPorts()
+	m.fail("ports", err)
 
-	// Extract Load
-	var cpuLoad float64
-	if load, ok := sysInfo["load"].([]interface{}); ok && len(load) > 0 {
-		// OpenWrt load is usually integer scaled by 65535
-		if l, ok := load[0].(float64); ok {
-			cpuLoad = (l / 65535.0) * 100.0
-		}
+	m.Modem, err = collectModem()
+	m.fail("modem", err)
+	m.Plugins = collectPlugins(m.Errors)
+
+	switch {
+	case m.Errors["system"] != "":
+		m.Status = StatusFailed
+	case len(m.Errors) > 0:
+		m.Status = StatusPartial
 	}
+	return m
+}
 
-	return map[string]interface{}{
-		"uptime":      fmt.Sprintf("%.0f", sysInfo["uptime"]),
-		"cpuLoad":     cpuLoad,
-		"totalMemory": totalMem,
-		"freeMemory":  freeMem,
-		"activeUsers": activeUsers,
+// fail records a collector error
+func (m *Metrics) fail(collector string, err error) {
+	if err != nil {
+		m.Errors[collector] = err.Error()
 	}
 }
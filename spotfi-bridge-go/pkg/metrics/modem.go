@@ -0,0 +1,387 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Modem collection backends
+const (
+	ModemAuto  = "auto"
+	ModemOff   = "off"
+	ModemMMCLI = "mmcli" // ModemManager
+	ModemUQMI  = "uqmi"  // QMI modems managed by netifd
+	ModemAT    = "at"    // Raw AT commands on a serial port (Quectel style)
+
+	modemTimeout     = 5 * time.Second
+	defaultQMIDevice = "/dev/cdc-wdm0"
+)
+
+// ModemMetrics describes the cellular uplink
+type ModemMetrics struct {
+	Source        string   `json:"source"` // mmcli, uqmi or at
+	Device        string   `json:"device,omitempty"`
+	Operator      string   `json:"operator,omitempty"`
+	Technology    string   `json:"technology,omitempty"` // e.g. lte, nr5g, umts
+	Band          string   `json:"band,omitempty"`
+	Registration  string   `json:"registration,omitempty"`
+	RSRP          *float64 `json:"rsrp,omitempty"` // dBm
+	RSRQ          *float64 `json:"rsrq,omitempty"` // dB
+	SINR          *float64 `json:"sinr,omitempty"` // dB
+	RSSI          *float64 `json:"rssi,omitempty"` // dBm
+	DataConnected bool     `json:"dataConnected"`
+	SIMStatus     string   `json:"simStatus,omitempty"` // ready, locked, absent or the raw state
+}
+
+var modem = struct {
+	mu          sync.Mutex
+	mode        string
+	device      string
+	signalSetup bool // mmcli only reports signal values after --signal-setup
+}{mode: ModemAuto}
+
+// SetModem selects the modem backend (auto, off, mmcli, uqmi, at) and its
+// device: the QMI control device for uqmi, the serial port for at
+func SetModem(mode, device string) {
+	modem.mu.Lock()
+	defer modem.mu.Unlock()
+	if mode != "" {
+		modem.mode = mode
+	}
+	modem.device = device
+}
+
+func modemCommand(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), modemTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return out, fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+func available(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// collectModem returns nil when no modem is configured or detected
+func collectModem() (*ModemMetrics, error) {
+	modem.mu.Lock()
+	mode, device := modem.mode, modem.device
+	modem.mu.Unlock()
+
+	if mode == ModemAuto {
+		if available("mmcli") {
+			out, err := modemCommand("mmcli", "-L", "-J")
+			if err == nil && strings.Contains(string(out), "/Modem/") {
+				mode = ModemMMCLI
+			}
+		}
+		if mode == ModemAuto {
+			qmi := device
+			if qmi == "" {
+				qmi = defaultQMIDevice
+			}
+			switch {
+			case available("uqmi") && strings.Contains(qmi, "cdc-wdm") && fileExists(qmi):
+				mode, device = ModemUQMI, qmi
+			case strings.HasPrefix(device, "/dev/tty") && fileExists(device):
+				mode = ModemAT
+			default:
+				return nil, nil
+			}
+		}
+	}
+
+	switch mode {
+	case ModemMMCLI:
+		return collectMMCLI()
+	case ModemUQMI:
+		if device == "" {
+			device = defaultQMIDevice
+		}
+		return collectUQMI(device)
+	case ModemAT:
+		return collectAT(device)
+	}
+	return nil, nil
+}
+
+// mmcliValue reads a dotted path from mmcli JSON; "--" means unset
+func mmcliValue(doc map[string]interface{}, path string) string {
+	var cur interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		cur = m[key]
+	}
+	switch v := cur.(type) {
+	case string:
+		if v == "--" {
+			return ""
+		}
+		return v
+	case []interface{}:
+		parts := []string{}
+		for _, p := range v {
+			if s, ok := p.(string); ok && s != "--" {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+	return ""
+}
+
+func parseDBm(s string) *float64 {
+	if s == "" {
+		return nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+func collectMMCLI() (*ModemMetrics, error) {
+	out, err := modemCommand("mmcli", "-L", "-J")
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Modems []string `json:"modem-list"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil || len(list.Modems) == 0 {
+		return nil, fmt.Errorf("mmcli: no modem found")
+	}
+	path := list.Modems[0]
+	id := path[strings.LastIndexByte(path, '/')+1:]
+	m := &ModemMetrics{Source: ModemMMCLI, Device: id}
+
+	out, err = modemCommand("mmcli", "-m", id, "-J")
+	if err != nil {
+		return m, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return m, fmt.Errorf("mmcli: %w", err)
+	}
+	m.Operator = mmcliValue(doc, "modem.3gpp.operator-name")
+	m.Registration = mmcliValue(doc, "modem.3gpp.registration-state")
+	m.Technology = mmcliValue(doc, "modem.generic.access-technologies")
+	state := mmcliValue(doc, "modem.generic.state")
+	m.DataConnected = state == "connected"
+	switch {
+	case mmcliValue(doc, "modem.generic.sim") == "":
+		m.SIMStatus = "absent"
+	case state == "locked":
+		m.SIMStatus = "locked"
+	default:
+		m.SIMStatus = "ready"
+	}
+
+	modem.mu.Lock()
+	setup := modem.signalSetup
+	modem.signalSetup = true
+	modem.mu.Unlock()
+	if !setup {
+		modemCommand("mmcli", "-m", id, "--signal-setup=30")
+	}
+	if out, err := modemCommand("mmcli", "-m", id, "--signal-get", "-J"); err == nil {
+		var sig map[string]interface{}
+		if json.Unmarshal(out, &sig) == nil {
+			for _, tech := range []string{"5g", "lte", "umts", "gsm"} {
+				prefix := "modem.signal." + tech + "."
+				if rssi := mmcliValue(sig, prefix+"rssi"); rssi != "" || mmcliValue(sig, prefix+"rsrp") != "" {
+					m.RSRP = parseDBm(mmcliValue(sig, prefix+"rsrp"))
+					m.RSRQ = parseDBm(mmcliValue(sig, prefix+"rsrq"))
+					m.SINR = parseDBm(mmcliValue(sig, prefix+"snr"))
+					m.RSSI = parseDBm(rssi)
+					break
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+func uqmiJSON(device, arg string) (map[string]interface{}, error) {
+	out, err := modemCommand("uqmi", "-s", "-d", device, arg)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return nil, fmt.Errorf("uqmi %s: %w", arg, err)
+	}
+	return doc, nil
+}
+
+func floatField(doc map[string]interface{}, name string) *float64 {
+	if v, ok := doc[name].(float64); ok {
+		return &v
+	}
+	return nil
+}
+
+func collectUQMI(device string) (*ModemMetrics, error) {
+	m := &ModemMetrics{Source: ModemUQMI, Device: device}
+	sig, err := uqmiJSON(device, "--get-signal-info")
+	if err != nil {
+		return m, err
+	}
+	m.Technology = str(sig, "type")
+	m.RSRP = floatField(sig, "rsrp")
+	m.RSRQ = floatField(sig, "rsrq")
+	m.SINR = floatField(sig, "snr")
+	m.RSSI = floatField(sig, "rssi")
+
+	if serving, err := uqmiJSON(device, "--get-serving-system"); err == nil {
+		m.Operator = str(serving, "plmn_description")
+		m.Registration = str(serving, "registration")
+	}
+	if out, err := modemCommand("uqmi", "-s", "-d", device, "--get-data-status"); err == nil {
+		m.DataConnected = strings.Trim(strings.TrimSpace(string(out)), `"`) == "connected"
+	}
+	if sim, err := uqmiJSON(device, "--uim-get-sim-state"); err == nil {
+		m.SIMStatus = str(sim, "card_application_state", "card_state")
+	}
+	// Carrier aggregation info names the primary band; older modems lack it
+	if ca, err := uqmiJSON(device, "--get-lte-cphy-ca-info"); err == nil {
+		if primary, ok := ca["primary"].(map[string]interface{}); ok {
+			m.Band = str(primary, "band")
+		}
+	}
+	return m, nil
+}
+
+var (
+	copsRe = regexp.MustCompile(`\+COPS: \d+,\d+,"([^"]*)",(\d+)`)
+	csqRe  = regexp.MustCompile(`\+CSQ: (\d+),`)
+)
+
+// atCommand sends one command and returns the response lines up to OK
+func atCommand(port, cmd string) ([]string, error) {
+	f, err := os.OpenFile(port, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	f.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := f.WriteString(cmd + "\r"); err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "AT"):
+			continue // Blank lines and the echo
+		case line == "OK":
+			return lines, nil
+		case strings.Contains(line, "ERROR"):
+			return lines, fmt.Errorf("%s: %s", cmd, line)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return lines, fmt.Errorf("%s: %w", cmd, err)
+	}
+	return lines, fmt.Errorf("%s: no response", cmd)
+}
+
+// atTechnology maps the AT+COPS access technology
+func atTechnology(act string) string {
+	switch act {
+	case "0", "1", "3":
+		return "gsm"
+	case "2", "4", "5", "6":
+		return "umts"
+	case "7", "9":
+		return "lte"
+	case "10", "11", "12", "13":
+		return "nr5g"
+	}
+	return ""
+}
+
+func collectAT(port string) (*ModemMetrics, error) {
+	m := &ModemMetrics{Source: ModemAT, Device: port}
+	lines, err := atCommand(port, "AT+CPIN?")
+	switch {
+	case err != nil && strings.Contains(err.Error(), "ERROR"):
+		m.SIMStatus = "absent"
+	case err != nil:
+		return m, err
+	case len(lines) > 0:
+		state := strings.TrimSpace(strings.TrimPrefix(lines[0], "+CPIN:"))
+		switch state {
+		case "READY":
+			m.SIMStatus = "ready"
+		case "SIM PIN", "SIM PUK":
+			m.SIMStatus = "locked"
+		default:
+			m.SIMStatus = strings.ToLower(state)
+		}
+	}
+
+	if lines, err := atCommand(port, "AT+COPS?"); err == nil {
+		for _, l := range lines {
+			if sm := copsRe.FindStringSubmatch(l); sm != nil {
+				m.Operator, m.Technology = sm[1], atTechnology(sm[2])
+			}
+		}
+	}
+	if lines, err := atCommand(port, "AT+CSQ"); err == nil {
+		for _, l := range lines {
+			if sm := csqRe.FindStringSubmatch(l); sm != nil {
+				if n, _ := strconv.Atoi(sm[1]); n != 99 {
+					v := float64(-113 + 2*n)
+					m.RSSI = &v
+				}
+			}
+		}
+	}
+	if lines, err := atCommand(port, "AT+CGACT?"); err == nil {
+		for _, l := range lines {
+			if strings.HasSuffix(strings.ReplaceAll(l, " ", ""), ",1") {
+				m.DataConnected = true
+			}
+		}
+	}
+	// Quectel serving cell report: band and LTE signal quality
+	if lines, err := atCommand(port, `AT+QENG="servingcell"`); err == nil {
+		for _, l := range lines {
+			fields := strings.Split(strings.ReplaceAll(strings.TrimPrefix(l, "+QENG: "), `"`, ""), ",")
+			if len(fields) >= 17 && fields[2] == "LTE" {
+				m.Band = "B" + fields[9]
+				m.RSRP = parseDBm(fields[13])
+				m.RSRQ = parseDBm(fields[14])
+				m.RSSI = parseDBm(fields[15])
+				m.SINR = parseDBm(fields[16])
+			}
+		}
+	}
+	return m, nil
+}
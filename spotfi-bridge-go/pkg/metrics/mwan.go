@@ -0,0 +1,191 @@
+package metrics
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/ubus"
+)
+
+const DefaultMWANInterval = 10 * time.Second
+
+// MWANTrackIP is the state of one mwan3 tracking target
+type MWANTrackIP struct {
+	IP          string  `json:"ip"`
+	Status      string  `json:"status"` // up, down or skipped
+	LatencyMs   float64 `json:"latencyMs"`
+	LossPercent float64 `json:"lossPercent"`
+}
+
+// MWANInterface is one uplink managed by mwan3
+type MWANInterface struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"` // online, offline, connecting, disconnecting, disabled, unknown
+	Enabled  bool          `json:"enabled"`
+	Tracking string        `json:"tracking,omitempty"`
+	Online   int64         `json:"online"`  // Seconds online
+	Offline  int64         `json:"offline"` // Seconds offline
+	Score    int64         `json:"score"`
+	Lost     int64         `json:"lost"`
+	TrackIPs []MWANTrackIP `json:"trackIps,omitempty"`
+}
+
+// MWANMember is an interface a policy currently sends traffic to
+type MWANMember struct {
+	Interface string `json:"interface"`
+	Percent   int    `json:"percent"`
+}
+
+// MWANMetrics is the multi-WAN state from "ubus call mwan3 status"
+type MWANMetrics struct {
+	Interfaces []MWANInterface         `json:"interfaces"`
+	Policies   map[string][]MWANMember `json:"policies"` // Active members per IPv4 policy
+}
+
+// FailoverEvent reports an mwan3 transition as soon as it is seen
+type FailoverEvent struct {
+	Type      string       `json:"type"` // Always "failover"
+	Interface string       `json:"interface,omitempty"`
+	Policy    string       `json:"policy,omitempty"`
+	From      string       `json:"from,omitempty"` // Previous interface status
+	To        string       `json:"to,omitempty"`
+	Members   []MWANMember `json:"members,omitempty"` // New active policy members
+	Previous  []MWANMember `json:"previous,omitempty"`
+	TS        int64        `json:"ts"`
+}
+
+var mwan = struct {
+	mu     sync.Mutex
+	latest *MWANMetrics
+	err    error // Why the last poll failed; nil without mwan3
+}{}
+
+// StartMWANWatch polls mwan3 until ctx is cancelled and publishes interface
+// status and policy membership changes right away, without waiting for the
+// next metrics sample. Routers without mwan3 are polled at a slow pace
+func StartMWANWatch(ctx context.Context, interval time.Duration, publish func(*FailoverEvent) error) {
+	if interval <= 0 {
+		interval = DefaultMWANInterval
+	}
+	go func() {
+		defer crash.Recover("mwan watch")
+		var prev *MWANMetrics
+		for {
+			cur, err := readMWAN()
+			wait := interval
+			if err != nil {
+				wait = max(interval, time.Minute)
+			} else {
+				for _, ev := range mwanChanges(prev, cur) {
+					if ev.Interface != "" {
+						logger.Info("mwan3 interface changed", "interface", ev.Interface, "from", ev.From, "to", ev.To)
+					} else {
+						logger.Info("mwan3 policy changed", "policy", ev.Policy, "members", ev.Members)
+					}
+					if err := publish(ev); err != nil {
+						logger.Error("Failed to publish failover event", "error", err)
+					}
+				}
+				prev = cur
+			}
+			if ubus.IsNotFound(err) {
+				err = nil
+			}
+			mwan.mu.Lock()
+			mwan.latest, mwan.err = cur, err
+			mwan.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+// collectMWAN returns the latest mwan3 state, or nil without mwan3
+func collectMWAN() (*MWANMetrics, error) {
+	mwan.mu.Lock()
+	defer mwan.mu.Unlock()
+	return mwan.latest, mwan.err
+}
+
+func readMWAN() (*MWANMetrics, error) {
+	status, err := ubus.Call("mwan3", "status", nil)
+	if err != nil {
+		return nil, err
+	}
+	m := &MWANMetrics{Interfaces: []MWANInterface{}, Policies: map[string][]MWANMember{}}
+	ifaces, _ := status["interfaces"].(map[string]interface{})
+	for name, v := range ifaces {
+		info, _ := v.(map[string]interface{})
+		iface := MWANInterface{
+			Name:     name,
+			Status:   str(info, "status"),
+			Tracking: str(info, "tracking"),
+			Online:   number(info, "online"),
+			Offline:  number(info, "offline"),
+			Score:    number(info, "score"),
+			Lost:     number(info, "lost"),
+		}
+		iface.Enabled, _ = info["enabled"].(bool)
+		tracks, _ := info["track_ip"].([]interface{})
+		for _, t := range tracks {
+			track, _ := t.(map[string]interface{})
+			ip := MWANTrackIP{IP: str(track, "ip"), Status: str(track, "status")}
+			ip.LatencyMs, _ = track["latency"].(float64)
+			ip.LossPercent, _ = track["packetloss"].(float64)
+			iface.TrackIPs = append(iface.TrackIPs, ip)
+		}
+		m.Interfaces = append(m.Interfaces, iface)
+	}
+	sort.Slice(m.Interfaces, func(i, j int) bool { return m.Interfaces[i].Name < m.Interfaces[j].Name })
+
+	families, _ := status["policies"].(map[string]interface{})
+	policies, _ := families["ipv4"].(map[string]interface{})
+	for name, v := range policies {
+		members := []MWANMember{}
+		list, _ := v.([]interface{})
+		for _, e := range list {
+			member, _ := e.(map[string]interface{})
+			members = append(members, MWANMember{Interface: str(member, "interface"), Percent: int(number(member, "percent"))})
+		}
+		m.Policies[name] = members
+	}
+	return m, nil
+}
+
+// mwanChanges lists interface status and policy membership transitions
+func mwanChanges(prev, cur *MWANMetrics) []*FailoverEvent {
+	if prev == nil || cur == nil {
+		return nil
+	}
+	now := time.Now().Unix()
+	var events []*FailoverEvent
+	before := map[string]string{}
+	for _, iface := range prev.Interfaces {
+		before[iface.Name] = iface.Status
+	}
+	for _, iface := range cur.Interfaces {
+		if old, ok := before[iface.Name]; ok && old != iface.Status {
+			events = append(events, &FailoverEvent{Type: "failover", Interface: iface.Name, From: old, To: iface.Status, TS: now})
+		}
+	}
+	names := make([]string, 0, len(cur.Policies))
+	for name := range cur.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		old, ok := prev.Policies[name]
+		if ok && !slices.Equal(old, cur.Policies[name]) {
+			events = append(events, &FailoverEvent{Type: "failover", Policy: name, Members: cur.Policies[name], Previous: old, TS: now})
+		}
+	}
+	return events
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+)
+
+const (
+	DefaultPluginDir     = "/usr/lib/spotfi/metrics.d"
+	DefaultPluginTimeout = 5 * time.Second
+
+	maxPluginOutput = 64 * 1024
+)
+
+var plugins = struct {
+	mu      sync.Mutex
+	dir     string
+	timeout time.Duration
+	source  func(timeout time.Duration, errs map[string]string) map[string]json.RawMessage
+}{dir: DefaultPluginDir, timeout: DefaultPluginTimeout}
+
+// SetPlugins configures the plugin directory ("off" disables plugins) and the
+// time each plugin may take
+func SetPlugins(dir string, timeout time.Duration) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	if dir != "" {
+		plugins.dir = dir
+	}
+	if timeout > 0 {
+		plugins.timeout = timeout
+	}
+}
+
+// SetPluginSource adds the results of long-running plugins (see pkg/plugins) to
+// those of the plugin directory; a script of the same name takes precedence
+func SetPluginSource(source func(timeout time.Duration, errs map[string]string) map[string]json.RawMessage) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	plugins.source = source
+}
+
+// limitedBuffer keeps the first maxPluginOutput bytes and remembers if there was more
+type limitedBuffer struct {
+	bytes.Buffer
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxPluginOutput - b.Len(); len(p) > room {
+		b.overflow = true
+		p = p[:max(room, 0)]
+	}
+	b.Buffer.Write(p)
+	return len(p), nil
+}
+
+// collectPlugins runs every executable of the plugin directory in parallel.
+// Each must print one JSON value, reported under the file name without
+// extension; failures are recorded as "plugin:<name>" errors
+func collectPlugins(errs map[string]string) map[string]json.RawMessage {
+	plugins.mu.Lock()
+	dir, timeout, source := plugins.dir, plugins.timeout, plugins.source
+	plugins.mu.Unlock()
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = map[string]json.RawMessage{}
+	)
+	if source != nil {
+		for name, out := range source(timeout, errs) {
+			results[name] = out
+		}
+	}
+	var entries []os.DirEntry
+	if dir != "off" {
+		entries, _ = os.ReadDir(dir) // No error: no plugins installed
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || strings.HasPrefix(e.Name(), ".") || info.Mode()&0111 == 0 {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		path := filepath.Join(dir, e.Name())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer crash.Catch("metrics plugin " + name)
+			out, err := runPlugin(path, timeout)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs["plugin:"+name] = err.Error()
+				return
+			}
+			results[name] = out
+		}()
+	}
+	wg.Wait()
+	if len(results) == 0 {
+		return nil
+	}
+	return results
+}
+
+func runPlugin(path string, timeout time.Duration) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var stdout limitedBuffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdout = &stdout
+	// Children of a killed shell script may keep stdout open; don't wait for them
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	switch {
+	case ctx.Err() != nil:
+		return nil, fmt.Errorf("timed out after %v", timeout)
+	case err != nil:
+		return nil, err
+	case stdout.overflow:
+		return nil, fmt.Errorf("output larger than %d bytes", maxPluginOutput)
+	}
+	out := bytes.TrimSpace(stdout.Bytes())
+	if !json.Valid(out) {
+		return nil, fmt.Errorf("output is not valid JSON")
+	}
+	return json.RawMessage(out), nil
+}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"spotfi-bridge/pkg/ubus"
+)
+
+// PoEPort is the power sourcing state of one switch port
+type PoEPort struct {
+	Status string  `json:"status"`         // e.g. "Delivering power", "Searching"
+	Mode   string  `json:"mode,omitempty"` // e.g. 802.3at
+	PowerW float64 `json:"powerW"`
+}
+
+// PortMetrics is the link state of one Ethernet switch port
+type PortMetrics struct {
+	Name   string   `json:"name"` // DSA interface (lan1) or swconfig switch0/port2
+	Up     bool     `json:"up"`
+	Speed  int      `json:"speed,omitempty"`  // Mbit/s
+	Duplex string   `json:"duplex,omitempty"` // full or half
+	PoE    *PoEPort `json:"poe,omitempty"`
+}
+
+// PoEBudget is the power budget of the PoE controller
+type PoEBudget struct {
+	BudgetW      float64 `json:"budgetW"`
+	ConsumptionW float64 `json:"consumptionW"`
+}
+
+// collectPorts reads DSA ports from sysfs or, on older targets, the swconfig
+// switch, and attaches PoE state from "ubus call poe info" where available
+func collectPorts() ([]PortMetrics, *PoEBudget, error) {
+	ports := dsaPorts()
+	var err error
+	if len(ports) == 0 {
+		ports, err = swconfigPorts()
+	}
+
+	info, poeErr := ubus.Call("poe", "info", nil)
+	if ubus.IsNotFound(poeErr) {
+		return ports, nil, err
+	}
+	if poeErr != nil {
+		return ports, nil, errors.Join(err, poeErr)
+	}
+	budget := &PoEBudget{}
+	budget.BudgetW, _ = info["budget"].(float64)
+	budget.ConsumptionW, _ = info["consumption"].(float64)
+	poePorts, _ := info["ports"].(map[string]interface{})
+	names := make([]string, 0, len(poePorts))
+	for name := range poePorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, _ := poePorts[name].(map[string]interface{})
+		poe := &PoEPort{Status: str(p, "status"), Mode: str(p, "mode")}
+		poe.PowerW, _ = p["consumption"].(float64)
+		matched := false
+		for i := range ports {
+			if ports[i].Name == name {
+				ports[i].PoE, matched = poe, true
+				break
+			}
+		}
+		if !matched {
+			ports = append(ports, PortMetrics{Name: name, PoE: poe})
+		}
+	}
+	return ports, budget, err
+}
+
+// dsaPorts lists the user ports of DSA switches, which carry a phys_switch_id
+func dsaPorts() []PortMetrics {
+	dirs, _ := filepath.Glob("/sys/class/net/*")
+	var ports []PortMetrics
+	for _, dir := range dirs {
+		if readTrimmed(filepath.Join(dir, "phys_switch_id")) == "" {
+			continue
+		}
+		// Skip the CPU conduit, in case its driver reports a switch ID too
+		if _, err := os.Stat(filepath.Join(dir, "dsa")); err == nil {
+			continue
+		}
+		p := PortMetrics{Name: filepath.Base(dir), Up: readTrimmed(filepath.Join(dir, "carrier")) == "1"}
+		if p.Up {
+			if speed, ok := readInt(filepath.Join(dir, "speed")); ok && speed > 0 {
+				p.Speed = int(speed)
+			}
+			if duplex := readTrimmed(filepath.Join(dir, "duplex")); duplex != "unknown" {
+				p.Duplex = duplex
+			}
+		}
+		ports = append(ports, p)
+	}
+	return ports
+}
+
+// swconfigPorts parses the "link:" attribute of every port of every swconfig
+// switch, e.g. "link: port:1 link:up speed:1000baseT full-duplex auto"
+func swconfigPorts() ([]PortMetrics, error) {
+	if !available("swconfig") {
+		return nil, nil
+	}
+	out, err := exec.Command("swconfig", "list").Output()
+	if err != nil {
+		return nil, fmt.Errorf("swconfig list: %w", err)
+	}
+	var ports []PortMetrics
+	var errs []error
+	for _, line := range strings.Split(string(out), "\n") {
+		// Found: switch0 - mt7530
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "Found:" {
+			continue
+		}
+		sw := f[1]
+		show, err := exec.Command("swconfig", "dev", sw, "show").Output()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("swconfig dev %s show: %w", sw, err))
+			continue
+		}
+		for _, l := range strings.Split(string(show), "\n") {
+			rest, ok := strings.CutPrefix(strings.TrimSpace(l), "link: ")
+			if !ok {
+				continue
+			}
+			var p PortMetrics
+			for _, tok := range strings.Fields(rest) {
+				key, val, _ := strings.Cut(tok, ":")
+				switch {
+				case key == "port":
+					p.Name = sw + "/port" + val
+				case key == "link":
+					p.Up = val == "up"
+				case key == "speed":
+					p.Speed, _ = strconv.Atoi(strings.TrimSuffix(val, "baseT"))
+				case strings.HasSuffix(tok, "-duplex"):
+					p.Duplex = strings.TrimSuffix(tok, "-duplex")
+				}
+			}
+			if p.Name != "" {
+				ports = append(ports, p)
+			}
+		}
+	}
+	return ports, errors.Join(errs...)
+}
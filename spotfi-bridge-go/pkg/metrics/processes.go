@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Process is one entry of a process snapshot
+type Process struct {
+	PID        int     `json:"pid"`
+	Name       string  `json:"name"`
+	Command    string  `json:"command,omitempty"`
+	State      string  `json:"state"`
+	CPUPercent float64 `json:"cpuPercent"` // Of one CPU over the sample window
+	VSZ        int64   `json:"vsz"`        // Bytes
+	RSS        int64   `json:"rss"`        // Bytes
+}
+
+const maxCommandLength = 256
+
+type procSample struct {
+	Process
+	ticks int64 // utime + stime
+}
+
+// readProcesses parses /proc/<pid>/stat of every process
+func readProcesses() map[int]procSample {
+	procs := map[int]procSample{}
+	dirs, _ := filepath.Glob("/proc/[0-9]*")
+	pageSize := int64(os.Getpagesize())
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue // Exited meanwhile
+		}
+		// The name is in parentheses and may contain spaces
+		stat := string(data)
+		open, end := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+		if open < 0 || end < open {
+			continue
+		}
+		fields := strings.Fields(stat[end+1:])
+		if len(fields) < 22 {
+			continue
+		}
+		// Fields after the name start at 3 (state): utime is 14, stime 15, vsize 23, rss 24
+		utime, _ := strconv.ParseInt(fields[11], 10, 64)
+		stime, _ := strconv.ParseInt(fields[12], 10, 64)
+		vsz, _ := strconv.ParseInt(fields[20], 10, 64)
+		rss, _ := strconv.ParseInt(fields[21], 10, 64)
+		p := procSample{
+			Process: Process{PID: pid, Name: stat[open+1 : end], State: fields[0], VSZ: vsz, RSS: rss * pageSize},
+			ticks:   utime + stime,
+		}
+		if cmd, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+			p.Command = strings.TrimSpace(strings.ReplaceAll(string(cmd), "\x00", " "))
+			if len(p.Command) > maxCommandLength {
+				p.Command = p.Command[:maxCommandLength]
+			}
+		}
+		procs[pid] = p
+	}
+	return procs
+}
+
+// TopProcesses samples CPU time over window and returns the limit processes
+// using the most CPU, or memory (RSS) when by is "memory"
+func TopProcesses(ctx context.Context, limit int, by string, window time.Duration) ([]Process, error) {
+	before := readProcesses()
+	start := time.Now()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(window):
+	}
+	after := readProcesses()
+	elapsed := time.Since(start).Seconds()
+
+	// USER_HZ is 100 on every Linux architecture OpenWrt runs on
+	const clockTicks = 100
+	list := make([]Process, 0, len(after))
+	for pid, p := range after {
+		if prev, ok := before[pid]; ok && elapsed > 0 {
+			p.CPUPercent = float64(p.ticks-prev.ticks) / clockTicks / elapsed * 100
+		}
+		list = append(list, p.Process)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if by == "memory" {
+			return list[i].RSS > list[j].RSS
+		}
+		if list[i].CPUPercent != list[j].CPUPercent {
+			return list[i].CPUPercent > list[j].CPUPercent
+		}
+		return list[i].RSS > list[j].RSS
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
@@ -0,0 +1,357 @@
+package metrics
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PrometheusOptions configures ServePrometheus
+type PrometheusOptions struct {
+	Addr string
+
+	// Token is required from scrapers as "Authorization: Bearer <token>" when set.
+	// Addresses other than loopback ones, which guest clients on the LAN could
+	// reach, are only served with a token
+	Token string
+
+	// ClientLabels exports per-client series labelled with the client's MAC and IP
+	ClientLabels bool
+}
+
+// ServePrometheus exposes the latest sample in the Prometheus text format on
+// addr/metrics. Only loopback and private (LAN) addresses are accepted so the
+// exporter is never reachable from the WAN side. The exporter stops when ctx is cancelled
+func ServePrometheus(ctx context.Context, opts PrometheusOptions, latest func() *Metrics) error {
+	host, _, err := net.SplitHostPort(opts.Addr)
+	if err != nil {
+		return err
+	}
+	if !localAddress(host) {
+		return fmt.Errorf("refusing to listen on %q: use a loopback or LAN address", opts.Addr)
+	}
+	if opts.Token == "" && !loopbackAddress(host) {
+		return fmt.Errorf("refusing to listen on %q without a token: only loopback addresses are served without one", opts.Addr)
+	}
+	ln, err := net.Listen("tcp", opts.Addr)
+	if err != nil {
+		return err
+	}
+
+	want := []byte("Bearer " + opts.Token)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if opts.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		m := latest()
+		if m == nil {
+			http.Error(w, "no sample collected yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(renderPrometheus(m, opts.ClientLabels))
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error("Prometheus exporter stopped", "error", err)
+		}
+	}()
+	logger.Info("Prometheus exporter listening", "addr", ln.Addr().String())
+	return nil
+}
+
+func localAddress(host string) bool {
+	if loopbackAddress(host) {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+func loopbackAddress(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type promFamily struct {
+	name, typ, help string
+	samples         []string
+}
+
+// promWriter groups samples by metric name, as the text format requires
+type promWriter struct {
+	families []*promFamily
+	index    map[string]*promFamily
+}
+
+// add appends a sample; labels are name, value pairs
+func (w *promWriter) add(name, typ, help string, value float64, labels ...string) {
+	f := w.index[name]
+	if f == nil {
+		f = &promFamily{name: name, typ: typ, help: help}
+		w.families = append(w.families, f)
+		w.index[name] = f
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], promEscape(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	f.samples = append(f.samples, b.String())
+}
+
+func (w *promWriter) bytes() []byte {
+	var b strings.Builder
+	for _, f := range w.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range f.samples {
+			b.WriteString(s)
+			b.WriteByte('\n')
+		}
+	}
+	return []byte(b.String())
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promEscape(s string) string {
+	return promEscaper.Replace(s)
+}
+
+// snakeCase turns camelCase counter names into Prometheus style names
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func renderPrometheus(m *Metrics, clientLabels bool) []byte {
+	w := &promWriter{index: map[string]*promFamily{}}
+
+	for _, collector := range []string{"system", "clients", "wireless", "storage", "wan", "mwan", "health", "conntrack", "services", "sqm", "ports", "modem"} {
+		_, failed := m.Errors[collector]
+		w.add("spotfi_collector_up", "gauge", "Whether the collector succeeded in the latest sample", boolValue(!failed), "collector", collector)
+	}
+
+	w.add("spotfi_uptime_seconds", "gauge", "System uptime", float64(m.Uptime))
+	w.add("spotfi_boot_time_seconds", "gauge", "Unix time of the last boot", float64(m.BootTime))
+	w.add("spotfi_cpu_load_percent", "gauge", "1 minute load average in percent", m.CPULoad)
+	w.add("spotfi_memory_total_bytes", "gauge", "Total memory", float64(m.TotalMemory))
+	w.add("spotfi_memory_free_bytes", "gauge", "Free memory", float64(m.FreeMemory))
+	w.add("spotfi_active_users", "gauge", "Number of uspot clients", float64(m.ActiveUsers))
+
+	// Series per client identify who is on the network, so they are opt-in
+	if clientLabels {
+		for _, c := range m.Clients {
+			labels := []string{"mac", c.Mac, "ip", c.IP, "interface", c.Interface}
+			w.add("spotfi_client_upload_bytes_total", "counter", "Bytes sent by the client", float64(c.BytesUp), labels...)
+			w.add("spotfi_client_download_bytes_total", "counter", "Bytes received by the client", float64(c.BytesDown), labels...)
+			w.add("spotfi_client_session_seconds", "gauge", "Client session duration", float64(c.SessionSeconds), labels...)
+		}
+	}
+
+	for _, r := range m.Wireless {
+		labels := []string{"device", r.Device, "ssid", r.SSID, "channel", strconv.Itoa(r.Channel)}
+		w.add("spotfi_wireless_stations", "gauge", "Associated stations", float64(r.Stations), labels...)
+		w.add("spotfi_wireless_noise_dbm", "gauge", "Noise floor", float64(r.Noise), labels...)
+		w.add("spotfi_wireless_txpower_dbm", "gauge", "Transmit power", float64(r.TxPower), labels...)
+		if r.BusyPercent != nil {
+			w.add("spotfi_wireless_channel_busy_percent", "gauge", "Channel busy time from the survey", *r.BusyPercent, labels...)
+		}
+		buckets := make([]string, 0, len(r.RSSI))
+		for b := range r.RSSI {
+			buckets = append(buckets, b)
+		}
+		sort.Strings(buckets)
+		for _, b := range buckets {
+			w.add("spotfi_wireless_rssi_stations", "gauge", "Stations per signal bucket", float64(r.RSSI[b]), append(labels, "bucket", b)...)
+		}
+	}
+
+	for _, group := range []struct {
+		kind     string
+		segments []Segment
+	}{{"ssid", m.Breakdown.SSIDs}, {"radio", m.Breakdown.Radios}, {"network", m.Breakdown.Networks}} {
+		for _, seg := range group.segments {
+			w.add("spotfi_segment_connected_clients", "gauge", "Associated stations per SSID, radio or network", float64(seg.Connected), "kind", group.kind, "name", seg.Name)
+			w.add("spotfi_segment_authorized_clients", "gauge", "Portal-authorized clients per SSID, radio or network", float64(seg.Authorized), "kind", group.kind, "name", seg.Name)
+		}
+	}
+
+	for _, mm := range m.Mesh {
+		for _, p := range mm.Peers {
+			labels := []string{"device", mm.Device, "mode", mm.Mode, "peer", p.Mac}
+			w.add("spotfi_mesh_peer_signal_dbm", "gauge", "Signal of a mesh or WDS peer", float64(p.Signal), labels...)
+			w.add("spotfi_mesh_peer_tx_bitrate_mbps", "gauge", "Transmit bitrate to a mesh or WDS peer", p.TxBitrate, labels...)
+			w.add("spotfi_mesh_peer_rx_bitrate_mbps", "gauge", "Receive bitrate from a mesh or WDS peer", p.RxBitrate, labels...)
+		}
+		for _, p := range mm.Paths {
+			w.add("spotfi_mesh_path_metric", "gauge", "Airtime metric of a mesh path", float64(p.Metric), "device", mm.Device, "dest", p.Dest, "next_hop", p.NextHop)
+		}
+	}
+
+	for _, s := range m.Storage.Temperatures {
+		w.add("spotfi_temperature_celsius", "gauge", "Sensor temperature", s.Celsius, "sensor", s.Name)
+	}
+	for _, fs := range m.Storage.Filesystems {
+		w.add("spotfi_filesystem_size_bytes", "gauge", "Filesystem size", float64(fs.TotalBytes), "mount", fs.Mount)
+		w.add("spotfi_filesystem_free_bytes", "gauge", "Filesystem space available", float64(fs.FreeBytes), "mount", fs.Mount)
+		w.add("spotfi_filesystem_used_percent", "gauge", "Filesystem usage", fs.UsedPercent, "mount", fs.Mount)
+	}
+	for _, f := range m.Storage.Flash {
+		if f.TotalEraseBlocks > 0 {
+			w.add("spotfi_flash_max_erase_count", "gauge", "Highest UBI erase counter", float64(f.MaxEraseCount), "device", f.Device)
+			w.add("spotfi_flash_bad_blocks", "gauge", "UBI bad physical eraseblocks", float64(f.BadBlocks), "device", f.Device)
+		}
+	}
+
+	if m.WAN != nil {
+		w.add("spotfi_wan_up", "gauge", "Whether the WAN interface is up", boolValue(m.WAN.Up), "interface", m.WAN.Interface)
+		w.add("spotfi_wan_uptime_seconds", "gauge", "Time since the WAN interface came up", float64(m.WAN.Uptime), "interface", m.WAN.Interface)
+		for _, p := range []struct {
+			role   string
+			result *PingResult
+		}{{"gateway", m.WAN.Gateway}, {"target", m.WAN.Target}} {
+			if p.result == nil {
+				continue
+			}
+			labels := []string{"role", p.role, "host", p.result.Host}
+			w.add("spotfi_wan_ping_loss_percent", "gauge", "Packet loss of the WAN probe", p.result.LossPercent, labels...)
+			w.add("spotfi_wan_ping_avg_ms", "gauge", "Average round trip time of the WAN probe", p.result.AvgMs, labels...)
+			w.add("spotfi_wan_ping_jitter_ms", "gauge", "Round trip jitter of the WAN probe", p.result.JitterMs, labels...)
+		}
+	}
+
+	if m.MWAN != nil {
+		for _, iface := range m.MWAN.Interfaces {
+			w.add("spotfi_mwan_online", "gauge", "Whether mwan3 considers the uplink online", boolValue(iface.Status == "online"), "interface", iface.Name)
+		}
+	}
+
+	for _, svc := range m.Services {
+		w.add("spotfi_service_up", "gauge", "Whether the service is running", boolValue(svc.Up), "service", svc.Name)
+		w.add("spotfi_service_restarts_total", "counter", "Service restarts seen by the bridge", float64(svc.Restarts), "service", svc.Name)
+	}
+
+	for _, p := range m.Ports {
+		w.add("spotfi_port_up", "gauge", "Whether the switch port has link", boolValue(p.Up), "port", p.Name)
+		if p.Up {
+			w.add("spotfi_port_speed_mbps", "gauge", "Negotiated speed of the switch port", float64(p.Speed), "port", p.Name)
+		}
+		if p.PoE != nil {
+			w.add("spotfi_poe_power_watts", "gauge", "Power delivered on the PoE port", p.PoE.PowerW, "port", p.Name)
+		}
+	}
+	if p := m.PoE; p != nil {
+		w.add("spotfi_poe_budget_watts", "gauge", "Power budget of the PoE controller", p.BudgetW)
+		w.add("spotfi_poe_consumption_watts", "gauge", "Total power drawn from the PoE controller", p.ConsumptionW)
+	}
+
+	for _, q := range m.SQM {
+		labels := []string{"device", q.Device, "kind", q.Kind, "handle", q.Handle}
+		w.add("spotfi_sqm_sent_bytes_total", "counter", "Bytes sent through the SQM queue", float64(q.SentBytes), labels...)
+		w.add("spotfi_sqm_drops_total", "counter", "Packets dropped by the SQM queue", float64(q.Drops), labels...)
+		w.add("spotfi_sqm_marks_total", "counter", "Packets ECN-marked by the SQM queue", float64(q.Marks), labels...)
+		w.add("spotfi_sqm_backlog_bytes", "gauge", "Bytes queued in the SQM queue", float64(q.Backlog), labels...)
+		for _, t := range q.Tins {
+			tl := append(append([]string{}, labels...), "tin", strconv.Itoa(t.Tin))
+			w.add("spotfi_sqm_tin_avg_delay_us", "gauge", "Average queueing delay of a cake tin", float64(t.AvgDelayUs), tl...)
+			w.add("spotfi_sqm_tin_peak_delay_us", "gauge", "Peak queueing delay of a cake tin", float64(t.PeakDelayUs), tl...)
+		}
+	}
+
+	if c := m.Conntrack; c != nil {
+		w.add("spotfi_conntrack_entries", "gauge", "Connection tracking entries", float64(c.Count))
+		w.add("spotfi_conntrack_max", "gauge", "Connection tracking table size", float64(c.Max))
+		protos := make([]string, 0, len(c.Protocols))
+		for p := range c.Protocols {
+			protos = append(protos, p)
+		}
+		sort.Strings(protos)
+		for _, p := range protos {
+			w.add("spotfi_conntrack_protocol_entries", "gauge", "Connection tracking entries per protocol", float64(c.Protocols[p]), "protocol", p)
+		}
+		w.add("spotfi_conntrack_drop_total", "counter", "Packets dropped because the conntrack table was full", float64(c.Drop))
+		w.add("spotfi_conntrack_early_drop_total", "counter", "Conntrack entries evicted to make room", float64(c.EarlyDrop))
+		w.add("spotfi_conntrack_insert_failed_total", "counter", "Conntrack entries that could not be inserted", float64(c.InsertFailed))
+	}
+
+	if m.Modem != nil {
+		labels := []string{"device", m.Modem.Device, "operator", m.Modem.Operator, "technology", m.Modem.Technology}
+		for _, sig := range []struct {
+			name  string
+			value *float64
+		}{{"rsrp_dbm", m.Modem.RSRP}, {"rsrq_db", m.Modem.RSRQ}, {"sinr_db", m.Modem.SINR}, {"rssi_dbm", m.Modem.RSSI}} {
+			if sig.value != nil {
+				w.add("spotfi_modem_"+sig.name, "gauge", "Cellular signal quality", *sig.value, labels...)
+			}
+		}
+		w.add("spotfi_modem_data_connected", "gauge", "Whether the cellular data session is up", boolValue(m.Modem.DataConnected), labels...)
+	}
+
+	addCounters(w, "spotfi_rpc_", "RPC counter ", m.RPC)
+	addCounters(w, "spotfi_bridge_", "Bridge runtime statistic ", m.Bridge)
+	return w.bytes()
+}
+
+// addCounters renders the numeric values of a stats map, nested maps included
+func addCounters(w *promWriter, prefix, help string, stats map[string]interface{}) {
+	keys := make([]string, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if nested, ok := stats[k].(map[string]interface{}); ok {
+			addCounters(w, prefix+snakeCase(k)+"_", help+k+" ", nested)
+			continue
+		}
+		v, err := strconv.ParseFloat(fmt.Sprint(stats[k]), 64)
+		if err != nil {
+			continue
+		}
+		w.add(prefix+snakeCase(k), "gauge", help+k, v)
+	}
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"spotfi-bridge/pkg/ubus"
+)
+
+// DefaultWatchedServices are the daemons a hotspot cannot work without
+var DefaultWatchedServices = []string{"dnsmasq", "hostapd", "uspot", "firewall", "odhcpd"}
+
+// serviceAliases lists procd names a service may be registered under
+var serviceAliases = map[string][]string{
+	"hostapd": {"hostapd", "wpad"},
+}
+
+// ServiceHealth is the state of one watched daemon
+type ServiceHealth struct {
+	Name      string `json:"name"`
+	Up        bool   `json:"up"`
+	Instances int    `json:"instances"` // Running procd instances
+	Restarts  int64  `json:"restarts"`  // PID changes seen since the bridge started
+	ExitCode  *int   `json:"exitCode,omitempty"`
+}
+
+var services = struct {
+	mu       sync.Mutex
+	watched  []string
+	pids     map[string]float64 // Last PID per service/instance
+	restarts map[string]int64
+}{watched: DefaultWatchedServices, pids: map[string]float64{}, restarts: map[string]int64{}}
+
+// SetWatchedServices replaces the list of daemons reported in metrics
+func SetWatchedServices(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	services.mu.Lock()
+	services.watched = names
+	services.mu.Unlock()
+}
+
+// collectServices reads procd's service list; the firewall has no daemon and
+// is up when the fw4 (or iptables) ruleset is loaded
+func collectServices() ([]ServiceHealth, error) {
+	list, err := ubus.Call("service", "list", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	services.mu.Lock()
+	defer services.mu.Unlock()
+	health := []ServiceHealth{}
+	for _, name := range services.watched {
+		h := ServiceHealth{Name: name}
+		if name == "firewall" {
+			h.Up = firewallLoaded()
+			health = append(health, h)
+			continue
+		}
+
+		aliases := serviceAliases[name]
+		if aliases == nil {
+			aliases = []string{name}
+		}
+		for _, alias := range aliases {
+			svc, ok := list[alias].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			instances, _ := svc["instances"].(map[string]interface{})
+			names := make([]string, 0, len(instances))
+			for n := range instances {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			for _, n := range names {
+				inst, _ := instances[n].(map[string]interface{})
+				key := alias + "/" + n
+				if running, _ := inst["running"].(bool); running {
+					h.Instances++
+					pid, _ := inst["pid"].(float64)
+					if prev, seen := services.pids[key]; seen && prev != pid {
+						services.restarts[key]++
+					}
+					services.pids[key] = pid
+				} else if code, ok := inst["exit_code"].(float64); ok {
+					c := int(code)
+					h.ExitCode = &c
+				}
+				h.Restarts += services.restarts[key]
+			}
+		}
+		h.Up = h.Instances > 0
+		health = append(health, h)
+	}
+	return health, nil
+}
+
+func firewallLoaded() bool {
+	if _, err := exec.LookPath("nft"); err == nil {
+		out, err := exec.Command("nft", "list", "tables").Output()
+		return err == nil && strings.Contains(string(out), "inet fw4")
+	}
+	return exec.Command("iptables", "-n", "-L", "zone_wan_input").Run() == nil
+}
+
+// ServicesDown counts watched services that are not running, for alerting
+func ServicesDown(m *Metrics) (float64, bool) {
+	if m.Services == nil {
+		return 0, false
+	}
+	down := 0
+	for _, s := range m.Services {
+		if !s.Up {
+			down++
+		}
+	}
+	return float64(down), true
+}
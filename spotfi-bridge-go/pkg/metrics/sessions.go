@@ -0,0 +1,66 @@
+package metrics
+
+import "sync"
+
+// SessionDurationBounds are the upper bounds (seconds) of the duration
+// histogram buckets; the last bucket counts longer sessions
+var SessionDurationBounds = []int64{300, 900, 1800, 3600, 7200, 14400}
+
+// SessionStats reports captive portal sessions that started and ended since
+// the previous sample, derived from consecutive uspot client lists
+type SessionStats struct {
+	Started      int64   `json:"started"` // Clients that became authorized (successful logins)
+	Ended        int64   `json:"ended"`   // Authorized clients that logged out, expired or left
+	AuthFailures int64   `json:"authFailures"`
+	Bounds       []int64 `json:"bounds"` // Bucket upper bounds in seconds
+	Counts       []int64 `json:"counts"` // Ended sessions per bucket, one more than bounds
+	SumSeconds   int64   `json:"sumSeconds"`
+}
+
+// portalSessions remembers the authorized clients of the previous sample
+var portalSessions = struct {
+	mu     sync.Mutex
+	seeded bool
+	active map[string]int64 // Session seconds per MAC
+}{active: map[string]int64{}}
+
+// trackSessions compares the authorized clients with the previous sample. The
+// first sample only records the baseline, so a bridge restart does not count
+// every connected client as a new login
+func trackSessions(clients []ClientTraffic) *SessionStats {
+	s := &SessionStats{Bounds: SessionDurationBounds, Counts: make([]int64, len(SessionDurationBounds)+1)}
+	current := map[string]int64{}
+	for _, c := range clients {
+		if c.Authorized {
+			current[c.Interface+"/"+c.Mac] = c.SessionSeconds
+		}
+	}
+
+	portalSessions.mu.Lock()
+	defer portalSessions.mu.Unlock()
+	if portalSessions.seeded {
+		for key, seconds := range portalSessions.active {
+			if now, ok := current[key]; ok && now >= seconds {
+				continue
+			}
+			// Gone, or its session counter restarted with a new login
+			s.Ended++
+			s.SumSeconds += seconds
+			bucket := len(SessionDurationBounds)
+			for i, bound := range SessionDurationBounds {
+				if seconds <= bound {
+					bucket = i
+					break
+				}
+			}
+			s.Counts[bucket]++
+		}
+		for key, seconds := range current {
+			if prev, ok := portalSessions.active[key]; !ok || seconds < prev {
+				s.Started++
+			}
+		}
+	}
+	portalSessions.active, portalSessions.seeded = current, true
+	return s
+}
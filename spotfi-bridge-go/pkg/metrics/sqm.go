@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// TinStats are the counters of one cake tin (traffic class)
+type TinStats struct {
+	Tin           int   `json:"tin"`
+	ThresholdRate int64 `json:"thresholdRate"` // Bytes/s
+	SentBytes     int64 `json:"sentBytes"`
+	BacklogBytes  int64 `json:"backlogBytes"`
+	Drops         int64 `json:"drops"`
+	Marks         int64 `json:"marks"` // ECN marks
+	PeakDelayUs   int64 `json:"peakDelayUs"`
+	AvgDelayUs    int64 `json:"avgDelayUs"`
+}
+
+// QueueStats describes one SQM queue discipline (cake, fq_codel or codel)
+type QueueStats struct {
+	Device      string     `json:"device"` // ifb4* devices shape ingress
+	Kind        string     `json:"kind"`
+	Handle      string     `json:"handle"`
+	Parent      string     `json:"parent,omitempty"`
+	SentBytes   int64      `json:"sentBytes"`
+	SentPackets int64      `json:"sentPackets"`
+	Drops       int64      `json:"drops"`
+	Overlimits  int64      `json:"overlimits"`
+	Backlog     int64      `json:"backlog"` // Bytes
+	Qlen        int64      `json:"qlen"`
+	Marks       int64      `json:"marks"`
+	Tins        []TinStats `json:"tins,omitempty"` // cake only
+}
+
+var sqmKinds = map[string]bool{"cake": true, "fq_codel": true, "codel": true}
+
+// collectSQM reads queue statistics with "tc -s -j qdisc". Qdiscs the kernel
+// attaches by default (handle 0:) are skipped, leaving those set up by SQM.
+// Without tc, or with a tc built without JSON support, it returns nil
+func collectSQM() ([]QueueStats, error) {
+	if !available("tc") {
+		return nil, nil
+	}
+	out, err := exec.Command("tc", "-s", "-j", "qdisc", "show").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			stderr := strings.TrimSpace(string(exitErr.Stderr))
+			if strings.Contains(stderr, `"-j" is unknown`) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("tc qdisc show: %w: %s", err, stderr)
+		}
+		return nil, fmt.Errorf("tc qdisc show: %w", err)
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(out), []byte("[")) {
+		return nil, nil // Older tc ignores -j and prints text
+	}
+	var qdiscs []map[string]interface{}
+	if err := json.Unmarshal(out, &qdiscs); err != nil {
+		return nil, fmt.Errorf("tc qdisc show: %w", err)
+	}
+
+	var queues []QueueStats
+	for _, q := range qdiscs {
+		kind, handle := str(q, "kind"), str(q, "handle")
+		if !sqmKinds[kind] || handle == "0:" {
+			continue
+		}
+		qs := QueueStats{
+			Device:      str(q, "dev"),
+			Kind:        kind,
+			Handle:      handle,
+			Parent:      str(q, "parent"),
+			SentBytes:   number(q, "bytes"),
+			SentPackets: number(q, "packets"),
+			Drops:       number(q, "drops"),
+			Overlimits:  number(q, "overlimits"),
+			Backlog:     number(q, "backlog"),
+			Qlen:        number(q, "qlen"),
+		}
+		if opts, ok := q["options"].(map[string]interface{}); ok && qs.Parent == "" {
+			qs.Parent = str(opts, "parent")
+		}
+		// fq_codel counters live in the xstats-like top level, cake's per tin
+		qs.Marks = number(q, "ecn_mark")
+		tins, _ := q["tins"].([]interface{})
+		for i, t := range tins {
+			tin, _ := t.(map[string]interface{})
+			ts := TinStats{
+				Tin:           i,
+				ThresholdRate: number(tin, "threshold_rate"),
+				SentBytes:     number(tin, "sent_bytes"),
+				BacklogBytes:  number(tin, "backlog_bytes"),
+				Drops:         number(tin, "drops"),
+				Marks:         number(tin, "ecn_mark"),
+				PeakDelayUs:   number(tin, "peak_delay_us"),
+				AvgDelayUs:    number(tin, "avg_delay_us"),
+			}
+			qs.Marks += ts.Marks
+			qs.Tins = append(qs.Tins, ts)
+		}
+		queues = append(queues, qs)
+	}
+	return queues, nil
+}
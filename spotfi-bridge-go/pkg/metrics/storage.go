@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Sensor is one temperature reading in degrees Celsius
+type Sensor struct {
+	Name    string  `json:"name"`
+	Celsius float64 `json:"celsius"`
+}
+
+// Filesystem is the usage of a mount point
+type Filesystem struct {
+	Mount       string  `json:"mount"`
+	TotalBytes  int64   `json:"totalBytes"`
+	FreeBytes   int64   `json:"freeBytes"`
+	UsedPercent float64 `json:"usedPercent"`
+}
+
+// FlashWear reports erase counters of UBI devices or the eMMC life time estimate
+type FlashWear struct {
+	Device           string `json:"device"`
+	MaxEraseCount    int64  `json:"maxEraseCount,omitempty"`    // UBI
+	BadBlocks        int64  `json:"badBlocks,omitempty"`        // UBI
+	TotalEraseBlocks int64  `json:"totalEraseBlocks,omitempty"` // UBI
+	LifeTimeUsed     string `json:"lifeTimeUsed,omitempty"`     // eMMC, 0x01 (0-10% used) to 0x0B (exceeded)
+	PreEOL           string `json:"preEol,omitempty"`           // eMMC, 0x01 normal, 0x02 warning, 0x03 urgent
+}
+
+// StorageMetrics groups temperatures, filesystem usage and flash wear
+type StorageMetrics struct {
+	Temperatures []Sensor     `json:"temperatures"`
+	Filesystems  []Filesystem `json:"filesystems"`
+	Flash        []FlashWear  `json:"flash,omitempty"`
+}
+
+var watchedMounts = []string{"/overlay", "/tmp", "/"}
+
+func readTrimmed(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func readInt(path string) (int64, bool) {
+	n, err := strconv.ParseInt(readTrimmed(path), 10, 64)
+	return n, err == nil
+}
+
+// statfs reports the usage of the filesystem mounted at path; pseudo
+// filesystems without blocks report a zero Filesystem and no error
+func statfs(path string) (Filesystem, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return Filesystem{}, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	if st.Blocks == 0 {
+		return Filesystem{}, nil
+	}
+	bsize := int64(st.Bsize)
+	fs := Filesystem{
+		Mount:      path,
+		TotalBytes: int64(st.Blocks) * bsize,
+		FreeBytes:  int64(st.Bavail) * bsize,
+	}
+	fs.UsedPercent = float64(st.Blocks-st.Bfree) / float64(st.Blocks) * 100
+	return fs, nil
+}
+
+// OverlayUsedPercent reports how full the writable overlay is; images without
+// an overlay (read-only squashfs root) report nothing
+func OverlayUsedPercent() (float64, bool) {
+	fs, err := statfs("/overlay")
+	return fs.UsedPercent, err == nil && fs.TotalBytes > 0
+}
+
+// collectStorage reads thermal zones, hwmon sensors, mount usage and flash
+// wear. Sensors that cannot be read are skipped, as disabled thermal zones
+// fail every read; a watched mount that exists but cannot be measured is an error
+func collectStorage() (StorageMetrics, error) {
+	s := StorageMetrics{Temperatures: []Sensor{}, Filesystems: []Filesystem{}}
+
+	zones, _ := filepath.Glob("/sys/class/thermal/thermal_zone*")
+	for _, zone := range zones {
+		if milli, ok := readInt(filepath.Join(zone, "temp")); ok {
+			name := readTrimmed(filepath.Join(zone, "type"))
+			if name == "" {
+				name = filepath.Base(zone)
+			}
+			s.Temperatures = append(s.Temperatures, Sensor{Name: name, Celsius: float64(milli) / 1000})
+		}
+	}
+	inputs, _ := filepath.Glob("/sys/class/hwmon/hwmon*/temp*_input")
+	for _, input := range inputs {
+		if milli, ok := readInt(input); ok {
+			dir := filepath.Dir(input)
+			name := readTrimmed(filepath.Join(dir, "name"))
+			if name == "" {
+				name = filepath.Base(dir)
+			}
+			label := readTrimmed(strings.TrimSuffix(input, "_input") + "_label")
+			if label == "" {
+				label = strings.TrimSuffix(filepath.Base(input), "_input")
+			}
+			s.Temperatures = append(s.Temperatures, Sensor{Name: name + "/" + label, Celsius: float64(milli) / 1000})
+		}
+	}
+	sort.Slice(s.Temperatures, func(i, j int) bool { return s.Temperatures[i].Name < s.Temperatures[j].Name })
+
+	var errs []error
+	for _, mount := range watchedMounts {
+		fs, err := statfs(mount)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// Images without an overlay (read-only squashfs root)
+		case err != nil:
+			errs = append(errs, err)
+		case fs.TotalBytes > 0:
+			s.Filesystems = append(s.Filesystems, fs)
+		}
+	}
+
+	ubis, _ := filepath.Glob("/sys/class/ubi/ubi[0-9]*")
+	for _, dev := range ubis {
+		if strings.Contains(filepath.Base(dev), "_") {
+			continue // Volumes (ubi0_1) share the device counters
+		}
+		w := FlashWear{Device: filepath.Base(dev)}
+		w.MaxEraseCount, _ = readInt(filepath.Join(dev, "max_ec"))
+		w.BadBlocks, _ = readInt(filepath.Join(dev, "bad_peb_count"))
+		w.TotalEraseBlocks, _ = readInt(filepath.Join(dev, "total_eraseblocks"))
+		s.Flash = append(s.Flash, w)
+	}
+	mmcs, _ := filepath.Glob("/sys/block/mmcblk[0-9]")
+	for _, dev := range mmcs {
+		life := readTrimmed(filepath.Join(dev, "device", "life_time"))
+		eol := readTrimmed(filepath.Join(dev, "device", "pre_eol_info"))
+		if life == "" && eol == "" {
+			continue
+		}
+		s.Flash = append(s.Flash, FlashWear{Device: filepath.Base(dev), LifeTimeUsed: life, PreEOL: eol})
+	}
+	return s, errors.Join(errs...)
+}
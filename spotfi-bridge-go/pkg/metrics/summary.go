@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSummaryPeriod = time.Hour
+
+	// Summaries that could not be published are kept for a day at the default period
+	maxPendingSummaries = 24
+)
+
+// Stat is the minimum, maximum and average of a value over a summary period
+type Stat struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+
+	sum float64
+	n   int
+}
+
+func (s *Stat) add(v float64) {
+	if s.n == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.n == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.sum += v
+	s.n++
+	s.Avg = s.sum / float64(s.n)
+}
+
+// Summary aggregates the samples of one period, aligned to the wall clock
+type Summary struct {
+	Type        string `json:"type"` // Always "metrics-summary"
+	Start       int64  `json:"start"`
+	End         int64  `json:"end"`
+	Samples     int    `json:"samples"`
+	CPULoad     Stat   `json:"cpuLoad"`
+	FreeMemory  Stat   `json:"freeMemory"` // Bytes
+	ActiveUsers Stat   `json:"activeUsers"`
+	WANRxBps    *Stat  `json:"wanRxBps,omitempty"` // bit/s between consecutive samples
+	WANTxBps    *Stat  `json:"wanTxBps,omitempty"`
+	WANRxBytes  int64  `json:"wanRxBytes"` // Total over the period
+	WANTxBytes  int64  `json:"wanTxBytes"`
+}
+
+// Summarizer turns samples into per-period summaries
+type Summarizer struct {
+	period time.Duration
+
+	mu      sync.Mutex
+	current *Summary
+	pending []*Summary
+
+	// Previous WAN counters, for throughput
+	wanDevice    string
+	wanRx, wanTx int64
+	wanAt        time.Time
+}
+
+// NewSummarizer creates a summarizer for the given period (default one hour)
+func NewSummarizer(period time.Duration) *Summarizer {
+	if period <= 0 {
+		period = DefaultSummaryPeriod
+	}
+	return &Summarizer{period: period}
+}
+
+// Add folds a sample into the current period; a finished period is queued
+// for Flush
+func (s *Summarizer) Add(m *Metrics) {
+	now := time.Now()
+	start := now.Truncate(s.period)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil && s.current.Start != start.Unix() {
+		s.close()
+	}
+	if s.current == nil {
+		s.current = &Summary{Type: "metrics-summary", Start: start.Unix(), End: start.Add(s.period).Unix()}
+	}
+	c := s.current
+	c.Samples++
+	c.CPULoad.add(m.CPULoad)
+	c.FreeMemory.add(float64(m.FreeMemory))
+	c.ActiveUsers.add(float64(m.ActiveUsers))
+
+	if m.WAN == nil || m.WAN.Device == "" {
+		return
+	}
+	stats := filepath.Join("/sys/class/net", m.WAN.Device, "statistics")
+	rx, okRx := readInt(filepath.Join(stats, "rx_bytes"))
+	tx, okTx := readInt(filepath.Join(stats, "tx_bytes"))
+	if !okRx || !okTx {
+		return
+	}
+	// Counters restart when the device changes or is recreated
+	if m.WAN.Device == s.wanDevice && rx >= s.wanRx && tx >= s.wanTx {
+		if secs := now.Sub(s.wanAt).Seconds(); secs > 0 {
+			if c.WANRxBps == nil {
+				c.WANRxBps, c.WANTxBps = &Stat{}, &Stat{}
+			}
+			c.WANRxBytes += rx - s.wanRx
+			c.WANTxBytes += tx - s.wanTx
+			c.WANRxBps.add(float64(rx-s.wanRx) * 8 / secs)
+			c.WANTxBps.add(float64(tx-s.wanTx) * 8 / secs)
+		}
+	}
+	s.wanDevice, s.wanRx, s.wanTx, s.wanAt = m.WAN.Device, rx, tx, now
+}
+
+// close queues the current summary, dropping the oldest when too many are pending
+func (s *Summarizer) close() {
+	s.pending = append(s.pending, s.current)
+	if len(s.pending) > maxPendingSummaries {
+		s.pending = s.pending[1:]
+	}
+	s.current = nil
+}
+
+// Pending returns the number of finished summaries not yet published
+func (s *Summarizer) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Flush publishes the finished summaries in order, keeping them when publish fails
+func (s *Summarizer) Flush(publish func(*Summary) error) error {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		next := s.pending[0]
+		s.mu.Unlock()
+
+		if err := publish(next); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if len(s.pending) > 0 && s.pending[0] == next {
+			s.pending = s.pending[1:]
+		}
+		s.mu.Unlock()
+	}
+}
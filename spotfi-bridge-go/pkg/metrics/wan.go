@@ -0,0 +1,255 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/ubus"
+)
+
+const (
+	DefaultWANProbeTarget   = "1.1.1.1"
+	DefaultWANProbeInterval = 60 * time.Second
+	DefaultPublicIPURL      = "https://api.ipify.org"
+
+	wanPingCount     = 5
+	publicIPInterval = 10 * time.Minute
+)
+
+var (
+	wanReplyRe   = regexp.MustCompile(`time=([0-9.]+) ?ms`)
+	wanSummaryRe = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+)
+
+// WANProbeConfig configures the background WAN probe
+type WANProbeConfig struct {
+	Target      string        // Host pinged besides the gateway
+	Interval    time.Duration // Time between probes
+	PublicIPURL string        // Plain-text IP echo service, "off" disables the lookup
+	DNSName     string        // Name resolved to check DNS health
+}
+
+// PingResult is the outcome of one probe of a host
+type PingResult struct {
+	Host        string  `json:"host"`
+	LossPercent float64 `json:"lossPercent"`
+	AvgMs       float64 `json:"avgMs"`
+	JitterMs    float64 `json:"jitterMs"` // Mean deviation between consecutive replies
+}
+
+// WANMetrics describes the upstream connection
+type WANMetrics struct {
+	Interface string      `json:"interface"`
+	Up        bool        `json:"up"`
+	Uptime    int64       `json:"uptime"` // Seconds since the interface came up
+	Device    string      `json:"device,omitempty"`
+	IPv4      string      `json:"ipv4,omitempty"`
+	Gateway   *PingResult `json:"gateway,omitempty"`
+	Target    *PingResult `json:"target,omitempty"`
+	PublicIP  string      `json:"publicIp,omitempty"`
+	ProbedAt  int64       `json:"probedAt,omitempty"`
+	Error     string      `json:"error,omitempty"` // Why the WAN state could not be read
+}
+
+// wan holds the latest probe result; probing runs in the background so a
+// slow or dead uplink never delays the metrics publish
+var wan = struct {
+	mu         sync.Mutex
+	latest     *WANMetrics
+	publicIP   string
+	publicIPAt time.Time
+	dns        *DNSHealth
+	clock      *ClockHealth
+	clockErr   error
+	clockAt    time.Time
+}{}
+
+// StartWANProbe probes the WAN periodically until ctx is cancelled
+func StartWANProbe(ctx context.Context, cfg WANProbeConfig) {
+	if cfg.Target == "" {
+		cfg.Target = DefaultWANProbeTarget
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultWANProbeInterval
+	}
+	if cfg.PublicIPURL == "" {
+		cfg.PublicIPURL = DefaultPublicIPURL
+	}
+	if cfg.DNSName == "" {
+		cfg.DNSName = DefaultDNSProbeName
+	}
+
+	go func() {
+		defer crash.Recover("wan probe")
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			result := probeWAN(ctx, cfg)
+			dns := probeDNS(ctx, cfg.DNSName)
+			wan.mu.Lock()
+			wan.latest, wan.dns = result, dns
+			clockDue := time.Since(wan.clockAt) >= clockProbeInterval
+			wan.mu.Unlock()
+
+			if clockDue {
+				clock, err := probeClock(ctx)
+				wan.mu.Lock()
+				wan.clock, wan.clockErr, wan.clockAt = clock, err, time.Now()
+				wan.mu.Unlock()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// collectWAN returns the latest probe result, or nil before the first probe
+func collectWAN() *WANMetrics {
+	wan.mu.Lock()
+	defer wan.mu.Unlock()
+	if wan.latest == nil {
+		return nil
+	}
+	latest := *wan.latest
+	return &latest
+}
+
+// collectHealth returns the latest DNS and clock checks, and the error of the
+// last clock probe if its time source could not be queried
+func collectHealth() (*DNSHealth, *ClockHealth, error) {
+	wan.mu.Lock()
+	defer wan.mu.Unlock()
+	return wan.dns, wan.clock, wan.clockErr
+}
+
+// WANLossPercent reports packet loss to the probe target, for alerting
+func WANLossPercent(m *Metrics) (float64, bool) {
+	if m.WAN == nil || m.WAN.Target == nil {
+		return 0, false
+	}
+	return m.WAN.Target.LossPercent, true
+}
+
+func probeWAN(ctx context.Context, cfg WANProbeConfig) *WANMetrics {
+	w := &WANMetrics{Interface: "wan", ProbedAt: time.Now().Unix()}
+
+	gateway := ""
+	status, err := ubus.Call("network.interface.wan", "status", nil)
+	if err != nil {
+		w.Error = err.Error()
+	} else {
+		w.Up, _ = status["up"].(bool)
+		w.Uptime = number(status, "uptime")
+		w.Device = str(status, "l3_device", "device")
+		if addrs, ok := status["ipv4-address"].([]interface{}); ok && len(addrs) > 0 {
+			if a, ok := addrs[0].(map[string]interface{}); ok {
+				w.IPv4 = str(a, "address")
+			}
+		}
+		routes, _ := status["route"].([]interface{})
+		for _, r := range routes {
+			route, _ := r.(map[string]interface{})
+			if str(route, "target") == "0.0.0.0" && number(route, "mask") == 0 {
+				gateway = str(route, "nexthop")
+				break
+			}
+		}
+	}
+
+	if gateway != "" && gateway != "0.0.0.0" {
+		w.Gateway = ping(ctx, gateway)
+	}
+	if w.Up {
+		w.Target = ping(ctx, cfg.Target)
+		w.PublicIP = publicIP(ctx, cfg.PublicIPURL)
+	}
+	return w
+}
+
+func ping(ctx context.Context, host string) *PingResult {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, "ping", "-c", strconv.Itoa(wanPingCount), "-W", "2", host).CombinedOutput()
+
+	var rtts []float64
+	for _, m := range wanReplyRe.FindAllStringSubmatch(string(out), -1) {
+		if v, err := strconv.ParseFloat(m[1], 64); err == nil {
+			rtts = append(rtts, v)
+		}
+	}
+	sent, received := wanPingCount, len(rtts)
+	if m := wanSummaryRe.FindStringSubmatch(string(out)); m != nil {
+		sent, _ = strconv.Atoi(m[1])
+		received, _ = strconv.Atoi(m[2])
+	}
+
+	r := &PingResult{Host: host, LossPercent: 100}
+	if sent > 0 {
+		r.LossPercent = float64(sent-received) / float64(sent) * 100
+	}
+	if len(rtts) > 0 {
+		sum := 0.0
+		for _, v := range rtts {
+			sum += v
+		}
+		r.AvgMs = sum / float64(len(rtts))
+	}
+	if len(rtts) > 1 {
+		dev := 0.0
+		for i := 1; i < len(rtts); i++ {
+			dev += math.Abs(rtts[i] - rtts[i-1])
+		}
+		r.JitterMs = dev / float64(len(rtts)-1)
+	}
+	return r
+}
+
+// publicIP looks up the public address at most every publicIPInterval
+func publicIP(ctx context.Context, url string) string {
+	if url == "off" {
+		return ""
+	}
+	wan.mu.Lock()
+	cached, at := wan.publicIP, wan.publicIPAt
+	wan.mu.Unlock()
+	if cached != "" && time.Since(at) < publicIPInterval {
+		return cached
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		logger.Warn("Invalid public IP URL", "url", url, "error", err)
+		return cached
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return cached
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		return cached
+	}
+
+	wan.mu.Lock()
+	wan.publicIP, wan.publicIPAt = ip, time.Now()
+	wan.mu.Unlock()
+	return ip
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+
+	"spotfi-bridge/pkg/ubus"
+)
+
+// RSSI buckets in dBm, lower bounds of excellent/good/fair/poor; anything below is "bad"
+var rssiBuckets = []struct {
+	name string
+	min  float64
+}{
+	{"excellent", -50},
+	{"good", -60},
+	{"fair", -70},
+	{"poor", -80},
+}
+
+// RadioMetrics describes one wireless interface (SSID) and its radio
+type RadioMetrics struct {
+	Device      string         `json:"device"` // e.g. wlan0
+	Phy         string         `json:"phy,omitempty"`
+	SSID        string         `json:"ssid,omitempty"`
+	BSSID       string         `json:"bssid,omitempty"`
+	Mode        string         `json:"mode,omitempty"`
+	Channel     int            `json:"channel"`
+	Frequency   int            `json:"frequency"` // MHz
+	TxPower     int            `json:"txPower"`   // dBm
+	Noise       int            `json:"noise"`     // dBm
+	BusyPercent *float64       `json:"busyPercent,omitempty"`
+	Stations    int            `json:"stations"`
+	RSSI        map[string]int `json:"rssi"` // Station count per signal bucket
+
+	stationMacs []string // Lowercase MACs of the associated stations
+}
+
+func rssiBucket(signal float64) string {
+	for _, b := range rssiBuckets {
+		if signal >= b.min {
+			return b.name
+		}
+	}
+	return "bad"
+}
+
+// collectWireless queries iwinfo for every wireless device
+func collectWireless() ([]RadioMetrics, error) {
+	radios := []RadioMetrics{}
+	res, err := ubus.Call("iwinfo", "devices", nil)
+	if err != nil {
+		return radios, err
+	}
+	devices, _ := res["devices"].([]interface{})
+	for _, d := range devices {
+		name, ok := d.(string)
+		if !ok {
+			continue
+		}
+		radios = append(radios, radioMetrics(name))
+	}
+	sort.Slice(radios, func(i, j int) bool { return radios[i].Device < radios[j].Device })
+	return radios, nil
+}
+
+func radioMetrics(device string) RadioMetrics {
+	r := RadioMetrics{Device: device, RSSI: map[string]int{}}
+	for _, b := range rssiBuckets {
+		r.RSSI[b.name] = 0
+	}
+	r.RSSI["bad"] = 0
+
+	args := map[string]string{"device": device}
+	if info, err := ubus.Call("iwinfo", "info", args); err == nil {
+		r.Phy = str(info, "phy")
+		r.SSID = str(info, "ssid")
+		r.BSSID = str(info, "bssid")
+		r.Mode = str(info, "mode")
+		r.Channel = int(number(info, "channel"))
+		r.Frequency = int(number(info, "frequency"))
+		r.TxPower = int(number(info, "txpower"))
+		r.Noise = int(number(info, "noise"))
+	}
+
+	if assoc, err := ubus.Call("iwinfo", "assoclist", args); err == nil {
+		stations, _ := assoc["results"].([]interface{})
+		r.Stations = len(stations)
+		for _, s := range stations {
+			st, _ := s.(map[string]interface{})
+			if mac := str(st, "mac"); mac != "" {
+				r.stationMacs = append(r.stationMacs, strings.ToLower(mac))
+			}
+			if signal, ok := st["signal"].(float64); ok {
+				r.RSSI[rssiBucket(signal)]++
+			}
+		}
+	}
+
+	// Channel survey (busy/active time) is only available on newer iwinfo and drivers
+	if survey, err := ubus.Call("iwinfo", "survey", args); err == nil {
+		results, _ := survey["results"].([]interface{})
+		for _, s := range results {
+			ch, _ := s.(map[string]interface{})
+			if int(number(ch, "mhz")) != r.Frequency {
+				continue
+			}
+			active, busy := number(ch, "active_time"), number(ch, "busy_time")
+			if active > 0 {
+				pct := float64(busy) / float64(active) * 100
+				r.BusyPercent = &pct
+			}
+			break
+		}
+	}
+	return r
+}
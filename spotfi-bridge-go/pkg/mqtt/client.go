@@ -3,23 +3,41 @@ package mqtt
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
 )
 
+var logger = logging.For("mqtt")
+
 type Client struct {
 	client   mqtt.Client
 	routerID string
+	status   string // Retained ONLINE/OFFLINE topic
+	instance string // Optional instance name, see statusMessage
+	clientID string
+	store    mqtt.Store
+
+	published atomic.Int64 // Messages handed to the client
+	failed    atomic.Int64 // Publishes that returned an error or timed out
+	waiting   atomic.Int64 // QoS 1 publishes waiting for the broker's acknowledgment
 }
 
 // NewClient creates a new MQTT client
+// statusTopic: retained ONLINE/OFFLINE topic of this router (also the LWT)
+// instance: optional name of this bridge instance when several share a router ID
 // username: Router ID (from database) - used for EMQX authentication
 // password: Router Token - used for EMQX authentication
 // EMQX authenticates using: SELECT token FROM routers WHERE id = username
-func NewClient(brokerURL, clientID, username, password string, onConnect mqtt.OnConnectHandler) (*Client, error) {
+// onLost is called with the error when an established connection drops
+func NewClient(brokerURL, clientID, statusTopic, instance, username, password string, onConnect mqtt.OnConnectHandler, onLost func(error)) (*Client, error) {
+	c := &Client{routerID: username, status: statusTopic, instance: instance, clientID: clientID}
+
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(brokerURL)
 	opts.SetClientID(clientID)
@@ -31,19 +49,22 @@ func NewClient(brokerURL, clientID, username, password string, onConnect mqtt.On
 	// When connection is lost, broker publishes OFFLINE status
 	// LWT (Last Will and Testament)
 	// When connection is lost, broker publishes OFFLINE status
-	opts.SetWill(fmt.Sprintf("spotfi/router/%s/status", username), "OFFLINE", 1, true)
+	opts.SetWill(statusTopic, string(c.statusMessage("OFFLINE")), 1, true)
 
-	opts.SetOnConnectHandler(func(c mqtt.Client) {
-		log.Println("MQTT Connected")
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		logger.Info("Connected")
 		// Publish ONLINE status
-		c.Publish(fmt.Sprintf("spotfi/router/%s/status", username), 1, true, "ONLINE")
+		client.Publish(statusTopic, 1, true, c.statusMessage("ONLINE"))
 		if onConnect != nil {
-			onConnect(c)
+			onConnect(client)
 		}
 	})
 
 	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
-		log.Printf("MQTT Connection Lost: %v", err)
+		logger.Warn("Connection lost", "error", err)
+		if onLost != nil {
+			onLost(err)
+		}
 	})
 
 	// Custom dialer that prefers IPv4 to avoid IPv6 DNS issues on OpenWrt
@@ -58,12 +79,17 @@ func NewClient(brokerURL, clientID, username, password string, onConnect mqtt.On
 
 	opts.SetDialer(customDialer)
 
+	// Our own store, so the number of unacknowledged messages can be reported
+	store := mqtt.NewMemoryStore()
+	opts.SetStore(store)
+
 	client := mqtt.NewClient(opts)
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		return nil, token.Error()
 	}
 
-	return &Client{client: client, routerID: username}, nil
+	c.client, c.store = client, store
+	return c, nil
 }
 
 func (c *Client) Publish(topic string, payload interface{}) error {
@@ -87,22 +113,136 @@ func (c *Client) Publish(topic string, payload interface{}) error {
 	// Use QoS 0 (fire-and-forget) and don't wait for acknowledgment
 	// This reduces latency for terminal data
 	token := c.client.Publish(topic, 0, false, payloadBytes)
+	c.published.Add(1)
 	// Check for immediate errors without blocking
 	// For QoS 0, this is fire-and-forget, so we don't wait
 	if token.Error() != nil {
+		c.failed.Add(1)
 		return token.Error()
 	}
 	return nil
 }
 
+// PublishReliable publishes with QoS 1 and waits (bounded) for the broker to acknowledge,
+// for events that must not be lost like alerts
+func (c *Client) PublishReliable(topic string, payload interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return c.wait(topic, c.client.Publish(topic, 1, false, payloadBytes))
+}
+
+// PublishRetained publishes with QoS 1 and the retain flag, so the broker keeps
+// the latest message for subscribers that connect later
+func (c *Client) PublishRetained(topic string, payload interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return c.wait(topic, c.client.Publish(topic, 1, true, payloadBytes))
+}
+
+// wait waits (bounded) for a QoS 1 publish to be acknowledged
+func (c *Client) wait(topic string, token mqtt.Token) error {
+	c.published.Add(1)
+	c.waiting.Add(1)
+	defer c.waiting.Add(-1)
+	if !token.WaitTimeout(10 * time.Second) {
+		c.failed.Add(1)
+		return fmt.Errorf("publish to %s timed out", topic)
+	}
+	if err := token.Error(); err != nil {
+		c.failed.Add(1)
+		return err
+	}
+	return nil
+}
+
+// Stats reports publish counters and queue depths for self-telemetry
+func (c *Client) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"published": c.published.Load(),
+		"failed":    c.failed.Load(),
+		"waiting":   c.waiting.Load(),
+		"pending":   len(c.store.All()), // QoS 1 messages not yet acknowledged by the broker
+	}
+}
+
+// statusMessage is the plain status string, or with an instance name a JSON object
+// {"status", "instance", "clientId"} so the backend can tell instances apart
+func (c *Client) statusMessage(status string) []byte {
+	if c.instance == "" {
+		return []byte(status)
+	}
+	payload, _ := json.Marshal(map[string]string{"status": status, "instance": c.instance, "clientId": c.clientID})
+	return payload
+}
+
+// PublishStatus publishes a retained status (ONLINE/OFFLINE/REBOOTING) and waits for delivery
+func (c *Client) PublishStatus(status string) error {
+	token := c.client.Publish(c.status, 1, true, c.statusMessage(status))
+	token.Wait()
+	return token.Error()
+}
+
+// IsConnected reports whether the connection to the broker is currently up (not reconnecting)
+func (c *Client) IsConnected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+// Subscribe subscribes handler to topic; a panic in handler is reported and the message dropped
 func (c *Client) Subscribe(topic string, handler mqtt.MessageHandler) error {
-	token := c.client.Subscribe(topic, 0, handler)
+	token := c.client.Subscribe(topic, 0, func(client mqtt.Client, m mqtt.Message) {
+		defer crash.Catch("mqtt " + topic)
+		handler(client, m)
+	})
 	token.Wait()
 	return token.Error()
 }
 
-func (c *Client) Close() {
+// Close drains the publish queue, publishes OFFLINE and disconnects, all within timeout:
+// QoS 1 messages still waiting for the broker's acknowledgment get most of the time,
+// the rest is left for OFFLINE and the disconnect
+func (c *Client) Close(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	drainUntil := deadline.Add(-timeout / 4)
+	for time.Now().Before(drainUntil) && c.IsConnected() && (c.waiting.Load() > 0 || len(c.store.All()) > 0) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := len(c.store.All()); n > 0 {
+		logger.Warn("Disconnecting with unacknowledged messages", "pending", n)
+	}
+
 	// Publish OFFLINE before disconnecting gracefully
-	c.client.Publish(fmt.Sprintf("spotfi/router/%s/status", c.routerID), 1, true, "OFFLINE").Wait()
+	if !c.client.Publish(c.status, 1, true, c.statusMessage("OFFLINE")).WaitTimeout(time.Until(deadline)) {
+		logger.Warn("OFFLINE status not acknowledged before disconnecting")
+	}
 	c.client.Disconnect(250)
 }
+
+// CheckAuth connects once with the given credentials and disconnects again, without the
+// status LWT or ONLINE message, so a running bridge using the same router is not disturbed
+// as long as clientID differs from its own
+func CheckAuth(brokerURL, clientID, username, password string, timeout time.Duration) error {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(brokerURL)
+	opts.SetClientID(clientID)
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectTimeout(timeout)
+	opts.SetDialer(&net.Dialer{Timeout: timeout, Resolver: &net.Resolver{PreferGo: true}})
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("no CONNACK within %v", timeout)
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	client.Disconnect(250)
+	return nil
+}
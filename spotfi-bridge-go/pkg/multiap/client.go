@@ -0,0 +1,217 @@
+package multiap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/ubus"
+)
+
+const (
+	// nullSession is rpcd's unauthenticated session, which may only log in
+	nullSession = "00000000000000000000000000000000"
+
+	sessionTimeout = time.Hour
+	callTimeout    = 15 * time.Second
+	maxReplySize   = 4 << 20
+
+	// JSON-RPC error rpcd answers with for an expired or unknown session
+	errAccessDenied = -32002
+	// UBUS_STATUS_PERMISSION_DENIED
+	statusPermissionDenied = 6
+)
+
+var httpClient = &http.Client{Timeout: callTimeout}
+
+// client calls ubus on an AP through uhttpd-mod-ubus (http://host/ubus),
+// logging in to rpcd as needed
+type client struct {
+	host, username, password string
+
+	mu      sync.Mutex
+	session string
+	expires time.Time
+}
+
+type jsonRPCRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type jsonRPCReply struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// rpcError is a JSON-RPC level error of the AP's ubus endpoint
+type rpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("ubus endpoint error %d: %s", e.Code, e.Message)
+}
+
+func (c *client) post(ctx context.Context, method string, params ...interface{}) (json.RawMessage, error) {
+	body, err := json.Marshal(jsonRPCRequest{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+c.host+"/ubus", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP %d", c.host, resp.StatusCode)
+	}
+	var reply jsonRPCReply
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxReplySize)).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("%s: invalid JSON-RPC reply: %w", c.host, err)
+	}
+	if reply.Error != nil {
+		return nil, &rpcError{Code: reply.Error.Code, Message: reply.Error.Message}
+	}
+	return reply.Result, nil
+}
+
+// ubusResult decodes a "call" result, [status] or [status, data]
+func ubusResult(path, method string, raw json.RawMessage) (map[string]interface{}, error) {
+	var result []json.RawMessage
+	if err := json.Unmarshal(raw, &result); err != nil || len(result) == 0 {
+		return nil, fmt.Errorf("ubus call %s %s: invalid reply", path, method)
+	}
+	var status int
+	if err := json.Unmarshal(result[0], &status); err != nil {
+		return nil, fmt.Errorf("ubus call %s %s: invalid status", path, method)
+	}
+	if status != 0 {
+		return nil, &ubus.Error{Path: path, Method: method, ExitCode: status}
+	}
+	data := map[string]interface{}{}
+	if len(result) > 1 {
+		if err := json.Unmarshal(result[1], &data); err != nil {
+			return nil, fmt.Errorf("ubus call %s %s: invalid JSON reply: %w", path, method, err)
+		}
+	}
+	return data, nil
+}
+
+func (c *client) login(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != "" && time.Now().Before(c.expires) {
+		return c.session, nil
+	}
+	raw, err := c.post(ctx, "call", nullSession, "session", "login", map[string]interface{}{
+		"username": c.username,
+		"password": c.password,
+		"timeout":  int(sessionTimeout.Seconds()),
+	})
+	if err != nil {
+		return "", err
+	}
+	data, err := ubusResult("session", "login", raw)
+	if err != nil {
+		var ubusErr *ubus.Error
+		if errors.As(err, &ubusErr) && ubusErr.ExitCode == statusPermissionDenied {
+			return "", fmt.Errorf("%s: login as %s refused", c.host, c.username)
+		}
+		return "", err
+	}
+	sid, _ := data["ubus_rpc_session"].(string)
+	if sid == "" {
+		return "", fmt.Errorf("%s: login returned no session", c.host)
+	}
+	c.session = sid
+	// Renewed a little early so a call never races the expiry
+	c.expires = time.Now().Add(sessionTimeout - time.Minute)
+	return sid, nil
+}
+
+// forget drops the session after the AP refused it, e.g. because rpcd restarted
+func (c *client) forget(sid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == sid {
+		c.session = ""
+	}
+}
+
+// call invokes a ubus method on the AP, logging in again once if the session was lost
+func (c *client) call(ctx context.Context, path, method string, args interface{}) (map[string]interface{}, error) {
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	for attempt := 0; ; attempt++ {
+		sid, err := c.login(ctx)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := c.post(ctx, "call", sid, path, method, args)
+		if err == nil {
+			var data map[string]interface{}
+			data, err = ubusResult(path, method, raw)
+			var ubusErr *ubus.Error
+			if err == nil || !errors.As(err, &ubusErr) || ubusErr.ExitCode != statusPermissionDenied {
+				return data, err
+			}
+		} else if rpcErr, ok := err.(*rpcError); !ok || rpcErr.Code != errAccessDenied {
+			return nil, err
+		}
+		c.forget(sid)
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// list returns the ubus objects matching pattern
+func (c *client) list(ctx context.Context, pattern string) ([]string, error) {
+	sid, err := c.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := c.post(ctx, "list", sid, pattern)
+	if err != nil {
+		return nil, err
+	}
+	var objects map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &objects); err != nil {
+		return nil, fmt.Errorf("%s: invalid list reply: %w", c.host, err)
+	}
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// probe reports whether host serves a ubus JSON-RPC endpoint, without credentials
+func probe(ctx context.Context, host string) bool {
+	c := &client{host: host}
+	_, err := c.post(ctx, "list", nullSession, "session")
+	if err == nil {
+		return true
+	}
+	_, isRPC := err.(*rpcError)
+	return isRPC
+}
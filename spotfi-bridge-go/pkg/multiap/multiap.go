@@ -0,0 +1,639 @@
+package multiap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/inventory"
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/session"
+)
+
+var logger = logging.For("multiap")
+
+const (
+	// APFile keeps the adopted APs, including their credentials
+	APFile = "/etc/spotfi/aps.json"
+
+	DefaultInterval = time.Minute
+	MaxAPs          = 32
+
+	defaultUsername = "root"
+	defaultSSHPort  = 22
+
+	discoverTimeout     = 3 * time.Second
+	discoverConcurrency = 16
+)
+
+var (
+	// ErrDisabled is returned while gateway mode is off
+	ErrDisabled = errors.New("multi-AP gateway mode is disabled")
+	// ErrUnknownAP is returned for a MAC that was not adopted
+	ErrUnknownAP = errors.New("unknown AP")
+	// ErrLimit is returned when adopting more than MaxAPs
+	ErrLimit = fmt.Errorf("at most %d APs can be managed", MaxAPs)
+)
+
+var (
+	macPattern  = regexp.MustCompile(`^([0-9a-f]{2}:){5}[0-9a-f]{2}$`)
+	hostPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]{0,251}[A-Za-z0-9])?$`)
+)
+
+// Config configures gateway mode, in which the bridge manages dumb OpenWrt APs
+// behind the router on their behalf; the APs need no cloud credentials
+type Config struct {
+	Enabled bool
+
+	// Interval between metrics polls of each AP
+	Interval time.Duration
+
+	// PublishMetrics publishes on ap/{mac}/metrics
+	PublishMetrics func(mac string, m *Metrics) error
+	// PublishStatus publishes on ap/{mac}/status whenever an AP goes on- or offline
+	PublishStatus func(mac string, s *Status) error
+	// PublishTerminal publishes x-tunnel output of an AP terminal; topic is the
+	// responseTopic of the session, empty for ap/{mac}/x/out
+	PublishTerminal func(mac, topic string, v interface{}) error
+}
+
+// AP is an adopted access point
+type AP struct {
+	MAC      string `json:"mac"`
+	Host     string `json:"host"` // Address or name, optionally with the HTTP port
+	Name     string `json:"name,omitempty"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	SSHPort  int    `json:"sshPort,omitempty"`
+	AddedAt  int64  `json:"addedAt"`
+}
+
+// Status describes an AP for spotfi.ap/list and the status topic; credentials are left out
+type Status struct {
+	Type     string `json:"type"` // Always "ap-status"
+	MAC      string `json:"mac"`
+	Host     string `json:"host"`
+	Name     string `json:"name,omitempty"`
+	Online   bool   `json:"online"`
+	Error    string `json:"error,omitempty"`
+	Since    int64  `json:"since,omitempty"` // When Online last changed
+	LastSeen int64  `json:"lastSeen,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	Clients  int    `json:"clients"`
+	Removed  bool   `json:"removed,omitempty"`
+	AddedAt  int64  `json:"addedAt"`
+
+	// BSSIDs of the AP's hostapd interfaces, as of the last poll
+	BSSIDs []string `json:"bssids,omitempty"`
+}
+
+// Metrics is published on ap/{mac}/metrics every interval
+type Metrics struct {
+	Type     string                 `json:"type"` // Always "ap-metrics"
+	MAC      string                 `json:"mac"`
+	Name     string                 `json:"name,omitempty"`
+	Hostname string                 `json:"hostname,omitempty"`
+	Model    string                 `json:"model,omitempty"`
+	Firmware string                 `json:"firmware,omitempty"`
+	Uptime   int64                  `json:"uptime"`
+	Load     []float64              `json:"load"`
+	Memory   map[string]interface{} `json:"memory,omitempty"`
+	Clients  int                    `json:"clients"`
+	Radios   map[string]int         `json:"radios"` // Clients per hostapd interface
+	TS       int64                  `json:"ts"`
+}
+
+// Candidate is a host on the LAN serving ubus over HTTP
+type Candidate struct {
+	MAC     string `json:"mac"`
+	IP      string `json:"ip"`
+	Vendor  string `json:"vendor,omitempty"`
+	Adopted bool   `json:"adopted"`
+}
+
+type managedAP struct {
+	AP
+	client   *client
+	status   Status
+	sessions *session.SessionManager
+}
+
+var state = struct {
+	mu      sync.Mutex
+	enabled bool
+	ctx     context.Context
+	cfg     Config
+	aps     map[string]*managedAP
+	wake    chan struct{}
+}{aps: map[string]*managedAP{}, wake: make(chan struct{}, 1)}
+
+// Start loads the adopted APs and polls them until ctx is cancelled
+func Start(ctx context.Context, cfg Config) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	state.mu.Lock()
+	state.enabled = true
+	state.ctx = ctx
+	state.cfg = cfg
+	loadAPsLocked()
+	state.mu.Unlock()
+
+	go func() {
+		defer crash.Recover("multiap")
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			pollAll(ctx)
+			select {
+			case <-ctx.Done():
+				state.mu.Lock()
+				for _, ap := range state.aps {
+					if ap.sessions != nil {
+						ap.sessions.CloseAll("bridge is shutting down")
+					}
+				}
+				state.mu.Unlock()
+				return
+			case <-ticker.C:
+			case <-state.wake:
+			}
+		}
+	}()
+}
+
+func newManagedAP(ap AP) *managedAP {
+	return &managedAP{
+		AP:     ap,
+		client: &client{host: ap.Host, username: ap.Username, password: ap.Password},
+		status: Status{Type: "ap-status", MAC: ap.MAC, Host: ap.Host, Name: ap.Name, AddedAt: ap.AddedAt},
+	}
+}
+
+func loadAPsLocked() {
+	data, err := os.ReadFile(APFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Failed to read APs", "error", err)
+		}
+		return
+	}
+	var aps []AP
+	if err := json.Unmarshal(data, &aps); err != nil {
+		logger.Warn("Ignoring invalid AP file", "path", APFile, "error", err)
+		return
+	}
+	for _, ap := range aps {
+		state.aps[ap.MAC] = newManagedAP(ap)
+	}
+	logger.Info("Managing downstream APs", "aps", len(state.aps))
+}
+
+func saveAPsLocked() error {
+	aps := make([]AP, 0, len(state.aps))
+	for _, ap := range state.aps {
+		aps = append(aps, ap.AP)
+	}
+	sort.Slice(aps, func(i, j int) bool { return aps[i].MAC < aps[j].MAC })
+	data, err := json.MarshalIndent(aps, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(APFile), 0755); err != nil {
+		return err
+	}
+	tmp := APFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, APFile)
+}
+
+// NormalizeMAC returns mac in lower case with colons, or "" if it is not a MAC
+func NormalizeMAC(mac string) string {
+	mac = strings.ToLower(strings.ReplaceAll(mac, "-", ":"))
+	if len(mac) == 12 && !strings.Contains(mac, ":") {
+		var parts []string
+		for i := 0; i < 12; i += 2 {
+			parts = append(parts, mac[i:i+2])
+		}
+		mac = strings.Join(parts, ":")
+	}
+	if !macPattern.MatchString(mac) {
+		return ""
+	}
+	return mac
+}
+
+// ValidHost reports whether host is an address or name, optionally with a port
+func ValidHost(host string) bool {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return false
+		}
+		host = h
+	}
+	return net.ParseIP(host) != nil || hostPattern.MatchString(host)
+}
+
+// Adopt validates the credentials by logging in to the AP and starts managing it.
+// Adopting a MAC again replaces its settings
+func Adopt(ctx context.Context, ap AP) (*Status, error) {
+	ap.MAC = NormalizeMAC(ap.MAC)
+	if ap.MAC == "" {
+		return nil, fmt.Errorf("invalid mac")
+	}
+	if !ValidHost(ap.Host) {
+		return nil, fmt.Errorf("invalid host: %q", ap.Host)
+	}
+	if ap.Username == "" {
+		ap.Username = defaultUsername
+	}
+	if ap.SSHPort == 0 {
+		ap.SSHPort = defaultSSHPort
+	}
+	if ap.SSHPort < 1 || ap.SSHPort > 65535 {
+		return nil, fmt.Errorf("invalid sshPort: %d", ap.SSHPort)
+	}
+
+	state.mu.Lock()
+	if !state.enabled {
+		state.mu.Unlock()
+		return nil, ErrDisabled
+	}
+	old, exists := state.aps[ap.MAC]
+	if !exists && len(state.aps) >= MaxAPs {
+		state.mu.Unlock()
+		return nil, ErrLimit
+	}
+	state.mu.Unlock()
+
+	m := newManagedAP(ap)
+	if err := poll(ctx, m); err != nil {
+		return nil, fmt.Errorf("%s did not answer: %w", ap.Host, err)
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if exists {
+		m.AddedAt = old.AddedAt
+		if old.sessions != nil {
+			old.sessions.CloseAll("AP settings changed")
+		}
+	} else {
+		m.AddedAt = time.Now().Unix()
+	}
+	m.status.AddedAt = m.AddedAt
+	m.status.Online = true
+	m.status.Since = time.Now().Unix()
+	state.aps[ap.MAC] = m
+	if err := saveAPsLocked(); err != nil {
+		return nil, err
+	}
+	logger.Info("Adopted AP", "mac", ap.MAC, "host", ap.Host, "model", m.status.Model)
+	publishStatus(m)
+	select {
+	case state.wake <- struct{}{}:
+	default:
+	}
+	s := m.status
+	return &s, nil
+}
+
+// Remove stops managing an AP; the AP itself is left as it is
+func Remove(mac string) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.enabled {
+		return ErrDisabled
+	}
+	ap, ok := state.aps[NormalizeMAC(mac)]
+	if !ok {
+		return ErrUnknownAP
+	}
+	delete(state.aps, ap.MAC)
+	if ap.sessions != nil {
+		ap.sessions.CloseAll("AP removed")
+	}
+	if err := saveAPsLocked(); err != nil {
+		return err
+	}
+	ap.status.Online = false
+	ap.status.Removed = true
+	publishStatus(ap)
+	return nil
+}
+
+// List returns the adopted APs sorted by MAC
+func List() ([]Status, error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.enabled {
+		return nil, ErrDisabled
+	}
+	list := make([]Status, 0, len(state.aps))
+	for _, ap := range state.aps {
+		list = append(list, ap.status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].MAC < list[j].MAC })
+	return list, nil
+}
+
+// BSSIDs returns the BSSIDs of every adopted AP, empty while gateway mode is off
+func BSSIDs() []string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	var bssids []string
+	for _, ap := range state.aps {
+		bssids = append(bssids, ap.status.BSSIDs...)
+	}
+	return bssids
+}
+
+func lookup(mac string) (*managedAP, error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.enabled {
+		return nil, ErrDisabled
+	}
+	ap, ok := state.aps[NormalizeMAC(mac)]
+	if !ok {
+		return nil, ErrUnknownAP
+	}
+	return ap, nil
+}
+
+// Call invokes a ubus method on an adopted AP
+func Call(ctx context.Context, mac, path, method string, args json.RawMessage) (interface{}, error) {
+	ap, err := lookup(mac)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if len(args) > 0 {
+		if err := json.Unmarshal(args, &decoded); err != nil {
+			return nil, err
+		}
+	}
+	return ap.client.call(ctx, path, method, decoded)
+}
+
+func pollAll(ctx context.Context) {
+	state.mu.Lock()
+	aps := make([]*managedAP, 0, len(state.aps))
+	for _, ap := range state.aps {
+		aps = append(aps, ap)
+	}
+	state.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ap := range aps {
+		wg.Add(1)
+		go func(ap *managedAP) {
+			defer wg.Done()
+			defer crash.Catch("multiap poll")
+			err := poll(ctx, ap)
+			state.mu.Lock()
+			defer state.mu.Unlock()
+			if state.aps[ap.MAC] != ap {
+				return // Removed or replaced meanwhile
+			}
+			now := time.Now().Unix()
+			online := err == nil
+			changed := online != ap.status.Online || ap.status.Since == 0
+			ap.status.Online = online
+			ap.status.Error = ""
+			if err != nil {
+				ap.status.Error = err.Error()
+			}
+			if changed {
+				ap.status.Since = now
+				if err != nil {
+					logger.Warn("AP offline", "mac", ap.MAC, "host", ap.Host, "error", err)
+				} else {
+					logger.Info("AP online", "mac", ap.MAC, "host", ap.Host)
+				}
+				publishStatus(ap)
+			}
+		}(ap)
+	}
+	wg.Wait()
+}
+
+// poll collects and publishes the metrics of one AP
+func poll(ctx context.Context, ap *managedAP) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*callTimeout)
+	defer cancel()
+	board, err := ap.client.call(ctx, "system", "board", nil)
+	if err != nil {
+		return err
+	}
+	info, err := ap.client.call(ctx, "system", "info", nil)
+	if err != nil {
+		return err
+	}
+	m := &Metrics{
+		Type:     "ap-metrics",
+		MAC:      ap.MAC,
+		Name:     ap.Name,
+		Hostname: stringField(board, "hostname"),
+		Model:    stringField(board, "model"),
+		Radios:   map[string]int{},
+		TS:       time.Now().Unix(),
+	}
+	if release, ok := board["release"].(map[string]interface{}); ok {
+		m.Firmware = stringField(release, "description")
+	}
+	if uptime, ok := info["uptime"].(float64); ok {
+		m.Uptime = int64(uptime)
+	}
+	if load, ok := info["load"].([]interface{}); ok {
+		for _, l := range load {
+			if v, ok := l.(float64); ok {
+				m.Load = append(m.Load, v/65536) // Fixed point, as in sysinfo(2)
+			}
+		}
+	}
+	m.Memory, _ = info["memory"].(map[string]interface{})
+
+	// Clients are optional: an AP without hostapd objects is still online
+	var bssids []string
+	if objects, err := ap.client.list(ctx, "hostapd.*"); err == nil {
+		for _, obj := range objects {
+			iface := strings.TrimPrefix(obj, "hostapd.")
+			if info, err := ap.client.call(ctx, "iwinfo", "info", map[string]string{"device": iface}); err == nil {
+				if bssid := NormalizeMAC(stringField(info, "bssid")); bssid != "" {
+					bssids = append(bssids, bssid)
+				}
+			}
+			res, err := ap.client.call(ctx, obj, "get_clients", nil)
+			if err != nil {
+				continue
+			}
+			clients, _ := res["clients"].(map[string]interface{})
+			m.Radios[iface] = len(clients)
+			m.Clients += len(clients)
+		}
+	}
+
+	state.mu.Lock()
+	ap.status.Model = m.Model
+	ap.status.Firmware = m.Firmware
+	ap.status.Clients = m.Clients
+	ap.status.LastSeen = m.TS
+	ap.status.BSSIDs = bssids
+	publish := state.cfg.PublishMetrics
+	state.mu.Unlock()
+	if publish != nil {
+		if err := publish(ap.MAC, m); err != nil {
+			logger.Debug("Failed to publish AP metrics", "mac", ap.MAC, "error", err)
+		}
+	}
+	return nil
+}
+
+func stringField(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+// publishStatus is called with state.mu held
+func publishStatus(ap *managedAP) {
+	if state.cfg.PublishStatus == nil {
+		return
+	}
+	s := ap.status
+	go func() {
+		defer crash.Catch("multiap status")
+		if err := state.cfg.PublishStatus(s.MAC, &s); err != nil {
+			logger.Debug("Failed to publish AP status", "mac", s.MAC, "error", err)
+		}
+	}()
+}
+
+// PublishStatuses publishes the status of every AP, e.g. after reconnecting
+func PublishStatuses() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, ap := range state.aps {
+		if ap.status.Since != 0 { // Not polled yet; published by the first poll
+			publishStatus(ap)
+		}
+	}
+}
+
+// Discover probes the hosts of the device inventory for a ubus HTTP endpoint
+func Discover(ctx context.Context) ([]Candidate, error) {
+	state.mu.Lock()
+	enabled := state.enabled
+	adopted := map[string]bool{}
+	for mac := range state.aps {
+		adopted[mac] = true
+	}
+	state.mu.Unlock()
+	if !enabled {
+		return nil, ErrDisabled
+	}
+	inv, ok := inventory.Current()
+	if !ok {
+		return nil, errors.New("discovery needs the device inventory (SPOTFI_INVENTORY_INTERVAL)")
+	}
+
+	var (
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+		candidates = []Candidate{}
+		slots      = make(chan struct{}, discoverConcurrency)
+	)
+	for _, d := range inv.Devices {
+		if !d.Active {
+			continue
+		}
+		for _, ip := range d.IPs {
+			if net.ParseIP(ip).To4() == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(d inventory.Device, ip string) {
+				defer wg.Done()
+				defer crash.Catch("multiap discover")
+				slots <- struct{}{}
+				defer func() { <-slots }()
+				pctx, cancel := context.WithTimeout(ctx, discoverTimeout)
+				defer cancel()
+				if !probe(pctx, ip) {
+					return
+				}
+				mu.Lock()
+				candidates = append(candidates, Candidate{MAC: d.Mac, IP: ip, Vendor: d.Vendor, Adopted: adopted[d.Mac]})
+				mu.Unlock()
+			}(d, ip)
+		}
+	}
+	wg.Wait()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].MAC < candidates[j].MAC })
+	return candidates, nil
+}
+
+// HandleTerminal passes an x-tunnel message for an AP to its session manager,
+// which runs ssh to the AP in place of a local shell
+func HandleTerminal(mac string, msg map[string]interface{}) {
+	msgType, _ := msg["type"].(string)
+	sessionID, _ := msg["sessionId"].(string)
+	responseTopic, _ := msg["responseTopic"].(string)
+
+	state.mu.Lock()
+	ap, ok := state.aps[NormalizeMAC(mac)]
+	if !ok || !state.enabled || state.cfg.PublishTerminal == nil {
+		send := state.cfg.PublishTerminal
+		state.mu.Unlock()
+		if msgType == "x-start" && send != nil {
+			send(NormalizeMAC(mac), responseTopic, map[string]interface{}{
+				"type":      "x-error",
+				"sessionId": sessionID,
+				"error":     ErrUnknownAP.Error(),
+			})
+		}
+		return
+	}
+	if ap.sessions == nil {
+		host := ap.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		apMAC, send := ap.MAC, state.cfg.PublishTerminal
+		// dropbear's client takes the password from DROPBEAR_PASSWORD; with
+		// OpenSSH it is asked for in the terminal. Unknown host keys are accepted
+		// and remembered on first use
+		ap.sessions = session.NewCommandSessionManager(state.ctx, func(topic string, v interface{}) error {
+			return send(apMAC, topic, v)
+		}, []string{"ssh", "-y", "-p", strconv.Itoa(ap.SSHPort), ap.Username + "@" + host},
+			[]string{"DROPBEAR_PASSWORD=" + ap.Password})
+	}
+	sm := ap.sessions
+	state.mu.Unlock()
+
+	switch msgType {
+	case "x-start":
+		go sm.HandleStart(msg)
+	case "x-data":
+		sm.HandleData(msg)
+	case "x-stop":
+		sm.HandleStop(msg)
+	}
+}
@@ -0,0 +1,592 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("plugins")
+
+const (
+	DefaultDir         = "/usr/lib/spotfi/plugins"
+	DefaultCallTimeout = 30 * time.Second
+
+	registerTimeout = 10 * time.Second
+	stopTimeout     = 2 * time.Second
+	maxLine         = 1 << 20
+
+	// Restarts back off from minRestart to maxRestart; a plugin that ran for
+	// stableAfter starts over at minRestart
+	minRestart  = time.Second
+	maxRestart  = 5 * time.Minute
+	stableAfter = time.Minute
+
+	maxEventsPerSecond = 10
+	maxStderrPerMinute = 60
+)
+
+var namePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+var methodPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// ErrUnknown is returned for a plugin or method that is not registered
+var ErrUnknown = errors.New("no such plugin method")
+
+// Config configures the plugin host
+type Config struct {
+	// Dir holds the plugin executables ("off" disables plugins)
+	Dir string
+
+	// PublishEvent publishes events emitted by plugins
+	PublishEvent func(*Event) error
+}
+
+// Event is emitted by a plugin and published on events/plugins
+type Event struct {
+	Type   string          `json:"type"` // Always "plugin-event"
+	Plugin string          `json:"plugin"`
+	Event  string          `json:"event"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	TS     int64           `json:"ts"`
+}
+
+// Error is a failure reported by a plugin; Code is an RPC code name such as "invalid_args"
+type Error struct {
+	Plugin  string
+	Code    string
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("plugin %s: %s", e.Plugin, e.Message)
+}
+
+// Status describes a plugin for spotfi.plugin/list
+type Status struct {
+	File      string   `json:"file"`
+	Name      string   `json:"name,omitempty"` // Empty until the plugin registered
+	Version   string   `json:"version,omitempty"`
+	Running   bool     `json:"running"`
+	PID       int      `json:"pid,omitempty"`
+	Methods   []string `json:"methods"`
+	Metrics   bool     `json:"metrics"`
+	StartedAt int64    `json:"startedAt,omitempty"`
+	Restarts  int      `json:"restarts"`
+	LastError string   `json:"lastError,omitempty"`
+}
+
+// message is one line of the protocol, in either direction
+type message struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+
+	// register
+	Name    string   `json:"name,omitempty"`
+	Version string   `json:"version,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	Metrics bool     `json:"metrics,omitempty"`
+
+	// call
+	Method string          `json:"method,omitempty"`
+	Args   json.RawMessage `json:"args,omitempty"`
+
+	// result
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *struct {
+		Code    string                 `json:"code"`
+		Message string                 `json:"message"`
+		Details map[string]interface{} `json:"details,omitempty"`
+	} `json:"error,omitempty"`
+
+	// event
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+type proc struct {
+	file string
+
+	mu        sync.Mutex
+	status    Status
+	stdin     io.WriteCloser
+	process   *os.Process // Killed when a request cannot be written in time
+	pending   map[string]chan message
+	nextID    int
+	methods   map[string]bool
+	events    int // Emitted in the current second
+	eventsAt  int64
+	stderr    int // Lines logged in the current minute
+	stderrAt  int64
+	writeLock sync.Mutex
+}
+
+var state = struct {
+	mu     sync.Mutex
+	cfg    Config
+	procs  []*proc
+	byName map[string]*proc
+}{byName: map[string]*proc{}}
+
+// Start runs every executable of the plugin directory and keeps them running until ctx is cancelled
+func Start(ctx context.Context, cfg Config) {
+	if cfg.Dir == "" {
+		cfg.Dir = DefaultDir
+	}
+	if cfg.Dir == "off" {
+		return
+	}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return // No plugins installed
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.cfg = cfg
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || strings.HasPrefix(e.Name(), ".") || info.Mode()&0111 == 0 {
+			continue
+		}
+		p := &proc{file: filepath.Join(cfg.Dir, e.Name())}
+		p.status = Status{File: e.Name(), Methods: []string{}}
+		state.procs = append(state.procs, p)
+		go p.supervise(ctx)
+	}
+	if len(state.procs) > 0 {
+		logger.Info("Starting plugins", "dir", cfg.Dir, "plugins", len(state.procs))
+	}
+}
+
+// supervise restarts the plugin whenever it exits, with a growing delay
+func (p *proc) supervise(ctx context.Context) {
+	defer crash.Recover("plugin " + p.status.File)
+	backoff := minRestart
+	for {
+		started := time.Now()
+		err := p.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		p.mu.Lock()
+		p.status.Restarts++
+		if err != nil {
+			p.status.LastError = err.Error()
+		}
+		p.mu.Unlock()
+		if time.Since(started) > stableAfter {
+			backoff = minRestart
+		}
+		logger.Warn("Plugin exited", "file", p.status.File, "error", err, "restart", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxRestart {
+			backoff = maxRestart
+		}
+	}
+}
+
+// run starts the plugin, waits for its registration and serves it until it exits
+func (p *proc) run(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, p.file)
+	// Plugins are asked to stop with SIGTERM (and EOF on stdin) and killed if they do not
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = stopTimeout
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	lines := make(chan []byte)
+	go func() {
+		defer crash.Catch("plugin reader")
+		defer close(lines)
+		sc := bufio.NewScanner(stdout)
+		sc.Buffer(make([]byte, 64*1024), maxLine)
+		for sc.Scan() {
+			lines <- append([]byte(nil), sc.Bytes()...)
+		}
+	}()
+	go p.logStderr(stderr)
+
+	err = p.serve(ctx, cmd, stdin, lines)
+	stdin.Close()
+	for range lines {
+		// Drained so the reader goroutine ends
+	}
+	waitErr := cmd.Wait()
+	p.stopped()
+	if err == nil {
+		err = waitErr
+	}
+	if err == nil {
+		err = errors.New("exited")
+	}
+	return err
+}
+
+func (p *proc) serve(ctx context.Context, cmd *exec.Cmd, stdin io.WriteCloser, lines chan []byte) error {
+	var reg message
+	select {
+	case line, ok := <-lines:
+		if !ok {
+			return errors.New("exited before registering")
+		}
+		if err := json.Unmarshal(line, &reg); err != nil || reg.Type != "register" {
+			cmd.Process.Kill()
+			return errors.New("first message is not a registration")
+		}
+	case <-time.After(registerTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("did not register within %v", registerTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := p.register(reg, cmd.Process, stdin); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	for line := range lines {
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			logger.Debug("Ignoring invalid plugin output", "plugin", reg.Name, "error", err)
+			continue
+		}
+		switch msg.Type {
+		case "result":
+			p.mu.Lock()
+			ch := p.pending[msg.ID]
+			delete(p.pending, msg.ID)
+			p.mu.Unlock()
+			if ch != nil {
+				ch <- msg
+			}
+		case "event":
+			p.emit(reg.Name, msg)
+		default:
+			logger.Debug("Ignoring plugin message", "plugin", reg.Name, "type", msg.Type)
+		}
+	}
+	return nil
+}
+
+func (p *proc) register(reg message, process *os.Process, stdin io.WriteCloser) error {
+	if !namePattern.MatchString(reg.Name) {
+		return fmt.Errorf("invalid name: %q", reg.Name)
+	}
+	methods := map[string]bool{}
+	for _, m := range reg.Methods {
+		if !methodPattern.MatchString(m) {
+			return fmt.Errorf("invalid method: %q", m)
+		}
+		methods[m] = true
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if other, ok := state.byName[reg.Name]; ok && other != p {
+		return fmt.Errorf("name %q is already registered by %s", reg.Name, other.status.File)
+	}
+	state.byName[reg.Name] = p
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stdin = stdin
+	p.process = process
+	p.pending = map[string]chan message{}
+	p.methods = methods
+	p.status.Name = reg.Name
+	p.status.Version = reg.Version
+	p.status.Running = true
+	p.status.PID = process.Pid
+	p.status.Methods = sortedMethods(methods)
+	p.status.Metrics = reg.Metrics
+	p.status.StartedAt = time.Now().Unix()
+	p.status.LastError = ""
+	logger.Info("Plugin registered", "plugin", reg.Name, "file", p.status.File, "version", reg.Version, "methods", len(methods))
+	return nil
+}
+
+// stopped fails the calls still waiting for the plugin that exited
+func (p *proc) stopped() {
+	p.mu.Lock()
+	name := p.status.Name
+	p.mu.Unlock()
+	state.mu.Lock()
+	if state.byName[name] == p {
+		delete(state.byName, name)
+	}
+	state.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, ch := range p.pending {
+		close(ch)
+		delete(p.pending, id)
+	}
+	p.stdin = nil
+	p.process = nil
+	p.status.Running = false
+	p.status.PID = 0
+}
+
+func (p *proc) emit(name string, msg message) {
+	now := time.Now()
+	p.mu.Lock()
+	if p.eventsAt != now.Unix() {
+		p.eventsAt, p.events = now.Unix(), 0
+	}
+	p.events++
+	dropped := p.events > maxEventsPerSecond
+	p.mu.Unlock()
+	if dropped || msg.Event == "" {
+		return
+	}
+	publish := state.cfg.PublishEvent
+	if publish == nil {
+		return
+	}
+	ev := &Event{Type: "plugin-event", Plugin: name, Event: msg.Event, Data: msg.Data, TS: now.Unix()}
+	if err := publish(ev); err != nil {
+		logger.Debug("Failed to publish plugin event", "plugin", name, "error", err)
+	}
+}
+
+// logStderr logs what a plugin writes to stderr, rate limited
+func (p *proc) logStderr(r io.Reader) {
+	defer crash.Catch("plugin stderr")
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		now := time.Now().Unix() / 60
+		p.mu.Lock()
+		if p.stderrAt != now {
+			p.stderrAt, p.stderr = now, 0
+		}
+		p.stderr++
+		log := p.stderr <= maxStderrPerMinute
+		p.mu.Unlock()
+		if log {
+			logger.Info(sc.Text(), "plugin", p.status.File)
+		}
+	}
+}
+
+// request sends a call or collect message and waits for its result
+func (p *proc) request(ctx context.Context, msg message) (json.RawMessage, error) {
+	p.mu.Lock()
+	if p.stdin == nil {
+		p.mu.Unlock()
+		return nil, &Error{Plugin: p.status.Name, Code: "unavailable", Message: "not running"}
+	}
+	p.nextID++
+	msg.ID = strconv.Itoa(p.nextID)
+	ch := make(chan message, 1)
+	p.pending[msg.ID] = ch
+	stdin, name := p.stdin, p.status.Name
+	p.mu.Unlock()
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	// A plugin that stops reading its stdin would block the write, and every
+	// request queued behind it, for good: the write is bounded by ctx instead
+	written := make(chan error, 1)
+	go func() {
+		p.writeLock.Lock()
+		defer p.writeLock.Unlock()
+		_, err := stdin.Write(append(line, '\n'))
+		written <- err
+	}()
+	select {
+	case err = <-written:
+	case <-ctx.Done():
+		p.forget(msg.ID)
+		p.kill("request could not be written in time")
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		p.forget(msg.ID)
+		return nil, &Error{Plugin: name, Code: "unavailable", Message: err.Error()}
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, &Error{Plugin: name, Code: "unavailable", Message: "exited during the call"}
+		}
+		if reply.Error != nil {
+			code := reply.Error.Code
+			if code == "" {
+				code = "exec_error"
+			}
+			return nil, &Error{Plugin: name, Code: code, Message: reply.Error.Message, Details: reply.Error.Details}
+		}
+		return reply.Result, nil
+	case <-ctx.Done():
+		p.forget(msg.ID)
+		return nil, ctx.Err()
+	}
+}
+
+// kill ends a plugin that stopped serving requests, which fails the writes
+// stuck on its stdin; supervise restarts it
+func (p *proc) kill(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.process == nil {
+		return
+	}
+	logger.Warn("Killing unresponsive plugin", "plugin", p.status.Name, "reason", reason)
+	p.status.LastError = reason
+	p.process.Kill()
+	p.process = nil
+}
+
+func (p *proc) forget(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, id)
+}
+
+func sortedMethods(methods map[string]bool) []string {
+	list := make([]string, 0, len(methods))
+	for m := range methods {
+		list = append(list, m)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Call invokes an RPC method registered by the named plugin
+func Call(ctx context.Context, name, method string, args json.RawMessage) (json.RawMessage, error) {
+	state.mu.Lock()
+	p := state.byName[name]
+	state.mu.Unlock()
+	if p == nil {
+		return nil, ErrUnknown
+	}
+	p.mu.Lock()
+	known := p.methods[method]
+	p.mu.Unlock()
+	if !known {
+		return nil, ErrUnknown
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+	return p.request(ctx, message{Type: "call", Method: method, Args: args})
+}
+
+// Methods returns the RPC methods of every registered plugin by name
+func Methods() map[string][]string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	methods := map[string][]string{}
+	for name, p := range state.byName {
+		p.mu.Lock()
+		if len(p.methods) > 0 {
+			methods[name] = sortedMethods(p.methods)
+		}
+		p.mu.Unlock()
+	}
+	return methods
+}
+
+// List returns the status of every plugin, sorted by file name
+func List() []Status {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	list := make([]Status, 0, len(state.procs))
+	for _, p := range state.procs {
+		p.mu.Lock()
+		list = append(list, p.status)
+		p.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].File < list[j].File })
+	return list
+}
+
+// Collect asks every plugin that registered as a metrics collector for its
+// metrics, in parallel; failures are recorded as "plugin:<name>" errors
+func Collect(timeout time.Duration, errs map[string]string) map[string]json.RawMessage {
+	state.mu.Lock()
+	var collectors []*proc
+	for _, p := range state.byName {
+		p.mu.Lock()
+		if p.status.Metrics {
+			collectors = append(collectors, p)
+		}
+		p.mu.Unlock()
+	}
+	state.mu.Unlock()
+	if len(collectors) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = map[string]json.RawMessage{}
+	)
+	for _, p := range collectors {
+		wg.Add(1)
+		go func(p *proc) {
+			defer wg.Done()
+			defer crash.Catch("plugin collect")
+			out, err := p.request(ctx, message{Type: "collect"})
+			p.mu.Lock()
+			name := p.status.Name
+			p.mu.Unlock()
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, context.DeadlineExceeded):
+				errs["plugin:"+name] = fmt.Sprintf("timed out after %v", timeout)
+			case err != nil:
+				errs["plugin:"+name] = err.Error()
+			case len(out) > 0 && json.Valid(out):
+				results[name] = out
+			}
+		}(p)
+	}
+	wg.Wait()
+	return results
+}
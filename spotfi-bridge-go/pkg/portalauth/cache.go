@@ -0,0 +1,247 @@
+package portalauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// CacheFile keeps the logins the cloud allowed, for SPOTFI_PORTAL_AUTH_CACHE
+	CacheFile = "/etc/spotfi/auth-cache.json"
+
+	// CacheKeyFile holds the random key credentials are hashed and entries signed with
+	CacheKeyFile = "/etc/spotfi/auth-cache.key"
+
+	// maxCached bounds CacheFile; the oldest entries are dropped first
+	maxCached = 1000
+)
+
+// cacheEntry is one allowed login. Credentials are only kept as a keyed hash, and
+// the signature covers all other fields, so entries cannot be extended or forged
+// by editing the file without the key
+type cacheEntry struct {
+	Credential string `json:"credential"` // HMAC of the voucher or username and password
+	Mac        string `json:"mac"`        // Only this client may reuse the login offline
+	Interface  string `json:"interface"`
+
+	SessionTimeout int   `json:"sessionTimeout,omitempty"`
+	MaxTotalOctets int64 `json:"maxTotalOctets,omitempty"`
+	UploadKbit     int   `json:"uploadKbit,omitempty"`
+	DownloadKbit   int   `json:"downloadKbit,omitempty"`
+
+	CachedAt int64  `json:"cachedAt"`
+	Expires  int64  `json:"expires"`
+	Sig      string `json:"sig"`
+}
+
+var cache = struct {
+	mu      sync.Mutex
+	key     []byte
+	entries map[string]*cacheEntry // By credential and MAC
+}{}
+
+// openCache loads CacheFile, creating the key on first use; entries with an invalid
+// signature or past their expiry are dropped
+func openCache() error {
+	key, err := os.ReadFile(CacheKeyFile)
+	if err != nil || len(key) != 32 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(CacheKeyFile), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(CacheKeyFile, key, 0600); err != nil {
+			return err
+		}
+		os.Remove(CacheFile) // Signed with a lost key
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.key = key
+	cache.entries = map[string]*cacheEntry{}
+	data, err := os.ReadFile(CacheFile)
+	if err != nil {
+		return nil
+	}
+	var entries []*cacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		logger.Warn("Discarding corrupt portal auth cache", "error", err)
+		return nil
+	}
+	now := time.Now().Unix()
+	invalid := 0
+	for _, e := range entries {
+		if !hmac.Equal([]byte(e.Sig), []byte(sign(e))) {
+			invalid++
+			continue
+		}
+		if e.Expires > now {
+			cache.entries[e.Credential+" "+e.Mac] = e
+		}
+	}
+	if invalid > 0 {
+		logger.Warn("Discarded portal auth cache entries with an invalid signature", "entries", invalid)
+	}
+	return nil
+}
+
+// credential hashes the credentials of req, or returns "" when it has none to cache;
+// cache.mu must be held
+func credential(req *Request) string {
+	var secret string
+	switch {
+	case req.Voucher != "":
+		secret = "voucher\x00" + req.Voucher
+	case req.Username != "":
+		secret = "user\x00" + req.Username + "\x00" + req.Password
+	default:
+		return ""
+	}
+	h := hmac.New(sha256.New, cache.key)
+	h.Write([]byte(secret))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sign returns the signature of e; cache.mu must be held
+func sign(e *cacheEntry) string {
+	unsigned := *e
+	unsigned.Sig = ""
+	data, _ := json.Marshal(&unsigned)
+	h := hmac.New(sha256.New, cache.key)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// remember caches a login the cloud allowed for ttl
+func remember(req *Request, d *Decision, ttl time.Duration) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.key == nil {
+		return
+	}
+	cred := credential(req)
+	if cred == "" {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{
+		Credential:     cred,
+		Mac:            req.Mac,
+		Interface:      req.Interface,
+		SessionTimeout: d.SessionTimeout,
+		MaxTotalOctets: d.MaxTotalOctets,
+		UploadKbit:     d.UploadKbit,
+		DownloadKbit:   d.DownloadKbit,
+		CachedAt:       now.Unix(),
+		Expires:        now.Add(ttl).Unix(),
+	}
+	e.Sig = sign(e)
+	cache.entries[cred+" "+req.Mac] = e
+	saveCache()
+}
+
+// forget drops the cached logins with credential cred, after the cloud denied them
+func forget(cred string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.key == nil || cred == "" {
+		return
+	}
+	removed := false
+	for k, e := range cache.entries {
+		if e.Credential == cred {
+			delete(cache.entries, k)
+			removed = true
+		}
+	}
+	if removed {
+		saveCache()
+	}
+}
+
+// lookup returns the cached decision for req, or nil when its login was not cached
+// for this client or has expired
+func lookup(req *Request) *Decision {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.key == nil {
+		return nil
+	}
+	cred := credential(req)
+	if cred == "" {
+		return nil
+	}
+	e := cache.entries[cred+" "+req.Mac]
+	if e == nil || e.Expires <= time.Now().Unix() {
+		return nil
+	}
+	return &Decision{
+		ID:             req.ID,
+		Decision:       "allow",
+		Reason:         "cached login",
+		SessionTimeout: e.SessionTimeout,
+		MaxTotalOctets: e.MaxTotalOctets,
+		UploadKbit:     e.UploadKbit,
+		DownloadKbit:   e.DownloadKbit,
+	}
+}
+
+// forgetLogin drops the cached logins with the credentials of req
+func forgetLogin(req *Request) {
+	cache.mu.Lock()
+	cred := ""
+	if cache.key != nil {
+		cred = credential(req)
+	}
+	cache.mu.Unlock()
+	forget(cred)
+}
+
+// cacheSize returns the number of cached logins
+func cacheSize() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return len(cache.entries)
+}
+
+// saveCache writes the unexpired entries, newest maxCached first; cache.mu must be held
+func saveCache() {
+	now := time.Now().Unix()
+	entries := make([]*cacheEntry, 0, len(cache.entries))
+	for k, e := range cache.entries {
+		if e.Expires <= now {
+			delete(cache.entries, k)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CachedAt > entries[j].CachedAt })
+	if len(entries) > maxCached {
+		for _, e := range entries[maxCached:] {
+			delete(cache.entries, e.Credential+" "+e.Mac)
+		}
+		entries = entries[:maxCached]
+	}
+
+	data, err := json.Marshal(entries)
+	if err == nil {
+		tmp := CacheFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, CacheFile)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save portal auth cache", "error", err)
+	}
+}
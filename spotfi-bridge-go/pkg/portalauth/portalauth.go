@@ -0,0 +1,332 @@
+package portalauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("portalauth")
+
+const (
+	DefaultTimeout         = 5 * time.Second
+	DefaultFallback        = "deny"
+	DefaultFallbackSession = time.Hour
+
+	// maxPending bounds the requests waiting for the cloud; more are decided locally
+	maxPending = 100
+
+	// maxField bounds credentials and the other strings of a request
+	maxField = 256
+
+	defaultInterface = "uspot"
+)
+
+// Fallback policies, applied when the cloud cannot decide in time
+const (
+	FallbackDeny  = "deny"
+	FallbackAllow = "allow"
+)
+
+// Config configures the authorization relay. uspot's portal hands login attempts to
+// the bridge (the auth method of the spotfi.bridge ubus object), which asks the
+// cloud over MQTT and authorizes the client when it is allowed
+type Config struct {
+	// Enabled turns the relay on; without it auth requests are refused
+	Enabled bool
+
+	// Timeout is how long the cloud may take to decide
+	Timeout time.Duration
+
+	// Fallback is the local policy when the broker is unreachable or the cloud does not
+	// answer within Timeout: deny, or allow for FallbackSession
+	Fallback        string
+	FallbackSession time.Duration
+
+	// Cache is how long a login the cloud allowed may be reused by the same client
+	// while the cloud cannot be asked; 0 disables the cache
+	Cache time.Duration
+
+	// Authorize applies an allow decision to the portal, e.g. uspot client_add, and
+	// Deauthorize revokes a login allowed offline that the cloud denied afterwards
+	Authorize   func(req *Request, d *Decision) error
+	Deauthorize func(req *Request) error
+}
+
+// Request is published on the auth/request topic for every login attempt
+type Request struct {
+	Type      string `json:"type"` // Always "auth"
+	ID        string `json:"id"`
+	Mac       string `json:"mac"`
+	IP        string `json:"ip,omitempty"`
+	Interface string `json:"interface"` // uspot instance
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Voucher   string `json:"voucher,omitempty"`
+	Ts        int64  `json:"ts"`
+}
+
+// Decision is the cloud's answer on the auth/response topic, matched by ID
+type Decision struct {
+	ID       string `json:"id"`
+	Decision string `json:"decision"` // allow or deny
+	Reason   string `json:"reason,omitempty"`
+
+	// Limits of an allowed session; 0 leaves the portal default
+	SessionTimeout int   `json:"sessionTimeout,omitempty"` // Seconds
+	MaxTotalOctets int64 `json:"maxTotalOctets,omitempty"` // Data quota in bytes
+	UploadKbit     int   `json:"uploadKbit,omitempty"`
+	DownloadKbit   int   `json:"downloadKbit,omitempty"`
+
+	// NoCache keeps an allowed login out of the offline cache, e.g. for single-use vouchers
+	NoCache bool `json:"noCache,omitempty"`
+}
+
+// Result is returned to the portal
+type Result struct {
+	Allowed bool   `json:"allowed"`
+	Source  string `json:"source"` // cloud, cache or fallback
+	Reason  string `json:"reason,omitempty"`
+
+	SessionTimeout int   `json:"sessionTimeout,omitempty"`
+	MaxTotalOctets int64 `json:"maxTotalOctets,omitempty"`
+}
+
+// ErrDisabled is returned by Handle when the relay is not enabled
+var ErrDisabled = errors.New("portal auth relay is disabled")
+
+var state = struct {
+	mu        sync.Mutex
+	cfg       Config
+	ctx       context.Context
+	publish   func(*Request) error
+	connected func() bool
+	pending   map[string]chan *Decision
+	stats     Stats
+}{}
+
+// Stats counts the decisions since startup
+type Stats struct {
+	Allowed  int64 `json:"allowed"`
+	Denied   int64 `json:"denied"`
+	Fallback int64 `json:"fallback"` // Decided by the local policy
+	Pending  int   `json:"pending"`
+
+	CacheHits int64 `json:"cacheHits"` // Logins allowed from the offline cache
+	Cached    int   `json:"cached"`
+	Offline   int   `json:"offline"` // Logins allowed offline, not yet reported
+}
+
+// Configure starts the relay when enabled. It must run before the broker
+// connects, so the fallback policy applies while it is unreachable
+func Configure(ctx context.Context, cfg Config, publish func(*Request) error, connected func() bool) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.Fallback == "" {
+		cfg.Fallback = DefaultFallback
+	}
+	if cfg.FallbackSession <= 0 {
+		cfg.FallbackSession = DefaultFallbackSession
+	}
+	state.mu.Lock()
+	state.cfg = cfg
+	state.ctx = ctx
+	state.publish = publish
+	state.connected = connected
+	state.pending = map[string]chan *Decision{}
+	state.mu.Unlock()
+	if cfg.Cache > 0 {
+		if err := openCache(); err != nil {
+			logger.Error("Portal auth cache disabled", "error", err)
+		}
+	}
+	logger.Info("Portal auth relay enabled", "timeout", cfg.Timeout, "fallback", cfg.Fallback, "cache", cfg.Cache)
+}
+
+// Enabled reports whether the relay was configured
+func Enabled() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.cfg.Enabled
+}
+
+// GetStats returns the decision counters
+func GetStats() Stats {
+	state.mu.Lock()
+	s := state.stats
+	s.Pending = len(state.pending)
+	s.Offline = len(offline.logins)
+	state.mu.Unlock()
+	s.Cached = cacheSize()
+	return s
+}
+
+// Handle decides a login attempt and, when allowed, authorizes the client. The
+// returned error is for invalid requests and failures to authorize; a denial is a Result
+func Handle(req *Request) (*Result, error) {
+	state.mu.Lock()
+	cfg, ctx, publish, connected := state.cfg, state.ctx, state.publish, state.connected
+	state.mu.Unlock()
+	if !cfg.Enabled {
+		return nil, ErrDisabled
+	}
+	if err := validate(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	req.Type, req.ID, req.Ts = "auth", "auth-"+hex.EncodeToString(buf), time.Now().Unix()
+
+	d, reason := ask(ctx, cfg, req, publish, connected)
+	if d == nil {
+		if d := lookup(req); d != nil {
+			if err := cfg.Authorize(req, d); err != nil {
+				return nil, fmt.Errorf("authorize %s: %w", req.Mac, err)
+			}
+			count(func(s *Stats) { s.CacheHits++ })
+			recordOffline(req, "cache", reason, d)
+			logger.Info("Portal login allowed from the offline cache", "mac", req.Mac, "reason", reason)
+			return &Result{Allowed: true, Source: "cache", Reason: reason, SessionTimeout: d.SessionTimeout, MaxTotalOctets: d.MaxTotalOctets}, nil
+		}
+		return fallback(cfg, req, reason)
+	}
+	reportOffline()
+
+	if d.Decision != "allow" {
+		forgetLogin(req)
+		count(func(s *Stats) { s.Denied++ })
+		logger.Info("Portal login denied", "mac", req.Mac, "reason", d.Reason)
+		return &Result{Allowed: false, Source: "cloud", Reason: d.Reason}, nil
+	}
+	if err := cfg.Authorize(req, d); err != nil {
+		return nil, fmt.Errorf("authorize %s: %w", req.Mac, err)
+	}
+	if cfg.Cache > 0 && !d.NoCache {
+		remember(req, d, cfg.Cache)
+	}
+	count(func(s *Stats) { s.Allowed++ })
+	logger.Info("Portal login allowed", "mac", req.Mac, "sessionTimeout", d.SessionTimeout)
+	return &Result{Allowed: true, Source: "cloud", Reason: d.Reason, SessionTimeout: d.SessionTimeout, MaxTotalOctets: d.MaxTotalOctets}, nil
+}
+
+// ask publishes req and waits for the cloud's decision; nil means it could not
+// decide, for the given reason
+func ask(ctx context.Context, cfg Config, req *Request, publish func(*Request) error, connected func() bool) (*Decision, string) {
+	if connected != nil && !connected() {
+		return nil, "broker unreachable"
+	}
+	reply := make(chan *Decision, 1)
+	state.mu.Lock()
+	if len(state.pending) >= maxPending {
+		state.mu.Unlock()
+		return nil, "too many pending requests"
+	}
+	state.pending[req.ID] = reply
+	state.mu.Unlock()
+	defer func() {
+		state.mu.Lock()
+		delete(state.pending, req.ID)
+		state.mu.Unlock()
+	}()
+
+	if err := publish(req); err != nil {
+		logger.Warn("Failed to relay portal login", "mac", req.Mac, "error", err)
+		return nil, "relay failed"
+	}
+	timer := time.NewTimer(cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case d := <-reply:
+		return d, ""
+	case <-timer.C:
+		return nil, "cloud timeout"
+	case <-ctx.Done():
+		return nil, "bridge is shutting down"
+	}
+}
+
+// fallback applies the local policy
+func fallback(cfg Config, req *Request, reason string) (*Result, error) {
+	count(func(s *Stats) { s.Fallback++ })
+	logger.Warn("Portal login decided locally", "mac", req.Mac, "reason", reason, "policy", cfg.Fallback)
+	if cfg.Fallback != FallbackAllow {
+		return &Result{Allowed: false, Source: "fallback", Reason: reason}, nil
+	}
+	d := &Decision{ID: req.ID, Decision: "allow", Reason: reason, SessionTimeout: int(cfg.FallbackSession.Seconds())}
+	if err := cfg.Authorize(req, d); err != nil {
+		return nil, fmt.Errorf("authorize %s: %w", req.Mac, err)
+	}
+	recordOffline(req, "fallback", reason, d)
+	return &Result{Allowed: true, Source: "fallback", Reason: reason, SessionTimeout: d.SessionTimeout}, nil
+}
+
+// HandleResponse delivers a decision from the auth/response topic to the waiting request,
+// or applies it to a reported offline login. Late and unknown decisions are dropped: the
+// portal was already answered
+func HandleResponse(payload []byte) {
+	var d Decision
+	if err := json.Unmarshal(payload, &d); err != nil || d.ID == "" {
+		logger.Warn("Invalid portal auth response", "error", err)
+		return
+	}
+	if d.Decision != "allow" && d.Decision != "deny" {
+		logger.Warn("Invalid portal auth decision", "id", d.ID, "decision", d.Decision)
+		return
+	}
+	if d.SessionTimeout < 0 || d.MaxTotalOctets < 0 || d.UploadKbit < 0 || d.DownloadKbit < 0 {
+		logger.Warn("Invalid portal auth limits", "id", d.ID)
+		return
+	}
+	state.mu.Lock()
+	reply := state.pending[d.ID]
+	delete(state.pending, d.ID)
+	state.mu.Unlock()
+	if reply == nil {
+		if !reconcile(&d) {
+			logger.Debug("Portal auth response for no pending request", "id", d.ID)
+		}
+		return
+	}
+	reply <- &d
+}
+
+func validate(req *Request) error {
+	hw, err := net.ParseMAC(strings.TrimSpace(req.Mac))
+	if err != nil || len(hw) != 6 {
+		return fmt.Errorf("invalid MAC address: %q", req.Mac)
+	}
+	req.Mac = hw.String()
+	if req.IP != "" && net.ParseIP(req.IP) == nil {
+		return fmt.Errorf("invalid IP address: %q", req.IP)
+	}
+	if req.Interface == "" {
+		req.Interface = defaultInterface
+	}
+	for _, f := range []string{req.Interface, req.Username, req.Password, req.Voucher} {
+		if len(f) > maxField {
+			return fmt.Errorf("field longer than %d bytes", maxField)
+		}
+	}
+	return nil
+}
+
+func count(f func(*Stats)) {
+	state.mu.Lock()
+	f(&state.stats)
+	state.mu.Unlock()
+}
@@ -0,0 +1,171 @@
+package portalauth
+
+import (
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+)
+
+const (
+	// maxOffline bounds the logins decided locally that wait to be reported
+	maxOffline = 500
+
+	// reconcileWindow is how long the cloud may take to answer a report; later
+	// decisions for an offline login are dropped
+	reconcileWindow = time.Hour
+)
+
+// OfflineLogin is a login decided locally while the cloud could not be asked
+type OfflineLogin struct {
+	ID        string `json:"id"`
+	Mac       string `json:"mac"`
+	IP        string `json:"ip,omitempty"`
+	Interface string `json:"interface"`
+	Username  string `json:"username,omitempty"`
+	Voucher   string `json:"voucher,omitempty"`
+	Source    string `json:"source"` // cache or fallback
+	Reason    string `json:"reason"` // Why the cloud was not asked
+
+	SessionTimeout int   `json:"sessionTimeout,omitempty"`
+	MaxTotalOctets int64 `json:"maxTotalOctets,omitempty"`
+	At             int64 `json:"at"`
+
+	credential string // Cache key of the login, forgotten when the cloud revokes it
+}
+
+// OfflineReport is published on the auth/offline topic after reconnecting
+type OfflineReport struct {
+	Type    string          `json:"type"` // Always "authOffline"
+	Logins  []*OfflineLogin `json:"logins"`
+	Dropped int             `json:"dropped,omitempty"` // Logins beyond maxOffline, not reported
+}
+
+var offline = struct {
+	publish  func(*OfflineReport) error // Kept from Reconcile
+	logins   []*OfflineLogin
+	dropped  int
+	reported map[string]*reported // By ID, awaiting the cloud's decision
+}{reported: map[string]*reported{}}
+
+type reported struct {
+	login *OfflineLogin
+	at    time.Time
+}
+
+// recordOffline keeps a login allowed without the cloud for the next report.
+// The password is not kept: the cloud identifies the login by username or voucher
+func recordOffline(req *Request, source, reason string, d *Decision) {
+	cache.mu.Lock()
+	cred := ""
+	if cache.key != nil {
+		cred = credential(req)
+	}
+	cache.mu.Unlock()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if len(offline.logins) >= maxOffline {
+		offline.dropped++
+		return
+	}
+	offline.logins = append(offline.logins, &OfflineLogin{
+		ID:             req.ID,
+		Mac:            req.Mac,
+		IP:             req.IP,
+		Interface:      req.Interface,
+		Username:       req.Username,
+		Voucher:        req.Voucher,
+		Source:         source,
+		Reason:         reason,
+		SessionTimeout: d.SessionTimeout,
+		MaxTotalOctets: d.MaxTotalOctets,
+		At:             req.Ts,
+		credential:     cred,
+	})
+}
+
+// Reconcile reports the logins allowed while the cloud could not be asked, so it can
+// confirm, re-limit or revoke them with a decision per ID on auth/response. Call it
+// after every connect; logins that could not be published are kept for the next one.
+// Logins decided locally while connected, after a cloud timeout, are reported with the
+// cloud's next decision
+func Reconcile(publish func(*OfflineReport) error) {
+	state.mu.Lock()
+	offline.publish = publish
+	logins, dropped := offline.logins, offline.dropped
+	offline.logins, offline.dropped = nil, 0
+	state.mu.Unlock()
+	if len(logins) == 0 && dropped == 0 {
+		return
+	}
+
+	if err := publish(&OfflineReport{Type: "authOffline", Logins: logins, Dropped: dropped}); err != nil {
+		logger.Warn("Offline logins not reported, kept for retry", "logins", len(logins), "error", err)
+		state.mu.Lock()
+		offline.logins = append(logins, offline.logins...)
+		offline.dropped += dropped
+		state.mu.Unlock()
+		return
+	}
+	logger.Info("Reported logins allowed offline", "logins", len(logins), "dropped", dropped)
+
+	now := time.Now()
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for id, r := range offline.reported {
+		if now.Sub(r.at) > reconcileWindow {
+			delete(offline.reported, id)
+		}
+	}
+	for _, l := range logins {
+		offline.reported[l.ID] = &reported{login: l, at: now}
+	}
+}
+
+// reportOffline reports the offline logins once the cloud answers again
+func reportOffline() {
+	state.mu.Lock()
+	publish := offline.publish
+	waiting := len(offline.logins) > 0 || offline.dropped > 0
+	state.mu.Unlock()
+	if publish != nil && waiting {
+		go Reconcile(publish)
+	}
+}
+
+// reconcile starts applying the cloud's decision on a reported offline login and
+// reports whether d was one
+func reconcile(d *Decision) bool {
+	state.mu.Lock()
+	r := offline.reported[d.ID]
+	delete(offline.reported, d.ID)
+	cfg := state.cfg
+	state.mu.Unlock()
+	if r == nil {
+		return false
+	}
+	if time.Since(r.at) <= reconcileWindow {
+		go apply(cfg, r.login, d)
+	}
+	return true
+}
+
+// apply revokes an offline login the cloud denied, or applies the limits it allowed it with
+func apply(cfg Config, l *OfflineLogin, d *Decision) {
+	defer crash.Catch("portal auth reconcile")
+	req := &Request{ID: l.ID, Mac: l.Mac, IP: l.IP, Interface: l.Interface, Username: l.Username, Voucher: l.Voucher}
+	if d.Decision != "allow" {
+		forget(l.credential)
+		if err := cfg.Deauthorize(req); err != nil {
+			logger.Warn("Failed to revoke offline login", "mac", l.Mac, "error", err)
+			return
+		}
+		logger.Info("Revoked offline login", "mac", l.Mac, "reason", d.Reason)
+		return
+	}
+	if err := cfg.Authorize(req, d); err != nil {
+		logger.Warn("Failed to apply limits to offline login", "mac", l.Mac, "error", err)
+		return
+	}
+	logger.Info("Confirmed offline login", "mac", l.Mac, "sessionTimeout", d.SessionTimeout)
+}
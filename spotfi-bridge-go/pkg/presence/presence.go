@@ -0,0 +1,327 @@
+package presence
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/ubus"
+)
+
+var logger = logging.For("presence")
+
+const (
+	DefaultInterval     = 5 * time.Minute
+	DefaultMinSignal    = -80
+	DefaultSaltRotation = 24 * time.Hour
+	DefaultMaxRate      = 200
+	DefaultMaxDevices   = 5000
+
+	// The hostapd object list is refreshed this often, picking up radios
+	// that came up after the bridge
+	resubscribeEvery = 15 * time.Minute
+)
+
+// Config configures presence counting. Probe requests are taken from hostapd's
+// ubus notifications, so nothing is transmitted and no airtime is spent
+type Config struct {
+	// Enabled must be set explicitly; presence counting is never on by default
+	Enabled bool
+
+	// Interval is the counting window; one report is published per window
+	Interval time.Duration
+
+	// MinSignal ignores probes weaker than this (dBm), i.e. people outside the venue
+	MinSignal int
+
+	// SaltRotation is how often the hashing salt is replaced; hashes from
+	// different salt periods cannot be linked
+	SaltRotation time.Duration
+
+	// MaxRate caps the probes processed per second; the rest are only counted as dropped
+	MaxRate int
+
+	// MaxDevices caps the distinct devices tracked per window
+	MaxDevices int
+}
+
+// Report is published on the presence topic once per window
+type Report struct {
+	Type        string         `json:"type"` // Always "presence"
+	WindowStart int64          `json:"windowStart"`
+	WindowEnd   int64          `json:"windowEnd"`
+	Devices     int            `json:"devices"`    // Distinct devices with a global MAC
+	Randomized  int            `json:"randomized"` // Distinct private MACs; one phone may use several
+	Returning   int            `json:"returning"`  // Devices also seen in the previous window
+	Bands       map[string]int `json:"bands"`      // Distinct devices per band
+	Signal      map[string]int `json:"signal"`     // Distinct devices by proximity: near (>= -60 dBm), mid, far
+	Probes      int64          `json:"probes"`     // Probe requests counted
+	Dropped     int64          `json:"dropped"`    // Probes ignored by the rate and device caps
+	Truncated   bool           `json:"truncated,omitempty"`
+}
+
+type sighting struct {
+	randomized bool
+	signal     int
+	bands      map[string]bool
+}
+
+var state = struct {
+	mu       sync.Mutex
+	cfg      Config
+	salt     []byte
+	saltAt   time.Time
+	window   map[string]*sighting // By salted hash, never by MAC
+	previous map[string]bool
+	start    time.Time
+	probes   int64
+	dropped  int64
+	second   int64 // Unix second of the rate counter
+	inSecond int
+}{}
+
+// Configure starts counting probe requests when enabled
+func Configure(ctx context.Context, cfg Config, publish func(*Report) error) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.MinSignal == 0 {
+		cfg.MinSignal = DefaultMinSignal
+	}
+	if cfg.SaltRotation <= 0 {
+		cfg.SaltRotation = DefaultSaltRotation
+	}
+	if cfg.MaxRate <= 0 {
+		cfg.MaxRate = DefaultMaxRate
+	}
+	if cfg.MaxDevices <= 0 {
+		cfg.MaxDevices = DefaultMaxDevices
+	}
+	state.mu.Lock()
+	state.cfg = cfg
+	state.window = map[string]*sighting{}
+	state.start = time.Now()
+	newSalt(state.start)
+	state.mu.Unlock()
+
+	go subscribeLoop(ctx)
+	go func() {
+		defer crash.Recover("presence report")
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := publish(rotate()); err != nil {
+				logger.Error("Failed to publish presence", "error", err)
+			}
+		}
+	}()
+}
+
+// rotate closes the current window and returns its report
+func rotate() *Report {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	now := time.Now()
+	r := &Report{
+		Type:        "presence",
+		WindowStart: state.start.Unix(),
+		WindowEnd:   now.Unix(),
+		Bands:       map[string]int{},
+		Signal:      map[string]int{},
+		Probes:      state.probes,
+		Dropped:     state.dropped,
+		Truncated:   len(state.window) >= state.cfg.MaxDevices,
+	}
+	current := make(map[string]bool, len(state.window))
+	for hash, s := range state.window {
+		current[hash] = true
+		if s.randomized {
+			r.Randomized++
+		} else {
+			r.Devices++
+			if state.previous[hash] {
+				r.Returning++
+			}
+		}
+		for b := range s.bands {
+			r.Bands[b]++
+		}
+		switch {
+		case s.signal >= -60:
+			r.Signal["near"]++
+		case s.signal >= -70:
+			r.Signal["mid"]++
+		default:
+			r.Signal["far"]++
+		}
+	}
+	state.previous = current
+	state.window = map[string]*sighting{}
+	state.start, state.probes, state.dropped = now, 0, 0
+	if now.Sub(state.saltAt) >= state.cfg.SaltRotation {
+		newSalt(now)
+	}
+	return r
+}
+
+// newSalt replaces the hashing salt; it only changes between windows so that
+// one device is never counted twice within a window. Hashes made with the old
+// salt can no longer match, so returning devices start over
+func newSalt(now time.Time) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		logger.Error("Cannot generate salt", "error", err)
+		state.salt = nil
+		return
+	}
+	state.salt, state.saltAt, state.previous = salt, now, nil
+}
+
+// record counts one probe. The MAC is hashed right away and never kept
+func record(mac string, signal, freq int) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if signal < state.cfg.MinSignal {
+		return
+	}
+	now := time.Now()
+	if sec := now.Unix(); sec != state.second {
+		state.second, state.inSecond = sec, 0
+	}
+	state.inSecond++
+	if state.inSecond > state.cfg.MaxRate {
+		state.dropped++
+		return
+	}
+
+	if state.salt == nil {
+		return
+	}
+	mac = strings.ToLower(mac)
+	h := hmac.New(sha256.New, state.salt)
+	h.Write([]byte(mac))
+	hash := string(h.Sum(nil)[:12])
+
+	s, ok := state.window[hash]
+	if !ok {
+		if len(state.window) >= state.cfg.MaxDevices {
+			state.dropped++
+			return
+		}
+		s = &sighting{randomized: randomized(mac), signal: signal, bands: map[string]bool{}}
+		state.window[hash] = s
+	}
+	state.probes++
+	s.signal = max(s.signal, signal)
+	s.bands[band(freq)] = true
+}
+
+// randomized reports whether the locally administered bit is set
+func randomized(mac string) bool {
+	if len(mac) < 2 {
+		return false
+	}
+	b, err := strconv.ParseUint(mac[:2], 16, 8)
+	return err == nil && b&0x02 != 0
+}
+
+func band(freq int) string {
+	switch {
+	case freq >= 5925:
+		return "6GHz"
+	case freq >= 5000:
+		return "5GHz"
+	case freq > 0:
+		return "2.4GHz"
+	}
+	return "unknown"
+}
+
+// subscribeLoop keeps a "ubus subscribe" running on every hostapd interface
+func subscribeLoop(ctx context.Context) {
+	defer crash.Recover("presence subscribe")
+	backoff := time.Second
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := subscribe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) >= resubscribeEvery {
+			backoff = time.Second
+			continue
+		}
+		logger.Warn("Probe capture failed", "error", err, "retry", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// subscribe reads probe notifications for up to resubscribeEvery. hostapd
+// only waits for subscriber replies with notify_response set, which is left
+// off, so subscribing never delays association
+func subscribe(ctx context.Context) error {
+	objects, err := ubus.List("hostapd.*")
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return errors.New("no hostapd interfaces")
+	}
+	ctx, cancel := context.WithTimeout(ctx, resubscribeEvery)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ubus", append([]string{"subscribe"}, objects...)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		cancel()
+		cmd.Wait()
+	}()
+
+	dec := json.NewDecoder(stdout)
+	for {
+		var ev struct {
+			Probe *struct {
+				Address string `json:"address"`
+				Signal  int    `json:"signal"`
+				Freq    int    `json:"freq"`
+			} `json:"probe"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if ev.Probe != nil && ev.Probe.Address != "" {
+			record(ev.Probe.Address, ev.Probe.Signal, ev.Probe.Freq)
+		}
+	}
+}
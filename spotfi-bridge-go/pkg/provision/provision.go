@@ -0,0 +1,134 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("provision")
+
+// DefaultRetry is how often an unclaimed router asks again
+const DefaultRetry = time.Minute
+
+// maxRetry caps the backoff after failed requests
+const maxRetry = 10 * time.Minute
+
+// Request identifies the router to the provisioning endpoint. The claim code is
+// entered in the dashboard (or printed on the unit); routers without one are
+// matched by MAC address or serial number
+type Request struct {
+	ClaimCode string `json:"claimCode,omitempty"`
+	MAC       string `json:"mac,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	Model     string `json:"model,omitempty"`
+	BoardName string `json:"boardName,omitempty"`
+	Version   string `json:"version"`
+}
+
+// Identity is returned once the router has been claimed
+type Identity struct {
+	RouterID   string `json:"routerId"`
+	Token      string `json:"token"`
+	Name       string `json:"name,omitempty"`
+	MQTTBroker string `json:"mqttBroker,omitempty"`
+}
+
+// ErrPending means the endpoint knows of no claim for this router yet
+var ErrPending = errors.New("not claimed yet")
+
+// rejectedError is a permanent refusal (bad or already used claim code)
+type rejectedError struct {
+	status int
+	msg    string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("provisioning rejected (HTTP %d): %s", e.status, e.msg)
+}
+
+// Claim asks the endpoint once for this router's identity: 200 carries the identity,
+// 202 and 404 mean not claimed yet (ErrPending), other 4xx are permanent rejections
+func Claim(ctx context.Context, url string, req Request) (*Identity, error) {
+	body, _ := json.Marshal(req)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		var id Identity
+		if err := json.Unmarshal(data, &id); err != nil {
+			return nil, fmt.Errorf("invalid provisioning response: %w", err)
+		}
+		if id.RouterID == "" || id.Token == "" {
+			return nil, fmt.Errorf("provisioning response without routerId or token")
+		}
+		return &id, nil
+	case resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusNotFound:
+		return nil, ErrPending
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return nil, &rejectedError{status: resp.StatusCode, msg: e.Error}
+	}
+	return nil, fmt.Errorf("provisioning endpoint returned HTTP %d", resp.StatusCode)
+}
+
+// Run claims until the router has an identity, asking every retry while it is
+// unclaimed and backing off on errors. It only gives up on a permanent rejection
+// or when ctx is done
+func Run(ctx context.Context, url string, req Request, retry time.Duration) (*Identity, error) {
+	if retry <= 0 {
+		retry = DefaultRetry
+	}
+	wait := retry
+	for {
+		id, err := Claim(ctx, url, req)
+		if err == nil {
+			return id, nil
+		}
+		var rejected *rejectedError
+		switch {
+		case errors.As(err, &rejected):
+			return nil, err
+		case errors.Is(err, ErrPending):
+			logger.Info("Router not claimed yet", "claimCode", req.ClaimCode, "mac", req.MAC, "retry", retry)
+			wait = retry
+		default:
+			logger.Warn("Provisioning failed", "error", err, "retry", wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if !errors.Is(err, ErrPending) {
+			wait *= 2
+			if wait > maxRetry {
+				wait = maxRetry
+			}
+		}
+	}
+}
@@ -0,0 +1,541 @@
+package rogueap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/multiap"
+	"spotfi-bridge/pkg/ubus"
+)
+
+var logger = logging.For("rogueap")
+
+// AllowFile keeps the BSSIDs allowed with spotfi.rogueap/allow
+const AllowFile = "/etc/spotfi/rogueap.json"
+
+const (
+	DefaultInterval = 15 * time.Minute
+
+	// The first scan waits for the radios to come up and the broker connection,
+	// so its alerts are not lost
+	firstScanDelay = time.Minute
+
+	// A rogue AP is cleared after missing from this many scans in a row
+	clearAfterScans = 3
+
+	maxTracked = 64
+	maxAllowed = 256
+)
+
+// Reasons a beacon is reported
+const (
+	ReasonSSIDSpoof  = "ssidSpoof"  // A venue SSID from a BSSID that is not the venue's
+	ReasonBSSIDSpoof = "bssidSpoof" // One of the router's BSSIDs on another channel
+	ReasonLookalike  = "lookalike"  // An SSID that only differs from a venue SSID in case, punctuation or look-alike characters
+)
+
+// Alert states, as for threshold alerts
+const (
+	StateFiring  = "firing"
+	StateCleared = "cleared"
+)
+
+// ErrDisabled is returned when rogue AP detection is off
+var ErrDisabled = errors.New("rogue AP detection is disabled")
+
+// Config configures the scanner
+type Config struct {
+	Enabled  bool
+	Interval time.Duration
+
+	// SSIDs are venue SSIDs served by other equipment; the router's own are always included
+	SSIDs []string
+
+	// Allow are BSSIDs, or MAC prefixes of at least 3 octets, that may broadcast venue SSIDs
+	Allow []string
+}
+
+// Beacon is a network seen in a scan
+type Beacon struct {
+	SSID       string `json:"ssid"`
+	BSSID      string `json:"bssid"`
+	Channel    int    `json:"channel"`
+	Signal     int    `json:"signal"` // dBm
+	Encryption string `json:"encryption"`
+	Radio      string `json:"radio"` // Interface that heard it
+}
+
+// Alert is published on the alerts topic when a rogue AP appears and when it
+// is gone, like threshold alerts
+type Alert struct {
+	Type     string `json:"type"` // Always "alert"
+	Rule     string `json:"rule"` // rogueAP/{bssid}
+	Metric   string `json:"metric"`
+	Severity string `json:"severity"`
+	State    string `json:"state"`
+	Reason   string `json:"reason"`
+	Beacon
+	Imitates string `json:"imitates,omitempty"` // The venue SSID of a lookalike
+	Since    int64  `json:"since"`
+	LastSeen int64  `json:"lastSeen"`
+	Ts       int64  `json:"ts"`
+	Message  string `json:"message"`
+}
+
+// detection is a rogue AP being tracked
+type detection struct {
+	alert  Alert
+	missed int // Scans in a row without it
+}
+
+// ownRadio is one of the router's AP interfaces
+type ownRadio struct {
+	device     string
+	phy        string
+	ssid       string
+	bssid      string
+	channel    int
+	encryption string
+}
+
+var state = struct {
+	mu        sync.Mutex
+	cfg       Config
+	enabled   bool
+	publish   func(*Alert) error
+	allowed   []string // From AllowFile
+	tracked   map[string]*detection
+	lastScan  int64
+	lastError string
+	beacons   int
+}{tracked: map[string]*detection{}}
+
+// scanning serializes scans
+var scanning sync.Mutex
+
+// Configure starts scanning every interval when enabled; publish sends an alert
+func Configure(ctx context.Context, cfg Config, publish func(*Alert) error) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	state.mu.Lock()
+	state.cfg = cfg
+	state.enabled = true
+	state.publish = publish
+	loadAllowed()
+	state.mu.Unlock()
+
+	go func() {
+		defer crash.Recover("rogueap")
+		timer := time.NewTimer(firstScanDelay)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			if _, err := Scan(ctx); err != nil {
+				logger.Warn("Rogue AP scan failed", "error", err)
+			}
+			timer.Reset(cfg.Interval)
+		}
+	}()
+}
+
+// Scan scans from every radio, compares the beacons with the venue's SSIDs and
+// BSSIDs and publishes the alerts that fire or clear. It returns the status
+func Scan(ctx context.Context) (map[string]interface{}, error) {
+	state.mu.Lock()
+	enabled := state.enabled
+	state.mu.Unlock()
+	if !enabled {
+		return nil, ErrDisabled
+	}
+	scanning.Lock()
+	defer scanning.Unlock()
+
+	radios, err := ownRadios()
+	if err == nil && len(radios) == 0 {
+		err = errors.New("no wireless AP interface to scan from")
+	}
+	var beacons []Beacon
+	if err == nil {
+		beacons, err = scan(ctx, radios)
+	}
+	state.mu.Lock()
+	state.lastScan = time.Now().Unix()
+	state.lastError = ""
+	if err != nil {
+		state.lastError = err.Error()
+		state.mu.Unlock()
+		return nil, err
+	}
+	state.beacons = len(beacons)
+	alerts := evaluate(radios, beacons)
+	publish := state.publish
+	state.mu.Unlock()
+
+	for _, a := range alerts {
+		if a.State == StateFiring {
+			logger.Warn("Rogue AP", "reason", a.Reason, "ssid", a.SSID, "bssid", a.BSSID, "channel", a.Channel, "signal", a.Signal)
+		}
+		if publish != nil {
+			if err := publish(a); err != nil {
+				logger.Error("Failed to publish rogue AP alert", "bssid", a.BSSID, "error", err)
+			}
+		}
+	}
+	return Status(), nil
+}
+
+// ownRadios reads the router's AP interfaces from iwinfo
+func ownRadios() ([]ownRadio, error) {
+	res, err := ubus.Call("iwinfo", "devices", nil)
+	if err != nil {
+		return nil, err
+	}
+	devices, _ := res["devices"].([]interface{})
+	var radios []ownRadio
+	for _, d := range devices {
+		device, _ := d.(string)
+		info, err := ubus.Call("iwinfo", "info", map[string]string{"device": device})
+		if err != nil || device == "" {
+			continue
+		}
+		if mode, _ := info["mode"].(string); mode != "Master" {
+			continue
+		}
+		r := ownRadio{device: device, encryption: encryption(info["encryption"])}
+		r.phy, _ = info["phy"].(string)
+		r.ssid, _ = info["ssid"].(string)
+		bssid, _ := info["bssid"].(string)
+		r.bssid = multiap.NormalizeMAC(bssid)
+		if ch, ok := info["channel"].(float64); ok {
+			r.channel = int(ch)
+		}
+		radios = append(radios, r)
+	}
+	return radios, nil
+}
+
+// scan runs an iwinfo scan on one interface of each radio; one scan covers
+// every channel of the radio's band
+func scan(ctx context.Context, radios []ownRadio) ([]Beacon, error) {
+	var beacons []Beacon
+	var lastErr error
+	scanned := 0
+	phys := map[string]bool{}
+	for _, r := range radios {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if r.phy != "" && phys[r.phy] {
+			continue
+		}
+		phys[r.phy] = true
+		res, err := ubus.Call("iwinfo", "scan", map[string]string{"device": r.device})
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", r.device, err)
+			continue
+		}
+		scanned++
+		results, _ := res["results"].([]interface{})
+		for _, item := range results {
+			b, _ := item.(map[string]interface{})
+			beacon := Beacon{Radio: r.device, Encryption: encryption(b["encryption"])}
+			beacon.SSID, _ = b["ssid"].(string)
+			bssid, _ := b["bssid"].(string)
+			beacon.BSSID = multiap.NormalizeMAC(bssid)
+			if ch, ok := b["channel"].(float64); ok {
+				beacon.Channel = int(ch)
+			}
+			if sig, ok := b["signal"].(float64); ok {
+				beacon.Signal = int(sig)
+			}
+			if beacon.BSSID != "" {
+				beacons = append(beacons, beacon)
+			}
+		}
+	}
+	if scanned == 0 {
+		// Some drivers cannot scan while serving clients
+		return nil, fmt.Errorf("no radio could scan: %w", lastErr)
+	}
+	return beacons, nil
+}
+
+// encryption summarizes an iwinfo encryption object, e.g. "open", "wpa2-psk" or "wpa3-sae"
+func encryption(v interface{}) string {
+	enc, _ := v.(map[string]interface{})
+	if enabled, _ := enc["enabled"].(bool); !enabled {
+		return "open"
+	}
+	version := 0
+	wpa, _ := enc["wpa"].([]interface{})
+	for _, w := range wpa {
+		if n, ok := w.(float64); ok && int(n) > version {
+			version = int(n)
+		}
+	}
+	var auth []string
+	list, _ := enc["authentication"].([]interface{})
+	for _, a := range list {
+		if s, ok := a.(string); ok {
+			auth = append(auth, strings.ToLower(s))
+		}
+	}
+	name := "wep"
+	if version > 0 {
+		name = "wpa" + strconv.Itoa(version)
+	}
+	if len(auth) > 0 {
+		name += "-" + strings.Join(auth, "/")
+	}
+	return name
+}
+
+// evaluate compares the beacons with the venue's networks, returning the alerts
+// that fire and clear; state.mu must be held
+func evaluate(radios []ownRadio, beacons []Beacon) []*Alert {
+	now := time.Now().Unix()
+	venue := map[string]string{} // SSID by normalized form
+	ownEncryption := map[string]string{}
+	ownChannels := map[string]map[int]bool{}
+	for _, s := range state.cfg.SSIDs {
+		venue[normalize(s)] = s
+	}
+	for _, r := range radios {
+		if r.ssid != "" {
+			venue[normalize(r.ssid)] = r.ssid
+			ownEncryption[r.ssid] = r.encryption
+		}
+		if r.bssid != "" {
+			if ownChannels[r.bssid] == nil {
+				ownChannels[r.bssid] = map[int]bool{}
+			}
+			ownChannels[r.bssid][r.channel] = true
+		}
+	}
+	known := map[string]bool{}
+	for _, b := range multiap.BSSIDs() {
+		known[b] = true
+	}
+	allow := append(append([]string{}, state.cfg.Allow...), state.allowed...)
+
+	seen := map[string]bool{}
+	var fired []*Alert
+	for _, b := range beacons {
+		reason, imitates := "", ""
+		if channels, own := ownChannels[b.BSSID]; own {
+			// Radios that report no channel cannot tell a copy apart
+			if !channels[b.Channel] && !channels[0] {
+				reason = ReasonBSSIDSpoof
+			}
+		} else if b.SSID != "" && !known[b.BSSID] && !allowed(allow, b.BSSID) {
+			if ssid, ok := venue[normalize(b.SSID)]; ok {
+				reason = ReasonSSIDSpoof
+				if ssid != b.SSID && !isVenueSSID(venue, b.SSID) {
+					reason, imitates = ReasonLookalike, ssid
+				}
+			}
+		}
+		if reason == "" {
+			continue
+		}
+		seen[b.BSSID] = true
+		if d, ok := state.tracked[b.BSSID]; ok {
+			d.missed = 0
+			d.alert.Beacon, d.alert.LastSeen = b, now
+			continue
+		}
+		if len(state.tracked) >= maxTracked {
+			continue
+		}
+		a := Alert{
+			Type:     "alert",
+			Rule:     "rogueAP/" + b.BSSID,
+			Metric:   "rogueAP",
+			Severity: "critical",
+			State:    StateFiring,
+			Reason:   reason,
+			Beacon:   b,
+			Imitates: imitates,
+			Since:    now,
+			LastSeen: now,
+			Ts:       now,
+		}
+		switch reason {
+		case ReasonBSSIDSpoof:
+			a.Message = fmt.Sprintf("BSSID %s of this router seen on channel %d, broadcasting %q", b.BSSID, b.Channel, b.SSID)
+		case ReasonLookalike:
+			a.Severity = "warning"
+			a.Message = fmt.Sprintf("%q from %s imitates venue SSID %q", b.SSID, b.BSSID, imitates)
+		default:
+			a.Message = fmt.Sprintf("Venue SSID %q broadcast by unknown %s on channel %d", b.SSID, b.BSSID, b.Channel)
+			if own := ownEncryption[b.SSID]; own != "" && own != "open" && b.Encryption == "open" {
+				a.Message += fmt.Sprintf(", open instead of %s", own)
+			}
+		}
+		state.tracked[b.BSSID] = &detection{alert: a}
+		fired = append(fired, &a)
+	}
+
+	for bssid, d := range state.tracked {
+		if seen[bssid] {
+			continue
+		}
+		// Also cleared right away once allowed
+		if d.missed++; d.missed < clearAfterScans && !allowed(allow, bssid) {
+			continue
+		}
+		delete(state.tracked, bssid)
+		a := d.alert
+		a.State, a.Ts = StateCleared, now
+		a.Message = fmt.Sprintf("%s (%q) no longer seen", bssid, a.SSID)
+		fired = append(fired, &a)
+	}
+	return fired
+}
+
+func isVenueSSID(venue map[string]string, ssid string) bool {
+	for _, s := range venue {
+		if s == ssid {
+			return true
+		}
+	}
+	return false
+}
+
+// lookalikes maps characters commonly swapped in spoofed SSIDs to the ones they imitate
+var lookalikes = strings.NewReplacer("0", "o", "1", "l", "i", "l", "3", "e", "5", "s", "@", "a", "$", "s", "rn", "m", "vv", "w")
+
+// normalize folds case, drops spaces and punctuation and maps look-alike characters
+func normalize(ssid string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(ssid) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '@' || r == '$' {
+			b.WriteRune(r)
+		}
+	}
+	return lookalikes.Replace(b.String())
+}
+
+// allowed reports whether bssid is in the allow list, as a whole or by prefix
+func allowed(allow []string, bssid string) bool {
+	for _, a := range allow {
+		if a == bssid || (len(a) < len(bssid) && strings.HasPrefix(bssid, a+":")) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizePrefix returns a BSSID or a MAC prefix of 3 to 5 octets in lower case
+// with colons, or "" if it is neither
+func NormalizePrefix(s string) string {
+	s = strings.ToLower(strings.ReplaceAll(s, "-", ":"))
+	if mac := multiap.NormalizeMAC(s); mac != "" {
+		return mac
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) < 3 || len(parts) > 5 {
+		return ""
+	}
+	for _, p := range parts {
+		if _, err := strconv.ParseUint(p, 16, 8); err != nil || len(p) != 2 {
+			return ""
+		}
+	}
+	return s
+}
+
+// Status returns the scanner state and the rogue APs being tracked
+func Status() map[string]interface{} {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	active := make([]Alert, 0, len(state.tracked))
+	for _, d := range state.tracked {
+		active = append(active, d.alert)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].BSSID < active[j].BSSID })
+	status := map[string]interface{}{
+		"enabled": state.enabled,
+		"active":  active,
+		"allowed": append(append([]string{}, state.cfg.Allow...), state.allowed...),
+	}
+	if state.lastScan > 0 {
+		status["lastScan"] = state.lastScan
+		status["beacons"] = state.beacons
+	}
+	if state.lastError != "" {
+		status["error"] = state.lastError
+	}
+	return status
+}
+
+// Allow adds a BSSID or prefix to the persisted allow list, or removes it
+func Allow(entry string, allow bool) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.enabled {
+		return ErrDisabled
+	}
+	list := make([]string, 0, len(state.allowed)+1)
+	for _, a := range state.allowed {
+		if a != entry {
+			list = append(list, a)
+		}
+	}
+	if allow {
+		if len(list) >= maxAllowed {
+			return fmt.Errorf("at most %d entries can be allowed", maxAllowed)
+		}
+		list = append(list, entry)
+	}
+	sort.Strings(list)
+	data, _ := json.Marshal(map[string]interface{}{"allow": list})
+	if err := os.MkdirAll(filepath.Dir(AllowFile), 0755); err != nil {
+		return err
+	}
+	tmp := AllowFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, AllowFile); err != nil {
+		return err
+	}
+	state.allowed = list
+	return nil
+}
+
+// loadAllowed reads AllowFile; state.mu must be held
+func loadAllowed() {
+	data, err := os.ReadFile(AllowFile)
+	if err != nil {
+		return
+	}
+	var saved struct {
+		Allow []string `json:"allow"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		logger.Error("Ignoring corrupt rogue AP allow list", "file", AllowFile, "error", err)
+		return
+	}
+	state.allowed = saved.Allow
+}
@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"spotfi-bridge/pkg/multiap"
+	"spotfi-bridge/pkg/ubus"
+)
+
+// APAdoptArgs are the arguments of spotfi.ap/adopt
+type APAdoptArgs struct {
+	MAC      string `json:"mac"`
+	Host     string `json:"host"` // Address of the AP's web interface, optionally with the port
+	Name     string `json:"name"`
+	Username string `json:"username"` // rpcd and SSH login, default root
+	Password string `json:"password"`
+	SSHPort  int    `json:"sshPort"`
+}
+
+func init() {
+	register("spotfi.ap", "adopt", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args APAdoptArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		mac, err := normalizeMAC(args.MAC)
+		if err != nil {
+			return nil, err
+		}
+		if !multiap.ValidHost(args.Host) {
+			return nil, invalidArgs("invalid host: %q", args.Host)
+		}
+		if args.SSHPort < 0 || args.SSHPort > 65535 {
+			return nil, invalidArgs("invalid sshPort: %d", args.SSHPort)
+		}
+		if len(args.Name) > 64 || strings.ContainsAny(args.Name, "\n\x00") {
+			return nil, invalidArgs("name must be at most 64 characters")
+		}
+		status, err := multiap.Adopt(ctx, multiap.AP{
+			MAC:      mac,
+			Host:     args.Host,
+			Name:     args.Name,
+			Username: args.Username,
+			Password: args.Password,
+			SSHPort:  args.SSHPort,
+		})
+		if err != nil && !errors.Is(err, multiap.ErrDisabled) && !errors.Is(err, multiap.ErrLimit) {
+			return nil, Errorf(CodeUnavailable, "%v", err)
+		}
+		return status, apError(err)
+	})
+	register("spotfi.ap", "remove", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args struct {
+			MAC string `json:"mac"`
+		}
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		mac, err := normalizeMAC(args.MAC)
+		if err != nil {
+			return nil, err
+		}
+		if err := multiap.Remove(mac); err != nil {
+			return nil, apError(err)
+		}
+		return map[string]interface{}{"removed": mac}, nil
+	})
+	register("spotfi.ap", "list", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		aps, err := multiap.List()
+		if err != nil {
+			return nil, apError(err)
+		}
+		return map[string]interface{}{"aps": aps}, nil
+	})
+	register("spotfi.ap", "discover", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		candidates, err := multiap.Discover(ctx)
+		if err != nil {
+			return nil, apError(err)
+		}
+		return map[string]interface{}{"candidates": candidates}, nil
+	})
+}
+
+func apError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, multiap.ErrDisabled):
+		return Errorf(CodeUnavailable, "%v", err)
+	case errors.Is(err, multiap.ErrUnknownAP):
+		return Errorf(CodeNotFound, "%v", err)
+	case errors.Is(err, multiap.ErrLimit):
+		return Errorf(CodeInvalidArgs, "%v", err)
+	}
+	return err
+}
+
+// callAP forwards a request for a downstream AP to its ubus. The bridge's own
+// and plugin operations are not available there, as the AP runs no bridge
+func callAP(ctx context.Context, req RPCRequest) *Response {
+	if strings.HasPrefix(req.Path, "spotfi.") || strings.HasPrefix(req.Path, pluginPrefix) {
+		return newResponse(req.ID, nil, Errorf(CodeNotFound, "%s is not available on downstream APs", req.Path))
+	}
+	result, err := multiap.Call(ctx, req.target, req.Path, req.Method, req.Args)
+	var ubusErr *ubus.Error
+	if err != nil && ctx.Err() == nil && !errors.As(err, &ubusErr) &&
+		!errors.Is(err, multiap.ErrDisabled) && !errors.Is(err, multiap.ErrUnknownAP) {
+		err = Errorf(CodeUnavailable, "AP %s: %v", req.target, err)
+	}
+	return newResponse(req.ID, result, apError(err))
+}
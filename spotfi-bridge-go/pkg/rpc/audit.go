@@ -0,0 +1,159 @@
+package rpc
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxAuditArgs = 512
+
+// auditSecrets are the argument names, matched case-insensitively at any depth,
+// whose values never reach the audit log, topic or journal
+var auditSecrets = map[string]bool{
+	"password": true, "privatekey": true, "presharedkey": true, "key": true, "token": true, "secret": true,
+}
+
+// AuditRecord is one line of the RPC audit log
+type AuditRecord struct {
+	Timestamp  int64                  `json:"ts"`
+	ID         string                 `json:"id"`
+	Source     string                 `json:"source,omitempty"`
+	Requester  map[string]interface{} `json:"requester,omitempty"`
+	Target     string                 `json:"target,omitempty"` // MAC of the downstream AP
+	Path       string                 `json:"path"`
+	Method     string                 `json:"method"`
+	Args       string                 `json:"args,omitempty"` // Secrets redacted, truncated to maxAuditArgs bytes
+	Status     string                 `json:"status"`
+	Code       ErrorCode              `json:"code"`
+	DurationMs int64                  `json:"durationMs"`
+	Duplicate  bool                   `json:"duplicate,omitempty"`
+}
+
+var auditLog = struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}{}
+
+// audit records a handled request in the local log and, if configured, on the audit topic;
+// every request is also logged at debug level
+func audit(req RPCRequest, resp *Response, started time.Time) {
+	logger.Debug("Handled request", "id", req.ID, "path", req.Path, "method", req.Method,
+		"status", resp.Status, "code", resp.Code.String(), "duration", time.Since(started))
+	if options.AuditLogPath == "" && options.PublishAudit == nil {
+		return
+	}
+
+	// Redacted before truncating, so a secret cut short cannot slip through
+	args := redactArgs(req.Args)
+	if len(args) > maxAuditArgs {
+		args = args[:maxAuditArgs] + "...(truncated)"
+	}
+	record := AuditRecord{
+		Timestamp:  started.Unix(),
+		ID:         req.ID,
+		Source:     req.Source,
+		Requester:  req.Requester,
+		Target:     req.target,
+		Path:       req.Path,
+		Method:     req.Method,
+		Args:       args,
+		Status:     resp.Status,
+		Code:       resp.Code,
+		DurationMs: time.Since(started).Milliseconds(),
+		Duplicate:  resp.Duplicate,
+	}
+
+	if options.AuditLogPath != "" {
+		if err := writeAudit(record); err != nil {
+			logger.Error("Failed to write audit log", "error", err)
+		}
+	}
+	if options.PublishAudit != nil {
+		if err := options.PublishAudit(record); err != nil {
+			logger.Error("Failed to publish audit record", "error", err)
+		}
+	}
+}
+
+// redactArgs replaces the values of auditSecrets in request args with "[redacted]"
+func redactArgs(raw json.RawMessage) string {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return string(raw)
+	}
+	data, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if auditSecrets[strings.ToLower(k)] {
+				v[k] = "[redacted]"
+			} else {
+				v[k] = redactValue(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return v
+}
+
+// writeAudit appends a JSON line, rotating the file to <path>.1 once it exceeds AuditLogMaxSize
+func writeAudit(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+
+	if auditLog.file == nil {
+		if err := os.MkdirAll(filepath.Dir(options.AuditLogPath), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(options.AuditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		auditLog.file = f
+		auditLog.size = info.Size()
+	}
+
+	if auditLog.size+int64(len(line)) > options.AuditLogMaxSize && auditLog.size > 0 {
+		auditLog.file.Close()
+		auditLog.file = nil
+		if err := os.Rename(options.AuditLogPath, options.AuditLogPath+".1"); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(options.AuditLogPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		auditLog.file = f
+		auditLog.size = 0
+	}
+
+	n, err := auditLog.file.Write(line)
+	auditLog.size += int64(n)
+	return err
+}
@@ -0,0 +1,887 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/alerts"
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/script"
+)
+
+const (
+	// AutomationFile keeps the automations deployed with spotfi.automation/set
+	AutomationFile = "/etc/spotfi/automations.json"
+
+	maxAutomations           = 50
+	maxAutomationActions     = 10
+	maxAutomationRuns        = 5 // Kept per automation
+	maxAutomationCooldown    = 24 * 60 * 60
+	defaultAutomationTimeout = 5 * time.Minute
+	automationSaveInterval   = 5 * time.Minute // Run history is saved at most this often, sparing the flash
+
+	// Runs across all automations per minute, so an automation whose actions cause
+	// the events it reacts to cannot loop the router to death
+	maxAutomationFirings = 60
+	automationQueueSize  = 64
+
+	// Rate limiter source the RPC actions of automations are counted under
+	automationSource = "automation"
+)
+
+// Automation action types
+const (
+	ActionRPC     = "rpc"
+	ActionPublish = "publish"
+	ActionScript  = "script"
+)
+
+var templatePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.]+)\s*\}\}`)
+
+// Automation runs actions on the router itself when a local event matches, so it
+// reacts in time whether or not the broker is reachable
+type Automation struct {
+	Name string `json:"name"`
+
+	// On is the type of the events the automation reacts to: client, alert,
+	// failover, quota or plugin-event
+	On string `json:"on"`
+
+	// When maps event fields (dotted for nested ones, e.g. data.level) to the
+	// values they must have, all of them for the automation to run. A value is a
+	// glob such as "wan*", may be negated with a leading "!", or compares numbers
+	// with <, <=, > or >=
+	When map[string]string `json:"when,omitempty"`
+
+	Actions []AutomationAction `json:"actions"`
+
+	// Cooldown is the minimum number of seconds between two runs
+	Cooldown int `json:"cooldown,omitempty"`
+
+	// Timeout cancels a run after this many seconds (default 300)
+	Timeout int `json:"timeout,omitempty"`
+
+	Disabled bool `json:"disabled,omitempty"`
+
+	UpdatedAt int64           `json:"updatedAt"`
+	LastRun   int64           `json:"lastRun,omitempty"`
+	Runs      []AutomationRun `json:"runs,omitempty"` // Latest first
+}
+
+// AutomationAction is one step of an automation. String values in Args and Data
+// may reference fields of the triggering event as {{field}}; a string consisting
+// of nothing but a reference takes the field's value with its JSON type
+type AutomationAction struct {
+	Type string `json:"type"` // rpc, publish or script
+
+	// rpc: the operation to run, as a job
+	Path   string          `json:"path,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Args   json.RawMessage `json:"args,omitempty"`
+
+	// publish: an event for the backend on the events/automation topic
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+
+	// script: a Starlark script run with the triggering event, see the README for
+	// its builtins and limits. Templates do not apply to it
+	Script string `json:"script,omitempty"`
+
+	// ContinueOnError runs the next action even if this one fails
+	ContinueOnError bool `json:"continueOnError,omitempty"`
+
+	program *script.Program
+}
+
+// AutomationRun reports one run on the events/automation topic
+type AutomationRun struct {
+	Type       string          `json:"type"` // Always "automation-run"
+	Automation string          `json:"automation"`
+	Trigger    json.RawMessage `json:"trigger,omitempty"` // The event that matched
+	Manual     bool            `json:"manual,omitempty"`
+	StartedAt  int64           `json:"startedAt"`
+	FinishedAt int64           `json:"finishedAt"`
+	Status     string          `json:"status"` // succeeded, failed or skipped
+	Error      string          `json:"error,omitempty"`
+	CodeName   string          `json:"codeName,omitempty"`
+	JobIDs     []string        `json:"jobIds,omitempty"` // One per operation run
+}
+
+// AutomationArgs name an automation for delete
+type AutomationArgs struct {
+	Name string `json:"name"`
+}
+
+// AutomationRunArgs are the arguments of spotfi.automation/run
+type AutomationRunArgs struct {
+	Name  string                 `json:"name"`
+	Event map[string]interface{} `json:"event"` // Sample trigger, checked against When
+}
+
+// AutomationReplaceArgs are the arguments of spotfi.automation/replace
+type AutomationReplaceArgs struct {
+	Automations []Automation `json:"automations"`
+}
+
+type automationEvent struct {
+	fields map[string]interface{}
+	raw    json.RawMessage
+}
+
+var automations = struct {
+	mu      sync.Mutex
+	byName  map[string]*Automation
+	queue   chan automationEvent
+	window  time.Time // Start of the current firing-limit minute
+	firings int
+	dirty   bool // Run history changed since the last save
+
+	// running holds the names of the automations with a run going. It is kept by
+	// name so a run still counts after its automation was replaced
+	running map[string]bool
+}{byName: map[string]*Automation{}, queue: make(chan automationEvent, automationQueueSize), running: map[string]bool{}}
+
+func init() {
+	register("spotfi.automation", "set", setAutomation)
+	register("spotfi.automation", "replace", replaceAutomations)
+	register("spotfi.automation", "delete", deleteAutomation)
+	register("spotfi.automation", "list", listAutomations)
+	register("spotfi.automation", "run", runAutomationNow)
+}
+
+// prepareAutomation validates an automation and its actions
+func prepareAutomation(a *Automation) error {
+	if !scheduleNamePattern.MatchString(a.Name) {
+		return invalidArgs("invalid automation name: %q", a.Name)
+	}
+	if a.On == "" || a.On == "automation-run" || a.On == "automation-event" {
+		return invalidArgs("automation %s: on must name a local event type", a.Name)
+	}
+	for field, want := range a.When {
+		if field == "" {
+			return invalidArgs("automation %s: empty field in when", a.Name)
+		}
+		if _, err := path.Match(strings.TrimPrefix(want, "!"), ""); err != nil {
+			return invalidArgs("automation %s: invalid pattern for %s: %q", a.Name, field, want)
+		}
+	}
+	if len(a.Actions) == 0 || len(a.Actions) > maxAutomationActions {
+		return invalidArgs("automation %s: between 1 and %d actions are required", a.Name, maxAutomationActions)
+	}
+	for i := range a.Actions {
+		act := &a.Actions[i]
+		switch act.Type {
+		case ActionRPC:
+			if act.Path == "" || act.Method == "" {
+				return invalidArgs("automation %s: action %d: path and method are required", a.Name, i)
+			}
+			if !automatable(act.Path) {
+				return invalidArgs("automation %s: action %d: %s cannot be automated", a.Name, i, act.Path)
+			}
+			if err := checkActionObject(act.Args); err != nil {
+				return invalidArgs("automation %s: action %d: args %v", a.Name, i, err)
+			}
+		case ActionPublish:
+			if act.Event == "" {
+				return invalidArgs("automation %s: action %d: event is required", a.Name, i)
+			}
+			if err := checkActionObject(act.Data); err != nil {
+				return invalidArgs("automation %s: action %d: data %v", a.Name, i, err)
+			}
+		case ActionScript:
+			program, err := script.Compile(act.Script)
+			if err != nil {
+				return invalidArgs("automation %s: action %d: %v", a.Name, i, err)
+			}
+			act.program = program
+		default:
+			return invalidArgs("automation %s: action %d: unknown type %q", a.Name, i, act.Type)
+		}
+	}
+	if a.Cooldown < 0 || a.Cooldown > maxAutomationCooldown {
+		return invalidArgs("automation %s: cooldown must be between 0 and %d seconds", a.Name, maxAutomationCooldown)
+	}
+	if a.Timeout < 0 || a.Timeout > 60*60 {
+		return invalidArgs("automation %s: timeout must be between 0 and 3600 seconds", a.Name)
+	}
+	return nil
+}
+
+// automatable reports whether automations may call path. Jobs, schedules and
+// automations themselves are left out so automations cannot multiply
+func automatable(path string) bool {
+	switch path {
+	case "spotfi.job", "spotfi.schedule", "spotfi.automation":
+		return false
+	}
+	return true
+}
+
+func checkActionObject(raw json.RawMessage) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if len(raw) > options.MaxArgsSize {
+		return fmt.Errorf("exceed %d bytes", options.MaxArgsSize)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return fmt.Errorf("must be an object")
+	}
+	return nil
+}
+
+// installAutomationLocked replaces the automation with its name, keeping its
+// history; automations.mu must be held. A run still going finishes with the
+// actions it started with, and the replacement does not start until it has
+func installAutomationLocked(a *Automation, now time.Time) {
+	if old := automations.byName[a.Name]; old != nil {
+		a.Runs, a.LastRun = old.Runs, old.LastRun
+	}
+	a.UpdatedAt = now.Unix()
+	automations.byName[a.Name] = a
+}
+
+func setAutomation(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var a Automation
+	if err := decodeArgs(raw, &a); err != nil {
+		return nil, err
+	}
+	if err := prepareAutomation(&a); err != nil {
+		return nil, err
+	}
+	automations.mu.Lock()
+	defer automations.mu.Unlock()
+	if _, ok := automations.byName[a.Name]; !ok && len(automations.byName) >= maxAutomations {
+		return nil, invalidArgs("at most %d automations are allowed", maxAutomations)
+	}
+	installAutomationLocked(&a, time.Now())
+	if err := saveAutomationsLocked(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// replaceAutomations makes the given automations the complete set
+func replaceAutomations(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args AutomationReplaceArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if len(args.Automations) > maxAutomations {
+		return nil, invalidArgs("at most %d automations are allowed", maxAutomations)
+	}
+	seen := map[string]bool{}
+	for i := range args.Automations {
+		a := &args.Automations[i]
+		if err := prepareAutomation(a); err != nil {
+			return nil, err
+		}
+		if seen[a.Name] {
+			return nil, invalidArgs("duplicate automation name: %s", a.Name)
+		}
+		seen[a.Name] = true
+	}
+
+	now := time.Now()
+	automations.mu.Lock()
+	for name := range automations.byName {
+		if !seen[name] {
+			delete(automations.byName, name)
+		}
+	}
+	for i := range args.Automations {
+		installAutomationLocked(&args.Automations[i], now)
+	}
+	err := saveAutomationsLocked()
+	automations.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return listAutomations(ctx, nil)
+}
+
+func deleteAutomation(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args AutomationArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	automations.mu.Lock()
+	defer automations.mu.Unlock()
+	if _, ok := automations.byName[args.Name]; !ok {
+		return nil, Errorf(CodeNotFound, "automation not found: %s", args.Name)
+	}
+	delete(automations.byName, args.Name)
+	if err := saveAutomationsLocked(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"name": args.Name, "deleted": true}, nil
+}
+
+func listAutomations(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	automations.mu.Lock()
+	defer automations.mu.Unlock()
+	list := make([]Automation, 0, len(automations.byName))
+	for _, a := range automations.byName {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return map[string]interface{}{"automations": list}, nil
+}
+
+// runAutomationNow runs an automation on a sample event, e.g. to test it. The
+// event must match When, but the cooldown does not apply
+func runAutomationNow(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args AutomationRunArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	automations.mu.Lock()
+	a := automations.byName[args.Name]
+	automations.mu.Unlock()
+	if a == nil {
+		return nil, Errorf(CodeNotFound, "automation not found: %s", args.Name)
+	}
+	if args.Event == nil {
+		args.Event = map[string]interface{}{}
+	}
+	if _, ok := args.Event["type"]; !ok {
+		args.Event["type"] = a.On
+	}
+	if args.Event["type"] != a.On || !matchEvent(a.When, args.Event) {
+		return map[string]interface{}{"name": args.Name, "matched": false}, nil
+	}
+	trigger, _ := json.Marshal(args.Event)
+	if !startAutomation(a, automationEvent{fields: args.Event, raw: trigger}, true) {
+		return nil, Errorf(CodeUnavailable, "automation %s is still running", a.Name)
+	}
+	return map[string]interface{}{"name": args.Name, "matched": true, "started": true}, nil
+}
+
+// Notify hands a local event, such as a client, alert or failover event, to the
+// automations. It never blocks; events are dropped while the queue is full
+func Notify(ev interface{}) {
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return
+	}
+	select {
+	case automations.queue <- automationEvent{fields: fields, raw: raw}:
+	default:
+		logger.Warn("Automation queue full, dropping event", "type", fields["type"])
+	}
+}
+
+// StartAutomations loads the saved automations and runs them on the events passed
+// to Notify until the RPC context is cancelled. Call it after Configure
+func StartAutomations() {
+	loadAutomations()
+	go automationLoop(options.Context)
+}
+
+func loadAutomations() {
+	data, err := os.ReadFile(AutomationFile)
+	if err != nil {
+		return
+	}
+	var saved struct {
+		Automations []*Automation `json:"automations"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		logger.Error("Ignoring corrupt automation file", "file", AutomationFile, "error", err)
+		return
+	}
+
+	automations.mu.Lock()
+	defer automations.mu.Unlock()
+	for _, a := range saved.Automations {
+		if err := prepareAutomation(a); err != nil {
+			logger.Error("Ignoring invalid saved automation", "automation", a.Name, "error", err)
+			continue
+		}
+		automations.byName[a.Name] = a
+	}
+	logger.Info("Loaded automations", "automations", len(automations.byName))
+}
+
+func automationLoop(ctx context.Context) {
+	defer crash.Recover("automations")
+	ticker := time.NewTicker(automationSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			automations.mu.Lock()
+			if automations.dirty {
+				saveAutomationsLocked()
+			}
+			automations.mu.Unlock()
+			return
+		case ev := <-automations.queue:
+			dispatchEvent(ev, time.Now())
+		case <-ticker.C:
+			automations.mu.Lock()
+			if automations.dirty {
+				saveAutomationsLocked()
+			}
+			automations.mu.Unlock()
+		}
+	}
+}
+
+// dispatchEvent starts the automations matching ev that are not cooling down
+func dispatchEvent(ev automationEvent, now time.Time) {
+	evType, _ := ev.fields["type"].(string)
+	var matched []*Automation
+	automations.mu.Lock()
+	for _, a := range automations.byName {
+		if a.Disabled || a.On != evType || !matchEvent(a.When, ev.fields) {
+			continue
+		}
+		if a.Cooldown > 0 && now.Unix()-a.LastRun < int64(a.Cooldown) {
+			continue
+		}
+		matched = append(matched, a)
+	}
+	automations.mu.Unlock()
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Name < matched[j].Name })
+
+	for _, a := range matched {
+		if !allowFiring(now) {
+			logger.Warn("Automation firing limit reached, skipping", "automation", a.Name, "limit", maxAutomationFirings)
+			recordAutomationRun(a, AutomationRun{
+				Automation: a.Name, Trigger: ev.raw, StartedAt: now.Unix(), Status: "skipped",
+				Error: fmt.Sprintf("more than %d runs in a minute", maxAutomationFirings),
+			}, false)
+			continue
+		}
+		startAutomation(a, ev, false)
+	}
+}
+
+func allowFiring(now time.Time) bool {
+	automations.mu.Lock()
+	defer automations.mu.Unlock()
+	if now.Sub(automations.window) >= time.Minute {
+		automations.window, automations.firings = now, 0
+	}
+	if automations.firings >= maxAutomationFirings {
+		return false
+	}
+	automations.firings++
+	return true
+}
+
+// matchEvent reports whether the event's fields satisfy every condition of when
+func matchEvent(when map[string]string, fields map[string]interface{}) bool {
+	for field, want := range when {
+		value, ok := lookupField(fields, field)
+		if !matchValue(want, value, ok) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupField resolves a dotted field name in an event
+func lookupField(fields map[string]interface{}, name string) (interface{}, bool) {
+	var value interface{} = fields
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func matchValue(want string, value interface{}, present bool) bool {
+	for _, op := range []string{"<=", ">=", "<", ">"} {
+		if !strings.HasPrefix(want, op) {
+			continue
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSpace(want[len(op):]), 64)
+		if err != nil {
+			break // Not a comparison, matched as a pattern
+		}
+		n, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "<=":
+			return n <= limit
+		case ">=":
+			return n >= limit
+		case "<":
+			return n < limit
+		default:
+			return n > limit
+		}
+	}
+	if negated, ok := strings.CutPrefix(want, "!"); ok {
+		return !matchValue(negated, value, present)
+	}
+	if !present {
+		return false
+	}
+	matched, _ := path.Match(want, fieldString(value))
+	return matched
+}
+
+// expand substitutes the {{field}} references of an action's args or data
+func expand(raw json.RawMessage, fields map[string]interface{}) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(expandValue(v, fields))
+}
+
+func expandValue(v interface{}, fields map[string]interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if m := templatePattern.FindStringSubmatch(v); m != nil && m[0] == v {
+			value, _ := lookupField(fields, m[1])
+			return value
+		}
+		return templatePattern.ReplaceAllStringFunc(v, func(ref string) string {
+			value, _ := lookupField(fields, templatePattern.FindStringSubmatch(ref)[1])
+			return fieldString(value)
+		})
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = expandValue(item, fields)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = expandValue(item, fields)
+		}
+	}
+	return v
+}
+
+// startAutomation runs an automation's actions in the background, or records the
+// run as skipped while its previous run is still going
+func startAutomation(a *Automation, ev automationEvent, manual bool) bool {
+	now := time.Now()
+	automations.mu.Lock()
+	running := automations.running[a.Name]
+	if !running {
+		automations.running[a.Name], a.LastRun = true, now.Unix()
+	}
+	automations.mu.Unlock()
+	if running {
+		recordAutomationRun(a, AutomationRun{
+			Automation: a.Name, Trigger: ev.raw, Manual: manual, StartedAt: now.Unix(), Status: "skipped",
+			Error: "previous run still in progress",
+		}, false)
+		return false
+	}
+
+	timeout := defaultAutomationTimeout
+	if a.Timeout > 0 {
+		timeout = time.Duration(a.Timeout) * time.Second
+	}
+	logger.Info("Running automation", "automation", a.Name, "event", ev.fields["type"])
+	// Drain waits for the run to be recorded at shutdown
+	inFlight.Add(1)
+	go func() {
+		defer inFlight.Done()
+		defer crash.Catch("automation " + a.Name)
+		ctx, cancel := context.WithTimeout(options.Context, timeout)
+		defer cancel()
+		run := AutomationRun{Automation: a.Name, Trigger: ev.raw, Manual: manual, StartedAt: now.Unix(), Status: JobSucceeded}
+		for i, act := range a.Actions {
+			jobIDs, err := runAction(ctx, a, act, ev)
+			run.JobIDs = append(run.JobIDs, jobIDs...)
+			if err == nil {
+				continue
+			}
+			logger.Warn("Automation action failed", "automation", a.Name, "action", i, "error", err)
+			if act.ContinueOnError {
+				continue
+			}
+			run.Status = JobFailed
+			run.Error = fmt.Sprintf("action %d: %v", i, err)
+			var rpcErr *Error
+			if errors.As(err, &rpcErr) {
+				run.CodeName = codeNames[rpcErr.Code]
+			}
+			break
+		}
+		recordAutomationRun(a, run, true)
+	}()
+	return true
+}
+
+// runAction performs one action and returns the IDs of the jobs it ran; rpc
+// actions run as jobs so their progress and result are reported like any other
+func runAction(ctx context.Context, a *Automation, act AutomationAction, ev automationEvent) ([]string, error) {
+	switch act.Type {
+	case ActionPublish:
+		data, err := expand(act.Data, ev.fields)
+		if err != nil {
+			return nil, err
+		}
+		return nil, publishAutomationEvent(a, act.Event, data, ev)
+	case ActionScript:
+		return runScript(ctx, a, act.program, ev)
+	}
+
+	args, err := expand(act.Args, ev.fields)
+	if err != nil {
+		return nil, err
+	}
+	job, err := runAutomationJob(ctx, act.Path, act.Method, args)
+	if job == nil {
+		return nil, err
+	}
+	return []string{job.ID}, err
+}
+
+func publishAutomationEvent(a *Automation, event string, data json.RawMessage, ev automationEvent) error {
+	if options.PublishAutomation == nil {
+		return Errorf(CodeUnavailable, "publishing is not configured")
+	}
+	return options.PublishAutomation(map[string]interface{}{
+		"type":       "automation-event",
+		"automation": a.Name,
+		"event":      event,
+		"data":       data,
+		"trigger":    ev.raw,
+		"ts":         time.Now().Unix(),
+	})
+}
+
+// runAutomationJob runs an operation for an automation as a job and waits for
+// it. The job is nil if it could not be started
+func runAutomationJob(ctx context.Context, path, method string, args json.RawMessage) (*Job, error) {
+	// Automations share the rate limit of the requests they act as, under their own source
+	if ok, wait := allow(automationSource, false); !ok {
+		rpcCounters.throttledRate.Add(1)
+		return nil, Errorf(CodeThrottled, "throttled: rate limit exceeded, retry in %v", wait.Round(time.Millisecond))
+	}
+	job, jobCtx, err := newJob(path, method)
+	if err != nil {
+		return nil, err
+	}
+	// The job stops with the run's timeout as well as on an explicit cancel
+	stop := context.AfterFunc(ctx, job.cancel)
+	defer stop()
+	inFlight.Add(1)
+	runJob(jobCtx, job, RPCRequest{ID: job.ID, Path: path, Method: method, Args: args})
+
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	if job.State == JobSucceeded {
+		return job, nil
+	}
+	if job.Result == nil {
+		return job, Errorf(CodeTimeout, "job %s", job.State)
+	}
+	return job, &Error{Code: job.Result.Code, Message: job.Result.Error}
+}
+
+// runScript runs a script action. Scripts see the event as the global event and
+// reach the router only through the rpc, publish and metric builtins; their run
+// ends with the automation's timeout or after script.DefaultMaxSteps steps
+func runScript(ctx context.Context, a *Automation, program *script.Program, ev automationEvent) ([]string, error) {
+	var jobIDs []string
+	rpcCall := &script.Builtin{Name: "rpc", Fn: func(ctx context.Context, args []script.Value, kwargs map[string]script.Value) (script.Value, error) {
+		params, err := script.Bind("rpc", args, kwargs, "path", "method", "args?")
+		if err != nil {
+			return nil, err
+		}
+		path, ok1 := params[0].(string)
+		method, ok2 := params[1].(string)
+		if !ok1 || !ok2 || path == "" || method == "" {
+			return nil, fmt.Errorf("rpc: path and method must be strings")
+		}
+		if !automatable(path) {
+			return nil, fmt.Errorf("rpc: %s cannot be automated", path)
+		}
+		var raw json.RawMessage
+		if params[2] != nil {
+			if _, ok := params[2].(*script.Dict); !ok {
+				return nil, fmt.Errorf("rpc: args must be a dict")
+			}
+			if raw, err = scriptJSON(params[2]); err != nil {
+				return nil, fmt.Errorf("rpc: args: %v", err)
+			}
+		}
+		job, err := runAutomationJob(ctx, path, method, raw)
+		if job != nil {
+			jobIDs = append(jobIDs, job.ID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if job.Result == nil {
+			return nil, nil
+		}
+		// Round-trip the result so the script only sees plain JSON values
+		var result interface{}
+		if data, err := json.Marshal(job.Result.Result); err == nil {
+			json.Unmarshal(data, &result)
+		}
+		return script.FromJSON(result), nil
+	}}
+	publish := &script.Builtin{Name: "publish", Fn: func(ctx context.Context, args []script.Value, kwargs map[string]script.Value) (script.Value, error) {
+		params, err := script.Bind("publish", args, kwargs, "event", "data?")
+		if err != nil {
+			return nil, err
+		}
+		event, ok := params[0].(string)
+		if !ok || event == "" {
+			return nil, fmt.Errorf("publish: event must be a non-empty string")
+		}
+		var data json.RawMessage
+		if params[1] != nil {
+			if data, err = scriptJSON(params[1]); err != nil {
+				return nil, fmt.Errorf("publish: data: %v", err)
+			}
+		}
+		return nil, publishAutomationEvent(a, event, data, ev)
+	}}
+	metric := &script.Builtin{Name: "metric", Fn: func(ctx context.Context, args []script.Value, kwargs map[string]script.Value) (script.Value, error) {
+		params, err := script.Bind("metric", args, kwargs, "name")
+		if err != nil {
+			return nil, err
+		}
+		name, _ := params[0].(string)
+		if !alerts.IsMetric(name) {
+			return nil, fmt.Errorf("metric: unknown metric %q", name)
+		}
+		if options.LatestMetrics == nil {
+			return nil, nil
+		}
+		if value, ok := alerts.Value(options.LatestMetrics(), name); ok {
+			return value, nil
+		}
+		return nil, nil
+	}}
+
+	err := program.Run(ctx, script.Env{
+		Globals: map[string]script.Value{
+			"event":      script.FromJSON(ev.fields),
+			"automation": a.Name,
+		},
+		Builtins: []*script.Builtin{rpcCall, publish, metric},
+		Print: func(msg string) {
+			logger.Info("Automation script", "automation", a.Name, "message", msg)
+		},
+	})
+	if err != nil && ctx.Err() != nil {
+		return jobIDs, Errorf(CodeTimeout, "script: %v", err)
+	}
+	return jobIDs, err
+}
+
+// scriptJSON encodes a script value as JSON of at most options.MaxArgsSize bytes
+func scriptJSON(v script.Value) (json.RawMessage, error) {
+	converted, err := script.ToJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(converted)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > options.MaxArgsSize {
+		return nil, fmt.Errorf("exceeds %d bytes", options.MaxArgsSize)
+	}
+	return data, nil
+}
+
+// recordAutomationRun keeps a run in the automation's history and reports it.
+// The history is saved with the next automationSaveInterval tick, or right away
+// once the bridge is shutting down
+func recordAutomationRun(a *Automation, run AutomationRun, finished bool) {
+	run.Type = "automation-run"
+	run.FinishedAt = time.Now().Unix()
+	automations.mu.Lock()
+	if finished {
+		delete(automations.running, a.Name)
+	}
+	// The history moves on to the automation's replacement if it was set meanwhile
+	if current := automations.byName[a.Name]; current != nil {
+		a = current
+	}
+	a.Runs = append([]AutomationRun{run}, a.Runs...)
+	if len(a.Runs) > maxAutomationRuns {
+		a.Runs = a.Runs[:maxAutomationRuns]
+	}
+	automations.dirty = true
+	if options.Context.Err() != nil {
+		saveAutomationsLocked()
+	}
+	automations.mu.Unlock()
+
+	if options.PublishAutomation != nil && (options.Connected == nil || options.Connected()) {
+		if err := options.PublishAutomation(run); err != nil {
+			logger.Warn("Automation run report not published", "automation", a.Name, "error", err)
+		}
+	}
+}
+
+// saveAutomationsLocked writes AutomationFile; automations.mu must be held
+func saveAutomationsLocked() error {
+	list := make([]*Automation, 0, len(automations.byName))
+	for _, a := range automations.byName {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.Marshal(map[string]interface{}{"automations": list})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(AutomationFile), 0755)
+	}
+	if err == nil {
+		tmp := AutomationFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, AutomationFile)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save automations", "error", err)
+		return Errorf(CodeInternal, "failed to save automations: %v", err)
+	}
+	automations.dirty = false
+	return nil
+}
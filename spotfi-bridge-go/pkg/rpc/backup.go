@@ -0,0 +1,214 @@
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupChunkSize = 48 * 1024
+	backupDir       = "/tmp"
+	maxBackupSize   = 16 * 1024 * 1024
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// uploads tracks the next chunk each upload expects; the lock also keeps two
+// chunks from being appended at the same time
+var uploads = struct {
+	mu   sync.Mutex
+	next map[string]int // By upload ID
+}{next: map[string]int{}}
+
+// UploadArgs are the arguments of spotfi.backup/upload (one call per chunk)
+type UploadArgs struct {
+	UploadID string `json:"uploadId"`
+	Seq      int    `json:"seq"`  // 0-based, must arrive in order
+	Data     string `json:"data"` // base64
+}
+
+// RestoreArgs are the arguments of spotfi.backup/restore
+type RestoreArgs struct {
+	UploadID string `json:"uploadId"`
+	SHA256   string `json:"sha256"`
+	Reboot   bool   `json:"reboot"`
+	Delay    int    `json:"delay"` // Seconds before the automatic reboot
+}
+
+func init() {
+	registerStream("spotfi.backup", "create", createBackup)
+	register("spotfi.backup", "upload", uploadBackup)
+	register("spotfi.backup", "restore", restoreBackup)
+}
+
+// createBackup runs "sysupgrade -b" and streams the archive back as
+// sequence-numbered "rpc-chunk" messages before the final result
+func createBackup(ctx context.Context, raw json.RawMessage, emit func(map[string]interface{}) error) (interface{}, error) {
+	path := fmt.Sprintf("%s/spotfi-backup-%d.tar.gz", backupDir, time.Now().UnixNano())
+	defer os.Remove(path)
+
+	if out, err := exec.CommandContext(ctx, "sysupgrade", "-b", path).CombinedOutput(); err != nil {
+		return map[string]interface{}{"output": strings.TrimSpace(string(out))}, fmt.Errorf("sysupgrade -b failed: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	buf := make([]byte, backupChunkSize)
+	seq := 0
+	size := 0
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			size += n
+			if err := emit(map[string]interface{}{
+				"type": "rpc-chunk",
+				"seq":  seq,
+				"data": base64.StdEncoding.EncodeToString(buf[:n]),
+			}); err != nil {
+				return nil, fmt.Errorf("failed to send chunk %d: %w", seq, err)
+			}
+			seq++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]interface{}{
+		"chunks": seq,
+		"size":   size,
+		"sha256": hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+func uploadPath(id string) string {
+	return fmt.Sprintf("%s/spotfi-restore-%s.tar.gz", backupDir, id)
+}
+
+// uploadBackup appends one chunk of a backup archive to be restored later
+func uploadBackup(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args UploadArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if !uploadIDPattern.MatchString(args.UploadID) {
+		return nil, invalidArgs("invalid uploadId")
+	}
+	data, err := base64.StdEncoding.DecodeString(args.Data)
+	if err != nil {
+		return nil, invalidArgs("invalid chunk data: %v", err)
+	}
+
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+	path := uploadPath(args.UploadID)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if args.Seq == 0 {
+		// Chunk 0 starts the upload over
+		flags |= os.O_TRUNC
+	} else if next, ok := uploads.next[args.UploadID]; !ok {
+		return nil, invalidArgs("chunk %d received before chunk 0, expected seq 0", args.Seq)
+	} else if args.Seq != next {
+		return nil, invalidArgs("chunk %d out of order, expected seq %d", args.Seq, next)
+	}
+
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size() + int64(len(data))
+	if size > maxBackupSize {
+		os.Remove(path)
+		delete(uploads.next, args.UploadID)
+		return nil, invalidArgs("backup exceeds %d bytes", maxBackupSize)
+	}
+	if _, err := f.Write(data); err != nil {
+		// The chunk may be partly written, so the upload has to start over
+		os.Remove(path)
+		delete(uploads.next, args.UploadID)
+		return nil, err
+	}
+	uploads.next[args.UploadID] = args.Seq + 1
+
+	return map[string]interface{}{
+		"uploadId": args.UploadID,
+		"seq":      args.Seq,
+		"size":     size,
+	}, nil
+}
+
+// restoreBackup verifies an uploaded archive and applies it with "sysupgrade -r"
+func restoreBackup(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args RestoreArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if !uploadIDPattern.MatchString(args.UploadID) {
+		return nil, invalidArgs("invalid uploadId")
+	}
+	if args.SHA256 == "" {
+		return nil, invalidArgs("sha256 is required")
+	}
+
+	path := uploadPath(args.UploadID)
+	defer os.Remove(path)
+	uploads.mu.Lock()
+	delete(uploads.next, args.UploadID)
+	uploads.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "upload not found: %s", args.UploadID)
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, args.SHA256) {
+		return map[string]interface{}{"sha256": actual}, invalidArgs("checksum mismatch")
+	}
+
+	if out, err := exec.CommandContext(ctx, "sysupgrade", "-r", path).CombinedOutput(); err != nil {
+		return map[string]interface{}{"output": strings.TrimSpace(string(out))}, fmt.Errorf("sysupgrade -r failed: %w", err)
+	}
+
+	result := map[string]interface{}{
+		"restored": true,
+		"size":     len(data),
+	}
+	if args.Reboot {
+		delay := time.Duration(args.Delay) * time.Second
+		if delay <= 0 {
+			delay = 5 * time.Second // Leave time for the response to be published
+		}
+		record, err := scheduleReboot(delay, "config restore "+args.UploadID)
+		if err != nil {
+			return result, err
+		}
+		result["rebootAt"] = record.RebootAt
+	}
+	return result, nil
+}
@@ -0,0 +1,96 @@
+package rpc
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCachePolicy lists read-only calls whose results may be served from
+// cache, keyed by "path:method", with their time-to-live
+var DefaultCachePolicy = map[string]time.Duration{
+	"system:board":            10 * time.Minute,
+	"system:info":             5 * time.Second,
+	"iwinfo:devices":          1 * time.Minute,
+	"iwinfo:info":             10 * time.Second,
+	"iwinfo:scan":             30 * time.Second,
+	"network.interface:dump":  5 * time.Second,
+	"network.device:status":   5 * time.Second,
+	"spotfi.wireguard:status": 5 * time.Second,
+	"spotfi.ubus:list":        1 * time.Minute,
+}
+
+const maxCacheEntries = 128
+
+type cacheEntry struct {
+	response *Response
+	expires  time.Time
+}
+
+var resultCache = struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}{entries: map[string]cacheEntry{}}
+
+// ParseCachePolicy parses "path:method=ttl" pairs, e.g. "system:board=10m,iwinfo:scan=30s"
+func ParseCachePolicy(entries []string) map[string]time.Duration {
+	policy := map[string]time.Duration{}
+	for _, entry := range entries {
+		call, ttl, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		if d, err := time.ParseDuration(ttl); err == nil {
+			policy[call] = d
+		}
+	}
+	return policy
+}
+
+func cacheTTL(req RPCRequest) time.Duration {
+	return options.CachePolicy[req.Path+":"+req.Method]
+}
+
+func cacheKey(req RPCRequest) string {
+	return req.Path + ":" + req.Method + ":" + string(req.Args)
+}
+
+// cachedResult returns a fresh cached response for a read-only call
+func cachedResult(req RPCRequest) (*Response, bool) {
+	if req.NoCache || req.target != "" || cacheTTL(req) <= 0 {
+		return nil, false
+	}
+
+	resultCache.mu.Lock()
+	defer resultCache.mu.Unlock()
+	entry, ok := resultCache.entries[cacheKey(req)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	resp := *entry.response
+	resp.ID = req.ID
+	resp.Cached = true
+	return &resp, true
+}
+
+// storeResult caches successful responses of read-only calls
+func storeResult(req RPCRequest, resp *Response) {
+	ttl := cacheTTL(req)
+	if ttl <= 0 || resp.Status != "success" {
+		return
+	}
+
+	resultCache.mu.Lock()
+	defer resultCache.mu.Unlock()
+	now := time.Now()
+	if len(resultCache.entries) >= maxCacheEntries {
+		for key, entry := range resultCache.entries {
+			if now.After(entry.expires) {
+				delete(resultCache.entries, key)
+			}
+		}
+	}
+	if len(resultCache.entries) < maxCacheEntries {
+		resultCache.entries[cacheKey(req)] = cacheEntry{response: resp, expires: now.Add(ttl)}
+	}
+}
@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// ResponseChunk carries one slice of a response that exceeded MaxPayloadSize.
+// The API concatenates the decoded data of seq 0..chunks-1 and parses the
+// result as a regular Response.
+type ResponseChunk struct {
+	Type   string `json:"type"`   // Always "rpc-result-chunk"
+	ID     string `json:"id"`     // Request ID
+	Seq    int    `json:"seq"`    // 0-based chunk index
+	Chunks int    `json:"chunks"` // Total number of chunks
+	Size   int    `json:"size"`   // Total size of the encoded response in bytes
+	Final  bool   `json:"final"`  // Set on the last chunk
+	Data   string `json:"data"`   // base64 slice of the JSON-encoded response
+}
+
+// chunkDataSize returns how many bytes of a size-byte response fit in one
+// chunk of at most limit bytes, or <= 0 if not even an empty chunk fits. The
+// envelope is measured with the widest seq and chunks values possible
+func chunkDataSize(id string, size, limit int) int {
+	envelope, _ := json.Marshal(ResponseChunk{
+		Type:   "rpc-result-chunk",
+		ID:     id,
+		Seq:    size,
+		Chunks: size,
+		Size:   size,
+	})
+	// base64 turns every 3 bytes into 4, so whole groups of 4 stay under the limit
+	return (limit - len(envelope)) / 4 * 3
+}
+
+// sendResponse publishes a response, splitting it into chunks when its
+// encoded size exceeds the configured payload limit
+func sendResponse(resp *Response, sendFunc func(interface{}) error) {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("Failed to encode response", "id", resp.ID, "error", err)
+		payload, _ = json.Marshal(newResponse(resp.ID, nil, Errorf(CodeInternal, "failed to encode response: %v", err)))
+	}
+
+	chunkSize := chunkDataSize(resp.ID, len(payload), options.MaxPayloadSize)
+	if len(payload) <= options.MaxPayloadSize || chunkSize <= 0 {
+		if err := sendFunc(json.RawMessage(payload)); err != nil {
+			logger.Error("Failed to publish response", "id", resp.ID, "error", err)
+		}
+		return
+	}
+
+	chunks := (len(payload) + chunkSize - 1) / chunkSize
+	for seq := 0; seq < chunks; seq++ {
+		start := seq * chunkSize
+		end := start + chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk := ResponseChunk{
+			Type:   "rpc-result-chunk",
+			ID:     resp.ID,
+			Seq:    seq,
+			Chunks: chunks,
+			Size:   len(payload),
+			Final:  seq == chunks-1,
+			Data:   base64.StdEncoding.EncodeToString(payload[start:end]),
+		}
+		if err := sendFunc(chunk); err != nil {
+			logger.Error("Failed to publish response chunk", "id", resp.ID, "chunk", seq+1, "chunks", chunks, "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSendResponseChunks(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      int
+		resultSize int
+		id         string
+		chunked    bool
+	}{
+		{"fits", 1024, 100, "1", false},
+		{"just over", 1024, 1024, "1", true},
+		{"many chunks", 512, 20000, "1", true},
+		{"long id", 512, 5000, strings.Repeat("x", 200), true},
+		{"limit below envelope", 64, 5000, "1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOptions(t, Options{MaxPayloadSize: tt.limit})
+			resp := newResponse(tt.id, map[string]interface{}{"data": strings.Repeat("a", tt.resultSize)}, nil)
+			want, _ := json.Marshal(resp)
+
+			var sent [][]byte
+			sendResponse(resp, func(v interface{}) error {
+				b, err := json.Marshal(v)
+				sent = append(sent, b)
+				return err
+			})
+
+			if !tt.chunked {
+				if len(sent) != 1 || !bytes.Equal(sent[0], want) {
+					t.Fatalf("sent %d messages, want the response unchunked", len(sent))
+				}
+				return
+			}
+			if len(sent) < 2 {
+				t.Fatalf("sent %d messages, want chunks", len(sent))
+			}
+			var data []byte
+			for i, msg := range sent {
+				if len(msg) > tt.limit {
+					t.Errorf("chunk %d is %d bytes, over the %d byte limit", i, len(msg), tt.limit)
+				}
+				var c ResponseChunk
+				if err := json.Unmarshal(msg, &c); err != nil {
+					t.Fatal(err)
+				}
+				if c.ID != tt.id || c.Seq != i || c.Chunks != len(sent) || c.Size != len(want) || c.Final != (i == len(sent)-1) {
+					t.Errorf("chunk %d header = %+v", i, c)
+				}
+				part, err := base64.StdEncoding.DecodeString(c.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data = append(data, part...)
+			}
+			if !bytes.Equal(data, want) {
+				t.Error("reassembled chunks differ from the response")
+			}
+		})
+	}
+}
+
+func TestChunkDataSize(t *testing.T) {
+	for _, limit := range []int{140, 141, 142, 143, 1000, 256 * 1024} {
+		n := chunkDataSize("id", 1<<20, limit)
+		if n <= 0 || n%3 != 0 {
+			t.Errorf("limit %d: data size %d, want a positive multiple of 3", limit, n)
+			continue
+		}
+		chunk, _ := json.Marshal(ResponseChunk{
+			Type: "rpc-result-chunk", ID: "id", Seq: 1 << 20, Chunks: 1 << 20, Size: 1 << 20,
+			Data: base64.StdEncoding.EncodeToString(make([]byte, n)),
+		})
+		if len(chunk) > limit {
+			t.Errorf("limit %d: a full chunk is %d bytes", limit, len(chunk))
+		}
+	}
+	if n := chunkDataSize("id", 1<<20, 10); n > 0 {
+		t.Errorf("limit below the envelope gave data size %d", n)
+	}
+}
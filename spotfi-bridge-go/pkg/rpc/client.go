@@ -0,0 +1,270 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"spotfi-bridge/pkg/ubus"
+	"spotfi-bridge/pkg/uci"
+)
+
+// KickArgs are the arguments of spotfi.client/kick
+type KickArgs struct {
+	Mac     string `json:"mac"`
+	Reason  int    `json:"reason"`  // IEEE 802.11 reason code, defaults to 5 (AP busy)
+	BanTime int    `json:"banTime"` // Milliseconds hostapd refuses re-association
+	Block   string `json:"block"`   // "", "maclist" or "firewall"
+}
+
+func init() {
+	register("spotfi.client", "kick", kickClient)
+	register("spotfi.client", "unblock", unblockClient)
+}
+
+// normalizeMAC validates a MAC address and returns it in lowercase colon form
+func normalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil || len(hw) != 6 {
+		return "", invalidArgs("invalid MAC address: %q", mac)
+	}
+	return hw.String(), nil
+}
+
+// hostapdInterfaces returns the hostapd ubus objects (one per AP interface)
+func hostapdInterfaces() ([]string, error) {
+	return ubus.List("hostapd.*")
+}
+
+// stationInterfaces returns the hostapd objects the station is associated with
+func stationInterfaces(mac string) []string {
+	ifaces, _ := hostapdInterfaces()
+	var found []string
+	for _, obj := range ifaces {
+		res, err := ubus.Call(obj, "get_clients", nil)
+		if err != nil {
+			continue
+		}
+		if clients, ok := res["clients"].(map[string]interface{}); ok {
+			if _, ok := clients[mac]; ok {
+				found = append(found, obj)
+			}
+		}
+	}
+	return found
+}
+
+func kickClient(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args KickArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	mac, err := normalizeMAC(args.Mac)
+	if err != nil {
+		return nil, err
+	}
+	if args.Reason == 0 {
+		args.Reason = 5
+	}
+
+	associated := stationInterfaces(mac)
+	for _, obj := range associated {
+		_, err := ubus.Call(obj, "del_client", map[string]interface{}{
+			"addr":     mac,
+			"reason":   args.Reason,
+			"deauth":   true,
+			"ban_time": args.BanTime,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := map[string]interface{}{
+		"mac":        mac,
+		"interfaces": associated,
+	}
+
+	switch args.Block {
+	case "":
+	case "maclist":
+		if err := blockMaclist(mac); err != nil {
+			return result, err
+		}
+		result["blocked"] = "maclist"
+	case "firewall":
+		if err := blockFirewall(mac); err != nil {
+			return result, err
+		}
+		result["blocked"] = "firewall"
+	default:
+		return result, invalidArgs("unknown block mode: %q", args.Block)
+	}
+
+	// Give hostapd a moment to tear the association down before verifying
+	if len(associated) > 0 {
+		time.Sleep(1 * time.Second)
+	}
+	result["wasConnected"] = len(associated) > 0
+	result["disconnected"] = len(stationInterfaces(mac)) == 0
+	return result, nil
+}
+
+func unblockClient(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args KickArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	mac, err := normalizeMAC(args.Mac)
+	if err != nil {
+		return nil, err
+	}
+
+	uci.Lock()
+	defer uci.Unlock()
+	ifaces, err := uci.SectionsOfType("wireless", "wifi-iface")
+	if err != nil {
+		return nil, err
+	}
+	wirelessChanged := false
+	for _, s := range ifaces {
+		for _, m := range s.Options["maclist"] {
+			if !strings.EqualFold(m, mac) {
+				continue
+			}
+			if err := uci.DelList("wireless."+s.Name+".maclist", m); err != nil {
+				uci.Revert("wireless")
+				return nil, err
+			}
+			wirelessChanged = true
+		}
+	}
+
+	rules, err := uci.SectionsOfType("firewall", "rule")
+	if err != nil {
+		uci.Revert("wireless")
+		return nil, err
+	}
+	firewallChanged := false
+	for _, r := range rules {
+		if r.Option("name") != blockRuleName(mac) {
+			continue
+		}
+		if err := uci.Delete("firewall." + r.Name); err != nil {
+			uci.Revert("wireless")
+			uci.Revert("firewall")
+			return nil, err
+		}
+		firewallChanged = true
+	}
+
+	// Only the configs that held the MAC are committed and reloaded, so an
+	// unblock of a client that was never blocked does not restart the radios
+	if wirelessChanged {
+		if err := uci.Commit("wireless"); err != nil {
+			uci.Revert("firewall")
+			return nil, err
+		}
+	}
+	if firewallChanged {
+		if err := uci.Commit("firewall"); err != nil {
+			return nil, err
+		}
+	}
+	var errs []error
+	if wirelessChanged {
+		if out, err := exec.CommandContext(ctx, "wifi", "reload").CombinedOutput(); err != nil {
+			errs = append(errs, Errorf(CodeExecError, "wifi reload failed: %s", strings.TrimSpace(string(out))))
+		}
+	}
+	if firewallChanged {
+		if err := reloadFirewall(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"mac": mac, "unblocked": true}, nil
+}
+
+// blockMaclist denies the MAC on every wifi-iface via the hostapd MAC filter
+func blockMaclist(mac string) error {
+	uci.Lock()
+	defer uci.Unlock()
+	ifaces, err := uci.SectionsOfType("wireless", "wifi-iface")
+	if err != nil {
+		return err
+	}
+	for _, s := range ifaces {
+		// An existing allow-list must not be turned into a deny-list
+		if s.Option("macfilter") == "allow" {
+			continue
+		}
+		listed := false
+		for _, m := range s.Options["maclist"] {
+			if strings.EqualFold(m, mac) {
+				listed = true
+			}
+		}
+		if !listed {
+			if err := uci.AddList("wireless."+s.Name+".maclist", mac); err != nil {
+				uci.Revert("wireless")
+				return err
+			}
+		}
+		if err := uci.Set("wireless."+s.Name+".macfilter", "deny"); err != nil {
+			uci.Revert("wireless")
+			return err
+		}
+	}
+	if err := uci.Commit("wireless"); err != nil {
+		return err
+	}
+	return exec.Command("wifi", "reload").Run()
+}
+
+// blockFirewall adds a fw4 rule dropping all forwarded traffic from the MAC
+func blockFirewall(mac string) error {
+	uci.Lock()
+	defer uci.Unlock()
+	rules, err := uci.SectionsOfType("firewall", "rule")
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if r.Option("name") == blockRuleName(mac) {
+			return nil // Already blocked
+		}
+	}
+
+	name, err := uci.Add("firewall", "rule")
+	if err != nil {
+		return err
+	}
+	section := "firewall." + name
+	for opt, val := range map[string]string{
+		"name":    blockRuleName(mac),
+		"src":     "*",
+		"dest":    "*",
+		"src_mac": mac,
+		"target":  "REJECT",
+	} {
+		if err := uci.Set(section+"."+opt, val); err != nil {
+			uci.Revert("firewall")
+			return err
+		}
+	}
+	if err := uci.Commit("firewall"); err != nil {
+		return err
+	}
+	return exec.Command("/etc/init.d/firewall", "reload").Run()
+}
+
+func blockRuleName(mac string) string {
+	return "spotfi-block-" + strings.ReplaceAll(mac, ":", "")
+}
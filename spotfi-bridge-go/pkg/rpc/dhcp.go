@@ -0,0 +1,299 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"spotfi-bridge/pkg/uci"
+)
+
+const defaultLeaseFile = "/tmp/dhcp.leases"
+
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// Lease is one entry of the dnsmasq lease table
+type Lease struct {
+	Expires  int64  `json:"expires"` // Unix time, 0 for infinite
+	Mac      string `json:"mac"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname,omitempty"`
+	ClientID string `json:"clientId,omitempty"`
+}
+
+// StaticLease is a dhcp "host" section
+type StaticLease struct {
+	Section string `json:"section"`
+	Name    string `json:"name,omitempty"`
+	Mac     string `json:"mac"`
+	IP      string `json:"ip,omitempty"`
+}
+
+// StaticLeaseArgs are the arguments of spotfi.dhcp/add_static and remove_static
+type StaticLeaseArgs struct {
+	Mac  string `json:"mac"`
+	IP   string `json:"ip"`
+	Name string `json:"name"` // Hostname handed out to the client
+}
+
+// HostnameArgs are the arguments of spotfi.dhcp/set_hostname (a DNS override)
+type HostnameArgs struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"` // Empty removes the override
+}
+
+func init() {
+	register("spotfi.dhcp", "leases", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return dhcpState()
+	})
+	register("spotfi.dhcp", "add_static", addStaticLease)
+	register("spotfi.dhcp", "remove_static", removeStaticLease)
+	register("spotfi.dhcp", "set_hostname", setHostname)
+}
+
+func leaseFile() string {
+	if f, err := uci.Get("dhcp.@dnsmasq[0].leasefile"); err == nil && f != "" {
+		return f
+	}
+	return defaultLeaseFile
+}
+
+// readLeases parses the dnsmasq lease file ("expiry mac ip hostname clientid")
+func readLeases() ([]Lease, error) {
+	f, err := os.Open(leaseFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Lease{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	leases := []Lease{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		expires, _ := strconv.ParseInt(fields[0], 10, 64)
+		lease := Lease{Expires: expires, Mac: fields[1], IP: fields[2]}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		if len(fields) > 4 && fields[4] != "*" {
+			lease.ClientID = fields[4]
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+func staticLeases() ([]StaticLease, error) {
+	hosts, err := uci.SectionsOfType("dhcp", "host")
+	if err != nil {
+		return nil, err
+	}
+	list := []StaticLease{}
+	for _, h := range hosts {
+		list = append(list, StaticLease{
+			Section: h.Name,
+			Name:    h.Option("name"),
+			Mac:     strings.ToLower(h.Option("mac")),
+			IP:      h.Option("ip"),
+		})
+	}
+	return list, nil
+}
+
+func hostnameOverrides() ([]map[string]string, error) {
+	domains, err := uci.SectionsOfType("dhcp", "domain")
+	if err != nil {
+		return nil, err
+	}
+	list := []map[string]string{}
+	for _, d := range domains {
+		list = append(list, map[string]string{
+			"section": d.Name,
+			"name":    d.Option("name"),
+			"ip":      d.Option("ip"),
+		})
+	}
+	return list, nil
+}
+
+// dhcpState returns leases, static leases and hostname overrides
+func dhcpState() (interface{}, error) {
+	leases, err := readLeases()
+	if err != nil {
+		return nil, err
+	}
+	static, err := staticLeases()
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := hostnameOverrides()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"leases":    leases,
+		"static":    static,
+		"hostnames": overrides,
+	}, nil
+}
+
+// commitDHCP commits the staged dhcp changes and reloads dnsmasq; the caller holds the uci lock
+func commitDHCP(ctx context.Context) error {
+	if err := uci.Commit("dhcp"); err != nil {
+		uci.Revert("dhcp")
+		return err
+	}
+	if out, err := exec.CommandContext(ctx, "/etc/init.d/dnsmasq", "reload").CombinedOutput(); err != nil {
+		return Errorf(CodeExecError, "dnsmasq reload failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func addStaticLease(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args StaticLeaseArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	mac, err := normalizeMAC(args.Mac)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(args.IP); ip == nil || ip.To4() == nil {
+		return nil, invalidArgs("invalid IPv4 address: %q", args.IP)
+	}
+	if args.Name != "" && !hostnamePattern.MatchString(args.Name) {
+		return nil, invalidArgs("invalid hostname: %q", args.Name)
+	}
+
+	uci.Lock()
+	defer uci.Unlock()
+	existing, err := staticLeases()
+	if err != nil {
+		return nil, err
+	}
+	section := ""
+	for _, s := range existing {
+		if s.IP == args.IP && s.Mac != mac {
+			return nil, invalidArgs("%s is already reserved for %s", args.IP, s.Mac)
+		}
+		if s.Mac == mac {
+			section = s.Section // Update the existing reservation
+		}
+	}
+	if section == "" {
+		if section, err = uci.Add("dhcp", "host"); err != nil {
+			return nil, err
+		}
+	}
+
+	base := "dhcp." + section
+	for _, opt := range [][2]string{{"mac", mac}, {"ip", args.IP}, {"name", args.Name}} {
+		if opt[1] == "" {
+			uci.Delete(base + "." + opt[0])
+			continue
+		}
+		if err := uci.Set(base+"."+opt[0], opt[1]); err != nil {
+			uci.Revert("dhcp")
+			return nil, err
+		}
+	}
+	if err := commitDHCP(ctx); err != nil {
+		return nil, err
+	}
+	return dhcpState()
+}
+
+func removeStaticLease(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args StaticLeaseArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	mac, err := normalizeMAC(args.Mac)
+	if err != nil {
+		return nil, err
+	}
+
+	uci.Lock()
+	defer uci.Unlock()
+	existing, err := staticLeases()
+	if err != nil {
+		return nil, err
+	}
+	removed := false
+	for _, s := range existing {
+		if s.Mac == mac {
+			uci.Delete("dhcp." + s.Section)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil, Errorf(CodeNotFound, "no static lease for %s", mac)
+	}
+	if err := commitDHCP(ctx); err != nil {
+		return nil, err
+	}
+	return dhcpState()
+}
+
+func setHostname(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args HostnameArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if !hostnamePattern.MatchString(args.Name) {
+		return nil, invalidArgs("invalid hostname: %q", args.Name)
+	}
+	if args.IP != "" && net.ParseIP(args.IP) == nil {
+		return nil, invalidArgs("invalid address: %q", args.IP)
+	}
+
+	uci.Lock()
+	defer uci.Unlock()
+	overrides, err := hostnameOverrides()
+	if err != nil {
+		return nil, err
+	}
+	section := ""
+	for _, d := range overrides {
+		if d["name"] == args.Name {
+			section = d["section"]
+		}
+	}
+
+	switch {
+	case args.IP == "" && section == "":
+		return dhcpState()
+	case args.IP == "":
+		uci.Delete("dhcp." + section)
+	default:
+		if section == "" {
+			if section, err = uci.Add("dhcp", "domain"); err != nil {
+				return nil, err
+			}
+		}
+		if err := uci.Set("dhcp."+section+".name", args.Name); err != nil {
+			uci.Revert("dhcp")
+			return nil, err
+		}
+		if err := uci.Set("dhcp."+section+".ip", args.IP); err != nil {
+			uci.Revert("dhcp")
+			return nil, err
+		}
+	}
+	if err := commitDHCP(ctx); err != nil {
+		return nil, err
+	}
+	return dhcpState()
+}
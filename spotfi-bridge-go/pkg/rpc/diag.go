@@ -0,0 +1,239 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDiagTimeout = 10 * time.Second
+	maxDiagTimeout     = 60 * time.Second
+)
+
+var (
+	hostPattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.:-]{0,252}$`)
+	pingReplyRe    = regexp.MustCompile(`time=([0-9.]+) ?ms`)
+	pingSummaryRe  = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+	tracerouteHop  = regexp.MustCompile(`^\s*(\d+)\s+(.*)$`)
+	tracerouteRTT  = regexp.MustCompile(`([0-9.]+) ms`)
+	tracerouteAddr = regexp.MustCompile(`([0-9a-fA-F.:]+[0-9a-fA-F])\s`)
+)
+
+// DiagArgs are the arguments shared by the spotfi.diag operations
+type DiagArgs struct {
+	Host    string `json:"host"`
+	URL     string `json:"url"`     // http only
+	Server  string `json:"server"`  // dns only, defaults to the system resolver
+	Count   int    `json:"count"`   // ping only
+	MaxHops int    `json:"maxHops"` // traceroute only
+	Timeout int    `json:"timeout"` // Seconds for the whole check
+}
+
+func init() {
+	register("spotfi.diag", "ping", diagPing)
+	register("spotfi.diag", "traceroute", diagTraceroute)
+	register("spotfi.diag", "dns", diagDNS)
+	register("spotfi.diag", "http", diagHTTP)
+}
+
+func parseDiagArgs(raw json.RawMessage, needHost bool) (DiagArgs, time.Duration, error) {
+	var args DiagArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return args, 0, err
+	}
+	if needHost && !hostPattern.MatchString(args.Host) {
+		return args, 0, invalidArgs("invalid host: %q", args.Host)
+	}
+	timeout := time.Duration(args.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultDiagTimeout
+	}
+	if timeout > maxDiagTimeout {
+		timeout = maxDiagTimeout
+	}
+	return args, timeout, nil
+}
+
+func diagPing(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	args, timeout, err := parseDiagArgs(raw, true)
+	if err != nil {
+		return nil, err
+	}
+	if args.Count <= 0 || args.Count > 20 {
+		args.Count = 4
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	out, runErr := exec.CommandContext(ctx, "ping", "-c", strconv.Itoa(args.Count), "-W", "2", args.Host).CombinedOutput()
+
+	var rtts []float64
+	for _, m := range pingReplyRe.FindAllStringSubmatch(string(out), -1) {
+		if v, err := strconv.ParseFloat(m[1], 64); err == nil {
+			rtts = append(rtts, v)
+		}
+	}
+
+	sent, received := args.Count, len(rtts)
+	if m := pingSummaryRe.FindStringSubmatch(string(out)); m != nil {
+		sent, _ = strconv.Atoi(m[1])
+		received, _ = strconv.Atoi(m[2])
+	}
+
+	result := map[string]interface{}{
+		"host":     args.Host,
+		"sent":     sent,
+		"received": received,
+		"loss":     0.0,
+		"rtts":     rtts,
+	}
+	if sent > 0 {
+		result["loss"] = float64(sent-received) / float64(sent) * 100.0
+	}
+	if len(rtts) > 0 {
+		min, max, sum := rtts[0], rtts[0], 0.0
+		for _, v := range rtts {
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+			sum += v
+		}
+		result["min"] = min
+		result["avg"] = sum / float64(len(rtts))
+		result["max"] = max
+	}
+
+	// ping exits non-zero on 100% loss, which is a valid result rather than a failure
+	if runErr != nil && !strings.Contains(string(out), "transmitted") {
+		return result, fmt.Errorf("ping failed: %s", strings.TrimSpace(string(out)))
+	}
+	return result, nil
+}
+
+func diagTraceroute(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	args, timeout, err := parseDiagArgs(raw, true)
+	if err != nil {
+		return nil, err
+	}
+	if args.MaxHops <= 0 || args.MaxHops > 30 {
+		args.MaxHops = 20
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	out, runErr := exec.CommandContext(ctx, "traceroute", "-n", "-q", "1", "-w", "2",
+		"-m", strconv.Itoa(args.MaxHops), args.Host).CombinedOutput()
+
+	hops := []map[string]interface{}{}
+	for _, line := range strings.Split(string(out), "\n") {
+		m := tracerouteHop.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		ttl, _ := strconv.Atoi(m[1])
+		hop := map[string]interface{}{"ttl": ttl}
+		if a := tracerouteAddr.FindStringSubmatch(m[2] + " "); a != nil && !strings.HasPrefix(strings.TrimSpace(m[2]), "*") {
+			hop["address"] = a[1]
+		}
+		if r := tracerouteRTT.FindStringSubmatch(m[2]); r != nil {
+			hop["rtt"], _ = strconv.ParseFloat(r[1], 64)
+		}
+		hops = append(hops, hop)
+	}
+
+	result := map[string]interface{}{
+		"host":      args.Host,
+		"hops":      hops,
+		"timedOut":  ctx.Err() != nil,
+		"completed": runErr == nil,
+	}
+	if runErr != nil && len(hops) == 0 && ctx.Err() == nil {
+		return result, fmt.Errorf("traceroute failed: %s", strings.TrimSpace(string(out)))
+	}
+	return result, nil
+}
+
+func diagDNS(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	args, timeout, err := parseDiagArgs(raw, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := &net.Resolver{PreferGo: true}
+	if args.Server != "" {
+		server := args.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver.Dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, server)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := resolver.LookupHost(ctx, args.Host)
+	result := map[string]interface{}{
+		"host":      args.Host,
+		"server":    args.Server,
+		"addresses": addrs,
+		"duration":  time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		return result, fmt.Errorf("lookup failed: %w", err)
+	}
+	return result, nil
+}
+
+func diagHTTP(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	args, timeout, err := parseDiagArgs(raw, false)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(args.URL, "http://") && !strings.HasPrefix(args.URL, "https://") {
+		return nil, invalidArgs("url must start with http:// or https://")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, args.URL, nil)
+	if err != nil {
+		return nil, invalidArgs("invalid url: %v", err)
+	}
+
+	client := &http.Client{
+		// Report redirects (e.g. captive portal interception) instead of following them
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	start := time.Now()
+	resp, err := client.Do(httpReq)
+	result := map[string]interface{}{
+		"url":      args.URL,
+		"duration": time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result["reachable"] = false
+		return result, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	result["reachable"] = true
+	result["statusCode"] = resp.StatusCode
+	if loc := resp.Header.Get("Location"); loc != "" {
+		result["location"] = loc
+	}
+	return result, nil
+}
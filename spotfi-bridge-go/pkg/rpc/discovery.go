@@ -0,0 +1,54 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"sort"
+
+	"spotfi-bridge/pkg/plugins"
+	"spotfi-bridge/pkg/ubus"
+)
+
+var ubusPatternRe = regexp.MustCompile(`^[A-Za-z0-9_.*-]{1,128}$`)
+
+// UbusListArgs are the arguments of spotfi.ubus/list
+type UbusListArgs struct {
+	Pattern string `json:"pattern"` // e.g. "hostapd.*", empty for all objects
+}
+
+func init() {
+	register("spotfi.ubus", "list", listUbusObjects)
+}
+
+// listUbusObjects enumerates ubus objects and their method signatures so the
+// backend can feature-detect what the firmware supports
+func listUbusObjects(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args UbusListArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Pattern != "" && !ubusPatternRe.MatchString(args.Pattern) {
+		return nil, invalidArgs("invalid pattern: %q", args.Pattern)
+	}
+
+	objects, err := ubus.Objects(args.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	// Built-in and plugin operations are reported alongside so one call covers everything callable
+	builtin := map[string][]string{}
+	for path, methods := range handlers {
+		for method := range methods {
+			builtin[path] = append(builtin[path], method)
+		}
+		sort.Strings(builtin[path])
+	}
+	for name, methods := range plugins.Methods() {
+		builtin[pluginPrefix+name] = methods
+	}
+	return map[string]interface{}{
+		"objects": objects,
+		"builtin": builtin,
+	}, nil
+}
@@ -0,0 +1,608 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/uci"
+)
+
+const (
+	// DNSFilterFile keeps the filter configuration pushed by the backend
+	DNSFilterFile = "/etc/spotfi/dnsfilter.json"
+
+	// DNSFilterServersFile is the merged blocklist read by dnsmasq. It is on flash, so
+	// dnsmasq finds it at boot and filters before the bridge has fetched the lists
+	DNSFilterServersFile = "/etc/spotfi/dnsfilter.servers"
+
+	// dnsFilterDir holds the downloaded lists. It is in RAM, so list refreshes do not
+	// wear the flash; lists are fetched again after a reboot
+	dnsFilterDir = "/tmp/spotfi-dnsfilter"
+
+	defaultDNSFilterRefresh = 24 * time.Hour
+	dnsFilterRetry          = 15 * time.Minute // After a failed update
+	defaultDNSFilterMax     = 250000           // Domains, bounding dnsmasq's memory
+	maxDNSFilterLists       = 20
+	maxDNSFilterListSize    = 32 << 20
+	maxDNSFilterDomains     = 1000 // In the block and allow lists
+)
+
+// DNSFilterList is a blocklist source
+type DNSFilterList struct {
+	URL  string `json:"url"`            // Hosts file, plain domain list or ||domain^ list
+	Name string `json:"name,omitempty"` // For the dashboard
+}
+
+// DNSFilterArgs are the arguments of spotfi.dnsfilter/set
+type DNSFilterArgs struct {
+	Enabled    bool            `json:"enabled"`
+	Lists      []DNSFilterList `json:"lists"`
+	Block      []string        `json:"block"`      // Extra domains to block
+	Allow      []string        `json:"allow"`      // Domains never blocked, also when on a list
+	Refresh    int             `json:"refresh"`    // Seconds between list updates, at least 3600 (default 86400)
+	MaxDomains int             `json:"maxDomains"` // Default 250000
+}
+
+// DNSFilterListStatus reports the last download of a list
+type DNSFilterListStatus struct {
+	URL          string `json:"url"`
+	Name         string `json:"name,omitempty"`
+	Domains      int    `json:"domains"`
+	Bytes        int64  `json:"bytes"`
+	LastRefresh  int64  `json:"lastRefresh,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Error        string `json:"error,omitempty"` // Of the last update; the previous download stays in use
+
+	etag string
+	file string
+}
+
+// DNSFilterStatus is returned by spotfi.dnsfilter/status and update
+type DNSFilterStatus struct {
+	Enabled     bool                  `json:"enabled"`
+	Active      bool                  `json:"active"`  // dnsmasq is using the filter
+	Domains     int                   `json:"domains"` // Blocked, after removing duplicates and subdomains of blocked domains
+	Truncated   bool                  `json:"truncated,omitempty"`
+	Lists       []DNSFilterListStatus `json:"lists"`
+	Block       int                   `json:"block"`
+	Allow       int                   `json:"allow"`
+	LastRefresh int64                 `json:"lastRefresh,omitempty"`
+	NextRefresh int64                 `json:"nextRefresh,omitempty"`
+	Error       string                `json:"error,omitempty"`
+}
+
+var dnsFilter = struct {
+	mu      sync.Mutex
+	config  DNSFilterArgs
+	lists   map[string]*DNSFilterListStatus // By URL
+	domains int
+	trunc   bool
+	last    int64
+	next    time.Time
+	lastErr string
+	wake    chan struct{}
+	update  sync.Mutex // Serializes updates
+}{lists: map[string]*DNSFilterListStatus{}, wake: make(chan struct{}, 1)}
+
+func init() {
+	register("spotfi.dnsfilter", "set", setDNSFilter)
+	register("spotfi.dnsfilter", "status", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return dnsFilterStatus(), nil
+	})
+	register("spotfi.dnsfilter", "update", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return updateDNSFilter(ctx)
+	})
+}
+
+// normalizeDomains validates a list of domains, lowercased and deduplicated
+func normalizeDomains(list []string, field string) ([]string, error) {
+	if len(list) > maxDNSFilterDomains {
+		return nil, invalidArgs("at most %d %s domains are allowed", maxDNSFilterDomains, field)
+	}
+	seen := map[string]bool{}
+	for _, d := range list {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		if len(d) > 253 || !domainPattern.MatchString(d) {
+			return nil, invalidArgs("invalid %s domain: %q", field, d)
+		}
+		seen[d] = true
+	}
+	return sortedKeys(seen), nil
+}
+
+func normalizeDNSFilter(args *DNSFilterArgs) error {
+	if len(args.Lists) > maxDNSFilterLists {
+		return invalidArgs("at most %d lists are allowed", maxDNSFilterLists)
+	}
+	seen := map[string]bool{}
+	for _, l := range args.Lists {
+		u, err := url.Parse(l.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return invalidArgs("invalid list URL: %q", l.URL)
+		}
+		if seen[l.URL] {
+			return invalidArgs("duplicate list URL: %s", l.URL)
+		}
+		seen[l.URL] = true
+	}
+	var err error
+	if args.Block, err = normalizeDomains(args.Block, "block"); err != nil {
+		return err
+	}
+	if args.Allow, err = normalizeDomains(args.Allow, "allow"); err != nil {
+		return err
+	}
+	if args.Refresh == 0 {
+		args.Refresh = int(defaultDNSFilterRefresh.Seconds())
+	}
+	if args.Refresh < 3600 || args.Refresh > 30*24*3600 {
+		return invalidArgs("refresh must be between 3600 and %d seconds", 30*24*3600)
+	}
+	if args.MaxDomains == 0 {
+		args.MaxDomains = defaultDNSFilterMax
+	}
+	if args.MaxDomains < 1 || args.MaxDomains > 2000000 {
+		return invalidArgs("maxDomains must be between 1 and 2000000")
+	}
+	if args.Enabled && len(args.Lists) == 0 && len(args.Block) == 0 {
+		return invalidArgs("an enabled filter needs lists or block domains")
+	}
+	return nil
+}
+
+// setDNSFilter replaces the filter configuration and updates the lists now
+func setDNSFilter(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args DNSFilterArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := normalizeDNSFilter(&args); err != nil {
+		return nil, err
+	}
+
+	dnsFilter.mu.Lock()
+	dnsFilter.config = args
+	keep := map[string]bool{}
+	for _, l := range args.Lists {
+		keep[l.URL] = true
+	}
+	for u, st := range dnsFilter.lists {
+		if !keep[u] {
+			os.Remove(st.file)
+			delete(dnsFilter.lists, u)
+		}
+	}
+	err := saveDNSFilterLocked()
+	dnsFilter.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case dnsFilter.wake <- struct{}{}: // Restart the refresh period
+	default:
+	}
+	return updateDNSFilter(ctx)
+}
+
+// updateDNSFilter downloads the lists and hands the merged blocklist to dnsmasq
+func updateDNSFilter(ctx context.Context) (*DNSFilterStatus, error) {
+	dnsFilter.update.Lock()
+	defer dnsFilter.update.Unlock()
+	dnsFilter.mu.Lock()
+	cfg := dnsFilter.config
+	dnsFilter.mu.Unlock()
+
+	var err error
+	if cfg.Enabled {
+		err = buildDNSFilter(ctx, cfg)
+	} else {
+		err = disableDNSFilter(ctx)
+	}
+	dnsFilter.mu.Lock()
+	dnsFilter.next = time.Now().Add(time.Duration(cfg.Refresh) * time.Second)
+	dnsFilter.lastErr = ""
+	if err != nil {
+		dnsFilter.lastErr = err.Error()
+		dnsFilter.next = time.Now().Add(dnsFilterRetry)
+	}
+	dnsFilter.mu.Unlock()
+	if err != nil {
+		logger.Warn("DNS filter update failed", "error", err)
+		return nil, err
+	}
+	return dnsFilterStatus(), nil
+}
+
+func buildDNSFilter(ctx context.Context, cfg DNSFilterArgs) error {
+	if err := os.MkdirAll(dnsFilterDir, 0755); err != nil {
+		return Errorf(CodeInternal, "failed to create %s: %v", dnsFilterDir, err)
+	}
+	blocked := map[string]bool{}
+	for _, d := range cfg.Block {
+		blocked[d] = true
+	}
+	failed := 0
+	for i, l := range cfg.Lists {
+		reportProgress(ctx, map[string]interface{}{"list": l.URL, "index": i + 1, "lists": len(cfg.Lists)})
+		domains, err := fetchDNSFilterList(ctx, l)
+		if err != nil {
+			failed++
+			logger.Warn("DNS filter list not updated", "url", l.URL, "error", err)
+		}
+		for _, d := range domains {
+			blocked[d] = true
+		}
+		if ctx.Err() != nil {
+			return Errorf(CodeTimeout, "update cancelled")
+		}
+	}
+	if failed == len(cfg.Lists) && len(cfg.Lists) > 0 && len(blocked) == len(cfg.Block) {
+		return Errorf(CodeExecError, "no list could be downloaded")
+	}
+
+	// Blocking a domain blocks its subdomains, so they are dropped; allowed
+	// domains and their subdomains are never blocked
+	allowed := map[string]bool{}
+	for _, d := range cfg.Allow {
+		allowed[d] = true
+	}
+	var list []string
+	for d := range blocked {
+		if !coveredDomain(d, blocked, false) && !coveredDomain(d, allowed, true) {
+			list = append(list, d)
+		}
+	}
+	sort.Strings(list)
+	truncated := len(list) > cfg.MaxDomains
+	if truncated {
+		logger.Warn("DNS filter truncated", "domains", len(list), "max", cfg.MaxDomains)
+		list = list[:cfg.MaxDomains]
+	}
+
+	var buf strings.Builder
+	for _, d := range list {
+		fmt.Fprintf(&buf, "server=/%s/\n", d) // Local only: answered with NXDOMAIN
+	}
+	for _, d := range cfg.Allow {
+		// Subdomains of blocked domains resolve normally
+		fmt.Fprintf(&buf, "server=/%s/#\n", d)
+	}
+	path := DNSFilterServersFile
+	previous, _ := os.ReadFile(path)
+	changed := string(previous) != buf.String()
+	if changed {
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(buf.String()), 0644); err != nil {
+			return Errorf(CodeInternal, "failed to write %s: %v", path, err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return Errorf(CodeInternal, "failed to write %s: %v", path, err)
+		}
+	}
+	if err := configureDnsmasq(ctx, path, changed); err != nil {
+		return err
+	}
+
+	dnsFilter.mu.Lock()
+	dnsFilter.domains, dnsFilter.trunc, dnsFilter.last = len(list), truncated, time.Now().Unix()
+	dnsFilter.mu.Unlock()
+	logger.Info("DNS filter updated", "domains", len(list), "lists", len(cfg.Lists), "failed", failed)
+	return nil
+}
+
+// coveredDomain reports whether d or, with self false, only a parent of d is in set
+func coveredDomain(d string, set map[string]bool, self bool) bool {
+	if self && set[d] {
+		return true
+	}
+	for i := strings.IndexByte(d, '.'); i >= 0; i = strings.IndexByte(d, '.') {
+		d = d[i+1:]
+		if set[d] {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchDNSFilterList downloads a list, or reuses the previous download when it did
+// not change or cannot be fetched, and returns its domains
+func fetchDNSFilterList(ctx context.Context, l DNSFilterList) ([]string, error) {
+	sum := sha256.Sum256([]byte(l.URL))
+	file := filepath.Join(dnsFilterDir, hex.EncodeToString(sum[:8])+".list")
+
+	dnsFilter.mu.Lock()
+	st := dnsFilter.lists[l.URL]
+	if st == nil {
+		st = &DNSFilterListStatus{URL: l.URL, file: file}
+		dnsFilter.lists[l.URL] = st
+	}
+	st.Name = l.Name
+	etag, modified := st.etag, st.LastModified
+	dnsFilter.mu.Unlock()
+
+	fail := func(err error) ([]string, error) {
+		dnsFilter.mu.Lock()
+		st.Error = err.Error()
+		dnsFilter.mu.Unlock()
+		previous, _ := readDNSFilterList(file)
+		return previous, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.URL, nil)
+	if err != nil {
+		return fail(err)
+	}
+	if _, statErr := os.Stat(file); statErr == nil {
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if modified != "" {
+			req.Header.Set("If-Modified-Since", modified)
+		}
+	}
+	client := &http.Client{Timeout: 2 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	var domains []string
+	var size int64
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if domains, err = readDNSFilterList(file); err != nil {
+			return fail(err)
+		}
+		info, _ := os.Stat(file)
+		size = info.Size()
+	case http.StatusOK:
+		counter := &countingReader{r: io.LimitReader(resp.Body, maxDNSFilterListSize+1)}
+		domains = parseDNSFilterList(counter)
+		if counter.n > maxDNSFilterListSize {
+			return fail(fmt.Errorf("list larger than %d bytes", maxDNSFilterListSize))
+		}
+		size = counter.n
+		if err := os.WriteFile(file, []byte(strings.Join(domains, "\n")), 0644); err != nil {
+			return fail(err)
+		}
+	default:
+		return fail(fmt.Errorf("HTTP %d", resp.StatusCode))
+	}
+
+	dnsFilter.mu.Lock()
+	st.Domains, st.Bytes, st.LastRefresh, st.Error = len(domains), size, time.Now().Unix(), ""
+	st.etag, st.LastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode == http.StatusNotModified {
+		st.etag, st.LastModified = etag, modified
+	}
+	dnsFilter.mu.Unlock()
+	return domains, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// parseDNSFilterList reads hosts files ("0.0.0.0 ads.example.com"), plain domain
+// lists and adblock-style "||ads.example.com^" lines, skipping anything else
+func parseDNSFilterList(r io.Reader) []string {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		if strings.HasPrefix(line, "||") {
+			line = strings.TrimSuffix(strings.TrimPrefix(line, "||"), "^")
+		} else if fields := strings.Fields(line); len(fields) >= 2 {
+			line = fields[1] // Hosts file: address first
+		}
+		line = strings.TrimSuffix(strings.ToLower(line), ".")
+		if line == "localhost" || line == "localhost.localdomain" || len(line) > 253 || !domainPattern.MatchString(line) {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	return domains
+}
+
+func readDNSFilterList(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(data), "\n"), nil
+}
+
+// dnsmasqSection returns the name of the first dnsmasq instance in /etc/config/dhcp
+func dnsmasqSection() (string, error) {
+	sections, err := uci.SectionsOfType("dhcp", "dnsmasq")
+	if err != nil {
+		return "", Errorf(CodeUbusError, "failed to read dhcp config: %v", err)
+	}
+	if len(sections) == 0 {
+		return "", Errorf(CodeNotFound, "no dnsmasq instance configured")
+	}
+	return sections[0].Name, nil
+}
+
+// configureDnsmasq points dnsmasq's servers-file at path (or removes it with an empty
+// path) and makes dnsmasq read it: a restart when the option changed, a reload when
+// only the file did
+func configureDnsmasq(ctx context.Context, path string, changed bool) error {
+	uci.Lock()
+	defer uci.Unlock()
+	section, err := dnsmasqSection()
+	if err != nil {
+		return err
+	}
+	key := "dhcp." + section + ".serversfile"
+	current, _ := uci.Get(key)
+	action := "reload" // SIGHUP re-reads the servers-file
+	if current != path {
+		if current != "" && current != DNSFilterServersFile {
+			return Errorf(CodeInvalidArgs, "dnsmasq already uses the servers-file %s", current)
+		}
+		if path == "" {
+			err = uci.Delete(key)
+		} else {
+			err = uci.Set(key, path)
+		}
+		if err == nil {
+			err = uci.Commit("dhcp")
+		}
+		if err != nil {
+			uci.Revert("dhcp")
+			return Errorf(CodeExecError, "failed to configure dnsmasq: %v", err)
+		}
+		action = "restart"
+	} else if path == "" || !changed {
+		return nil
+	}
+	if out, err := exec.CommandContext(ctx, "/etc/init.d/dnsmasq", action).CombinedOutput(); err != nil {
+		return Errorf(CodeExecError, "dnsmasq %s failed: %s", action, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func disableDNSFilter(ctx context.Context) error {
+	if err := configureDnsmasq(ctx, "", false); err != nil {
+		return err
+	}
+	os.Remove(DNSFilterServersFile)
+	os.RemoveAll(dnsFilterDir)
+	dnsFilter.mu.Lock()
+	dnsFilter.domains, dnsFilter.trunc = 0, false
+	for _, st := range dnsFilter.lists {
+		st.Domains, st.Bytes, st.etag, st.LastModified = 0, 0, "", ""
+	}
+	dnsFilter.mu.Unlock()
+	return nil
+}
+
+func dnsFilterStatus() *DNSFilterStatus {
+	active := false
+	if section, err := dnsmasqSection(); err == nil {
+		current, _ := uci.Get("dhcp." + section + ".serversfile")
+		_, statErr := os.Stat(current)
+		active = current == DNSFilterServersFile && statErr == nil
+	}
+
+	dnsFilter.mu.Lock()
+	defer dnsFilter.mu.Unlock()
+	s := &DNSFilterStatus{
+		Enabled:     dnsFilter.config.Enabled,
+		Active:      active,
+		Domains:     dnsFilter.domains,
+		Truncated:   dnsFilter.trunc,
+		Lists:       []DNSFilterListStatus{},
+		Block:       len(dnsFilter.config.Block),
+		Allow:       len(dnsFilter.config.Allow),
+		LastRefresh: dnsFilter.last,
+		Error:       dnsFilter.lastErr,
+	}
+	if dnsFilter.config.Enabled && !dnsFilter.next.IsZero() {
+		s.NextRefresh = dnsFilter.next.Unix()
+	}
+	for _, l := range dnsFilter.config.Lists {
+		if st := dnsFilter.lists[l.URL]; st != nil {
+			s.Lists = append(s.Lists, *st)
+		} else {
+			s.Lists = append(s.Lists, DNSFilterListStatus{URL: l.URL, Name: l.Name})
+		}
+	}
+	return s
+}
+
+// StartDNSFilter loads the saved filter configuration and keeps the lists updated
+// until the RPC context is cancelled. Call it after Configure
+func StartDNSFilter() {
+	if data, err := os.ReadFile(DNSFilterFile); err == nil {
+		var saved DNSFilterArgs
+		if err := json.Unmarshal(data, &saved); err != nil || normalizeDNSFilter(&saved) != nil {
+			logger.Error("Ignoring invalid DNS filter file", "file", DNSFilterFile, "error", err)
+		} else {
+			dnsFilter.mu.Lock()
+			dnsFilter.config = saved
+			dnsFilter.mu.Unlock()
+		}
+	}
+	go dnsFilterLoop(options.Context)
+}
+
+// dnsFilterLoop updates the lists every refresh period, starting at boot since the
+// downloads are kept in RAM only
+func dnsFilterLoop(ctx context.Context) {
+	defer crash.Recover("dns filter")
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-dnsFilter.wake:
+		case <-time.After(wait):
+			dnsFilter.mu.Lock()
+			enabled := dnsFilter.config.Enabled
+			dnsFilter.mu.Unlock()
+			if enabled {
+				updateDNSFilter(ctx)
+			}
+		}
+		dnsFilter.mu.Lock()
+		wait = defaultDNSFilterRefresh
+		if dnsFilter.config.Enabled && !dnsFilter.next.IsZero() {
+			wait = max(time.Until(dnsFilter.next), time.Minute)
+		}
+		dnsFilter.mu.Unlock()
+	}
+}
+
+// saveDNSFilterLocked writes DNSFilterFile; dnsFilter.mu must be held
+func saveDNSFilterLocked() error {
+	data, err := json.Marshal(dnsFilter.config)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(DNSFilterFile), 0755)
+	}
+	if err == nil {
+		tmp := DNSFilterFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, DNSFilterFile)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save DNS filter", "error", err)
+		return Errorf(CodeInternal, "failed to save DNS filter: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+
+	"spotfi-bridge/pkg/downtime"
+)
+
+func init() {
+	register("spotfi.system", "downtime", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return downtime.Status(), nil
+	})
+}
@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"spotfi-bridge/pkg/ubus"
+)
+
+// ErrorCode is the machine-readable failure class of an RPC response
+type ErrorCode int
+
+const (
+	CodeOK               ErrorCode = 0
+	CodeTimeout          ErrorCode = 1
+	CodeNotFound         ErrorCode = 2
+	CodePermissionDenied ErrorCode = 3
+	CodeUbusError        ErrorCode = 4
+	CodeExecError        ErrorCode = 5
+	CodeInvalidArgs      ErrorCode = 6
+	CodeInternal         ErrorCode = 7
+	CodeThrottled        ErrorCode = 8
+	CodeUnavailable      ErrorCode = 9
+)
+
+var codeNames = map[ErrorCode]string{
+	CodeOK:               "ok",
+	CodeTimeout:          "timeout",
+	CodeNotFound:         "not_found",
+	CodePermissionDenied: "permission_denied",
+	CodeUbusError:        "ubus_error",
+	CodeExecError:        "exec_error",
+	CodeInvalidArgs:      "invalid_args",
+	CodeInternal:         "internal_error",
+	CodeThrottled:        "throttled",
+	CodeUnavailable:      "unavailable",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code_%d", int(c))
+}
+
+// Error is an RPC failure carrying a code and optional structured details
+type Error struct {
+	Code     ErrorCode
+	Message  string
+	ExitCode *int
+	Details  map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf creates an *Error with the given code
+func Errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errShuttingDown answers requests refused or cancelled by the shutdown
+var errShuttingDown = Errorf(CodeUnavailable, "bridge is shutting down")
+
+// invalidArgs is shorthand for argument validation failures
+func invalidArgs(format string, args ...interface{}) *Error {
+	return Errorf(CodeInvalidArgs, format, args...)
+}
+
+// ubusStatusCodes maps ubus CLI exit codes (UBUS_STATUS_*) to RPC error codes
+var ubusStatusCodes = map[int]ErrorCode{
+	2:  CodeInvalidArgs,      // UBUS_STATUS_INVALID_ARGUMENT
+	3:  CodeNotFound,         // UBUS_STATUS_METHOD_NOT_FOUND
+	4:  CodeNotFound,         // UBUS_STATUS_NOT_FOUND
+	6:  CodePermissionDenied, // UBUS_STATUS_PERMISSION_DENIED
+	7:  CodeTimeout,          // UBUS_STATUS_TIMEOUT
+	10: CodeUbusError,        // UBUS_STATUS_CONNECTION_FAILED
+}
+
+func codeForUbusStatus(status int) ErrorCode {
+	if code, ok := ubusStatusCodes[status]; ok {
+		return code
+	}
+	return CodeUbusError
+}
+
+// classify converts any handler error into an *Error
+func classify(err error) *Error {
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+
+	var ubusErr *ubus.Error
+	if errors.As(err, &ubusErr) {
+		exitCode := ubusErr.ExitCode
+		e := &Error{Code: codeForUbusStatus(exitCode), Message: err.Error(), ExitCode: &exitCode}
+		if ubusErr.Stderr != "" {
+			e.Details = map[string]interface{}{"stderr": ubusErr.Stderr}
+		}
+		return e
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Code: CodeTimeout, Message: err.Error()}
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, exec.ErrNotFound):
+		return &Error{Code: CodeNotFound, Message: err.Error()}
+	case errors.Is(err, os.ErrPermission):
+		return &Error{Code: CodePermissionDenied, Message: err.Error()}
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode := exitErr.ExitCode()
+		return &Error{Code: CodeExecError, Message: err.Error(), ExitCode: &exitCode}
+	}
+	return &Error{Code: CodeExecError, Message: err.Error()}
+}
@@ -0,0 +1,407 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"spotfi-bridge/pkg/uci"
+)
+
+var (
+	uciNamePattern  = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	ruleNamePattern = regexp.MustCompile(`^[A-Za-z0-9 _.-]{1,64}$`)
+	validProtos     = map[string]bool{"tcp": true, "udp": true, "tcp udp": true, "icmp": true, "all": true}
+	validTargets    = map[string]bool{"ACCEPT": true, "REJECT": true, "DROP": true}
+)
+
+// PortForwardArgs are the arguments of spotfi.firewall/add_forward (a fw4 redirect)
+type PortForwardArgs struct {
+	Name     string `json:"name"`
+	Proto    string `json:"proto"`    // tcp, udp or "tcp udp"
+	SrcZone  string `json:"srcZone"`  // Defaults to wan
+	SrcPort  string `json:"srcPort"`  // External port or range
+	DestIP   string `json:"destIp"`   // Internal host
+	DestPort string `json:"destPort"` // Defaults to SrcPort
+	DestZone string `json:"destZone"` // Defaults to lan
+}
+
+// TrafficRuleArgs are the arguments of spotfi.firewall/add_rule
+type TrafficRuleArgs struct {
+	Name     string `json:"name"`
+	Proto    string `json:"proto"`
+	Src      string `json:"src"`  // Source zone ("*" for any)
+	Dest     string `json:"dest"` // Destination zone, empty for input rules
+	SrcIP    string `json:"srcIp"`
+	SrcMac   string `json:"srcMac"`
+	DestIP   string `json:"destIp"`
+	DestPort string `json:"destPort"`
+	Family   string `json:"family"` // ipv4, ipv6 or any
+	Target   string `json:"target"`
+}
+
+// FirewallSectionArgs identify a section for spotfi.firewall/remove
+type FirewallSectionArgs struct {
+	Section string `json:"section"`
+	Reload  *bool  `json:"reload"` // Defaults to true
+}
+
+// FirewallToggleArgs are the arguments of spotfi.firewall/set_enabled
+type FirewallToggleArgs struct {
+	Section string `json:"section"`
+	Enabled bool   `json:"enabled"`
+	Reload  *bool  `json:"reload"` // Defaults to true
+}
+
+func init() {
+	register("spotfi.firewall", "list", listFirewall)
+	register("spotfi.firewall", "add_forward", addPortForward)
+	register("spotfi.firewall", "add_rule", addTrafficRule)
+	register("spotfi.firewall", "remove", removeFirewallSection)
+	register("spotfi.firewall", "set_enabled", setFirewallSectionEnabled)
+	register("spotfi.firewall", "reload", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"reloaded": true}, reloadFirewall(ctx)
+	})
+}
+
+func reloadFirewall(ctx context.Context) error {
+	if out, err := exec.CommandContext(ctx, "/etc/init.d/firewall", "reload").CombinedOutput(); err != nil {
+		return Errorf(CodeExecError, "firewall reload failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// sectionsToMaps converts UCI sections into JSON-friendly objects
+func sectionsToMaps(sections []uci.Section) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(sections))
+	for _, s := range sections {
+		entry := map[string]interface{}{".name": s.Name, ".type": s.Type}
+		for opt, vals := range s.Options {
+			if len(vals) == 1 {
+				entry[opt] = vals[0]
+			} else {
+				entry[opt] = vals
+			}
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+func listFirewall(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	all, err := uci.Show("firewall")
+	if err != nil {
+		return nil, err
+	}
+	byType := map[string][]uci.Section{}
+	for _, s := range all {
+		byType[s.Type] = append(byType[s.Type], s)
+	}
+	return map[string]interface{}{
+		"defaults":    sectionsToMaps(byType["defaults"]),
+		"zones":       sectionsToMaps(byType["zone"]),
+		"forwardings": sectionsToMaps(byType["forwarding"]),
+		"rules":       sectionsToMaps(byType["rule"]),
+		"redirects":   sectionsToMaps(byType["redirect"]),
+	}, nil
+}
+
+func firewallZones() (map[string]bool, error) {
+	zones, err := uci.SectionsOfType("firewall", "zone")
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, z := range zones {
+		names[z.Option("name")] = true
+	}
+	return names, nil
+}
+
+func validatePort(port string, required bool) error {
+	if port == "" {
+		if required {
+			return invalidArgs("port is required")
+		}
+		return nil
+	}
+	parts := strings.SplitN(port, "-", 2)
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return invalidArgs("invalid port: %q", port)
+		}
+	}
+	return nil
+}
+
+func validateAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	if net.ParseIP(addr) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(addr); err == nil {
+		return nil
+	}
+	return invalidArgs("invalid address: %q", addr)
+}
+
+func validateZone(zones map[string]bool, zone string, allowAny bool) error {
+	if zone == "" || (allowAny && zone == "*") || zones[zone] {
+		return nil
+	}
+	return invalidArgs("unknown firewall zone: %q", zone)
+}
+
+// ensureUniqueName rejects names already used by a rule or redirect
+func ensureUniqueName(name string) error {
+	if !ruleNamePattern.MatchString(name) {
+		return invalidArgs("invalid name: %q", name)
+	}
+	all, err := uci.Show("firewall")
+	if err != nil {
+		return err
+	}
+	for _, s := range all {
+		if (s.Type == "rule" || s.Type == "redirect") && s.Option("name") == name {
+			return invalidArgs("a firewall %s named %q already exists (%s)", s.Type, name, s.Name)
+		}
+	}
+	return nil
+}
+
+// addFirewallSection creates a section with the given options, commits and reloads
+func addFirewallSection(ctx context.Context, sectionType string, opts [][2]string) (string, error) {
+	uci.Lock()
+	defer uci.Unlock()
+	name, err := uci.Add("firewall", sectionType)
+	if err != nil {
+		return "", err
+	}
+	for _, opt := range opts {
+		if opt[1] == "" {
+			continue
+		}
+		if err := uci.Set("firewall."+name+"."+opt[0], opt[1]); err != nil {
+			uci.Revert("firewall")
+			return "", err
+		}
+	}
+	if err := uci.Commit("firewall"); err != nil {
+		uci.Revert("firewall")
+		return "", err
+	}
+	return name, reloadFirewall(ctx)
+}
+
+func addPortForward(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args PortForwardArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Proto == "" {
+		args.Proto = "tcp udp"
+	}
+	if args.SrcZone == "" {
+		args.SrcZone = "wan"
+	}
+	if args.DestZone == "" {
+		args.DestZone = "lan"
+	}
+	if args.DestPort == "" {
+		args.DestPort = args.SrcPort
+	}
+
+	if err := ensureUniqueName(args.Name); err != nil {
+		return nil, err
+	}
+	if !validProtos[args.Proto] || args.Proto == "icmp" {
+		return nil, invalidArgs("invalid proto for port forward: %q", args.Proto)
+	}
+	if err := validatePort(args.SrcPort, true); err != nil {
+		return nil, err
+	}
+	if err := validatePort(args.DestPort, true); err != nil {
+		return nil, err
+	}
+	if net.ParseIP(args.DestIP) == nil {
+		return nil, invalidArgs("invalid destIp: %q", args.DestIP)
+	}
+	zones, err := firewallZones()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateZone(zones, args.SrcZone, false); err != nil {
+		return nil, err
+	}
+	if err := validateZone(zones, args.DestZone, false); err != nil {
+		return nil, err
+	}
+
+	section, err := addFirewallSection(ctx, "redirect", [][2]string{
+		{"name", args.Name},
+		{"target", "DNAT"},
+		{"proto", args.Proto},
+		{"src", args.SrcZone},
+		{"src_dport", args.SrcPort},
+		{"dest", args.DestZone},
+		{"dest_ip", args.DestIP},
+		{"dest_port", args.DestPort},
+	})
+	return map[string]interface{}{"section": section}, err
+}
+
+func addTrafficRule(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args TrafficRuleArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Target == "" {
+		args.Target = "REJECT"
+	}
+
+	if err := ensureUniqueName(args.Name); err != nil {
+		return nil, err
+	}
+	if args.Proto != "" && !validProtos[args.Proto] {
+		return nil, invalidArgs("invalid proto: %q", args.Proto)
+	}
+	if !validTargets[args.Target] {
+		return nil, invalidArgs("invalid target: %q", args.Target)
+	}
+	if args.Family != "" && args.Family != "ipv4" && args.Family != "ipv6" && args.Family != "any" {
+		return nil, invalidArgs("invalid family: %q", args.Family)
+	}
+	if args.Src == "" {
+		return nil, invalidArgs("src zone is required")
+	}
+	if err := validatePort(args.DestPort, false); err != nil {
+		return nil, err
+	}
+	if err := validateAddr(args.SrcIP); err != nil {
+		return nil, err
+	}
+	if err := validateAddr(args.DestIP); err != nil {
+		return nil, err
+	}
+	if args.SrcMac != "" {
+		mac, err := normalizeMAC(args.SrcMac)
+		if err != nil {
+			return nil, err
+		}
+		args.SrcMac = mac
+	}
+	zones, err := firewallZones()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateZone(zones, args.Src, true); err != nil {
+		return nil, err
+	}
+	if err := validateZone(zones, args.Dest, true); err != nil {
+		return nil, err
+	}
+
+	section, err := addFirewallSection(ctx, "rule", [][2]string{
+		{"name", args.Name},
+		{"proto", args.Proto},
+		{"src", args.Src},
+		{"dest", args.Dest},
+		{"src_ip", args.SrcIP},
+		{"src_mac", args.SrcMac},
+		{"dest_ip", args.DestIP},
+		{"dest_port", args.DestPort},
+		{"family", args.Family},
+		{"target", args.Target},
+	})
+	return map[string]interface{}{"section": section}, err
+}
+
+func removeFirewallSection(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args FirewallSectionArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	uci.Lock()
+	defer uci.Unlock()
+	sectionType, err := managedFirewallSection(args.Section, "remove")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := uci.Delete("firewall." + args.Section); err != nil {
+		return nil, err
+	}
+	if err := uci.Commit("firewall"); err != nil {
+		return nil, err
+	}
+	if args.Reload == nil || *args.Reload {
+		if err := reloadFirewall(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{"removed": args.Section, "type": sectionType}, nil
+}
+
+// managedFirewallSection returns the type of a rule, redirect or forwarding
+// section, refusing the zones and defaults the router depends on
+func managedFirewallSection(section, action string) (string, error) {
+	if !uciNamePattern.MatchString(section) {
+		return "", invalidArgs("invalid section: %q", section)
+	}
+	all, err := uci.Show("firewall")
+	if err != nil {
+		return "", err
+	}
+	var sectionType string
+	for _, s := range all {
+		if s.Name == section {
+			sectionType = s.Type
+		}
+	}
+	switch sectionType {
+	case "":
+		return "", Errorf(CodeNotFound, "firewall section not found: %s", section)
+	case "rule", "redirect", "forwarding":
+		return sectionType, nil
+	}
+	return "", Errorf(CodePermissionDenied, "refusing to %s %s section %s", action, sectionType, section)
+}
+
+// setFirewallSectionEnabled switches a rule, redirect or forwarding on or off
+// without removing it, e.g. from an automation
+func setFirewallSectionEnabled(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args FirewallToggleArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	uci.Lock()
+	defer uci.Unlock()
+	sectionType, err := managedFirewallSection(args.Section, "toggle")
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := "0"
+	if args.Enabled {
+		enabled = "1"
+	}
+	if err := uci.Set("firewall."+args.Section+".enabled", enabled); err != nil {
+		return nil, err
+	}
+	if err := uci.Commit("firewall"); err != nil {
+		return nil, err
+	}
+	if args.Reload == nil || *args.Reload {
+		if err := reloadFirewall(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{"section": args.Section, "type": sectionType, "enabled": args.Enabled}, nil
+}
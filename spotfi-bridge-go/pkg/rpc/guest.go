@@ -0,0 +1,481 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"spotfi-bridge/pkg/uci"
+)
+
+const (
+	defaultGuestWANZone   = "wan"
+	defaultGuestLeaseTime = "1h"
+	defaultGuestPortal    = "click-to-continue"
+)
+
+// Doubles as the interface, zone (fw4 limits those to 11 characters) and
+// bridge name, so it stays well inside IFNAMSIZ with the "br-" prefix
+var guestNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,10}$`)
+
+var devicePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,14}$`)
+
+var leaseTimePattern = regexp.MustCompile(`^([0-9]+[smhdw]?|infinite)$`)
+
+var guestEncryptions = map[string]bool{
+	"none": true, "owe": true, "psk2": true, "psk-mixed": true, "sae": true, "sae-mixed": true,
+}
+
+var guestPortalModes = map[string]bool{
+	"click-to-continue": true, "credentials": true, "radius": true, "uam": true,
+}
+
+// GuestNetworkArgs are the arguments of spotfi.guest/provision
+type GuestNetworkArgs struct {
+	Name       string   `json:"name"`       // Interface, zone and section prefix, e.g. "guest"
+	SSID       string   `json:"ssid"`       // Broadcast on every radio unless Radios is set
+	Encryption string   `json:"encryption"` // none (default), owe, psk2, psk-mixed, sae, sae-mixed
+	Key        string   `json:"key"`
+	Radios     []string `json:"radios"` // wifi-device sections
+	Isolate    *bool    `json:"isolate"`
+
+	VLAN       int    `json:"vlan"`       // 802.1Q ID tagged on VLANDevice, 0 for Wi-Fi only
+	VLANDevice string `json:"vlanDevice"` // Trunk port or bridge carrying the VLAN, e.g. "lan4"
+
+	Address   string `json:"address"` // Router address in CIDR form, e.g. "10.20.0.1/24"
+	DHCPStart int    `json:"dhcpStart"`
+	DHCPLimit int    `json:"dhcpLimit"`
+	LeaseTime string `json:"leaseTime"`
+
+	WANZone string `json:"wanZone"` // Zone guests may forward to (default wan)
+
+	Portal     bool   `json:"portal"`     // Bind a uspot captive portal to the network
+	PortalAuth string `json:"portalAuth"` // uspot auth_mode (default click-to-continue)
+
+	Replace         bool `json:"replace"` // Reprovision an existing guest network of this name
+	DryRun          bool `json:"dryRun"`  // Validate and return the changes without applying them
+	RollbackTimeout int  `json:"rollbackTimeout"`
+}
+
+// GuestNameArgs name a guest network
+type GuestNameArgs struct {
+	Name            string `json:"name"`
+	RollbackTimeout int    `json:"rollbackTimeout"`
+}
+
+func init() {
+	register("spotfi.guest", "provision", provisionGuest)
+	register("spotfi.guest", "remove", removeGuest)
+	register("spotfi.guest", "get", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args GuestNameArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if !guestNamePattern.MatchString(args.Name) {
+			return nil, invalidArgs("invalid name: %q", args.Name)
+		}
+		sections, err := guestSections(args.Name)
+		if err != nil {
+			return nil, err
+		}
+		if len(sections) == 0 {
+			return nil, Errorf(CodeNotFound, "no guest network named %q", args.Name)
+		}
+		return map[string]interface{}{"name": args.Name, "sections": sections}, nil
+	})
+}
+
+// guestChanges builds the UCI changes of a guest network on top of a clean slate
+type guestChanges []UCIChange
+
+func (g *guestChanges) set(config, section, option, value string) {
+	*g = append(*g, UCIChange{Op: "set", Config: config, Section: section, Option: option, Value: value})
+}
+
+func (g *guestChanges) addList(config, section, option string, values ...string) {
+	for _, v := range values {
+		*g = append(*g, UCIChange{Op: "add_list", Config: config, Section: section, Option: option, Value: v})
+	}
+}
+
+// guestSectionNames are the sections owned by a guest network, besides its
+// wifi-ifaces which are named after the radios
+func guestSectionNames(name string) map[string][]string {
+	return map[string][]string{
+		"network":  {name, name + "_dev", name + "_vlan"},
+		"dhcp":     {name},
+		"firewall": {name + "_zone", name + "_fwd", name + "_dhcp", name + "_dns"},
+		"uspot":    {name},
+	}
+}
+
+// guestSections lists the existing sections of a guest network as config.section
+func guestSections(name string) ([]string, error) {
+	var found []string
+	for _, config := range []string{"network", "wireless", "dhcp", "firewall", "uspot"} {
+		all, err := uci.Show(config)
+		if err != nil {
+			if config == "uspot" {
+				continue // Not installed
+			}
+			return nil, err
+		}
+		owned := map[string]bool{}
+		for _, s := range guestSectionNames(name)[config] {
+			owned[s] = true
+		}
+		for _, s := range all {
+			if owned[s.Name] || (s.Type == "wifi-iface" && strings.HasPrefix(s.Name, name+"_") && s.Option("network") == name) {
+				found = append(found, config+"."+s.Name)
+			}
+		}
+	}
+	return found, nil
+}
+
+func deleteChanges(sections []string) guestChanges {
+	var changes guestChanges
+	for _, s := range sections {
+		config, section, _ := strings.Cut(s, ".")
+		changes = append(changes, UCIChange{Op: "delete", Config: config, Section: section})
+	}
+	return changes
+}
+
+func validateGuestNetwork(args *GuestNetworkArgs) error {
+	if !guestNamePattern.MatchString(args.Name) {
+		return invalidArgs("name must be 1-11 lowercase letters, digits or underscores: %q", args.Name)
+	}
+	if args.SSID == "" || len(args.SSID) > 32 || strings.ContainsAny(args.SSID, "\n\x00") {
+		return invalidArgs("ssid must be 1-32 bytes")
+	}
+	if args.Encryption == "" {
+		args.Encryption = "none"
+	}
+	if !guestEncryptions[args.Encryption] {
+		return invalidArgs("unsupported encryption: %q", args.Encryption)
+	}
+	switch args.Encryption {
+	case "none", "owe":
+		if args.Key != "" {
+			return invalidArgs("key is not used with encryption %s", args.Encryption)
+		}
+	default:
+		if len(args.Key) < 8 || len(args.Key) > 63 || strings.ContainsAny(args.Key, "\n\x00") {
+			return invalidArgs("key must be 8-63 characters")
+		}
+	}
+	if args.VLAN < 0 || args.VLAN > 4094 {
+		return invalidArgs("vlan must be between 1 and 4094")
+	}
+	if args.VLAN > 0 {
+		if !devicePattern.MatchString(args.VLANDevice) || len(args.VLANDevice)+len(strconv.Itoa(args.VLAN))+1 > 15 {
+			return invalidArgs("invalid vlanDevice: %q", args.VLANDevice)
+		}
+		if _, err := os.Stat("/sys/class/net/" + args.VLANDevice); err != nil {
+			return invalidArgs("unknown vlanDevice: %q", args.VLANDevice)
+		}
+	} else if args.VLANDevice != "" {
+		return invalidArgs("vlanDevice requires vlan")
+	}
+
+	ip, subnet, err := net.ParseCIDR(args.Address)
+	if err != nil || ip.To4() == nil {
+		return invalidArgs("address must be an IPv4 address in CIDR form, e.g. 10.20.0.1/24")
+	}
+	ones, _ := subnet.Mask.Size()
+	if ones < 8 || ones > 30 || ip.Equal(subnet.IP) {
+		return invalidArgs("address must be a host address in a /8 to /30 network")
+	}
+	hosts := 1<<(32-ones) - 2
+	if args.DHCPStart == 0 {
+		args.DHCPStart = 100
+		if args.DHCPStart >= hosts {
+			args.DHCPStart = 2
+		}
+	}
+	if args.DHCPLimit == 0 {
+		args.DHCPLimit = hosts - args.DHCPStart
+		if args.DHCPLimit > 150 {
+			args.DHCPLimit = 150
+		}
+	}
+	if args.DHCPStart < 1 || args.DHCPLimit < 1 || args.DHCPStart+args.DHCPLimit > hosts+1 {
+		return invalidArgs("dhcpStart and dhcpLimit must fit in %s", subnet)
+	}
+	ip4, base := ip.To4(), subnet.IP.To4()
+	offset := int(ip4[0]^base[0])<<24 | int(ip4[1]^base[1])<<16 | int(ip4[2]^base[2])<<8 | int(ip4[3]^base[3])
+	if offset >= args.DHCPStart && offset < args.DHCPStart+args.DHCPLimit {
+		return invalidArgs("the DHCP pool must not contain the router address %s", ip)
+	}
+	if args.LeaseTime == "" {
+		args.LeaseTime = defaultGuestLeaseTime
+	}
+	if !leaseTimePattern.MatchString(args.LeaseTime) {
+		return invalidArgs("invalid leaseTime: %q", args.LeaseTime)
+	}
+
+	if args.WANZone == "" {
+		args.WANZone = defaultGuestWANZone
+	}
+	zones, err := firewallZones()
+	if err != nil {
+		return err
+	}
+	if err := validateZone(zones, args.WANZone, false); err != nil {
+		return err
+	}
+	if args.Portal {
+		if args.PortalAuth == "" {
+			args.PortalAuth = defaultGuestPortal
+		}
+		if !guestPortalModes[args.PortalAuth] {
+			return invalidArgs("unsupported portalAuth: %q", args.PortalAuth)
+		}
+		if _, err := os.Stat(uciConfigDir + "/uspot"); err != nil {
+			return Errorf(CodeUnavailable, "uspot is not installed")
+		}
+	} else if args.PortalAuth != "" {
+		return invalidArgs("portalAuth requires portal")
+	}
+
+	radios, err := uci.SectionsOfType("wireless", "wifi-device")
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, r := range radios {
+		known[r.Name] = true
+	}
+	if len(args.Radios) == 0 {
+		for _, r := range radios {
+			args.Radios = append(args.Radios, r.Name)
+		}
+		if len(args.Radios) == 0 {
+			return Errorf(CodeUnavailable, "no radios configured")
+		}
+	}
+	for _, r := range args.Radios {
+		if !known[r] {
+			return invalidArgs("unknown radio: %q", r)
+		}
+	}
+	return nil
+}
+
+// checkGuestConflicts rejects a name or subnet already used outside the guest
+// network being (re)provisioned
+func checkGuestConflicts(args GuestNetworkArgs, existing []string) error {
+	if len(existing) > 0 && !args.Replace {
+		return invalidArgs("guest network %q already exists (%s); set replace to reprovision it", args.Name, strings.Join(existing, ", "))
+	}
+	zones, err := uci.SectionsOfType("firewall", "zone")
+	if err != nil {
+		return err
+	}
+	for _, z := range zones {
+		if z.Option("name") == args.Name && z.Name != args.Name+"_zone" {
+			return invalidArgs("firewall zone %q already exists (%s)", args.Name, z.Name)
+		}
+	}
+
+	_, subnet, _ := net.ParseCIDR(args.Address)
+	ifaces, err := uci.SectionsOfType("network", "interface")
+	if err != nil {
+		return err
+	}
+	for _, iface := range ifaces {
+		if iface.Name == args.Name || iface.Option("proto") != "static" {
+			continue
+		}
+		for _, addr := range iface.Options["ipaddr"] {
+			other := interfaceSubnet(addr, iface.Option("netmask"))
+			if other != nil && (other.Contains(subnet.IP) || subnet.Contains(other.IP)) {
+				return invalidArgs("address %s overlaps interface %s (%s)", args.Address, iface.Name, other)
+			}
+		}
+	}
+	return nil
+}
+
+// interfaceSubnet parses a static ipaddr in either CIDR or address plus netmask form
+func interfaceSubnet(addr, netmask string) *net.IPNet {
+	if _, subnet, err := net.ParseCIDR(addr); err == nil {
+		return subnet
+	}
+	ip := net.ParseIP(addr).To4()
+	mask := net.ParseIP(netmask).To4()
+	if ip == nil {
+		return nil
+	}
+	if mask == nil {
+		mask = net.IPv4(255, 255, 255, 0).To4()
+	}
+	return &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+}
+
+func buildGuestChanges(args GuestNetworkArgs) guestChanges {
+	var c guestChanges
+	name := args.Name
+	bridge := "br-" + name
+
+	if args.VLAN > 0 {
+		port := fmt.Sprintf("%s.%d", args.VLANDevice, args.VLAN)
+		c.set("network", name+"_vlan", "", "device")
+		c.set("network", name+"_vlan", "type", "8021q")
+		c.set("network", name+"_vlan", "ifname", args.VLANDevice)
+		c.set("network", name+"_vlan", "vid", strconv.Itoa(args.VLAN))
+		c.set("network", name+"_vlan", "name", port)
+		c.set("network", name+"_dev", "", "device")
+		c.set("network", name+"_dev", "type", "bridge")
+		c.set("network", name+"_dev", "name", bridge)
+		c.addList("network", name+"_dev", "ports", port)
+	} else {
+		// Wi-Fi only: an empty bridge the wifi-ifaces join
+		c.set("network", name+"_dev", "", "device")
+		c.set("network", name+"_dev", "type", "bridge")
+		c.set("network", name+"_dev", "name", bridge)
+		c.set("network", name+"_dev", "bridge_empty", "1")
+	}
+	ip, subnet, _ := net.ParseCIDR(args.Address)
+	c.set("network", name, "", "interface")
+	c.set("network", name, "proto", "static")
+	c.set("network", name, "device", bridge)
+	c.set("network", name, "ipaddr", ip.String())
+	c.set("network", name, "netmask", net.IP(subnet.Mask).String())
+
+	isolate := "1"
+	if args.Isolate != nil && !*args.Isolate {
+		isolate = "0"
+	}
+	for _, radio := range args.Radios {
+		section := name + "_" + radio
+		c.set("wireless", section, "", "wifi-iface")
+		c.set("wireless", section, "device", radio)
+		c.set("wireless", section, "mode", "ap")
+		c.set("wireless", section, "network", name)
+		c.set("wireless", section, "ssid", args.SSID)
+		c.set("wireless", section, "encryption", args.Encryption)
+		if args.Key != "" {
+			c.set("wireless", section, "key", args.Key)
+		}
+		c.set("wireless", section, "isolate", isolate)
+	}
+
+	c.set("dhcp", name, "", "dhcp")
+	c.set("dhcp", name, "interface", name)
+	c.set("dhcp", name, "start", strconv.Itoa(args.DHCPStart))
+	c.set("dhcp", name, "limit", strconv.Itoa(args.DHCPLimit))
+	c.set("dhcp", name, "leasetime", args.LeaseTime)
+
+	// Guests reach the router only for DHCP and DNS, and nothing but the WAN
+	// zone beyond it; fw4 rejects forwarding into other zones by default
+	c.set("firewall", name+"_zone", "", "zone")
+	c.set("firewall", name+"_zone", "name", name)
+	c.addList("firewall", name+"_zone", "network", name)
+	c.set("firewall", name+"_zone", "input", "REJECT")
+	c.set("firewall", name+"_zone", "output", "ACCEPT")
+	c.set("firewall", name+"_zone", "forward", "REJECT")
+	c.set("firewall", name+"_fwd", "", "forwarding")
+	c.set("firewall", name+"_fwd", "src", name)
+	c.set("firewall", name+"_fwd", "dest", args.WANZone)
+	c.set("firewall", name+"_dhcp", "", "rule")
+	c.set("firewall", name+"_dhcp", "name", "Allow-"+name+"-DHCP")
+	c.set("firewall", name+"_dhcp", "src", name)
+	c.set("firewall", name+"_dhcp", "proto", "udp")
+	c.set("firewall", name+"_dhcp", "dest_port", "67-68")
+	c.set("firewall", name+"_dhcp", "family", "ipv4")
+	c.set("firewall", name+"_dhcp", "target", "ACCEPT")
+	c.set("firewall", name+"_dns", "", "rule")
+	c.set("firewall", name+"_dns", "name", "Allow-"+name+"-DNS")
+	c.set("firewall", name+"_dns", "src", name)
+	c.set("firewall", name+"_dns", "proto", "tcp udp")
+	c.set("firewall", name+"_dns", "dest_port", "53")
+	c.set("firewall", name+"_dns", "target", "ACCEPT")
+
+	if args.Portal {
+		c.set("uspot", name, "", "uspot")
+		c.set("uspot", name, "interface", name)
+		c.set("uspot", name, "auth_mode", args.PortalAuth)
+	}
+	return c
+}
+
+func guestReload(sections []string, portal bool) []string {
+	reload := []string{"network", "dnsmasq", "firewall"}
+	if portal {
+		return append(reload, "uspot")
+	}
+	for _, s := range sections {
+		if strings.HasPrefix(s, "uspot.") {
+			return append(reload, "uspot")
+		}
+	}
+	return reload
+}
+
+func provisionGuest(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args GuestNetworkArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := validateGuestNetwork(&args); err != nil {
+		return nil, err
+	}
+	existing, err := guestSections(args.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkGuestConflicts(args, existing); err != nil {
+		return nil, err
+	}
+
+	// Reprovisioning starts from scratch so options of the previous
+	// version (e.g. a key, a dropped radio) do not survive
+	changes := append(deleteChanges(existing), buildGuestChanges(args)...)
+	apply := ConfigApplyArgs{
+		Changes:         changes,
+		Reload:          guestReload(existing, args.Portal),
+		RollbackTimeout: args.RollbackTimeout,
+	}
+	if args.DryRun {
+		return map[string]interface{}{"name": args.Name, "changes": apply.Changes, "reload": apply.Reload}, nil
+	}
+	result, err := applyChanges(ctx, apply)
+	if result != nil {
+		result["name"] = args.Name
+		result["radios"] = args.Radios
+	}
+	return result, err
+}
+
+func removeGuest(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args GuestNameArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if !guestNamePattern.MatchString(args.Name) {
+		return nil, invalidArgs("invalid name: %q", args.Name)
+	}
+	existing, err := guestSections(args.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) == 0 {
+		return nil, Errorf(CodeNotFound, "no guest network named %q", args.Name)
+	}
+	result, err := applyChanges(ctx, ConfigApplyArgs{
+		Changes:         deleteChanges(existing),
+		Reload:          guestReload(existing, false),
+		RollbackTimeout: args.RollbackTimeout,
+	})
+	if result != nil {
+		result["removed"] = existing
+	}
+	return result, err
+}
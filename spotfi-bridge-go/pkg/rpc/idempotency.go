@@ -0,0 +1,149 @@
+package rpc
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Bounds of the responses kept for duplicates; the ones closest to expiring go
+// first, so a burst of requests cannot hold the router's memory for the window
+const (
+	maxIdempotencyEntries = 1024
+	maxIdempotencyBytes   = 2 << 20
+)
+
+// readOnlyMethods only read state, whether they are built-in operations or ubus
+// methods. Their responses are kept for duplicates only when the request carries
+// an explicit idempotencyKey
+var readOnlyMethods = map[string]bool{
+	"get": true, "list": true, "status": true, "result": true, "query": true, "periods": true,
+	"pending": true, "last": true, "processes": true, "downtime": true, "check": true, "info": true,
+	"board": true, "dump": true, "devices": true, "scan": true, "leases": true, "assoclist": true,
+	"ping": true, "traceroute": true, "dns": true, "http": true,
+}
+
+// idempotent reports whether the response of req is kept to answer duplicates
+func idempotent(req RPCRequest) bool {
+	return req.IdempotencyKey != "" || !readOnlyMethods[req.Method]
+}
+
+// responseCache remembers recent responses by idempotency key so that MQTT
+// redeliveries and API retries do not execute a mutating call twice
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+	bytes   int // Encoded size of the stored responses
+}
+
+type cachedResponse struct {
+	response *Response
+	size     int
+	expires  time.Time
+	done     chan struct{} // closed once response is set
+}
+
+var responses = &responseCache{entries: map[string]*cachedResponse{}}
+
+// begin reserves key for execution. If the key was already executed (or is
+// still executing) it waits for and returns that response instead.
+func (c *responseCache) begin(key string) (*Response, bool) {
+	if key == "" {
+		return nil, false
+	}
+
+	for {
+		c.mu.Lock()
+		c.pruneLocked()
+		entry, ok := c.entries[key]
+		if !ok {
+			c.entries[key] = &cachedResponse{done: make(chan struct{})}
+			c.mu.Unlock()
+			return nil, false
+		}
+		c.mu.Unlock()
+
+		<-entry.done
+		if entry.response != nil {
+			return entry.response, true
+		}
+		// The original attempt was aborted; try to reserve the key again
+	}
+}
+
+// finish stores the response for key and releases waiting duplicates
+func (c *responseCache) finish(key string, response *Response) {
+	if key == "" {
+		return
+	}
+
+	size := len(key)
+	if data, err := json.Marshal(response); err == nil {
+		size += len(data)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		entry.response = response
+		entry.size = size
+		entry.expires = time.Now().Add(options.IdempotencyWindow)
+		c.bytes += size
+		close(entry.done)
+	}
+	c.evictLocked()
+}
+
+// abort releases a reserved key without caching, letting waiting duplicates retry
+func (c *responseCache) abort(key string) {
+	if key == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok && entry.response == nil {
+		delete(c.entries, key)
+		close(entry.done)
+	}
+}
+
+func (c *responseCache) pruneLocked() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			c.removeLocked(key, entry)
+		}
+	}
+}
+
+// evictLocked drops the stored responses closest to expiring until the cache is
+// within its bounds. Keys still executing are never dropped
+func (c *responseCache) evictLocked() {
+	for len(c.entries) > maxIdempotencyEntries || c.bytes > maxIdempotencyBytes {
+		var oldestKey string
+		var oldest *cachedResponse
+		for key, entry := range c.entries {
+			if entry.response != nil && (oldest == nil || entry.expires.Before(oldest.expires)) {
+				oldestKey, oldest = key, entry
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		c.removeLocked(oldestKey, oldest)
+	}
+}
+
+func (c *responseCache) removeLocked(key string, entry *cachedResponse) {
+	delete(c.entries, key)
+	c.bytes -= entry.size
+}
+
+// duplicateResponse copies a cached response for a repeated request
+func duplicateResponse(cached *Response, id string) *Response {
+	response := *cached
+	response.ID = id
+	response.Duplicate = true
+	return &response
+}
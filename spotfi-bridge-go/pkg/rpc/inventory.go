@@ -0,0 +1,41 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"spotfi-bridge/pkg/inventory"
+)
+
+func init() {
+	register("spotfi.inventory", "get", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args struct {
+			Rescan bool `json:"rescan"` // Read the neighbor table now instead of returning the last scan
+		}
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if args.Rescan {
+			inventory.Scan()
+		}
+		inv, ok := inventory.Current()
+		if !ok {
+			return nil, Errorf(CodeNotFound, "device inventory is disabled")
+		}
+		return inv, nil
+	})
+	register("spotfi.inventory", "discover", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		if _, ok := inventory.Current(); !ok {
+			return nil, Errorf(CodeNotFound, "device inventory is disabled")
+		}
+		inv, err := inventory.Discover(ctx)
+		if errors.Is(err, inventory.ErrDiscoveryDisabled) {
+			return nil, Errorf(CodeUnavailable, "%v", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return inv, nil
+	})
+}
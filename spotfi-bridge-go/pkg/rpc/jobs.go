@@ -0,0 +1,300 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+const (
+	jobRetention = 1 * time.Hour
+	maxJobs      = 50
+)
+
+// Job is an RPC executed in the background; its updates are published on the jobs topic
+type Job struct {
+	ID         string                 `json:"jobId"`
+	Path       string                 `json:"path"`
+	Method     string                 `json:"method"`
+	State      string                 `json:"state"`
+	Progress   map[string]interface{} `json:"progress,omitempty"`
+	CreatedAt  int64                  `json:"createdAt"`
+	StartedAt  int64                  `json:"startedAt,omitempty"`
+	FinishedAt int64                  `json:"finishedAt,omitempty"`
+	Result     *Response              `json:"result,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// JobSubmitArgs are the arguments of spotfi.job/submit
+type JobSubmitArgs struct {
+	Path   string          `json:"path"`
+	Method string          `json:"method"`
+	Args   json.RawMessage `json:"args"`
+}
+
+// JobArgs identify a job for status/result/cancel
+type JobArgs struct {
+	JobID string `json:"jobId"`
+}
+
+var jobs = struct {
+	mu   sync.Mutex
+	byID map[string]*Job
+}{byID: map[string]*Job{}}
+
+type progressKey struct{}
+
+func init() {
+	register("spotfi.job", "submit", submitJob)
+	register("spotfi.job", "status", jobStatus)
+	register("spotfi.job", "result", jobStatus)
+	register("spotfi.job", "cancel", cancelJob)
+	register("spotfi.job", "list", listJobs)
+}
+
+// reportProgress publishes a progress update when running inside a job; it is a no-op otherwise
+func reportProgress(ctx context.Context, progress map[string]interface{}) {
+	if fn, ok := ctx.Value(progressKey{}).(func(map[string]interface{})); ok {
+		fn(progress)
+	}
+}
+
+func submitJob(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args JobSubmitArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Path == "" || args.Method == "" {
+		return nil, invalidArgs("path and method are required")
+	}
+	if args.Path == "spotfi.job" {
+		return nil, invalidArgs("jobs cannot submit jobs")
+	}
+
+	job, jobCtx, err := newJob(args.Path, args.Method)
+	if err != nil {
+		return nil, err
+	}
+	inFlight.Add(1)
+	go runJob(jobCtx, job, RPCRequest{ID: job.ID, Path: args.Path, Method: args.Method, Args: args.Args})
+
+	return map[string]interface{}{"jobId": job.ID, "state": JobQueued}, nil
+}
+
+// newJob registers a queued job and publishes it; runJob executes it
+func newJob(path, method string) (*Job, context.Context, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, nil, err
+	}
+	// Jobs outlive the submitting request, so they don't inherit its context
+	jobCtx, cancel := context.WithCancel(options.Context)
+	job := &Job{
+		ID:        "job-" + hex.EncodeToString(buf),
+		Path:      path,
+		Method:    method,
+		State:     JobQueued,
+		CreatedAt: time.Now().Unix(),
+		cancel:    cancel,
+	}
+
+	jobs.mu.Lock()
+	pruneJobsLocked()
+	jobs.byID[job.ID] = job
+	jobs.mu.Unlock()
+
+	publishJob(job)
+	return job, jobCtx, nil
+}
+
+// runJob executes a job from newJob once an execution slot is free, so jobs
+// count against MaxConcurrent like requests; inFlight must have been incremented for it
+func runJob(ctx context.Context, job *Job, req RPCRequest) {
+	defer inFlight.Done()
+	defer crash.Catch("rpc job")
+	defer job.cancel()
+
+	release, err := waitSlot(ctx)
+	if err != nil {
+		// Cancelled, or the bridge stopped, while queued
+		jobs.mu.Lock()
+		changed := job.State != JobCancelled
+		if changed {
+			job.State = JobCancelled
+			job.FinishedAt = time.Now().Unix()
+		}
+		jobs.mu.Unlock()
+		if changed {
+			publishJob(job)
+		}
+		return
+	}
+	defer release()
+
+	jobs.mu.Lock()
+	if job.State == JobCancelled {
+		jobs.mu.Unlock()
+		return
+	}
+	job.State = JobRunning
+	job.StartedAt = time.Now().Unix()
+	jobs.mu.Unlock()
+	publishJob(job)
+	rpcCounters.currentlyExecuting.Add(1)
+	defer rpcCounters.currentlyExecuting.Add(-1)
+
+	ctx = context.WithValue(ctx, progressKey{}, func(progress map[string]interface{}) {
+		jobs.mu.Lock()
+		job.Progress = progress
+		jobs.mu.Unlock()
+		publishJob(job)
+	})
+
+	// Intermediate messages of streaming handlers go to the jobs topic as well
+	emit := func(v interface{}) error {
+		if options.PublishJob == nil {
+			return nil
+		}
+		return options.PublishJob(map[string]interface{}{
+			"type":    "job-message",
+			"jobId":   job.ID,
+			"message": v,
+		})
+	}
+	resp := execute(ctx, req, emit)
+
+	jobs.mu.Lock()
+	job.FinishedAt = time.Now().Unix()
+	job.Result = resp
+	switch {
+	case ctx.Err() == context.Canceled:
+		job.State = JobCancelled
+	case resp.Status == "success":
+		job.State = JobSucceeded
+	default:
+		job.State = JobFailed
+	}
+	jobs.mu.Unlock()
+	publishJob(job)
+}
+
+// publishJob sends the current job state on the jobs topic
+func publishJob(job *Job) {
+	if options.PublishJob == nil {
+		return
+	}
+	jobs.mu.Lock()
+	update := map[string]interface{}{
+		"type": "job-update",
+		"job":  *job,
+	}
+	jobs.mu.Unlock()
+	if err := options.PublishJob(update); err != nil {
+		logger.Error("Failed to publish job update", "job", job.ID, "error", err)
+	}
+}
+
+func findJob(raw json.RawMessage) (*Job, error) {
+	var args JobArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	job, ok := jobs.byID[args.JobID]
+	if !ok {
+		return nil, Errorf(CodeNotFound, "job not found: %s", args.JobID)
+	}
+	return job, nil
+}
+
+func jobStatus(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	job, err := findJob(raw)
+	if err != nil {
+		return nil, err
+	}
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	return *job, nil
+}
+
+func cancelJob(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	job, err := findJob(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs.mu.Lock()
+	cancelled := false
+	switch job.State {
+	case JobQueued:
+		job.State = JobCancelled
+		job.FinishedAt = time.Now().Unix()
+		cancelled = true
+	case JobRunning:
+		cancelled = true
+	}
+	jobs.mu.Unlock()
+
+	if cancelled {
+		job.cancel()
+	}
+	return map[string]interface{}{"jobId": job.ID, "cancelled": cancelled}, nil
+}
+
+func listJobs(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	list := make([]Job, 0, len(jobs.byID))
+	for _, job := range jobs.byID {
+		summary := *job
+		summary.Result = nil // Fetch via spotfi.job/result to keep the list small
+		list = append(list, summary)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt > list[j].CreatedAt })
+	return map[string]interface{}{"jobs": list}, nil
+}
+
+// pruneJobsLocked drops finished jobs past their retention and caps the table size
+func pruneJobsLocked() {
+	now := time.Now()
+	var finished []*Job
+	for id, job := range jobs.byID {
+		if job.FinishedAt == 0 {
+			continue
+		}
+		if now.Sub(time.Unix(job.FinishedAt, 0)) > jobRetention {
+			delete(jobs.byID, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+
+	if len(jobs.byID) < maxJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt < finished[j].FinishedAt })
+	for _, job := range finished {
+		if len(jobs.byID) < maxJobs {
+			break
+		}
+		delete(jobs.byID, job.ID)
+	}
+}
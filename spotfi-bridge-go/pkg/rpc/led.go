@@ -0,0 +1,176 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ledClassDir         = "/sys/class/leds"
+	defaultLocateTime   = 30 * time.Second
+	maxLocateTime       = 10 * time.Minute
+	locateBlinkInterval = "150" // ms on and off
+)
+
+// LocateArgs are the arguments of spotfi.led/locate
+type LocateArgs struct {
+	Duration int  `json:"duration"` // Seconds, defaults to 30
+	Beep     bool `json:"beep"`     // Also drive buzzer/beeper LEDs if the board has one
+}
+
+// ledState is what gets restored when locating ends
+type ledState struct {
+	Name       string
+	Trigger    string
+	Brightness string
+}
+
+var locate struct {
+	mu     sync.Mutex
+	saved  []ledState
+	timer  *time.Timer
+	endsAt time.Time
+}
+
+func init() {
+	register("spotfi.led", "locate", startLocate)
+	register("spotfi.led", "stop", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		locate.mu.Lock()
+		defer locate.mu.Unlock()
+		active := locate.timer != nil
+		stopLocateLocked()
+		return map[string]interface{}{"stopped": active}, nil
+	})
+}
+
+func readLED(name, attr string) string {
+	b, _ := os.ReadFile(filepath.Join(ledClassDir, name, attr))
+	return strings.TrimSpace(string(b))
+}
+
+func writeLED(name, attr, value string) error {
+	return os.WriteFile(filepath.Join(ledClassDir, name, attr), []byte(value), 0644)
+}
+
+// activeTrigger extracts the bracketed entry of a trigger list such as "none [timer] heartbeat"
+func activeTrigger(list string) (string, bool) {
+	active, timer := "none", false
+	for _, t := range strings.Fields(list) {
+		if strings.HasPrefix(t, "[") {
+			t = strings.Trim(t, "[]")
+			active = t
+		}
+		timer = timer || t == "timer"
+	}
+	return active, timer
+}
+
+func isBeeper(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "buzzer") || strings.Contains(name, "beep")
+}
+
+// startLocate blinks every LED with the kernel timer trigger and restores the
+// previous triggers after the duration. Calling it again extends the blinking
+func startLocate(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args LocateArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	duration := defaultLocateTime
+	if args.Duration != 0 {
+		duration = time.Duration(args.Duration) * time.Second
+	}
+	if duration <= 0 || duration > maxLocateTime {
+		return nil, invalidArgs("duration must be between 1 and %d seconds", int(maxLocateTime.Seconds()))
+	}
+
+	entries, err := os.ReadDir(ledClassDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, Errorf(CodeNotFound, "no LEDs on this device")
+		}
+		return nil, err
+	}
+
+	locate.mu.Lock()
+	defer locate.mu.Unlock()
+
+	if locate.timer == nil {
+		for _, e := range entries {
+			name := e.Name()
+			if isBeeper(name) && !args.Beep {
+				continue
+			}
+			trigger, hasTimer := activeTrigger(readLED(name, "trigger"))
+			if !hasTimer {
+				continue
+			}
+			state := ledState{Name: name, Trigger: trigger, Brightness: readLED(name, "brightness")}
+			if err := writeLED(name, "trigger", "timer"); err != nil {
+				logger.Warn("LED blink failed", "led", name, "error", err)
+				continue
+			}
+			writeLED(name, "delay_on", locateBlinkInterval)
+			writeLED(name, "delay_off", locateBlinkInterval)
+			locate.saved = append(locate.saved, state)
+		}
+		if len(locate.saved) == 0 {
+			return nil, Errorf(CodeNotFound, "no LED supports the timer trigger")
+		}
+	} else {
+		locate.timer.Stop()
+	}
+
+	locate.endsAt = time.Now().Add(duration)
+	locate.timer = time.AfterFunc(duration, func() {
+		locate.mu.Lock()
+		defer locate.mu.Unlock()
+		stopLocateLocked()
+	})
+
+	leds := make([]string, 0, len(locate.saved))
+	for _, s := range locate.saved {
+		leds = append(leds, s.Name)
+	}
+	return map[string]interface{}{
+		"leds":   leds,
+		"endsAt": locate.endsAt.Unix(),
+	}, nil
+}
+
+// stopLocateLocked restores the saved LED triggers and brightness
+func stopLocateLocked() {
+	if locate.timer != nil {
+		locate.timer.Stop()
+		locate.timer = nil
+	}
+	if len(locate.saved) == 0 {
+		return
+	}
+	for _, s := range locate.saved {
+		if err := writeLED(s.Name, "trigger", s.Trigger); err != nil {
+			logger.Error("Failed to restore LED", "led", s.Name, "error", err)
+			continue
+		}
+		// Brightness only matters for LEDs without an active trigger
+		if s.Trigger == "none" && s.Brightness != "" {
+			writeLED(s.Name, "brightness", s.Brightness)
+		}
+	}
+	locate.saved = nil
+
+	// Triggers like netdev lose their settings when reselected; the led init
+	// script re-applies the LEDs configured in /etc/config/system
+	if _, err := os.Stat("/etc/init.d/led"); err == nil {
+		if err := exec.Command("/etc/init.d/led", "restart").Run(); err != nil {
+			logger.Error("Failed to restart led service", "error", err)
+		}
+	}
+}
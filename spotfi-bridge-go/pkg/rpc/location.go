@@ -0,0 +1,36 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+
+	"spotfi-bridge/pkg/location"
+)
+
+func init() {
+	register("spotfi.location", "get", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		fix, ok := location.Current()
+		if !ok {
+			return nil, Errorf(CodeNotFound, "location reporting is disabled")
+		}
+		return fix, nil
+	})
+	register("spotfi.location", "status", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return location.Status(), nil
+	})
+	register("spotfi.location", "set_enabled", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if args.Enabled == nil {
+			return nil, invalidArgs("enabled is required")
+		}
+		if err := location.SetEnabled(*args.Enabled); err != nil {
+			return nil, err
+		}
+		return location.Status(), nil
+	})
+}
@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"spotfi-bridge/pkg/metrics"
+)
+
+// MetricsIntervalArgs are the arguments of spotfi.metrics/set_interval
+type MetricsIntervalArgs struct {
+	Interval    int `json:"interval"`    // Seconds, 0 restores the configured interval
+	RevertAfter int `json:"revertAfter"` // Seconds until the configured interval is restored, 0 to keep it
+}
+
+// ProcessesArgs are the arguments of spotfi.metrics/processes
+type ProcessesArgs struct {
+	Limit  int    `json:"limit"`  // Number of processes, default 10
+	Sort   string `json:"sort"`   // cpu (default) or memory
+	Window int    `json:"window"` // CPU sample window in milliseconds, default 1000
+}
+
+func init() {
+	register("spotfi.metrics", "get_interval", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return metrics.IntervalState(), nil
+	})
+	register("spotfi.metrics", "set_interval", setMetricsInterval)
+	register("spotfi.metrics", "processes", topProcesses)
+}
+
+func setMetricsInterval(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args MetricsIntervalArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	d := time.Duration(args.Interval) * time.Second
+	if args.Interval != 0 && (d < metrics.MinInterval || d > metrics.MaxInterval) {
+		return nil, invalidArgs("interval must be between %d and %d seconds",
+			int(metrics.MinInterval.Seconds()), int(metrics.MaxInterval.Seconds()))
+	}
+	if args.RevertAfter < 0 || time.Duration(args.RevertAfter)*time.Second > 24*time.Hour {
+		return nil, invalidArgs("revertAfter must be between 0 and 86400 seconds")
+	}
+	metrics.SetInterval(d, time.Duration(args.RevertAfter)*time.Second)
+	return metrics.IntervalState(), nil
+}
+
+func topProcesses(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	args := ProcessesArgs{Limit: 10, Sort: "cpu", Window: 1000}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Limit < 1 || args.Limit > 100 {
+		return nil, invalidArgs("limit must be between 1 and 100")
+	}
+	if args.Sort != "cpu" && args.Sort != "memory" {
+		return nil, invalidArgs("sort must be cpu or memory")
+	}
+	if args.Window < 100 || args.Window > 5000 {
+		return nil, invalidArgs("window must be between 100 and 5000 ms")
+	}
+	procs, err := metrics.TopProcesses(ctx, args.Limit, args.Sort, time.Duration(args.Window)*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"processes": procs, "sort": args.Sort, "windowMs": args.Window}, nil
+}
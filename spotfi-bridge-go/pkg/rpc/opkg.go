@@ -0,0 +1,77 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var packagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+._-]*$`)
+
+// OpkgArgs are the arguments of the spotfi.opkg operations
+type OpkgArgs struct {
+	Packages []string `json:"packages"`
+}
+
+func init() {
+	register("spotfi.opkg", "update", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return runOpkg(ctx, "update", nil)
+	})
+	for _, action := range []string{"install", "remove", "upgrade"} {
+		action := action
+		register("spotfi.opkg", action, func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+			var args OpkgArgs
+			if err := decodeArgs(raw, &args); err != nil {
+				return nil, err
+			}
+			if len(args.Packages) == 0 {
+				return nil, invalidArgs("packages is required")
+			}
+			for _, p := range args.Packages {
+				if !packagePattern.MatchString(p) {
+					return nil, invalidArgs("invalid package name: %q", p)
+				}
+			}
+			return runOpkg(ctx, action, args.Packages)
+		})
+	}
+}
+
+// runOpkg executes opkg, reporting each output line as job progress
+func runOpkg(ctx context.Context, action string, packages []string) (interface{}, error) {
+	cmd := exec.CommandContext(ctx, "opkg", append([]string{action}, packages...)...)
+	var output bytes.Buffer
+	pipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	// stderr goes into the same pipe, so only the scanner below writes to output
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(pipe)
+	for scanner.Scan() {
+		line := scanner.Text()
+		output.WriteString(line + "\n")
+		lines++
+		reportProgress(ctx, map[string]interface{}{"line": line, "lines": lines})
+	}
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	result := map[string]interface{}{
+		"action":   action,
+		"packages": packages,
+		"output":   strings.TrimSpace(output.String()),
+	}
+	return result, err
+}
@@ -0,0 +1,45 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"spotfi-bridge/pkg/plugins"
+)
+
+// pluginPrefix is the path prefix of the RPC namespaces registered by plugins
+const pluginPrefix = "plugin."
+
+func init() {
+	register("spotfi.plugin", "list", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"plugins": plugins.List()}, nil
+	})
+}
+
+// callPlugin forwards a request for plugin.<name> to the plugin
+func callPlugin(ctx context.Context, req RPCRequest) *Response {
+	result, err := plugins.Call(ctx, strings.TrimPrefix(req.Path, pluginPrefix), req.Method, req.Args)
+	var pluginErr *plugins.Error
+	switch {
+	case errors.Is(err, plugins.ErrUnknown):
+		err = Errorf(CodeNotFound, "unknown plugin method: %s.%s", req.Path, req.Method)
+	case errors.As(err, &pluginErr):
+		err = &Error{Code: codeForName(pluginErr.Code), Message: pluginErr.Error(), Details: pluginErr.Details}
+	}
+	if len(result) == 0 {
+		return newResponse(req.ID, nil, err)
+	}
+	return newResponse(req.ID, result, err)
+}
+
+// codeForName maps a code name reported by a plugin to its ErrorCode
+func codeForName(name string) ErrorCode {
+	for code, n := range codeNames {
+		if n == name && code != CodeOK {
+			return code
+		}
+	}
+	return CodeExecError
+}
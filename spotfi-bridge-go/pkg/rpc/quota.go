@@ -0,0 +1,576 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/ubus"
+)
+
+const (
+	// QuotaFile keeps the client quotas with their consumption
+	QuotaFile = "/etc/spotfi/quotas.json"
+
+	maxQuotas          = 1000
+	maxQuotaEvents     = 100 // Events kept while the broker is unreachable
+	quotaPollInterval  = 30 * time.Second
+	quotaSaveInterval  = 5 * time.Minute // Consumption is saved at most this often, sparing the flash
+	defaultWarnPercent = 80
+	defaultThrottle    = 128 // kbit/s in each direction once a throttled quota is used up
+)
+
+// Quota actions at 100% of the quota
+const (
+	QuotaCutoff   = "cutoff"
+	QuotaThrottle = "throttle"
+)
+
+// Quota periods after which consumption starts over
+const (
+	QuotaPeriodNone    = ""
+	QuotaPeriodDaily   = "daily"
+	QuotaPeriodWeekly  = "weekly"
+	QuotaPeriodMonthly = "monthly"
+)
+
+// ClientQuota limits the rate and data volume of one portal client, across its sessions
+type ClientQuota struct {
+	Mac       string `json:"mac"`
+	Interface string `json:"interface"` // uspot instance, defaults to "uspot"
+
+	// Rate limits applied whenever the client is authorized; 0 leaves a direction unlimited
+	UploadKbit   int `json:"uploadKbit,omitempty"`
+	DownloadKbit int `json:"downloadKbit,omitempty"`
+
+	// QuotaBytes is the data volume up and down per period; 0 only applies rate limits
+	QuotaBytes int64  `json:"quotaBytes,omitempty"`
+	Period     string `json:"period,omitempty"` // daily, weekly (from Monday) or monthly; none when empty
+	TZ         string `json:"tz,omitempty"`     // Where periods start at midnight; UTC when empty
+
+	// Action at the quota: cutoff ends the session (and any later one in the period),
+	// throttle limits the client to the throttle rates instead
+	Action               string `json:"action,omitempty"`
+	ThrottleUploadKbit   int    `json:"throttleUploadKbit,omitempty"`
+	ThrottleDownloadKbit int    `json:"throttleDownloadKbit,omitempty"`
+	WarnPercent          int    `json:"warnPercent,omitempty"` // Default 80; 100 sends no warning
+
+	UsedBytes   int64 `json:"usedBytes"`
+	PeriodStart int64 `json:"periodStart,omitempty"`
+	Warned      bool  `json:"warned,omitempty"`
+	ExceededAt  int64 `json:"exceededAt,omitempty"`
+	UpdatedAt   int64 `json:"updatedAt"`
+
+	// LastCounter is the uspot byte counter of the current session at the last poll,
+	// kept so a restart does not count the session twice
+	LastCounter int64 `json:"lastCounter,omitempty"`
+
+	loc     *time.Location
+	applied string // Rate limits applied in the current session: "", normal or throttle
+}
+
+// QuotaEvent is published on the events/quota topic
+type QuotaEvent struct {
+	Type       string `json:"type"`  // Always "quota"
+	Event      string `json:"event"` // warning, exceeded or reset
+	Mac        string `json:"mac"`
+	Interface  string `json:"interface"`
+	UsedBytes  int64  `json:"usedBytes"`
+	QuotaBytes int64  `json:"quotaBytes"`
+	Action     string `json:"action,omitempty"`
+	Period     string `json:"period,omitempty"`
+	Ts         int64  `json:"ts"`
+}
+
+// QuotaArgs name a client for get, remove and reset
+type QuotaArgs struct {
+	Mac string `json:"mac"`
+}
+
+var quotas = struct {
+	mu      sync.Mutex
+	byMac   map[string]*ClientQuota
+	pending []QuotaEvent
+	dirty   bool
+	saved   time.Time
+}{byMac: map[string]*ClientQuota{}}
+
+func init() {
+	register("spotfi.quota", "set", setQuota)
+	register("spotfi.quota", "get", getQuota)
+	register("spotfi.quota", "list", listQuotas)
+	register("spotfi.quota", "remove", removeQuota)
+	register("spotfi.quota", "reset", resetQuota)
+}
+
+// prepareQuota validates q and fills in its defaults
+func prepareQuota(q *ClientQuota) error {
+	mac, err := normalizeMAC(q.Mac)
+	if err != nil {
+		return err
+	}
+	q.Mac = mac
+	if q.Interface == "" {
+		q.Interface = defaultPortalInterface
+	}
+	if !uciNamePattern.MatchString(q.Interface) {
+		return invalidArgs("invalid interface: %q", q.Interface)
+	}
+	if q.UploadKbit < 0 || q.DownloadKbit < 0 || q.QuotaBytes < 0 || q.ThrottleUploadKbit < 0 || q.ThrottleDownloadKbit < 0 {
+		return invalidArgs("limits must not be negative")
+	}
+	if q.QuotaBytes == 0 && q.UploadKbit == 0 && q.DownloadKbit == 0 {
+		return invalidArgs("a quota or a rate limit is required")
+	}
+	switch q.Period {
+	case QuotaPeriodNone, QuotaPeriodDaily, QuotaPeriodWeekly, QuotaPeriodMonthly:
+	default:
+		return invalidArgs("period must be daily, weekly, monthly or empty")
+	}
+	if q.loc, err = loadLocation(q.TZ); err != nil {
+		return invalidArgs("%v", err)
+	}
+	switch q.Action {
+	case "":
+		q.Action = QuotaCutoff
+	case QuotaCutoff, QuotaThrottle:
+	default:
+		return invalidArgs("action must be cutoff or throttle")
+	}
+	if q.Action == QuotaThrottle {
+		if q.ThrottleUploadKbit == 0 {
+			q.ThrottleUploadKbit = defaultThrottle
+		}
+		if q.ThrottleDownloadKbit == 0 {
+			q.ThrottleDownloadKbit = defaultThrottle
+		}
+	}
+	if q.WarnPercent == 0 {
+		q.WarnPercent = defaultWarnPercent
+	}
+	if q.WarnPercent < 1 || q.WarnPercent > 100 {
+		return invalidArgs("warnPercent must be between 1 and 100")
+	}
+	return nil
+}
+
+// periodStart returns the start of the period containing t
+func (q *ClientQuota) periodStart(t time.Time) time.Time {
+	t = t.In(q.loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, q.loc)
+	switch q.Period {
+	case QuotaPeriodDaily:
+		return day
+	case QuotaPeriodWeekly:
+		return day.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+	case QuotaPeriodMonthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, q.loc)
+	}
+	return time.Time{}
+}
+
+// setQuota creates or replaces the quota of a client. Its consumption is kept unless
+// the period changes, so the backend can push new limits mid-period
+func setQuota(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var q ClientQuota
+	if err := decodeArgs(raw, &q); err != nil {
+		return nil, err
+	}
+	if err := prepareQuota(&q); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	q.UsedBytes, q.Warned, q.ExceededAt, q.LastCounter = 0, false, 0, 0
+	q.UpdatedAt = now.Unix()
+	if q.Period != QuotaPeriodNone {
+		q.PeriodStart = q.periodStart(now).Unix()
+	}
+
+	quotas.mu.Lock()
+	old := quotas.byMac[q.Mac]
+	if old == nil && len(quotas.byMac) >= maxQuotas {
+		quotas.mu.Unlock()
+		return nil, invalidArgs("at most %d client quotas are allowed", maxQuotas)
+	}
+	if old != nil {
+		q.applied = old.applied // So the next poll lifts or changes them
+	}
+	if old != nil && old.Period == q.Period && old.PeriodStart == q.PeriodStart {
+		q.UsedBytes, q.LastCounter = old.UsedBytes, old.LastCounter
+		q.Warned = q.QuotaBytes > 0 && old.Warned && q.UsedBytes*100 >= q.QuotaBytes*int64(q.WarnPercent)
+		if q.QuotaBytes > 0 && q.UsedBytes >= q.QuotaBytes {
+			q.ExceededAt = old.ExceededAt
+		}
+	}
+	quotas.byMac[q.Mac] = &q
+	err := saveQuotasLocked()
+	result := q
+	quotas.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// Applies the limits now rather than at the next poll
+	go pollQuota(q.Mac)
+	return result, nil
+}
+
+func getQuota(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args QuotaArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	mac, err := normalizeMAC(args.Mac)
+	if err != nil {
+		return nil, err
+	}
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	q := quotas.byMac[mac]
+	if q == nil {
+		return nil, Errorf(CodeNotFound, "no quota for %s", mac)
+	}
+	return *q, nil
+}
+
+func listQuotas(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	return map[string]interface{}{"quotas": sortedQuotasLocked()}, nil
+}
+
+// removeQuota drops the quota of a client and lifts its rate limits
+func removeQuota(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args QuotaArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	mac, err := normalizeMAC(args.Mac)
+	if err != nil {
+		return nil, err
+	}
+	quotas.mu.Lock()
+	q := quotas.byMac[mac]
+	if q == nil {
+		quotas.mu.Unlock()
+		return nil, Errorf(CodeNotFound, "no quota for %s", mac)
+	}
+	delete(quotas.byMac, mac)
+	err = saveQuotasLocked()
+	applied := q.applied
+	quotas.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if applied != "" {
+		if err := clearClientRate(mac); err != nil {
+			logger.Warn("Failed to lift client rate limits", "mac", mac, "error", err)
+		}
+	}
+	return map[string]interface{}{"mac": mac, "removed": true}, nil
+}
+
+// resetQuota starts the consumption of a client over, e.g. after a top-up
+func resetQuota(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args QuotaArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	mac, err := normalizeMAC(args.Mac)
+	if err != nil {
+		return nil, err
+	}
+	quotas.mu.Lock()
+	q := quotas.byMac[mac]
+	if q == nil {
+		quotas.mu.Unlock()
+		return nil, Errorf(CodeNotFound, "no quota for %s", mac)
+	}
+	q.UsedBytes, q.Warned, q.ExceededAt = 0, false, 0
+	q.UpdatedAt = time.Now().Unix()
+	err = saveQuotasLocked()
+	result := *q
+	quotas.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	go pollQuota(mac)
+	return result, nil
+}
+
+// clearClientRate lifts the ratelimit shaping of a station
+func clearClientRate(mac string) error {
+	for _, obj := range stationInterfaces(mac) {
+		if _, err := ubus.Call("ratelimit", "client_delete", map[string]interface{}{
+			"device": strings.TrimPrefix(obj, "hostapd."), "address": mac,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartQuotas loads the saved quotas and enforces them until the RPC context is
+// cancelled. Call it after Configure
+func StartQuotas() {
+	if data, err := os.ReadFile(QuotaFile); err == nil {
+		var saved struct {
+			Quotas  []*ClientQuota `json:"quotas"`
+			Pending []QuotaEvent   `json:"pending"`
+		}
+		if err := json.Unmarshal(data, &saved); err != nil {
+			logger.Error("Ignoring corrupt quota file", "file", QuotaFile, "error", err)
+		} else {
+			quotas.mu.Lock()
+			for _, q := range saved.Quotas {
+				if err := prepareQuota(q); err != nil {
+					logger.Error("Ignoring invalid saved quota", "mac", q.Mac, "error", err)
+					continue
+				}
+				quotas.byMac[q.Mac] = q
+			}
+			quotas.pending = saved.Pending
+			quotas.saved = time.Now()
+			quotas.mu.Unlock()
+		}
+	}
+	go quotaLoop(options.Context)
+}
+
+func quotaLoop(ctx context.Context) {
+	defer crash.Recover("quotas")
+	ticker := time.NewTicker(quotaPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			quotas.mu.Lock()
+			if quotas.dirty {
+				saveQuotasLocked()
+			}
+			quotas.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+		quotas.mu.Lock()
+		macs := make([]string, 0, len(quotas.byMac))
+		for mac := range quotas.byMac {
+			macs = append(macs, mac)
+		}
+		quotas.mu.Unlock()
+		for _, mac := range macs {
+			if ctx.Err() != nil {
+				break
+			}
+			pollQuota(mac)
+		}
+		quotas.mu.Lock()
+		if quotas.dirty && time.Since(quotas.saved) >= quotaSaveInterval {
+			saveQuotasLocked()
+		}
+		quotas.mu.Unlock()
+	}
+}
+
+// pollQuota accounts the traffic of one client since the last poll and applies
+// its rate limits or the quota action
+func pollQuota(mac string) {
+	defer crash.Catch("quota poll")
+	quotas.mu.Lock()
+	q := quotas.byMac[mac]
+	if q == nil {
+		quotas.mu.Unlock()
+		return
+	}
+	args := PortalClientArgs{Mac: q.Mac, Interface: q.Interface}
+	quotas.mu.Unlock()
+
+	client, err := portalClient(args)
+	state, _ := numberField(client, "state")
+	authorized := err == nil && state == 1
+	in, out := portalOctets(client)
+	counter := int64(in + out)
+
+	now := time.Now()
+	var events []QuotaEvent
+	event := func(name string) {
+		events = append(events, QuotaEvent{
+			Type: "quota", Event: name, Mac: q.Mac, Interface: q.Interface, UsedBytes: q.UsedBytes,
+			QuotaBytes: q.QuotaBytes, Action: q.Action, Period: q.Period, Ts: now.Unix(),
+		})
+	}
+
+	quotas.mu.Lock()
+	if quotas.byMac[mac] != q {
+		quotas.mu.Unlock()
+		return // Replaced or removed meanwhile
+	}
+	if q.Period != QuotaPeriodNone {
+		if start := q.periodStart(now).Unix(); start != q.PeriodStart {
+			q.PeriodStart, q.UsedBytes, q.Warned, q.ExceededAt = start, 0, false, 0
+			quotas.dirty = true
+			event("reset")
+		}
+	}
+	if !authorized {
+		q.LastCounter, q.applied = 0, ""
+		quotas.mu.Unlock()
+		publishQuotaEvents(events)
+		return
+	}
+	delta := counter - q.LastCounter
+	if delta < 0 {
+		delta = counter // A new session started between two polls
+	}
+	if delta > 0 {
+		q.UsedBytes += delta
+		quotas.dirty = true
+	}
+	q.LastCounter = counter
+
+	if q.QuotaBytes > 0 {
+		if !q.Warned && q.WarnPercent < 100 && q.UsedBytes*100 >= q.QuotaBytes*int64(q.WarnPercent) && q.UsedBytes < q.QuotaBytes {
+			q.Warned = true
+			event("warning")
+		}
+		if q.ExceededAt == 0 && q.UsedBytes >= q.QuotaBytes {
+			q.Warned, q.ExceededAt = true, now.Unix()
+			quotas.dirty = true
+			event("exceeded")
+		}
+	}
+
+	exceeded := q.ExceededAt != 0
+	rate := PortalClientArgs{Mac: q.Mac, Interface: q.Interface, UploadKbit: q.UploadKbit, DownloadKbit: q.DownloadKbit}
+	want := ""
+	if q.UploadKbit > 0 || q.DownloadKbit > 0 {
+		want = "normal"
+	}
+	if exceeded && q.Action == QuotaThrottle {
+		want = "throttle"
+		rate.UploadKbit, rate.DownloadKbit = q.ThrottleUploadKbit, q.ThrottleDownloadKbit
+	}
+	cutoff := exceeded && q.Action == QuotaCutoff
+	used, previous := q.UsedBytes, q.applied
+	if want != "" {
+		q.applied = want
+	}
+	if len(events) > 0 {
+		saveQuotasLocked()
+	}
+	quotas.mu.Unlock()
+	publishQuotaEvents(events)
+
+	switch {
+	case cutoff:
+		// Also ends sessions started anew within the period
+		logger.Info("Client quota used up, ending session", "mac", mac, "used", used)
+		if err := DeauthorizePortalClient(mac, args.Interface); err != nil {
+			logger.Warn("Failed to end session at quota", "mac", mac, "error", err)
+		}
+	case want != "" && want != previous:
+		if err := setClientRate(rate); err != nil {
+			// Retried at the next poll, unless the client is not on Wi-Fi
+			var e *Error
+			if errors.As(err, &e) && e.Code == CodeNotFound {
+				logger.Debug("Client rate limits not applied", "mac", mac, "error", err)
+				break
+			}
+			logger.Warn("Failed to apply client rate limits", "mac", mac, "limits", want, "error", err)
+			quotas.mu.Lock()
+			q.applied = previous
+			quotas.mu.Unlock()
+		}
+	case want == "" && previous != "":
+		// A top-up or reset lifted the throttle and there are no normal limits
+		if err := clearClientRate(mac); err != nil {
+			logger.Warn("Failed to lift client rate limits", "mac", mac, "error", err)
+		}
+		quotas.mu.Lock()
+		q.applied = ""
+		quotas.mu.Unlock()
+	}
+}
+
+// publishQuotaEvents publishes events, keeping them for the next connect when the
+// broker is unreachable
+func publishQuotaEvents(events []QuotaEvent) {
+	for _, e := range events {
+		logger.Info("Client quota event", "mac", e.Mac, "event", e.Event, "used", e.UsedBytes, "quota", e.QuotaBytes)
+		Notify(e)
+		if options.PublishQuota != nil && (options.Connected == nil || options.Connected()) {
+			if err := options.PublishQuota(e); err == nil {
+				continue
+			}
+		}
+		quotas.mu.Lock()
+		quotas.pending = append(quotas.pending, e)
+		if len(quotas.pending) > maxQuotaEvents {
+			quotas.pending = quotas.pending[len(quotas.pending)-maxQuotaEvents:]
+		}
+		saveQuotasLocked()
+		quotas.mu.Unlock()
+	}
+}
+
+// flushQuotaEvents publishes the quota events kept while the broker was unreachable
+func flushQuotaEvents() {
+	defer crash.Catch("quota events")
+	if options.PublishQuota == nil {
+		return
+	}
+	quotas.mu.Lock()
+	events := quotas.pending
+	quotas.pending = nil
+	quotas.mu.Unlock()
+	for i, e := range events {
+		if err := options.PublishQuota(e); err != nil {
+			logger.Warn("Quota events not published, kept for retry", "events", len(events)-i, "error", err)
+			quotas.mu.Lock()
+			quotas.pending = append(events[i:], quotas.pending...)
+			saveQuotasLocked()
+			quotas.mu.Unlock()
+			return
+		}
+	}
+	if len(events) > 0 {
+		quotas.mu.Lock()
+		saveQuotasLocked()
+		quotas.mu.Unlock()
+	}
+}
+
+func sortedQuotasLocked() []*ClientQuota {
+	list := make([]*ClientQuota, 0, len(quotas.byMac))
+	for _, q := range quotas.byMac {
+		list = append(list, q)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Mac < list[j].Mac })
+	return list
+}
+
+// saveQuotasLocked writes QuotaFile; quotas.mu must be held
+func saveQuotasLocked() error {
+	data, err := json.Marshal(map[string]interface{}{"quotas": sortedQuotasLocked(), "pending": quotas.pending})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(QuotaFile), 0755)
+	}
+	if err == nil {
+		tmp := QuotaFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, QuotaFile)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save quotas", "error", err)
+		return Errorf(CodeInternal, "failed to save quotas: %v", err)
+	}
+	quotas.dirty, quotas.saved = false, time.Now()
+	return nil
+}
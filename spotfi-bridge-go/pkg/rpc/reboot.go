@@ -0,0 +1,204 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/metrics"
+)
+
+// RebootReasonFile persists the reason of a requested reboot across the restart.
+// It is written right before rebooting, and removed again if that fails
+const RebootReasonFile = "/etc/spotfi/reboot-reason.json"
+
+const (
+	rebootNonceTTL = 60 * time.Second
+	maxRebootDelay = 1 * time.Hour
+)
+
+// RebootArgs are the arguments of spotfi.system/reboot
+type RebootArgs struct {
+	Delay   int    `json:"delay"`   // Seconds to wait before rebooting
+	Reason  string `json:"reason"`  // Free-form reason reported in the next hello
+	Confirm string `json:"confirm"` // Nonce returned by the first (unconfirmed) call
+}
+
+// RebootRecord is what gets stored in RebootReasonFile
+type RebootRecord struct {
+	Reason      string `json:"reason"`
+	RequestedAt int64  `json:"requestedAt"`
+	RebootAt    int64  `json:"rebootAt"`
+
+	// BootID is the kernel boot ID the reboot was run from; a record still
+	// showing the current one is from a reboot that never happened
+	BootID string `json:"bootId,omitempty"`
+}
+
+var reboot struct {
+	mu      sync.Mutex
+	nonce   string
+	expires time.Time
+	args    RebootArgs
+	timer   *time.Timer
+}
+
+func init() {
+	register("spotfi.system", "reboot", requestReboot)
+	register("spotfi.system", "cancel_reboot", cancelReboot)
+}
+
+// requestReboot implements a two-step reboot: the first call returns a nonce,
+// the second call must echo it back in "confirm" with the same delay and reason.
+// Scheduled reboots were confirmed when their schedule was set and skip the nonce
+func requestReboot(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args RebootArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Delay < 0 || time.Duration(args.Delay)*time.Second > maxRebootDelay {
+		return nil, invalidArgs("delay must be between 0 and %d seconds", int(maxRebootDelay.Seconds()))
+	}
+
+	reboot.mu.Lock()
+	defer reboot.mu.Unlock()
+
+	if reboot.timer != nil {
+		return nil, fmt.Errorf("reboot already scheduled")
+	}
+
+	if name, ok := scheduleName(ctx); ok {
+		if args.Reason == "" {
+			args.Reason = "schedule " + name
+		}
+		record := scheduleRebootLocked(time.Duration(args.Delay)*time.Second, args.Reason)
+		return map[string]interface{}{"scheduled": true, "rebootAt": record.RebootAt, "reason": args.Reason}, nil
+	}
+
+	if args.Confirm == "" {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		reboot.nonce = hex.EncodeToString(buf)
+		reboot.expires = time.Now().Add(rebootNonceTTL)
+		reboot.args = args
+		return map[string]interface{}{
+			"confirmRequired": true,
+			"nonce":           reboot.nonce,
+			"expiresIn":       int(rebootNonceTTL.Seconds()),
+		}, nil
+	}
+
+	if reboot.nonce == "" || args.Confirm != reboot.nonce || time.Now().After(reboot.expires) {
+		return nil, Errorf(CodePermissionDenied, "invalid or expired confirmation nonce")
+	}
+	if args.Delay != reboot.args.Delay || args.Reason != reboot.args.Reason {
+		return nil, invalidArgs("confirmed request does not match the original request")
+	}
+	reboot.nonce = ""
+
+	record := scheduleRebootLocked(time.Duration(args.Delay)*time.Second, args.Reason)
+	return map[string]interface{}{
+		"scheduled": true,
+		"rebootAt":  record.RebootAt,
+		"reason":    args.Reason,
+	}, nil
+}
+
+// scheduleReboot schedules a reboot without the nonce handshake, for operations
+// (like config restore) that were already confirmed by their own request
+func scheduleReboot(delay time.Duration, reason string) (RebootRecord, error) {
+	reboot.mu.Lock()
+	defer reboot.mu.Unlock()
+	if reboot.timer != nil {
+		return RebootRecord{}, fmt.Errorf("reboot already scheduled")
+	}
+	return scheduleRebootLocked(delay, reason), nil
+}
+
+func scheduleRebootLocked(delay time.Duration, reason string) RebootRecord {
+	now := time.Now()
+	record := RebootRecord{
+		Reason:      reason,
+		RequestedAt: now.Unix(),
+		RebootAt:    now.Add(delay).Unix(),
+	}
+
+	reboot.timer = time.AfterFunc(delay, func() {
+		defer crash.Catch("reboot timer")
+		logger.Warn("Rebooting", "reason", reason)
+		if options.PublishStatus != nil {
+			if err := options.PublishStatus("REBOOTING"); err != nil {
+				logger.Error("Failed to publish rebooting status", "error", err)
+			}
+		}
+		// A reboot cancelled or failed before this point leaves no record behind
+		record := record
+		_, record.BootID = metrics.BootInfo()
+		if err := saveRebootRecord(record); err != nil {
+			logger.Error("Failed to save reboot reason", "error", err)
+		}
+		exec.Command("sync").Run()
+		if err := exec.Command("reboot").Run(); err != nil {
+			logger.Error("Reboot failed", "error", err)
+			os.Remove(RebootReasonFile)
+			reboot.mu.Lock()
+			reboot.timer = nil
+			reboot.mu.Unlock()
+		}
+	})
+	return record
+}
+
+func cancelReboot(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	reboot.mu.Lock()
+	defer reboot.mu.Unlock()
+
+	reboot.nonce = ""
+	if reboot.timer == nil || !reboot.timer.Stop() {
+		return map[string]interface{}{"cancelled": false}, nil
+	}
+	reboot.timer = nil
+	return map[string]interface{}{"cancelled": true}, nil
+}
+
+func saveRebootRecord(record RebootRecord) error {
+	if err := os.MkdirAll(filepath.Dir(RebootReasonFile), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(RebootReasonFile, data, 0644)
+}
+
+// ConsumeRebootRecord returns the reason persisted before the last requested
+// reboot (or nil) and removes it so it is only reported for one boot. A record
+// written in the current boot, such as by a reboot that hung, is dropped
+func ConsumeRebootRecord() *RebootRecord {
+	data, err := os.ReadFile(RebootReasonFile)
+	if err != nil {
+		return nil
+	}
+	os.Remove(RebootReasonFile)
+
+	var record RebootRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil
+	}
+	if _, bootID := metrics.BootInfo(); bootID != "" && record.BootID == bootID {
+		logger.Warn("Ignoring reboot reason from the current boot", "reason", record.Reason)
+		return nil
+	}
+	return &record
+}
@@ -0,0 +1,49 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"spotfi-bridge/pkg/rogueap"
+)
+
+func init() {
+	register("spotfi.rogueap", "status", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return rogueap.Status(), nil
+	})
+	register("spotfi.rogueap", "scan", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		status, err := rogueap.Scan(ctx)
+		if err != nil {
+			// Scans fail when the radios or iwinfo cannot scan, not on bad arguments
+			return nil, Errorf(CodeUnavailable, "%v", err)
+		}
+		return status, nil
+	})
+	for _, method := range []string{"allow", "disallow"} {
+		allow := method == "allow"
+		register("spotfi.rogueap", method, func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+			var args struct {
+				BSSID string `json:"bssid"` // Or a MAC prefix of at least 3 octets
+			}
+			if err := decodeArgs(raw, &args); err != nil {
+				return nil, err
+			}
+			entry := rogueap.NormalizePrefix(args.BSSID)
+			if entry == "" {
+				return nil, invalidArgs("invalid bssid: %q", args.BSSID)
+			}
+			if err := rogueap.Allow(entry, allow); err != nil {
+				return nil, rogueAPError(err)
+			}
+			return rogueap.Status(), nil
+		})
+	}
+}
+
+func rogueAPError(err error) error {
+	if errors.Is(err, rogueap.ErrDisabled) {
+		return Errorf(CodeUnavailable, "%v", err)
+	}
+	return err
+}
@@ -2,68 +2,514 @@ package rpc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"os/exec"
+	"strings"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+	"spotfi-bridge/pkg/metrics"
+	"spotfi-bridge/pkg/ubus"
 )
 
+var logger = logging.For("rpc")
+
+// RPCRequest is a request received on the rpc/request topic, see parseRequest
 type RPCRequest struct {
+	Type   string          `json:"type,omitempty"` // "rpc" when set
 	ID     string          `json:"id"`
 	Path   string          `json:"path"`
 	Method string          `json:"method"`
 	Args   json.RawMessage `json:"args"`
+
+	// IdempotencyKey identifies retries of the same logical call; defaults to ID
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Source identifies the requester (e.g. API instance or user) for rate limiting
+	Source string `json:"source,omitempty"`
+
+	// Requester carries optional metadata about who issued the call (user, IP), recorded in the audit log
+	Requester map[string]interface{} `json:"requester,omitempty"`
+
+	// NoCache forces execution of calls that are otherwise served from the read-only cache
+	NoCache bool `json:"noCache,omitempty"`
+
+	// Priority "urgent" runs the request on the reserved lane (see Options.UrgentPaths)
+	Priority string `json:"priority,omitempty"`
+
+	// Signature fields, required when request signing is enabled
+	Timestamp int64  `json:"ts,omitempty"`    // Unix seconds
+	Nonce     string `json:"nonce,omitempty"` // Unique per request
+	Signature string `json:"sig,omitempty"`   // base64 HMAC-SHA256 or Ed25519 over the canonical request
+
+	// target is the MAC of the downstream AP the request is for (see HandleAPRPC)
+	target string
+}
+
+// Options configures the built-in RPC operations
+type Options struct {
+	// DisableExec rejects ubus file.exec, the arbitrary command execution
+	// path, for deployments that forbid remote shells
+	DisableExec bool
+
+	// ServiceAllowlist limits which init.d services spotfi.service may control
+	ServiceAllowlist []string
+
+	// IdempotencyWindow is how long responses are kept to answer duplicate requests
+	IdempotencyWindow time.Duration
+
+	// MaxArgsSize is the largest accepted request args object in bytes
+	MaxArgsSize int
+
+	// MaxPayloadSize is the largest response published as a single message;
+	// bigger responses are split into rpc-result-chunk messages
+	MaxPayloadSize int
+
+	// RateLimit is the sustained requests per second allowed per source (0 disables)
+	RateLimit float64
+
+	// RateBurst is the number of requests a source may send at once
+	RateBurst int
+
+	// MaxConcurrent caps how many requests execute at the same time
+	MaxConcurrent int
+
+	// UrgentWorkers is the number of execution slots reserved for urgent requests
+	UrgentWorkers int
+
+	// UrgentPaths are the paths (path.Match patterns) allowed to use the urgent lane
+	UrgentPaths []string
+
+	// CachePolicy maps "path:method" of read-only calls to their cache TTL
+	CachePolicy map[string]time.Duration
+
+	// SigningMode is "off", "hmac" or "ed25519"
+	SigningMode string
+
+	// SigningKey is the HMAC secret or Ed25519 public key (see ParseSigningKey)
+	SigningKey []byte
+
+	// SignatureMaxAge is the accepted clock difference for signed request timestamps
+	SignatureMaxAge time.Duration
+
+	// AuditLogPath is the local audit log file ("" disables local auditing)
+	AuditLogPath string
+
+	// AuditLogMaxSize is the size in bytes at which the audit log is rotated
+	AuditLogMaxSize int64
+
+	// PublishAudit mirrors audit records to the audit topic when set
+	PublishAudit func(v interface{}) error
+
+	// PublishJob publishes job updates on the jobs topic
+	PublishJob func(v interface{}) error
+
+	// PublishSchedule publishes scheduled run reports on the schedule topic
+	PublishSchedule func(v interface{}) error
+
+	// PublishQuota publishes client quota events on the events/quota topic
+	PublishQuota func(v interface{}) error
+
+	// PublishAutomation publishes automation run reports and events on the events/automation topic
+	PublishAutomation func(v interface{}) error
+
+	// PublishWalledGarden publishes the effective walled garden whenever it changes
+	PublishWalledGarden func(v interface{}) error
+
+	// PublishStatus publishes a retained router status (e.g. "REBOOTING")
+	PublishStatus func(status string) error
+
+	// Connected reports whether MQTT is connected, used by transaction rollback
+	Connected func() bool
+
+	// LatestMetrics returns the most recent metrics sample, nil before the first;
+	// automation scripts read it with metric()
+	LatestMetrics func() *metrics.Metrics
+
+	// Context is cancelled at shutdown, which cancels in-flight requests and jobs and
+	// refuses new requests (see Drain)
+	Context context.Context
+}
+
+var options = Options{
+	ServiceAllowlist:  DefaultServiceAllowlist,
+	IdempotencyWindow: 5 * time.Minute,
+	MaxArgsSize:       64 * 1024,
+	MaxPayloadSize:    256 * 1024,
+	RateLimit:         10,
+	RateBurst:         20,
+	MaxConcurrent:     8,
+	UrgentWorkers:     2,
+	UrgentPaths:       DefaultUrgentPaths,
+	CachePolicy:       DefaultCachePolicy,
+	SigningMode:       SigningOff,
+	SignatureMaxAge:   60 * time.Second,
+	AuditLogPath:      "/var/log/spotfi-rpc-audit.log",
+	AuditLogMaxSize:   256 * 1024,
+	Context:           context.Background(),
+}
+
+// Configure applies RPC options; zero-valued fields keep their defaults
+func Configure(o Options) {
+	options.DisableExec = o.DisableExec
+	if len(o.ServiceAllowlist) > 0 {
+		options.ServiceAllowlist = o.ServiceAllowlist
+	}
+	if o.IdempotencyWindow > 0 {
+		options.IdempotencyWindow = o.IdempotencyWindow
+	}
+	if o.MaxArgsSize > 0 {
+		options.MaxArgsSize = o.MaxArgsSize
+	}
+	if o.MaxPayloadSize > 0 {
+		options.MaxPayloadSize = o.MaxPayloadSize
+	}
+	if o.RateLimit > 0 {
+		options.RateLimit = o.RateLimit
+	}
+	if o.RateBurst > 0 {
+		options.RateBurst = o.RateBurst
+	}
+	if o.MaxConcurrent > 0 {
+		options.MaxConcurrent = o.MaxConcurrent
+	}
+	if o.UrgentWorkers > 0 {
+		options.UrgentWorkers = o.UrgentWorkers
+	}
+	if len(o.UrgentPaths) > 0 {
+		options.UrgentPaths = o.UrgentPaths
+	}
+	if len(o.CachePolicy) > 0 {
+		options.CachePolicy = o.CachePolicy
+	}
+	if o.SigningMode != "" {
+		options.SigningMode = o.SigningMode
+		options.SigningKey = o.SigningKey
+	}
+	if o.SignatureMaxAge > 0 {
+		options.SignatureMaxAge = o.SignatureMaxAge
+	}
+	switch o.AuditLogPath {
+	case "":
+	case "off":
+		options.AuditLogPath = ""
+	default:
+		options.AuditLogPath = o.AuditLogPath
+	}
+	if o.AuditLogMaxSize > 0 {
+		options.AuditLogMaxSize = o.AuditLogMaxSize
+	}
+	if o.PublishAudit != nil {
+		options.PublishAudit = o.PublishAudit
+	}
+	if o.PublishJob != nil {
+		options.PublishJob = o.PublishJob
+	}
+	if o.PublishSchedule != nil {
+		options.PublishSchedule = o.PublishSchedule
+	}
+	if o.PublishQuota != nil {
+		options.PublishQuota = o.PublishQuota
+	}
+	if o.PublishAutomation != nil {
+		options.PublishAutomation = o.PublishAutomation
+	}
+	if o.PublishWalledGarden != nil {
+		options.PublishWalledGarden = o.PublishWalledGarden
+	}
+	if o.PublishStatus != nil {
+		options.PublishStatus = o.PublishStatus
+	}
+	if o.Connected != nil {
+		options.Connected = o.Connected
+	}
+	if o.LatestMetrics != nil {
+		options.LatestMetrics = o.LatestMetrics
+	}
+	if o.Context != nil {
+		options.Context = o.Context
+	}
+}
+
+// Handler implements a built-in operation that is executed by the bridge
+// itself instead of being forwarded to ubus
+type Handler func(ctx context.Context, args json.RawMessage) (interface{}, error)
+
+// StreamHandler is a built-in operation that emits intermediate messages
+// (e.g. data chunks) for the request before returning its final result
+type StreamHandler func(ctx context.Context, args json.RawMessage, emit func(msg map[string]interface{}) error) (interface{}, error)
+
+// handlers maps path -> method -> built-in handler (paths use the "spotfi." prefix)
+var handlers = map[string]map[string]StreamHandler{}
+
+func register(path, method string, h Handler) {
+	registerStream(path, method, func(ctx context.Context, args json.RawMessage, _ func(map[string]interface{}) error) (interface{}, error) {
+		return h(ctx, args)
+	})
+}
+
+func registerStream(path, method string, h StreamHandler) {
+	if handlers[path] == nil {
+		handlers[path] = map[string]StreamHandler{}
+	}
+	handlers[path][method] = h
+}
+
+func lookup(path, method string) StreamHandler {
+	if methods, ok := handlers[path]; ok {
+		return methods[method]
+	}
+	return nil
+}
+
+// Response is the rpc-result envelope sent back for every request
+type Response struct {
+	Type   string      `json:"type"`   // Always "rpc-result"
+	ID     string      `json:"id"`     // Request ID
+	Status string      `json:"status"` // "success" or "error"
+	Result interface{} `json:"result"` // ubus or handler output, present even on error when available
+
+	// Error fields, only set when Status is "error"
+	Error    string                 `json:"error,omitempty"`    // Human-readable message
+	Code     ErrorCode              `json:"code"`               // 0 on success, see ErrorCode
+	CodeName string                 `json:"codeName,omitempty"` // Name of Code, e.g. "timeout"
+	ExitCode *int                   `json:"exitCode,omitempty"` // ubus/command exit status
+	Details  map[string]interface{} `json:"details,omitempty"`  // Machine-readable context (e.g. stderr)
+
+	// Duplicate is set when the response was replayed from the idempotency cache
+	Duplicate bool `json:"duplicate,omitempty"`
+
+	// Cached is set when a read-only call was answered from the result cache
+	Cached bool `json:"cached,omitempty"`
+}
+
+func newResponse(id string, result interface{}, err error) *Response {
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+	resp := &Response{
+		Type:   "rpc-result",
+		ID:     id,
+		Status: "success",
+		Result: result,
+	}
+	if err != nil {
+		e := classify(err)
+		resp.Status = "error"
+		resp.Error = e.Message
+		resp.Code = e.Code
+		resp.CodeName = e.Code.String()
+		resp.ExitCode = e.ExitCode
+		resp.Details = e.Details
+	}
+	return resp
+}
+
+func throttledResponse(id, reason string, retryAfter time.Duration) *Response {
+	e := Errorf(CodeThrottled, "throttled: %s", reason)
+	e.Details = map[string]interface{}{"retryAfterMs": retryAfter.Milliseconds()}
+	return newResponse(id, nil, e)
 }
 
 // HandleRPC executes ubus command and sends response via callback
-func HandleRPC(msg map[string]interface{}, sendFunc func(interface{}) error) {
-	// Re-marshal to struct for easier handling
-	tmp, _ := json.Marshal(msg)
-	var req RPCRequest
-	json.Unmarshal(tmp, &req)
+func HandleRPC(payload []byte, sendFunc func(interface{}) error) {
+	handleRPC(payload, "", sendFunc)
+}
+
+// HandleAPRPC is HandleRPC for a request to the downstream AP with the given
+// MAC, which is forwarded to the AP's ubus (see pkg/multiap)
+func HandleAPRPC(mac string, payload []byte, sendFunc func(interface{}) error) {
+	handleRPC(payload, mac, sendFunc)
+}
+
+func handleRPC(payload []byte, target string, sendFunc func(interface{}) error) {
+	inFlight.Add(1)
+	defer inFlight.Done()
+	defer crash.Catch("rpc")
+	started := time.Now()
+	rpcCounters.requests.Add(1)
+	req, err := parseRequest(payload)
+	req.target = target
+	if err != nil {
+		rpcCounters.invalid.Add(1)
+		response := newResponse(req.ID, nil, err)
+		audit(req, response, started)
+		sendResponse(response, sendFunc)
+		return
+	}
+
+	if options.Context.Err() != nil {
+		response := newResponse(req.ID, nil, errShuttingDown)
+		audit(req, response, started)
+		sendResponse(response, sendFunc)
+		return
+	}
+
+	// Verified before the rate limit is charged, so forged requests naming a
+	// source cannot use up its bucket
+	if err := verifySignature(req); err != nil {
+		rpcCounters.rejectedSignature.Add(1)
+		response := newResponse(req.ID, nil, err)
+		audit(req, response, started)
+		sendResponse(response, sendFunc)
+		return
+	}
 
+	urgent := isUrgent(req)
+	if urgent {
+		rpcCounters.urgent.Add(1)
+	}
+	if ok, wait := allow(req.Source, urgent); !ok {
+		rpcCounters.throttledRate.Add(1)
+		response := throttledResponse(req.ID, "rate limit exceeded", wait)
+		audit(req, response, started)
+		sendResponse(response, sendFunc)
+		return
+	}
+
+	key := req.IdempotencyKey
+	if key == "" {
+		key = req.ID
+	}
+	if req.target != "" {
+		key = "ap/" + req.target + "/" + key
+	}
+	if !idempotent(req) {
+		key = "" // Running a read again is harmless, keeping its response is not free
+	}
+	if cached, ok := responses.begin(key); ok {
+		rpcCounters.duplicates.Add(1)
+		response := duplicateResponse(cached, req.ID)
+		audit(req, response, started)
+		sendResponse(response, sendFunc)
+		return
+	}
+
+	if !claimNonce(req.Nonce) {
+		rpcCounters.rejectedSignature.Add(1)
+		response := newResponse(req.ID, nil, Errorf(CodePermissionDenied, "replayed nonce"))
+		responses.abort(key)
+		audit(req, response, started)
+		sendResponse(response, sendFunc)
+		return
+	}
+
+	release, ok := acquireSlot(urgent)
+	if !ok {
+		rpcCounters.throttledInFlight.Add(1)
+		response := throttledResponse(req.ID, "too many concurrent requests", time.Second)
+		// Not cached: a retry of a throttled request must be allowed to execute
+		responses.abort(key)
+		audit(req, response, started)
+		sendResponse(response, sendFunc)
+		return
+	}
+	rpcCounters.currentlyExecuting.Add(1)
+	response := execute(options.Context, req, sendFunc)
+	rpcCounters.currentlyExecuting.Add(-1)
+	release()
+	if response.Status == "error" && options.Context.Err() != nil {
+		// Cancelled by the shutdown rather than failed
+		response = newResponse(req.ID, response.Result, errShuttingDown)
+	}
+
+	responses.finish(key, response)
+	audit(req, response, started)
+	sendResponse(response, sendFunc)
+}
+
+// execute runs a request either through a built-in handler or ubus
+func execute(ctx context.Context, req RPCRequest, sendFunc func(interface{}) error) *Response {
+	if resp, ok := cachedResult(req); ok {
+		return resp
+	}
+
+	var resp *Response
+	if options.DisableExec && req.Path == "file" && req.Method == "exec" {
+		// Checked here so spotfi.job/submit cannot get around it
+		return newResponse(req.ID, nil, Errorf(CodePermissionDenied, "file.exec is disabled on this router"))
+	}
+	switch h := lookup(req.Path, req.Method); {
+	case req.target != "":
+		return callAP(ctx, req)
+	case h != nil:
+		resp = runHandler(ctx, req, h, sendFunc)
+	case strings.HasPrefix(req.Path, pluginPrefix):
+		resp = callPlugin(ctx, req)
+	default:
+		resp = callUbus(ctx, req)
+	}
+	storeResult(req, resp)
+	return resp
+}
+
+// callUbus forwards a request to "ubus call"
+func callUbus(ctx context.Context, req RPCRequest) *Response {
 	// Execute ubus command via OS exec (safest/most portable way on OpenWrt)
 	argsStr := "{}"
 	if len(req.Args) > 0 {
 		argsStr = string(req.Args)
 	}
 
-	cmd := exec.Command("ubus", "call", req.Path, req.Method, argsStr)
+	cmd := exec.CommandContext(ctx, "ubus", "call", req.Path, req.Method, argsStr)
 	var out bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
 
-	response := map[string]interface{}{
-		"type": "rpc-result",
-		"id":   req.ID,
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		err = ctx.Err()
 	}
 
-	err := cmd.Run()
-	
 	// Always try to parse output, even on error (ubus may return JSON with error details)
 	var result interface{}
 	if out.Len() > 0 {
-		if err := json.Unmarshal(out.Bytes(), &result); err == nil {
-			response["result"] = result
-		} else {
+		if err := json.Unmarshal(out.Bytes(), &result); err != nil {
 			// If not JSON, return as string
-			response["result"] = out.String()
+			result = out.String()
 		}
-	} else {
-		response["result"] = map[string]interface{}{}
 	}
 
-	if err != nil {
-		response["status"] = "error"
-		// Include the error message, but also include the result if available
-		// This allows us to see stderr/stdout from commands like opkg
-		response["error"] = err.Error()
-		// If we have stderr, include it
-		if stderr.Len() > 0 {
-			response["stderr"] = stderr.String()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// Keep stderr/stdout from commands like opkg for inspection
+		err = &ubus.Error{
+			Path:     req.Path,
+			Method:   req.Method,
+			ExitCode: exitErr.ExitCode(),
+			Stderr:   strings.TrimSpace(stderr.String()),
 		}
-	} else {
-		response["status"] = "success"
+	}
+	return newResponse(req.ID, result, err)
+}
+
+// runHandler executes a built-in handler and wraps its outcome in the standard response shape
+func runHandler(ctx context.Context, req RPCRequest, h StreamHandler, sendFunc func(interface{}) error) (resp *Response) {
+	defer func() {
+		if v := recover(); v != nil {
+			// Answered as an internal error; the bridge keeps serving other requests
+			crash.Record("rpc "+req.Path+"."+req.Method, v)
+			resp = newResponse(req.ID, nil, Errorf(CodeInternal, "%s.%s failed: panic: %v", req.Path, req.Method, v))
+		}
+	}()
+	emit := func(msg map[string]interface{}) error {
+		msg["id"] = req.ID
+		return sendFunc(msg)
 	}
 
-	sendFunc(response)
+	result, err := h(ctx, req.Args, emit)
+	return newResponse(req.ID, result, err)
+}
+
+// decodeArgs unmarshals handler args, treating empty args as an empty object
+func decodeArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return invalidArgs("invalid args: %v", err)
+	}
+	return nil
 }
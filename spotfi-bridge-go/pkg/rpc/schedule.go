@@ -0,0 +1,615 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+)
+
+const (
+	// ScheduleFile keeps the schedules and the run reports not yet published
+	ScheduleFile = "/etc/spotfi/schedules.json"
+
+	maxSchedules           = 50
+	maxScheduleRuns        = 5   // Kept per schedule
+	maxUnreportedRuns      = 100 // Run reports kept while the broker is unreachable
+	maxScheduleJitter      = 6 * 60 * 60
+	defaultScheduleTimeout = 30 * time.Minute
+
+	// A run more than maxLateness past its time was missed (the clock jumped or the
+	// bridge was stopped) and is skipped, unless it is caught up after a start
+	maxLateness   = 10 * time.Minute
+	catchUpWindow = 24 * time.Hour
+)
+
+// Run triggers
+const (
+	TriggerSchedule = "schedule"
+	TriggerCatchUp  = "catchUp"
+	TriggerManual   = "manual"
+)
+
+var (
+	scheduleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+	offsetPattern       = regexp.MustCompile(`^(?:UTC|GMT)?([+-])(\d{1,2})(?::?(\d{2}))?$`)
+)
+
+// Schedule is a named RPC the bridge runs on a cron timetable, as a job, whether
+// or not the broker is reachable at the time
+type Schedule struct {
+	Name   string          `json:"name"`
+	Cron   string          `json:"cron"`         // Five fields, or @hourly, @daily, @weekly, @monthly, @yearly
+	TZ     string          `json:"tz,omitempty"` // IANA zone or fixed offset such as +02:00; UTC when empty
+	Path   string          `json:"path"`
+	Method string          `json:"method"`
+	Args   json.RawMessage `json:"args,omitempty"`
+
+	// Jitter delays each run by up to this many seconds, so a fleet sharing a
+	// schedule does not hit the same servers at once
+	Jitter int `json:"jitter,omitempty"`
+
+	// Timeout cancels a run after this many seconds (default 1800)
+	Timeout int `json:"timeout,omitempty"`
+
+	// CatchUp runs the schedule once after a start when its last run in the past
+	// 24 hours was missed because the bridge or router was down
+	CatchUp bool `json:"catchUp,omitempty"`
+
+	Disabled bool `json:"disabled,omitempty"`
+
+	UpdatedAt int64         `json:"updatedAt"`
+	NextRun   int64         `json:"nextRun,omitempty"` // Unix seconds, without jitter
+	Runs      []ScheduleRun `json:"runs,omitempty"`    // Latest first
+
+	spec    *cronSpec
+	loc     *time.Location
+	running bool
+}
+
+// ScheduleRun reports one run on the schedule topic
+type ScheduleRun struct {
+	Type        string `json:"type"` // Always "schedule-run"
+	Schedule    string `json:"schedule"`
+	Trigger     string `json:"trigger"` // schedule, catchUp or manual
+	JobID       string `json:"jobId,omitempty"`
+	ScheduledAt int64  `json:"scheduledAt"`
+	StartedAt   int64  `json:"startedAt,omitempty"`
+	FinishedAt  int64  `json:"finishedAt"`
+	Status      string `json:"status"` // succeeded, failed, cancelled or skipped
+	Error       string `json:"error,omitempty"`
+	CodeName    string `json:"codeName,omitempty"`
+}
+
+// ScheduleArgs name a schedule for delete and run
+type ScheduleArgs struct {
+	Name string `json:"name"`
+}
+
+// ScheduleReplaceArgs are the arguments of spotfi.schedule/replace
+type ScheduleReplaceArgs struct {
+	Schedules []Schedule `json:"schedules"`
+}
+
+var schedules = struct {
+	mu         sync.Mutex
+	byName     map[string]*Schedule
+	unreported []ScheduleRun
+	wake       chan struct{}
+}{byName: map[string]*Schedule{}, wake: make(chan struct{}, 1)}
+
+// scheduleKey carries the name of the schedule a run belongs to
+type scheduleKey struct{}
+
+// scheduleName returns the schedule that started the request of ctx, if any
+func scheduleName(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(scheduleKey{}).(string)
+	return name, ok
+}
+
+func init() {
+	register("spotfi.schedule", "set", setSchedule)
+	register("spotfi.schedule", "replace", replaceSchedules)
+	register("spotfi.schedule", "delete", deleteSchedule)
+	register("spotfi.schedule", "list", listSchedules)
+	register("spotfi.schedule", "run", runScheduleNow)
+}
+
+// loadLocation resolves the tz of a schedule. IANA names need the zoneinfo
+// packages, which most OpenWrt images leave out, so fixed offsets work as well
+func loadLocation(tz string) (*time.Location, error) {
+	switch tz {
+	case "", "UTC", "GMT":
+		return time.UTC, nil
+	}
+	if m := offsetPattern.FindStringSubmatch(tz); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		if hours > 14 || minutes > 59 {
+			return nil, fmt.Errorf("invalid offset %q", tz)
+		}
+		offset := hours*3600 + minutes*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(tz, offset), nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q (install zoneinfo or use an offset such as +02:00)", tz)
+	}
+	return loc, nil
+}
+
+// prepareSchedule validates s and parses its timetable
+func prepareSchedule(s *Schedule) error {
+	if !scheduleNamePattern.MatchString(s.Name) {
+		return invalidArgs("invalid schedule name: %q", s.Name)
+	}
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return invalidArgs("schedule %s: invalid cron: %v", s.Name, err)
+	}
+	loc, err := loadLocation(s.TZ)
+	if err != nil {
+		return invalidArgs("schedule %s: %v", s.Name, err)
+	}
+	if s.Path == "" || s.Method == "" {
+		return invalidArgs("schedule %s: path and method are required", s.Name)
+	}
+	if s.Path == "spotfi.job" || s.Path == "spotfi.schedule" {
+		return invalidArgs("schedule %s: %s cannot be scheduled", s.Name, s.Path)
+	}
+	if len(s.Args) > options.MaxArgsSize {
+		return invalidArgs("schedule %s: args exceed %d bytes", s.Name, options.MaxArgsSize)
+	}
+	if len(s.Args) > 0 {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(s.Args, &obj); err != nil {
+			return invalidArgs("schedule %s: args must be an object", s.Name)
+		}
+	}
+	if s.Jitter < 0 || s.Jitter > maxScheduleJitter {
+		return invalidArgs("schedule %s: jitter must be between 0 and %d seconds", s.Name, maxScheduleJitter)
+	}
+	if s.Timeout < 0 || s.Timeout > 24*60*60 {
+		return invalidArgs("schedule %s: timeout must be between 0 and 86400 seconds", s.Name)
+	}
+	if spec.next(time.Now(), loc).IsZero() {
+		return invalidArgs("schedule %s: cron %q never matches", s.Name, s.Cron)
+	}
+	s.spec, s.loc = spec, loc
+	return nil
+}
+
+// install replaces the schedule with its name, keeping the run history; schedules.mu must be held
+func installScheduleLocked(s *Schedule, now time.Time) {
+	if old := schedules.byName[s.Name]; old != nil {
+		s.Runs, s.running = old.Runs, old.running
+	}
+	s.UpdatedAt = now.Unix()
+	s.NextRun = s.spec.next(now, s.loc).Unix()
+	schedules.byName[s.Name] = s
+}
+
+func setSchedule(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var s Schedule
+	if err := decodeArgs(raw, &s); err != nil {
+		return nil, err
+	}
+	if err := prepareSchedule(&s); err != nil {
+		return nil, err
+	}
+	schedules.mu.Lock()
+	if _, ok := schedules.byName[s.Name]; !ok && len(schedules.byName) >= maxSchedules {
+		schedules.mu.Unlock()
+		return nil, invalidArgs("at most %d schedules are allowed", maxSchedules)
+	}
+	installScheduleLocked(&s, time.Now())
+	err := saveSchedulesLocked()
+	result := s
+	schedules.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	wakeScheduler()
+	return result, nil
+}
+
+// replaceSchedules makes the given schedules the complete set, so the backend can
+// push its desired state in one call
+func replaceSchedules(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args ScheduleReplaceArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if len(args.Schedules) > maxSchedules {
+		return nil, invalidArgs("at most %d schedules are allowed", maxSchedules)
+	}
+	seen := map[string]bool{}
+	for i := range args.Schedules {
+		s := &args.Schedules[i]
+		if err := prepareSchedule(s); err != nil {
+			return nil, err
+		}
+		if seen[s.Name] {
+			return nil, invalidArgs("duplicate schedule name: %s", s.Name)
+		}
+		seen[s.Name] = true
+	}
+
+	now := time.Now()
+	schedules.mu.Lock()
+	for name := range schedules.byName {
+		if !seen[name] {
+			delete(schedules.byName, name)
+		}
+	}
+	for i := range args.Schedules {
+		installScheduleLocked(&args.Schedules[i], now)
+	}
+	err := saveSchedulesLocked()
+	schedules.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	wakeScheduler()
+	return listSchedules(ctx, nil)
+}
+
+func deleteSchedule(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args ScheduleArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	if _, ok := schedules.byName[args.Name]; !ok {
+		return nil, Errorf(CodeNotFound, "schedule not found: %s", args.Name)
+	}
+	delete(schedules.byName, args.Name)
+	if err := saveSchedulesLocked(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"name": args.Name, "deleted": true}, nil
+}
+
+func listSchedules(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	list := make([]Schedule, 0, len(schedules.byName))
+	for _, s := range schedules.byName {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return map[string]interface{}{"schedules": list}, nil
+}
+
+// runScheduleNow starts a schedule outside its timetable, e.g. to test it
+func runScheduleNow(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args ScheduleArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	schedules.mu.Lock()
+	s := schedules.byName[args.Name]
+	schedules.mu.Unlock()
+	if s == nil {
+		return nil, Errorf(CodeNotFound, "schedule not found: %s", args.Name)
+	}
+	job, err := startRun(s, TriggerManual, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"name": args.Name, "jobId": job.ID}, nil
+}
+
+// StartScheduler loads the saved schedules and SSID timetables and runs them until
+// the RPC context is cancelled. Call it after Configure
+func StartScheduler() {
+	loadSchedules()
+	loadSSIDTimetables()
+	go schedulerLoop(options.Context)
+	go ssidLoop(options.Context)
+}
+
+// loadSchedules reads ScheduleFile
+func loadSchedules() {
+	data, err := os.ReadFile(ScheduleFile)
+	if err != nil {
+		return
+	}
+	var saved struct {
+		Schedules  []*Schedule   `json:"schedules"`
+		Unreported []ScheduleRun `json:"unreported"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		logger.Error("Ignoring corrupt schedule file", "file", ScheduleFile, "error", err)
+		return
+	}
+
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	schedules.unreported = saved.Unreported
+	for _, s := range saved.Schedules {
+		if err := prepareSchedule(s); err != nil {
+			logger.Error("Ignoring invalid saved schedule", "schedule", s.Name, "error", err)
+			continue
+		}
+		schedules.byName[s.Name] = s
+	}
+	logger.Info("Loaded schedules", "schedules", len(schedules.byName))
+}
+
+// clockSet reports whether the clock looks set; routers without an RTC boot in
+// the past until NTP syncs
+func clockSet(now time.Time) bool {
+	return now.Year() >= 2024
+}
+
+// catchUp moves the schedules missed while the bridge was down to their next run,
+// first running once those with CatchUp set that were missed in the past day
+func catchUp(now time.Time) {
+	var missed []*Schedule
+	schedules.mu.Lock()
+	for _, s := range schedules.byName {
+		if s.NextRun == 0 || s.NextRun > now.Unix() {
+			continue
+		}
+		if s.CatchUp && !s.Disabled && now.Sub(time.Unix(s.NextRun, 0)) <= catchUpWindow {
+			missed = append(missed, s)
+		}
+		s.NextRun = s.spec.next(now, s.loc).Unix()
+	}
+	saveSchedulesLocked()
+	schedules.mu.Unlock()
+
+	for _, s := range missed {
+		logger.Info("Catching up a missed scheduled run", "schedule", s.Name)
+		startRun(s, TriggerCatchUp, now)
+	}
+}
+
+func wakeScheduler() {
+	select {
+	case schedules.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedulerLoop sleeps until the next run is due, or a schedule changes
+func schedulerLoop(ctx context.Context) {
+	defer crash.Recover("scheduler")
+	for !clockSet(time.Now()) {
+		logger.Debug("Scheduler waiting for the clock to be set")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(30 * time.Second):
+		}
+	}
+	catchUp(time.Now())
+
+	for {
+		var next time.Time
+		schedules.mu.Lock()
+		for _, s := range schedules.byName {
+			if s.Disabled || s.NextRun == 0 {
+				continue
+			}
+			if t := time.Unix(s.NextRun, 0); next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+		schedules.mu.Unlock()
+
+		wait := time.Hour // Also corrects for clock changes
+		if !next.IsZero() {
+			wait = min(max(time.Until(next), 0), wait)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-schedules.wake:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+		fireDue(time.Now())
+	}
+}
+
+// fireDue starts the schedules whose time has come and moves them to their next run
+func fireDue(now time.Time) {
+	type due struct {
+		s      *Schedule
+		at     time.Time
+		missed bool
+	}
+	var fired []due
+	schedules.mu.Lock()
+	for _, s := range schedules.byName {
+		if s.Disabled || s.NextRun == 0 || s.NextRun > now.Unix() {
+			continue
+		}
+		at := time.Unix(s.NextRun, 0)
+		fired = append(fired, due{s: s, at: at, missed: now.Sub(at) > maxLateness})
+		s.NextRun = s.spec.next(now, s.loc).Unix()
+	}
+	if len(fired) > 0 {
+		saveSchedulesLocked()
+	}
+	schedules.mu.Unlock()
+
+	for _, d := range fired {
+		if d.missed {
+			logger.Warn("Skipped a missed scheduled run", "schedule", d.s.Name, "due", d.at)
+			recordRun(d.s, ScheduleRun{
+				Schedule: d.s.Name, Trigger: TriggerSchedule, ScheduledAt: d.at.Unix(), Status: "skipped",
+				Error: fmt.Sprintf("missed by %s", now.Sub(d.at).Round(time.Second)),
+			}, false)
+			continue
+		}
+		go func(s *Schedule, at time.Time) {
+			defer crash.Catch("schedule " + s.Name)
+			if s.Jitter > 0 {
+				select {
+				case <-options.Context.Done():
+					return
+				case <-time.After(time.Duration(rand.IntN(s.Jitter)) * time.Second):
+				}
+			}
+			startRun(s, TriggerSchedule, at)
+		}(d.s, d.at)
+	}
+}
+
+// startRun executes a schedule as a job in the background, or records it as skipped
+// while its previous run is still going
+func startRun(s *Schedule, trigger string, scheduledAt time.Time) (*Job, error) {
+	schedules.mu.Lock()
+	running := s.running
+	s.running = true
+	schedules.mu.Unlock()
+	if running {
+		recordRun(s, ScheduleRun{
+			Schedule: s.Name, Trigger: trigger, ScheduledAt: scheduledAt.Unix(), Status: "skipped",
+			Error: "previous run still in progress",
+		}, false)
+		return nil, Errorf(CodeUnavailable, "schedule %s is still running", s.Name)
+	}
+
+	job, jobCtx, err := newJob(s.Path, s.Method)
+	if err != nil {
+		schedules.mu.Lock()
+		s.running = false
+		schedules.mu.Unlock()
+		return nil, err
+	}
+	timeout := defaultScheduleTimeout
+	if s.Timeout > 0 {
+		timeout = time.Duration(s.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(jobCtx, scheduleKey{}, s.Name), timeout)
+	logger.Info("Running schedule", "schedule", s.Name, "trigger", trigger, "job", job.ID)
+
+	inFlight.Add(1)
+	go func() {
+		defer cancel()
+		runJob(ctx, job, RPCRequest{ID: job.ID, Path: s.Path, Method: s.Method, Args: s.Args})
+
+		jobs.mu.Lock()
+		run := ScheduleRun{
+			Schedule: s.Name, Trigger: trigger, JobID: job.ID, ScheduledAt: scheduledAt.Unix(),
+			StartedAt: job.StartedAt, Status: job.State,
+		}
+		if job.Result != nil && job.Result.Status == "error" {
+			run.Error, run.CodeName = job.Result.Error, job.Result.CodeName
+		}
+		jobs.mu.Unlock()
+		recordRun(s, run, true)
+	}()
+	return job, nil
+}
+
+// recordRun keeps a run in the schedule's history and reports it
+func recordRun(s *Schedule, run ScheduleRun, finished bool) {
+	run.Type = "schedule-run"
+	run.FinishedAt = time.Now().Unix()
+	schedules.mu.Lock()
+	if finished {
+		s.running = false
+	}
+	s.Runs = append([]ScheduleRun{run}, s.Runs...)
+	if len(s.Runs) > maxScheduleRuns {
+		s.Runs = s.Runs[:maxScheduleRuns]
+	}
+	schedules.mu.Unlock()
+
+	if run.Status == JobFailed {
+		logger.Warn("Scheduled run failed", "schedule", s.Name, "error", run.Error)
+	}
+	published := false
+	if options.PublishSchedule != nil && (options.Connected == nil || options.Connected()) {
+		if err := options.PublishSchedule(run); err != nil {
+			logger.Warn("Schedule run report not published, kept for retry", "schedule", s.Name, "error", err)
+		} else {
+			published = true
+		}
+	}
+
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	if !published {
+		schedules.unreported = append(schedules.unreported, run)
+		if len(schedules.unreported) > maxUnreportedRuns {
+			schedules.unreported = schedules.unreported[len(schedules.unreported)-maxUnreportedRuns:]
+		}
+	}
+	saveSchedulesLocked()
+}
+
+// flushScheduleRuns publishes the run reports kept while the broker was unreachable
+func flushScheduleRuns() {
+	defer crash.Catch("schedule reports")
+	if options.PublishSchedule == nil {
+		return
+	}
+	schedules.mu.Lock()
+	runs := schedules.unreported
+	schedules.unreported = nil
+	schedules.mu.Unlock()
+	if len(runs) == 0 {
+		return
+	}
+
+	for i, run := range runs {
+		if err := options.PublishSchedule(run); err != nil {
+			logger.Warn("Schedule run reports not published, kept for retry", "reports", len(runs)-i, "error", err)
+			schedules.mu.Lock()
+			schedules.unreported = append(runs[i:], schedules.unreported...)
+			saveSchedulesLocked()
+			schedules.mu.Unlock()
+			return
+		}
+	}
+	logger.Info("Published schedule run reports kept while offline", "reports", len(runs))
+	schedules.mu.Lock()
+	saveSchedulesLocked()
+	schedules.mu.Unlock()
+}
+
+// saveSchedulesLocked writes ScheduleFile; schedules.mu must be held
+func saveSchedulesLocked() error {
+	list := make([]*Schedule, 0, len(schedules.byName))
+	for _, s := range schedules.byName {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.Marshal(map[string]interface{}{"schedules": list, "unreported": schedules.unreported})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(ScheduleFile), 0755)
+	}
+	if err == nil {
+		tmp := ScheduleFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, ScheduleFile)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save schedules", "error", err)
+		return Errorf(CodeInternal, "failed to save schedules: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"spotfi-bridge/pkg/ubus"
+)
+
+// DefaultServiceAllowlist are the init.d services that may be controlled remotely
+var DefaultServiceAllowlist = []string{
+	"dnsmasq", "uspot", "wpad", "hostapd", "firewall", "network", "odhcpd", "uhttpd",
+}
+
+// ServiceArgs are the arguments of the spotfi.service operations
+type ServiceArgs struct {
+	Name string `json:"name"`
+}
+
+var serviceActions = []string{"start", "stop", "restart", "reload", "enable", "disable"}
+
+func init() {
+	for _, action := range serviceActions {
+		action := action
+		register("spotfi.service", action, func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+			return controlService(ctx, raw, action)
+		})
+	}
+	register("spotfi.service", "status", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return controlService(ctx, raw, "")
+	})
+}
+
+func serviceAllowed(name string) bool {
+	for _, s := range options.ServiceAllowlist {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// controlService runs an init.d action (empty for status only) and returns the resulting state
+func controlService(ctx context.Context, raw json.RawMessage, action string) (interface{}, error) {
+	var args ServiceArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Name == "" || strings.ContainsAny(args.Name, "/. ") {
+		return nil, invalidArgs("invalid service name: %q", args.Name)
+	}
+	if !serviceAllowed(args.Name) {
+		return nil, Errorf(CodePermissionDenied, "service not in allowlist: %s", args.Name)
+	}
+	script := "/etc/init.d/" + args.Name
+	if _, err := os.Stat(script); err != nil {
+		return nil, Errorf(CodeNotFound, "service not installed: %s", args.Name)
+	}
+
+	if action != "" {
+		out, err := exec.CommandContext(ctx, script, action).CombinedOutput()
+		if err != nil {
+			state := serviceState(args.Name)
+			state["output"] = strings.TrimSpace(string(out))
+			return state, fmt.Errorf("%s %s failed: %w", args.Name, action, err)
+		}
+	}
+	return serviceState(args.Name), nil
+}
+
+// serviceState reports whether a service is enabled and which procd instances are running
+func serviceState(name string) map[string]interface{} {
+	enabled := exec.Command("/etc/init.d/"+name, "enabled").Run() == nil
+
+	running := false
+	instances := map[string]interface{}{}
+	if res, err := ubus.Call("service", "list", map[string]string{"name": name}); err == nil {
+		if svc, ok := res[name].(map[string]interface{}); ok {
+			if inst, ok := svc["instances"].(map[string]interface{}); ok {
+				for id, v := range inst {
+					info, _ := v.(map[string]interface{})
+					up, _ := info["running"].(bool)
+					running = running || up
+					instances[id] = map[string]interface{}{
+						"running": up,
+						"pid":     info["pid"],
+					}
+				}
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"name":      name,
+		"enabled":   enabled,
+		"running":   running,
+		"instances": instances,
+	}
+}
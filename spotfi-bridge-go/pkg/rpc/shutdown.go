@@ -0,0 +1,26 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// inFlight counts requests being handled and jobs running, for Drain
+var inFlight sync.WaitGroup
+
+// Drain waits up to timeout for in-flight requests and jobs to send their final
+// response or job update after Options.Context was cancelled. It reports whether
+// they all finished
+func Drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,187 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signing modes
+const (
+	SigningOff     = "off"
+	SigningHMAC    = "hmac"
+	SigningEd25519 = "ed25519"
+)
+
+var seenNonces = struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}{expires: map[string]time.Time{}}
+
+// ParseSigningKey decodes a provisioned key: the raw secret for hmac, or a
+// base64/hex encoded 32 byte public key for ed25519
+func ParseSigningKey(mode, key string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	switch mode {
+	case "", SigningOff:
+		return nil, nil
+	case SigningHMAC:
+		if key == "" {
+			return nil, fmt.Errorf("hmac signing requires a key")
+		}
+		return []byte(key), nil
+	case SigningEd25519:
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			b, err = hex.DecodeString(key)
+		}
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("ed25519 signing requires a 32 byte public key (base64 or hex)")
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown signing mode: %q", mode)
+}
+
+// canonicalVersion leads the canonical request; v2 added the idempotency key,
+// priority, noCache, source and AP target, which v1 left unsigned
+const canonicalVersion = "v2"
+
+// canonicalRequest is the byte string covered by the signature: the version,
+// id, path, method, timestamp, nonce, idempotency key, priority, noCache, source,
+// AP target and compact JSON args separated by newlines
+func canonicalRequest(req RPCRequest) []byte {
+	var args bytes.Buffer
+	if len(req.Args) > 0 {
+		if err := json.Compact(&args, req.Args); err != nil {
+			args.Write(req.Args)
+		}
+	}
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n%s\n%d\n%s\n%s\n%s\n%t\n%s\n%s\n%s", canonicalVersion,
+		req.ID, req.Path, req.Method, req.Timestamp, req.Nonce,
+		req.IdempotencyKey, req.Priority, req.NoCache, req.Source, req.target, args.String()))
+}
+
+func signingEnabled() bool {
+	return options.SigningMode != "" && options.SigningMode != SigningOff
+}
+
+// verifySignature checks signature and freshness of a request when signing is enabled
+func verifySignature(req RPCRequest) error {
+	if !signingEnabled() {
+		return nil
+	}
+	if req.Signature == "" || req.Nonce == "" || req.Timestamp == 0 {
+		return Errorf(CodePermissionDenied, "request is not signed")
+	}
+	return checkSignature(req.Timestamp, req.Signature, canonicalRequest(req))
+}
+
+// VerifyMessage checks a signed message of a topic other than RPC requests, such
+// as control requests and journal acknowledgments, when signing is enabled. The
+// payload carries ts, nonce and sig like a request; sig covers
+// "<topic>\n<ts>\n<nonce>\n<payload>", the payload being the JSON object without
+// those three fields, keys sorted and compact. Nonces are claimed as for requests
+func VerifyMessage(topic string, payload []byte) error {
+	if !signingEnabled() {
+		return nil
+	}
+	err := verifyMessage(topic, payload)
+	if err != nil {
+		rpcCounters.rejectedSignature.Add(1)
+	}
+	return err
+}
+
+func verifyMessage(topic string, payload []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return Errorf(CodeInvalidArgs, "invalid JSON: %v", err)
+	}
+	sig, _ := fields["sig"].(string)
+	nonce, _ := fields["nonce"].(string)
+	var ts int64
+	if n, ok := fields["ts"].(json.Number); ok {
+		ts, _ = n.Int64()
+	}
+	if sig == "" || nonce == "" || ts == 0 {
+		return Errorf(CodePermissionDenied, "message is not signed")
+	}
+	delete(fields, "sig")
+	delete(fields, "nonce")
+	delete(fields, "ts")
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return Errorf(CodeInvalidArgs, "invalid JSON: %v", err)
+	}
+	if err := checkSignature(ts, sig, []byte(fmt.Sprintf("%s\n%d\n%s\n%s", topic, ts, nonce, body))); err != nil {
+		return err
+	}
+	if !claimNonce(nonce) {
+		return Errorf(CodePermissionDenied, "replayed nonce")
+	}
+	return nil
+}
+
+// checkSignature verifies sig over message and the freshness of its timestamp
+func checkSignature(timestamp int64, signature string, message []byte) error {
+	age := time.Since(time.Unix(timestamp, 0))
+	if age < 0 {
+		age = -age
+	}
+	if age > options.SignatureMaxAge {
+		return Errorf(CodePermissionDenied, "timestamp outside the allowed window")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return Errorf(CodePermissionDenied, "invalid signature encoding")
+	}
+
+	valid := false
+	switch options.SigningMode {
+	case SigningHMAC:
+		mac := hmac.New(sha256.New, options.SigningKey)
+		mac.Write(message)
+		valid = hmac.Equal(sig, mac.Sum(nil))
+	case SigningEd25519:
+		valid = len(options.SigningKey) == ed25519.PublicKeySize &&
+			ed25519.Verify(ed25519.PublicKey(options.SigningKey), message, sig)
+	}
+	if !valid {
+		return Errorf(CodePermissionDenied, "invalid signature")
+	}
+	return nil
+}
+
+// claimNonce records a nonce and reports false if it was already used within the window
+func claimNonce(nonce string) bool {
+	if !signingEnabled() {
+		return true
+	}
+
+	seenNonces.mu.Lock()
+	defer seenNonces.mu.Unlock()
+	now := time.Now()
+	for n, exp := range seenNonces.expires {
+		if now.After(exp) {
+			delete(seenNonces.expires, n)
+		}
+	}
+	if _, seen := seenNonces.expires[nonce]; seen {
+		return false
+	}
+	// Timestamps are accepted up to SignatureMaxAge in either direction
+	seenNonces.expires[nonce] = now.Add(2 * options.SignatureMaxAge)
+	return true
+}
@@ -0,0 +1,142 @@
+package rpc
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// setOptions replaces the package options for the duration of the test
+func setOptions(t *testing.T, o Options) {
+	saved := options
+	t.Cleanup(func() { options = saved })
+	options = o
+}
+
+func hmacSign(key string, req RPCRequest) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(canonicalRequest(req))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	base := RPCRequest{
+		ID: "1", Path: "system", Method: "info", Args: json.RawMessage(`{"a": 1}`),
+		Timestamp: now, Nonce: "n1", Source: "api", Priority: "urgent",
+	}
+	signed := func(mutate func(*RPCRequest)) RPCRequest {
+		req := base
+		if mutate != nil {
+			mutate(&req)
+		}
+		req.Signature = hmacSign("secret", req)
+		return req
+	}
+
+	tests := []struct {
+		name string
+		mode string
+		key  []byte
+		req  RPCRequest
+		ok   bool
+	}{
+		{"signing off", SigningOff, nil, base, true},
+		{"hmac", SigningHMAC, []byte("secret"), signed(nil), true},
+		{"hmac compacts args", SigningHMAC, []byte("secret"), func() RPCRequest {
+			req := signed(nil)
+			req.Args = json.RawMessage("{\"a\":\n 1}")
+			return req
+		}(), true},
+		{"ed25519", SigningEd25519, pub, func() RPCRequest {
+			req := base
+			req.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, canonicalRequest(req)))
+			return req
+		}(), true},
+		{"unsigned", SigningHMAC, []byte("secret"), base, false},
+		{"missing nonce", SigningHMAC, []byte("secret"), signed(func(r *RPCRequest) { r.Nonce = "" }), false},
+		{"wrong key", SigningHMAC, []byte("other"), signed(nil), false},
+		{"stale", SigningHMAC, []byte("secret"), signed(func(r *RPCRequest) { r.Timestamp = now - 600 }), false},
+		{"future", SigningHMAC, []byte("secret"), signed(func(r *RPCRequest) { r.Timestamp = now + 600 }), false},
+		{"bad encoding", SigningHMAC, []byte("secret"), func() RPCRequest {
+			req := signed(nil)
+			req.Signature = "not base64!"
+			return req
+		}(), false},
+		{"source changed", SigningHMAC, []byte("secret"), func() RPCRequest {
+			req := signed(nil)
+			req.Source = "attacker"
+			return req
+		}(), false},
+		{"priority changed", SigningHMAC, []byte("secret"), func() RPCRequest {
+			req := signed(nil)
+			req.Priority = ""
+			return req
+		}(), false},
+		{"target changed", SigningHMAC, []byte("secret"), func() RPCRequest {
+			req := signed(nil)
+			req.target = "ap1"
+			return req
+		}(), false},
+		{"ed25519 with hmac signature", SigningEd25519, pub, signed(nil), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOptions(t, Options{SigningMode: tt.mode, SigningKey: tt.key, SignatureMaxAge: 5 * time.Minute})
+			err := verifySignature(tt.req)
+			if tt.ok {
+				if err != nil {
+					t.Errorf("verifySignature = %v, want nil", err)
+				}
+				return
+			}
+			var rpcErr *Error
+			if !errors.As(err, &rpcErr) || rpcErr.Code != CodePermissionDenied {
+				t.Errorf("verifySignature = %v, want permission_denied", err)
+			}
+		})
+	}
+}
+
+func TestClaimNonce(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		claims []string
+		want   []bool
+	}{
+		{"fresh nonces", SigningHMAC, []string{"a", "b", "c"}, []bool{true, true, true}},
+		{"replay", SigningHMAC, []string{"a", "b", "a"}, []bool{true, true, false}},
+		{"signing off", SigningOff, []string{"a", "a"}, []bool{true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOptions(t, Options{SigningMode: tt.mode, SignatureMaxAge: 5 * time.Minute})
+			seenNonces.expires = map[string]time.Time{}
+			for i, nonce := range tt.claims {
+				if got := claimNonce(nonce); got != tt.want[i] {
+					t.Errorf("claim %d of %q = %t, want %t", i, nonce, got, tt.want[i])
+				}
+			}
+		})
+	}
+
+	// Nonces are forgotten once no request carrying them can still be fresh
+	setOptions(t, Options{SigningMode: SigningHMAC, SignatureMaxAge: 5 * time.Minute})
+	seenNonces.expires = map[string]time.Time{"old": time.Now().Add(-time.Second)}
+	if !claimNonce("old") {
+		t.Error("expired nonce was rejected")
+	}
+	if _, ok := seenNonces.expires["old"]; !ok {
+		t.Error("reclaimed nonce was not recorded")
+	}
+}
@@ -0,0 +1,31 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"spotfi-bridge/pkg/speedtest"
+)
+
+func init() {
+	register("spotfi.speedtest", "run", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		res, err := speedtest.Run(ctx, "rpc")
+		var tooSoon *speedtest.ErrTooSoon
+		if errors.As(err, &tooSoon) {
+			e := Errorf(CodeThrottled, "%s", err.Error())
+			e.Details = map[string]interface{}{"retryAfterMs": tooSoon.RetryAfter.Milliseconds()}
+			return nil, e
+		}
+		if res == nil {
+			return nil, err
+		}
+		return res, err
+	})
+	register("spotfi.speedtest", "last", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		if res := speedtest.Last(); res != nil {
+			return res, nil
+		}
+		return nil, Errorf(CodeNotFound, "no speedtest has run yet")
+	})
+}
@@ -0,0 +1,492 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/uci"
+)
+
+const (
+	// SSIDTimetableFile keeps the SSID timetables and their overrides
+	SSIDTimetableFile = "/etc/spotfi/ssid-timetables.json"
+
+	maxSSIDWindows = 28 // Per timetable, e.g. two windows a day
+)
+
+// SSIDTimetable turns a wifi-iface on during its windows and off outside them.
+// While it is set, the timetable owns the iface's disabled option
+type SSIDTimetable struct {
+	Iface    string       `json:"iface"`        // wifi-iface section, e.g. "guest"
+	TZ       string       `json:"tz,omitempty"` // As for schedules; UTC when empty
+	Windows  []SSIDWindow `json:"windows"`
+	Disabled bool         `json:"disabled,omitempty"` // Keep the timetable but stop enforcing it
+
+	Override  *SSIDOverride `json:"override,omitempty"`
+	UpdatedAt int64         `json:"updatedAt"`
+
+	loc *time.Location
+}
+
+// SSIDWindow is a daily time range on the given weekdays. An End at or before Start
+// runs past midnight into the next day; "24:00" ends at midnight
+type SSIDWindow struct {
+	Days  []string `json:"days"`  // sun-sat, ranges such as mon-fri, or "*"
+	Start string   `json:"start"` // HH:MM
+	End   string   `json:"end"`
+
+	days       uint8 // Bit n set for time.Weekday n
+	start, end int   // Minutes since midnight
+}
+
+// SSIDOverride forces an iface on or off regardless of its timetable
+type SSIDOverride struct {
+	Enabled bool   `json:"enabled"`
+	Until   int64  `json:"until,omitempty"` // Unix seconds; 0 keeps it until cleared
+	Reason  string `json:"reason,omitempty"`
+	SetAt   int64  `json:"setAt"`
+}
+
+// SSIDTimetableArgs name a timetable for delete and clear_override
+type SSIDTimetableArgs struct {
+	Iface string `json:"iface"`
+}
+
+// SSIDOverrideArgs are the arguments of spotfi.ssid/override
+type SSIDOverrideArgs struct {
+	Iface   string `json:"iface"`
+	Enabled bool   `json:"enabled"`
+
+	// Duration in seconds; 0 lasts until the timetable next changes state, -1 until cleared
+	Duration int    `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// SSIDState is the state of a timetabled iface, returned by list and published on
+// the schedule topic when the bridge changes it
+type SSIDState struct {
+	Type       string `json:"type"` // Always "ssid-state"
+	Iface      string `json:"iface"`
+	SSID       string `json:"ssid,omitempty"`
+	Enabled    bool   `json:"enabled"`
+	Source     string `json:"source"`               // timetable or override
+	NextChange int64  `json:"nextChange,omitempty"` // When the timetable next switches, Unix seconds
+	At         int64  `json:"at"`
+}
+
+var ssidTimetables = struct {
+	mu      sync.Mutex
+	byIface map[string]*SSIDTimetable
+}{byIface: map[string]*SSIDTimetable{}}
+
+func init() {
+	register("spotfi.ssid", "set_timetable", setSSIDTimetable)
+	register("spotfi.ssid", "delete_timetable", deleteSSIDTimetable)
+	register("spotfi.ssid", "list", listSSIDTimetables)
+	register("spotfi.ssid", "override", overrideSSID)
+	register("spotfi.ssid", "clear_override", clearSSIDOverride)
+}
+
+// parseClock parses HH:MM into minutes since midnight; 24:00 is allowed as an end
+func parseClock(s string, end bool) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	if end && h == 24 && m == 0 {
+		return 24 * 60, nil
+	}
+	if h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// prepareSSIDTimetable validates t and parses its windows
+func prepareSSIDTimetable(t *SSIDTimetable) error {
+	if !uciNamePattern.MatchString(t.Iface) {
+		return invalidArgs("invalid iface: %q", t.Iface)
+	}
+	loc, err := loadLocation(t.TZ)
+	if err != nil {
+		return invalidArgs("iface %s: %v", t.Iface, err)
+	}
+	if len(t.Windows) == 0 || len(t.Windows) > maxSSIDWindows {
+		return invalidArgs("iface %s: between 1 and %d windows are required", t.Iface, maxSSIDWindows)
+	}
+	for i := range t.Windows {
+		w := &t.Windows[i]
+		bits, err := parseCronField(strings.ToLower(strings.Join(w.Days, ",")), 0, 7, dayNames)
+		if err != nil || len(w.Days) == 0 {
+			return invalidArgs("iface %s: window %d: invalid days %v", t.Iface, i, w.Days)
+		}
+		if bits&(1<<7) != 0 {
+			bits |= 1
+		}
+		w.days = uint8(bits & 0x7f)
+		if w.start, err = parseClock(w.Start, false); err != nil {
+			return invalidArgs("iface %s: window %d: %v", t.Iface, i, err)
+		}
+		if w.end, err = parseClock(w.End, true); err != nil {
+			return invalidArgs("iface %s: window %d: %v", t.Iface, i, err)
+		}
+	}
+	t.loc = loc
+	return nil
+}
+
+// open reports whether a window of the timetable covers t
+func (t *SSIDTimetable) open(at time.Time) bool {
+	at = at.In(t.loc)
+	day, minute := at.Weekday(), at.Hour()*60+at.Minute()
+	yesterday := (day + 6) % 7
+	for _, w := range t.Windows {
+		if w.end > w.start {
+			if w.days&(1<<uint(day)) != 0 && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// Runs past midnight: the evening of its day or the morning after
+		if w.days&(1<<uint(day)) != 0 && minute >= w.start {
+			return true
+		}
+		if w.days&(1<<uint(yesterday)) != 0 && minute < w.end {
+			return true
+		}
+	}
+	return false
+}
+
+// nextChange returns the next minute at which the timetable switches state, or the
+// zero time when it never does within a week
+func (t *SSIDTimetable) nextChange(now time.Time) time.Time {
+	state := t.open(now)
+	at := now.Truncate(time.Minute)
+	for i := 0; i < 8*24*60; i++ {
+		at = at.Add(time.Minute)
+		if t.open(at) != state {
+			return at
+		}
+	}
+	return time.Time{}
+}
+
+// desired returns whether the iface should be on at now and what decided it;
+// ssidTimetables.mu must be held
+func (t *SSIDTimetable) desired(now time.Time) (bool, string) {
+	if o := t.Override; o != nil {
+		if o.Until == 0 || now.Unix() < o.Until {
+			return o.Enabled, "override"
+		}
+		t.Override = nil
+	}
+	return t.open(now), "timetable"
+}
+
+func (t *SSIDTimetable) state(now time.Time, ssid string) SSIDState {
+	enabled, source := t.desired(now)
+	s := SSIDState{Type: "ssid-state", Iface: t.Iface, SSID: ssid, Enabled: enabled, Source: source, At: now.Unix()}
+	if next := t.nextChange(now); !next.IsZero() {
+		s.NextChange = next.Unix()
+	}
+	return s
+}
+
+// wifiIfaces returns the wifi-iface sections by name
+func wifiIfaces() (map[string]uci.Section, error) {
+	sections, err := uci.SectionsOfType("wireless", "wifi-iface")
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]uci.Section, len(sections))
+	for _, s := range sections {
+		byName[s.Name] = s
+	}
+	return byName, nil
+}
+
+func setSSIDTimetable(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var t SSIDTimetable
+	if err := decodeArgs(raw, &t); err != nil {
+		return nil, err
+	}
+	t.Override = nil
+	if err := prepareSSIDTimetable(&t); err != nil {
+		return nil, err
+	}
+	ifaces, err := wifiIfaces()
+	if err != nil {
+		return nil, Errorf(CodeUbusError, "failed to read wireless config: %v", err)
+	}
+	if _, ok := ifaces[t.Iface]; !ok {
+		return nil, Errorf(CodeNotFound, "wifi-iface not found: %s", t.Iface)
+	}
+
+	now := time.Now()
+	ssidTimetables.mu.Lock()
+	if old := ssidTimetables.byIface[t.Iface]; old != nil {
+		t.Override = old.Override
+	}
+	t.UpdatedAt = now.Unix()
+	ssidTimetables.byIface[t.Iface] = &t
+	err = saveSSIDTimetablesLocked()
+	ssidTimetables.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return enforceSSIDs(ctx, now, t.Iface)
+}
+
+func deleteSSIDTimetable(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args SSIDTimetableArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	ssidTimetables.mu.Lock()
+	defer ssidTimetables.mu.Unlock()
+	if _, ok := ssidTimetables.byIface[args.Iface]; !ok {
+		return nil, Errorf(CodeNotFound, "no timetable for iface: %s", args.Iface)
+	}
+	// The iface keeps its current state
+	delete(ssidTimetables.byIface, args.Iface)
+	if err := saveSSIDTimetablesLocked(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"iface": args.Iface, "deleted": true}, nil
+}
+
+func listSSIDTimetables(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	ifaces, _ := wifiIfaces()
+	now := time.Now()
+	ssidTimetables.mu.Lock()
+	defer ssidTimetables.mu.Unlock()
+	list := make([]map[string]interface{}, 0, len(ssidTimetables.byIface))
+	for _, t := range ssidTimetables.byIface {
+		list = append(list, map[string]interface{}{
+			"timetable": t,
+			"state":     t.state(now, ifaces[t.Iface].Option("ssid")),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["timetable"].(*SSIDTimetable).Iface < list[j]["timetable"].(*SSIDTimetable).Iface
+	})
+	return map[string]interface{}{"timetables": list}, nil
+}
+
+// overrideSSID forces a timetabled iface on or off, e.g. for an event after hours
+func overrideSSID(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args SSIDOverrideArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Duration < -1 || args.Duration > 30*24*60*60 {
+		return nil, invalidArgs("duration must be between -1 and %d seconds", 30*24*60*60)
+	}
+	now := time.Now()
+	ssidTimetables.mu.Lock()
+	t := ssidTimetables.byIface[args.Iface]
+	if t == nil {
+		ssidTimetables.mu.Unlock()
+		return nil, Errorf(CodeNotFound, "no timetable for iface: %s (use spotfi.config/apply)", args.Iface)
+	}
+	o := &SSIDOverride{Enabled: args.Enabled, Reason: args.Reason, SetAt: now.Unix()}
+	switch {
+	case args.Duration > 0:
+		o.Until = now.Add(time.Duration(args.Duration) * time.Second).Unix()
+	case args.Duration == 0:
+		// Until the timetable itself would switch, e.g. "on until we open tomorrow"
+		if next := t.nextChange(now); !next.IsZero() {
+			o.Until = next.Unix()
+		}
+	}
+	t.Override = o
+	err := saveSSIDTimetablesLocked()
+	ssidTimetables.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("SSID override set", "iface", args.Iface, "enabled", args.Enabled, "until", o.Until, "reason", args.Reason)
+	return enforceSSIDs(ctx, now, args.Iface)
+}
+
+func clearSSIDOverride(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args SSIDTimetableArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ssidTimetables.mu.Lock()
+	t := ssidTimetables.byIface[args.Iface]
+	if t == nil {
+		ssidTimetables.mu.Unlock()
+		return nil, Errorf(CodeNotFound, "no timetable for iface: %s", args.Iface)
+	}
+	t.Override = nil
+	err := saveSSIDTimetablesLocked()
+	ssidTimetables.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return enforceSSIDs(ctx, now, args.Iface)
+}
+
+// enforceSSIDs turns the timetabled ifaces on or off as their timetables say and
+// returns the state of iface
+func enforceSSIDs(ctx context.Context, now time.Time, iface string) (interface{}, error) {
+	states, err := applySSIDs(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range states {
+		if s.Iface == iface {
+			return s, nil
+		}
+	}
+	return map[string]interface{}{"iface": iface, "enforced": false}, nil
+}
+
+var ssidApply sync.Mutex
+
+// applySSIDs sets the disabled option of every timetabled iface that differs from
+// its desired state, reloading Wi-Fi once, and publishes the changes
+func applySSIDs(ctx context.Context, now time.Time) ([]SSIDState, error) {
+	ssidApply.Lock()
+	defer ssidApply.Unlock()
+	uci.Lock()
+	defer uci.Unlock()
+	ifaces, err := wifiIfaces()
+	if err != nil {
+		return nil, Errorf(CodeUbusError, "failed to read wireless config: %v", err)
+	}
+
+	var states, changed []SSIDState
+	ssidTimetables.mu.Lock()
+	expired := false
+	for _, t := range ssidTimetables.byIface {
+		section, ok := ifaces[t.Iface]
+		if t.Disabled || !ok {
+			continue
+		}
+		hadOverride := t.Override != nil
+		s := t.state(now, section.Option("ssid"))
+		expired = expired || (hadOverride && t.Override == nil)
+		states = append(states, s)
+		if (section.Option("disabled") == "1") == s.Enabled {
+			changed = append(changed, s)
+		}
+	}
+	if expired {
+		saveSSIDTimetablesLocked()
+	}
+	ssidTimetables.mu.Unlock()
+	if len(changed) == 0 {
+		return states, nil
+	}
+
+	for _, s := range changed {
+		value := "1"
+		if s.Enabled {
+			value = "0"
+		}
+		if err := uci.Set("wireless."+s.Iface+".disabled", value); err != nil {
+			uci.Revert("wireless")
+			return nil, Errorf(CodeExecError, "failed to set %s: %v", s.Iface, err)
+		}
+	}
+	if err := uci.Commit("wireless"); err != nil {
+		uci.Revert("wireless")
+		return nil, Errorf(CodeExecError, "failed to commit wireless: %v", err)
+	}
+	if out, err := exec.CommandContext(ctx, "wifi", "reload").CombinedOutput(); err != nil {
+		return nil, Errorf(CodeExecError, "wifi reload failed: %s", strings.TrimSpace(string(out)))
+	}
+	for _, s := range changed {
+		logger.Info("SSID switched", "iface", s.Iface, "ssid", s.SSID, "enabled", s.Enabled, "source", s.Source)
+		if options.PublishSchedule != nil && (options.Connected == nil || options.Connected()) {
+			if err := options.PublishSchedule(s); err != nil {
+				logger.Warn("SSID state not published", "iface", s.Iface, "error", err)
+			}
+		}
+	}
+	return states, nil
+}
+
+// loadSSIDTimetables reads SSIDTimetableFile
+func loadSSIDTimetables() {
+	data, err := os.ReadFile(SSIDTimetableFile)
+	if err != nil {
+		return
+	}
+	var saved []*SSIDTimetable
+	if err := json.Unmarshal(data, &saved); err != nil {
+		logger.Error("Ignoring corrupt SSID timetable file", "file", SSIDTimetableFile, "error", err)
+		return
+	}
+	ssidTimetables.mu.Lock()
+	defer ssidTimetables.mu.Unlock()
+	for _, t := range saved {
+		if err := prepareSSIDTimetable(t); err != nil {
+			logger.Error("Ignoring invalid saved SSID timetable", "iface", t.Iface, "error", err)
+			continue
+		}
+		ssidTimetables.byIface[t.Iface] = t
+	}
+}
+
+// ssidLoop enforces the timetables at the start of every minute, so clock and
+// daylight saving changes are followed
+func ssidLoop(ctx context.Context) {
+	defer crash.Recover("ssid timetables")
+	for {
+		now := time.Now()
+		if clockSet(now) {
+			ssidTimetables.mu.Lock()
+			n := len(ssidTimetables.byIface)
+			ssidTimetables.mu.Unlock()
+			if n > 0 {
+				if _, err := applySSIDs(ctx, now); err != nil {
+					logger.Warn("Failed to apply SSID timetables", "error", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(now.Truncate(time.Minute).Add(time.Minute))):
+		}
+	}
+}
+
+// saveSSIDTimetablesLocked writes SSIDTimetableFile; ssidTimetables.mu must be held
+func saveSSIDTimetablesLocked() error {
+	list := make([]*SSIDTimetable, 0, len(ssidTimetables.byIface))
+	for _, t := range ssidTimetables.byIface {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Iface < list[j].Iface })
+	data, err := json.Marshal(list)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(SSIDTimetableFile), 0755)
+	}
+	if err == nil {
+		tmp := SSIDTimetableFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, SSIDTimetableFile)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save SSID timetables", "error", err)
+		return Errorf(CodeInternal, "failed to save SSID timetables: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package rpc
+
+import (
+	"context"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSource = "default"
+	maxBuckets    = 256
+
+	// PriorityUrgent marks a request for the reserved lane
+	PriorityUrgent = "urgent"
+)
+
+// DefaultUrgentPaths are the safety/abuse actions allowed on the urgent lane
+var DefaultUrgentPaths = []string{"spotfi.client", "spotfi.portal", "hostapd.*"}
+
+// tokenBucket allows Rate requests per second with bursts of up to Burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var limiter = struct {
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	inFlight chan struct{}
+	reserved chan struct{}
+}{buckets: map[string]*tokenBucket{}}
+
+// counters exported through Stats for the metrics payload
+var rpcCounters struct {
+	requests           atomic.Int64
+	throttledRate      atomic.Int64
+	throttledInFlight  atomic.Int64
+	duplicates         atomic.Int64
+	rejectedSignature  atomic.Int64
+	invalid            atomic.Int64
+	urgent             atomic.Int64
+	currentlyExecuting atomic.Int64
+}
+
+// isUrgent reports whether a request asked for, and may use, the urgent lane;
+// other paths asking for it are executed as normal requests
+func isUrgent(req RPCRequest) bool {
+	if req.Priority != PriorityUrgent {
+		return false
+	}
+	for _, pattern := range options.UrgentPaths {
+		if ok, _ := path.Match(pattern, req.Path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allow takes a token from the source's bucket and returns how long to wait when none is left.
+// Urgent requests draw from a separate bucket so a flood of normal calls cannot starve them
+func allow(source string, urgent bool) (bool, time.Duration) {
+	if options.RateLimit <= 0 {
+		return true, 0
+	}
+	if source == "" {
+		source = defaultSource
+	}
+	if urgent {
+		source += "/" + PriorityUrgent
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	b, ok := limiter.buckets[source]
+	if !ok {
+		// Idle buckets are full again, dropping them loses nothing
+		if len(limiter.buckets) >= maxBuckets {
+			for s, old := range limiter.buckets {
+				if now.Sub(old.last) > time.Minute {
+					delete(limiter.buckets, s)
+				}
+			}
+		}
+		b = &tokenBucket{tokens: float64(options.RateBurst), last: now}
+		limiter.buckets[source] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * options.RateLimit
+	if b.tokens > float64(options.RateBurst) {
+		b.tokens = float64(options.RateBurst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / options.RateLimit * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// acquireSlot reserves one of the MaxConcurrent execution slots without blocking.
+// Urgent requests fall back to the UrgentWorkers reserved slots when all regular
+// slots are busy (e.g. during an opkg upgrade)
+func acquireSlot(urgent bool) (release func(), ok bool) {
+	slots, reserved := slotChannels()
+	if slots == nil {
+		return func() {}, true
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+	}
+	if urgent && reserved != nil {
+		select {
+		case reserved <- struct{}{}:
+			return func() { <-reserved }, true
+		default:
+		}
+	}
+	return nil, false
+}
+
+// waitSlot blocks until one of the regular slots is free or ctx is done. Jobs
+// stay queued while they wait instead of being rejected like requests
+func waitSlot(ctx context.Context) (release func(), err error) {
+	slots, _ := slotChannels()
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func slotChannels() (slots, reserved chan struct{}) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.inFlight == nil && options.MaxConcurrent > 0 {
+		limiter.inFlight = make(chan struct{}, options.MaxConcurrent)
+	}
+	if limiter.reserved == nil && options.UrgentWorkers > 0 {
+		limiter.reserved = make(chan struct{}, options.UrgentWorkers)
+	}
+	return limiter.inFlight, limiter.reserved
+}
+
+// Stats returns RPC counters for the metrics payload
+func Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"requests":          rpcCounters.requests.Load(),
+		"throttledRate":     rpcCounters.throttledRate.Load(),
+		"throttledInFlight": rpcCounters.throttledInFlight.Load(),
+		"duplicates":        rpcCounters.duplicates.Load(),
+		"rejectedSignature": rpcCounters.rejectedSignature.Load(),
+		"invalid":           rpcCounters.invalid.Load(),
+		"urgent":            rpcCounters.urgent.Load(),
+		"inFlight":          rpcCounters.currentlyExecuting.Load(),
+	}
+}
@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"spotfi-bridge/pkg/traffic"
+)
+
+// TrafficQueryArgs are the arguments of spotfi.traffic/query
+type TrafficQueryArgs struct {
+	Group  []string `json:"group"`  // nlbwmon fields, default mac and ip
+	Period string   `json:"period"` // Start date of the accounting period, default the current one
+	Limit  int      `json:"limit"`  // Rows returned, largest first
+}
+
+const (
+	defaultTrafficLimit = 50
+	maxTrafficLimit     = 1000
+)
+
+func init() {
+	register("spotfi.traffic", "query", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args TrafficQueryArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if len(args.Group) == 0 {
+			args.Group = []string{"mac", "ip"}
+		}
+		for _, f := range args.Group {
+			if !traffic.GroupFields[f] {
+				return nil, invalidArgs("invalid group field %q, expected family, proto, port, mac, ip or layer7", f)
+			}
+		}
+		if args.Limit < 0 || args.Limit > maxTrafficLimit {
+			return nil, invalidArgs("limit must be between 0 and %d", maxTrafficLimit)
+		}
+		if args.Limit == 0 {
+			args.Limit = defaultTrafficLimit
+		}
+		rows, err := traffic.Query(ctx, args.Group, args.Period)
+		if err != nil {
+			return nil, trafficError(err)
+		}
+		result := map[string]interface{}{"group": args.Group, "total": len(rows)}
+		if args.Period != "" {
+			result["period"] = args.Period
+		}
+		result["rows"] = rows[:min(args.Limit, len(rows))]
+		return result, nil
+	})
+	register("spotfi.traffic", "periods", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		periods, err := traffic.Periods(ctx)
+		if err != nil {
+			return nil, trafficError(err)
+		}
+		return map[string]interface{}{"periods": periods}, nil
+	})
+}
+
+func trafficError(err error) error {
+	switch {
+	case errors.Is(err, traffic.ErrUnavailable):
+		return Errorf(CodeUnavailable, "%v", err)
+	case errors.Is(err, traffic.ErrInvalidPeriod):
+		return invalidArgs("%v", err)
+	}
+	return err
+}
@@ -0,0 +1,366 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/uci"
+)
+
+const (
+	uciConfigDir           = "/etc/config"
+	defaultRollbackTimeout = 60 * time.Second
+	// Below the MQTT keepalive a dead connection may still look connected
+	minRollbackTimeout = 30 * time.Second
+	maxRollbackTimeout = 10 * time.Minute
+	maxTxChanges       = 500
+)
+
+// UCIChange is one step of a spotfi.config/apply transaction
+type UCIChange struct {
+	Op      string `json:"op"`      // set, delete, add_list, del_list
+	Config  string `json:"config"`  // e.g. "wireless"
+	Section string `json:"section"` // Section name
+	Option  string `json:"option"`  // Empty to set the section type or delete the section
+	Value   string `json:"value"`
+}
+
+// ConfigApplyArgs are the arguments of spotfi.config/apply
+type ConfigApplyArgs struct {
+	Changes []UCIChange `json:"changes"`
+	Reload  []string    `json:"reload"` // Allowlisted services reloaded after commit
+
+	// RollbackTimeout is how long (seconds) MQTT connectivity has to be back
+	// after the apply before everything is reverted; -1 disables the check
+	RollbackTimeout int `json:"rollbackTimeout"`
+}
+
+// TransactionArgs identify a pending transaction for confirm/rollback
+type TransactionArgs struct {
+	TxID string `json:"txId"`
+}
+
+// pendingTx is an applied transaction waiting for connectivity to be confirmed
+type pendingTx struct {
+	ID        string
+	Snapshot  map[string][]byte      // Config name -> file contents before the apply, nil if absent
+	Modes     map[string]os.FileMode // Config name -> file permissions before the apply
+	Reload    []string
+	AppliedAt time.Time
+	Deadline  time.Time
+	timer     *time.Timer
+}
+
+var tx struct {
+	mu      sync.Mutex
+	pending *pendingTx
+}
+
+func init() {
+	register("spotfi.config", "apply", applyTransaction)
+	register("spotfi.config", "confirm", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return finishTransaction(raw, false)
+	})
+	register("spotfi.config", "rollback", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return finishTransaction(raw, true)
+	})
+	register("spotfi.config", "pending", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		if tx.pending == nil {
+			return map[string]interface{}{"pending": false}, nil
+		}
+		return map[string]interface{}{
+			"pending":  true,
+			"txId":     tx.pending.ID,
+			"deadline": tx.pending.Deadline.Unix(),
+		}, nil
+	})
+}
+
+func validateChange(c UCIChange) error {
+	if !uciNamePattern.MatchString(c.Config) || !uciNamePattern.MatchString(c.Section) {
+		return invalidArgs("invalid config or section: %q.%q", c.Config, c.Section)
+	}
+	if c.Option != "" && !uciNamePattern.MatchString(c.Option) {
+		return invalidArgs("invalid option: %q", c.Option)
+	}
+	if strings.ContainsAny(c.Value, "\n\x00") {
+		return invalidArgs("value of %s.%s.%s contains control characters", c.Config, c.Section, c.Option)
+	}
+	switch c.Op {
+	case "set", "delete":
+	case "add_list", "del_list":
+		if c.Option == "" {
+			return invalidArgs("%s requires an option", c.Op)
+		}
+	default:
+		return invalidArgs("unknown op: %q", c.Op)
+	}
+	return nil
+}
+
+func stageChange(c UCIChange) error {
+	key := c.Config + "." + c.Section
+	if c.Option != "" {
+		key += "." + c.Option
+	}
+	switch c.Op {
+	case "set":
+		return uci.Set(key, c.Value)
+	case "delete":
+		return uci.Delete(key)
+	case "add_list":
+		return uci.AddList(key, c.Value)
+	default:
+		return uci.DelList(key, c.Value)
+	}
+}
+
+func reloadServices(ctx context.Context, services []string) error {
+	for _, name := range services {
+		if out, err := exec.CommandContext(ctx, "/etc/init.d/"+name, "reload").CombinedOutput(); err != nil {
+			return Errorf(CodeExecError, "%s reload failed: %s", name, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// restoreSnapshot writes the saved config files back and reloads the services
+func restoreSnapshot(ctx context.Context, t *pendingTx) error {
+	uci.Lock()
+	firstErr := restoreFiles(t)
+	uci.Unlock()
+	if err := reloadServices(ctx, t.Reload); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// restoreFiles is the part of restoreSnapshot done under the uci lock
+func restoreFiles(t *pendingTx) error {
+	var firstErr error
+	for config, data := range t.Snapshot {
+		uci.Revert(config)
+		path := filepath.Join(uciConfigDir, config)
+		var err error
+		if data == nil {
+			err = os.Remove(path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			// WriteFile leaves the mode of an existing file alone and umask applies
+			// to a new one, so the saved mode is set explicitly
+			tmp := path + ".spotfi-rollback"
+			mode := t.Modes[config]
+			if err = os.WriteFile(tmp, data, mode); err == nil {
+				if err = os.Chmod(tmp, mode); err == nil {
+					err = os.Rename(tmp, path)
+				}
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("restore %s: %w", config, err)
+		}
+	}
+	return firstErr
+}
+
+// applyTransaction stages all changes, commits them and reloads services as one
+// unit. Any failure restores the previous config files; a successful apply is
+// reverted as well unless connectivity is confirmed before the rollback deadline
+func applyTransaction(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args ConfigApplyArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	return applyChanges(ctx, args)
+}
+
+// applyChanges is applyTransaction for changes built by other operations
+func applyChanges(ctx context.Context, args ConfigApplyArgs) (map[string]interface{}, error) {
+	if len(args.Changes) == 0 || len(args.Changes) > maxTxChanges {
+		return nil, invalidArgs("between 1 and %d changes are required", maxTxChanges)
+	}
+	for _, c := range args.Changes {
+		if err := validateChange(c); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range args.Reload {
+		if !serviceAllowed(name) {
+			return nil, Errorf(CodePermissionDenied, "service not in allowlist: %s", name)
+		}
+	}
+	timeout := defaultRollbackTimeout
+	switch {
+	case args.RollbackTimeout < 0:
+		timeout = 0
+	case args.RollbackTimeout > 0:
+		timeout = time.Duration(args.RollbackTimeout) * time.Second
+		if timeout < minRollbackTimeout || timeout > maxRollbackTimeout {
+			return nil, invalidArgs("rollbackTimeout must be between %d and %d seconds",
+				int(minRollbackTimeout.Seconds()), int(maxRollbackTimeout.Seconds()))
+		}
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.pending != nil {
+		return nil, fmt.Errorf("transaction %s is awaiting confirmation", tx.pending.ID)
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	t := &pendingTx{
+		ID:        "tx-" + hex.EncodeToString(buf),
+		Snapshot:  map[string][]byte{},
+		Modes:     map[string]os.FileMode{},
+		Reload:    args.Reload,
+		AppliedAt: time.Now(),
+	}
+
+	if err := commitChanges(t, args.Changes); err != nil {
+		return nil, err
+	}
+	if err := reloadServices(ctx, args.Reload); err != nil {
+		if rbErr := restoreSnapshot(context.Background(), t); rbErr != nil {
+			logger.Error("Rollback failed", "transaction", t.ID, "error", rbErr)
+		}
+		return map[string]interface{}{"txId": t.ID, "rolledBack": true}, err
+	}
+
+	result := map[string]interface{}{"txId": t.ID, "applied": len(args.Changes)}
+	if timeout == 0 {
+		return result, nil
+	}
+	t.Deadline = t.AppliedAt.Add(timeout)
+	t.timer = time.AfterFunc(timeout, func() {
+		defer crash.Catch("transaction rollback")
+		rollbackDeadline(t)
+	})
+	tx.pending = t
+	result["deadline"] = t.Deadline.Unix()
+	return result, nil
+}
+
+// commitChanges snapshots the files of the changed configs into t, then stages
+// and commits the changes under the uci lock. A failed commit restores the files
+func commitChanges(t *pendingTx, changes []UCIChange) error {
+	uci.Lock()
+	defer uci.Unlock()
+
+	// Snapshot the committed files and drop unrelated staged changes, which
+	// would otherwise be committed along with the transaction
+	for _, c := range changes {
+		if _, ok := t.Snapshot[c.Config]; ok {
+			continue
+		}
+		path := filepath.Join(uciConfigDir, c.Config)
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if data != nil {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			t.Modes[c.Config] = info.Mode().Perm()
+		}
+		t.Snapshot[c.Config] = data
+		uci.Revert(c.Config)
+	}
+
+	for i, c := range changes {
+		if err := stageChange(c); err != nil {
+			for config := range t.Snapshot {
+				uci.Revert(config)
+			}
+			return Errorf(CodeInvalidArgs, "change %d (%s %s.%s.%s) failed: %v", i, c.Op, c.Config, c.Section, c.Option, err)
+		}
+	}
+	for config := range t.Snapshot {
+		if err := uci.Commit(config); err != nil {
+			// Nothing was reloaded yet, so the files are all there is to restore
+			restoreFiles(t)
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackDeadline runs when the timeout expires: the transaction is kept if
+// MQTT is connected, and reverted otherwise
+func rollbackDeadline(t *pendingTx) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.pending != t {
+		return
+	}
+	tx.pending = nil
+
+	if options.Connected != nil && options.Connected() {
+		logger.Info("Transaction confirmed: MQTT connected at deadline", "transaction", t.ID)
+		return
+	}
+	logger.Warn("No MQTT connectivity, rolling back transaction", "transaction", t.ID, "after", t.Deadline.Sub(t.AppliedAt))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if err := restoreSnapshot(ctx, t); err != nil {
+		logger.Error("Rollback failed", "transaction", t.ID, "error", err)
+	}
+}
+
+// ConnectionEstablished confirms a pending transaction once MQTT (re)connects,
+// proving the applied configuration still reaches the broker, and publishes the
+// scheduled run reports and quota events kept while it was unreachable
+func ConnectionEstablished() {
+	go flushScheduleRuns()
+	go flushQuotaEvents()
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.pending == nil {
+		return
+	}
+	tx.pending.timer.Stop()
+	logger.Info("Transaction confirmed: MQTT reconnected", "transaction", tx.pending.ID)
+	tx.pending = nil
+}
+
+func finishTransaction(raw json.RawMessage, rollback bool) (interface{}, error) {
+	var args TransactionArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	t := tx.pending
+	if t == nil || t.ID != args.TxID {
+		return nil, Errorf(CodeNotFound, "no pending transaction %s", args.TxID)
+	}
+	t.timer.Stop()
+	tx.pending = nil
+
+	if !rollback {
+		return map[string]interface{}{"txId": t.ID, "confirmed": true}, nil
+	}
+	if err := restoreSnapshot(context.Background(), t); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"txId": t.ID, "rolledBack": true}, nil
+}
@@ -0,0 +1,53 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+
+	"spotfi-bridge/pkg/update"
+)
+
+// UpdateArgs are the arguments of spotfi.update/check and spotfi.update/apply
+type UpdateArgs struct {
+	Manifest string `json:"manifest"` // Overrides SPOTFI_UPDATE_URL, e.g. for a hotfix build
+	Channel  string `json:"channel"`  // Overrides the router's channel for this call
+	Force    bool   `json:"force"`    // Install even if the release is not newer or the router is not in its rollout (apply only)
+}
+
+func init() {
+	register("spotfi.update", "check", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args UpdateArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		return update.Check(ctx, args.Manifest, args.Channel)
+	})
+	register("spotfi.update", "apply", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args UpdateArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		return update.Apply(ctx, args.Manifest, args.Channel, args.Force, "rpc")
+	})
+	register("spotfi.update", "status", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		if res := update.Last(); res != nil {
+			return res, nil
+		}
+		return nil, Errorf(CodeNotFound, "no update has run since the bridge started")
+	})
+	register("spotfi.update", "set_channel", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args struct {
+			Channel string `json:"channel"`
+		}
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if args.Channel == "" {
+			return nil, invalidArgs("channel is required")
+		}
+		if err := update.SetChannel(args.Channel); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"channel": update.Channel()}, nil
+	})
+}
@@ -0,0 +1,250 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"spotfi-bridge/pkg/ubus"
+)
+
+const defaultPortalInterface = "uspot"
+
+// PortalClientArgs are the arguments of the spotfi.portal operations
+type PortalClientArgs struct {
+	Mac       string `json:"mac"`
+	Interface string `json:"interface"` // uspot instance, defaults to "uspot"
+
+	// authorize only
+	SessionTimeout int   `json:"sessionTimeout"` // Seconds, 0 for the portal default
+	MaxTotalOctets int64 `json:"maxTotalOctets"` // Data quota in bytes, 0 for unlimited
+
+	// deauthorize only
+	Deauth bool `json:"deauth"` // Also disassociate the station from Wi-Fi
+
+	// authorize and set_bandwidth
+	UploadKbit   int `json:"uploadKbit"`
+	DownloadKbit int `json:"downloadKbit"`
+}
+
+func init() {
+	register("spotfi.portal", "authorize", portalAuthorize)
+	register("spotfi.portal", "deauthorize", portalDeauthorize)
+	register("spotfi.portal", "session", portalSession)
+	register("spotfi.portal", "set_bandwidth", portalSetBandwidth)
+}
+
+func parsePortalArgs(raw json.RawMessage) (PortalClientArgs, error) {
+	var args PortalClientArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return args, err
+	}
+	mac, err := normalizeMAC(args.Mac)
+	if err != nil {
+		return args, err
+	}
+	args.Mac = mac
+	if args.Interface == "" {
+		args.Interface = defaultPortalInterface
+	}
+	if !uciNamePattern.MatchString(args.Interface) {
+		return args, invalidArgs("invalid interface: %q", args.Interface)
+	}
+	if args.SessionTimeout < 0 || args.MaxTotalOctets < 0 || args.UploadKbit < 0 || args.DownloadKbit < 0 {
+		return args, invalidArgs("limits must not be negative")
+	}
+	return args, nil
+}
+
+func portalClient(args PortalClientArgs) (map[string]interface{}, error) {
+	return ubus.Call("uspot", "client_get", map[string]interface{}{
+		"interface": args.Interface,
+		"address":   args.Mac,
+	})
+}
+
+func portalAuthorize(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	args, err := parsePortalArgs(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := authorizeClient(args); err != nil {
+		return nil, err
+	}
+	return sessionSummary(args)
+}
+
+// AuthorizePortalClient authorizes a client on uspot outside of an RPC, for
+// decisions of the portal auth relay
+func AuthorizePortalClient(args PortalClientArgs) error {
+	raw, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	if args, err = parsePortalArgs(raw); err != nil {
+		return err
+	}
+	return authorizeClient(args)
+}
+
+func authorizeClient(args PortalClientArgs) error {
+	req := map[string]interface{}{
+		"interface": args.Interface,
+		"address":   args.Mac,
+		"state":     1,
+	}
+	if args.SessionTimeout > 0 {
+		req["session_timeout"] = args.SessionTimeout
+	}
+	if args.MaxTotalOctets > 0 {
+		req["max_total_octets"] = args.MaxTotalOctets
+	}
+	if _, err := ubus.Call("uspot", "client_add", req); err != nil {
+		return err
+	}
+
+	if args.UploadKbit > 0 || args.DownloadKbit > 0 {
+		return setClientRate(args)
+	}
+	return nil
+}
+
+// DeauthorizePortalClient removes a client from uspot outside of an RPC, for logins
+// the portal auth relay revokes
+func DeauthorizePortalClient(mac, iface string) error {
+	raw, err := json.Marshal(PortalClientArgs{Mac: mac, Interface: iface})
+	if err != nil {
+		return err
+	}
+	_, err = portalDeauthorize(context.Background(), raw)
+	return err
+}
+
+func portalDeauthorize(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	args, err := parsePortalArgs(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := ubus.Call("uspot", "client_remove", map[string]interface{}{
+		"interface": args.Interface,
+		"address":   args.Mac,
+	}); err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{"mac": args.Mac, "deauthorized": true}
+	if args.Deauth {
+		for _, obj := range stationInterfaces(args.Mac) {
+			if _, err := ubus.Call(obj, "del_client", map[string]interface{}{
+				"addr": args.Mac, "reason": 5, "deauth": true, "ban_time": 0,
+			}); err != nil {
+				return result, err
+			}
+		}
+		result["disassociated"] = true
+	}
+	return result, nil
+}
+
+func portalSession(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	args, err := parsePortalArgs(raw)
+	if err != nil {
+		return nil, err
+	}
+	return sessionSummary(args)
+}
+
+func portalSetBandwidth(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	args, err := parsePortalArgs(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := setClientRate(args); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"mac":          args.Mac,
+		"uploadKbit":   args.UploadKbit,
+		"downloadKbit": args.DownloadKbit,
+	}, nil
+}
+
+// setClientRate applies per-station shaping through the ratelimit ubus service used by uspot
+func setClientRate(args PortalClientArgs) error {
+	devices := stationInterfaces(args.Mac)
+	if len(devices) == 0 {
+		return Errorf(CodeNotFound, "station %s is not associated", args.Mac)
+	}
+	for _, obj := range devices {
+		req := map[string]interface{}{
+			"device":  strings.TrimPrefix(obj, "hostapd."),
+			"address": args.Mac,
+		}
+		// Directions left at 0 are not limited
+		if args.UploadKbit > 0 {
+			req["rate_ingress"] = strconv.Itoa(args.UploadKbit) + "kbit"
+		}
+		if args.DownloadKbit > 0 {
+			req["rate_egress"] = strconv.Itoa(args.DownloadKbit) + "kbit"
+		}
+		if _, err := ubus.Call("ratelimit", "client_set", req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func numberField(m map[string]interface{}, names ...string) (float64, bool) {
+	for _, name := range names {
+		if v, ok := m[name].(float64); ok {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// portalOctets returns the bytes a uspot client downloaded and uploaded in its session
+func portalOctets(client map[string]interface{}) (in, out float64) {
+	in, _ = numberField(client, "bytes_dl", "acct_input_octets", "download")
+	out, _ = numberField(client, "bytes_ul", "acct_output_octets", "upload")
+	return in, out
+}
+
+// sessionSummary reports the portal state of a client with remaining time and quota
+func sessionSummary(args PortalClientArgs) (interface{}, error) {
+	client, err := portalClient(args)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := map[string]interface{}{
+		"mac":       args.Mac,
+		"interface": args.Interface,
+		"client":    client,
+	}
+	state, _ := numberField(client, "state")
+	summary["authorized"] = state == 1
+
+	duration, hasDuration := numberField(client, "duration", "time")
+	if timeout, ok := numberField(client, "session_timeout"); ok && timeout > 0 && hasDuration {
+		remaining := timeout - duration
+		if remaining < 0 {
+			remaining = 0
+		}
+		summary["remainingSeconds"] = remaining
+	}
+
+	in, out := portalOctets(client)
+	summary["usedOctets"] = in + out
+	if quota, ok := numberField(client, "max_total_octets"); ok && quota > 0 {
+		remaining := quota - in - out
+		if remaining < 0 {
+			remaining = 0
+		}
+		summary["remainingOctets"] = remaining
+	}
+	return summary, nil
+}
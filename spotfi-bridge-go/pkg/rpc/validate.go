@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxIDLength   = 128
+	maxNameLength = 128
+	maxKeyLength  = 256
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// validationError describes which request field was rejected
+func validationError(field, format string, args ...interface{}) *Error {
+	e := invalidArgs(format, args...)
+	e.Details = map[string]interface{}{}
+	if field != "" {
+		e.Details["field"] = field
+	}
+	return e
+}
+
+// parseRequest decodes a request strictly: unknown fields, wrong types, missing
+// id/path/method and oversized args are rejected with a descriptive error
+func parseRequest(payload []byte) (RPCRequest, error) {
+	var req RPCRequest
+	// The ID is recovered first so even rejected requests can be answered
+	var envelope struct {
+		ID interface{} `json:"id"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return req, validationError("", "invalid request JSON: %v", err)
+	}
+	if id, ok := envelope.ID.(string); ok {
+		req.ID = id
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &typeErr):
+			return req, validationError(typeErr.Field, "invalid request: %s must be %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return req, validationError(field, "invalid request: unknown field %q", field)
+		}
+		return req, validationError("", "invalid request: %v", err)
+	}
+
+	switch {
+	case req.Type != "" && req.Type != "rpc":
+		return req, validationError("type", "invalid request: type must be \"rpc\", got %q", req.Type)
+	case req.ID == "":
+		return req, validationError("id", "invalid request: id is required")
+	case len(req.ID) > maxIDLength:
+		return req, validationError("id", "invalid request: id longer than %d characters", maxIDLength)
+	case req.Path == "":
+		return req, validationError("path", "invalid request: path is required")
+	case len(req.Path) > maxNameLength || !namePattern.MatchString(req.Path):
+		return req, validationError("path", "invalid request: invalid path %q", req.Path)
+	case req.Method == "":
+		return req, validationError("method", "invalid request: method is required")
+	case len(req.Method) > maxNameLength || !namePattern.MatchString(req.Method):
+		return req, validationError("method", "invalid request: invalid method %q", req.Method)
+	case len(req.IdempotencyKey) > maxKeyLength || len(req.Source) > maxKeyLength || len(req.Nonce) > maxKeyLength:
+		return req, validationError("", "invalid request: idempotencyKey, source and nonce are limited to %d characters", maxKeyLength)
+	case req.Priority != "" && req.Priority != PriorityUrgent:
+		return req, validationError("priority", "invalid request: unknown priority %q", req.Priority)
+	}
+
+	args := bytes.TrimSpace(req.Args)
+	if len(args) > options.MaxArgsSize {
+		e := validationError("args", "invalid request: args exceed %d bytes", options.MaxArgsSize)
+		e.Details["size"] = len(args)
+		e.Details["limit"] = options.MaxArgsSize
+		return req, e
+	}
+	if len(args) > 0 && string(args) != "null" && args[0] != '{' {
+		return req, validationError("args", "invalid request: args must be an object")
+	}
+	return req, nil
+}
@@ -0,0 +1,750 @@
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/uci"
+)
+
+const (
+	// WalledGardenFile keeps the walled garden pushed by the backend
+	WalledGardenFile = "/etc/spotfi/walled-garden.json"
+
+	// walledGardenSet is the name of the fw4 sets (with "4" and "6" appended) and
+	// of the UCI sections defining them
+	walledGardenSet = "spotfi_wg"
+
+	defaultWalledGardenZone    = "hotspot"
+	defaultWalledGardenRefresh = 5 * time.Minute
+	minWalledGardenRefresh     = time.Minute
+
+	// Addresses a domain stopped resolving to are kept this many refreshes, as
+	// round-robin DNS answers with a subset each time
+	walledGardenGrace = 3
+
+	maxWalledGardenDomains = 200
+	maxWalledGardenIPs     = 1000
+	maxWalledGardenEntries = 4096 // Per family, static and resolved together
+)
+
+var domainPattern = regexp.MustCompile(`^([A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9])?\.)+[A-Za-z]{2,63}$`)
+
+// WalledGardenArgs are the arguments of spotfi.walledgarden/set: the complete list of
+// destinations captive portal clients may reach before they log in
+type WalledGardenArgs struct {
+	Domains []string `json:"domains"` // Resolved every Refresh seconds
+	IPs     []string `json:"ips"`     // Addresses or CIDR networks
+	Zone    string   `json:"zone"`    // Firewall zone of the portal (default hotspot)
+	Refresh int      `json:"refresh"` // Seconds, at least 60 (default 300)
+}
+
+// WalledGardenChangeArgs are the arguments of spotfi.walledgarden/add and remove
+type WalledGardenChangeArgs struct {
+	Domains []string `json:"domains"`
+	IPs     []string `json:"ips"`
+}
+
+// WalledGardenDomain is the resolution state of one domain
+type WalledGardenDomain struct {
+	Domain     string   `json:"domain"`
+	Addresses  []string `json:"addresses"`
+	Error      string   `json:"error,omitempty"` // Of the last lookup; its previous addresses are kept
+	ResolvedAt int64    `json:"resolvedAt,omitempty"`
+}
+
+// WalledGardenReport is returned by get and published on the walledgarden topic
+// whenever the effective set changes
+type WalledGardenReport struct {
+	Type    string               `json:"type"` // Always "walledGarden"
+	Zone    string               `json:"zone,omitempty"`
+	Domains []WalledGardenDomain `json:"domains"`
+	IPs     []string             `json:"ips"`
+
+	// Effective holds the addresses actually in the firewall sets, read back from
+	// nftables, and Hash their SHA-256 so the backend can compare cheaply
+	Effective struct {
+		IPv4 []string `json:"ipv4"`
+		IPv6 []string `json:"ipv6"`
+	} `json:"effective"`
+	Hash        string `json:"hash"`
+	Error       string `json:"error,omitempty"` // Of the last firewall update
+	RefreshedAt int64  `json:"refreshedAt,omitempty"`
+	UpdatedAt   int64  `json:"updatedAt,omitempty"`
+}
+
+type resolvedAddr struct {
+	missed int // Refreshes since the domain last resolved to it
+}
+
+var walledGarden = struct {
+	mu        sync.Mutex
+	config    WalledGardenArgs
+	updatedAt int64
+	resolved  map[string]map[string]*resolvedAddr // By domain, then address
+	errors    map[string]string
+	times     map[string]int64
+	lastHash  string
+	lastError string
+	refreshed int64
+	wake      chan struct{}
+	apply     sync.Mutex // Serializes firewall updates
+}{resolved: map[string]map[string]*resolvedAddr{}, errors: map[string]string{}, times: map[string]int64{}, wake: make(chan struct{}, 1)}
+
+func init() {
+	register("spotfi.walledgarden", "set", setWalledGarden)
+	register("spotfi.walledgarden", "add", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return changeWalledGarden(ctx, raw, true)
+	})
+	register("spotfi.walledgarden", "remove", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return changeWalledGarden(ctx, raw, false)
+	})
+	register("spotfi.walledgarden", "get", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return walledGardenReport(), nil
+	})
+	register("spotfi.walledgarden", "refresh", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return refreshWalledGarden(ctx, true)
+	})
+}
+
+// normalizeWalledGarden validates and deduplicates args
+func normalizeWalledGarden(args *WalledGardenArgs) error {
+	domains := map[string]bool{}
+	for _, d := range args.Domains {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		if len(d) > 253 || !domainPattern.MatchString(d) {
+			return invalidArgs("invalid domain: %q (wildcards are not supported, list each host)", d)
+		}
+		domains[d] = true
+	}
+	ips := map[string]bool{}
+	for _, ip := range args.IPs {
+		ip = strings.TrimSpace(ip)
+		if parsed := net.ParseIP(ip); parsed != nil {
+			ips[parsed.String()] = true
+			continue
+		}
+		_, network, err := net.ParseCIDR(ip)
+		if err != nil {
+			return invalidArgs("invalid address: %q", ip)
+		}
+		ones, bits := network.Mask.Size()
+		if ones == 0 {
+			return invalidArgs("%s would open the walled garden to everything", ip)
+		}
+		if ones == bits {
+			ips[network.IP.String()] = true // nftables lists host networks as addresses
+			continue
+		}
+		ips[network.String()] = true
+	}
+	if len(domains) > maxWalledGardenDomains {
+		return invalidArgs("at most %d domains are allowed", maxWalledGardenDomains)
+	}
+	if len(ips) > maxWalledGardenIPs {
+		return invalidArgs("at most %d addresses are allowed", maxWalledGardenIPs)
+	}
+	args.Domains, args.IPs = sortedKeys(domains), sortedKeys(ips)
+
+	if args.Zone == "" {
+		args.Zone = defaultWalledGardenZone
+	}
+	if !uciNamePattern.MatchString(args.Zone) {
+		return invalidArgs("invalid zone: %q", args.Zone)
+	}
+	if args.Refresh == 0 {
+		args.Refresh = int(defaultWalledGardenRefresh.Seconds())
+	}
+	if time.Duration(args.Refresh)*time.Second < minWalledGardenRefresh || args.Refresh > 24*60*60 {
+		return invalidArgs("refresh must be between %d and 86400 seconds", int(minWalledGardenRefresh.Seconds()))
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func setWalledGarden(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args WalledGardenArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	return replaceWalledGarden(ctx, args)
+}
+
+// changeWalledGarden adds destinations to the walled garden or removes them
+func changeWalledGarden(ctx context.Context, raw json.RawMessage, add bool) (interface{}, error) {
+	var args WalledGardenChangeArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	walledGarden.mu.Lock()
+	next := walledGarden.config
+	walledGarden.mu.Unlock()
+
+	edit := func(list, changes []string) []string {
+		if add {
+			return append(append([]string{}, list...), changes...)
+		}
+		drop := map[string]bool{}
+		for _, c := range changes {
+			drop[strings.TrimSuffix(strings.ToLower(strings.TrimSpace(c)), ".")] = true
+		}
+		var kept []string
+		for _, v := range list {
+			if !drop[v] {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	}
+	next.Domains = edit(next.Domains, args.Domains)
+	next.IPs = edit(next.IPs, args.IPs)
+	return replaceWalledGarden(ctx, next)
+}
+
+// replaceWalledGarden makes args the walled garden, resolves it and updates the firewall
+func replaceWalledGarden(ctx context.Context, args WalledGardenArgs) (interface{}, error) {
+	if err := normalizeWalledGarden(&args); err != nil {
+		return nil, err
+	}
+	if len(args.Domains) > 0 || len(args.IPs) > 0 {
+		zones, err := firewallZones()
+		if err != nil {
+			return nil, err
+		}
+		if err := validateZone(zones, args.Zone, false); err != nil {
+			return nil, err
+		}
+	}
+
+	walledGarden.mu.Lock()
+	walledGarden.config = args
+	walledGarden.updatedAt = time.Now().Unix()
+	keep := map[string]bool{}
+	for _, d := range args.Domains {
+		keep[d] = true
+	}
+	for d := range walledGarden.resolved {
+		if !keep[d] {
+			delete(walledGarden.resolved, d)
+			delete(walledGarden.errors, d)
+			delete(walledGarden.times, d)
+		}
+	}
+	err := saveWalledGardenLocked()
+	walledGarden.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensureWalledGardenFirewall(ctx, args); err != nil {
+		return nil, err
+	}
+	select {
+	case walledGarden.wake <- struct{}{}: // Restart the refresh period
+	default:
+	}
+	return refreshWalledGarden(ctx, true)
+}
+
+// ensureWalledGardenFirewall creates the fw4 sets and the rules accepting traffic
+// from the portal zone to them, or removes them with an empty walled garden
+func ensureWalledGardenFirewall(ctx context.Context, args WalledGardenArgs) error {
+	walledGarden.apply.Lock()
+	defer walledGarden.apply.Unlock()
+	uci.Lock()
+	defer uci.Unlock()
+	all, err := uci.Show("firewall")
+	if err != nil {
+		return Errorf(CodeUbusError, "failed to read firewall config: %v", err)
+	}
+	existing := map[string]uci.Section{}
+	for _, s := range all {
+		existing[s.Name] = s
+	}
+
+	empty := len(args.Domains) == 0 && len(args.IPs) == 0
+	var opts [][2]string
+	for _, family := range []string{"4", "6"} {
+		set, rule := walledGardenSet+family, walledGardenSet+family+"_allow"
+		if empty {
+			for _, name := range []string{set, rule} {
+				if _, ok := existing[name]; ok {
+					opts = append(opts, [2]string{name, ""})
+				}
+			}
+			continue
+		}
+		want := [][2]string{
+			{set, "ipset"},
+			{set + ".name", set},
+			{set + ".family", "ipv" + family},
+			{set + ".match", "dest_net"},
+			{set + ".loadfile", walledGardenLoadfile(family)},
+			{rule, "rule"},
+			{rule + ".name", "SpotFi walled garden (IPv" + family + ")"},
+			{rule + ".src", args.Zone},
+			{rule + ".dest", "*"},
+			{rule + ".family", "ipv" + family},
+			{rule + ".proto", "all"},
+			{rule + ".ipset", set},
+			{rule + ".target", "ACCEPT"},
+		}
+		for _, o := range want {
+			section, option, _ := strings.Cut(o[0], ".")
+			s, ok := existing[section]
+			switch {
+			case option == "" && ok && s.Type == o[1]:
+			case option != "" && ok && s.Option(option) == o[1]:
+			default:
+				opts = append(opts, o)
+			}
+		}
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+
+	for _, o := range opts {
+		if empty {
+			err = uci.Delete("firewall." + o[0])
+		} else {
+			err = uci.Set("firewall."+o[0], o[1])
+		}
+		if err != nil {
+			uci.Revert("firewall")
+			return Errorf(CodeExecError, "failed to update firewall.%s: %v", o[0], err)
+		}
+	}
+	if err := uci.Commit("firewall"); err != nil {
+		uci.Revert("firewall")
+		return Errorf(CodeExecError, "failed to commit firewall: %v", err)
+	}
+	if empty {
+		for _, family := range []string{"4", "6"} {
+			os.Remove(walledGardenLoadfile(family))
+		}
+	} else if err := writeWalledGardenLoadfiles(nil, nil); err != nil {
+		return err
+	}
+	logger.Info("Walled garden firewall rules updated", "zone", args.Zone, "removed", empty)
+	return reloadFirewall(ctx)
+}
+
+// walledGardenLoadfile is read by fw4 to fill the set on reloads and at boot
+func walledGardenLoadfile(family string) string {
+	return filepath.Join(filepath.Dir(WalledGardenFile), "walled-garden.v"+family)
+}
+
+// writeWalledGardenLoadfiles writes the loadfiles, keeping the current ones when
+// both lists are nil
+func writeWalledGardenLoadfiles(v4, v6 []string) error {
+	for family, list := range map[string][]string{"4": v4, "6": v6} {
+		path := walledGardenLoadfile(family)
+		if list == nil {
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+		}
+		tmp := path + ".tmp"
+		data := strings.Join(list, "\n")
+		if data != "" {
+			data += "\n"
+		}
+		if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+			return Errorf(CodeInternal, "failed to write %s: %v", path, err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return Errorf(CodeInternal, "failed to write %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// resolveWalledGarden looks up every domain, updating walledGarden.resolved
+func resolveWalledGarden(ctx context.Context, domains []string) {
+	resolver := &net.Resolver{PreferGo: true}
+	type lookup struct {
+		domain string
+		addrs  []string
+		err    error
+	}
+	results := make(chan lookup, len(domains))
+	sem := make(chan struct{}, 8)
+	for _, d := range domains {
+		go func(d string) {
+			defer crash.Catch("walled garden lookup")
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			ips, err := resolver.LookupIPAddr(lctx, d)
+			var addrs []string
+			for _, ip := range ips {
+				addrs = append(addrs, ip.IP.String())
+			}
+			results <- lookup{domain: d, addrs: addrs, err: err}
+		}(d)
+	}
+
+	now := time.Now().Unix()
+	for range domains {
+		r := <-results
+		walledGarden.mu.Lock()
+		known := walledGarden.resolved[r.domain]
+		if known == nil {
+			known = map[string]*resolvedAddr{}
+			walledGarden.resolved[r.domain] = known
+		}
+		if r.err != nil {
+			// Keep the previous addresses: the portal should not break with the resolver
+			walledGarden.errors[r.domain] = r.err.Error()
+			walledGarden.mu.Unlock()
+			continue
+		}
+		delete(walledGarden.errors, r.domain)
+		walledGarden.times[r.domain] = now
+		current := map[string]bool{}
+		for _, a := range r.addrs {
+			current[a] = true
+			known[a] = &resolvedAddr{}
+		}
+		for a, st := range known {
+			if current[a] {
+				continue
+			}
+			if st.missed++; st.missed >= walledGardenGrace {
+				delete(known, a)
+			}
+		}
+		walledGarden.mu.Unlock()
+	}
+}
+
+// effectiveEntries returns the addresses the sets should hold per family, without
+// entries covered by a configured network (nftables rejects overlapping intervals);
+// walledGarden.mu must be held
+func effectiveEntriesLocked() (v4, v6 []string) {
+	all := map[string]bool{}
+	for _, ip := range walledGarden.config.IPs {
+		all[ip] = true
+	}
+	for _, addrs := range walledGarden.resolved {
+		for a := range addrs {
+			all[a] = true
+		}
+	}
+	var networks []*net.IPNet
+	for e := range all {
+		if _, n, err := net.ParseCIDR(e); err == nil {
+			networks = append(networks, n)
+		}
+	}
+	covered := func(e string) bool {
+		ip, self, err := net.ParseCIDR(e)
+		if err != nil {
+			ip, self = net.ParseIP(e), nil
+		}
+		for _, n := range networks {
+			if !n.Contains(ip) {
+				continue
+			}
+			if self == nil {
+				return true
+			}
+			outer, _ := n.Mask.Size()
+			inner, _ := self.Mask.Size()
+			if outer < inner {
+				return true
+			}
+		}
+		return false
+	}
+	for e := range all {
+		if covered(e) {
+			continue
+		}
+		if strings.Contains(e, ":") {
+			v6 = append(v6, e)
+		} else {
+			v4 = append(v4, e)
+		}
+	}
+	sort.Strings(v4)
+	sort.Strings(v6)
+	if len(v4) > maxWalledGardenEntries {
+		v4 = v4[:maxWalledGardenEntries]
+	}
+	if len(v6) > maxWalledGardenEntries {
+		v6 = v6[:maxWalledGardenEntries]
+	}
+	return v4, v6
+}
+
+// refreshWalledGarden resolves the domains and replaces the set contents when they
+// changed (or always with force), then returns the report
+func refreshWalledGarden(ctx context.Context, force bool) (interface{}, error) {
+	walledGarden.mu.Lock()
+	cfg := walledGarden.config
+	walledGarden.mu.Unlock()
+	if len(cfg.Domains) == 0 && len(cfg.IPs) == 0 {
+		return walledGardenReport(), nil
+	}
+	resolveWalledGarden(ctx, cfg.Domains)
+
+	walledGarden.mu.Lock()
+	v4, v6 := effectiveEntriesLocked()
+	walledGarden.refreshed = time.Now().Unix()
+	walledGarden.mu.Unlock()
+
+	walledGarden.apply.Lock()
+	err := loadWalledGardenSets(ctx, v4, v6, force)
+	walledGarden.apply.Unlock()
+
+	report := walledGardenReport()
+	walledGarden.mu.Lock()
+	walledGarden.lastError = ""
+	if err != nil {
+		walledGarden.lastError = err.Error()
+		report.Error = err.Error()
+	}
+	changed := report.Hash != walledGarden.lastHash
+	walledGarden.lastHash = report.Hash
+	walledGarden.mu.Unlock()
+	if err != nil {
+		logger.Warn("Failed to update walled garden sets", "error", err)
+	}
+	if changed && options.PublishWalledGarden != nil && (options.Connected == nil || options.Connected()) {
+		if perr := options.PublishWalledGarden(report); perr != nil {
+			logger.Warn("Walled garden report not published", "error", perr)
+		}
+	}
+	return report, err
+}
+
+// loadWalledGardenSets replaces the set contents in one nft transaction, so clients
+// never see an empty walled garden, and writes the loadfiles for firewall reloads
+func loadWalledGardenSets(ctx context.Context, v4, v6 []string, force bool) error {
+	e4, e6, err := readWalledGardenSets(ctx)
+	if err == nil && !force && equalStrings(e4, v4) && equalStrings(e6, v6) {
+		return nil
+	}
+	var script strings.Builder
+	for family, list := range map[string][]string{"4": v4, "6": v6} {
+		set := walledGardenSet + family
+		fmt.Fprintf(&script, "flush set inet fw4 %s\n", set)
+		if len(list) > 0 {
+			fmt.Fprintf(&script, "add element inet fw4 %s { %s }\n", set, strings.Join(list, ", "))
+		}
+	}
+	cmd := exec.CommandContext(ctx, "nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return Errorf(CodeExecError, "nft failed: %s", strings.TrimSpace(string(out)))
+	}
+	if err := writeWalledGardenLoadfiles(v4, v6); err != nil {
+		return err
+	}
+	logger.Info("Walled garden updated", "ipv4", len(v4), "ipv6", len(v6))
+	return nil
+}
+
+// readWalledGardenSets reads the elements currently in the fw4 sets
+func readWalledGardenSets(ctx context.Context) (v4, v6 []string, err error) {
+	read := func(set string) ([]string, error) {
+		out, err := exec.CommandContext(ctx, "nft", "-j", "list", "set", "inet", "fw4", set).Output()
+		if err != nil {
+			return nil, err
+		}
+		var doc struct {
+			Nftables []struct {
+				Set *struct {
+					Elem []json.RawMessage `json:"elem"`
+				} `json:"set"`
+			} `json:"nftables"`
+		}
+		if err := json.Unmarshal(out, &doc); err != nil {
+			return nil, err
+		}
+		list := []string{}
+		for _, item := range doc.Nftables {
+			if item.Set == nil {
+				continue
+			}
+			for _, raw := range item.Set.Elem {
+				list = append(list, nftElement(raw)...)
+			}
+		}
+		sort.Strings(list)
+		return list, nil
+	}
+	if v4, err = read(walledGardenSet + "4"); err != nil {
+		return nil, nil, err
+	}
+	if v6, err = read(walledGardenSet + "6"); err != nil {
+		return nil, nil, err
+	}
+	return v4, v6, nil
+}
+
+// nftElement decodes an element of "nft -j": an address, {"prefix": {"addr", "len"}},
+// {"range": [from, to]} or an {"elem": {"val": ...}} wrapper
+func nftElement(raw json.RawMessage) []string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return []string{s}
+	}
+	var obj struct {
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+		Range []string `json:"range"`
+		Elem  *struct {
+			Val json.RawMessage `json:"val"`
+		} `json:"elem"`
+	}
+	if json.Unmarshal(raw, &obj) != nil {
+		return nil
+	}
+	switch {
+	case obj.Prefix != nil:
+		return []string{fmt.Sprintf("%s/%d", obj.Prefix.Addr, obj.Prefix.Len)}
+	case len(obj.Range) == 2:
+		return []string{obj.Range[0] + "-" + obj.Range[1]}
+	case obj.Elem != nil:
+		return nftElement(obj.Elem.Val)
+	}
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// walledGardenReport describes the configured walled garden and what the firewall holds
+func walledGardenReport() *WalledGardenReport {
+	walledGarden.mu.Lock()
+	r := &WalledGardenReport{
+		Type:        "walledGarden",
+		IPs:         append([]string{}, walledGarden.config.IPs...),
+		Domains:     []WalledGardenDomain{},
+		Error:       walledGarden.lastError,
+		RefreshedAt: walledGarden.refreshed,
+		UpdatedAt:   walledGarden.updatedAt,
+	}
+	if len(walledGarden.config.Domains) > 0 || len(walledGarden.config.IPs) > 0 {
+		r.Zone = walledGarden.config.Zone
+	}
+	for _, d := range walledGarden.config.Domains {
+		entry := WalledGardenDomain{Domain: d, Addresses: []string{}, Error: walledGarden.errors[d], ResolvedAt: walledGarden.times[d]}
+		for a := range walledGarden.resolved[d] {
+			entry.Addresses = append(entry.Addresses, a)
+		}
+		sort.Strings(entry.Addresses)
+		r.Domains = append(r.Domains, entry)
+	}
+	walledGarden.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	v4, v6, err := readWalledGardenSets(ctx)
+	if err != nil {
+		v4, v6 = []string{}, []string{}
+	}
+	r.Effective.IPv4, r.Effective.IPv6 = v4, v6
+	h := sha256.Sum256([]byte(strings.Join(v4, ",") + "|" + strings.Join(v6, ",")))
+	r.Hash = hex.EncodeToString(h[:])
+	return r
+}
+
+// StartWalledGarden loads the saved walled garden and keeps it resolved until the
+// RPC context is cancelled. Call it after Configure
+func StartWalledGarden() {
+	if data, err := os.ReadFile(WalledGardenFile); err == nil {
+		var saved struct {
+			WalledGardenArgs
+			UpdatedAt int64 `json:"updatedAt"`
+		}
+		if err := json.Unmarshal(data, &saved); err != nil || normalizeWalledGarden(&saved.WalledGardenArgs) != nil {
+			logger.Error("Ignoring invalid walled garden file", "file", WalledGardenFile, "error", err)
+		} else {
+			walledGarden.mu.Lock()
+			walledGarden.config, walledGarden.updatedAt = saved.WalledGardenArgs, saved.UpdatedAt
+			walledGarden.mu.Unlock()
+		}
+	}
+	go walledGardenLoop(options.Context)
+}
+
+// walledGardenLoop re-resolves the domains every refresh period; a set restarts the
+// period, as it refreshed already
+func walledGardenLoop(ctx context.Context) {
+	defer crash.Recover("walled garden")
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-walledGarden.wake:
+		case <-time.After(wait):
+			refreshWalledGarden(ctx, false)
+		}
+		walledGarden.mu.Lock()
+		wait = time.Duration(walledGarden.config.Refresh) * time.Second
+		walledGarden.mu.Unlock()
+		if wait <= 0 {
+			wait = defaultWalledGardenRefresh
+		}
+	}
+}
+
+// saveWalledGardenLocked writes WalledGardenFile; walledGarden.mu must be held
+func saveWalledGardenLocked() error {
+	data, err := json.Marshal(struct {
+		WalledGardenArgs
+		UpdatedAt int64 `json:"updatedAt"`
+	}{walledGarden.config, walledGarden.updatedAt})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(WalledGardenFile), 0755)
+	}
+	if err == nil {
+		tmp := WalledGardenFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, WalledGardenFile)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save walled garden", "error", err)
+		return Errorf(CodeInternal, "failed to save walled garden: %v", err)
+	}
+	return nil
+}
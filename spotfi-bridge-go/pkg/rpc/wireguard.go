@@ -0,0 +1,362 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"spotfi-bridge/pkg/uci"
+)
+
+// WGInterfaceArgs describe a WireGuard interface to create
+type WGInterfaceArgs struct {
+	Name       string   `json:"name"`
+	PrivateKey string   `json:"privateKey"` // Generated when empty
+	ListenPort int      `json:"listenPort"`
+	Addresses  []string `json:"addresses"` // CIDRs assigned to the interface
+}
+
+// WGPeerArgs describe a peer of a WireGuard interface
+type WGPeerArgs struct {
+	Interface    string   `json:"interface"`
+	PublicKey    string   `json:"publicKey"`
+	PresharedKey string   `json:"presharedKey"`
+	AllowedIPs   []string `json:"allowedIps"`
+	EndpointHost string   `json:"endpointHost"`
+	EndpointPort int      `json:"endpointPort"`
+	Keepalive    int      `json:"keepalive"`
+	Description  string   `json:"description"`
+}
+
+// WGApplyArgs is a batch of changes staged and committed as one unit
+type WGApplyArgs struct {
+	CreateInterfaces []WGInterfaceArgs `json:"createInterfaces"`
+	RemoveInterfaces []string          `json:"removeInterfaces"`
+	AddPeers         []WGPeerArgs      `json:"addPeers"`
+	RemovePeers      []WGPeerArgs      `json:"removePeers"` // Only interface and publicKey are used
+}
+
+func init() {
+	register("spotfi.wireguard", "status", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		return wireguardStatus(ctx)
+	})
+	register("spotfi.wireguard", "apply", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args WGApplyArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		return applyWireGuard(ctx, args)
+	})
+	register("spotfi.wireguard", "create_interface", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args WGInterfaceArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		return applyWireGuard(ctx, WGApplyArgs{CreateInterfaces: []WGInterfaceArgs{args}})
+	})
+	register("spotfi.wireguard", "remove_interface", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args WGInterfaceArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		return applyWireGuard(ctx, WGApplyArgs{RemoveInterfaces: []string{args.Name}})
+	})
+	register("spotfi.wireguard", "add_peer", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args WGPeerArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		return applyWireGuard(ctx, WGApplyArgs{AddPeers: []WGPeerArgs{args}})
+	})
+	register("spotfi.wireguard", "remove_peer", func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		var args WGPeerArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		return applyWireGuard(ctx, WGApplyArgs{RemovePeers: []WGPeerArgs{args}})
+	})
+}
+
+// validWGKey checks for a base64 encoded 32 byte Curve25519 key
+func validWGKey(key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(b) == 32
+}
+
+func wgCommand(ctx context.Context, stdin string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "wg", args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin + "\n")
+	}
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", Errorf(CodeExecError, "wg %s failed: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+func validateWGInterface(ctx context.Context, iface *WGInterfaceArgs) error {
+	if !uciNamePattern.MatchString(iface.Name) || len(iface.Name) > 15 {
+		return invalidArgs("invalid interface name: %q", iface.Name)
+	}
+	if iface.PrivateKey == "" {
+		key, err := wgCommand(ctx, "", "genkey")
+		if err != nil {
+			return err
+		}
+		iface.PrivateKey = key
+	} else if !validWGKey(iface.PrivateKey) {
+		return invalidArgs("invalid private key for %s", iface.Name)
+	}
+	if iface.ListenPort < 0 || iface.ListenPort > 65535 {
+		return invalidArgs("invalid listenPort: %d", iface.ListenPort)
+	}
+	for _, addr := range iface.Addresses {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return invalidArgs("invalid address: %q", addr)
+		}
+	}
+	return nil
+}
+
+func validateWGPeer(peer WGPeerArgs) error {
+	if !uciNamePattern.MatchString(peer.Interface) {
+		return invalidArgs("invalid interface name: %q", peer.Interface)
+	}
+	if !validWGKey(peer.PublicKey) {
+		return invalidArgs("invalid public key")
+	}
+	if peer.PresharedKey != "" && !validWGKey(peer.PresharedKey) {
+		return invalidArgs("invalid preshared key")
+	}
+	for _, allowed := range peer.AllowedIPs {
+		if _, _, err := net.ParseCIDR(allowed); err != nil {
+			return invalidArgs("invalid allowed IP: %q", allowed)
+		}
+	}
+	if peer.EndpointHost != "" && !hostPattern.MatchString(peer.EndpointHost) {
+		return invalidArgs("invalid endpoint host: %q", peer.EndpointHost)
+	}
+	if peer.EndpointPort < 0 || peer.EndpointPort > 65535 {
+		return invalidArgs("invalid endpoint port: %d", peer.EndpointPort)
+	}
+	if peer.Keepalive < 0 || peer.Keepalive > 65535 {
+		return invalidArgs("invalid keepalive: %d", peer.Keepalive)
+	}
+	return nil
+}
+
+// findPeerSection returns the UCI section of a peer identified by interface and public key
+func findPeerSection(iface, publicKey string) (string, error) {
+	peers, err := uci.SectionsOfType("network", "wireguard_"+iface)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range peers {
+		if p.Option("public_key") == publicKey {
+			return p.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// applyWireGuard validates every change first, stages them all in UCI and
+// commits only if every step succeeded; any failure reverts the network config
+func applyWireGuard(ctx context.Context, args WGApplyArgs) (interface{}, error) {
+	for i := range args.CreateInterfaces {
+		if err := validateWGInterface(ctx, &args.CreateInterfaces[i]); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range args.RemoveInterfaces {
+		if !uciNamePattern.MatchString(name) {
+			return nil, invalidArgs("invalid interface name: %q", name)
+		}
+	}
+	for _, p := range args.AddPeers {
+		if err := validateWGPeer(p); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range args.RemovePeers {
+		if !uciNamePattern.MatchString(p.Interface) || !validWGKey(p.PublicKey) {
+			return nil, invalidArgs("removePeers entries need a valid interface and publicKey")
+		}
+	}
+
+	uci.Lock()
+	defer uci.Unlock()
+	if err := stageWireGuard(args); err != nil {
+		uci.Revert("network")
+		return nil, err
+	}
+	if err := uci.Commit("network"); err != nil {
+		uci.Revert("network")
+		return nil, err
+	}
+
+	if out, err := exec.CommandContext(ctx, "/etc/init.d/network", "reload").CombinedOutput(); err != nil {
+		return nil, Errorf(CodeExecError, "network reload failed: %s", strings.TrimSpace(string(out)))
+	}
+
+	created := []map[string]string{}
+	for _, iface := range args.CreateInterfaces {
+		pub, _ := wgCommand(ctx, iface.PrivateKey, "pubkey")
+		created = append(created, map[string]string{"name": iface.Name, "publicKey": pub})
+	}
+	status, err := wireguardStatus(ctx)
+	return map[string]interface{}{
+		"created": created,
+		"status":  status,
+	}, err
+}
+
+func stageWireGuard(args WGApplyArgs) error {
+	for _, iface := range args.CreateInterfaces {
+		if proto, _ := uci.Get("network." + iface.Name + ".proto"); proto != "" {
+			return invalidArgs("interface %s already exists", iface.Name)
+		}
+		base := "network." + iface.Name
+		if err := uci.Set(base, "interface"); err != nil {
+			return err
+		}
+		if err := uci.Set(base+".proto", "wireguard"); err != nil {
+			return err
+		}
+		if err := uci.Set(base+".private_key", iface.PrivateKey); err != nil {
+			return err
+		}
+		if iface.ListenPort > 0 {
+			if err := uci.Set(base+".listen_port", strconv.Itoa(iface.ListenPort)); err != nil {
+				return err
+			}
+		}
+		for _, addr := range iface.Addresses {
+			if err := uci.AddList(base+".addresses", addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range args.RemoveInterfaces {
+		if proto, _ := uci.Get("network." + name + ".proto"); proto != "wireguard" {
+			return Errorf(CodeNotFound, "wireguard interface not found: %s", name)
+		}
+		peers, err := uci.SectionsOfType("network", "wireguard_"+name)
+		if err != nil {
+			return err
+		}
+		for _, p := range peers {
+			if err := uci.Delete("network." + p.Name); err != nil {
+				return err
+			}
+		}
+		if err := uci.Delete("network." + name); err != nil {
+			return err
+		}
+	}
+
+	for _, peer := range args.RemovePeers {
+		section, err := findPeerSection(peer.Interface, peer.PublicKey)
+		if err != nil {
+			return err
+		}
+		if section == "" {
+			return Errorf(CodeNotFound, "peer not found on %s", peer.Interface)
+		}
+		if err := uci.Delete("network." + section); err != nil {
+			return err
+		}
+	}
+
+	for _, peer := range args.AddPeers {
+		section, err := findPeerSection(peer.Interface, peer.PublicKey)
+		if err != nil {
+			return err
+		}
+		if section == "" {
+			if section, err = uci.Add("network", "wireguard_"+peer.Interface); err != nil {
+				return err
+			}
+		} else {
+			// Replace allowed IPs of an existing peer rather than appending
+			uci.Delete("network." + section + ".allowed_ips")
+		}
+		base := "network." + section
+		opts := [][2]string{
+			{"public_key", peer.PublicKey},
+			{"preshared_key", peer.PresharedKey},
+			{"endpoint_host", peer.EndpointHost},
+			{"description", peer.Description},
+			{"route_allowed_ips", "1"},
+		}
+		if peer.EndpointPort > 0 {
+			opts = append(opts, [2]string{"endpoint_port", strconv.Itoa(peer.EndpointPort)})
+		}
+		if peer.Keepalive > 0 {
+			opts = append(opts, [2]string{"persistent_keepalive", strconv.Itoa(peer.Keepalive)})
+		}
+		for _, opt := range opts {
+			if opt[1] == "" {
+				continue
+			}
+			if err := uci.Set(base+"."+opt[0], opt[1]); err != nil {
+				return err
+			}
+		}
+		for _, allowed := range peer.AllowedIPs {
+			if err := uci.AddList(base+".allowed_ips", allowed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// wireguardStatus parses "wg show all dump" into interfaces with peer statistics
+func wireguardStatus(ctx context.Context) (interface{}, error) {
+	out, err := wgCommand(ctx, "", "show", "all", "dump")
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Split(line, "\t")
+		switch len(f) {
+		case 5: // interface: name, private key, public key, listen port, fwmark
+			port, _ := strconv.Atoi(f[3])
+			interfaces[f[0]] = map[string]interface{}{
+				"publicKey":  f[2],
+				"listenPort": port,
+				"peers":      []map[string]interface{}{},
+			}
+		case 9: // peer: iface, public key, psk, endpoint, allowed ips, handshake, rx, tx, keepalive
+			iface, ok := interfaces[f[0]]
+			if !ok {
+				continue
+			}
+			handshake, _ := strconv.ParseInt(f[5], 10, 64)
+			rx, _ := strconv.ParseInt(f[6], 10, 64)
+			tx, _ := strconv.ParseInt(f[7], 10, 64)
+			peer := map[string]interface{}{
+				"publicKey":       f[1],
+				"endpoint":        strings.Replace(f[3], "(none)", "", 1),
+				"allowedIps":      strings.Split(strings.Replace(f[4], "(none)", "", 1), ","),
+				"latestHandshake": handshake,
+				"rxBytes":         rx,
+				"txBytes":         tx,
+				"keepalive":       f[8],
+			}
+			iface["peers"] = append(iface["peers"].([]map[string]interface{}), peer)
+		}
+	}
+	return map[string]interface{}{"interfaces": interfaces}, nil
+}
@@ -0,0 +1,875 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// builtin is a function of the language itself or a method bound to a value
+type builtin struct {
+	name string
+	fn   func(t *thread, args []Value, kwargs map[string]Value) (Value, error)
+}
+
+var universe map[string]*builtin
+
+func init() {
+	universe = map[string]*builtin{}
+	for name, fn := range map[string]func(t *thread, args []Value, kwargs map[string]Value) (Value, error){
+		"abs":       builtinAbs,
+		"all":       builtinAll,
+		"any":       builtinAny,
+		"bool":      builtinBool,
+		"dict":      builtinDict,
+		"enumerate": builtinEnumerate,
+		"fail":      builtinFail,
+		"float":     builtinFloat,
+		"int":       builtinInt,
+		"len":       builtinLen,
+		"list":      builtinList,
+		"max":       builtinMinMax(1),
+		"min":       builtinMinMax(-1),
+		"print":     builtinPrint,
+		"range":     builtinRange,
+		"repr":      builtinRepr,
+		"reversed":  builtinReversed,
+		"sorted":    builtinSorted,
+		"str":       builtinStr,
+		"type":      builtinType,
+		"zip":       builtinZip,
+	} {
+		universe[name] = &builtin{name: name, fn: fn}
+	}
+}
+
+func builtinAbs(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("abs", args, kwargs, "x")
+	if err != nil {
+		return nil, err
+	}
+	switch x := a[0].(type) {
+	case int64:
+		if x < 0 {
+			return -x, nil
+		}
+		return x, nil
+	case float64:
+		return math.Abs(x), nil
+	}
+	return nil, fmt.Errorf("abs: %s is not a number", typeName(a[0]))
+}
+
+func builtinAll(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	items, err := iterableArg("all", args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if !truth(item) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func builtinAny(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	items, err := iterableArg("any", args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if truth(item) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func builtinBool(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("bool", args, kwargs, "x?")
+	if err != nil {
+		return nil, err
+	}
+	return truth(a[0]), nil
+}
+
+func builtinDict(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("dict: got %d positional arguments, want at most 1", len(args))
+	}
+	d := NewDict()
+	if len(args) == 1 {
+		if err := dictUpdate(d, args[0]); err != nil {
+			return nil, fmt.Errorf("dict: %v", err)
+		}
+	}
+	for _, k := range sortedNames(kwargs) {
+		if err := d.Set(k, kwargs[k]); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func sortedNames(kwargs map[string]Value) []string {
+	names := make([]string, 0, len(kwargs))
+	for k := range kwargs {
+		names = append(names, k)
+	}
+	// Go maps are unordered; a stable order keeps runs reproducible
+	sort.Strings(names)
+	return names
+}
+
+// dictUpdate adds the entries of a dict or a list of pairs to d
+func dictUpdate(d *Dict, src Value) error {
+	if other, ok := src.(*Dict); ok {
+		for _, k := range other.keys {
+			v, _, _ := other.Get(k)
+			if err := d.Set(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	items, err := iterate(src)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		pair, ok := item.(*List)
+		if !ok || len(pair.Items) != 2 {
+			return fmt.Errorf("expected pairs, got %s", repr(item))
+		}
+		if err := d.Set(pair.Items[0], pair.Items[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func builtinEnumerate(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("enumerate", args, kwargs, "iterable", "start?")
+	if err != nil {
+		return nil, err
+	}
+	items, err := iterate(a[0])
+	if err != nil {
+		return nil, fmt.Errorf("enumerate: %v", err)
+	}
+	start, _ := a[1].(int64)
+	out := make([]Value, len(items))
+	for i, item := range items {
+		out[i] = &List{Items: []Value{start + int64(i), item}}
+	}
+	return &List{Items: out}, nil
+}
+
+func builtinFail(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	parts := make([]string, len(args))
+	for i, a := range args {
+		parts[i] = str(a)
+	}
+	return nil, fmt.Errorf("fail: %s", strings.Join(parts, " "))
+}
+
+func builtinFloat(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("float", args, kwargs, "x?")
+	if err != nil {
+		return nil, err
+	}
+	switch x := a[0].(type) {
+	case nil:
+		return 0.0, nil
+	case bool:
+		if x {
+			return 1.0, nil
+		}
+		return 0.0, nil
+	case int64:
+		return float64(x), nil
+	case float64:
+		return x, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		if err != nil {
+			return nil, fmt.Errorf("float: invalid literal %s", repr(x))
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("float: cannot convert %s", typeName(a[0]))
+}
+
+func builtinInt(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("int", args, kwargs, "x?", "base?")
+	if err != nil {
+		return nil, err
+	}
+	switch x := a[0].(type) {
+	case nil:
+		return int64(0), nil
+	case bool:
+		if x {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case int64:
+		return x, nil
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) || math.Abs(x) >= 1<<63 {
+			return nil, fmt.Errorf("int: cannot convert %v", x)
+		}
+		return int64(x), nil
+	case string:
+		base := int64(10)
+		if b, ok := a[1].(int64); ok {
+			base = b
+		}
+		if base != 0 && (base < 2 || base > 36) {
+			return nil, fmt.Errorf("int: invalid base %d", base)
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(x), int(base), 64)
+		if err != nil {
+			return nil, fmt.Errorf("int: invalid literal %s", repr(x))
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("int: cannot convert %s", typeName(a[0]))
+}
+
+func builtinLen(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("len", args, kwargs, "x")
+	if err != nil {
+		return nil, err
+	}
+	return length(a[0])
+}
+
+func builtinList(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("list", args, kwargs, "iterable?")
+	if err != nil {
+		return nil, err
+	}
+	if a[0] == nil {
+		return &List{}, nil
+	}
+	items, err := iterate(a[0])
+	if err != nil {
+		return nil, fmt.Errorf("list: %v", err)
+	}
+	return &List{Items: items}, nil
+}
+
+func builtinMinMax(sign int) func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	name := "max"
+	if sign < 0 {
+		name = "min"
+	}
+	return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+		key := kwargs["key"]
+		for k := range kwargs {
+			if k != "key" {
+				return nil, fmt.Errorf("%s: unexpected keyword argument %s", name, k)
+			}
+		}
+		items := args
+		if len(args) == 1 {
+			var err error
+			if items, err = iterate(args[0]); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		if len(items) == 0 {
+			return nil, fmt.Errorf("%s: empty sequence", name)
+		}
+		best, bestKey := items[0], items[0]
+		for i, item := range items {
+			k := item
+			if key != nil {
+				var err error
+				if k, err = t.call(key, []Value{item}, nil); err != nil {
+					return nil, err
+				}
+			}
+			if i == 0 {
+				bestKey = k
+				continue
+			}
+			c, err := order(k, bestKey)
+			if err != nil {
+				return nil, fmt.Errorf("%s: cannot compare %s and %s", name, typeName(k), typeName(bestKey))
+			}
+			if c*sign > 0 {
+				best, bestKey = item, k
+			}
+		}
+		return best, nil
+	}
+}
+
+func builtinPrint(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	parts := make([]string, len(args))
+	for i, a := range args {
+		parts[i] = str(a)
+	}
+	if t.print != nil {
+		t.print(strings.Join(parts, " "))
+	}
+	return nil, nil
+}
+
+func builtinRange(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("range: unexpected keyword arguments")
+	}
+	n := make([]int64, len(args))
+	for i, a := range args {
+		v, ok := a.(int64)
+		if !ok {
+			return nil, fmt.Errorf("range: %s is not an int", typeName(a))
+		}
+		n[i] = v
+	}
+	switch len(n) {
+	case 1:
+		return &rangeValue{0, n[0], 1}, nil
+	case 2:
+		return &rangeValue{n[0], n[1], 1}, nil
+	case 3:
+		if n[2] == 0 {
+			return nil, fmt.Errorf("range: step cannot be 0")
+		}
+		return &rangeValue{n[0], n[1], n[2]}, nil
+	}
+	return nil, fmt.Errorf("range: got %d arguments, want 1 to 3", len(args))
+}
+
+func builtinRepr(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("repr", args, kwargs, "x")
+	if err != nil {
+		return nil, err
+	}
+	return repr(a[0]), nil
+}
+
+func builtinReversed(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	items, err := iterableArg("reversed", args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return &List{Items: items}, nil
+}
+
+func builtinSorted(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("sorted", args, kwargs, "iterable", "key?", "reverse?")
+	if err != nil {
+		return nil, err
+	}
+	items, err := iterate(a[0])
+	if err != nil {
+		return nil, fmt.Errorf("sorted: %v", err)
+	}
+	if a[1] == nil {
+		if err := sortValues(items, truth(a[2])); err != nil {
+			return nil, fmt.Errorf("sorted: %v", err)
+		}
+		return &List{Items: items}, nil
+	}
+	// Sort pairs of key and item by the key
+	pairs := make([]Value, len(items))
+	for i, item := range items {
+		k, err := t.call(a[1], []Value{item}, nil)
+		if err != nil {
+			return nil, err
+		}
+		pairs[i] = &List{Items: []Value{k, int64(i)}}
+	}
+	if err := sortValues(pairs, truth(a[2])); err != nil {
+		return nil, fmt.Errorf("sorted: %v", err)
+	}
+	out := make([]Value, len(items))
+	for i, p := range pairs {
+		out[i] = items[p.(*List).Items[1].(int64)]
+	}
+	return &List{Items: out}, nil
+}
+
+func builtinStr(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("str", args, kwargs, "x")
+	if err != nil {
+		return nil, err
+	}
+	return str(a[0]), nil
+}
+
+func builtinType(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	a, err := Bind("type", args, kwargs, "x")
+	if err != nil {
+		return nil, err
+	}
+	return typeName(a[0]), nil
+}
+
+func builtinZip(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("zip: unexpected keyword arguments")
+	}
+	var seqs [][]Value
+	n := -1
+	for _, a := range args {
+		items, err := iterate(a)
+		if err != nil {
+			return nil, fmt.Errorf("zip: %v", err)
+		}
+		seqs = append(seqs, items)
+		if n < 0 || len(items) < n {
+			n = len(items)
+		}
+	}
+	out := make([]Value, max(n, 0))
+	for i := range out {
+		tuple := make([]Value, len(seqs))
+		for j, s := range seqs {
+			tuple[j] = s[i]
+		}
+		out[i] = &List{Items: tuple}
+	}
+	return &List{Items: out}, nil
+}
+
+func iterableArg(fn string, args []Value, kwargs map[string]Value) ([]Value, error) {
+	a, err := Bind(fn, args, kwargs, "iterable")
+	if err != nil {
+		return nil, err
+	}
+	items, err := iterate(a[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return items, nil
+}
+
+// method returns the method name of v bound to it
+func method(v Value, name string) (*builtin, bool) {
+	var fn func(t *thread, args []Value, kwargs map[string]Value) (Value, error)
+	switch v := v.(type) {
+	case string:
+		fn = stringMethod(v, name)
+	case *List:
+		fn = listMethod(v, name)
+	case *Dict:
+		fn = dictMethod(v, name)
+	}
+	if fn == nil {
+		return nil, false
+	}
+	return &builtin{name: typeName(v) + "." + name, fn: fn}, true
+}
+
+func stringMethod(s, name string) func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	strArg := func(args []Value, kwargs map[string]Value, params ...string) ([]string, error) {
+		a, err := Bind(name, args, kwargs, params...)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]string, len(a))
+		for i, v := range a {
+			if v == nil {
+				continue
+			}
+			if out[i], err = asString(name, v); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	switch name {
+	case "lower", "upper":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			if _, err := Bind(name, args, kwargs); err != nil {
+				return nil, err
+			}
+			if name == "lower" {
+				return strings.ToLower(s), nil
+			}
+			return strings.ToUpper(s), nil
+		}
+	case "strip", "lstrip", "rstrip":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := Bind(name, args, kwargs, "chars?")
+			if err != nil {
+				return nil, err
+			}
+			chars := " \t\n\r\v\f"
+			if a[0] != nil {
+				if chars, err = asString(name, a[0]); err != nil {
+					return nil, err
+				}
+			}
+			switch name {
+			case "lstrip":
+				return strings.TrimLeft(s, chars), nil
+			case "rstrip":
+				return strings.TrimRight(s, chars), nil
+			}
+			return strings.Trim(s, chars), nil
+		}
+	case "startswith", "endswith":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := Bind(name, args, kwargs, "prefix")
+			if err != nil {
+				return nil, err
+			}
+			candidates := []Value{a[0]}
+			if l, ok := a[0].(*List); ok {
+				candidates = l.Items
+			}
+			for _, c := range candidates {
+				affix, err := asString(name, c)
+				if err != nil {
+					return nil, err
+				}
+				if name == "startswith" && strings.HasPrefix(s, affix) || name == "endswith" && strings.HasSuffix(s, affix) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	case "split":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := Bind(name, args, kwargs, "sep?", "maxsplit?")
+			if err != nil {
+				return nil, err
+			}
+			limit := -1
+			if n, ok := a[1].(int64); ok && n >= 0 {
+				limit = int(n) + 1
+			}
+			var parts []string
+			if a[0] == nil {
+				parts = strings.Fields(s)
+				if limit > 0 && len(parts) > limit {
+					// Rejoining loses runs of whitespace, which is close enough
+					parts = append(parts[:limit-1], strings.Join(parts[limit-1:], " "))
+				}
+			} else {
+				sep, err := asString(name, a[0])
+				if err != nil {
+					return nil, err
+				}
+				if sep == "" {
+					return nil, fmt.Errorf("split: empty separator")
+				}
+				parts = strings.SplitN(s, sep, limit)
+			}
+			return stringList(parts), nil
+		}
+	case "join":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			items, err := iterableArg(name, args, kwargs)
+			if err != nil {
+				return nil, err
+			}
+			parts := make([]string, len(items))
+			size := 0
+			for i, item := range items {
+				if parts[i], err = asString(name, item); err != nil {
+					return nil, err
+				}
+				if size += len(parts[i]) + len(s); size > maxStringLen {
+					return nil, errTooLarge
+				}
+			}
+			return strings.Join(parts, s), nil
+		}
+	case "replace":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := strArg(args, kwargs, "old", "new")
+			if err != nil {
+				return nil, err
+			}
+			if n := strings.Count(s, a[0]); n > 0 && len(s)+n*(len(a[1])-len(a[0])) > maxStringLen {
+				return nil, errTooLarge
+			}
+			return strings.ReplaceAll(s, a[0], a[1]), nil
+		}
+	case "find", "count":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := strArg(args, kwargs, "sub")
+			if err != nil {
+				return nil, err
+			}
+			if name == "count" {
+				return int64(strings.Count(s, a[0])), nil
+			}
+			return int64(strings.Index(s, a[0])), nil
+		}
+	case "format":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			return braceFormat(s, args, kwargs)
+		}
+	}
+	return nil
+}
+
+func asString(fn string, v Value) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: expected a string, got %s", fn, typeName(v))
+	}
+	return s, nil
+}
+
+func stringList(parts []string) *List {
+	items := make([]Value, len(parts))
+	for i, p := range parts {
+		items[i] = p
+	}
+	return &List{Items: items}
+}
+
+// braceFormat implements str.format with {}, {0} and {name} fields
+func braceFormat(format string, args []Value, kwargs map[string]Value) (Value, error) {
+	var b strings.Builder
+	auto := 0
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		switch {
+		case c == '{' && i+1 < len(format) && format[i+1] == '{':
+			b.WriteByte('{')
+			i++
+		case c == '}' && i+1 < len(format) && format[i+1] == '}':
+			b.WriteByte('}')
+			i++
+		case c == '{':
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("format: unmatched {")
+			}
+			field := format[i+1 : i+end]
+			i += end
+			var v Value
+			switch n, err := strconv.Atoi(field); {
+			case field == "":
+				if auto >= len(args) {
+					return nil, fmt.Errorf("format: not enough arguments")
+				}
+				v = args[auto]
+				auto++
+			case err == nil:
+				if n < 0 || n >= len(args) {
+					return nil, fmt.Errorf("format: no argument %d", n)
+				}
+				v = args[n]
+			default:
+				var ok bool
+				if v, ok = kwargs[field]; !ok {
+					return nil, fmt.Errorf("format: no argument %s", field)
+				}
+			}
+			b.WriteString(str(v))
+		case c == '}':
+			return nil, fmt.Errorf("format: single } in format string")
+		default:
+			b.WriteByte(c)
+		}
+		if b.Len() > maxStringLen {
+			return nil, errTooLarge
+		}
+	}
+	return b.String(), nil
+}
+
+func listMethod(l *List, name string) func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	switch name {
+	case "append":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := Bind(name, args, kwargs, "x")
+			if err != nil {
+				return nil, err
+			}
+			if len(l.Items) >= maxItems {
+				return nil, errTooLarge
+			}
+			l.Items = append(l.Items, a[0])
+			return nil, nil
+		}
+	case "extend":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			items, err := iterableArg(name, args, kwargs)
+			if err != nil {
+				return nil, err
+			}
+			if len(l.Items)+len(items) > maxItems {
+				return nil, errTooLarge
+			}
+			l.Items = append(l.Items, items...)
+			return nil, t.charge(len(items))
+		}
+	case "insert":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := Bind(name, args, kwargs, "index", "x")
+			if err != nil {
+				return nil, err
+			}
+			i, ok := a[0].(int64)
+			if !ok {
+				return nil, fmt.Errorf("insert: index must be an int")
+			}
+			n := int64(len(l.Items))
+			if i < 0 {
+				i += n
+			}
+			i = min(max(i, 0), n)
+			if n >= maxItems {
+				return nil, errTooLarge
+			}
+			l.Items = append(l.Items[:i], append([]Value{a[1]}, l.Items[i:]...)...)
+			return nil, nil
+		}
+	case "pop":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := Bind(name, args, kwargs, "index?")
+			if err != nil {
+				return nil, err
+			}
+			if a[0] == nil {
+				a[0] = int64(-1)
+			}
+			i, err := sequenceIndex(a[0], int64(len(l.Items)))
+			if err != nil {
+				return nil, fmt.Errorf("pop: %v", err)
+			}
+			v := l.Items[i]
+			l.Items = append(l.Items[:i], l.Items[i+1:]...)
+			return v, nil
+		}
+	case "remove", "index":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := Bind(name, args, kwargs, "x")
+			if err != nil {
+				return nil, err
+			}
+			for i, item := range l.Items {
+				if equal(item, a[0]) {
+					if name == "index" {
+						return int64(i), nil
+					}
+					l.Items = append(l.Items[:i], l.Items[i+1:]...)
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("%s: %s not in list", name, repr(a[0]))
+		}
+	case "clear":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			if _, err := Bind(name, args, kwargs); err != nil {
+				return nil, err
+			}
+			l.Items = nil
+			return nil, nil
+		}
+	}
+	return nil
+}
+
+func dictMethod(d *Dict, name string) func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+	switch name {
+	case "get":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := Bind(name, args, kwargs, "key", "default?")
+			if err != nil {
+				return nil, err
+			}
+			v, found, err := d.Get(a[0])
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				return a[1], nil
+			}
+			return v, nil
+		}
+	case "keys", "values", "items":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			if _, err := Bind(name, args, kwargs); err != nil {
+				return nil, err
+			}
+			out := make([]Value, len(d.keys))
+			for i, k := range d.keys {
+				v, _, _ := d.Get(k)
+				switch name {
+				case "keys":
+					out[i] = k
+				case "values":
+					out[i] = v
+				default:
+					out[i] = &List{Items: []Value{k, v}}
+				}
+			}
+			return &List{Items: out}, nil
+		}
+	case "pop":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := Bind(name, args, kwargs, "key", "default?")
+			if err != nil {
+				return nil, err
+			}
+			v, found, err := d.delete(a[0])
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				if _, ok := kwargs["default"]; !ok && len(args) < 2 {
+					return nil, fmt.Errorf("pop: key %s not in dict", repr(a[0]))
+				}
+				return a[1], nil
+			}
+			return v, nil
+		}
+	case "setdefault":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			a, err := Bind(name, args, kwargs, "key", "default?")
+			if err != nil {
+				return nil, err
+			}
+			v, found, err := d.Get(a[0])
+			if err != nil || found {
+				return v, err
+			}
+			return a[1], d.Set(a[0], a[1])
+		}
+	case "update":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			if len(args) > 1 {
+				return nil, fmt.Errorf("update: got %d positional arguments, want at most 1", len(args))
+			}
+			if len(args) == 1 {
+				if err := dictUpdate(d, args[0]); err != nil {
+					return nil, fmt.Errorf("update: %v", err)
+				}
+			}
+			for _, k := range sortedNames(kwargs) {
+				if err := d.Set(k, kwargs[k]); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		}
+	case "clear":
+		return func(t *thread, args []Value, kwargs map[string]Value) (Value, error) {
+			if _, err := Bind(name, args, kwargs); err != nil {
+				return nil, err
+			}
+			d.keys, d.values = nil, map[interface{}]Value{}
+			return nil, nil
+		}
+	}
+	return nil
+}
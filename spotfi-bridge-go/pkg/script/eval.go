@@ -0,0 +1,573 @@
+package script
+
+import (
+	"context"
+	"fmt"
+)
+
+type control int
+
+const (
+	ctrlNone control = iota
+	ctrlBreak
+	ctrlContinue
+	ctrlReturn
+)
+
+// thread is the state of one run
+type thread struct {
+	ctx      context.Context
+	steps    int
+	maxSteps int
+	depth    int
+	print    func(string)
+	builtins map[string]Value
+}
+
+// frame holds the variables of the module or of a function call; a function
+// reads the variables of the frames it was defined in as well
+type frame struct {
+	vars   map[string]Value
+	parent *frame
+}
+
+func (f *frame) lookup(name string) (Value, bool) {
+	for ; f != nil; f = f.parent {
+		if v, ok := f.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// function is a def'd function
+type function struct {
+	def      *defStmt
+	env      *frame
+	defaults []Value
+}
+
+// charge counts n steps and checks the limits of the run
+func (t *thread) charge(n int) error {
+	t.steps += n
+	if t.steps > t.maxSteps {
+		return ErrStepLimit
+	}
+	if t.steps&0xff < n || n > 0xff {
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chargeValue counts a value a statement created: one step per item or 16 bytes
+func (t *thread) chargeValue(v Value) error {
+	switch v := v.(type) {
+	case string:
+		return t.charge(len(v) / 16)
+	case *List:
+		return t.charge(len(v.Items))
+	case *Dict:
+		return t.charge(v.Len())
+	}
+	return nil
+}
+
+// lineError attaches the line to an error that has none yet
+func lineError(line int, err error) error {
+	if e, ok := err.(*Error); ok {
+		if e.Line == 0 {
+			return &Error{Line: line, Msg: e.Msg, Err: e.Err}
+		}
+		return err
+	}
+	return &Error{Line: line, Msg: err.Error(), Err: err}
+}
+
+func (t *thread) exec(f *frame, body []stmt) (control, Value, error) {
+	for _, s := range body {
+		if err := t.charge(1); err != nil {
+			return ctrlNone, nil, lineError(s.stmtLine(), err)
+		}
+		ctrl, v, err := t.execStmt(f, s)
+		if err != nil {
+			return ctrlNone, nil, lineError(s.stmtLine(), err)
+		}
+		if ctrl != ctrlNone {
+			return ctrl, v, nil
+		}
+	}
+	return ctrlNone, nil, nil
+}
+
+func (t *thread) execStmt(f *frame, s stmt) (control, Value, error) {
+	switch s := s.(type) {
+	case *exprStmt:
+		_, err := t.eval(f, s.x)
+		return ctrlNone, nil, err
+	case *assignStmt:
+		return ctrlNone, nil, t.assign(f, s)
+	case *ifStmt:
+		cond, err := t.eval(f, s.cond)
+		if err != nil {
+			return ctrlNone, nil, err
+		}
+		if truth(cond) {
+			return t.exec(f, s.then)
+		}
+		return t.exec(f, s.els)
+	case *forStmt:
+		seq, err := t.eval(f, s.iter)
+		if err != nil {
+			return ctrlNone, nil, err
+		}
+		var result Value
+		returned := false
+		err = t.forEach(seq, func(item Value) (bool, error) {
+			if err := t.store(f, s.vars, item); err != nil {
+				return false, err
+			}
+			ctrl, v, err := t.exec(f, s.body)
+			switch {
+			case err != nil:
+				return false, err
+			case ctrl == ctrlBreak:
+				return false, nil
+			case ctrl == ctrlReturn:
+				result, returned = v, true
+				return false, nil
+			}
+			return true, nil
+		})
+		if returned {
+			return ctrlReturn, result, err
+		}
+		return ctrlNone, nil, err
+	case *defStmt:
+		fn := &function{def: s, env: f}
+		for _, p := range s.params {
+			var def Value
+			if p.def != nil {
+				v, err := t.eval(f, p.def)
+				if err != nil {
+					return ctrlNone, nil, err
+				}
+				def = v
+			}
+			fn.defaults = append(fn.defaults, def)
+		}
+		f.vars[s.name] = fn
+		return ctrlNone, nil, nil
+	case *returnStmt:
+		if s.x == nil {
+			return ctrlReturn, nil, nil
+		}
+		v, err := t.eval(f, s.x)
+		return ctrlReturn, v, err
+	case *branchStmt:
+		switch s.op {
+		case "break":
+			return ctrlBreak, nil, nil
+		case "continue":
+			return ctrlContinue, nil, nil
+		}
+		return ctrlNone, nil, nil
+	}
+	return ctrlNone, nil, fmt.Errorf("unknown statement %T", s)
+}
+
+func (t *thread) assign(f *frame, s *assignStmt) error {
+	value, err := t.eval(f, s.value)
+	if err != nil {
+		return err
+	}
+	if s.op == "=" {
+		return t.store(f, s.target, value)
+	}
+
+	current, err := t.eval(f, s.target)
+	if err != nil {
+		return err
+	}
+	op := s.op[:len(s.op)-1]
+	if l, ok := current.(*List); ok && op == "+" {
+		// += extends a list in place
+		r, ok := value.(*List)
+		if !ok {
+			return fmt.Errorf("unsupported operand types for +=: list and %s", typeName(value))
+		}
+		if len(l.Items)+len(r.Items) > maxItems {
+			return errTooLarge
+		}
+		l.Items = append(l.Items, r.Items...)
+		return t.charge(len(r.Items))
+	}
+	result, err := binary(op, current, value)
+	if err != nil {
+		return err
+	}
+	if err := t.chargeValue(result); err != nil {
+		return err
+	}
+	return t.store(f, s.target, result)
+}
+
+// store assigns value to an identifier, an index or a tuple of targets
+func (t *thread) store(f *frame, target expr, value Value) error {
+	switch target := target.(type) {
+	case *identExpr:
+		f.vars[target.name] = value
+		return nil
+	case *indexExpr:
+		x, err := t.eval(f, target.x)
+		if err != nil {
+			return err
+		}
+		key, err := t.eval(f, target.key)
+		if err != nil {
+			return err
+		}
+		return setIndex(x, key, value)
+	case *listExpr:
+		items, err := iterate(value)
+		if err != nil {
+			return fmt.Errorf("cannot unpack %s", typeName(value))
+		}
+		if len(items) != len(target.items) {
+			return fmt.Errorf("cannot unpack %d values into %d variables", len(items), len(target.items))
+		}
+		for i, item := range target.items {
+			if err := t.store(f, item, items[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot assign to %T", target)
+}
+
+func (t *thread) eval(f *frame, x expr) (Value, error) {
+	v, err := t.evalExpr(f, x)
+	if err != nil {
+		return nil, lineError(x.exprLine(), err)
+	}
+	return v, nil
+}
+
+func (t *thread) evalExpr(f *frame, x expr) (Value, error) {
+	switch x := x.(type) {
+	case *identExpr:
+		if v, ok := f.lookup(x.name); ok {
+			return v, nil
+		}
+		if v, ok := t.builtins[x.name]; ok {
+			return v, nil
+		}
+		if b, ok := universe[x.name]; ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("undefined: %s", x.name)
+	case *literalExpr:
+		return x.value, nil
+	case *listExpr:
+		items := make([]Value, len(x.items))
+		for i, item := range x.items {
+			v, err := t.eval(f, item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = v
+		}
+		return &List{Items: items}, t.charge(len(items))
+	case *dictExpr:
+		d := NewDict()
+		for i := range x.keys {
+			k, err := t.eval(f, x.keys[i])
+			if err != nil {
+				return nil, err
+			}
+			v, err := t.eval(f, x.values[i])
+			if err != nil {
+				return nil, err
+			}
+			if err := d.Set(k, v); err != nil {
+				return nil, err
+			}
+		}
+		return d, t.charge(d.Len())
+	case *unaryExpr:
+		v, err := t.eval(f, x.x)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "not":
+			return !truth(v), nil
+		case "-":
+			switch v := v.(type) {
+			case int64:
+				return -v, nil
+			case float64:
+				return -v, nil
+			}
+		case "+":
+			switch v.(type) {
+			case int64, float64:
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("unsupported operand type for unary %s: %s", x.op, typeName(v))
+	case *binaryExpr:
+		l, err := t.eval(f, x.x)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "and":
+			if !truth(l) {
+				return l, nil
+			}
+			return t.eval(f, x.y)
+		case "or":
+			if truth(l) {
+				return l, nil
+			}
+			return t.eval(f, x.y)
+		}
+		r, err := t.eval(f, x.y)
+		if err != nil {
+			return nil, err
+		}
+		v, err := binary(x.op, l, r)
+		if err != nil {
+			return nil, err
+		}
+		return v, t.chargeValue(v)
+	case *condExpr:
+		cond, err := t.eval(f, x.cond)
+		if err != nil {
+			return nil, err
+		}
+		if truth(cond) {
+			return t.eval(f, x.then)
+		}
+		return t.eval(f, x.els)
+	case *callExpr:
+		fn, err := t.eval(f, x.fn)
+		if err != nil {
+			return nil, err
+		}
+		args := make([]Value, len(x.args))
+		for i, a := range x.args {
+			if args[i], err = t.eval(f, a); err != nil {
+				return nil, err
+			}
+		}
+		var kwargs map[string]Value
+		if len(x.names) > 0 {
+			kwargs = make(map[string]Value, len(x.names))
+			for i, name := range x.names {
+				if kwargs[name], err = t.eval(f, x.kwargs[i]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return t.call(fn, args, kwargs)
+	case *indexExpr:
+		v, err := t.eval(f, x.x)
+		if err != nil {
+			return nil, err
+		}
+		key, err := t.eval(f, x.key)
+		if err != nil {
+			return nil, err
+		}
+		return index(v, key)
+	case *sliceExpr:
+		v, err := t.eval(f, x.x)
+		if err != nil {
+			return nil, err
+		}
+		var start, stop Value
+		if x.start != nil {
+			if start, err = t.eval(f, x.start); err != nil {
+				return nil, err
+			}
+		}
+		if x.stop != nil {
+			if stop, err = t.eval(f, x.stop); err != nil {
+				return nil, err
+			}
+		}
+		result, err := slice(v, start, stop)
+		if err != nil {
+			return nil, err
+		}
+		return result, t.chargeValue(result)
+	case *dotExpr:
+		v, err := t.eval(f, x.x)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := method(v, x.name)
+		if !ok {
+			return nil, fmt.Errorf("%s has no attribute %s", typeName(v), x.name)
+		}
+		return m, nil
+	case *comprehension:
+		var result Value
+		list := &List{}
+		dict := NewDict()
+		if x.dict {
+			result = dict
+		} else {
+			result = list
+		}
+		inner := &frame{vars: map[string]Value{}, parent: f}
+		err := t.comprehend(inner, x, x.clauses, func() error {
+			if x.dict {
+				k, err := t.eval(inner, x.key)
+				if err != nil {
+					return err
+				}
+				v, err := t.eval(inner, x.value)
+				if err != nil {
+					return err
+				}
+				return dict.Set(k, v)
+			}
+			v, err := t.eval(inner, x.value)
+			if err != nil {
+				return err
+			}
+			if len(list.Items) >= maxItems {
+				return errTooLarge
+			}
+			list.Items = append(list.Items, v)
+			return nil
+		})
+		return result, err
+	}
+	return nil, fmt.Errorf("unknown expression %T", x)
+}
+
+func (t *thread) comprehend(f *frame, c *comprehension, clauses []compClause, yield func() error) error {
+	if len(clauses) == 0 {
+		return yield()
+	}
+	clause := clauses[0]
+	if clause.vars == nil {
+		cond, err := t.eval(f, clause.cond)
+		if err != nil || !truth(cond) {
+			return err
+		}
+		return t.comprehend(f, c, clauses[1:], yield)
+	}
+	seq, err := t.eval(f, clause.iter)
+	if err != nil {
+		return err
+	}
+	return t.forEach(seq, func(item Value) (bool, error) {
+		if err := t.store(f, clause.vars, item); err != nil {
+			return false, err
+		}
+		return true, t.comprehend(f, c, clauses[1:], yield)
+	})
+}
+
+// forEach calls fn with the items of seq, one step each, until fn returns false.
+// Ranges are not materialized, so their length is bounded by the steps alone
+func (t *thread) forEach(seq Value, fn func(item Value) (bool, error)) error {
+	if r, ok := seq.(*rangeValue); ok {
+		for i, n := int64(0), r.len(); i < n; i++ {
+			if err := t.charge(1); err != nil {
+				return err
+			}
+			if more, err := fn(r.index(i)); !more || err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	items, err := iterate(seq)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := t.charge(1); err != nil {
+			return err
+		}
+		if more, err := fn(item); !more || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *thread) call(fn Value, args []Value, kwargs map[string]Value) (Value, error) {
+	if err := t.charge(1); err != nil {
+		return nil, err
+	}
+	switch fn := fn.(type) {
+	case *builtin:
+		v, err := fn.fn(t, args, kwargs)
+		if err != nil {
+			return nil, err
+		}
+		return v, t.chargeValue(v)
+	case *Builtin:
+		v, err := fn.Fn(t.ctx, args, kwargs)
+		if err != nil {
+			// Kept as Err of the script error, so the host can tell its own errors apart
+			return nil, &Error{Msg: err.Error(), Err: err}
+		}
+		return v, nil
+	case *function:
+		return t.callFunction(fn, args, kwargs)
+	}
+	return nil, fmt.Errorf("%s is not callable", typeName(fn))
+}
+
+func (t *thread) callFunction(fn *function, args []Value, kwargs map[string]Value) (Value, error) {
+	params := fn.def.params
+	if len(args) > len(params) {
+		return nil, fmt.Errorf("%s: got %d arguments, want at most %d", fn.def.name, len(args), len(params))
+	}
+	locals := &frame{vars: map[string]Value{}, parent: fn.env}
+	for i, a := range args {
+		locals.vars[params[i].name] = a
+	}
+	for name, v := range kwargs {
+		found := false
+		for i, p := range params {
+			if p.name != name {
+				continue
+			}
+			if i < len(args) {
+				return nil, fmt.Errorf("%s: got multiple values for %s", fn.def.name, name)
+			}
+			locals.vars[name], found = v, true
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: unexpected keyword argument %s", fn.def.name, name)
+		}
+	}
+	for i, p := range params {
+		if _, ok := locals.vars[p.name]; ok {
+			continue
+		}
+		if p.def == nil {
+			return nil, fmt.Errorf("%s: missing argument %s", fn.def.name, p.name)
+		}
+		locals.vars[p.name] = fn.defaults[i]
+	}
+
+	if t.depth >= maxDepth {
+		return nil, fmt.Errorf("calls nested deeper than %d", maxDepth)
+	}
+	t.depth++
+	defer func() { t.depth-- }()
+	_, v, err := t.exec(locals, fn.def.body)
+	return v, err
+}
@@ -0,0 +1,218 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultMaxSteps bounds a run unless Env sets MaxSteps
+	DefaultMaxSteps = 100000
+
+	// MaxSourceSize is the largest script Compile accepts
+	MaxSourceSize = 32 << 10
+
+	maxItems     = 100000  // Per list or dict
+	maxStringLen = 1 << 20 // Bytes per string
+	maxDepth     = 32      // Nested function calls
+)
+
+var (
+	// ErrStepLimit ends a run that took more steps than allowed
+	ErrStepLimit = errors.New("step limit exceeded")
+
+	errTooLarge = errors.New("value too large")
+)
+
+// Error is a syntax or runtime error with the script line it happened on. Err
+// is the error a builtin returned, if that is what failed
+type Error struct {
+	Line int
+	Msg  string
+	Err  error
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("line %d: %s", e.Line, e.Msg) }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Builtin is a function the host provides to scripts. Fn runs with the context
+// of the run and must honour it
+type Builtin struct {
+	Name string
+	Fn   func(ctx context.Context, args []Value, kwargs map[string]Value) (Value, error)
+}
+
+// Program is a compiled script
+type Program struct {
+	body []stmt
+}
+
+// Env is what a script runs with. Scripts can only reach the host through the
+// values and builtins of their Env: there is no file, network or process access
+type Env struct {
+	Globals  map[string]Value // Predeclared names, e.g. the triggering event
+	Builtins []*Builtin
+	Print    func(msg string) // Receives print() output; discarded when nil
+
+	// MaxSteps bounds the statements, loop iterations, calls and created items
+	// of a run (DefaultMaxSteps when 0)
+	MaxSteps int
+}
+
+// Compile parses a script written in a subset of Starlark: assignments, if,
+// for, def, comprehensions and the usual operators and builtins, without while
+// loops, lambdas, load or recursion deeper than a few calls
+func Compile(src string) (*Program, error) {
+	if len(src) > MaxSourceSize {
+		return nil, fmt.Errorf("script exceeds %d bytes", MaxSourceSize)
+	}
+	body, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{body: body}, nil
+}
+
+// Run executes the program until it finishes, fails, exceeds its steps or ctx
+// is done
+func (p *Program) Run(ctx context.Context, env Env) error {
+	t := &thread{ctx: ctx, maxSteps: env.MaxSteps, print: env.Print, builtins: map[string]Value{}}
+	if t.maxSteps <= 0 {
+		t.maxSteps = DefaultMaxSteps
+	}
+	for _, b := range env.Builtins {
+		t.builtins[b.Name] = b
+	}
+	globals := &frame{vars: map[string]Value{}}
+	for name, v := range env.Globals {
+		globals.vars[name] = v
+	}
+	_, _, err := t.exec(globals, p.body)
+	return err
+}
+
+// Bind assigns the positional and keyword arguments of a builtin call to the
+// named parameters, in order. Names ending in "?" are optional and left nil
+func Bind(fn string, args []Value, kwargs map[string]Value, params ...string) ([]Value, error) {
+	out := make([]Value, len(params))
+	if len(args) > len(params) {
+		return nil, fmt.Errorf("%s: got %d arguments, want at most %d", fn, len(args), len(params))
+	}
+	copy(out, args)
+	set := make([]bool, len(params))
+	for i := range args {
+		set[i] = true
+	}
+	for name, v := range kwargs {
+		found := false
+		for i, p := range params {
+			if strings.TrimSuffix(p, "?") == name {
+				if set[i] {
+					return nil, fmt.Errorf("%s: got multiple values for %s", fn, name)
+				}
+				out[i], set[i], found = v, true, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: unexpected keyword argument %s", fn, name)
+		}
+	}
+	for i, p := range params {
+		if !set[i] && !strings.HasSuffix(p, "?") {
+			return nil, fmt.Errorf("%s: missing argument %s", fn, p)
+		}
+	}
+	return out, nil
+}
+
+// FromJSON converts a value decoded by encoding/json. Integral numbers become
+// ints and objects dicts with their keys sorted
+func FromJSON(v interface{}) Value {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	case int:
+		return int64(v)
+	case int64, string, bool, nil:
+		return v
+	case []interface{}:
+		items := make([]Value, len(v))
+		for i, item := range v {
+			items[i] = FromJSON(item)
+		}
+		return &List{Items: items}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := NewDict()
+		for _, k := range keys {
+			// Host data is not subject to the size limits of scripts
+			d.keys = append(d.keys, k)
+			d.values[k] = FromJSON(v[k])
+		}
+		return d
+	}
+	return fmt.Sprint(v)
+}
+
+// ToJSON converts a script value for encoding/json; dict keys must be strings
+func ToJSON(v Value) (interface{}, error) {
+	return toJSON(v, 0)
+}
+
+func toJSON(v Value, depth int) (interface{}, error) {
+	if depth > 64 {
+		return nil, fmt.Errorf("value nested too deeply")
+	}
+	switch v := v.(type) {
+	case nil, bool, int64, string:
+		return v, nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%v cannot be encoded as JSON", v)
+		}
+		return v, nil
+	case *List:
+		out := make([]interface{}, len(v.Items))
+		for i, item := range v.Items {
+			converted, err := toJSON(item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = converted
+		}
+		return out, nil
+	case *Dict:
+		out := make(map[string]interface{}, v.Len())
+		for _, k := range v.keys {
+			s, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("dict key %s is not a string", repr(k))
+			}
+			converted, err := toJSON(v.values[s], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			out[s] = converted
+		}
+		return out, nil
+	case *rangeValue:
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		return toJSON(&List{Items: items}, depth)
+	}
+	return nil, fmt.Errorf("%s cannot be encoded as JSON", typeName(v))
+}
@@ -0,0 +1,268 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// run compiles and runs src, returning what it printed
+func run(ctx context.Context, src string, env Env) (string, error) {
+	p, err := Compile(src)
+	if err != nil {
+		return "", err
+	}
+	var out []string
+	env.Print = func(msg string) { out = append(out, msg) }
+	err = p.Run(ctx, env)
+	return strings.Join(out, "\n"), err
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"arithmetic", "print(1 + 2 * 3, 7 // 2, 7 % 3, 2.5 * 2)", "7 3 1 5.0"},
+		{"strings", `print("a,b".split(","), "x".upper() + "y", "%s-%d" % ("n", 4))`, `["a", "b"] Xy n-4`},
+		{"if", "x = 3\nif x > 2:\n    print(\"big\")\nelif x > 1:\n    print(\"mid\")\nelse:\n    print(\"small\")", "big"},
+		{"for", "total = 0\nfor i in range(5):\n    if i == 3:\n        break\n    total += i\nprint(total)", "3"},
+		{"def", "def add(a, b=10):\n    return a + b\nprint(add(1), add(1, b=2))", "11 3"},
+		{"closure", "def outer():\n    n = 5\n    def inner():\n        return n\n    return inner()\nprint(outer())", "5"},
+		{"comprehension", "print([x * x for x in range(4) if x % 2 == 0])", "[0, 4]"},
+		{"dict", "d = {\"b\": 1}\nd[\"a\"] = 2\nprint(sorted(d.keys()), d.get(\"c\", 0), len(d))", `["a", "b"] 0 2`},
+		{"globals", "print(event[\"name\"])", "up"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := Env{Globals: map[string]Value{"event": FromJSON(map[string]interface{}{"name": "up"})}}
+			got, err := run(context.Background(), tt.src, env)
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("printed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		line int
+	}{
+		{"unterminated string", "x = \"abc", 1},
+		{"return outside function", "x = 1\nreturn x", 2},
+		{"break outside loop", "break", 1},
+		{"chained comparison", "x = 1 < 2 < 3", 1},
+		{"duplicate parameter", "def f(a, a):\n    pass", 1},
+		{"while", "while True:\n    pass", 1},
+		{"lambda", "f = lambda x: x", 1},
+		{"bad indentation", "if True:\nprint(1)", 2},
+		{"assign to call", "f() = 1", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.src)
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("Compile(%q) = %v, want *Error", tt.src, err)
+			}
+			if e.Line != tt.line {
+				t.Errorf("error %q on line %d, want %d", e, e.Line, tt.line)
+			}
+		})
+	}
+
+	if _, err := Compile(strings.Repeat("#", MaxSourceSize+1)); err == nil {
+		t.Error("Compile accepted a script over MaxSourceSize")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		maxSteps int
+		want     error
+	}{
+		{"loop steps", "for i in range(1000000):\n    pass", 1000, ErrStepLimit},
+		{"default steps", "for i in range(1000000):\n    pass", 0, ErrStepLimit},
+		{"created items", "x = list(range(5000))", 1000, ErrStepLimit},
+		{"list repeat", "x = [0] * (maxItems + 1)", 1 << 30, errTooLarge},
+		{"list append", "x = []\nfor i in range(maxItems + 1):\n    x.append(i)", 1 << 30, errTooLarge},
+		{"list concat", "x = [0] * maxItems\ny = x + [1]", 1 << 30, errTooLarge},
+		{"dict keys", "d = {}\nfor i in range(maxItems + 1):\n    d[i] = i", 1 << 30, errTooLarge},
+		{"string repeat", "s = \"ab\" * (maxStringLen // 2 + 1)", 1 << 30, errTooLarge},
+		{"string concat", "s = \"a\" * maxStringLen\nt = s + \"b\"", 1 << 30, errTooLarge},
+		{"string join", "s = \"a\" * (maxStringLen // 2)\nt = \",\".join([s, s, s])", 1 << 30, errTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := Env{MaxSteps: tt.maxSteps, Globals: map[string]Value{
+				"maxItems":     int64(maxItems),
+				"maxStringLen": int64(maxStringLen),
+			}}
+			_, err := run(context.Background(), tt.src, env)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("run = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDepth(t *testing.T) {
+	src := "def f(n):\n    if n == 0:\n        return 0\n    return f(n - 1) + 1\nprint(f(depth))"
+	for _, tt := range []struct {
+		depth int64
+		ok    bool
+	}{
+		{maxDepth - 1, true},
+		{maxDepth, false},
+		{1000, false},
+	} {
+		got, err := run(context.Background(), src, Env{Globals: map[string]Value{"depth": tt.depth}})
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("depth %d: %v", tt.depth, err)
+		case tt.ok && got != fmt.Sprint(tt.depth):
+			t.Errorf("depth %d printed %q", tt.depth, got)
+		case !tt.ok && (err == nil || !strings.Contains(err.Error(), "nested deeper")):
+			t.Errorf("depth %d: err = %v, want nesting error", tt.depth, err)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := run(ctx, "for i in range(1000000):\n    pass", Env{MaxSteps: 1 << 30})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("run = %v, want context.Canceled", err)
+	}
+
+	// A builtin sees the run's context
+	var seen context.Context
+	b := &Builtin{Name: "probe", Fn: func(ctx context.Context, args []Value, kwargs map[string]Value) (Value, error) {
+		seen = ctx
+		return nil, ctx.Err()
+	}}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = run(ctx, "probe()", Env{Builtins: []*Builtin{b}})
+	if seen != ctx || !errors.Is(err, context.Canceled) {
+		t.Errorf("builtin ran with %v and returned %v", seen, err)
+	}
+}
+
+func TestBuiltinError(t *testing.T) {
+	errBoom := errors.New("boom")
+	b := &Builtin{Name: "boom", Fn: func(ctx context.Context, args []Value, kwargs map[string]Value) (Value, error) {
+		return nil, errBoom
+	}}
+	_, err := run(context.Background(), "x = 1\nboom()", Env{Builtins: []*Builtin{b}})
+	var e *Error
+	if !errors.As(err, &e) || !errors.Is(err, errBoom) {
+		t.Fatalf("run = %v, want *Error wrapping the builtin's error", err)
+	}
+	if e.Line != 2 {
+		t.Errorf("error on line %d, want 2", e.Line)
+	}
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []Value
+		kwargs  map[string]Value
+		want    []Value
+		wantErr string
+	}{
+		{"positional", []Value{"a", "b"}, nil, []Value{"a", "b", nil}, ""},
+		{"keyword", []Value{"a", "b"}, map[string]Value{"args": int64(1)}, []Value{"a", "b", int64(1)}, ""},
+		{"all keyword", nil, map[string]Value{"path": "a", "method": "b"}, []Value{"a", "b", nil}, ""},
+		{"too many", []Value{"a", "b", "c", "d"}, nil, nil, "got 4 arguments, want at most 3"},
+		{"missing", []Value{"a"}, nil, nil, "missing argument method"},
+		{"duplicate", []Value{"a"}, map[string]Value{"path": "b"}, nil, "got multiple values for path"},
+		{"unknown keyword", []Value{"a", "b"}, map[string]Value{"timeout": int64(1)}, nil, "unexpected keyword argument timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Bind("rpc", tt.args, tt.kwargs, "path", "method", "args?")
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != "rpc: "+tt.wantErr {
+					t.Fatalf("Bind = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Bind: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Bind = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	in := map[string]interface{}{
+		"int":   float64(3),
+		"float": 2.5,
+		"big":   float64(1 << 60),
+		"list":  []interface{}{"a", true, nil},
+		"dict":  map[string]interface{}{"z": float64(1), "a": float64(2)},
+	}
+	v := FromJSON(in)
+	d, ok := v.(*Dict)
+	if !ok {
+		t.Fatalf("FromJSON returned %T, want *Dict", v)
+	}
+	if got, _, _ := d.Get("int"); got != int64(3) {
+		t.Errorf("integral number = %#v, want int64(3)", got)
+	}
+	if got, _, _ := d.Get("big"); got != float64(1<<60) {
+		t.Errorf("number beyond 2^53 = %#v, want float64", got)
+	}
+	inner, _, _ := d.Get("dict")
+	if keys := inner.(*Dict).Keys(); !reflect.DeepEqual(keys, []Value{"a", "z"}) {
+		t.Errorf("dict keys = %v, want sorted", keys)
+	}
+
+	out, err := ToJSON(v)
+	if err != nil {
+		t.Fatalf("ToJSON: %v", err)
+	}
+	want := map[string]interface{}{
+		"int":   int64(3),
+		"float": 2.5,
+		"big":   float64(1 << 60),
+		"list":  []interface{}{"a", true, nil},
+		"dict":  map[string]interface{}{"z": int64(1), "a": int64(2)},
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("ToJSON(FromJSON(x)) = %#v, want %#v", out, want)
+	}
+
+	nonString := NewDict()
+	nonString.Set(int64(1), "x")
+	deep := Value(int64(0))
+	for i := 0; i < 100; i++ {
+		deep = &List{Items: []Value{deep}}
+	}
+	for name, v := range map[string]Value{
+		"non-string key": nonString,
+		"function":       &Builtin{Name: "f"},
+		"too deep":       deep,
+	} {
+		if _, err := ToJSON(v); err == nil {
+			t.Errorf("ToJSON(%s) succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,1192 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNewline
+	tokIndent
+	tokDedent
+	tokIdent
+	tokInt
+	tokFloat
+	tokString
+	tokKeyword
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string // Identifier, keyword or operator; decoded value of a string
+	num  interface{}
+	line int
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "continue": true, "def": true, "elif": true, "else": true,
+	"for": true, "if": true, "in": true, "not": true, "or": true, "pass": true, "return": true,
+	"None": true, "True": true, "False": true,
+	// Reserved by Starlark, refused so scripts stay portable
+	"while": true, "lambda": true, "load": true, "import": true, "class": true, "try": true,
+	"except": true, "raise": true, "with": true, "yield": true, "global": true, "nonlocal": true,
+	"del": true, "assert": true, "is": true, "from": true, "as": true, "finally": true,
+}
+
+// Longest first, so that "//=" is not read as "/" "/="
+var operators = []string{
+	"//=", "//", "==", "!=", "<=", ">=", "+=", "-=", "*=", "/=", "%=",
+	"+", "-", "*", "/", "%", "<", ">", "=", "(", ")", "[", "]", "{", "}", ",", ":", ".", ";",
+}
+
+// lex splits src into tokens, turning indentation into indent and dedent tokens
+// the way Python does. Line breaks inside brackets are ignored
+func lex(src string) ([]token, error) {
+	var toks []token
+	indents := []int{0}
+	depth := 0
+	line := 1
+	atLineStart := true
+	i := 0
+	errorf := func(format string, args ...interface{}) error {
+		return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	for i < len(src) {
+		if atLineStart && depth == 0 {
+			col := 0
+			j := i
+			for j < len(src) && (src[j] == ' ' || src[j] == '\t') {
+				if src[j] == '\t' {
+					col += 8 - col%8
+				} else {
+					col++
+				}
+				j++
+			}
+			i = j
+			if j < len(src) && (src[j] == '\n' || src[j] == '\r' || src[j] == '#') {
+				// Blank or comment-only lines do not affect indentation
+				for i < len(src) && src[i] != '\n' {
+					i++
+				}
+				if i < len(src) {
+					i++
+					line++
+				}
+				continue
+			}
+			if j == len(src) {
+				break
+			}
+			atLineStart = false
+			switch top := indents[len(indents)-1]; {
+			case col > top:
+				indents = append(indents, col)
+				toks = append(toks, token{kind: tokIndent, line: line})
+			case col < top:
+				for col < indents[len(indents)-1] {
+					indents = indents[:len(indents)-1]
+					toks = append(toks, token{kind: tokDedent, line: line})
+				}
+				if col != indents[len(indents)-1] {
+					return nil, errorf("unindent does not match any outer indentation level")
+				}
+			}
+		}
+
+		c := src[i]
+		switch {
+		case c == '\n':
+			if depth == 0 {
+				toks = append(toks, token{kind: tokNewline, line: line})
+				atLineStart = true
+			}
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '\\' && i+1 < len(src) && src[i+1] == '\n':
+			// Explicit line continuation
+			line++
+			i += 2
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '_' || isLetter(c):
+			j := i
+			for j < len(src) && (src[j] == '_' || isLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			word := src[i:j]
+			kind := tokIdent
+			if keywords[word] {
+				kind = tokKeyword
+			}
+			toks = append(toks, token{kind: kind, text: word, line: line})
+			i = j
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			tok, n, err := lexNumber(src[i:])
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			tok.line = line
+			toks = append(toks, tok)
+			i += n
+		case c == '"' || c == '\'':
+			s, n, lines, err := lexString(src[i:])
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			toks = append(toks, token{kind: tokString, text: s, line: line})
+			line += lines
+			i += n
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, errorf("unexpected character %q", c)
+			}
+			switch op {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				if depth == 0 {
+					return nil, errorf("unbalanced %q", op)
+				}
+				depth--
+			}
+			toks = append(toks, token{kind: tokOp, text: op, line: line})
+			i += len(op)
+		}
+	}
+	if depth > 0 {
+		return nil, errorf("unexpected end of script inside brackets")
+	}
+	if len(toks) > 0 && toks[len(toks)-1].kind != tokNewline && toks[len(toks)-1].kind != tokDedent {
+		toks = append(toks, token{kind: tokNewline, line: line})
+	}
+	for len(indents) > 1 {
+		indents = indents[:len(indents)-1]
+		toks = append(toks, token{kind: tokDedent, line: line})
+	}
+	return append(toks, token{kind: tokEOF, line: line}), nil
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+func lexNumber(src string) (token, int, error) {
+	j := 0
+	if strings.HasPrefix(src, "0x") || strings.HasPrefix(src, "0X") {
+		j = 2
+		for j < len(src) && strings.IndexByte("0123456789abcdefABCDEF", src[j]) >= 0 {
+			j++
+		}
+		n, err := strconv.ParseInt(src[2:j], 16, 64)
+		if err != nil {
+			return token{}, 0, fmt.Errorf("invalid number %q", src[:j])
+		}
+		return token{kind: tokInt, num: n}, j, nil
+	}
+	float := false
+	for j < len(src) && isDigit(src[j]) {
+		j++
+	}
+	if j < len(src) && src[j] == '.' {
+		float = true
+		j++
+		for j < len(src) && isDigit(src[j]) {
+			j++
+		}
+	}
+	if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+		float = true
+		j++
+		if j < len(src) && (src[j] == '+' || src[j] == '-') {
+			j++
+		}
+		for j < len(src) && isDigit(src[j]) {
+			j++
+		}
+	}
+	if j < len(src) && (src[j] == '_' || isLetter(src[j])) {
+		return token{}, 0, fmt.Errorf("invalid number %q", src[:j+1])
+	}
+	if float {
+		f, err := strconv.ParseFloat(src[:j], 64)
+		if err != nil {
+			return token{}, 0, fmt.Errorf("invalid number %q", src[:j])
+		}
+		return token{kind: tokFloat, num: f}, j, nil
+	}
+	n, err := strconv.ParseInt(src[:j], 10, 64)
+	if err != nil {
+		return token{}, 0, fmt.Errorf("invalid number %q", src[:j])
+	}
+	return token{kind: tokInt, num: n}, j, nil
+}
+
+// lexString decodes a quoted string, returning the value, the bytes consumed and
+// the line breaks inside it (only triple-quoted strings may span lines)
+func lexString(src string) (string, int, int, error) {
+	quote := src[:1]
+	if strings.HasPrefix(src, strings.Repeat(quote, 3)) {
+		quote = src[:3]
+	}
+	var b strings.Builder
+	lines := 0
+	for j := len(quote); j < len(src); j++ {
+		c := src[j]
+		switch {
+		case strings.HasPrefix(src[j:], quote):
+			return b.String(), j + len(quote), lines, nil
+		case c == '\n':
+			if len(quote) == 1 {
+				return "", 0, 0, fmt.Errorf("unterminated string")
+			}
+			lines++
+			b.WriteByte(c)
+		case c == '\\':
+			j++
+			if j == len(src) {
+				return "", 0, 0, fmt.Errorf("unterminated string")
+			}
+			switch src[j] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			case '\\', '\'', '"':
+				b.WriteByte(src[j])
+			case '\n':
+				lines++ // Escaped line break
+			case 'x':
+				if j+2 >= len(src) {
+					return "", 0, 0, fmt.Errorf("invalid \\x escape")
+				}
+				n, err := strconv.ParseUint(src[j+1:j+3], 16, 8)
+				if err != nil {
+					return "", 0, 0, fmt.Errorf("invalid \\x escape")
+				}
+				b.WriteByte(byte(n))
+				j += 2
+			default:
+				return "", 0, 0, fmt.Errorf("invalid escape \\%c", src[j])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, 0, fmt.Errorf("unterminated string")
+}
+
+// Syntax tree
+
+type stmt interface{ stmtLine() int }
+
+type (
+	exprStmt struct {
+		line int
+		x    expr
+	}
+	assignStmt struct {
+		line   int
+		op     string // "=", "+=", ...
+		target expr
+		value  expr
+	}
+	ifStmt struct {
+		line int
+		cond expr
+		then []stmt
+		els  []stmt
+	}
+	forStmt struct {
+		line int
+		vars expr
+		iter expr
+		body []stmt
+	}
+	defStmt struct {
+		line   int
+		name   string
+		params []param
+		body   []stmt
+	}
+	returnStmt struct {
+		line int
+		x    expr // nil returns None
+	}
+	branchStmt struct {
+		line int
+		op   string // break, continue or pass
+	}
+)
+
+type param struct {
+	name string
+	def  expr // nil when required
+}
+
+func (s *exprStmt) stmtLine() int   { return s.line }
+func (s *assignStmt) stmtLine() int { return s.line }
+func (s *ifStmt) stmtLine() int     { return s.line }
+func (s *forStmt) stmtLine() int    { return s.line }
+func (s *defStmt) stmtLine() int    { return s.line }
+func (s *returnStmt) stmtLine() int { return s.line }
+func (s *branchStmt) stmtLine() int { return s.line }
+
+type expr interface{ exprLine() int }
+
+type (
+	identExpr struct {
+		line int
+		name string
+	}
+	literalExpr struct {
+		line  int
+		value Value
+	}
+	listExpr struct {
+		line  int
+		items []expr
+		tuple bool // Written with parentheses or without brackets, e.g. a, b = ...
+	}
+	dictExpr struct {
+		line   int
+		keys   []expr
+		values []expr
+	}
+	unaryExpr struct {
+		line int
+		op   string
+		x    expr
+	}
+	binaryExpr struct {
+		line int
+		op   string
+		x, y expr
+	}
+	condExpr struct {
+		line            int
+		cond, then, els expr
+	}
+	callExpr struct {
+		line   int
+		fn     expr
+		args   []expr
+		names  []string // Keyword argument names
+		kwargs []expr
+	}
+	indexExpr struct {
+		line int
+		x    expr
+		key  expr
+	}
+	sliceExpr struct {
+		line           int
+		x, start, stop expr // start and stop may be nil
+	}
+	dotExpr struct {
+		line int
+		x    expr
+		name string
+	}
+	comprehension struct {
+		line    int
+		key     expr // Dict comprehensions only
+		value   expr
+		clauses []compClause
+		dict    bool
+	}
+)
+
+// compClause is a "for vars in iter" or an "if cond" of a comprehension
+type compClause struct {
+	vars expr // nil for an if clause
+	iter expr
+	cond expr
+}
+
+func (e *identExpr) exprLine() int     { return e.line }
+func (e *literalExpr) exprLine() int   { return e.line }
+func (e *listExpr) exprLine() int      { return e.line }
+func (e *dictExpr) exprLine() int      { return e.line }
+func (e *unaryExpr) exprLine() int     { return e.line }
+func (e *binaryExpr) exprLine() int    { return e.line }
+func (e *condExpr) exprLine() int      { return e.line }
+func (e *callExpr) exprLine() int      { return e.line }
+func (e *indexExpr) exprLine() int     { return e.line }
+func (e *sliceExpr) exprLine() int     { return e.line }
+func (e *dotExpr) exprLine() int       { return e.line }
+func (e *comprehension) exprLine() int { return e.line }
+
+// Parser
+
+type parser struct {
+	toks  []token
+	pos   int
+	defs  int // Depth of enclosing function definitions
+	loops int // Depth of enclosing loops in the current function
+}
+
+func parse(src string) ([]stmt, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	var body []stmt
+	for p.peek().kind != tokEOF {
+		stmts, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, stmts...)
+	}
+	return body, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) is(kind tokenKind, text string) bool {
+	t := p.peek()
+	return t.kind == kind && t.text == text
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if p.is(kind, text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.accept(kind, text) {
+		return p.unexpected("expected " + strconv.Quote(text))
+	}
+	return nil
+}
+
+func (p *parser) unexpected(want string) error {
+	t := p.peek()
+	var got string
+	switch t.kind {
+	case tokEOF:
+		got = "end of script"
+	case tokNewline:
+		got = "end of line"
+	case tokIndent:
+		got = "unexpected indentation"
+		want = ""
+	case tokDedent:
+		got = "end of block"
+	case tokString:
+		got = strconv.Quote(t.text)
+	case tokInt, tokFloat:
+		got = fmt.Sprint(t.num)
+	default:
+		got = strconv.Quote(t.text)
+	}
+	if want == "" {
+		return &Error{Line: t.line, Msg: got}
+	}
+	return &Error{Line: t.line, Msg: fmt.Sprintf("%s, got %s", want, got)}
+}
+
+// statement parses a compound statement, or a line of simple statements
+func (p *parser) statement() ([]stmt, error) {
+	t := p.peek()
+	if t.kind == tokKeyword {
+		switch t.text {
+		case "if":
+			s, err := p.ifStatement()
+			return []stmt{s}, err
+		case "for":
+			s, err := p.forStatement()
+			return []stmt{s}, err
+		case "def":
+			s, err := p.defStatement()
+			return []stmt{s}, err
+		}
+	}
+	var stmts []stmt
+	for {
+		s, err := p.simpleStatement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+		if !p.accept(tokOp, ";") || p.peek().kind == tokNewline {
+			break
+		}
+	}
+	if p.peek().kind != tokNewline {
+		return nil, p.unexpected("expected end of line")
+	}
+	p.next()
+	return stmts, nil
+}
+
+func (p *parser) simpleStatement() (stmt, error) {
+	t := p.peek()
+	if t.kind == tokKeyword {
+		switch t.text {
+		case "pass", "break", "continue":
+			p.next()
+			if t.text != "pass" && p.loops == 0 {
+				return nil, &Error{Line: t.line, Msg: t.text + " outside loop"}
+			}
+			return &branchStmt{line: t.line, op: t.text}, nil
+		case "return":
+			p.next()
+			if p.defs == 0 {
+				return nil, &Error{Line: t.line, Msg: "return outside function"}
+			}
+			s := &returnStmt{line: t.line}
+			if k := p.peek(); k.kind != tokNewline && !(k.kind == tokOp && k.text == ";") {
+				x, err := p.exprList()
+				if err != nil {
+					return nil, err
+				}
+				s.x = x
+			}
+			return s, nil
+		}
+	}
+
+	x, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.peek(); op.kind == tokOp {
+		switch op.text {
+		case "=", "+=", "-=", "*=", "/=", "//=", "%=":
+			p.next()
+			if err := checkTarget(x, op.text != "="); err != nil {
+				return nil, err
+			}
+			value, err := p.exprList()
+			if err != nil {
+				return nil, err
+			}
+			return &assignStmt{line: op.line, op: op.text, target: x, value: value}, nil
+		}
+	}
+	return &exprStmt{line: t.line, x: x}, nil
+}
+
+// checkTarget reports whether x can be assigned to
+func checkTarget(x expr, augmented bool) error {
+	switch x := x.(type) {
+	case *identExpr, *indexExpr:
+		return nil
+	case *listExpr:
+		if !augmented {
+			for _, item := range x.items {
+				if err := checkTarget(item, false); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return &Error{Line: x.exprLine(), Msg: "cannot assign to this expression"}
+}
+
+// block parses the body of a compound statement after its colon
+func (p *parser) block() ([]stmt, error) {
+	if err := p.expect(tokOp, ":"); err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokNewline {
+		// Simple statements on the same line
+		return p.statement()
+	}
+	p.next()
+	if p.peek().kind != tokIndent {
+		return nil, p.unexpected("expected an indented block")
+	}
+	p.next()
+	var body []stmt
+	for p.peek().kind != tokDedent && p.peek().kind != tokEOF {
+		stmts, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, stmts...)
+	}
+	p.next()
+	return body, nil
+}
+
+func (p *parser) ifStatement() (stmt, error) {
+	t := p.next() // if or elif
+	cond, err := p.test()
+	if err != nil {
+		return nil, err
+	}
+	then, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	s := &ifStmt{line: t.line, cond: cond, then: then}
+	switch {
+	case p.is(tokKeyword, "elif"):
+		elif, err := p.ifStatement()
+		if err != nil {
+			return nil, err
+		}
+		s.els = []stmt{elif}
+	case p.accept(tokKeyword, "else"):
+		if s.els, err = p.block(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) forStatement() (stmt, error) {
+	t := p.next()
+	vars, err := p.loopVars()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokKeyword, "in"); err != nil {
+		return nil, err
+	}
+	iter, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	p.loops++
+	body, err := p.block()
+	p.loops--
+	if err != nil {
+		return nil, err
+	}
+	return &forStmt{line: t.line, vars: vars, iter: iter, body: body}, nil
+}
+
+// loopVars parses the targets of a for loop or comprehension, e.g. "k, v"
+func (p *parser) loopVars() (expr, error) {
+	line := p.peek().line
+	var items []expr
+	for {
+		x, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkTarget(x, false); err != nil {
+			return nil, err
+		}
+		items = append(items, x)
+		if !p.accept(tokOp, ",") {
+			break
+		}
+	}
+	if len(items) == 1 {
+		return items[0], nil
+	}
+	return &listExpr{line: line, items: items, tuple: true}, nil
+}
+
+func (p *parser) defStatement() (stmt, error) {
+	t := p.next()
+	name := p.next()
+	if name.kind != tokIdent {
+		p.pos--
+		return nil, p.unexpected("expected a function name")
+	}
+	if err := p.expect(tokOp, "("); err != nil {
+		return nil, err
+	}
+	s := &defStmt{line: t.line, name: name.text}
+	seen := map[string]bool{}
+	for !p.accept(tokOp, ")") {
+		n := p.next()
+		if n.kind != tokIdent {
+			p.pos--
+			return nil, p.unexpected("expected a parameter name")
+		}
+		if seen[n.text] {
+			return nil, &Error{Line: n.line, Msg: "duplicate parameter " + n.text}
+		}
+		seen[n.text] = true
+		prm := param{name: n.text}
+		if p.accept(tokOp, "=") {
+			def, err := p.test()
+			if err != nil {
+				return nil, err
+			}
+			prm.def = def
+		} else if len(s.params) > 0 && s.params[len(s.params)-1].def != nil {
+			return nil, &Error{Line: n.line, Msg: "required parameter " + n.text + " follows an optional one"}
+		}
+		s.params = append(s.params, prm)
+		if !p.accept(tokOp, ",") {
+			if err := p.expect(tokOp, ")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	loops := p.loops
+	p.defs, p.loops = p.defs+1, 0
+	body, err := p.block()
+	p.defs, p.loops = p.defs-1, loops
+	if err != nil {
+		return nil, err
+	}
+	s.body = body
+	return s, nil
+}
+
+// exprList parses one expression, or several separated by commas as a tuple
+func (p *parser) exprList() (expr, error) {
+	line := p.peek().line
+	x, err := p.test()
+	if err != nil {
+		return nil, err
+	}
+	if !p.is(tokOp, ",") {
+		return x, nil
+	}
+	items := []expr{x}
+	for p.accept(tokOp, ",") {
+		if p.endOfList() {
+			break
+		}
+		y, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, y)
+	}
+	return &listExpr{line: line, items: items, tuple: true}, nil
+}
+
+// endOfList reports whether the next token ends an expression list, allowing a
+// trailing comma
+func (p *parser) endOfList() bool {
+	t := p.peek()
+	if t.kind == tokNewline || t.kind == tokEOF {
+		return true
+	}
+	if t.kind != tokOp {
+		return false
+	}
+	switch t.text {
+	case ")", "]", "}", ";", ":", "=", "+=", "-=", "*=", "/=", "//=", "%=":
+		return true
+	}
+	return false
+}
+
+// test is a conditional expression or anything of lower precedence
+func (p *parser) test() (expr, error) {
+	x, err := p.orTest()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokKeyword && t.text == "if" {
+		p.next()
+		cond, err := p.orTest()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokKeyword, "else"); err != nil {
+			return nil, err
+		}
+		els, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		return &condExpr{line: t.line, cond: cond, then: x, els: els}, nil
+	}
+	return x, nil
+}
+
+func (p *parser) orTest() (expr, error) {
+	x, err := p.andTest()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if !p.accept(tokKeyword, "or") {
+			return x, nil
+		}
+		y, err := p.andTest()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{line: t.line, op: "or", x: x, y: y}
+	}
+}
+
+func (p *parser) andTest() (expr, error) {
+	x, err := p.notTest()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if !p.accept(tokKeyword, "and") {
+			return x, nil
+		}
+		y, err := p.notTest()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{line: t.line, op: "and", x: x, y: y}
+	}
+}
+
+func (p *parser) notTest() (expr, error) {
+	if t := p.peek(); t.kind == tokKeyword && t.text == "not" {
+		p.next()
+		x, err := p.notTest()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{line: t.line, op: "not", x: x}, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (expr, error) {
+	x, err := p.arith()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	op := ""
+	switch {
+	case t.kind == tokOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == ">" || t.text == "<=" || t.text == ">="):
+		op = t.text
+		p.next()
+	case t.kind == tokKeyword && t.text == "in":
+		op = "in"
+		p.next()
+	case t.kind == tokKeyword && t.text == "not" && p.toks[p.pos+1].kind == tokKeyword && p.toks[p.pos+1].text == "in":
+		op = "not in"
+		p.pos += 2
+	default:
+		return x, nil
+	}
+	y, err := p.arith()
+	if err != nil {
+		return nil, err
+	}
+	if n := p.peek(); n.kind == tokOp && (n.text == "==" || n.text == "!=" || n.text == "<" || n.text == ">" || n.text == "<=" || n.text == ">=") ||
+		n.kind == tokKeyword && (n.text == "in" || n.text == "not" && p.toks[p.pos+1].text == "in") {
+		// Starlark does not chain comparisons
+		return nil, &Error{Line: n.line, Msg: "comparisons cannot be chained, use and"}
+	}
+	return &binaryExpr{line: t.line, op: op, x: x, y: y}, nil
+}
+
+func (p *parser) arith() (expr, error) {
+	x, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if !(t.kind == tokOp && (t.text == "+" || t.text == "-")) {
+			return x, nil
+		}
+		p.next()
+		y, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{line: t.line, op: t.text, x: x, y: y}
+	}
+}
+
+func (p *parser) term() (expr, error) {
+	x, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if !(t.kind == tokOp && (t.text == "*" || t.text == "/" || t.text == "//" || t.text == "%")) {
+			return x, nil
+		}
+		p.next()
+		y, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{line: t.line, op: t.text, x: x, y: y}
+	}
+}
+
+func (p *parser) factor() (expr, error) {
+	if t := p.peek(); t.kind == tokOp && (t.text == "-" || t.text == "+") {
+		p.next()
+		x, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{line: t.line, op: t.text, x: x}, nil
+	}
+	return p.primary()
+}
+
+// primary is an operand followed by any calls, indexing and attribute accesses
+func (p *parser) primary() (expr, error) {
+	x, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case p.accept(tokOp, "("):
+			call := &callExpr{line: t.line, fn: x}
+			if err := p.callArgs(call); err != nil {
+				return nil, err
+			}
+			x = call
+		case p.accept(tokOp, "["):
+			var start, stop expr
+			if !p.is(tokOp, ":") {
+				if start, err = p.test(); err != nil {
+					return nil, err
+				}
+			}
+			if p.accept(tokOp, ":") {
+				if !p.is(tokOp, "]") {
+					if stop, err = p.test(); err != nil {
+						return nil, err
+					}
+				}
+				x = &sliceExpr{line: t.line, x: x, start: start, stop: stop}
+			} else {
+				x = &indexExpr{line: t.line, x: x, key: start}
+			}
+			if err := p.expect(tokOp, "]"); err != nil {
+				return nil, err
+			}
+		case p.accept(tokOp, "."):
+			name := p.next()
+			if name.kind != tokIdent {
+				p.pos--
+				return nil, p.unexpected("expected an attribute name")
+			}
+			x = &dotExpr{line: t.line, x: x, name: name.text}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) callArgs(call *callExpr) error {
+	for !p.accept(tokOp, ")") {
+		t := p.peek()
+		if t.kind == tokIdent && p.toks[p.pos+1].kind == tokOp && p.toks[p.pos+1].text == "=" {
+			p.pos += 2
+			for _, n := range call.names {
+				if n == t.text {
+					return &Error{Line: t.line, Msg: "keyword argument " + t.text + " repeated"}
+				}
+			}
+			x, err := p.test()
+			if err != nil {
+				return err
+			}
+			call.names = append(call.names, t.text)
+			call.kwargs = append(call.kwargs, x)
+		} else {
+			if len(call.names) > 0 {
+				return &Error{Line: t.line, Msg: "positional argument follows keyword argument"}
+			}
+			x, err := p.test()
+			if err != nil {
+				return err
+			}
+			call.args = append(call.args, x)
+		}
+		if !p.accept(tokOp, ",") {
+			return p.expect(tokOp, ")")
+		}
+	}
+	return nil
+}
+
+func (p *parser) operand() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokIdent:
+		return &identExpr{line: t.line, name: t.text}, nil
+	case tokInt, tokFloat:
+		return &literalExpr{line: t.line, value: t.num}, nil
+	case tokString:
+		s := t.text
+		// Adjacent strings are concatenated
+		for p.peek().kind == tokString {
+			s += p.next().text
+		}
+		return &literalExpr{line: t.line, value: s}, nil
+	case tokKeyword:
+		switch t.text {
+		case "None":
+			return &literalExpr{line: t.line, value: nil}, nil
+		case "True":
+			return &literalExpr{line: t.line, value: true}, nil
+		case "False":
+			return &literalExpr{line: t.line, value: false}, nil
+		}
+	case tokOp:
+		switch t.text {
+		case "(":
+			if p.accept(tokOp, ")") {
+				return &listExpr{line: t.line, tuple: true}, nil
+			}
+			x, err := p.exprList()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokOp, ")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		case "[":
+			return p.listOrComprehension(t)
+		case "{":
+			return p.dictOrComprehension(t)
+		}
+	}
+	p.pos--
+	if t.kind == tokKeyword && !isExprKeyword(t.text) {
+		if t.text == "while" || t.text == "lambda" || t.text == "load" {
+			return nil, &Error{Line: t.line, Msg: t.text + " is not supported"}
+		}
+		return nil, &Error{Line: t.line, Msg: t.text + " is a reserved word"}
+	}
+	return nil, p.unexpected("expected an expression")
+}
+
+func isExprKeyword(word string) bool {
+	switch word {
+	case "not", "None", "True", "False", "if", "else", "in", "and", "or", "for":
+		return true
+	}
+	return false
+}
+
+func (p *parser) listOrComprehension(open token) (expr, error) {
+	list := &listExpr{line: open.line}
+	for !p.accept(tokOp, "]") {
+		x, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		if len(list.items) == 0 && p.is(tokKeyword, "for") {
+			c := &comprehension{line: open.line, value: x}
+			if err := p.compClauses(c, "]"); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+		list.items = append(list.items, x)
+		if !p.accept(tokOp, ",") {
+			if err := p.expect(tokOp, "]"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return list, nil
+}
+
+func (p *parser) dictOrComprehension(open token) (expr, error) {
+	dict := &dictExpr{line: open.line}
+	for !p.accept(tokOp, "}") {
+		k, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokOp, ":"); err != nil {
+			return nil, err
+		}
+		v, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		if len(dict.keys) == 0 && p.is(tokKeyword, "for") {
+			c := &comprehension{line: open.line, key: k, value: v, dict: true}
+			if err := p.compClauses(c, "}"); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+		dict.keys = append(dict.keys, k)
+		dict.values = append(dict.values, v)
+		if !p.accept(tokOp, ",") {
+			if err := p.expect(tokOp, "}"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return dict, nil
+}
+
+func (p *parser) compClauses(c *comprehension, close string) error {
+	for !p.accept(tokOp, close) {
+		switch {
+		case p.accept(tokKeyword, "for"):
+			vars, err := p.loopVars()
+			if err != nil {
+				return err
+			}
+			if err := p.expect(tokKeyword, "in"); err != nil {
+				return err
+			}
+			iter, err := p.orTest()
+			if err != nil {
+				return err
+			}
+			c.clauses = append(c.clauses, compClause{vars: vars, iter: iter})
+		case p.accept(tokKeyword, "if"):
+			cond, err := p.orTest()
+			if err != nil {
+				return err
+			}
+			c.clauses = append(c.clauses, compClause{cond: cond})
+		default:
+			return p.unexpected("expected for, if or " + strconv.Quote(close))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,730 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Value is a script value: nil (None), bool, int64, float64, string, *List,
+// *Dict or a callable
+type Value interface{}
+
+// List is a mutable script list; tuples are lists as well
+type List struct {
+	Items []Value
+}
+
+// Dict is a script dict, keeping its keys in insertion order
+type Dict struct {
+	keys   []Value
+	values map[interface{}]Value
+}
+
+// NewDict returns an empty dict
+func NewDict() *Dict {
+	return &Dict{values: map[interface{}]Value{}}
+}
+
+// Len returns the number of entries
+func (d *Dict) Len() int { return len(d.keys) }
+
+// Keys returns the keys in insertion order
+func (d *Dict) Keys() []Value { return append([]Value(nil), d.keys...) }
+
+// Get returns the value under key
+func (d *Dict) Get(key Value) (Value, bool, error) {
+	k, err := hashKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	v, ok := d.values[k]
+	return v, ok, nil
+}
+
+// Set stores value under key
+func (d *Dict) Set(key, value Value) error {
+	k, err := hashKey(key)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.values[k]; !ok {
+		if len(d.keys) >= maxItems {
+			return errTooLarge
+		}
+		d.keys = append(d.keys, key)
+	}
+	d.values[k] = value
+	return nil
+}
+
+func (d *Dict) delete(key Value) (Value, bool, error) {
+	k, err := hashKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	v, ok := d.values[k]
+	if !ok {
+		return nil, false, nil
+	}
+	delete(d.values, k)
+	for i, existing := range d.keys {
+		if ek, _ := hashKey(existing); ek == k {
+			d.keys = append(d.keys[:i], d.keys[i+1:]...)
+			break
+		}
+	}
+	return v, true, nil
+}
+
+// hashKey maps a dict key to a Go map key; integral floats share the key of
+// the equal int, as in Starlark
+func hashKey(v Value) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, bool, int64, string:
+		return v, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return int64(v), nil
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unhashable type: %s", typeName(v))
+}
+
+// rangeValue is the lazy sequence returned by range()
+type rangeValue struct {
+	start, stop, step int64
+}
+
+func (r *rangeValue) len() int64 {
+	switch {
+	case r.step > 0 && r.start < r.stop:
+		return (r.stop - r.start + r.step - 1) / r.step
+	case r.step < 0 && r.start > r.stop:
+		return (r.start - r.stop - r.step - 1) / -r.step
+	}
+	return 0
+}
+
+func (r *rangeValue) index(i int64) int64 { return r.start + i*r.step }
+
+func typeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "NoneType"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case *List:
+		return "list"
+	case *Dict:
+		return "dict"
+	case *rangeValue:
+		return "range"
+	case *function, *builtin, *Builtin:
+		return "function"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func truth(v Value) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case *List:
+		return len(v.Items) > 0
+	case *Dict:
+		return v.Len() > 0
+	case *rangeValue:
+		return v.len() > 0
+	}
+	return true
+}
+
+// str formats v as str() does: strings as they are, everything else like repr
+func str(v Value) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return repr(v)
+}
+
+func repr(v Value) string {
+	var b strings.Builder
+	writeRepr(&b, v, 0)
+	return b.String()
+}
+
+func writeRepr(b *strings.Builder, v Value, depth int) {
+	if depth > 16 {
+		b.WriteString("...")
+		return
+	}
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("None")
+	case bool:
+		if v {
+			b.WriteString("True")
+		} else {
+			b.WriteString("False")
+		}
+	case int64:
+		b.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eIN") {
+			s += ".0"
+		}
+		b.WriteString(s)
+	case string:
+		b.WriteString(strconv.Quote(v))
+	case *List:
+		b.WriteByte('[')
+		for i, item := range v.Items {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeRepr(b, item, depth+1)
+		}
+		b.WriteByte(']')
+	case *Dict:
+		b.WriteByte('{')
+		for i, k := range v.keys {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeRepr(b, k, depth+1)
+			b.WriteString(": ")
+			value, _, _ := v.Get(k)
+			writeRepr(b, value, depth+1)
+		}
+		b.WriteByte('}')
+	case *rangeValue:
+		fmt.Fprintf(b, "range(%d, %d, %d)", v.start, v.stop, v.step)
+	case *function:
+		fmt.Fprintf(b, "<function %s>", v.def.name)
+	case *builtin:
+		fmt.Fprintf(b, "<built-in function %s>", v.name)
+	case *Builtin:
+		fmt.Fprintf(b, "<built-in function %s>", v.Name)
+	default:
+		fmt.Fprintf(b, "<%T>", v)
+	}
+}
+
+func equal(x, y Value) bool {
+	switch x := x.(type) {
+	case int64, float64:
+		if xi, ok := x.(int64); ok {
+			if yi, ok := y.(int64); ok {
+				return xi == yi
+			}
+		}
+		a, _ := toFloat(x)
+		b, ok := toFloat(y)
+		return ok && a == b
+	case *List:
+		y, ok := y.(*List)
+		if !ok || len(x.Items) != len(y.Items) {
+			return false
+		}
+		for i := range x.Items {
+			if !equal(x.Items[i], y.Items[i]) {
+				return false
+			}
+		}
+		return true
+	case *Dict:
+		y, ok := y.(*Dict)
+		if !ok || x.Len() != y.Len() {
+			return false
+		}
+		for _, k := range x.keys {
+			a, _, _ := x.Get(k)
+			b, found, _ := y.Get(k)
+			if !found || !equal(a, b) {
+				return false
+			}
+		}
+		return true
+	case *rangeValue:
+		y, ok := y.(*rangeValue)
+		return ok && *x == *y
+	}
+	switch y.(type) {
+	case *List, *Dict, int64, float64:
+		return false
+	}
+	return x == y
+}
+
+func toFloat(v Value) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// compare orders numbers, strings and lists
+func compare(op string, x, y Value) (bool, error) {
+	c, err := order(x, y)
+	if err != nil {
+		return false, fmt.Errorf("%s %s %s not supported", typeName(x), op, typeName(y))
+	}
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+func order(x, y Value) (int, error) {
+	if a, ok := x.(int64); ok {
+		if b, ok := y.(int64); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a > b:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	if a, ok := toFloat(x); ok {
+		if b, ok := toFloat(y); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a > b:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	switch x := x.(type) {
+	case string:
+		if y, ok := y.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	case bool:
+		if y, ok := y.(bool); ok {
+			switch {
+			case x == y:
+				return 0, nil
+			case y:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	case *List:
+		if y, ok := y.(*List); ok {
+			for i := 0; i < len(x.Items) && i < len(y.Items); i++ {
+				if c, err := order(x.Items[i], y.Items[i]); err != nil || c != 0 {
+					return c, err
+				}
+			}
+			return len(x.Items) - len(y.Items), nil
+		}
+	}
+	return 0, fmt.Errorf("not ordered")
+}
+
+func binary(op string, x, y Value) (Value, error) {
+	switch op {
+	case "==":
+		return equal(x, y), nil
+	case "!=":
+		return !equal(x, y), nil
+	case "<", "<=", ">", ">=":
+		return compare(op, x, y)
+	case "in", "not in":
+		found, err := contains(y, x)
+		if err != nil {
+			return nil, err
+		}
+		return found == (op == "in"), nil
+	}
+
+	if a, ok := x.(int64); ok {
+		if b, ok := y.(int64); ok {
+			return intOp(op, a, b)
+		}
+	}
+	if a, ok := toFloat(x); ok {
+		if b, ok := toFloat(y); ok {
+			return floatOp(op, a, b)
+		}
+	}
+	switch op {
+	case "+":
+		switch x := x.(type) {
+		case string:
+			if y, ok := y.(string); ok {
+				if len(x)+len(y) > maxStringLen {
+					return nil, errTooLarge
+				}
+				return x + y, nil
+			}
+		case *List:
+			if y, ok := y.(*List); ok {
+				if len(x.Items)+len(y.Items) > maxItems {
+					return nil, errTooLarge
+				}
+				items := make([]Value, 0, len(x.Items)+len(y.Items))
+				return &List{Items: append(append(items, x.Items...), y.Items...)}, nil
+			}
+		}
+	case "*":
+		if _, ok := x.(int64); ok {
+			x, y = y, x
+		}
+		if n, ok := y.(int64); ok {
+			n = max(n, 0)
+			switch x := x.(type) {
+			case string:
+				if n > 0 && int64(len(x)) > maxStringLen/n {
+					return nil, errTooLarge
+				}
+				return strings.Repeat(x, int(n)), nil
+			case *List:
+				if n > 0 && int64(len(x.Items)) > maxItems/n {
+					return nil, errTooLarge
+				}
+				items := make([]Value, 0, len(x.Items)*int(n))
+				for i := int64(0); i < n; i++ {
+					items = append(items, x.Items...)
+				}
+				return &List{Items: items}, nil
+			}
+		}
+	case "%":
+		if format, ok := x.(string); ok {
+			return percentFormat(format, y)
+		}
+	}
+	return nil, fmt.Errorf("unsupported operand types for %s: %s and %s", op, typeName(x), typeName(y))
+}
+
+func intOp(op string, a, b int64) (Value, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return float64(a) / float64(b), nil
+	case "//":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		q := a / b
+		if (a%b != 0) && ((a < 0) != (b < 0)) {
+			q--
+		}
+		return q, nil
+	case "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		m := a % b
+		if m != 0 && (m < 0) != (b < 0) {
+			m += b
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", op)
+}
+
+func floatOp(op string, a, b float64) (Value, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	case "//":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Floor(a / b), nil
+	case "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		m := math.Mod(a, b)
+		if m != 0 && (m < 0) != (b < 0) {
+			m += b
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", op)
+}
+
+// percentFormat implements "format" % args with %s, %d, %r, %f and %%
+func percentFormat(format string, args Value) (Value, error) {
+	values := []Value{args}
+	if l, ok := args.(*List); ok {
+		values = l.Items
+	}
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(format) {
+			return nil, fmt.Errorf("incomplete format")
+		}
+		if format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		if n == len(values) {
+			return nil, fmt.Errorf("not enough arguments for format string")
+		}
+		v := values[n]
+		n++
+		switch format[i] {
+		case 's':
+			b.WriteString(str(v))
+		case 'r':
+			writeRepr(&b, v, 0)
+		case 'd':
+			f, ok := toFloat(v)
+			if !ok {
+				return nil, fmt.Errorf("%%d format requires a number, not %s", typeName(v))
+			}
+			b.WriteString(strconv.FormatInt(int64(f), 10))
+		case 'f':
+			f, ok := toFloat(v)
+			if !ok {
+				return nil, fmt.Errorf("%%f format requires a number, not %s", typeName(v))
+			}
+			b.WriteString(strconv.FormatFloat(f, 'f', 6, 64))
+		default:
+			return nil, fmt.Errorf("unsupported format character %q", format[i])
+		}
+		if b.Len() > maxStringLen {
+			return nil, errTooLarge
+		}
+	}
+	if n < len(values) {
+		return nil, fmt.Errorf("not all arguments converted during string formatting")
+	}
+	return b.String(), nil
+}
+
+func contains(container, x Value) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := x.(string)
+		if !ok {
+			return false, fmt.Errorf("'in <string>' requires a string, not %s", typeName(x))
+		}
+		return strings.Contains(c, s), nil
+	case *List:
+		for _, item := range c.Items {
+			if equal(item, x) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case *Dict:
+		_, found, err := c.Get(x)
+		return found, err
+	case *rangeValue:
+		n, ok := x.(int64)
+		if !ok {
+			return false, nil
+		}
+		if i := (n - c.start) / c.step; (n-c.start)%c.step == 0 && i >= 0 && i < c.len() {
+			return true, nil
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("'in' not supported for %s", typeName(container))
+}
+
+// iterate returns the items a for loop visits: list items, dict keys or range
+// numbers. Strings are not iterable, as in Starlark
+func iterate(v Value) ([]Value, error) {
+	switch v := v.(type) {
+	case *List:
+		return append([]Value(nil), v.Items...), nil
+	case *Dict:
+		return v.Keys(), nil
+	case *rangeValue:
+		n := v.len()
+		if n > maxItems {
+			return nil, errTooLarge
+		}
+		items := make([]Value, n)
+		for i := range items {
+			items[i] = v.index(int64(i))
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%s is not iterable", typeName(v))
+}
+
+func length(v Value) (int64, error) {
+	switch v := v.(type) {
+	case string:
+		return int64(len(v)), nil
+	case *List:
+		return int64(len(v.Items)), nil
+	case *Dict:
+		return int64(v.Len()), nil
+	case *rangeValue:
+		return v.len(), nil
+	}
+	return 0, fmt.Errorf("%s has no len()", typeName(v))
+}
+
+func index(x, key Value) (Value, error) {
+	switch x := x.(type) {
+	case *Dict:
+		v, found, err := x.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("key %s not in dict", repr(key))
+		}
+		return v, nil
+	case *List, string, *rangeValue:
+		n, _ := length(x)
+		i, err := sequenceIndex(key, n)
+		if err != nil {
+			return nil, err
+		}
+		switch x := x.(type) {
+		case *List:
+			return x.Items[i], nil
+		case string:
+			return x[i : i+1], nil
+		case *rangeValue:
+			return x.index(i), nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not indexable", typeName(x))
+}
+
+func sequenceIndex(key Value, n int64) (int64, error) {
+	i, ok := key.(int64)
+	if !ok {
+		return 0, fmt.Errorf("index must be an int, not %s", typeName(key))
+	}
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		return 0, fmt.Errorf("index %d out of range", key)
+	}
+	return i, nil
+}
+
+func slice(x, start, stop Value) (Value, error) {
+	n, err := length(x)
+	if err != nil {
+		return nil, err
+	}
+	bound := func(v Value, def int64) (int64, error) {
+		if v == nil {
+			return def, nil
+		}
+		i, ok := v.(int64)
+		if !ok {
+			return 0, fmt.Errorf("slice indices must be ints, not %s", typeName(v))
+		}
+		if i < 0 {
+			i += n
+		}
+		return min(max(i, 0), n), nil
+	}
+	lo, err := bound(start, 0)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := bound(stop, n)
+	if err != nil {
+		return nil, err
+	}
+	hi = max(hi, lo)
+	switch x := x.(type) {
+	case string:
+		return x[lo:hi], nil
+	case *List:
+		return &List{Items: append([]Value(nil), x.Items[lo:hi]...)}, nil
+	}
+	return nil, fmt.Errorf("%s cannot be sliced", typeName(x))
+}
+
+func setIndex(x, key, value Value) error {
+	switch x := x.(type) {
+	case *Dict:
+		return x.Set(key, value)
+	case *List:
+		i, err := sequenceIndex(key, int64(len(x.Items)))
+		if err != nil {
+			return err
+		}
+		x.Items[i] = value
+		return nil
+	}
+	return fmt.Errorf("%s does not support item assignment", typeName(x))
+}
+
+func sortValues(items []Value, reverse bool) error {
+	var err error
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if reverse {
+			a, b = b, a
+		}
+		c, e := order(a, b)
+		if e != nil && err == nil {
+			err = fmt.Errorf("cannot compare %s and %s", typeName(a), typeName(b))
+		}
+		return c < 0
+	})
+	return err
+}
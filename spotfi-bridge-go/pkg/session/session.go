@@ -1,6 +1,7 @@
 package session
 
 import (
+	"context"
 	"encoding/base64"
 	"os"
 	"os/exec"
@@ -8,8 +9,13 @@ import (
 	"time"
 
 	"github.com/creack/pty"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
 )
 
+var logger = logging.For("session")
+
 type XSession struct {
 	ID            string
 	Cmd           *exec.Cmd
@@ -23,21 +29,65 @@ type SessionManager struct {
 	sessions map[string]*XSession
 	mu       sync.Mutex
 	sendFunc func(topic string, payload interface{}) error
+	closed   bool     // Set by CloseAll; new sessions are refused
+	command  []string // Run in each session's PTY, /bin/sh by default
+	env      []string // Added to the environment of command
+}
+
+// Count returns the number of open x-tunnel sessions
+func (sm *SessionManager) Count() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return len(sm.sessions)
+}
+
+// SessionInfo describes an open session for local status queries
+type SessionInfo struct {
+	ID           string `json:"id"`
+	LastActivity int64  `json:"lastActivity"`
+}
+
+// List returns the open sessions
+func (sm *SessionManager) List() []SessionInfo {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	list := make([]SessionInfo, 0, len(sm.sessions))
+	for id, sess := range sm.sessions {
+		list = append(list, SessionInfo{ID: id, LastActivity: sess.LastActivity.Unix()})
+	}
+	return list
 }
 
-func NewSessionManager(sendFunc func(topic string, payload interface{}) error) *SessionManager {
+// NewSessionManager creates the session manager; its sweeper stops when ctx is cancelled
+func NewSessionManager(ctx context.Context, sendFunc func(topic string, payload interface{}) error) *SessionManager {
 	sm := &SessionManager{
 		sessions: make(map[string]*XSession),
 		sendFunc: sendFunc,
 	}
 	// Start background sweeper for ghost sessions
-	go sm.sweepGhostSessions()
+	go sm.sweepGhostSessions(ctx)
+	return sm
+}
+
+// NewCommandSessionManager is NewSessionManager for sessions running command
+// instead of a local shell, e.g. ssh to another device
+func NewCommandSessionManager(ctx context.Context, sendFunc func(topic string, payload interface{}) error, command, env []string) *SessionManager {
+	sm := NewSessionManager(ctx, sendFunc)
+	sm.command = command
+	sm.env = env
 	return sm
 }
 
-func (sm *SessionManager) sweepGhostSessions() {
+func (sm *SessionManager) sweepGhostSessions(ctx context.Context) {
+	defer crash.Recover("session sweeper")
 	ticker := time.NewTicker(30 * time.Second)
-	for range ticker.C {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		sm.mu.Lock()
 		now := time.Now()
 		for id, sess := range sm.sessions {
@@ -45,6 +95,7 @@ func (sm *SessionManager) sweepGhostSessions() {
 			// This catches any sessions that didn't get properly closed
 			if sess.Active && now.Sub(sess.LastActivity) > 2*time.Minute {
 				// Kill idle session
+				logger.Info("Closing idle session", "session", id)
 				sess.Active = false
 				sess.Pty.Close()
 				if sess.Cmd.Process != nil {
@@ -58,6 +109,7 @@ func (sm *SessionManager) sweepGhostSessions() {
 }
 
 func (sm *SessionManager) HandleStart(msg map[string]interface{}) {
+	defer crash.Catch("session start")
 	sessionID, _ := msg["sessionId"].(string)
 	responseTopic, _ := msg["responseTopic"].(string)
 	if sessionID == "" {
@@ -67,6 +119,15 @@ func (sm *SessionManager) HandleStart(msg map[string]interface{}) {
 	// Clean up ALL existing sessions to prevent multiple active terminals
 	// This fixes the issue where reconnecting creates new sessions but old ones remain active
 	sm.mu.Lock()
+	if sm.closed {
+		sm.mu.Unlock()
+		sm.sendFunc(responseTopic, map[string]interface{}{
+			"type":      "x-error",
+			"sessionId": sessionID,
+			"error":     "bridge is shutting down",
+		})
+		return
+	}
 	for id, sess := range sm.sessions {
 		if sess.Active {
 			sess.Active = false
@@ -81,16 +142,21 @@ func (sm *SessionManager) HandleStart(msg map[string]interface{}) {
 
 	// Create command
 	c := exec.Command("/bin/sh")
+	if len(sm.command) > 0 {
+		c = exec.Command(sm.command[0], sm.command[1:]...)
+	}
 	// Set proper terminal environment variables to prevent echo issues
-	c.Env = append(os.Environ(), 
+	c.Env = append(os.Environ(),
 		"TERM=xterm-256color",
 		"HOME=/root",
 		"PS1=$ ", // Simple prompt to avoid issues
 	)
+	c.Env = append(c.Env, sm.env...)
 
 	// Start PTY
 	f, err := pty.Start(c)
 	if err != nil {
+		logger.Error("Failed to start shell", "session", sessionID, "error", err)
 		sm.sendFunc(responseTopic, map[string]interface{}{
 			"type":      "x-error",
 			"sessionId": sessionID,
@@ -114,6 +180,7 @@ func (sm *SessionManager) HandleStart(msg map[string]interface{}) {
 	sm.mu.Lock()
 	sm.sessions[sessionID] = sess
 	sm.mu.Unlock()
+	logger.Info("Session started", "session", sessionID)
 
 	// Ack
 	sm.sendFunc(responseTopic, map[string]interface{}{
@@ -124,6 +191,7 @@ func (sm *SessionManager) HandleStart(msg map[string]interface{}) {
 
 	// Reader Loop
 	go func() {
+		defer crash.Catch("session reader")
 		buf := make([]byte, 1024)
 		for {
 			n, err := f.Read(buf)
@@ -173,6 +241,7 @@ func (sm *SessionManager) HandleStop(msg map[string]interface{}) {
 	defer sm.mu.Unlock()
 
 	if sess, ok := sm.sessions[sessionID]; ok {
+		logger.Info("Session closed", "session", sessionID)
 		sess.Active = false
 		sess.Pty.Close()
 		if sess.Cmd.Process != nil {
@@ -181,3 +250,25 @@ func (sm *SessionManager) HandleStop(msg map[string]interface{}) {
 		delete(sm.sessions, sessionID)
 	}
 }
+
+// CloseAll ends every session and refuses new ones, e.g. at shutdown. Each client is
+// sent an x-error with the reason, so the API closes its terminal instead of waiting
+func (sm *SessionManager) CloseAll(reason string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.closed = true
+	for id, sess := range sm.sessions {
+		logger.Info("Session closed", "session", id, "reason", reason)
+		sm.sendFunc(sess.ResponseTopic, map[string]interface{}{
+			"type":      "x-error",
+			"sessionId": id,
+			"error":     reason,
+		})
+		sess.Active = false
+		sess.Pty.Close()
+		if sess.Cmd.Process != nil {
+			sess.Cmd.Process.Kill()
+		}
+		delete(sm.sessions, id)
+	}
+}
@@ -0,0 +1,340 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("speedtest")
+
+const (
+	DefaultMinInterval = 1 * time.Hour
+	DefaultMaxBytes    = 25 * 1024 * 1024
+
+	latencySamples = 5
+	testDuration   = 8 * time.Second
+)
+
+// Config configures the speedtest runner
+type Config struct {
+	// Endpoint is a LibreSpeed server base URL (https://speed.example.com/backend)
+	// or iperf3://host[:port]; empty disables the subsystem
+	Endpoint string
+
+	// Interval schedules automatic runs (0 for on demand only)
+	Interval time.Duration
+
+	// MinInterval is the minimum time between two runs, protecting data caps
+	MinInterval time.Duration
+
+	// MaxBytes caps the data transferred per direction
+	MaxBytes int64
+}
+
+// Result is published on the speedtest topic after every run
+type Result struct {
+	Type         string  `json:"type"` // Always "speedtest"
+	Endpoint     string  `json:"endpoint"`
+	StartedAt    int64   `json:"startedAt"`
+	DurationMs   int64   `json:"durationMs"`
+	DownloadMbps float64 `json:"downloadMbps"`
+	UploadMbps   float64 `json:"uploadMbps"`
+	LatencyMs    float64 `json:"latencyMs"`
+	JitterMs     float64 `json:"jitterMs"`
+	BytesUsed    int64   `json:"bytesUsed"`
+	Trigger      string  `json:"trigger"` // "schedule" or "rpc"
+	Error        string  `json:"error,omitempty"`
+}
+
+var runner = struct {
+	mu      sync.Mutex
+	cfg     Config
+	publish func(*Result) error
+	running bool
+	lastRun time.Time
+	last    *Result
+}{}
+
+// Configure sets up the runner and starts the schedule when an interval is set
+func Configure(ctx context.Context, cfg Config, publish func(*Result) error) {
+	if cfg.MinInterval <= 0 {
+		cfg.MinInterval = DefaultMinInterval
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	runner.mu.Lock()
+	runner.cfg = cfg
+	runner.publish = publish
+	runner.mu.Unlock()
+
+	if cfg.Endpoint == "" || cfg.Interval <= 0 {
+		return
+	}
+	if cfg.Interval < cfg.MinInterval {
+		cfg.Interval = cfg.MinInterval
+	}
+	go func() {
+		defer crash.Recover("speedtest schedule")
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := Run(ctx, "schedule"); err != nil {
+					logger.Warn("Scheduled speedtest failed", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// ErrTooSoon is returned when a run is refused by the rate limit
+type ErrTooSoon struct {
+	RetryAfter time.Duration
+}
+
+func (e *ErrTooSoon) Error() string {
+	return fmt.Sprintf("speedtest rate limited, retry in %v", e.RetryAfter.Round(time.Second))
+}
+
+// Last returns the most recent result, or nil
+func Last() *Result {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	return runner.last
+}
+
+// Run executes a speedtest unless one is running or the last one was too recent,
+// publishes the result and returns it
+func Run(ctx context.Context, trigger string) (*Result, error) {
+	runner.mu.Lock()
+	cfg := runner.cfg
+	switch {
+	case cfg.Endpoint == "":
+		runner.mu.Unlock()
+		return nil, fmt.Errorf("speedtest endpoint not configured")
+	case runner.running:
+		runner.mu.Unlock()
+		return nil, fmt.Errorf("speedtest already running")
+	case !runner.lastRun.IsZero() && time.Since(runner.lastRun) < cfg.MinInterval:
+		wait := cfg.MinInterval - time.Since(runner.lastRun)
+		runner.mu.Unlock()
+		return nil, &ErrTooSoon{RetryAfter: wait}
+	}
+	runner.running = true
+	runner.lastRun = time.Now()
+	publish := runner.publish
+	runner.mu.Unlock()
+
+	res := &Result{Type: "speedtest", Endpoint: cfg.Endpoint, StartedAt: time.Now().Unix(), Trigger: trigger}
+	started := time.Now()
+	var err error
+	if strings.HasPrefix(cfg.Endpoint, "iperf3://") {
+		err = runIperf(ctx, cfg, res)
+	} else {
+		err = runHTTP(ctx, cfg, res)
+	}
+	res.DurationMs = time.Since(started).Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	runner.mu.Lock()
+	runner.running = false
+	runner.last = res
+	runner.mu.Unlock()
+
+	if publish != nil {
+		if pubErr := publish(res); pubErr != nil {
+			logger.Error("Failed to publish speedtest result", "error", pubErr)
+		}
+	}
+	return res, err
+}
+
+func mbps(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / d.Seconds() / 1e6
+}
+
+func latencyStats(samples []float64) (avg, jitter float64) {
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	sum := 0.0
+	for _, s := range samples {
+		sum += s
+	}
+	for i := 1; i < len(samples); i++ {
+		jitter += math.Abs(samples[i] - samples[i-1])
+	}
+	if len(samples) > 1 {
+		jitter /= float64(len(samples) - 1)
+	}
+	return sum / float64(len(samples)), jitter
+}
+
+// runHTTP uses the LibreSpeed backend API: empty.php for latency and upload,
+// garbage.php?ckSize=<MiB> for download
+func runHTTP(ctx context.Context, cfg Config, res *Result) error {
+	base := strings.TrimSuffix(cfg.Endpoint, "/")
+	client := &http.Client{Timeout: 2 * testDuration}
+
+	var samples []float64
+	for i := 0; i < latencySamples; i++ {
+		start := time.Now()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/empty.php?r="+strconv.Itoa(i), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("latency: %w", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		samples = append(samples, float64(time.Since(start).Microseconds())/1000)
+	}
+	res.LatencyMs, res.JitterMs = latencyStats(samples)
+
+	dlCtx, cancel := context.WithTimeout(ctx, testDuration)
+	defer cancel()
+	chunks := cfg.MaxBytes / (1024 * 1024)
+	if chunks < 1 {
+		chunks = 1
+	}
+	req, err := http.NewRequestWithContext(dlCtx, http.MethodGet, fmt.Sprintf("%s/garbage.php?ckSize=%d", base, chunks), nil)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+	n, _ := io.Copy(io.Discard, io.LimitReader(resp.Body, cfg.MaxBytes))
+	resp.Body.Close()
+	res.DownloadMbps = mbps(n, time.Since(start))
+	res.BytesUsed += n
+
+	upCtx, cancelUp := context.WithTimeout(ctx, testDuration)
+	defer cancelUp()
+	// Zeros are streamed rather than allocated; routers have little RAM
+	upload := cfg.MaxBytes
+	counter := &countingReader{r: io.LimitReader(zeros{}, upload)}
+	req, err = http.NewRequestWithContext(upCtx, http.MethodPost, base+"/empty.php", counter)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = upload
+	start = time.Now()
+	resp, err = client.Do(req)
+	elapsed := time.Since(start)
+	if err != nil && counter.n == 0 {
+		return fmt.Errorf("upload: %w", err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	// A timeout after sending data still yields a valid (lower bound) rate
+	res.UploadMbps = mbps(counter.n, elapsed)
+	res.BytesUsed += counter.n
+	return nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runIperf runs iperf3 in both directions and pings the server for latency
+func runIperf(ctx context.Context, cfg Config, res *Result) error {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("invalid iperf3 endpoint %q", cfg.Endpoint)
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "5201"
+	}
+
+	if out, err := exec.CommandContext(ctx, "ping", "-c", strconv.Itoa(latencySamples), "-W", "2", host).Output(); err == nil {
+		var samples []float64
+		for _, field := range strings.Fields(string(out)) {
+			if v, ok := strings.CutPrefix(field, "time="); ok {
+				if ms, err := strconv.ParseFloat(v, 64); err == nil {
+					samples = append(samples, ms)
+				}
+			}
+		}
+		res.LatencyMs, res.JitterMs = latencyStats(samples)
+	}
+
+	for _, reverse := range []bool{true, false} {
+		// -n caps the transfer at MaxBytes, the timeout bounds slow links
+		args := []string{"-c", host, "-p", port, "-J", "-n", strconv.FormatInt(cfg.MaxBytes, 10)}
+		if reverse {
+			args = append(args, "-R") // Server sends: download
+		}
+		runCtx, cancel := context.WithTimeout(ctx, 2*testDuration)
+		out, err := exec.CommandContext(runCtx, "iperf3", args...).Output()
+		cancel()
+		if err != nil && len(out) == 0 {
+			return fmt.Errorf("iperf3: %w", err)
+		}
+		var report struct {
+			End struct {
+				SumReceived struct {
+					Bytes         int64   `json:"bytes"`
+					BitsPerSecond float64 `json:"bits_per_second"`
+				} `json:"sum_received"`
+			} `json:"end"`
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(out, &report); err != nil {
+			return fmt.Errorf("iperf3: invalid report: %w", err)
+		}
+		if report.Error != "" {
+			return fmt.Errorf("iperf3: %s", report.Error)
+		}
+		rate := report.End.SumReceived.BitsPerSecond / 1e6
+		if reverse {
+			res.DownloadMbps = rate
+		} else {
+			res.UploadMbps = rate
+		}
+		res.BytesUsed += report.End.SumReceived.Bytes
+	}
+	return nil
+}
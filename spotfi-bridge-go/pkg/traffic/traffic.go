@@ -0,0 +1,354 @@
+package traffic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/inventory"
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("traffic")
+
+const (
+	DefaultInterval = 15 * time.Minute
+	DefaultTop      = 10
+
+	queryTimeout = 20 * time.Second
+	maxOutput    = 8 << 20
+)
+
+// Fields nlbwmon can group by
+var GroupFields = map[string]bool{
+	"family": true, "proto": true, "port": true, "mac": true, "ip": true, "layer7": true,
+}
+
+var (
+	// ErrUnavailable is returned when nlbwmon is not installed or not running
+	ErrUnavailable = errors.New("nlbwmon is not available")
+
+	// ErrInvalidPeriod is returned for a period not given as YYYY-MM-DD
+	ErrInvalidPeriod = errors.New("invalid period, expected YYYY-MM-DD")
+
+	periodPattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+)
+
+// Config configures the traffic summaries
+type Config struct {
+	// Interval between summaries; negative disables them
+	Interval time.Duration
+
+	// Top is the number of hosts and protocols in a summary
+	Top int
+}
+
+// Row is one line of nlbwmon accounting data. Rx is what the host downloaded and
+// Tx what it uploaded; only the grouped fields are set
+type Row struct {
+	Family    int    `json:"family,omitempty"` // 4 or 6
+	Proto     string `json:"proto,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	Mac       string `json:"mac,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Layer7    string `json:"layer7,omitempty"`
+	Vendor    string `json:"vendor,omitempty"` // From the inventory, with mac
+	Conns     int64  `json:"conns"`
+	RxBytes   int64  `json:"rxBytes"`
+	RxPackets int64  `json:"rxPackets"`
+	TxBytes   int64  `json:"txBytes"`
+	TxPackets int64  `json:"txPackets"`
+}
+
+// Summary is published on the traffic topic: the top hosts and protocols by the
+// bytes they moved since the previous summary
+type Summary struct {
+	Type      string `json:"type"` // Always "traffic"
+	Since     int64  `json:"since"`
+	Hosts     []Row  `json:"hosts"`     // By mac and ip
+	Protocols []Row  `json:"protocols"` // By proto and port
+	RxBytes   int64  `json:"rxBytes"`   // All hosts
+	TxBytes   int64  `json:"txBytes"`
+	TS        int64  `json:"ts"`
+}
+
+// nlbwDump is the output of nlbw -c json
+type nlbwDump struct {
+	Columns []string            `json:"columns"`
+	Data    [][]json.RawMessage `json:"data"`
+}
+
+// Periods lists the accounting periods in the nlbwmon database, newest first
+func Periods(ctx context.Context) ([]string, error) {
+	out, err := nlbw(ctx, "-c", "list")
+	if err != nil {
+		return nil, err
+	}
+	var periods []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); periodPattern.MatchString(line) {
+			periods = append(periods, line)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(periods)))
+	return periods, nil
+}
+
+// Query returns accounting data grouped by fields for period, the start date of
+// an accounting period (YYYY-MM-DD), or the current period when empty. Rows come
+// sorted by the bytes moved, largest first
+func Query(ctx context.Context, fields []string, period string) ([]Row, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no group fields")
+	}
+	for _, f := range fields {
+		if !GroupFields[f] {
+			return nil, fmt.Errorf("invalid group field: %q", f)
+		}
+	}
+	args := []string{"-c", "json", "-g", strings.Join(fields, ",")}
+	if period != "" {
+		if !periodPattern.MatchString(period) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPeriod, period)
+		}
+		args = append(args, "-t", period)
+	}
+	out, err := nlbw(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	var dump nlbwDump
+	if err := json.Unmarshal(out, &dump); err != nil {
+		return nil, fmt.Errorf("invalid nlbw output: %w", err)
+	}
+
+	rows := make([]Row, 0, len(dump.Data))
+	for _, values := range dump.Data {
+		var r Row
+		for i, col := range dump.Columns {
+			if i < len(values) {
+				setColumn(&r, col, values[i])
+			}
+		}
+		rows = append(rows, r)
+	}
+	if slices.Contains(fields, "mac") {
+		addVendors(rows)
+	}
+	sortRows(rows)
+	return rows, nil
+}
+
+func setColumn(r *Row, col string, raw json.RawMessage) {
+	str := func() string {
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			return ""
+		}
+		return s
+	}
+	num := func() int64 {
+		var n json.Number
+		if json.Unmarshal(raw, &n) != nil {
+			// Some versions quote numbers
+			n = json.Number(str())
+		}
+		v, _ := strconv.ParseInt(n.String(), 10, 64)
+		return v
+	}
+	switch col {
+	case "family":
+		r.Family = int(num())
+	case "proto":
+		r.Proto = str()
+	case "port":
+		r.Port = int(num())
+	case "mac":
+		r.Mac = strings.ToLower(str())
+	case "ip":
+		r.IP = str()
+	case "layer7":
+		r.Layer7 = str()
+	case "conns":
+		r.Conns = num()
+	case "rx_bytes":
+		r.RxBytes = num()
+	case "rx_pkts":
+		r.RxPackets = num()
+	case "tx_bytes":
+		r.TxBytes = num()
+	case "tx_pkts":
+		r.TxPackets = num()
+	}
+}
+
+func addVendors(rows []Row) {
+	inv, ok := inventory.Current()
+	if !ok {
+		return
+	}
+	vendors := map[string]string{}
+	for _, d := range inv.Devices {
+		vendors[d.Mac] = d.Vendor
+	}
+	for i := range rows {
+		rows[i].Vendor = vendors[rows[i].Mac]
+	}
+}
+
+func sortRows(rows []Row) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].RxBytes+rows[i].TxBytes > rows[j].RxBytes+rows[j].TxBytes
+	})
+}
+
+// nlbw runs the nlbwmon client, which reads the running daemon's live counters
+func nlbw(ctx context.Context, args ...string) ([]byte, error) {
+	path, err := exec.LookPath("nlbw")
+	if err != nil {
+		return nil, ErrUnavailable
+	}
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		// The client cannot reach the daemon's socket when nlbwmon is stopped
+		if strings.Contains(msg, "No such file") || strings.Contains(msg, "Connection refused") {
+			return nil, fmt.Errorf("%w: %s", ErrUnavailable, msg)
+		}
+		return nil, fmt.Errorf("nlbw: %v: %s", err, msg)
+	}
+	if stdout.Len() > maxOutput {
+		return nil, fmt.Errorf("nlbw output exceeds %d bytes", maxOutput)
+	}
+	return stdout.Bytes(), nil
+}
+
+// snapshot holds the counters a summary is computed against
+type snapshot struct {
+	at        time.Time
+	hosts     map[string]Row
+	protocols map[string]Row
+}
+
+// Configure publishes a summary every interval while nlbwmon is available
+func Configure(ctx context.Context, cfg Config, publish func(*Summary) error) {
+	if cfg.Interval < 0 {
+		return
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Top <= 0 {
+		cfg.Top = DefaultTop
+	}
+
+	go func() {
+		defer crash.Recover("traffic")
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		var last *snapshot // Of the last published summary
+		unavailable := false
+		for {
+			summary, snap, err := summarize(ctx, last, cfg.Top)
+			switch {
+			case errors.Is(err, ErrUnavailable):
+				if !unavailable {
+					logger.Info("Traffic summaries paused until nlbwmon is available", "error", err)
+				}
+				unavailable = true
+			case err != nil:
+				logger.Warn("Failed to read nlbwmon counters", "error", err)
+			case summary == nil:
+				unavailable = false
+				last = snap
+			default:
+				unavailable = false
+				if err := publish(summary); err != nil {
+					logger.Warn("Traffic summary not published, the next one covers its time as well", "error", err)
+				} else {
+					last = snap
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// summarize reads the counters and computes the summary against last; without
+// a last snapshot it only takes the baseline
+func summarize(ctx context.Context, last *snapshot, top int) (*Summary, *snapshot, error) {
+	hosts, err := Query(ctx, []string{"mac", "ip"}, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	protocols, err := Query(ctx, []string{"proto", "port"}, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	snap := &snapshot{at: time.Now(), hosts: byKey(hosts, hostKey), protocols: byKey(protocols, protoKey)}
+	if last == nil {
+		return nil, snap, nil
+	}
+
+	summary := &Summary{Type: "traffic", Since: last.at.Unix(), TS: snap.at.Unix()}
+	summary.Hosts = deltas(snap.hosts, last.hosts)
+	summary.Protocols = deltas(snap.protocols, last.protocols)
+	for _, r := range summary.Hosts {
+		summary.RxBytes += r.RxBytes
+		summary.TxBytes += r.TxBytes
+	}
+	summary.Hosts = summary.Hosts[:min(top, len(summary.Hosts))]
+	summary.Protocols = summary.Protocols[:min(top, len(summary.Protocols))]
+	return summary, snap, nil
+}
+
+func hostKey(r Row) string  { return r.Mac + "/" + r.IP }
+func protoKey(r Row) string { return r.Proto + "/" + strconv.Itoa(r.Port) }
+
+func byKey(rows []Row, key func(Row) string) map[string]Row {
+	m := make(map[string]Row, len(rows))
+	for _, r := range rows {
+		m[key(r)] = r
+	}
+	return m
+}
+
+// deltas returns what each row moved since last, largest first. Counters lower
+// than before mean nlbwmon started a new accounting period or was restarted, and
+// count from zero
+func deltas(cur, last map[string]Row) []Row {
+	rows := make([]Row, 0, len(cur))
+	for key, r := range cur {
+		if prev, ok := last[key]; ok && r.RxBytes >= prev.RxBytes && r.TxBytes >= prev.TxBytes {
+			r.Conns = max(r.Conns-prev.Conns, 0)
+			r.RxBytes -= prev.RxBytes
+			r.RxPackets = max(r.RxPackets-prev.RxPackets, 0)
+			r.TxBytes -= prev.TxBytes
+			r.TxPackets = max(r.TxPackets-prev.TxPackets, 0)
+		}
+		if r.RxBytes+r.TxBytes > 0 {
+			rows = append(rows, r)
+		}
+	}
+	sortRows(rows)
+	return rows
+}
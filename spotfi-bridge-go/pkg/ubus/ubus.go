@@ -0,0 +1,137 @@
+package ubus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Error is returned when the ubus CLI exits non-zero; ExitCode is the UBUS_STATUS_* value
+type Error struct {
+	Path     string
+	Method   string
+	ExitCode int
+	Stderr   string
+}
+
+func (e *Error) Error() string {
+	if e.Stderr != "" {
+		return fmt.Sprintf("ubus call %s %s: exit status %d: %s", e.Path, e.Method, e.ExitCode, e.Stderr)
+	}
+	return fmt.Sprintf("ubus call %s %s: exit status %d", e.Path, e.Method, e.ExitCode)
+}
+
+// statusNotFound is UBUS_STATUS_NOT_FOUND, returned when the object does not exist
+const statusNotFound = 4
+
+// IsNotFound reports whether err is a call to a ubus object that is not
+// registered, such as a package that is not installed
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.ExitCode == statusNotFound
+}
+
+// Call invokes a ubus method and decodes the JSON reply
+func Call(path, method string, args interface{}) (map[string]interface{}, error) {
+	argsStr := "{}"
+	if args != nil {
+		b, err := json.Marshal(args)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal args: %w", err)
+		}
+		argsStr = string(b)
+	}
+
+	cmd := exec.Command("ubus", "call", path, method, argsStr)
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, &Error{
+				Path:     path,
+				Method:   method,
+				ExitCode: exitErr.ExitCode(),
+				Stderr:   strings.TrimSpace(stderr.String()),
+			}
+		}
+		return nil, fmt.Errorf("ubus call %s %s: %w", path, method, err)
+	}
+
+	result := map[string]interface{}{}
+	if out.Len() > 0 {
+		if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+			return nil, fmt.Errorf("ubus call %s %s: invalid JSON reply: %w", path, method, err)
+		}
+	}
+	return result, nil
+}
+
+// List returns the ubus objects matching pattern (e.g. "hostapd.*")
+func List(pattern string) ([]string, error) {
+	out, err := exec.Command("ubus", "list", pattern).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ubus list %s: %w", pattern, err)
+	}
+	var objects []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			objects = append(objects, line)
+		}
+	}
+	return objects, nil
+}
+
+// Object is a ubus object with its method signatures (argument name -> type)
+type Object struct {
+	Name    string                       `json:"name"`
+	ID      string                       `json:"id"`
+	Methods map[string]map[string]string `json:"methods"`
+}
+
+// Objects returns the objects matching pattern with their methods, parsed from "ubus -v list"
+func Objects(pattern string) ([]Object, error) {
+	args := []string{"-v", "list"}
+	if pattern != "" {
+		args = append(args, pattern)
+	}
+	out, err := exec.Command("ubus", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ubus -v list %s: %w", pattern, err)
+	}
+
+	objects := []Object{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// Objects are "'name' @id", methods are indented "\"method\":{signature}"
+		if !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, " ") {
+			name, id, _ := strings.Cut(strings.TrimSpace(line), " ")
+			objects = append(objects, Object{
+				Name:    strings.Trim(name, "'"),
+				ID:      strings.TrimPrefix(id, "@"),
+				Methods: map[string]map[string]string{},
+			})
+			continue
+		}
+		if len(objects) == 0 {
+			continue
+		}
+		method, signature, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		params := map[string]string{}
+		if err := json.Unmarshal([]byte(signature), &params); err != nil {
+			return nil, fmt.Errorf("ubus -v list: invalid signature for %s: %w", method, err)
+		}
+		objects[len(objects)-1].Methods[strings.Trim(method, `"`)] = params
+	}
+	return objects, nil
+}
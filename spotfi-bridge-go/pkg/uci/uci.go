@@ -0,0 +1,172 @@
+package uci
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// mu is the lock behind Lock and Unlock. uci stages changes in one directory
+// shared by every caller, and Commit writes all staged changes of a config
+var mu sync.Mutex
+
+// Section is a single UCI section as reported by "uci show"
+type Section struct {
+	Name    string
+	Type    string
+	Options map[string][]string
+}
+
+// Lock must be held from the first staged change (Set, Add, Delete, ...) until
+// the Commit or Revert that ends them, so that concurrent writers neither commit
+// nor revert each other's changes. The functions of this package do not take it
+func Lock() { mu.Lock() }
+
+// Unlock releases the lock taken with Lock
+func Unlock() { mu.Unlock() }
+
+// Get returns the value of an option (e.g. "wireless.radio0.channel")
+func Get(key string) (string, error) {
+	out, err := run("get", key)
+	return strings.TrimSpace(out), err
+}
+
+// Set sets an option or creates a named section
+func Set(key, value string) error {
+	_, err := run("set", key+"="+value)
+	return err
+}
+
+// AddList appends a value to a list option
+func AddList(key, value string) error {
+	_, err := run("add_list", key+"="+value)
+	return err
+}
+
+// DelList removes a value from a list option
+func DelList(key, value string) error {
+	_, err := run("del_list", key+"="+value)
+	return err
+}
+
+// Add creates an anonymous section and returns its generated name
+func Add(config, sectionType string) (string, error) {
+	out, err := run("add", config, sectionType)
+	return strings.TrimSpace(out), err
+}
+
+// Delete removes an option or a whole section
+func Delete(key string) error {
+	_, err := run("delete", key)
+	return err
+}
+
+// Commit writes staged changes of a config to flash
+func Commit(config string) error {
+	_, err := run("commit", config)
+	return err
+}
+
+// Revert discards staged changes of a config
+func Revert(config string) error {
+	_, err := run("revert", config)
+	return err
+}
+
+// Show returns all sections of a config in file order. Anonymous sections are
+// reported by their stable cfgXXXXXX identifiers rather than @type[index].
+func Show(config string) ([]Section, error) {
+	out, err := run("-X", "show", config)
+	if err != nil {
+		return nil, err
+	}
+
+	var sections []Section
+	index := map[string]int{}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		parts := strings.SplitN(key, ".", 3)
+		switch len(parts) {
+		case 2:
+			index[parts[1]] = len(sections)
+			sections = append(sections, Section{
+				Name:    parts[1],
+				Type:    value,
+				Options: map[string][]string{},
+			})
+		case 3:
+			if i, ok := index[parts[1]]; ok {
+				sections[i].Options[parts[2]] = parseValues(value)
+			}
+		}
+	}
+	return sections, nil
+}
+
+// SectionsOfType filters Show output by section type
+func SectionsOfType(config, sectionType string) ([]Section, error) {
+	all, err := Show(config)
+	if err != nil {
+		return nil, err
+	}
+	var sections []Section
+	for _, s := range all {
+		if s.Type == sectionType {
+			sections = append(sections, s)
+		}
+	}
+	return sections, nil
+}
+
+// Option returns the first value of an option, or "" if unset
+func (s Section) Option(name string) string {
+	if v := s.Options[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// parseValues splits "uci show" values like 'a' 'b c' into their elements
+func parseValues(raw string) []string {
+	var values []string
+	var cur strings.Builder
+	inQuote := false
+	for _, r := range raw {
+		switch {
+		case r == '\'':
+			if inQuote {
+				values = append(values, cur.String())
+				cur.Reset()
+			}
+			inQuote = !inQuote
+		case inQuote:
+			cur.WriteRune(r)
+		case r != ' ':
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		values = append(values, cur.String())
+	}
+	return values
+}
+
+func run(args ...string) (string, error) {
+	cmd := exec.Command("uci", append([]string{"-q"}, args...)...)
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return "", fmt.Errorf("uci %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+		}
+		return "", fmt.Errorf("uci %s: %w", strings.Join(args, " "), err)
+	}
+	return out.String(), nil
+}
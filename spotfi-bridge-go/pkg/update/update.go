@@ -0,0 +1,720 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/logging"
+)
+
+var logger = logging.For("update")
+
+const (
+	DefaultGracePeriod = 5 * time.Minute
+	DefaultChannel     = "stable"
+
+	// StateFile records an update in progress across the restart
+	StateFile = "/etc/spotfi/update.json"
+
+	// initScript restarts the bridge through procd
+	initScript = "/etc/init.d/spotfi-bridge"
+
+	maxManifestSize = 64 * 1024
+	maxBinarySize   = 64 * 1024 * 1024
+	downloadTimeout = 10 * time.Minute
+	preflightTime   = 10 * time.Second
+
+	// maxStarts is how often an updated binary may start without connecting
+	// before it is rolled back; procd respawns a crashing bridge
+	maxStarts = 3
+
+	// restartDelay lets the RPC response go out before the bridge restarts
+	restartDelay = 2 * time.Second
+)
+
+// Channels are the release channels, most conservative first
+var Channels = []string{"stable", "beta", "canary"}
+
+// Config configures the updater
+type Config struct {
+	// ManifestURL points to the release manifest; empty disables updates
+	ManifestURL string
+
+	// PublicKey is the Ed25519 key release binaries are signed with (see ParseKey)
+	PublicKey ed25519.PublicKey
+
+	// Interval schedules automatic checks (0 for on demand only)
+	Interval time.Duration
+
+	// GracePeriod is how long an updated bridge has to reach the broker before
+	// the previous binary is restored
+	GracePeriod time.Duration
+
+	// Channel is the release channel followed in a multi-channel manifest
+	Channel string
+
+	// RouterID places the router in staged rollouts
+	RouterID string
+
+	// SaveChannel persists a channel set with SetChannel, so it survives restarts
+	SaveChannel func(channel string) error
+
+	// Version is the running bridge version
+	Version string
+
+	// PublishStatus publishes the retained router status before restarting
+	PublishStatus func(status string) error
+}
+
+// Manifest describes a release, or with channels one release per channel:
+//
+//	{"version": "2.1.0", "binaries": {"mipsle": {"url": "spotfi-bridge-mipsle", "sha256": "...", "size": 6291456, "signature": "..."}}}
+//	{"channels": {"stable": {"version": "2.0.3", ...}, "beta": {"version": "2.1.0", "rollout": 25, ...}}}
+//
+// Binary URLs may be relative to the manifest
+type Manifest struct {
+	Release
+	Channels map[string]Release `json:"channels,omitempty"`
+}
+
+// Release is one version offered by a Manifest
+type Release struct {
+	Version  string            `json:"version"`
+	Binaries map[string]Binary `json:"binaries"` // By GOARCH (mips, mipsle, arm, arm64, ...)
+
+	// Rollout is the percentage of routers offered the release (default 100).
+	// Each router falls in a fixed bucket per version, so raising the percentage
+	// only adds routers
+	Rollout *float64 `json:"rollout,omitempty"`
+}
+
+// release picks a channel's release; a manifest without channels serves every channel
+func (m *Manifest) release(channel string) (*Release, error) {
+	if len(m.Channels) == 0 {
+		if m.Version == "" {
+			return nil, fmt.Errorf("invalid manifest: no version")
+		}
+		return &m.Release, nil
+	}
+	r, ok := m.Channels[channel]
+	if !ok || r.Version == "" {
+		return nil, fmt.Errorf("manifest has no %s release", channel)
+	}
+	return &r, nil
+}
+
+// selected reports whether a router is part of the release's rollout
+func (r *Release) selected(routerID string) bool {
+	if r.Rollout == nil || *r.Rollout >= 100 {
+		return true
+	}
+	return rolloutBucket(routerID, r.Version) < *r.Rollout
+}
+
+// rolloutBucket places a router in [0, 100) for a version
+func rolloutBucket(routerID, version string) float64 {
+	sum := sha256.Sum256([]byte(routerID + "\n" + version))
+	n := uint64(sum[0])<<24 | uint64(sum[1])<<16 | uint64(sum[2])<<8 | uint64(sum[3])
+	return float64(n%10000) / 100
+}
+
+// Binary is one architecture's build in a Manifest. Signature is a base64 Ed25519
+// signature over "spotfi-bridge\n<version>\n<arch>\n<sha256>", binding the checksum
+// to the release so an old signed binary cannot be passed off as a newer one
+type Binary struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"` // Hex
+	Size      int64  `json:"size,omitempty"`
+	Signature string `json:"signature"`
+}
+
+// Result describes an update attempt; the latest one is reported in the hello
+type Result struct {
+	Status  string `json:"status"` // up-to-date, held-back, restarting, pending, completed, rolled-back or failed
+	From    string `json:"from"`
+	To      string `json:"to,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	At      int64  `json:"at"`
+	Trigger string `json:"trigger,omitempty"` // "rpc" or "schedule"
+}
+
+// record is the content of StateFile
+type record struct {
+	Status    string `json:"status"` // pending or rolled-back
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Channel   string `json:"channel,omitempty"`
+	Binary    string `json:"binary"`
+	Backup    string `json:"backup"`
+	AppliedAt int64  `json:"appliedAt"`
+	Starts    int    `json:"starts"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+var updater = struct {
+	mu      sync.Mutex
+	cfg     Config
+	running bool
+	pending *record     // Update of the running binary awaiting Confirm
+	grace   *time.Timer // Rolls back a pending update
+	last    *Result
+}{}
+
+// ParseKey decodes a base64 or hex encoded 32 byte Ed25519 public key
+func ParseKey(key string) (ed25519.PublicKey, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		b, err = hex.DecodeString(key)
+	}
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("update key must be a 32 byte Ed25519 public key (base64 or hex)")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// Configure sets up the updater, resumes an update started by the previous run and
+// starts the schedule when an interval is set. Call it before connecting, so a
+// pending update's grace period covers the first connection attempt
+func Configure(ctx context.Context, cfg Config) {
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = DefaultGracePeriod
+	}
+	if cfg.Channel == "" {
+		cfg.Channel = DefaultChannel
+	}
+	updater.mu.Lock()
+	updater.cfg = cfg
+	updater.mu.Unlock()
+	resume()
+
+	if cfg.ManifestURL == "" || cfg.Interval <= 0 {
+		return
+	}
+	go func() {
+		defer crash.Recover("update schedule")
+		// Spread the fleet's checks over the interval
+		first := time.NewTimer(time.Duration(rand.Int63n(int64(cfg.Interval))))
+		defer first.Stop()
+		select {
+		case <-ctx.Done():
+			return
+		case <-first.C:
+		}
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			if _, err := Apply(ctx, "", "", false, "schedule"); err != nil {
+				logger.Warn("Scheduled update check failed", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Channel returns the release channel followed
+func Channel() string {
+	updater.mu.Lock()
+	defer updater.mu.Unlock()
+	return updater.cfg.Channel
+}
+
+// SetChannel switches the release channel and persists it with Config.SaveChannel
+func SetChannel(channel string) error {
+	if !validChannel(channel) {
+		return fmt.Errorf("unknown channel %q (use %s)", channel, strings.Join(Channels, ", "))
+	}
+	updater.mu.Lock()
+	save := updater.cfg.SaveChannel
+	updater.mu.Unlock()
+	if save != nil {
+		if err := save(channel); err != nil {
+			return fmt.Errorf("saving channel: %w", err)
+		}
+	}
+	updater.mu.Lock()
+	updater.cfg.Channel = channel
+	updater.mu.Unlock()
+	logger.Info("Release channel changed", "channel", channel)
+	return nil
+}
+
+func validChannel(channel string) bool {
+	for _, c := range Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Last returns the most recent update result, or nil
+func Last() *Result {
+	updater.mu.Lock()
+	defer updater.mu.Unlock()
+	return updater.last
+}
+
+// Confirm marks a pending update as good once the bridge has connected
+func Confirm() {
+	updater.mu.Lock()
+	defer updater.mu.Unlock()
+	rec := updater.pending
+	if rec == nil {
+		return
+	}
+	updater.pending = nil
+	updater.grace.Stop()
+	os.Remove(StateFile)
+	os.Remove(rec.Backup)
+	updater.last = &Result{Status: "completed", From: rec.From, To: rec.To, Channel: rec.Channel, At: time.Now().Unix()}
+	logger.Info("Update completed", "from", rec.From, "to", rec.To)
+}
+
+// resume handles the StateFile left by an update: a pending update of this
+// version starts its grace period, anything else is reported once
+func resume() {
+	data, err := os.ReadFile(StateFile)
+	if err != nil {
+		return
+	}
+	var rec record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		os.Remove(StateFile)
+		return
+	}
+
+	updater.mu.Lock()
+	defer updater.mu.Unlock()
+	cfg := updater.cfg
+	now := time.Now().Unix()
+	switch {
+	case rec.Status == "pending" && rec.To == cfg.Version:
+		rec.Starts++
+		if rec.Starts > maxStarts {
+			rollbackLocked(&rec, fmt.Sprintf("restarted %d times without connecting", maxStarts))
+			return
+		}
+		if err := saveRecord(&rec); err != nil {
+			logger.Warn("Failed to record update start", "error", err)
+		}
+		updater.pending = &rec
+		updater.last = &Result{Status: "pending", From: rec.From, To: rec.To, Channel: rec.Channel, At: now}
+		updater.grace = time.AfterFunc(cfg.GracePeriod, func() {
+			defer crash.Catch("update grace period")
+			updater.mu.Lock()
+			defer updater.mu.Unlock()
+			if updater.pending == &rec {
+				rollbackLocked(&rec, fmt.Sprintf("no broker connection within %s", cfg.GracePeriod))
+			}
+		})
+		logger.Info("Running updated binary; waiting for the broker", "from", rec.From, "to", rec.To, "grace", cfg.GracePeriod)
+	case rec.Status == "rolled-back":
+		os.Remove(StateFile)
+		updater.last = &Result{Status: "rolled-back", From: rec.From, To: rec.To, Channel: rec.Channel, Reason: rec.Reason, At: now}
+		logger.Warn("Update was rolled back", "to", rec.To, "reason", rec.Reason)
+	default:
+		// The swap did not take effect, e.g. the binary was replaced by hand
+		os.Remove(StateFile)
+		updater.last = &Result{Status: "failed", From: rec.From, To: rec.To, Reason: "running version " + cfg.Version, At: now}
+	}
+}
+
+// rollbackLocked restores the previous binary and restarts; updater.mu must be held
+func rollbackLocked(rec *record, reason string) {
+	logger.Error("Rolling back update", "from", rec.To, "to", rec.From, "reason", reason)
+	updater.pending = nil
+	if err := os.Rename(rec.Backup, rec.Binary); err != nil {
+		logger.Error("Failed to restore previous binary", "error", err)
+		os.Remove(StateFile)
+		updater.last = &Result{Status: "failed", From: rec.From, To: rec.To, Reason: reason + "; restore failed: " + err.Error(), At: time.Now().Unix()}
+		return
+	}
+	rec.Status, rec.Reason = "rolled-back", reason
+	if err := saveRecord(rec); err != nil {
+		logger.Warn("Failed to record rollback", "error", err)
+	}
+	restart()
+}
+
+// Check fetches the manifest and reports whether a newer version is available on
+// the channel (the configured one when empty)
+func Check(ctx context.Context, manifestURL, channel string) (map[string]interface{}, error) {
+	updater.mu.Lock()
+	cfg := updater.cfg
+	updater.mu.Unlock()
+	if manifestURL == "" {
+		manifestURL = cfg.ManifestURL
+	}
+	if manifestURL == "" {
+		return nil, fmt.Errorf("update manifest URL not configured")
+	}
+	if channel == "" {
+		channel = cfg.Channel
+	}
+	m, _, err := fetchManifest(ctx, manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	r, err := m.release(channel)
+	if err != nil {
+		return nil, err
+	}
+	_, built := r.Binaries[runtime.GOARCH]
+	res := map[string]interface{}{
+		"current":   cfg.Version,
+		"channel":   channel,
+		"available": r.Version,
+		"newer":     CompareVersions(r.Version, cfg.Version) > 0,
+		"arch":      runtime.GOARCH,
+		"supported": built,
+		"selected":  r.selected(cfg.RouterID),
+	}
+	if r.Rollout != nil {
+		res["rollout"] = *r.Rollout
+	}
+	return res, nil
+}
+
+// Apply installs the channel's release in the manifest (the configured ones when
+// empty) if it is newer than the running version and the router is part of its
+// rollout, or in any case with force, and restarts the bridge. It returns once the
+// new binary is in place, before the restart
+func Apply(ctx context.Context, manifestURL, channel string, force bool, trigger string) (*Result, error) {
+	updater.mu.Lock()
+	cfg := updater.cfg
+	switch {
+	case updater.running:
+		updater.mu.Unlock()
+		return nil, fmt.Errorf("update already in progress")
+	case updater.pending != nil:
+		updater.mu.Unlock()
+		return nil, fmt.Errorf("update to %s not confirmed yet", updater.pending.To)
+	}
+	updater.running = true
+	updater.mu.Unlock()
+	defer func() {
+		updater.mu.Lock()
+		updater.running = false
+		updater.mu.Unlock()
+	}()
+
+	if manifestURL == "" {
+		manifestURL = cfg.ManifestURL
+	}
+	if manifestURL == "" {
+		return nil, fmt.Errorf("update manifest URL not configured")
+	}
+	if len(cfg.PublicKey) == 0 {
+		return nil, fmt.Errorf("update key not configured")
+	}
+	if channel == "" {
+		channel = cfg.Channel
+	}
+
+	m, base, err := fetchManifest(ctx, manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	r, err := m.release(channel)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{From: cfg.Version, To: r.Version, Channel: channel, At: time.Now().Unix(), Trigger: trigger}
+	switch {
+	case force:
+	case CompareVersions(r.Version, cfg.Version) <= 0:
+		res.Status = "up-to-date"
+		return res, nil
+	case !r.selected(cfg.RouterID):
+		res.Status = "held-back"
+		res.Reason = fmt.Sprintf("not in the %g%% rollout", *r.Rollout)
+		return res, nil
+	}
+	bin, ok := r.Binaries[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("release %s has no %s binary", r.Version, runtime.GOARCH)
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("locating the running binary: %w", err)
+	}
+	staged := exe + ".new"
+	defer os.Remove(staged)
+
+	logger.Info("Downloading update", "version", r.Version, "channel", channel, "arch", runtime.GOARCH)
+	if err := download(ctx, base, bin, staged); err != nil {
+		return nil, err
+	}
+	if err := verify(cfg.PublicKey, r.Version, bin, staged); err != nil {
+		return nil, err
+	}
+	if err := preflight(ctx, staged, r.Version); err != nil {
+		return nil, err
+	}
+
+	// Keep the running binary for the rollback, then swap atomically
+	backup := exe + ".prev"
+	if err := copyFile(exe, backup); err != nil {
+		return nil, fmt.Errorf("backing up the running binary: %w", err)
+	}
+	rec := &record{Status: "pending", From: cfg.Version, To: r.Version, Channel: channel, Binary: exe, Backup: backup, AppliedAt: time.Now().Unix()}
+	if err := saveRecord(rec); err != nil {
+		os.Remove(backup)
+		return nil, fmt.Errorf("recording the update: %w", err)
+	}
+	if err := os.Rename(staged, exe); err != nil {
+		os.Remove(StateFile)
+		os.Remove(backup)
+		return nil, fmt.Errorf("installing the update: %w", err)
+	}
+
+	logger.Warn("Update installed, restarting", "from", cfg.Version, "to", r.Version)
+	res.Status = "restarting"
+	updater.mu.Lock()
+	updater.last = res
+	updater.mu.Unlock()
+	time.AfterFunc(restartDelay, func() {
+		defer crash.Catch("update restart")
+		if cfg.PublishStatus != nil {
+			cfg.PublishStatus("UPDATING")
+		}
+		restart()
+	})
+	return res, nil
+}
+
+// fetchManifest downloads and decodes a manifest, returning it with its URL for
+// resolving relative binary URLs
+func fetchManifest(ctx context.Context, rawURL string) (*Manifest, *url.URL, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil || (base.Scheme != "https" && base.Scheme != "http") {
+		return nil, nil, fmt.Errorf("invalid manifest URL %q", rawURL)
+	}
+	body, err := get(ctx, base.String(), maxManifestSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching manifest: %w", err)
+	}
+	defer body.Close()
+	var m Manifest
+	if err := json.NewDecoder(body).Decode(&m); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return &m, base, nil
+}
+
+// get starts a GET request, returning its body limited to max bytes
+func get(ctx context.Context, rawURL string, max int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, max), resp.Body}, nil
+}
+
+// download writes a binary to path
+func download(ctx context.Context, base *url.URL, bin Binary, path string) error {
+	ref, err := url.Parse(bin.URL)
+	if err != nil || bin.URL == "" {
+		return fmt.Errorf("invalid binary URL %q", bin.URL)
+	}
+	ctx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+	body, err := get(ctx, base.ResolveReference(ref).String(), maxBinarySize+1)
+	if err != nil {
+		return fmt.Errorf("downloading update: %w", err)
+	}
+	defer body.Close()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case err != nil:
+		return fmt.Errorf("downloading update: %w", err)
+	case n > maxBinarySize:
+		return fmt.Errorf("update binary is larger than %d bytes", maxBinarySize)
+	case bin.Size > 0 && n != bin.Size:
+		return fmt.Errorf("update binary is %d bytes, expected %d", n, bin.Size)
+	}
+	return nil
+}
+
+// verify checks the checksum of the downloaded binary and the release signature over it
+func verify(key ed25519.PublicKey, version string, bin Binary, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(sum, bin.SHA256) {
+		return fmt.Errorf("update checksum mismatch: got %s, expected %s", sum, bin.SHA256)
+	}
+	sig, err := base64.StdEncoding.DecodeString(bin.Signature)
+	if err != nil || !ed25519.Verify(key, SignedMessage(version, runtime.GOARCH, sum), sig) {
+		return fmt.Errorf("update signature is invalid")
+	}
+	return nil
+}
+
+// SignedMessage is the byte string a release binary's signature covers
+func SignedMessage(version, arch, sha256Hex string) []byte {
+	return []byte("spotfi-bridge\n" + version + "\n" + arch + "\n" + strings.ToLower(sha256Hex))
+}
+
+// preflight runs the new binary's --version, catching builds for the wrong CPU or
+// a manifest version that does not match the binary
+func preflight(ctx context.Context, path, version string) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTime)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("update binary does not run: %w", err)
+	}
+	if !strings.Contains(string(out), "v"+version+" ") {
+		return fmt.Errorf("update binary reports %q, expected version %s", strings.TrimSpace(string(out)), version)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func saveRecord(rec *record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(StateFile), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(StateFile, data, 0644)
+}
+
+// restart has procd restart the service, from a separate session so the init
+// script survives this process being stopped. Without the init script (e.g. when
+// run by hand) the bridge re-executes itself in place
+func restart() {
+	if _, err := os.Stat(initScript); err == nil {
+		cmd := exec.Command(initScript, "restart")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		if err := cmd.Start(); err == nil {
+			return
+		}
+		logger.Error("Failed to restart through procd", "error", err)
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		err = syscall.Exec(exe, os.Args, os.Environ())
+	}
+	logger.Error("Failed to restart, exiting", "error", err)
+	os.Exit(1)
+}
+
+// CompareVersions compares dotted versions such as "2.1.0" and "2.10.3" numerically,
+// returning -1, 0 or 1. A pre-release suffix ("2.1.0-beta.1") sorts before the release
+func CompareVersions(a, b string) int {
+	a, b = strings.TrimPrefix(a, "v"), strings.TrimPrefix(b, "v")
+	aCore, aPre, _ := strings.Cut(a, "-")
+	bCore, bPre, _ := strings.Cut(b, "-")
+	as, bs := strings.Split(aCore, "."), strings.Split(bCore, ".")
+	for i := 0; i < max(len(as), len(bs)); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	case aPre < bPre:
+		return -1
+	}
+	return 1
+}
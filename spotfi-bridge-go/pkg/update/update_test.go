@@ -0,0 +1,98 @@
+package update
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2.1.0", "2.1.0", 0},
+		{"v2.1.0", "2.1.0", 0},
+		{"2.1", "2.1.0", 0},
+		{"2.1.0", "2.10.3", -1},
+		{"2.10.0", "2.9.9", 1},
+		{"3.0.0", "2.99.99", 1},
+		{"2.1.0-beta.1", "2.1.0", -1},
+		{"2.1.0", "2.1.0-rc.1", 1},
+		{"2.1.0-beta.1", "2.1.0-rc.1", -1},
+		{"2.1.0-rc.1", "2.1.0-rc.1", 0},
+		{"2.1.1-beta.1", "2.1.0", 1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestSignedMessage(t *testing.T) {
+	got := string(SignedMessage("2.1.0", "arm64", "ABCDEF"))
+	if want := "spotfi-bridge\n2.1.0\narm64\nabcdef"; got != want {
+		t.Errorf("SignedMessage = %q, want %q", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("new bridge binary")
+	path := filepath.Join(t.TempDir(), "spotfi-bridge.new")
+	if err := os.WriteFile(path, content, 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(content)
+	sum := hex.EncodeToString(h[:])
+	sign := func(key ed25519.PrivateKey, version, arch string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedMessage(version, arch, sum)))
+	}
+
+	tests := []struct {
+		name    string
+		bin     Binary
+		wantErr string
+	}{
+		{"valid", Binary{SHA256: sum, Signature: sign(priv, "2.1.0", runtime.GOARCH)}, ""},
+		{"upper case checksum", Binary{SHA256: strings.ToUpper(sum), Signature: sign(priv, "2.1.0", runtime.GOARCH)}, ""},
+		{"checksum mismatch", Binary{SHA256: strings.Repeat("0", 64), Signature: sign(priv, "2.1.0", runtime.GOARCH)}, "checksum mismatch"},
+		{"other key", Binary{SHA256: sum, Signature: sign(otherPriv, "2.1.0", runtime.GOARCH)}, "signature is invalid"},
+		{"other version", Binary{SHA256: sum, Signature: sign(priv, "2.0.0", runtime.GOARCH)}, "signature is invalid"},
+		{"other arch", Binary{SHA256: sum, Signature: sign(priv, "2.1.0", "not-"+runtime.GOARCH)}, "signature is invalid"},
+		{"bad encoding", Binary{SHA256: sum, Signature: "not base64!"}, "signature is invalid"},
+		{"unsigned", Binary{SHA256: sum}, "signature is invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verify(pub, "2.1.0", tt.bin, path)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("verify = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("verify = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := verify(pub, "2.1.0", Binary{SHA256: sum}, filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("verify of a missing file = %v, want not exist", err)
+	}
+}
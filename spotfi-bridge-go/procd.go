@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"spotfi-bridge/pkg/crash"
+	"spotfi-bridge/pkg/metrics"
+	"spotfi-bridge/pkg/rpc"
+	"spotfi-bridge/pkg/ubus"
+)
+
+const (
+	// initScript is the procd init script written by --install
+	initScript = "/etc/init.d/spotfi-bridge"
+
+	// procdService and procdInstance name the bridge in procd, for the watchdog
+	procdService  = "spotfi-bridge"
+	procdInstance = "bridge"
+
+	// rpcdPluginDir holds rpcd exec plugins; --install links the binary in as spotfi.bridge
+	rpcdPluginDir = "/usr/libexec/rpcd"
+
+	// defaultWatchdogTimeout applies when SPOTFI_WATCHDOG is not set
+	defaultWatchdogTimeout = 60 * time.Second
+)
+
+// initScriptTemplate is filled in with the binary path. Configuration is read by the
+// bridge itself, so procd only restarts it when the files change on reload
+const initScriptTemplate = `#!/bin/sh /etc/rc.common
+# Written by spotfi-bridge --install
+
+START=99
+STOP=10
+
+USE_PROCD=1
+PROG=%s
+
+start_service() {
+	[ -x "$PROG" ] || {
+		logger -t spotfi-bridge "Error: $PROG is missing"
+		return 1
+	}
+
+	procd_open_instance %s
+	procd_set_param command "$PROG"
+	procd_set_param respawn ${respawn_threshold:-3600} ${respawn_timeout:-5} ${respawn_retry:-5}
+	procd_set_param term_timeout 15
+	procd_set_param file /etc/config/spotfi /etc/spotfi.env /etc/spotfi/config.yaml
+	procd_set_param stdout 1
+	procd_set_param stderr 1
+	procd_close_instance
+}
+
+service_triggers() {
+	procd_add_reload_trigger spotfi
+}
+`
+
+// install writes the procd init script for the running binary, enables the service
+// and links the binary in as the spotfi.bridge rpcd plugin
+func install() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	script := fmt.Sprintf(initScriptTemplate, exe, procdInstance)
+	if err := os.WriteFile(initScript+".tmp", []byte(script), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(initScript+".tmp", initScript); err != nil {
+		os.Remove(initScript + ".tmp")
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Wrote %s\n", initScript)
+
+	if out, err := exec.Command(initScript, "enable").CombinedOutput(); err != nil {
+		return fmt.Errorf("%s enable: %v: %s", initScript, err, strings.TrimSpace(string(out)))
+	}
+	fmt.Fprintf(os.Stdout, "Enabled %s at boot\n", procdService)
+
+	if _, err := os.Stat(rpcdPluginDir); err != nil {
+		fmt.Fprintf(os.Stdout, "Skipped the ubus object: %s not found\n", rpcdPluginDir)
+		return nil
+	}
+	plugin := filepath.Join(rpcdPluginDir, rpcdObject)
+	os.Remove(plugin) // An older link
+	if err := os.Symlink(exe, plugin); err != nil {
+		return err
+	}
+	exec.Command("/etc/init.d/rpcd", "reload").Run()
+	fmt.Fprintf(os.Stdout, "Linked %s (ubus object %s)\n", plugin, rpcdObject)
+	return nil
+}
+
+// startWatchdog arms procd's instance watchdog and, until ctx is cancelled, keeps pinging
+// it while the bridge is alive, so procd kills and respawns a wedged bridge after timeout.
+// It does nothing unless this process is the instance started by the --install init script
+func startWatchdog(ctx context.Context, timeout time.Duration) {
+	if timeout < 0 {
+		return
+	}
+	if timeout == 0 {
+		timeout = defaultWatchdogTimeout
+	}
+	if err := checkProcdInstance(); err != nil {
+		logger.Info("Not using the procd watchdog", "reason", err)
+		return
+	}
+	args := map[string]interface{}{
+		"name":     procdService,
+		"instance": procdInstance,
+		"mode":     1,
+		"timeout":  int(timeout.Seconds()),
+	}
+	if _, err := ubus.Call("service", "watchdog", args); err != nil {
+		logger.Warn("Failed to arm the procd watchdog", "error", err)
+		return
+	}
+	logger.Info("Armed the procd watchdog", "timeout", timeout)
+
+	ping := map[string]interface{}{"name": procdService, "instance": procdInstance}
+	go func() {
+		defer crash.Recover("watchdog")
+		ticker := time.NewTicker(timeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if reason := wedged(timeout / 2); reason != "" {
+				// No ping: procd restarts the bridge once the timeout passes
+				logger.Error("Bridge unresponsive, not pinging the procd watchdog", "reason", reason)
+				continue
+			}
+			if _, err := ubus.Call("service", "watchdog", ping); err != nil {
+				logger.Warn("Failed to ping the procd watchdog", "error", err)
+			}
+		}
+	}()
+}
+
+// checkProcdInstance fails unless procd runs this process as the spotfi-bridge
+// instance, e.g. when started by hand or by an older init script
+func checkProcdInstance() error {
+	list, err := ubus.Call("service", "list", map[string]interface{}{"name": procdService})
+	if err != nil {
+		return err
+	}
+	svc, _ := list[procdService].(map[string]interface{})
+	instances, _ := svc["instances"].(map[string]interface{})
+	inst, ok := instances[procdInstance].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("no procd instance %s/%s, run spotfi-bridge --install", procdService, procdInstance)
+	}
+	if pid, _ := inst["pid"].(float64); int(pid) != os.Getpid() {
+		return fmt.Errorf("procd instance %s/%s is another process (pid %d)", procdService, procdInstance, int(pid))
+	}
+	return nil
+}
+
+// loopBeat is when the metrics loop last ran (Unix seconds), checked by the watchdog
+var loopBeat atomic.Int64
+
+// wedged returns why the bridge looks stuck, or "" when it is alive: the metrics loop
+// must have run recently and the shared state must be lockable within wait
+func wedged(wait time.Duration) string {
+	if cfg.Metrics {
+		if beat := loopBeat.Load(); beat > 0 {
+			// Two missed ticks, plus the time a slow collection may take
+			since := time.Since(time.Unix(beat, 0))
+			if since-2*metrics.Interval() > wait {
+				return fmt.Sprintf("metrics loop stalled for %s", since.Round(time.Second))
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// Each takes the lock of its subsystem
+		if sm != nil {
+			sm.Count()
+		}
+		if mqttClient != nil {
+			mqttClient.Stats()
+		}
+		rpc.Stats()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return ""
+	case <-time.After(wait):
+		return "session, MQTT or RPC state locked"
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"spotfi-bridge/pkg/mqtt"
+	"spotfi-bridge/pkg/rpc"
+)
+
+// selfTestTimeout bounds every network step of --test
+const selfTestTimeout = 10 * time.Second
+
+// selfTest validates the loaded configuration and checks that the broker is reachable,
+// accepts the router's credentials and that ubus works, printing one line per check.
+// It returns false when any check failed
+func selfTest() bool {
+	ok := true
+	check := func(name string, err error, detail string) bool {
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "[FAIL] %s: %v\n", name, err)
+			ok = false
+			return false
+		}
+		fmt.Fprintf(os.Stdout, "[ OK ] %s%s\n", name, detail)
+		return true
+	}
+
+	// Required fields
+	var idErr, tokenErr error
+	if cfg.RouterID == "" {
+		idErr = fmt.Errorf("SPOTFI_ROUTER_ID not set")
+	}
+	if cfg.Token == "" {
+		tokenErr = fmt.Errorf("SPOTFI_TOKEN not set")
+	}
+	check("router ID", idErr, ": "+cfg.RouterID)
+	check("token", tokenErr, "")
+
+	signingKey := cfg.RPCSigningKey
+	var keyErr error
+	if cfg.RPCSigningKeyFile != "" {
+		var data []byte
+		if data, keyErr = os.ReadFile(cfg.RPCSigningKeyFile); keyErr == nil {
+			signingKey = string(data)
+		}
+	}
+	if keyErr == nil {
+		_, keyErr = rpc.ParseSigningKey(cfg.RPCSigning, signingKey)
+	}
+	check("RPC signing", keyErr, "")
+
+	// Broker: URL, DNS, TCP/TLS and MQTT authentication, each depending on the last
+	brokerURL := cfg.MQTTBroker
+	if brokerURL == "" {
+		brokerURL = defaultBrokerURL
+	}
+	u, host, port, err := parseBrokerURL(brokerURL)
+	if check("broker URL", err, ": "+brokerURL) {
+		ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+		resolver := &net.Resolver{PreferGo: true}
+		addrs, err := resolver.LookupHost(ctx, host)
+		cancel()
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no addresses for %s", host)
+		}
+		if check("resolve "+host, err, ": "+strings.Join(addrs, ", ")) && checkBrokerConnection(check, u, host, port) &&
+			idErr == nil && tokenErr == nil {
+			// A distinct client ID, so a running bridge is not disconnected by the broker
+			err := mqtt.CheckAuth(brokerURL, fmt.Sprintf("router-%s-test", cfg.RouterID), cfg.RouterID, cfg.Token, selfTestTimeout)
+			check("MQTT authentication", err, "")
+		}
+	}
+
+	// ubus
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	out, err := exec.CommandContext(ctx, "ubus", "call", "system", "board").CombinedOutput()
+	cancel()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+	}
+	check("ubus", err, "")
+
+	return ok
+}
+
+// checkBrokerConnection opens a TCP connection to the broker and, for TLS schemes, completes the handshake
+func checkBrokerConnection(check func(string, error, string) bool, u *url.URL, host, port string) bool {
+	addr := net.JoinHostPort(host, port)
+	dialer := &net.Dialer{Timeout: selfTestTimeout, Resolver: &net.Resolver{PreferGo: true}}
+	conn, err := dialer.Dial("tcp", addr)
+	if !check("connect "+addr, err, "") {
+		return false
+	}
+	defer conn.Close()
+
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts", "tcps", "wss":
+		conn.SetDeadline(time.Now().Add(selfTestTimeout))
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		err := tlsConn.Handshake()
+		detail := ""
+		if err == nil {
+			state := tlsConn.ConnectionState()
+			detail = ": " + tls.VersionName(state.Version)
+			if len(state.PeerCertificates) > 0 {
+				detail += ", certificate " + state.PeerCertificates[0].Subject.CommonName
+			}
+		}
+		return check("TLS handshake", err, detail)
+	}
+	return true
+}
+
+// parseBrokerURL splits a broker URL into host and port, filling in the scheme's default port
+func parseBrokerURL(raw string) (*url.URL, string, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, "", "", err
+	}
+	var defaultPort string
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		defaultPort = "1883"
+	case "ssl", "tls", "mqtts", "tcps":
+		defaultPort = "8883"
+	case "ws":
+		defaultPort = "80"
+	case "wss":
+		defaultPort = "443"
+	default:
+		return nil, "", "", fmt.Errorf("unsupported scheme %q (use tcp, ssl, ws or wss)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, "", "", fmt.Errorf("missing host")
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return u, u.Hostname(), port, nil
+}